@@ -0,0 +1,106 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+// Standalone KBFS metadata, key and block server
+
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/libkbfs"
+)
+
+var bind = flag.String("bind", "localhost:8443", "address to listen on")
+var serverRoot = flag.String("server-root", "", "directory to store all server data in")
+var tlsCert = flag.String("tls-cert", "", "path to the PEM-encoded TLS certificate (chain)")
+var tlsKey = flag.String("tls-key", "", "path to the PEM-encoded TLS private key")
+var debug = flag.Bool("debug", libkbfs.BoolForString(os.Getenv("KBFS_DEBUG")), "Print debug messages")
+var version = flag.Bool("version", false, "Print version")
+
+const usageStr = `Usage:
+  kbfsserver -version
+
+To serve KBFS from a local directory:
+  kbfsserver -server-root=path/to/dir
+    -tls-cert=path/to/cert.pem -tls-key=path/to/key.pem
+    [-bind=host:port] [-debug]
+
+The metadata, key and block server protocols are all served on the
+same address, so clients should be started with both
+-mdserver=host:port and -bserver=host:port pointing at it.  Clients
+only trust the server's certificate if its CA is given to them in
+the KEYBASE_TEST_ROOT_CERT_PEM environment variable.
+
+The server can't check with the Keybase servers which devices
+belong to which users, so it trusts any client that can sign for
+the device key it claims.  Only run it on trusted networks.  Team
+TLFs are not supported.
+`
+
+func start() error {
+	flag.Parse()
+
+	if *version {
+		fmt.Printf("%s\n", libkbfs.VersionString())
+		return nil
+	}
+
+	if len(flag.Args()) > 0 {
+		fmt.Print(usageStr)
+		return fmt.Errorf("extra arguments specified")
+	}
+
+	if *serverRoot == "" || *tlsCert == "" || *tlsKey == "" {
+		fmt.Print(usageStr)
+		return fmt.Errorf("-server-root, -tls-cert and -tls-key are required")
+	}
+
+	log := logger.New("kbfsserver")
+	log.Configure("", *debug, "")
+
+	cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+	if err != nil {
+		return err
+	}
+
+	s, err := libkbfs.NewKBFSServerDir(log, *serverRoot)
+	if err != nil {
+		return err
+	}
+	defer s.Shutdown()
+
+	l, err := tls.Listen("tcp", *bind, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	})
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+		<-c
+		log.Info("Shutting down")
+		s.Shutdown()
+	}()
+
+	log.Info("Serving from %s on %s", *serverRoot, l.Addr())
+	return s.Serve(l)
+}
+
+func main() {
+	err := start()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "kbfsserver error: %v\n", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
@@ -0,0 +1,136 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+
+	"github.com/keybase/kbfs/fsrpc"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+type duEntry struct {
+	name  string
+	usage libkbfs.DiskUsage
+}
+
+type duEntries []duEntry
+type duEntriesByName struct{ duEntries }
+type duEntriesBySizeDesc struct{ duEntries }
+type duEntriesByEncodedSizeDesc struct{ duEntries }
+type duEntriesByBlocksDesc struct{ duEntries }
+
+func (d duEntries) Len() int                 { return len(d) }
+func (d duEntries) Swap(i, j int)            { d[i], d[j] = d[j], d[i] }
+func (d duEntriesByName) Less(i, j int) bool { return d.duEntries[i].name < d.duEntries[j].name }
+func (d duEntriesBySizeDesc) Less(i, j int) bool {
+	return d.duEntries[i].usage.LogicalSize > d.duEntries[j].usage.LogicalSize
+}
+func (d duEntriesByEncodedSizeDesc) Less(i, j int) bool {
+	return d.duEntries[i].usage.EncodedSize > d.duEntries[j].usage.EncodedSize
+}
+func (d duEntriesByBlocksDesc) Less(i, j int) bool {
+	return d.duEntries[i].usage.Blocks > d.duEntries[j].usage.Blocks
+}
+
+// sortDuEntries sorts the given entries by name, and then, stably,
+// by the given key.  All keys other than "name" sort the largest
+// entries first.
+func sortDuEntries(entries duEntries, key string) error {
+	sort.Sort(duEntriesByName{entries})
+	switch key {
+	case "name":
+	case "size":
+		sort.Stable(duEntriesBySizeDesc{entries})
+	case "encoded":
+		sort.Stable(duEntriesByEncodedSizeDesc{entries})
+	case "blocks":
+		sort.Stable(duEntriesByBlocksDesc{entries})
+	default:
+		return fmt.Errorf("unknown sort key %q", key)
+	}
+	return nil
+}
+
+func printDuEntry(name string, usage libkbfs.DiskUsage) {
+	fmt.Printf("%d\t%d\t%d\t%s\n",
+		usage.LogicalSize, usage.EncodedSize, usage.Blocks, name)
+}
+
+func duDir(ctx context.Context, config libkbfs.Config,
+	dirPathStr string, sortKey string, totalOnly bool) error {
+	p, err := fsrpc.NewPath(dirPathStr)
+	if err != nil {
+		return err
+	}
+	if p.PathType != fsrpc.TLFPathType {
+		return fmt.Errorf("%q is not in a TLF", dirPathStr)
+	}
+
+	n, de, err := p.GetNode(ctx, config)
+	if err != nil {
+		return err
+	}
+	if de.Type != libkbfs.Dir {
+		return fmt.Errorf("%q is not a directory", dirPathStr)
+	}
+	usage, err := config.KBFSOps().GetDiskUsage(ctx, n)
+	if err != nil {
+		return err
+	}
+
+	if !totalOnly {
+		entries := make(duEntries, 0, len(usage.Children))
+		for name, childUsage := range usage.Children {
+			entries = append(entries, duEntry{name, childUsage})
+		}
+		err = sortDuEntries(entries, sortKey)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			childPath, err := p.Join(entry.name)
+			if err != nil {
+				return err
+			}
+			printDuEntry(childPath.String(), entry.usage)
+		}
+	}
+	printDuEntry(p.String(), usage.Total)
+	return nil
+}
+
+func du(ctx context.Context, config libkbfs.Config, args []string) (exitStatus int) {
+	flags := flag.NewFlagSet("kbfs du", flag.ContinueOnError)
+	sortKey := flags.String("s", "name", "Sort the children by \"name\", \"size\", \"encoded\" (size) or \"blocks\".")
+	totalOnly := flags.Bool("t", false, "Only print the total for each directory.")
+	err := flags.Parse(args)
+	if err != nil {
+		printError("du", err)
+		return 1
+	}
+
+	dirPaths := flags.Args()
+	if len(dirPaths) == 0 {
+		printError("du", errAtLeastOnePath)
+		return 1
+	}
+
+	for i, dirPath := range dirPaths {
+		if i > 0 && !*totalOnly {
+			fmt.Print("\n")
+		}
+		err := duDir(ctx, config, dirPath, *sortKey, *totalOnly)
+		if err != nil {
+			printError("du", err)
+			return 1
+		}
+	}
+
+	return 0
+}
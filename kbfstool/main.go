@@ -40,6 +40,8 @@ The possible commands are:
   mkdir		Make directories
   read		Dump file to stdout
   write		Write stdin to file
+  search	Search the names and contents of files
+  du		Display the disk usage of directories
   md            Operate on metadata objects
 
 `
@@ -74,6 +76,9 @@ func realMain() (exitStatus int) {
 	// Turn these off to not interfere with a running kbfs daemon.
 	kbfsParams.EnableJournal = false
 	kbfsParams.EnableDiskCache = false
+	// The search index can't be shared with a running kbfs daemon
+	// either, so only open it when it's needed.
+	kbfsParams.EnableSearchIndex = flag.Arg(0) == "search"
 
 	ctx := context.Background()
 	config, err := libkbfs.Init(ctx, kbCtx, *kbfsParams, nil, nil, log)
@@ -102,6 +107,10 @@ func realMain() (exitStatus int) {
 		return read(ctx, config, args)
 	case "write":
 		return write(ctx, config, args)
+	case "search":
+		return search(ctx, config, args)
+	case "du":
+		return du(ctx, config, args)
 	case "md":
 		return mdMain(ctx, config, args)
 	default:
@@ -43,6 +43,14 @@ func checkDirBlock(ctx context.Context, config libkbfs.Config,
 		return err
 	}
 
+	if dirBlock.IsInd {
+		for _, iptr := range dirBlock.IPtrs {
+			_ = checkDirBlock(
+				ctx, config, name, kmd, iptr.BlockInfo, verbose)
+		}
+		return nil
+	}
+
 	for entryName, entry := range dirBlock.Children {
 		switch entry.Type {
 		case libkbfs.File, libkbfs.Exec:
@@ -0,0 +1,88 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/keybase/kbfs/fsrpc"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+var errNoSearchIndex = errors.New(
+	"couldn't open the search index; is another KBFS process using it?")
+
+func searchTlfPath(ctx context.Context, config libkbfs.Config,
+	pathStr string, query string, maxResults int, longFormat bool) error {
+	p, err := fsrpc.NewPath(pathStr)
+	if err != nil {
+		return err
+	}
+	if p.PathType != fsrpc.TLFPathType {
+		return fmt.Errorf("%q is not in a TLF", pathStr)
+	}
+
+	index := config.SearchIndex()
+	if index == nil {
+		return errNoSearchIndex
+	}
+	h, err := fsrpc.ParseTlfHandle(ctx, config.KBPKI(), p.TLFName, p.TLFType)
+	if err != nil {
+		return err
+	}
+	results, err := index.Search(
+		ctx, h, strings.Join(p.TLFComponents, "/"), query, maxResults)
+	if err != nil {
+		return err
+	}
+
+	tlfPath := fsrpc.Path{
+		PathType: fsrpc.TLFPathType,
+		TLFType:  p.TLFType,
+		TLFName:  p.TLFName,
+	}
+	for _, result := range results {
+		resultPath := tlfPath.String() + "/" + result.Path
+		if longFormat {
+			fmt.Printf("%s\t%d\t%s\t%s\n", computeModeStr(result.Type),
+				result.Size, time.Unix(0, result.Mtime).Format(time.Stamp),
+				resultPath)
+		} else {
+			fmt.Println(resultPath)
+		}
+	}
+	return nil
+}
+
+func search(ctx context.Context, config libkbfs.Config, args []string) (exitStatus int) {
+	flags := flag.NewFlagSet("kbfs search", flag.ContinueOnError)
+	maxResults := flags.Int("n", 0, "Print at most this many results, or all of them if 0.")
+	longFormat := flags.Bool("l", false, "Use a long listing format.")
+	err := flags.Parse(args)
+	if err != nil {
+		printError("search", err)
+		return 1
+	}
+
+	if flags.NArg() < 2 {
+		printError("search", errors.New(
+			"a path and at least one word to search for must be specified"))
+		return 1
+	}
+
+	err = searchTlfPath(ctx, config, flags.Arg(0),
+		strings.Join(flags.Args()[1:], " "), *maxResults, *longFormat)
+	if err != nil {
+		printError("search", err)
+		return 1
+	}
+
+	return 0
+}
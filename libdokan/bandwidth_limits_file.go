@@ -0,0 +1,36 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libdokan
+
+import (
+	"github.com/keybase/kbfs/dokan"
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// BandwidthLimitsFile represents a write-only file where a write
+// replaces the block upload and download limits with the ones
+// written.
+type BandwidthLimitsFile struct {
+	fs *FS
+	specialWriteFile
+}
+
+// WriteFile performs writes for dokan.
+func (f *BandwidthLimitsFile) WriteFile(ctx context.Context, fi *dokan.FileInfo, bs []byte, offset int64) (n int, err error) {
+	f.fs.logEnter(ctx, "BandwidthLimitsFile WriteFile")
+	defer func() { f.fs.reportErr(ctx, libkbfs.WriteMode, err) }()
+	if len(bs) == 0 {
+		return 0, nil
+	}
+
+	err = libfs.SetBandwidthLimits(f.fs.config, bs)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(bs), nil
+}
@@ -308,6 +308,14 @@ func (d *Dir) open(ctx context.Context, oc *openContext, path []string) (dokan.F
 			return &SpecialReadFile{read: fileInfo(nmd).read, fs: d.folder.fs}, false, nil
 		}
 
+		// Every directory has a disk usage file.
+		if leaf && path[0] == libfs.DiskUsageFileName {
+			if err := oc.ReturningFileAllowed(); err != nil {
+				return nil, false, err
+			}
+			return NewDiskUsageFile(d), false, nil
+		}
+
 		newNode, de, err := d.folder.fs.config.KBFSOps().Lookup(ctx, d.node, path[0])
 
 		// If we are in the final component, check if it is a creation.
@@ -0,0 +1,38 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libdokan
+
+import (
+	"github.com/keybase/kbfs/dokan"
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// DiskCacheLimitsFile represents a write-only file where a write
+// replaces the TLF's limits on the disk block cache with the ones
+// written.
+type DiskCacheLimitsFile struct {
+	specialWriteFile
+	folder *Folder
+}
+
+// WriteFile implements writes for dokan.
+func (f *DiskCacheLimitsFile) WriteFile(ctx context.Context,
+	fi *dokan.FileInfo, bs []byte, offset int64) (n int, err error) {
+	f.folder.fs.logEnter(ctx, "DiskCacheLimitsFile WriteFile")
+	defer func() { f.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+	if len(bs) == 0 {
+		return 0, nil
+	}
+
+	err = libfs.SetDiskCacheTlfLimits(
+		f.folder.fs.config, f.folder.getFolderBranch(), bs)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(bs), nil
+}
@@ -0,0 +1,24 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libdokan
+
+import (
+	"time"
+
+	"github.com/keybase/kbfs/libfs"
+	"golang.org/x/net/context"
+)
+
+// NewDiskUsageFile returns a special read file that contains a text
+// representation of the recursive disk usage of the given directory.
+func NewDiskUsageFile(dir *Dir) *SpecialReadFile {
+	return &SpecialReadFile{
+		read: func(ctx context.Context) ([]byte, time.Time, error) {
+			return libfs.GetEncodedDiskUsage(
+				ctx, dir.folder.fs.config, dir.node)
+		},
+		fs: dir.folder.fs,
+	}
+}
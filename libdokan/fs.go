@@ -5,7 +5,6 @@
 package libdokan
 
 import (
-	"errors"
 	"os"
 	"strconv"
 	"strings"
@@ -19,6 +18,7 @@ import (
 	"github.com/keybase/kbfs/libfs"
 	"github.com/keybase/kbfs/libkbfs"
 	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
 	"golang.org/x/net/context"
 )
 
@@ -347,6 +347,8 @@ func (f *FS) open(ctx context.Context, oc *openContext, ps []string) (dokan.File
 			fs:     f,
 			enable: false,
 		})
+	case libfs.SetBandwidthLimitsFileName == ps[0]:
+		return oc.returnFileNoCleanup(&BandwidthLimitsFile{fs: f})
 
 	case ".kbfs_unmount" == ps[0]:
 		os.Exit(0)
@@ -524,10 +526,19 @@ func (f *FS) MoveFile(ctx context.Context, src dokan.File, sourceFI *dokan.FileI
 	// it is there in the first place, by its Forget
 
 	dstName := dstPath[len(dstPath)-1]
-	f.log.CDebugf(ctx, "FS MoveFile KBFSOps().Rename(ctx,%v,%v,%v,%v)", srcParent, srcName, ddst.node, dstName)
+	// The check above is racy, so make sure nothing is replaced
+	// even if the destination was created in the meantime.
+	mode := libkbfs.RenameReplace
+	if !replaceExisting {
+		mode = libkbfs.RenameNoReplace
+	}
+	f.log.CDebugf(ctx, "FS MoveFile KBFSOps().Rename(ctx,%v,%v,%v,%v,%v)", srcParent, srcName, ddst.node, dstName, mode)
 	if err := srcFolder.fs.config.KBFSOps().Rename(
-		ctx, srcParent, srcName, ddst.node, dstName); err != nil {
+		ctx, srcParent, srcName, ddst.node, dstName, mode); err != nil {
 		f.log.CDebugf(ctx, "FS MoveFile KBFSOps().Rename FAILED %v", err)
+		if _, ok := errors.Cause(err).(libkbfs.NameExistsError); ok {
+			return dokan.ErrObjectNameCollision
+		}
 		return err
 	}
 
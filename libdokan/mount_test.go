@@ -2413,6 +2413,45 @@ func TestInvalidateRenameToUncachedDir(t *testing.T) {
 
 }
 
+func TestDiskUsageFile(t *testing.T) {
+	ctx := libkbfs.BackgroundContextWithCancellationDelayer()
+	defer libkbfs.CleanupCancellationDelayer(ctx)
+	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
+	defer libkbfs.CheckConfigAndShutdown(ctx, t, config)
+	mnt, _, cancelFn := makeFS(t, ctx, config)
+	defer mnt.Close()
+	defer cancelFn()
+
+	mydir := filepath.Join(mnt.Dir, PrivateName, "jdoe", "mydir")
+	if err := ioutil.Mkdir(mydir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	myfile := filepath.Join(mydir, "myfile")
+	data := []byte("foo")
+	if err := ioutil.WriteFile(myfile, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	syncFilename(t, myfile)
+
+	buf, err := ioutil.ReadFile(
+		filepath.Join(mnt.Dir, PrivateName, "jdoe", libfs.DiskUsageFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var usage libkbfs.DirDiskUsage
+	if err := json.Unmarshal(buf, &usage); err != nil {
+		t.Fatal(err)
+	}
+	if g, e := usage.Children["mydir"].LogicalSize,
+		uint64(len(data)); g != e {
+		t.Errorf("Got logical size %d for mydir, expected %d", g, e)
+	}
+	if usage.Total.EncodedSize <= usage.Children["mydir"].EncodedSize {
+		t.Errorf("The total %d doesn't include the root dir block",
+			usage.Total.EncodedSize)
+	}
+}
+
 func TestStatusFile(t *testing.T) {
 	ctx := libkbfs.BackgroundContextWithCancellationDelayer()
 	defer libkbfs.CleanupCancellationDelayer(ctx)
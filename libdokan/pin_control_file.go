@@ -0,0 +1,41 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libdokan
+
+import (
+	"fmt"
+
+	"github.com/keybase/kbfs/dokan"
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// PinControlFile is a special file used to pin or unpin the path
+// written to it.
+type PinControlFile struct {
+	specialWriteFile
+	folder *Folder
+	action libfs.PinAction
+}
+
+// WriteFile implements writes for dokan.
+func (f *PinControlFile) WriteFile(ctx context.Context,
+	fi *dokan.FileInfo, bs []byte, offset int64) (n int, err error) {
+	f.folder.fs.logEnter(ctx,
+		fmt.Sprintf("PinControlFile (f.action=%s) Write", f.action))
+	defer func() { f.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+	if len(bs) == 0 {
+		return 0, nil
+	}
+
+	err = f.action.Execute(
+		ctx, f.folder.fs.config, f.folder.getFolderBranch(), bs)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(bs), nil
+}
@@ -23,6 +23,9 @@ func handleTLFSpecialFile(name string, folder *Folder) dokan.File {
 	case libfs.EditHistoryName:
 		return NewTlfEditHistoryFile(folder)
 
+	case libfs.ConflictsFileName:
+		return NewConflictsFile(folder)
+
 	case libfs.UnstageFileName:
 		return &UnstageFile{
 			folder: folder,
@@ -84,6 +87,18 @@ func handleTLFSpecialFile(name string, folder *Folder) dokan.File {
 			action: libfs.JournalDisable,
 		}
 
+	case libfs.ExportJournalBundleFileName:
+		return &JournalBundleControlFile{
+			folder: folder,
+			action: libfs.JournalBundleExport,
+		}
+
+	case libfs.ImportJournalBundleFileName:
+		return &JournalBundleControlFile{
+			folder: folder,
+			action: libfs.JournalBundleImport,
+		}
+
 	case libfs.EnableSyncFileName:
 		return &SyncControlFile{
 			folder: folder,
@@ -95,6 +110,53 @@ func handleTLFSpecialFile(name string, folder *Folder) dokan.File {
 			folder: folder,
 			action: libfs.SyncDisable,
 		}
+
+	case libfs.EnableManualConflictResolutionFileName:
+		return &ConflictControlFile{
+			folder: folder,
+			action: libfs.ConflictManualEnable,
+		}
+
+	case libfs.DisableManualConflictResolutionFileName:
+		return &ConflictControlFile{
+			folder: folder,
+			action: libfs.ConflictManualDisable,
+		}
+
+	case libfs.ResolveUnmergedFileName:
+		return &ConflictControlFile{
+			folder: folder,
+			action: libfs.ConflictResolveAutomatically,
+		}
+
+	case libfs.AcceptLocalFileName:
+		return &ConflictControlFile{
+			folder: folder,
+			action: libfs.ConflictAcceptLocal,
+		}
+
+	case libfs.AcceptRemoteFileName:
+		return &ConflictControlFile{
+			folder: folder,
+			action: libfs.ConflictAcceptRemote,
+		}
+
+	case libfs.SetDiskCacheLimitsFileName:
+		return &DiskCacheLimitsFile{
+			folder: folder,
+		}
+
+	case libfs.PinFileName:
+		return &PinControlFile{
+			folder: folder,
+			action: libfs.PinAdd,
+		}
+
+	case libfs.UnpinFileName:
+		return &PinControlFile{
+			folder: folder,
+			action: libfs.PinRemove,
+		}
 	}
 
 	return nil
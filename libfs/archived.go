@@ -0,0 +1,65 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfs
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// ParseArchivedDirName returns the revision named by an entry of
+// ArchivedDirName (e.g., "rev=5"), and true if the name is valid.
+func ParseArchivedDirName(name string) (kbfsmd.Revision, bool) {
+	if !strings.HasPrefix(name, ArchivedRevDirPrefix) {
+		return kbfsmd.RevisionUninitialized, false
+	}
+	i, err := strconv.ParseInt(name[len(ArchivedRevDirPrefix):], 10, 64)
+	if err != nil || i < int64(kbfsmd.RevisionInitial) {
+		return kbfsmd.RevisionUninitialized, false
+	}
+	return kbfsmd.Revision(i), true
+}
+
+// ParseArchivedTimeDirName returns the time named by an entry of
+// ArchivedDirName (e.g., "time=2017-10-16T11:00:00Z"), and true if
+// the name is valid.
+func ParseArchivedTimeDirName(name string) (time.Time, bool) {
+	if !strings.HasPrefix(name, ArchivedTimeDirPrefix) {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339, name[len(ArchivedTimeDirPrefix):])
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// GetArchivedRootNode returns the read-only root node of the TLF
+// given by `h`, as named by the ArchivedDirName entry `name`.  It
+// returns a libkbfs.NoSuchNameError if `name` doesn't name a valid
+// archived view.
+func GetArchivedRootNode(
+	ctx context.Context, config libkbfs.Config, h *libkbfs.TlfHandle,
+	name string) (libkbfs.Node, libkbfs.EntryInfo, error) {
+	rev, ok := ParseArchivedDirName(name)
+	if !ok {
+		t, ok := ParseArchivedTimeDirName(name)
+		if !ok {
+			return nil, libkbfs.EntryInfo{},
+				libkbfs.NoSuchNameError{Name: name}
+		}
+		var err error
+		rev, err = config.KBFSOps().GetRevisionForTime(ctx, h, t)
+		if err != nil {
+			return nil, libkbfs.EntryInfo{}, err
+		}
+	}
+	return config.KBFSOps().GetArchivedRootNode(ctx, h, rev)
+}
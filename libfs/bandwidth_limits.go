@@ -0,0 +1,24 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfs
+
+import (
+	"strings"
+
+	"github.com/keybase/kbfs/libkbfs"
+)
+
+// SetBandwidthLimits parses `data` in the format accepted by
+// libkbfs.ParseBandwidthLimits, and puts the resulting limits into
+// effect.  Empty data lifts all limits.
+func SetBandwidthLimits(config libkbfs.Config, data []byte) error {
+	limits, err := libkbfs.ParseBandwidthLimits(
+		strings.TrimSpace(string(data)))
+	if err != nil {
+		return err
+	}
+	config.BandwidthLimiter().SetLimits(limits)
+	return nil
+}
@@ -0,0 +1,84 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfs
+
+import (
+	"fmt"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// ConflictAction enumerates all the possible actions to take on a
+// TLF's conflict resolution mode, or on its local changes that were
+// set aside for manual resolution.
+type ConflictAction int
+
+const (
+	// ConflictManualEnable is to set aside conflicting local changes
+	// for manual resolution.
+	ConflictManualEnable ConflictAction = iota
+	// ConflictManualDisable is to resolve future conflicts
+	// automatically.
+	ConflictManualDisable
+	// ConflictResolveAutomatically is to resolve the local changes
+	// that were set aside with the usual rules.
+	ConflictResolveAutomatically
+	// ConflictAcceptLocal is to resolve the local changes that were
+	// set aside in their favor.
+	ConflictAcceptLocal
+	// ConflictAcceptRemote is to throw away the local changes that
+	// were set aside.
+	ConflictAcceptRemote
+)
+
+func (a ConflictAction) String() string {
+	switch a {
+	case ConflictManualEnable:
+		return "Enable manual conflict resolution"
+	case ConflictManualDisable:
+		return "Disable manual conflict resolution"
+	case ConflictResolveAutomatically:
+		return "Resolve unmerged changes automatically"
+	case ConflictAcceptLocal:
+		return "Accept local changes"
+	case ConflictAcceptRemote:
+		return "Accept remote changes"
+	}
+	return fmt.Sprintf("ConflictAction(%d)", int(a))
+}
+
+// Execute performs the action on the given TLF.
+func (a ConflictAction) Execute(
+	ctx context.Context, c libkbfs.Config, fb libkbfs.FolderBranch) error {
+	if fb == (libkbfs.FolderBranch{}) {
+		panic("zero fb in ConflictAction.Execute")
+	}
+
+	switch a {
+	case ConflictManualEnable:
+		return c.SetManualConflictResolution(fb.Tlf, true)
+
+	case ConflictManualDisable:
+		// Any changes that were already set aside still need to be
+		// resolved explicitly.
+		return c.SetManualConflictResolution(fb.Tlf, false)
+
+	case ConflictResolveAutomatically:
+		return c.KBFSOps().ResolveUnmerged(
+			ctx, fb, libkbfs.ResolveAutomatically)
+
+	case ConflictAcceptLocal:
+		return c.KBFSOps().ResolveUnmerged(
+			ctx, fb, libkbfs.ResolveAcceptLocal)
+
+	case ConflictAcceptRemote:
+		return c.KBFSOps().ResolveUnmerged(
+			ctx, fb, libkbfs.ResolveAcceptRemote)
+
+	default:
+		return fmt.Errorf("Unknown action %s", a)
+	}
+}
@@ -0,0 +1,30 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfs
+
+import (
+	"time"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// GetEncodedConflicts returns serialized JSON containing the most
+// recent decisions made by conflict resolution in a folder.
+func GetEncodedConflicts(ctx context.Context, config libkbfs.Config,
+	folderBranch libkbfs.FolderBranch) (
+	data []byte, t time.Time, err error) {
+	status, _, err := config.KBFSOps().FolderStatus(ctx, folderBranch)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	conflicts := status.Conflicts
+	if conflicts == nil {
+		conflicts = []libkbfs.ConflictRecord{}
+	}
+	data, err = PrettyJSON(conflicts)
+	return data, time.Time{}, err
+}
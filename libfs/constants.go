@@ -61,6 +61,16 @@ const ResumeJournalBackgroundWorkFileName = ".kbfs_resume_journal_background_wor
 // file. It can be reached anywhere within a top-level folder.
 const DisableJournalFileName = ".kbfs_disable_journal"
 
+// ExportJournalBundleFileName is the name of the file that exports
+// the unflushed journal of a TLF to the bundle file whose path is
+// written to it. It can be reached anywhere within a top-level folder.
+const ExportJournalBundleFileName = ".kbfs_export_journal_bundle"
+
+// ImportJournalBundleFileName is the name of the file that imports
+// and flushes the journal bundle whose path is written to it. It can
+// be reached anywhere within a top-level folder.
+const ImportJournalBundleFileName = ".kbfs_import_journal_bundle"
+
 // EnableAutoJournalsFileName is the name of the KBFS-wide
 // auto-journal-enabling file.  It's accessible anywhere outside a TLF.
 const EnableAutoJournalsFileName = ".kbfs_enable_auto_journals"
@@ -104,3 +114,112 @@ const EnableSyncFileName = ".kbfs_enable_sync"
 // DisableSyncFileName is the name of the file to disable the sync cache for a
 // TLF. It can be reached anywhere within a TLF.
 const DisableSyncFileName = ".kbfs_disable_sync"
+
+// ArchivedDirName is the name of the directory containing read-only
+// views of past revisions of a TLF -- it can be reached at the root
+// of any top-level folder.
+const ArchivedDirName = ".kbfs_archived"
+
+// ArchivedRevDirPrefix is the prefix of the entries within
+// ArchivedDirName that name a specific revision, e.g. "rev=5".
+const ArchivedRevDirPrefix = "rev="
+
+// ArchivedTimeDirPrefix is the prefix of the entries within
+// ArchivedDirName that name the latest revision written at or before
+// a given RFC3339 time, e.g. "time=2017-10-16T11:00:00Z".
+const ArchivedTimeDirPrefix = "time="
+
+// DeletedDirName is the name of the directory listing the entries
+// recently removed from a TLF -- it can be reached at the root of any
+// top-level folder.  Renaming one of its entries into the TLF
+// restores it.
+const DeletedDirName = ".kbfs_deleted"
+
+// DeletedEntryRevSeparator separates the escaped path of a removed
+// entry from the revision that removed it, within the names of the
+// entries of DeletedDirName, e.g. "a%2Fb@rev=5".
+const DeletedEntryRevSeparator = "@rev="
+
+// SetTrashRetentionFileName is the name of the file that sets how
+// long entries removed from a TLF stay in DeletedDirName to the
+// duration written to it, e.g. "168h" (see
+// libkbfs.KBFSOps.SetTrashRetention) -- it can be reached at the
+// root of any top-level folder.
+const SetTrashRetentionFileName = ".kbfs_set_trash_retention"
+
+// VersionsDirName is the name of the directory containing the
+// recent versions of the files in a directory -- it can be reached
+// in any directory of a top-level folder, and contains one
+// subdirectory per file.  Renaming a version onto its file restores
+// it.
+const VersionsDirName = ".kbfs_versions"
+
+// FileVersionPrefix is the prefix of the entries within the
+// subdirectories of VersionsDirName, which name the revision that
+// wrote each version, e.g. "rev=5".
+const FileVersionPrefix = "rev="
+
+// DiskUsageFileName is the name of the KBFS disk usage file -- it can
+// be reached in any directory of a top-level folder, and reports the
+// recursive disk usage of that directory and of each of its children.
+const DiskUsageFileName = ".kbfs_du"
+
+// ConflictsFileName is the name of the KBFS conflict report file --
+// it can be reached anywhere within a top-level folder, and lists
+// the most recent entries renamed or merged by conflict resolution.
+const ConflictsFileName = ".kbfs_conflicts"
+
+// UnmergedDirName is the name of the directory holding a read-only
+// view of the local changes of a TLF that were set aside for manual
+// conflict resolution -- it can be reached at the root of any
+// top-level folder, while there are such changes.
+const UnmergedDirName = ".kbfs_unmerged"
+
+// EnableManualConflictResolutionFileName is the name of the file to
+// set aside a TLF's conflicting local changes for manual resolution,
+// instead of resolving them automatically. It can be reached
+// anywhere within a TLF.
+const EnableManualConflictResolutionFileName = ".kbfs_enable_manual_cr"
+
+// DisableManualConflictResolutionFileName is the name of the file to
+// go back to resolving a TLF's conflicts automatically. It can be
+// reached anywhere within a TLF.
+const DisableManualConflictResolutionFileName = ".kbfs_disable_manual_cr"
+
+// ResolveUnmergedFileName is the name of the file to resolve the
+// changes in UnmergedDirName automatically. It can be reached
+// anywhere within a TLF.
+const ResolveUnmergedFileName = ".kbfs_resolve_unmerged"
+
+// AcceptLocalFileName is the name of the file to resolve the changes
+// in UnmergedDirName in favor of the local versions of any
+// conflicting files. It can be reached anywhere within a TLF.
+const AcceptLocalFileName = ".kbfs_accept_local"
+
+// AcceptRemoteFileName is the name of the file to throw away the
+// changes in UnmergedDirName. It can be reached anywhere within a
+// TLF.
+const AcceptRemoteFileName = ".kbfs_accept_remote"
+
+// SetBandwidthLimitsFileName is the name of the KBFS-wide file that
+// replaces the block upload and download limits with whatever is
+// written to it (see libkbfs.ParseBandwidthLimits).  It's accessible
+// anywhere outside a TLF.
+const SetBandwidthLimitsFileName = ".kbfs_set_bandwidth_limits"
+
+// SetDiskCacheLimitsFileName is the name of the file that replaces a
+// TLF's limits on the working set disk block cache with whatever is
+// written to it (see libkbfs.ParseDiskCacheTlfLimits). It can be
+// reached anywhere within a TLF.
+const SetDiskCacheLimitsFileName = ".kbfs_set_disk_cache_limits"
+
+// PinFileName is the name of the file that keeps the path written to
+// it, relative to the root of the TLF, available offline.  The
+// progress of each pin is reported in the TLF's StatusFileName.  It
+// can be reached anywhere within a TLF.
+const PinFileName = ".kbfs_pin"
+
+// UnpinFileName is the name of the file that stops keeping the path
+// written to it, relative to the root of the TLF, available offline.
+// It can be reached anywhere within a TLF.
+const UnpinFileName = ".kbfs_unpin"
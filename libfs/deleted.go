@@ -0,0 +1,79 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfs
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+var deletedPathEscaper = strings.NewReplacer("%", "%25", "/", "%2F")
+
+var deletedPathUnescaper = strings.NewReplacer("%2F", "/", "%25", "%")
+
+// DeletedEntryName returns the name of the given removed entry
+// within DeletedDirName.  It names both the full path of the entry,
+// with any slashes escaped, and the revision that removed it, so
+// that entries removed from different places, or at different
+// times, don't collide.
+func DeletedEntryName(entry libkbfs.DeletedEntry) string {
+	return deletedPathEscaper.Replace(entry.Path) +
+		DeletedEntryRevSeparator + strconv.FormatInt(
+		int64(entry.Revision), 10)
+}
+
+// ParseDeletedEntryName returns the path and revision named by an
+// entry of DeletedDirName, and true if the name is valid.
+func ParseDeletedEntryName(name string) (string, kbfsmd.Revision, bool) {
+	i := strings.LastIndex(name, DeletedEntryRevSeparator)
+	if i <= 0 {
+		return "", kbfsmd.RevisionUninitialized, false
+	}
+	rev, err := strconv.ParseInt(
+		name[i+len(DeletedEntryRevSeparator):], 10, 64)
+	if err != nil || rev < int64(kbfsmd.RevisionInitial) {
+		return "", kbfsmd.RevisionUninitialized, false
+	}
+	return deletedPathUnescaper.Replace(name[:i]), kbfsmd.Revision(rev), true
+}
+
+// DeletedEntryInfo returns the libkbfs.EntryInfo to show for the
+// given removed entry.  Its mtime is the time of the removal.
+func DeletedEntryInfo(entry libkbfs.DeletedEntry) libkbfs.EntryInfo {
+	return libkbfs.EntryInfo{
+		Type:  entry.Type,
+		Size:  entry.Size,
+		Mtime: entry.LocalTime.UnixNano(),
+		Ctime: entry.LocalTime.UnixNano(),
+	}
+}
+
+// LookupDeletedEntry returns the removed entry of the given folder
+// branch that is named by the DeletedDirName entry `name`.  It
+// returns a libkbfs.NoSuchNameError if there is no such entry, or if
+// it has already expired from the trash.
+func LookupDeletedEntry(
+	ctx context.Context, config libkbfs.Config,
+	folderBranch libkbfs.FolderBranch, name string) (
+	libkbfs.DeletedEntry, error) {
+	p, rev, ok := ParseDeletedEntryName(name)
+	if !ok {
+		return libkbfs.DeletedEntry{}, libkbfs.NoSuchNameError{Name: name}
+	}
+	entries, err := config.KBFSOps().GetDeletedEntries(ctx, folderBranch)
+	if err != nil {
+		return libkbfs.DeletedEntry{}, err
+	}
+	for _, entry := range entries {
+		if entry.Path == p && entry.Revision == rev {
+			return entry, nil
+		}
+	}
+	return libkbfs.DeletedEntry{}, libkbfs.NoSuchNameError{Name: name}
+}
@@ -0,0 +1,29 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfs
+
+import (
+	"strings"
+
+	"github.com/keybase/kbfs/libkbfs"
+)
+
+// SetDiskCacheTlfLimits parses `data` in the format accepted by
+// libkbfs.ParseDiskCacheTlfLimits, and puts the resulting limits
+// into effect for the given TLF.  Empty data resets the TLF to the
+// defaults.
+func SetDiskCacheTlfLimits(
+	config libkbfs.Config, fb libkbfs.FolderBranch, data []byte) error {
+	if fb == (libkbfs.FolderBranch{}) {
+		panic("zero fb in SetDiskCacheTlfLimits")
+	}
+	limits, err := libkbfs.ParseDiskCacheTlfLimits(
+		strings.TrimSpace(string(data)))
+	if err != nil {
+		return err
+	}
+	config.SetDiskCacheTlfLimits(fb.Tlf, limits)
+	return nil
+}
@@ -0,0 +1,25 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfs
+
+import (
+	"time"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// GetEncodedDiskUsage returns serialized JSON containing the recursive
+// disk usage of the given directory, and of each of its children.
+func GetEncodedDiskUsage(ctx context.Context, config libkbfs.Config,
+	dir libkbfs.Node) (data []byte, t time.Time, err error) {
+	usage, err := config.KBFSOps().GetDiskUsage(ctx, dir)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	data, err = PrettyJSON(usage)
+	return data, time.Time{}, err
+}
@@ -5,8 +5,11 @@
 package libfs
 
 import (
+	"context"
 	"io"
 	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/keybase/kbfs/libkbfs"
 	"github.com/pkg/errors"
@@ -21,10 +24,22 @@ type File struct {
 	node     libkbfs.Node
 	readOnly bool
 	offset   int64
+	// Identifies this file's path locks, separately from those of
+	// any other open file.
+	lockOwner libkbfs.PathLockOwner
+	// Set to 1 while this file holds a path lock.
+	locked int32
 }
 
 var _ billy.File = (*File)(nil)
 
+// lastLockOwner is the most recently assigned path lock owner ID.
+var lastLockOwner uint64
+
+func nextLockOwner() libkbfs.PathLockOwner {
+	return libkbfs.PathLockOwner(atomic.AddUint64(&lastLockOwner, 1))
+}
+
 // Name implements the billy.File interface for File.
 func (f *File) Name() string {
 	return f.filename
@@ -54,13 +69,20 @@ func (f *File) Write(p []byte) (n int, err error) {
 	return len(p), nil
 }
 
+// readCtx returns the context for reads through this file, so that
+// read-ahead follows its access pattern separately from any other
+// open file.
+func (f *File) readCtx() context.Context {
+	return context.WithValue(f.fs.ctx, libkbfs.CtxReadHandleKey, f.lockOwner)
+}
+
 // Read implements the billy.File interface for File.
 func (f *File) Read(p []byte) (n int, err error) {
 	f.fs.log.CDebugf(f.fs.ctx, "Read %d bytes at current offset", len(p))
 
 	origOffset := atomic.LoadInt64(&f.offset)
 	readBytes, err := f.fs.config.KBFSOps().Read(
-		f.fs.ctx, f.node, p, origOffset)
+		f.readCtx(), f.node, p, origOffset)
 	if err != nil {
 		return 0, err
 	}
@@ -78,7 +100,7 @@ func (f *File) ReadAt(p []byte, off int64) (n int, err error) {
 	f.fs.log.CDebugf(f.fs.ctx, "Read %d bytes at offset %d", len(p), off)
 
 	// ReadAt doesn't affect the underlying offset.
-	readBytes, err := f.fs.config.KBFSOps().Read(f.fs.ctx, f.node, p, off)
+	readBytes, err := f.fs.config.KBFSOps().Read(f.readCtx(), f.node, p, off)
 	if err != nil {
 		return 0, err
 	}
@@ -90,7 +112,61 @@ func (f *File) ReadAt(p []byte, off int64) (n int, err error) {
 	return int(readBytes), nil
 }
 
-// Seek implements the billy.File interface for File.
+// These are the extra whence values accepted by Seek, with the same
+// values and meanings as on Linux.  They aren't available through
+// the FUSE mount, since the vendored FUSE library doesn't decode
+// lseek or fallocate requests; there the kernel only sees files
+// with no holes.
+const (
+	// SeekData seeks to the next offset at or after the given one
+	// that contains data.
+	SeekData = 3
+	// SeekHole seeks to the next offset at or after the given one
+	// that is in a hole, counting the end of the file as a hole.
+	SeekHole = 4
+)
+
+// seekDataOrHole returns the offset that Seek should move to for
+// SeekData or SeekHole.  Like lseek(2), it returns ENXIO if `offset`
+// is past the end of the file, or if there's no more data.
+func (f *File) seekDataOrHole(offset int64, whence int) (int64, error) {
+	ei, err := f.fs.config.KBFSOps().Stat(f.fs.ctx, f.node)
+	if err != nil {
+		return 0, err
+	}
+	size := int64(ei.Size)
+	if offset < 0 || offset >= size {
+		return 0, syscall.ENXIO
+	}
+
+	// Only the extent that contains or follows `offset` matters.
+	extents, err := f.fs.config.KBFSOps().GetFileDataExtents(
+		f.fs.ctx, f.node, offset, 1)
+	if err != nil {
+		return 0, err
+	}
+
+	if whence == SeekData {
+		if len(extents) == 0 {
+			return 0, syscall.ENXIO
+		}
+		if extents[0].Off > offset {
+			return extents[0].Off, nil
+		}
+		return offset, nil
+	}
+
+	if len(extents) == 0 || extents[0].Off > offset {
+		return offset, nil
+	}
+	if end := extents[0].Off + extents[0].Len; end < size {
+		return end, nil
+	}
+	return size, nil
+}
+
+// Seek implements the billy.File interface for File.  In addition to
+// the standard whence values, it supports SeekData and SeekHole.
 func (f *File) Seek(offset int64, whence int) (n int64, err error) {
 	f.fs.log.CDebugf(f.fs.ctx, "Seek %d bytes (whence=%d)", offset, whence)
 	defer func() {
@@ -109,6 +185,11 @@ func (f *File) Seek(offset int64, whence int) (n int64, err error) {
 			return 0, err
 		}
 		newOffset = int64(ei.Size) + offset
+	case SeekData, SeekHole:
+		newOffset, err = f.seekDataOrHole(offset, whence)
+		if err != nil {
+			return 0, err
+		}
 	}
 	if newOffset < 0 {
 		return 0, errors.Errorf("Cannot seek to offset %d", newOffset)
@@ -118,8 +199,77 @@ func (f *File) Seek(offset int64, whence int) (n int64, err error) {
 	return newOffset, nil
 }
 
+// PunchHole replaces `length` bytes of the file, starting at `off`,
+// with zeroes that take up no space, like fallocate(2) with
+// FALLOC_FL_PUNCH_HOLE|FALLOC_FL_KEEP_SIZE.  It doesn't change the
+// size of the file, or its offset.
+func (f *File) PunchHole(off, length int64) (err error) {
+	f.fs.log.CDebugf(f.fs.ctx, "PunchHole %d bytes at offset %d",
+		length, off)
+	defer func() {
+		f.fs.deferLog.CDebugf(f.fs.ctx, "PunchHole done: %+v", err)
+	}()
+
+	if f.readOnly {
+		return errors.New("Trying to write a read-only file")
+	}
+	return f.fs.config.KBFSOps().PunchHole(f.fs.ctx, f.node, off, length)
+}
+
+// lockRetryInterval is how long Lock waits before trying again to
+// take a lock held by someone else.
+const lockRetryInterval = 1 * time.Second
+
+// Lock takes an advisory lock on this file's path, shared with all
+// other devices and users that can access the TLF.  It blocks until
+// the lock is available, or until the FS's context is canceled.
+// Different File objects for the same path exclude each other, even
+// on the same device.
+func (f *File) Lock() (err error) {
+	f.fs.log.CDebugf(f.fs.ctx, "Lock %s", f.filename)
+	defer func() {
+		f.fs.deferLog.CDebugf(f.fs.ctx, "Lock done: %+v", err)
+	}()
+
+	for {
+		err = f.fs.config.KBFSOps().LockPath(
+			f.fs.ctx, f.node, f.lockOwner)
+		if _, ok := errors.Cause(err).(libkbfs.PathLockedError); !ok {
+			break
+		}
+		f.fs.log.CDebugf(f.fs.ctx, "%s is locked; retrying in %s",
+			f.filename, lockRetryInterval)
+		select {
+		case <-time.After(lockRetryInterval):
+		case <-f.fs.ctx.Done():
+			return f.fs.ctx.Err()
+		}
+	}
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt32(&f.locked, 1)
+	return nil
+}
+
+// Unlock releases the lock taken by Lock.
+func (f *File) Unlock() (err error) {
+	f.fs.log.CDebugf(f.fs.ctx, "Unlock %s", f.filename)
+	defer func() {
+		f.fs.deferLog.CDebugf(f.fs.ctx, "Unlock done: %+v", err)
+	}()
+
+	if !atomic.CompareAndSwapInt32(&f.locked, 1, 0) {
+		return nil
+	}
+	return f.fs.config.KBFSOps().UnlockPath(
+		f.fs.ctx, f.node, f.lockOwner)
+}
+
 // Close implements the billy.File interface for File.
 func (f *File) Close() error {
+	// Don't let a lock outlive the file that took it.
+	err := f.Unlock()
 	f.node = nil
-	return nil
+	return err
 }
@@ -158,6 +158,198 @@ func followSymlink(parentPath, link string) (newPath string, err error) {
 	return newPath, nil
 }
 
+// lookupArchivedRoot returns the root node of an archived view of
+// the TLF, if the given path parts begin with an ArchivedDirName
+// entry (e.g., `.kbfs_archived/rev=5`), along with true.  Archived
+// views are only reachable from the root of a live TLF.
+func (fs *FS) lookupArchivedRoot(parts []string) (
+	libkbfs.Node, libkbfs.EntryInfo, bool, error) {
+	if fs.subdir != "" || len(parts) < 2 || parts[0] != ArchivedDirName ||
+		fs.root.GetFolderBranch().Branch != libkbfs.MasterBranch {
+		return nil, libkbfs.EntryInfo{}, false, nil
+	}
+	n, ei, err := GetArchivedRootNode(fs.ctx, fs.config, fs.h, parts[1])
+	if err != nil {
+		return nil, libkbfs.EntryInfo{}, true, err
+	}
+	return n, ei, true, nil
+}
+
+// isArchivedDir returns true if `filename` names the ArchivedDirName
+// directory itself, which has no corresponding node.
+func (fs *FS) isArchivedDir(filename string) bool {
+	return fs.subdir == "" && path.Clean(filename) == ArchivedDirName &&
+		fs.root.GetFolderBranch().Branch == libkbfs.MasterBranch
+}
+
+// isDeletedDir returns true if `filename` names the DeletedDirName
+// directory itself, which has no corresponding node.
+func (fs *FS) isDeletedDir(filename string) bool {
+	return fs.subdir == "" && path.Clean(filename) == DeletedDirName &&
+		fs.root.GetFolderBranch().Branch == libkbfs.MasterBranch
+}
+
+// lookupDeletedEntry returns the removed entry named by the given
+// path parts, if they name an entry of DeletedDirName (e.g.,
+// `.kbfs_deleted/a@rev=5`), along with true.
+func (fs *FS) lookupDeletedEntry(parts []string) (
+	libkbfs.DeletedEntry, bool, error) {
+	if len(parts) != 2 || !fs.isDeletedDir(parts[0]) {
+		return libkbfs.DeletedEntry{}, false, nil
+	}
+	entry, err := LookupDeletedEntry(
+		fs.ctx, fs.config, fs.root.GetFolderBranch(), parts[1])
+	if err != nil {
+		return libkbfs.DeletedEntry{}, true, err
+	}
+	return entry, true, nil
+}
+
+// versionsPath names VersionsDirName, or something within it, e.g.
+// `a/.kbfs_versions/f/rev=5`.
+type versionsPath struct {
+	dir     string // the directory containing VersionsDirName
+	file    string // the name of the file, if any
+	version string // the name of the file version, if any
+}
+
+// parseVersionsPath returns the parts of `filename`, along with true,
+// if it names VersionsDirName or something within it.
+func parseVersionsPath(filename string) (versionsPath, bool) {
+	parts := strings.Split(path.Clean(filename), "/")
+	for i, part := range parts {
+		if part != VersionsDirName {
+			continue
+		}
+		rest := parts[i+1:]
+		if len(rest) > 2 {
+			return versionsPath{}, false
+		}
+		vp := versionsPath{dir: path.Join(parts[:i]...)}
+		if len(rest) > 0 {
+			vp.file = rest[0]
+		}
+		if len(rest) > 1 {
+			vp.version = rest[1]
+		}
+		return vp, true
+	}
+	return versionsPath{}, false
+}
+
+// lookupDir looks up the node of the given directory, which may be
+// the root of the FS.
+func (fs *FS) lookupDir(dir string) (libkbfs.Node, error) {
+	if dir == "" || dir == "." {
+		return fs.root, nil
+	}
+	n, ei, err := fs.lookupOrCreateEntry(dir, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	if ei.Type != libkbfs.Dir {
+		return nil, errors.Errorf("%s is not a directory", dir)
+	}
+	return n, nil
+}
+
+// lookupVersionsFile looks up the file named by the given versions
+// path, which must be a file.
+func (fs *FS) lookupVersionsFile(vp versionsPath) (
+	libkbfs.Node, libkbfs.EntryInfo, error) {
+	n, ei, err := fs.lookupOrCreateEntry(
+		path.Join(vp.dir, vp.file), os.O_RDONLY, 0)
+	if err != nil {
+		return nil, libkbfs.EntryInfo{}, err
+	}
+	if !ei.Type.IsFile() {
+		return nil, libkbfs.EntryInfo{}, errors.Errorf(
+			"%s is not a file", path.Join(vp.dir, vp.file))
+	}
+	return n, ei, nil
+}
+
+// statVersionsPath returns the file info for the given versions
+// path.  The directories within VersionsDirName have no
+// corresponding nodes.
+func (fs *FS) statVersionsPath(vp versionsPath) (os.FileInfo, error) {
+	if vp.file == "" {
+		return &FileInfo{
+			fs:   fs,
+			ei:   libkbfs.EntryInfo{Type: libkbfs.Dir},
+			name: VersionsDirName,
+		}, nil
+	}
+	n, ei, err := fs.lookupVersionsFile(vp)
+	if err != nil {
+		return nil, err
+	}
+	if vp.version == "" {
+		return &FileInfo{
+			fs:   fs,
+			ei:   libkbfs.EntryInfo{Type: libkbfs.Dir},
+			name: vp.file,
+		}, nil
+	}
+	version, err := LookupFileVersion(fs.ctx, fs.config, n, vp.version)
+	if err != nil {
+		return nil, err
+	}
+	return &FileInfo{
+		fs:   fs,
+		ei:   FileVersionInfo(version, ei.Type),
+		name: vp.version,
+	}, nil
+}
+
+// readVersionsDir lists the given directory within VersionsDirName:
+// either one subdirectory per file, or the versions of one file.
+func (fs *FS) readVersionsDir(vp versionsPath) ([]os.FileInfo, error) {
+	if vp.version != "" {
+		return nil, errors.Errorf("%s is not a directory", vp.version)
+	}
+	if vp.file == "" {
+		n, err := fs.lookupDir(vp.dir)
+		if err != nil {
+			return nil, err
+		}
+		children, err := fs.config.KBFSOps().GetDirChildren(fs.ctx, n)
+		if err != nil {
+			return nil, err
+		}
+		fis := make([]os.FileInfo, 0, len(children))
+		for name, ei := range children {
+			if !ei.Type.IsFile() {
+				continue
+			}
+			fis = append(fis, &FileInfo{
+				fs:   fs,
+				ei:   libkbfs.EntryInfo{Type: libkbfs.Dir},
+				name: name,
+			})
+		}
+		return fis, nil
+	}
+
+	n, ei, err := fs.lookupVersionsFile(vp)
+	if err != nil {
+		return nil, err
+	}
+	versions, err := fs.config.KBFSOps().GetFileVersions(fs.ctx, n)
+	if err != nil {
+		return nil, err
+	}
+	fis := make([]os.FileInfo, 0, len(versions))
+	for _, version := range versions {
+		fis = append(fis, &FileInfo{
+			fs:   fs,
+			ei:   FileVersionInfo(version, ei.Type),
+			name: FileVersionName(version),
+		})
+	}
+	return fis, nil
+}
+
 // lookupParentWithDepth looks up the parent node of the given
 // filename.  It follows symlinks in the path, but doesn't resolve the
 // final base name.  If `exitEarly` is true, it returns on the first
@@ -168,9 +360,20 @@ func (fs *FS) lookupParentWithDepth(
 	parent libkbfs.Node, parentDir, base string, err error) {
 	parts := strings.Split(filename, "/")
 	n := fs.root
+	start := 0
+	if len(parts) > 2 {
+		archivedRoot, _, ok, err := fs.lookupArchivedRoot(parts)
+		if err != nil {
+			return nil, "", "", err
+		}
+		if ok {
+			n = archivedRoot
+			start = 2
+		}
+	}
 	// Iterate through each of the parent directories of the file, but
 	// not the file itself.
-	for i := 0; i < len(parts)-1; i++ {
+	for i := start; i < len(parts)-1; i++ {
 		p := parts[i]
 		nextNode, ei, err := fs.config.KBFSOps().Lookup(fs.ctx, n, p)
 		switch errors.Cause(err).(type) {
@@ -226,6 +429,16 @@ func (fs *FS) lookupOrCreateEntry(
 	filename string, flag int, perm os.FileMode) (
 	n libkbfs.Node, ei libkbfs.EntryInfo, err error) {
 	for i := 0; i < maxSymlinkLevels; i++ {
+		if parts := strings.Split(filename, "/"); len(parts) == 2 {
+			n, ei, ok, err := fs.lookupArchivedRoot(parts)
+			if err != nil {
+				return nil, libkbfs.EntryInfo{}, err
+			}
+			if ok {
+				return n, ei, nil
+			}
+		}
+
 		var parentDir, fName string
 		n, parentDir, fName, err = fs.lookupParent(filename)
 		if err != nil {
@@ -252,7 +465,8 @@ func (fs *FS) lookupOrCreateEntry(
 
 func translateErr(err error) error {
 	switch errors.Cause(err).(type) {
-	case libkbfs.NoSuchNameError:
+	case libkbfs.NoSuchNameError, libkbfs.NoSuchRevisionError,
+		libkbfs.NoRevisionAtTimeError:
 		return os.ErrNotExist
 	case libkbfs.NameExistsError:
 		return os.ErrExist
@@ -297,11 +511,12 @@ func (fs *FS) OpenFile(filename string, flag int, perm os.FileMode) (
 	}
 
 	return &File{
-		fs:       fs,
-		filename: filename,
-		node:     n,
-		readOnly: flag == os.O_RDONLY,
-		offset:   offset,
+		fs:        fs,
+		filename:  filename,
+		node:      n,
+		readOnly:  flag == os.O_RDONLY,
+		offset:    offset,
+		lockOwner: nextLockOwner(),
 	}, nil
 }
 
@@ -323,6 +538,33 @@ func (fs *FS) Stat(filename string) (fi os.FileInfo, err error) {
 		err = translateErr(err)
 	}()
 
+	if vp, ok := parseVersionsPath(filename); ok {
+		return fs.statVersionsPath(vp)
+	} else if fs.isArchivedDir(filename) {
+		return &FileInfo{
+			fs:   fs,
+			ei:   libkbfs.EntryInfo{Type: libkbfs.Dir},
+			name: ArchivedDirName,
+		}, nil
+	} else if fs.isDeletedDir(filename) {
+		return &FileInfo{
+			fs:   fs,
+			ei:   libkbfs.EntryInfo{Type: libkbfs.Dir},
+			name: DeletedDirName,
+		}, nil
+	}
+	parts := strings.Split(filename, "/")
+	entry, ok, err := fs.lookupDeletedEntry(parts)
+	if err != nil {
+		return nil, err
+	} else if ok {
+		return &FileInfo{
+			fs:   fs,
+			ei:   DeletedEntryInfo(entry),
+			name: parts[1],
+		}, nil
+	}
+
 	n, ei, err := fs.lookupOrCreateEntry(filename, os.O_RDONLY, 0)
 	if err != nil {
 		return nil, err
@@ -343,18 +585,87 @@ func (fs *FS) Rename(oldpath, newpath string) (err error) {
 		err = translateErr(err)
 	}()
 
-	oldParent, _, oldBase, err := fs.lookupParent(oldpath)
+	// Moving a file version onto its file restores it.
+	if vp, ok := parseVersionsPath(oldpath); ok {
+		if vp.version == "" ||
+			path.Clean(newpath) != path.Join(vp.dir, vp.file) {
+			return errors.Errorf(
+				"%s can only be restored onto %s", oldpath,
+				path.Join(vp.dir, vp.file))
+		}
+		n, _, err := fs.lookupVersionsFile(vp)
+		if err != nil {
+			return err
+		}
+		version, err := LookupFileVersion(fs.ctx, fs.config, n, vp.version)
+		if err != nil {
+			return err
+		}
+		return fs.config.KBFSOps().RestoreFileVersion(fs.ctx, n, version)
+	}
+
+	// Moving an entry out of DeletedDirName restores it.
+	entry, isDeleted, err := fs.lookupDeletedEntry(
+		strings.Split(oldpath, "/"))
 	if err != nil {
 		return err
 	}
 
+	var oldParent libkbfs.Node
+	var oldBase string
+	if !isDeleted {
+		oldParent, _, oldBase, err = fs.lookupParent(oldpath)
+		if err != nil {
+			return err
+		}
+	}
+
 	newParent, _, newBase, err := fs.lookupParent(newpath)
 	if err != nil {
 		return err
 	}
 
+	if isDeleted {
+		_, _, err = fs.config.KBFSOps().RestoreDeletedEntry(
+			fs.ctx, entry, newParent, newBase)
+		return err
+	}
 	return fs.config.KBFSOps().Rename(
-		fs.ctx, oldParent, oldBase, newParent, newBase)
+		fs.ctx, oldParent, oldBase, newParent, newBase, libkbfs.RenameReplace)
+}
+
+func (fs *FS) renameWithMode(
+	oldpath, newpath string, mode libkbfs.RenameMode) (err error) {
+	fs.log.CDebugf(fs.ctx, "Rename %s -> %s (%s)", oldpath, newpath, mode)
+	defer func() {
+		fs.deferLog.CDebugf(fs.ctx, "Rename done: %+v", err)
+		err = translateErr(err)
+	}()
+
+	oldParent, _, oldBase, err := fs.lookupParent(oldpath)
+	if err != nil {
+		return err
+	}
+	newParent, _, newBase, err := fs.lookupParent(newpath)
+	if err != nil {
+		return err
+	}
+	return fs.config.KBFSOps().Rename(
+		fs.ctx, oldParent, oldBase, newParent, newBase, mode)
+}
+
+// RenameNoReplace is like Rename, but returns os.ErrExist instead of
+// replacing an existing entry at `newpath`, like renameat2(2) with
+// RENAME_NOREPLACE.
+func (fs *FS) RenameNoReplace(oldpath, newpath string) error {
+	return fs.renameWithMode(oldpath, newpath, libkbfs.RenameNoReplace)
+}
+
+// RenameExchange atomically swaps the entries at `oldpath` and
+// `newpath`, which must both exist, like renameat2(2) with
+// RENAME_EXCHANGE.
+func (fs *FS) RenameExchange(oldpath, newpath string) error {
+	return fs.renameWithMode(oldpath, newpath, libkbfs.RenameExchange)
 }
 
 // Remove implements the billy.Filesystem interface for FS.
@@ -410,6 +721,29 @@ func (fs *FS) ReadDir(p string) (fis []os.FileInfo, err error) {
 		err = translateErr(err)
 	}()
 
+	if vp, ok := parseVersionsPath(p); ok {
+		return fs.readVersionsDir(vp)
+	} else if fs.isArchivedDir(p) {
+		// Archived views are created on demand, so there's nothing
+		// to list.
+		return nil, nil
+	} else if fs.isDeletedDir(p) {
+		entries, err := fs.config.KBFSOps().GetDeletedEntries(
+			fs.ctx, fs.root.GetFolderBranch())
+		if err != nil {
+			return nil, err
+		}
+		fis = make([]os.FileInfo, 0, len(entries))
+		for _, entry := range entries {
+			fis = append(fis, &FileInfo{
+				fs:   fs,
+				ei:   DeletedEntryInfo(entry),
+				name: DeletedEntryName(entry),
+			})
+		}
+		return fis, nil
+	}
+
 	n, _, err := fs.lookupOrCreateEntry(p, os.O_RDONLY, 0)
 	if err != nil {
 		return nil, err
@@ -464,6 +798,35 @@ func (fs *FS) Lstat(filename string) (fi os.FileInfo, err error) {
 		err = translateErr(err)
 	}()
 
+	if vp, ok := parseVersionsPath(filename); ok {
+		return fs.statVersionsPath(vp)
+	} else if fs.isArchivedDir(filename) || fs.isDeletedDir(filename) {
+		return fs.Stat(filename)
+	}
+	if parts := strings.Split(filename, "/"); len(parts) == 2 {
+		entry, ok, err := fs.lookupDeletedEntry(parts)
+		if err != nil {
+			return nil, err
+		} else if ok {
+			return &FileInfo{
+				fs:   fs,
+				ei:   DeletedEntryInfo(entry),
+				name: parts[1],
+			}, nil
+		}
+		_, ei, ok, err := fs.lookupArchivedRoot(parts)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return &FileInfo{
+				fs:   fs,
+				ei:   ei,
+				name: parts[1],
+			}, nil
+		}
+	}
+
 	n, _, base, err := fs.lookupParent(filename)
 	if err != nil {
 		return nil, err
@@ -571,6 +934,76 @@ func (fs *FS) Chtimes(name string, atime time.Time, mtime time.Time) (
 	return fs.config.KBFSOps().SetMtime(fs.ctx, n, &mtime)
 }
 
+// GetXattr returns the value of the extended attribute `attr` on the
+// given file.  If the attribute doesn't exist, it returns a
+// libkbfs.NoSuchXattrError.
+func (fs *FS) GetXattr(name, attr string) (value []byte, err error) {
+	fs.log.CDebugf(fs.ctx, "GetXattr %s %s", name, attr)
+	defer func() {
+		fs.deferLog.CDebugf(fs.ctx, "GetXattr done: %+v", err)
+		err = translateErr(err)
+	}()
+
+	n, _, err := fs.lookupOrCreateEntry(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return fs.config.KBFSOps().GetXattr(fs.ctx, n, attr)
+}
+
+// ListXattrs returns the sorted names of the extended attributes set
+// on the given file.
+func (fs *FS) ListXattrs(name string) (attrs []string, err error) {
+	fs.log.CDebugf(fs.ctx, "ListXattrs %s", name)
+	defer func() {
+		fs.deferLog.CDebugf(fs.ctx, "ListXattrs done: %+v", err)
+		err = translateErr(err)
+	}()
+
+	n, _, err := fs.lookupOrCreateEntry(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return fs.config.KBFSOps().ListXattrs(fs.ctx, n)
+}
+
+// SetXattr sets the extended attribute `attr` on the given file,
+// creating or replacing it as allowed by `flag`.
+func (fs *FS) SetXattr(
+	name, attr string, value []byte, flag libkbfs.XattrFlag) (err error) {
+	fs.log.CDebugf(fs.ctx, "SetXattr %s %s (%s)", name, attr, flag)
+	defer func() {
+		fs.deferLog.CDebugf(fs.ctx, "SetXattr done: %+v", err)
+		err = translateErr(err)
+	}()
+
+	n, _, err := fs.lookupOrCreateEntry(name, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+
+	return fs.config.KBFSOps().SetXattr(fs.ctx, n, attr, value, flag)
+}
+
+// RemoveXattr removes the extended attribute `attr` from the given
+// file.
+func (fs *FS) RemoveXattr(name, attr string) (err error) {
+	fs.log.CDebugf(fs.ctx, "RemoveXattr %s %s", name, attr)
+	defer func() {
+		fs.deferLog.CDebugf(fs.ctx, "RemoveXattr done: %+v", err)
+		err = translateErr(err)
+	}()
+
+	n, _, err := fs.lookupOrCreateEntry(name, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+
+	return fs.config.KBFSOps().RemoveXattr(fs.ctx, n, attr)
+}
+
 // Chroot implements the billy.Filesystem interface for FS.
 func (fs *FS) Chroot(p string) (newFS billy.Filesystem, err error) {
 	fs.log.CDebugf(fs.ctx, "Chroot %s", p)
@@ -7,13 +7,17 @@ package libfs
 import (
 	"bytes"
 	"context"
+	"io"
 	"os"
 	"path"
+	"strings"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/keybase/kbfs/libkbfs"
 	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
 	billy "github.com/src-d/go-billy"
 	"github.com/stretchr/testify/require"
 )
@@ -276,6 +280,51 @@ func TestRename(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestRenameNoReplaceAndExchange(t *testing.T) {
+	ctx, _, fs := makeFS(t, "")
+	defer libkbfs.CheckConfigAndShutdown(ctx, t, fs.config)
+
+	writeFile := func(name string, data []byte) {
+		f, err := fs.Create(name)
+		require.NoError(t, err)
+		_, err = f.Write(data)
+		require.NoError(t, err)
+		err = f.Close()
+		require.NoError(t, err)
+	}
+	readFile := func(name string) []byte {
+		f, err := fs.Open(name)
+		require.NoError(t, err)
+		defer f.Close()
+		data := make([]byte, 10)
+		n, err := f.Read(data)
+		require.NoError(t, err)
+		return data[:n]
+	}
+
+	err := fs.MkdirAll("a", os.FileMode(0600))
+	require.NoError(t, err)
+	writeFile("foo", []byte("foo"))
+	writeFile("a/bar", []byte("bar"))
+
+	err = fs.RenameNoReplace("foo", "a/bar")
+	require.Equal(t, os.ErrExist, err)
+	err = fs.RenameExchange("foo", "a/baz")
+	require.Equal(t, os.ErrNotExist, err)
+
+	err = fs.RenameExchange("foo", "a/bar")
+	require.NoError(t, err)
+	require.Equal(t, []byte("bar"), readFile("foo"))
+	require.Equal(t, []byte("foo"), readFile("a/bar"))
+
+	err = fs.RenameNoReplace("a/bar", "a/baz")
+	require.NoError(t, err)
+	require.Equal(t, []byte("foo"), readFile("a/baz"))
+
+	err = fs.SyncAll()
+	require.NoError(t, err)
+}
+
 func TestRemove(t *testing.T) {
 	ctx, h, fs := makeFS(t, "")
 	defer libkbfs.CheckConfigAndShutdown(ctx, t, fs.config)
@@ -492,6 +541,116 @@ func TestChtimes(t *testing.T) {
 	require.Equal(t, mtime, fi.ModTime())
 }
 
+func TestXattrs(t *testing.T) {
+	ctx, _, fs := makeFS(t, "")
+	defer libkbfs.CheckConfigAndShutdown(ctx, t, fs.config)
+
+	foo, err := fs.Create("foo")
+	require.NoError(t, err)
+	err = foo.Close()
+	require.NoError(t, err)
+
+	err = fs.SetXattr("foo", "user.b", []byte("2"), libkbfs.XattrSet)
+	require.NoError(t, err)
+	err = fs.SetXattr("foo", "user.a", []byte("1"), libkbfs.XattrCreate)
+	require.NoError(t, err)
+	err = fs.SetXattr("foo", "user.a", []byte("3"), libkbfs.XattrCreate)
+	require.Equal(t, os.ErrExist, err)
+
+	attrs, err := fs.ListXattrs("foo")
+	require.NoError(t, err)
+	require.Equal(t, []string{"user.a", "user.b"}, attrs)
+	value, err := fs.GetXattr("foo", "user.a")
+	require.NoError(t, err)
+	require.Equal(t, []byte("1"), value)
+
+	err = fs.RemoveXattr("foo", "user.a")
+	require.NoError(t, err)
+	_, err = fs.GetXattr("foo", "user.a")
+	require.IsType(t, libkbfs.NoSuchXattrError{}, err)
+}
+
+func TestFileLock(t *testing.T) {
+	ctx := libkbfs.BackgroundContextWithCancellationDelayer()
+	config := libkbfs.MakeTestConfigOrBust(t, "user1", "user2")
+	defer libkbfs.CheckConfigAndShutdown(ctx, t, config)
+	config2 := libkbfs.ConfigAsUser(config, "user2")
+	defer libkbfs.CheckConfigAndShutdown(ctx, t, config2)
+
+	h, err := libkbfs.ParseTlfHandle(
+		ctx, config.KBPKI(), "user1,user2", tlf.Private)
+	require.NoError(t, err)
+	fs1, err := NewFS(ctx, config, h, "", "")
+	require.NoError(t, err)
+	f1, err := fs1.Create("foo")
+	require.NoError(t, err)
+	defer f1.Close()
+	err = fs1.SyncAll()
+	require.NoError(t, err)
+
+	h2, err := libkbfs.ParseTlfHandle(
+		ctx, config2.KBPKI(), "user1,user2", tlf.Private)
+	require.NoError(t, err)
+	fs2, err := NewFS(ctx, config2, h2, "", "")
+	require.NoError(t, err)
+	f2, err := fs2.OpenFile("foo", os.O_RDWR, 0600)
+	require.NoError(t, err)
+	defer f2.Close()
+
+	err = f1.(*File).Lock()
+	require.NoError(t, err)
+	// Locking again through the same file is fine.
+	err = f1.(*File).Lock()
+	require.NoError(t, err)
+
+	err = config2.KBFSOps().LockPath(
+		ctx, f2.(*File).node, f2.(*File).lockOwner)
+	require.IsType(t, libkbfs.PathLockedError{}, errors.Cause(err))
+
+	// Another file for the same path on the same device is locked
+	// out too, and unlocking it doesn't release the first file's
+	// lock.
+	f1b, err := fs1.OpenFile("foo", os.O_RDWR, 0600)
+	require.NoError(t, err)
+	err = config.KBFSOps().LockPath(
+		ctx, f1b.(*File).node, f1b.(*File).lockOwner)
+	require.IsType(t, libkbfs.PathLockedError{}, errors.Cause(err))
+	err = config.KBFSOps().UnlockPath(
+		ctx, f1b.(*File).node, f1b.(*File).lockOwner)
+	require.NoError(t, err)
+	err = f1b.Close()
+	require.NoError(t, err)
+	err = config2.KBFSOps().LockPath(
+		ctx, f2.(*File).node, f2.(*File).lockOwner)
+	require.IsType(t, libkbfs.PathLockedError{}, errors.Cause(err))
+
+	// The second lock should block until the first one is released.
+	lockCh := make(chan error, 1)
+	go func() {
+		lockCh <- f2.(*File).Lock()
+	}()
+	select {
+	case err := <-lockCh:
+		t.Fatalf("Lock didn't block: %+v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	err = f1.(*File).Unlock()
+	require.NoError(t, err)
+	select {
+	case err := <-lockCh:
+		require.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for lock")
+	}
+
+	// Closing the file releases its lock.
+	err = f2.Close()
+	require.NoError(t, err)
+	err = f1.(*File).Lock()
+	require.NoError(t, err)
+}
+
 func TestChroot(t *testing.T) {
 	ctx, _, fs := makeFS(t, "")
 	defer libkbfs.CheckConfigAndShutdown(ctx, t, fs.config)
@@ -533,3 +692,334 @@ func TestChroot(t *testing.T) {
 	_, err = fs.Chroot("../../../etc/passwd")
 	require.NotNil(t, err)
 }
+
+func TestArchivedRevision(t *testing.T) {
+	ctx, _, fs := makeFS(t, "")
+	defer libkbfs.CheckConfigAndShutdown(ctx, t, fs.config)
+
+	t.Log("Write a first version of a file")
+	err := fs.MkdirAll("a", os.FileMode(0600))
+	require.NoError(t, err)
+	foo, err := fs.Create("a/foo")
+	require.NoError(t, err)
+	data1 := []byte{1, 2, 3, 4}
+	_, err = foo.Write(data1)
+	require.NoError(t, err)
+	err = foo.Close()
+	require.NoError(t, err)
+	err = fs.SyncAll()
+	require.NoError(t, err)
+
+	md, err := fs.config.MDOps().GetForTLF(
+		ctx, fs.root.GetFolderBranch().Tlf)
+	require.NoError(t, err)
+	revDir := path.Join(
+		ArchivedDirName, ArchivedRevDirPrefix+md.Revision().String())
+
+	t.Log("Overwrite it")
+	foo, err = fs.OpenFile("a/foo", os.O_RDWR, 0600)
+	require.NoError(t, err)
+	data2 := []byte{5, 6, 7, 8}
+	_, err = foo.Write(data2)
+	require.NoError(t, err)
+	err = foo.Close()
+	require.NoError(t, err)
+	err = fs.SyncAll()
+	require.NoError(t, err)
+
+	t.Log("Read the old version through the archived dir")
+	fi, err := fs.Stat(ArchivedDirName)
+	require.NoError(t, err)
+	require.True(t, fi.IsDir())
+	fi, err = fs.Stat(revDir)
+	require.NoError(t, err)
+	require.True(t, fi.IsDir())
+	fis, err := fs.ReadDir(path.Join(revDir, "a"))
+	require.NoError(t, err)
+	require.Len(t, fis, 1)
+	f, err := fs.Open(path.Join(revDir, "a/foo"))
+	require.NoError(t, err)
+	gotData := make([]byte, len(data1))
+	_, err = f.Read(gotData)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(data1, gotData))
+	err = f.Close()
+	require.NoError(t, err)
+
+	t.Log("Writes to the archived view should fail")
+	_, err = fs.Create(path.Join(revDir, "a/bar"))
+	require.IsType(t, libkbfs.WriteToReadonlyNodeError{},
+		errors.Cause(err))
+
+	t.Log("Bad revision names shouldn't exist")
+	_, err = fs.Stat(path.Join(ArchivedDirName, "rev=foo"))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestArchivedTime(t *testing.T) {
+	ctx, _, fs := makeFS(t, "")
+	defer libkbfs.CheckConfigAndShutdown(ctx, t, fs.config)
+	// The TLF was already created by `makeFS` using the wall clock,
+	// so start the test clock a bit after that.
+	clock := &libkbfs.TestClock{}
+	t0 := time.Now().Add(1 * time.Minute).Truncate(time.Second)
+	clock.Set(t0)
+	fs.config.SetClock(clock)
+
+	t.Log("Write a first version of a file")
+	foo, err := fs.Create("foo")
+	require.NoError(t, err)
+	data1 := []byte{1, 2, 3, 4}
+	_, err = foo.Write(data1)
+	require.NoError(t, err)
+	err = foo.Close()
+	require.NoError(t, err)
+	err = fs.SyncAll()
+	require.NoError(t, err)
+
+	t.Log("Overwrite it an hour later")
+	clock.Add(1 * time.Hour)
+	foo, err = fs.OpenFile("foo", os.O_RDWR, 0600)
+	require.NoError(t, err)
+	data2 := []byte{5, 6, 7, 8}
+	_, err = foo.Write(data2)
+	require.NoError(t, err)
+	err = foo.Close()
+	require.NoError(t, err)
+	err = fs.SyncAll()
+	require.NoError(t, err)
+
+	readAtTime := func(tm time.Time) []byte {
+		f, err := fs.Open(path.Join(ArchivedDirName,
+			ArchivedTimeDirPrefix+tm.Format(time.RFC3339), "foo"))
+		require.NoError(t, err)
+		defer f.Close()
+		gotData := make([]byte, len(data1))
+		_, err = f.Read(gotData)
+		require.NoError(t, err)
+		return gotData
+	}
+
+	require.Equal(t, data1, readAtTime(t0.Add(30*time.Minute)))
+	require.Equal(t, data2, readAtTime(t0.Add(90*time.Minute)))
+
+	t.Log("Times before the TLF existed shouldn't exist")
+	_, err = fs.Stat(path.Join(ArchivedDirName,
+		ArchivedTimeDirPrefix+t0.Add(-24*time.Hour).Format(time.RFC3339)))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestDeletedEntries(t *testing.T) {
+	ctx, _, fs := makeFS(t, "")
+	defer libkbfs.CheckConfigAndShutdown(ctx, t, fs.config)
+	err := fs.config.KBFSOps().SetTrashRetention(
+		ctx, fs.root.GetFolderBranch(), 1*time.Hour)
+	require.NoError(t, err)
+
+	t.Log("Write a file under a dir, and then remove it")
+	err = fs.MkdirAll("a/b", os.FileMode(0600))
+	require.NoError(t, err)
+	foo, err := fs.Create("a/b/foo")
+	require.NoError(t, err)
+	data := []byte{1, 2, 3, 4}
+	_, err = foo.Write(data)
+	require.NoError(t, err)
+	err = foo.Close()
+	require.NoError(t, err)
+	err = fs.SyncAll()
+	require.NoError(t, err)
+	err = fs.Remove("a/b/foo")
+	require.NoError(t, err)
+	err = fs.SyncAll()
+	require.NoError(t, err)
+
+	t.Log("The file shows up in the deleted dir")
+	fi, err := fs.Stat(DeletedDirName)
+	require.NoError(t, err)
+	require.True(t, fi.IsDir())
+	fis, err := fs.ReadDir(DeletedDirName)
+	require.NoError(t, err)
+	require.Len(t, fis, 1)
+	name := fis[0].Name()
+	require.True(t, strings.HasPrefix(name, "a%2Fb%2Ffoo@rev="), name)
+	require.Equal(t, int64(len(data)), fis[0].Size())
+	fi, err = fs.Lstat(path.Join(DeletedDirName, name))
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), fi.Size())
+
+	t.Log("Restore it by renaming it into a different dir")
+	err = fs.Rename(path.Join(DeletedDirName, name), "a/bar")
+	require.NoError(t, err)
+	f, err := fs.Open("a/bar")
+	require.NoError(t, err)
+	gotData := make([]byte, len(data))
+	_, err = f.Read(gotData)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(data, gotData))
+	err = f.Close()
+	require.NoError(t, err)
+
+	t.Log("Bad entry names shouldn't exist")
+	_, err = fs.Stat(path.Join(DeletedDirName, "foo@rev=1000"))
+	require.True(t, os.IsNotExist(err))
+	_, err = fs.Stat(path.Join(DeletedDirName, "foo"))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestParseDeletedEntryName(t *testing.T) {
+	entry := libkbfs.DeletedEntry{Path: "a/b%c/d@rev=e", Revision: 10}
+	name := DeletedEntryName(entry)
+	require.Equal(t, "a%2Fb%25c%2Fd@rev=e@rev=10", name)
+	p, rev, ok := ParseDeletedEntryName(name)
+	require.True(t, ok)
+	require.Equal(t, entry.Path, p)
+	require.Equal(t, entry.Revision, rev)
+
+	for _, name := range []string{"a", "@rev=1", "a@rev=0", "a@rev=b"} {
+		_, _, ok := ParseDeletedEntryName(name)
+		require.False(t, ok, name)
+	}
+}
+
+func TestFileVersions(t *testing.T) {
+	ctx, _, fs := makeFS(t, "")
+	defer libkbfs.CheckConfigAndShutdown(ctx, t, fs.config)
+
+	writeFile := func(data []byte) {
+		f, err := fs.OpenFile("a/foo", os.O_CREATE|os.O_TRUNC|os.O_WRONLY,
+			0600)
+		require.NoError(t, err)
+		_, err = f.Write(data)
+		require.NoError(t, err)
+		err = f.Close()
+		require.NoError(t, err)
+		err = fs.SyncAll()
+		require.NoError(t, err)
+	}
+
+	t.Log("Write two versions of a file under a dir")
+	err := fs.MkdirAll("a", os.FileMode(0600))
+	require.NoError(t, err)
+	data1 := []byte{1, 2, 3, 4}
+	writeFile(data1)
+	data2 := []byte{5, 6}
+	writeFile(data2)
+
+	t.Log("The file shows up in the versions dir, with both versions")
+	versionsDir := path.Join("a", VersionsDirName)
+	fi, err := fs.Stat(versionsDir)
+	require.NoError(t, err)
+	require.True(t, fi.IsDir())
+	fis, err := fs.ReadDir(versionsDir)
+	require.NoError(t, err)
+	require.Len(t, fis, 1)
+	require.Equal(t, "foo", fis[0].Name())
+	require.True(t, fis[0].IsDir())
+	fis, err = fs.ReadDir(path.Join(versionsDir, "foo"))
+	require.NoError(t, err)
+	require.Len(t, fis, 2)
+	sizes := map[int64]string{}
+	for _, fi := range fis {
+		require.True(t, strings.HasPrefix(fi.Name(), FileVersionPrefix))
+		sizes[fi.Size()] = fi.Name()
+	}
+	oldName, ok := sizes[int64(len(data1))]
+	require.True(t, ok)
+	fi, err = fs.Lstat(path.Join(versionsDir, "foo", oldName))
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data1)), fi.Size())
+
+	t.Log("Versions can only be restored onto their own file")
+	err = fs.Rename(path.Join(versionsDir, "foo", oldName), "a/bar")
+	require.Error(t, err)
+
+	t.Log("Restore the old version")
+	err = fs.Rename(path.Join(versionsDir, "foo", oldName), "a/foo")
+	require.NoError(t, err)
+	f, err := fs.Open("a/foo")
+	require.NoError(t, err)
+	gotData := make([]byte, len(data1))
+	_, err = f.Read(gotData)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(data1, gotData))
+	err = f.Close()
+	require.NoError(t, err)
+	fis, err = fs.ReadDir(path.Join(versionsDir, "foo"))
+	require.NoError(t, err)
+	require.Len(t, fis, 3)
+
+	t.Log("Bad version names shouldn't exist")
+	_, err = fs.Stat(path.Join(versionsDir, "foo", "rev=1000"))
+	require.True(t, os.IsNotExist(err))
+	_, err = fs.Stat(path.Join(versionsDir, "foo", "bar"))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestParseFileVersionName(t *testing.T) {
+	version := libkbfs.FileVersion{Revision: 10}
+	name := FileVersionName(version)
+	require.Equal(t, "rev=10", name)
+	rev, ok := ParseFileVersionName(name)
+	require.True(t, ok)
+	require.Equal(t, version.Revision, rev)
+
+	for _, name := range []string{"a", "rev=0", "rev=b", "10"} {
+		_, ok := ParseFileVersionName(name)
+		require.False(t, ok, name)
+	}
+}
+
+func TestSeekDataAndHole(t *testing.T) {
+	ctx, _, fs := makeFS(t, "")
+	defer libkbfs.CheckConfigAndShutdown(ctx, t, fs.config)
+
+	f, err := fs.Create("foo")
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = f.Write([]byte("hello"))
+	require.NoError(t, err)
+	const dataOff = 4 * libkbfs.MaxBlockSizeBytesDefault
+	_, err = f.Seek(dataOff, io.SeekStart)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("world"))
+	require.NoError(t, err)
+	err = fs.SyncAll()
+	require.NoError(t, err)
+	size := int64(dataOff + 5)
+
+	t.Log("Writing past the end of the file leaves a hole in the middle")
+	off, err := f.Seek(0, SeekData)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), off)
+	holeOff, err := f.Seek(0, SeekHole)
+	require.NoError(t, err)
+	require.True(t, holeOff >= 5 && holeOff < dataOff, "%d", holeOff)
+	off, err = f.Seek(holeOff, SeekData)
+	require.NoError(t, err)
+	require.Equal(t, int64(dataOff), off)
+	off, err = f.Seek(dataOff+1, SeekHole)
+	require.NoError(t, err)
+	require.Equal(t, size, off)
+	_, err = f.Seek(size, SeekData)
+	require.Equal(t, syscall.ENXIO, errors.Cause(err))
+
+	t.Log("Punching a hole leaves just the data at the end")
+	kbfsFile := f.(*File)
+	err = kbfsFile.PunchHole(0, dataOff)
+	require.NoError(t, err)
+	off, err = f.Seek(0, SeekData)
+	require.NoError(t, err)
+	require.Equal(t, int64(dataOff), off)
+	off, err = f.Seek(0, SeekHole)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), off)
+	buf := make([]byte, 5)
+	_, err = f.ReadAt(buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, make([]byte, 5), buf)
+	err = fs.SyncAll()
+	require.NoError(t, err)
+	fi, err := fs.Stat("foo")
+	require.NoError(t, err)
+	require.Equal(t, size, fi.Size())
+}
@@ -0,0 +1,65 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfs
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// JournalBundleAction enumerates all the possible actions to take
+// with a bundle of a TLF's journal.
+type JournalBundleAction int
+
+const (
+	// JournalBundleExport is to write the TLF's unflushed journal to
+	// a bundle file.
+	JournalBundleExport JournalBundleAction = iota
+	// JournalBundleImport is to flush a bundle file written by
+	// another device.
+	JournalBundleImport
+)
+
+func (a JournalBundleAction) String() string {
+	switch a {
+	case JournalBundleExport:
+		return "Export journal bundle"
+	case JournalBundleImport:
+		return "Import journal bundle"
+	}
+	return fmt.Sprintf("JournalBundleAction(%d)", int(a))
+}
+
+// Execute performs the action on the given JournalServer for the
+// given TLF, with the bundle file whose local path is given by
+// `data`.
+func (a JournalBundleAction) Execute(
+	ctx context.Context, jServer *libkbfs.JournalServer,
+	tlfID tlf.ID, data []byte) error {
+	if tlfID == (tlf.ID{}) {
+		panic("zero TlfID in JournalBundleAction.Execute")
+	}
+
+	bundlePath := strings.TrimSpace(string(data))
+	if bundlePath == "" {
+		return errors.New("No bundle path given")
+	}
+
+	switch a {
+	case JournalBundleExport:
+		return jServer.ExportBundle(ctx, tlfID, bundlePath)
+
+	case JournalBundleImport:
+		return jServer.ImportBundle(ctx, tlfID, bundlePath)
+
+	default:
+		return fmt.Errorf("Unknown action %s", a)
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfs
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// PinAction enumerates all the possible actions to take on the paths
+// of a TLF that are kept available offline.
+type PinAction int
+
+const (
+	// PinAdd is to start keeping a path available offline.
+	PinAdd PinAction = iota
+	// PinRemove is to stop keeping a path available offline.
+	PinRemove
+)
+
+func (a PinAction) String() string {
+	switch a {
+	case PinAdd:
+		return "Pin"
+	case PinRemove:
+		return "Unpin"
+	}
+	return fmt.Sprintf("PinAction(%d)", int(a))
+}
+
+// Execute performs the action on the path given by `data`, relative
+// to the root of the given TLF.
+func (a PinAction) Execute(ctx context.Context, c libkbfs.Config,
+	fb libkbfs.FolderBranch, data []byte) error {
+	if fb == (libkbfs.FolderBranch{}) {
+		panic("zero fb in PinAction.Execute")
+	}
+
+	p := strings.TrimSpace(string(data))
+	switch a {
+	case PinAdd:
+		return c.KBFSOps().PinPath(ctx, fb, p)
+
+	case PinRemove:
+		return c.KBFSOps().UnpinPath(ctx, fb, p)
+
+	default:
+		return fmt.Errorf("Unknown action %s", a)
+	}
+}
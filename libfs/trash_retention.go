@@ -0,0 +1,25 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfs
+
+import (
+	"strings"
+	"time"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// SetTrashRetention parses `data` as a duration (see
+// time.ParseDuration), and makes it the trash retention of the given
+// folder.
+func SetTrashRetention(ctx context.Context, config libkbfs.Config,
+	folderBranch libkbfs.FolderBranch, data []byte) error {
+	retention, err := time.ParseDuration(strings.TrimSpace(string(data)))
+	if err != nil {
+		return err
+	}
+	return config.KBFSOps().SetTrashRetention(ctx, folderBranch, retention)
+}
@@ -0,0 +1,68 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfs
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// FileVersionName returns the name of the given file version within
+// the file's subdirectory of VersionsDirName.
+func FileVersionName(version libkbfs.FileVersion) string {
+	return FileVersionPrefix + strconv.FormatInt(int64(version.Revision), 10)
+}
+
+// ParseFileVersionName returns the revision named by a file version
+// entry (e.g., "rev=5"), and true if the name is valid.
+func ParseFileVersionName(name string) (kbfsmd.Revision, bool) {
+	if !strings.HasPrefix(name, FileVersionPrefix) {
+		return kbfsmd.RevisionUninitialized, false
+	}
+	i, err := strconv.ParseInt(name[len(FileVersionPrefix):], 10, 64)
+	if err != nil || i < int64(kbfsmd.RevisionInitial) {
+		return kbfsmd.RevisionUninitialized, false
+	}
+	return kbfsmd.Revision(i), true
+}
+
+// FileVersionInfo returns the libkbfs.EntryInfo to show for the given
+// version of a file with the given current type.  Its mtime is the
+// time the version was written.
+func FileVersionInfo(
+	version libkbfs.FileVersion, t libkbfs.EntryType) libkbfs.EntryInfo {
+	return libkbfs.EntryInfo{
+		Type:  t,
+		Size:  version.Size,
+		Mtime: version.LocalTime.UnixNano(),
+		Ctime: version.LocalTime.UnixNano(),
+	}
+}
+
+// LookupFileVersion returns the version of the given file that is
+// named by `name`.  It returns a libkbfs.NoSuchNameError if there is
+// no such version, or if it has already expired.
+func LookupFileVersion(
+	ctx context.Context, config libkbfs.Config, file libkbfs.Node,
+	name string) (libkbfs.FileVersion, error) {
+	rev, ok := ParseFileVersionName(name)
+	if !ok {
+		return libkbfs.FileVersion{}, libkbfs.NoSuchNameError{Name: name}
+	}
+	versions, err := config.KBFSOps().GetFileVersions(ctx, file)
+	if err != nil {
+		return libkbfs.FileVersion{}, err
+	}
+	for _, version := range versions {
+		if version.Revision == rev {
+			return version, nil
+		}
+	}
+	return libkbfs.FileVersion{}, libkbfs.NoSuchNameError{Name: name}
+}
@@ -0,0 +1,134 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"os"
+	"strings"
+	"sync"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// ArchivedDir is a node that gives access to read-only views of past
+// revisions of a TLF.  Its entries are created on demand when looked
+// up by name (e.g., "rev=5" or "time=2017-10-16T11:00:00Z"), so it
+// always appears empty.
+type ArchivedDir struct {
+	folder *Folder
+
+	lock sync.Mutex
+	// Maps each archived branch to the folder holding that
+	// archived view's nodes.
+	folders map[libkbfs.BranchName]*Folder
+}
+
+func newArchivedDir(folder *Folder) *ArchivedDir {
+	return &ArchivedDir{
+		folder:  folder,
+		folders: make(map[libkbfs.BranchName]*Folder),
+	}
+}
+
+var _ fs.Node = (*ArchivedDir)(nil)
+
+// Attr implements the fs.Node interface for ArchivedDir.
+func (ad *ArchivedDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeDir | 0500
+	a.Uid = uint32(os.Getuid())
+	return nil
+}
+
+var _ fs.NodeRequestLookuper = (*ArchivedDir)(nil)
+
+// Lookup implements the fs.NodeRequestLookuper interface for
+// ArchivedDir.
+func (ad *ArchivedDir) Lookup(ctx context.Context, req *fuse.LookupRequest,
+	resp *fuse.LookupResponse) (node fs.Node, err error) {
+	ad.folder.fs.log.CDebugf(ctx, "ArchivedDir Lookup %s", req.Name)
+	defer func() { ad.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+
+	ad.folder.handleMu.RLock()
+	h := ad.folder.h
+	name := ad.folder.hPreferredName
+	ad.folder.handleMu.RUnlock()
+
+	rootNode, _, err := libfs.GetArchivedRootNode(
+		ctx, ad.folder.fs.config, h, req.Name)
+	if err != nil {
+		if isNoSuchNameError(err) {
+			return nil, fuse.ENOENT
+		}
+		return nil, err
+	}
+
+	if strings.HasPrefix(req.Name, libfs.ArchivedTimeDirPrefix) {
+		// The revision for a given time can change if the time is
+		// in the future, so don't let the kernel cache it.
+		resp.EntryValid = 0
+	}
+
+	branch := rootNode.GetFolderBranch().Branch
+	ad.lock.Lock()
+	defer ad.lock.Unlock()
+	f, ok := ad.folders[branch]
+	if !ok {
+		f = newFolder(ad.folder.list, h, name)
+		f.archived = true
+		f.forgetFromParent = func() { ad.forgetFolder(branch, f) }
+		ad.folders[branch] = f
+	}
+
+	f.nodesMu.Lock()
+	defer f.nodesMu.Unlock()
+	if n, ok := f.nodes[rootNode.GetID()]; ok {
+		return n, nil
+	}
+	if f.getFolderBranch() == (libkbfs.FolderBranch{}) {
+		err = f.setFolderBranch(rootNode.GetFolderBranch())
+		if err != nil {
+			return nil, err
+		}
+	}
+	child := newDir(f, rootNode)
+	f.nodes[rootNode.GetID()] = child
+	return child, nil
+}
+
+// forgetFolder drops the folder of the given archived branch, once
+// the kernel has forgotten all of its nodes, unless it has been
+// looked up again since.  The archived folder-branch itself is shut
+// down by KBFSOps once it's idle.
+func (ad *ArchivedDir) forgetFolder(
+	branch libkbfs.BranchName, f *Folder) {
+	ad.lock.Lock()
+	defer ad.lock.Unlock()
+	if ad.folders[branch] != f {
+		return
+	}
+	f.nodesMu.Lock()
+	defer f.nodesMu.Unlock()
+	if len(f.nodes) != 0 {
+		return
+	}
+	delete(ad.folders, branch)
+}
+
+var _ fs.Handle = (*ArchivedDir)(nil)
+
+var _ fs.HandleReadDirAller = (*ArchivedDir)(nil)
+
+// ReadDirAll implements the fs.HandleReadDirAller interface for
+// ArchivedDir.
+func (ad *ArchivedDir) ReadDirAll(ctx context.Context) (
+	res []fuse.Dirent, err error) {
+	// Archived views are only created on demand, so there's nothing
+	// to list.
+	return nil, nil
+}
@@ -0,0 +1,51 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// BandwidthLimitsFile represents a write-only file where a write
+// replaces the block upload and download limits with the ones
+// written.
+type BandwidthLimitsFile struct {
+	fs *FS
+}
+
+var _ fs.Node = (*BandwidthLimitsFile)(nil)
+
+// Attr implements the fs.Node interface for BandwidthLimitsFile.
+func (f *BandwidthLimitsFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Size = 0
+	a.Mode = 0222
+	return nil
+}
+
+var _ fs.Handle = (*BandwidthLimitsFile)(nil)
+
+var _ fs.HandleWriter = (*BandwidthLimitsFile)(nil)
+
+// Write implements the fs.HandleWriter interface for BandwidthLimitsFile.
+func (f *BandwidthLimitsFile) Write(ctx context.Context, req *fuse.WriteRequest,
+	resp *fuse.WriteResponse) (err error) {
+	f.fs.log.CDebugf(ctx, "BandwidthLimitsFile Write")
+	defer func() { f.fs.reportErr(ctx, libkbfs.WriteMode, err) }()
+	if len(req.Data) == 0 {
+		return nil
+	}
+
+	err = libfs.SetBandwidthLimits(f.fs.config, req.Data)
+	if err != nil {
+		return err
+	}
+
+	resp.Size = len(req.Data)
+	return nil
+}
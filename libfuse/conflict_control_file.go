@@ -0,0 +1,53 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// ConflictControlFile is a special file used to control conflict
+// resolution.
+type ConflictControlFile struct {
+	folder *Folder
+	action libfs.ConflictAction
+}
+
+var _ fs.Node = (*ConflictControlFile)(nil)
+
+// Attr implements the fs.Node interface for ConflictControlFile.
+func (f *ConflictControlFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Size = 0
+	a.Mode = 0222
+	return nil
+}
+
+var _ fs.Handle = (*ConflictControlFile)(nil)
+
+var _ fs.HandleWriter = (*ConflictControlFile)(nil)
+
+// Write implements the fs.HandleWriter interface for ConflictControlFile.
+func (f *ConflictControlFile) Write(ctx context.Context, req *fuse.WriteRequest,
+	resp *fuse.WriteResponse) (err error) {
+	f.folder.fs.log.CDebugf(ctx, "ConflictControlFile (f.action=%s) Write",
+		f.action)
+	defer func() { f.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+	if len(req.Data) == 0 {
+		return nil
+	}
+
+	err = f.action.Execute(
+		ctx, f.folder.fs.config, f.folder.getFolderBranch())
+	if err != nil {
+		return err
+	}
+
+	resp.Size = len(req.Data)
+	return nil
+}
@@ -0,0 +1,163 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"os"
+	"syscall"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// DeletedDir is a node that lists the entries recently removed from
+// a TLF, that haven't yet expired from the trash.  Renaming one of
+// its entries into a directory of the same TLF restores it there.
+type DeletedDir struct {
+	folder *Folder
+}
+
+func newDeletedDir(folder *Folder) *DeletedDir {
+	return &DeletedDir{folder: folder}
+}
+
+var _ fs.Node = (*DeletedDir)(nil)
+
+// Attr implements the fs.Node interface for DeletedDir.
+func (dd *DeletedDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeDir | 0700
+	a.Uid = uint32(os.Getuid())
+	return nil
+}
+
+var _ fs.NodeRequestLookuper = (*DeletedDir)(nil)
+
+// Lookup implements the fs.NodeRequestLookuper interface for
+// DeletedDir.
+func (dd *DeletedDir) Lookup(ctx context.Context, req *fuse.LookupRequest,
+	resp *fuse.LookupResponse) (node fs.Node, err error) {
+	dd.folder.fs.log.CDebugf(ctx, "DeletedDir Lookup %s", req.Name)
+	defer func() { dd.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+
+	entry, err := libfs.LookupDeletedEntry(
+		ctx, dd.folder.fs.config, dd.folder.getFolderBranch(), req.Name)
+	if err != nil {
+		if isNoSuchNameError(err) {
+			return nil, fuse.ENOENT
+		}
+		return nil, err
+	}
+
+	// Entries expire from the trash, and disappear once restored,
+	// so don't let the kernel cache them.
+	resp.EntryValid = 0
+	return &DeletedEntryNode{folder: dd.folder, entry: entry}, nil
+}
+
+var _ fs.Handle = (*DeletedDir)(nil)
+
+var _ fs.HandleReadDirAller = (*DeletedDir)(nil)
+
+// ReadDirAll implements the fs.HandleReadDirAller interface for
+// DeletedDir.
+func (dd *DeletedDir) ReadDirAll(ctx context.Context) (
+	res []fuse.Dirent, err error) {
+	dd.folder.fs.log.CDebugf(ctx, "DeletedDir ReadDirAll")
+	defer func() { dd.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+
+	entries, err := dd.folder.fs.config.KBFSOps().GetDeletedEntries(
+		ctx, dd.folder.getFolderBranch())
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		fde := fuse.Dirent{
+			Name: libfs.DeletedEntryName(entry),
+		}
+		switch entry.Type {
+		case libkbfs.File, libkbfs.Exec:
+			fde.Type = fuse.DT_File
+		case libkbfs.Dir:
+			fde.Type = fuse.DT_Dir
+		case libkbfs.Sym:
+			fde.Type = fuse.DT_Link
+		}
+		res = append(res, fde)
+	}
+	return res, nil
+}
+
+var _ fs.NodeRenamer = (*DeletedDir)(nil)
+
+// Rename implements the fs.NodeRenamer interface for DeletedDir.  It
+// restores the removed entry under its new name.
+func (dd *DeletedDir) Rename(ctx context.Context, req *fuse.RenameRequest,
+	newDir fs.Node) (err error) {
+	dd.folder.fs.log.CDebugf(ctx, "DeletedDir Rename %s -> %s",
+		req.OldName, req.NewName)
+	defer func() { dd.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+
+	var realNewDir *Dir
+	switch newDir := newDir.(type) {
+	case *Dir:
+		realNewDir = newDir
+	case *TLF:
+		var err error
+		realNewDir, err = newDir.loadDir(ctx)
+		if err != nil {
+			return err
+		}
+	default:
+		// Entries can only be restored into a real directory.
+		return fuse.Errno(syscall.EACCES)
+	}
+
+	entry, err := libfs.LookupDeletedEntry(
+		ctx, dd.folder.fs.config, dd.folder.getFolderBranch(), req.OldName)
+	if err != nil {
+		if isNoSuchNameError(err) {
+			return fuse.ENOENT
+		}
+		return err
+	}
+
+	_, _, err = dd.folder.fs.config.KBFSOps().RestoreDeletedEntry(
+		ctx, entry, realNewDir.node, req.NewName)
+	return err
+}
+
+// DeletedEntryNode represents an entry of a DeletedDir.  It only has
+// attributes; its contents can be read after restoring it.
+type DeletedEntryNode struct {
+	folder *Folder
+	entry  libkbfs.DeletedEntry
+}
+
+var _ fs.Node = (*DeletedEntryNode)(nil)
+
+// Attr implements the fs.Node interface for DeletedEntryNode.
+func (den *DeletedEntryNode) Attr(ctx context.Context, a *fuse.Attr) error {
+	ei := libfs.DeletedEntryInfo(den.entry)
+	if err := den.folder.fillAttrWithUIDAndWritePerm(ctx, &ei, a); err != nil {
+		return err
+	}
+	// Removed entries can only be restored, never modified.
+	a.Mode &^= 0222
+	switch ei.Type {
+	case libkbfs.Dir:
+		a.Mode |= os.ModeDir | 0500
+	case libkbfs.Sym:
+		a.Mode |= os.ModeSymlink | 0500
+	case libkbfs.Exec:
+		a.Mode |= 0500
+	default:
+		a.Mode |= 0400
+	}
+	return nil
+}
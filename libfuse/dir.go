@@ -53,6 +53,14 @@ type Folder struct {
 	// file system.  Sending a struct{}{} on this channel will unpause
 	// the updates.
 	updateChan chan<- struct{}
+
+	// archived is true if this folder holds the nodes of a read-only
+	// view of a past revision of the TLF.
+	archived bool
+	// forgetFromParent, if non-nil, is called once all of an
+	// archived folder's nodes have been forgotten, so that the
+	// directory that made the folder can forget it too.
+	forgetFromParent func()
 }
 
 func newFolder(fl *FolderList, h *libkbfs.TlfHandle,
@@ -127,15 +135,27 @@ func (f *Folder) getFolderBranch() libkbfs.FolderBranch {
 
 // forgetNode forgets a formerly active child with basename name.
 func (f *Folder) forgetNode(node libkbfs.Node) {
-	f.nodesMu.Lock()
-	defer f.nodesMu.Unlock()
+	empty := func() bool {
+		f.nodesMu.Lock()
+		defer f.nodesMu.Unlock()
 
-	delete(f.nodes, node.GetID())
-	if len(f.nodes) == 0 {
+		delete(f.nodes, node.GetID())
+		if len(f.nodes) != 0 {
+			return false
+		}
 		ctx := libkbfs.BackgroundContextWithCancellationDelayer()
 		defer libkbfs.CleanupCancellationDelayer(ctx)
 		f.unsetFolderBranch(ctx)
-		f.list.forgetFolder(string(f.name()))
+		if !f.archived {
+			// Archived folders aren't tracked by the folder list.
+			f.list.forgetFolder(string(f.name()))
+		}
+		return true
+	}()
+	// The parent takes its own lock before nodesMu, so call it
+	// without holding nodesMu.
+	if empty && f.forgetFromParent != nil {
+		f.forgetFromParent()
 	}
 }
 
@@ -340,6 +360,10 @@ func (f *Folder) tlfHandleChangeInvalidate(ctx context.Context,
 
 func (f *Folder) writePermMode(ctx context.Context,
 	original os.FileMode) (os.FileMode, error) {
+	if f.archived {
+		// Nothing in an archived view is writable.
+		return original, nil
+	}
 	f.handleMu.RLock()
 	defer f.handleMu.RUnlock()
 	return libfs.WritePermMode(ctx, original, f.fs.config.KBPKI(), f.h)
@@ -388,6 +412,10 @@ func (f *Folder) access(ctx context.Context, r *fuse.AccessRequest) error {
 		return nil
 	}
 
+	if f.archived {
+		return fuse.EPERM
+	}
+
 	iw, err := f.isWriter(ctx)
 	if err != nil {
 		return nil
@@ -518,6 +546,17 @@ func (d *Dir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.Lo
 		return &SpecialReadFile{fileInfo(nmd).read}, nil
 	}
 
+	if req.Name == libfs.DiskUsageFileName {
+		return NewDiskUsageFile(d, &resp.EntryValid), nil
+	}
+
+	if req.Name == libfs.VersionsDirName {
+		// The set of files changes, so don't let the kernel cache
+		// the listing.
+		resp.EntryValid = 0
+		return newVersionsDir(d), nil
+	}
+
 	newNode, de, err := d.folder.fs.config.KBFSOps().Lookup(ctx, d.node, req.Name)
 	if err != nil {
 		if _, ok := err.(libkbfs.NoSuchNameError); ok {
@@ -711,8 +750,13 @@ func (d *Dir) Rename(ctx context.Context, req *fuse.RenameRequest,
 		return fuse.Errno(syscall.EIO)
 	}
 
+	// The FUSE protocol version negotiated by bazil.org/fuse predates
+	// RENAME2, so the kernel rejects renameat2(2) flags with EINVAL
+	// before a request ever gets here, and every rename that does
+	// arrive is allowed to replace its target.
 	err = d.folder.fs.config.KBFSOps().Rename(ctx,
-		d.node, req.OldName, realNewDir.node, req.NewName)
+		d.node, req.OldName, realNewDir.node, req.NewName,
+		libkbfs.RenameReplace)
 
 	switch e := err.(type) {
 	case nil:
@@ -860,6 +904,38 @@ func (d *Dir) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.
 	return nil
 }
 
+var _ fs.NodeGetxattrer = (*Dir)(nil)
+
+// Getxattr implements the fs.NodeGetxattrer interface for Dir.
+func (d *Dir) Getxattr(ctx context.Context, req *fuse.GetxattrRequest,
+	resp *fuse.GetxattrResponse) error {
+	return d.folder.getxattr(ctx, d.node, req, resp)
+}
+
+var _ fs.NodeListxattrer = (*Dir)(nil)
+
+// Listxattr implements the fs.NodeListxattrer interface for Dir.
+func (d *Dir) Listxattr(ctx context.Context, req *fuse.ListxattrRequest,
+	resp *fuse.ListxattrResponse) error {
+	return d.folder.listxattr(ctx, d.node, req, resp)
+}
+
+var _ fs.NodeSetxattrer = (*Dir)(nil)
+
+// Setxattr implements the fs.NodeSetxattrer interface for Dir.
+func (d *Dir) Setxattr(
+	ctx context.Context, req *fuse.SetxattrRequest) error {
+	return d.folder.setxattr(ctx, d.node, req)
+}
+
+var _ fs.NodeRemovexattrer = (*Dir)(nil)
+
+// Removexattr implements the fs.NodeRemovexattrer interface for Dir.
+func (d *Dir) Removexattr(
+	ctx context.Context, req *fuse.RemovexattrRequest) error {
+	return d.folder.removexattr(ctx, d.node, req)
+}
+
 // Fsync implements the fs.NodeFsyncer interface for Dir.
 func (d *Dir) Fsync(ctx context.Context, req *fuse.FsyncRequest) (err error) {
 	ctx = d.folder.fs.config.MaybeStartTrace(
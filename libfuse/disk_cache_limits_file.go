@@ -0,0 +1,52 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// DiskCacheLimitsFile represents a write-only file where a write
+// replaces the TLF's limits on the disk block cache with the ones
+// written.
+type DiskCacheLimitsFile struct {
+	folder *Folder
+}
+
+var _ fs.Node = (*DiskCacheLimitsFile)(nil)
+
+// Attr implements the fs.Node interface for DiskCacheLimitsFile.
+func (f *DiskCacheLimitsFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Size = 0
+	a.Mode = 0222
+	return nil
+}
+
+var _ fs.Handle = (*DiskCacheLimitsFile)(nil)
+
+var _ fs.HandleWriter = (*DiskCacheLimitsFile)(nil)
+
+// Write implements the fs.HandleWriter interface for DiskCacheLimitsFile.
+func (f *DiskCacheLimitsFile) Write(ctx context.Context, req *fuse.WriteRequest,
+	resp *fuse.WriteResponse) (err error) {
+	f.folder.fs.log.CDebugf(ctx, "DiskCacheLimitsFile Write")
+	defer func() { f.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+	if len(req.Data) == 0 {
+		return nil
+	}
+
+	err = libfs.SetDiskCacheTlfLimits(
+		f.folder.fs.config, f.folder.getFolderBranch(), req.Data)
+	if err != nil {
+		return err
+	}
+
+	resp.Size = len(req.Data)
+	return nil
+}
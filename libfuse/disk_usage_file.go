@@ -0,0 +1,25 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/keybase/kbfs/libfs"
+)
+
+// NewDiskUsageFile returns a special read file that contains a text
+// representation of the recursive disk usage of the given directory.
+func NewDiskUsageFile(
+	dir *Dir, entryValid *time.Duration) *SpecialReadFile {
+	*entryValid = 0
+	return &SpecialReadFile{
+		read: func(ctx context.Context) ([]byte, time.Time, error) {
+			return libfs.GetEncodedDiskUsage(ctx, dir.folder.fs.config, dir.node)
+		},
+	}
+}
@@ -216,6 +216,9 @@ func (f *File) Read(ctx context.Context, req *fuse.ReadRequest,
 	f.folder.fs.log.CDebugf(ctx, "File Read off=%d sz=%d", off, sz)
 	defer func() { f.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
 
+	// Let read-ahead tell this handle's reads apart from those of
+	// any other handle open on the same file.
+	ctx = context.WithValue(ctx, libkbfs.CtxReadHandleKey, req.Handle)
 	n, err := f.folder.fs.config.KBFSOps().Read(
 		ctx, f.node, resp.Data[:sz], off)
 	if err != nil {
@@ -322,6 +325,40 @@ func (f *File) Setattr(ctx context.Context, req *fuse.SetattrRequest,
 	return nil
 }
 
+var _ fs.NodeGetxattrer = (*File)(nil)
+
+// Getxattr implements the fs.NodeGetxattrer interface for File.
+func (f *File) Getxattr(ctx context.Context, req *fuse.GetxattrRequest,
+	resp *fuse.GetxattrResponse) error {
+	return f.folder.getxattr(ctx, f.node, req, resp)
+}
+
+var _ fs.NodeListxattrer = (*File)(nil)
+
+// Listxattr implements the fs.NodeListxattrer interface for File.
+func (f *File) Listxattr(ctx context.Context, req *fuse.ListxattrRequest,
+	resp *fuse.ListxattrResponse) error {
+	return f.folder.listxattr(ctx, f.node, req, resp)
+}
+
+var _ fs.NodeSetxattrer = (*File)(nil)
+
+// Setxattr implements the fs.NodeSetxattrer interface for File.
+func (f *File) Setxattr(
+	ctx context.Context, req *fuse.SetxattrRequest) error {
+	f.eiCache.destroy()
+	return f.folder.setxattr(ctx, f.node, req)
+}
+
+var _ fs.NodeRemovexattrer = (*File)(nil)
+
+// Removexattr implements the fs.NodeRemovexattrer interface for File.
+func (f *File) Removexattr(
+	ctx context.Context, req *fuse.RemovexattrRequest) error {
+	f.eiCache.destroy()
+	return f.folder.removexattr(ctx, f.node, req)
+}
+
 var _ fs.NodeForgetter = (*File)(nil)
 
 // Forget kernel reference to this node.
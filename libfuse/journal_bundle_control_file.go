@@ -0,0 +1,60 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// JournalBundleControlFile is a special file used to export or
+// import a journal bundle at the local path written to it.
+type JournalBundleControlFile struct {
+	folder *Folder
+	action libfs.JournalBundleAction
+}
+
+var _ fs.Node = (*JournalBundleControlFile)(nil)
+
+// Attr implements the fs.Node interface for JournalBundleControlFile.
+func (f *JournalBundleControlFile) Attr(
+	ctx context.Context, a *fuse.Attr) error {
+	a.Size = 0
+	a.Mode = 0222
+	return nil
+}
+
+var _ fs.Handle = (*JournalBundleControlFile)(nil)
+
+var _ fs.HandleWriter = (*JournalBundleControlFile)(nil)
+
+// Write implements the fs.HandleWriter interface for
+// JournalBundleControlFile.
+func (f *JournalBundleControlFile) Write(ctx context.Context,
+	req *fuse.WriteRequest, resp *fuse.WriteResponse) (err error) {
+	f.folder.fs.log.CDebugf(ctx,
+		"JournalBundleControlFile (f.action=%s) Write", f.action)
+	defer func() { f.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+	if len(req.Data) == 0 {
+		return nil
+	}
+
+	jServer, err := libkbfs.GetJournalServer(f.folder.fs.config)
+	if err != nil {
+		return err
+	}
+
+	err = f.action.Execute(
+		ctx, jServer, f.folder.getFolderBranch().Tlf, req.Data)
+	if err != nil {
+		return err
+	}
+
+	resp.Size = len(req.Data)
+	return nil
+}
@@ -3892,3 +3892,196 @@ func TestDirSyncAll(t *testing.T) {
 		t.Fatalf("Expected=%v, got=%v", data, gotData)
 	}
 }
+
+func TestArchivedRevision(t *testing.T) {
+	ctx := libkbfs.BackgroundContextWithCancellationDelayer()
+	defer libkbfs.CleanupCancellationDelayer(ctx)
+	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
+	defer libkbfs.CheckConfigAndShutdown(ctx, t, config)
+	mnt, fs, cancelFn := makeFS(t, ctx, config)
+	defer mnt.Close()
+	defer cancelFn()
+
+	myfile := path.Join(mnt.Dir, PrivateName, "jdoe", "myfile")
+	data1 := []byte("foo")
+	if err := ioutil.WriteFile(myfile, data1, 0644); err != nil {
+		t.Fatal(err)
+	}
+	syncFilename(t, myfile)
+
+	root := libkbfs.GetRootNodeOrBust(ctx, t, config, "jdoe", tlf.Private)
+	md, err := config.MDOps().GetForTLF(ctx, root.GetFolderBranch().Tlf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revDir := path.Join(mnt.Dir, PrivateName, "jdoe",
+		libfs.ArchivedDirName,
+		libfs.ArchivedRevDirPrefix+md.Revision().String())
+
+	data2 := []byte("bar")
+	if err := ioutil.WriteFile(myfile, data2, 0644); err != nil {
+		t.Fatal(err)
+	}
+	syncAll(t, "jdoe", tlf.Private, fs)
+
+	gotData, err := ioutil.ReadFile(path.Join(revDir, "myfile"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data1, gotData) {
+		t.Fatalf("Expected=%v, got=%v", data1, gotData)
+	}
+
+	err = ioutil.WriteFile(path.Join(revDir, "myfile"), data2, 0644)
+	if err == nil {
+		t.Fatal("Write to archived file unexpectedly succeeded")
+	}
+}
+
+func TestDeletedEntryRestore(t *testing.T) {
+	ctx := libkbfs.BackgroundContextWithCancellationDelayer()
+	defer libkbfs.CleanupCancellationDelayer(ctx)
+	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
+	defer libkbfs.CheckConfigAndShutdown(ctx, t, config)
+	mnt, fs, cancelFn := makeFS(t, ctx, config)
+	defer mnt.Close()
+	defer cancelFn()
+	retentionFile := path.Join(mnt.Dir, PrivateName, "jdoe",
+		libfs.SetTrashRetentionFileName)
+	if err := ioutil.WriteFile(
+		retentionFile, []byte("1h"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	myfile := path.Join(mnt.Dir, PrivateName, "jdoe", "myfile")
+	data := []byte("foo")
+	if err := ioutil.WriteFile(myfile, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	syncFilename(t, myfile)
+	if err := ioutil.Remove(myfile); err != nil {
+		t.Fatal(err)
+	}
+	syncAll(t, "jdoe", tlf.Private, fs)
+
+	deletedDir := path.Join(mnt.Dir, PrivateName, "jdoe",
+		libfs.DeletedDirName)
+	fis, err := ioutil.ReadDir(deletedDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fis) != 1 {
+		t.Fatalf("Expected 1 deleted entry, got %d", len(fis))
+	}
+	if !strings.HasPrefix(fis[0].Name(), "myfile"+
+		libfs.DeletedEntryRevSeparator) {
+		t.Fatalf("Unexpected deleted entry name %s", fis[0].Name())
+	}
+
+	if err := ioutil.Rename(
+		path.Join(deletedDir, fis[0].Name()), myfile); err != nil {
+		t.Fatal(err)
+	}
+	gotData, err := ioutil.ReadFile(myfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, gotData) {
+		t.Fatalf("Expected=%v, got=%v", data, gotData)
+	}
+}
+
+func TestFileVersionRestore(t *testing.T) {
+	ctx := libkbfs.BackgroundContextWithCancellationDelayer()
+	defer libkbfs.CleanupCancellationDelayer(ctx)
+	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
+	defer libkbfs.CheckConfigAndShutdown(ctx, t, config)
+	mnt, _, cancelFn := makeFS(t, ctx, config)
+	defer mnt.Close()
+	defer cancelFn()
+
+	myfile := path.Join(mnt.Dir, PrivateName, "jdoe", "myfile")
+	data1 := []byte("foo")
+	if err := ioutil.WriteFile(myfile, data1, 0644); err != nil {
+		t.Fatal(err)
+	}
+	syncFilename(t, myfile)
+	data2 := []byte("barbaz")
+	if err := ioutil.WriteFile(myfile, data2, 0644); err != nil {
+		t.Fatal(err)
+	}
+	syncFilename(t, myfile)
+
+	versionsDir := path.Join(mnt.Dir, PrivateName, "jdoe",
+		libfs.VersionsDirName, "myfile")
+	fis, err := ioutil.ReadDir(versionsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fis) != 2 {
+		t.Fatalf("Expected 2 versions, got %d", len(fis))
+	}
+	var oldName string
+	for _, fi := range fis {
+		if !strings.HasPrefix(fi.Name(), libfs.FileVersionPrefix) {
+			t.Fatalf("Unexpected version name %s", fi.Name())
+		}
+		if fi.Size() == int64(len(data1)) {
+			oldName = fi.Name()
+		}
+	}
+	if oldName == "" {
+		t.Fatalf("No version of size %d", len(data1))
+	}
+
+	if err := ioutil.Rename(
+		path.Join(versionsDir, oldName), myfile); err != nil {
+		t.Fatal(err)
+	}
+	gotData, err := ioutil.ReadFile(myfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data1, gotData) {
+		t.Fatalf("Expected=%v, got=%v", data1, gotData)
+	}
+}
+
+func TestDiskUsageFile(t *testing.T) {
+	ctx := libkbfs.BackgroundContextWithCancellationDelayer()
+	defer libkbfs.CleanupCancellationDelayer(ctx)
+	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
+	defer libkbfs.CheckConfigAndShutdown(ctx, t, config)
+	mnt, _, cancelFn := makeFS(t, ctx, config)
+	defer mnt.Close()
+	defer cancelFn()
+
+	mydir := path.Join(mnt.Dir, PrivateName, "jdoe", "mydir")
+	if err := ioutil.Mkdir(mydir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	myfile := path.Join(mydir, "myfile")
+	data := []byte("foo")
+	if err := ioutil.WriteFile(myfile, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	syncFilename(t, myfile)
+
+	buf, err := ioutil.ReadFile(
+		path.Join(mnt.Dir, PrivateName, "jdoe", libfs.DiskUsageFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var usage libkbfs.DirDiskUsage
+	if err := json.Unmarshal(buf, &usage); err != nil {
+		t.Fatal(err)
+	}
+	if g, e := usage.Children["mydir"].LogicalSize,
+		uint64(len(data)); g != e {
+		t.Errorf("Got logical size %d for mydir, expected %d", g, e)
+	}
+	if usage.Total.EncodedSize <= usage.Children["mydir"].EncodedSize {
+		t.Errorf("The total %d doesn't include the root dir block",
+			usage.Total.EncodedSize)
+	}
+}
@@ -59,6 +59,8 @@ func handleNonTLFSpecialFile(
 		return &PrefetchFile{fs: fs, enable: true}
 	case libfs.DisableBlockPrefetchingFileName:
 		return &PrefetchFile{fs: fs, enable: false}
+	case libfs.SetBandwidthLimitsFileName:
+		return &BandwidthLimitsFile{fs: fs}
 
 	case libfs.EnableDebugServerFileName:
 		return &DebugServerFile{fs: fs, enable: true}
@@ -87,6 +89,9 @@ func handleTLFSpecialFile(
 	case libfs.EditHistoryName:
 		return NewTlfEditHistoryFile(folder, entryValid)
 
+	case libfs.ConflictsFileName:
+		return NewConflictsFile(folder, entryValid)
+
 	case libfs.UnstageFileName:
 		return &UnstageFile{
 			folder: folder,
@@ -113,6 +118,11 @@ func handleTLFSpecialFile(
 			folder: folder,
 		}
 
+	case libfs.SetTrashRetentionFileName:
+		return &TrashRetentionFile{
+			folder: folder,
+		}
+
 	case libfs.SyncFromServerFileName:
 		// Don't cache the node so that the next lookup of
 		// this file will force the dir to be re-checked
@@ -152,6 +162,18 @@ func handleTLFSpecialFile(
 			action: libfs.JournalDisable,
 		}
 
+	case libfs.ExportJournalBundleFileName:
+		return &JournalBundleControlFile{
+			folder: folder,
+			action: libfs.JournalBundleExport,
+		}
+
+	case libfs.ImportJournalBundleFileName:
+		return &JournalBundleControlFile{
+			folder: folder,
+			action: libfs.JournalBundleImport,
+		}
+
 	case libfs.EnableSyncFileName:
 		return &SyncControlFile{
 			folder: folder,
@@ -163,6 +185,53 @@ func handleTLFSpecialFile(
 			folder: folder,
 			action: libfs.SyncDisable,
 		}
+
+	case libfs.EnableManualConflictResolutionFileName:
+		return &ConflictControlFile{
+			folder: folder,
+			action: libfs.ConflictManualEnable,
+		}
+
+	case libfs.DisableManualConflictResolutionFileName:
+		return &ConflictControlFile{
+			folder: folder,
+			action: libfs.ConflictManualDisable,
+		}
+
+	case libfs.ResolveUnmergedFileName:
+		return &ConflictControlFile{
+			folder: folder,
+			action: libfs.ConflictResolveAutomatically,
+		}
+
+	case libfs.AcceptLocalFileName:
+		return &ConflictControlFile{
+			folder: folder,
+			action: libfs.ConflictAcceptLocal,
+		}
+
+	case libfs.AcceptRemoteFileName:
+		return &ConflictControlFile{
+			folder: folder,
+			action: libfs.ConflictAcceptRemote,
+		}
+
+	case libfs.SetDiskCacheLimitsFileName:
+		return &DiskCacheLimitsFile{
+			folder: folder,
+		}
+
+	case libfs.PinFileName:
+		return &PinControlFile{
+			folder: folder,
+			action: libfs.PinAdd,
+		}
+
+	case libfs.UnpinFileName:
+		return &PinControlFile{
+			folder: folder,
+			action: libfs.PinRemove,
+		}
 	}
 
 	return nil
@@ -24,13 +24,20 @@ type TLF struct {
 
 	dirLock sync.RWMutex
 	dir     *Dir
+
+	archivedDir *ArchivedDir
+	deletedDir  *DeletedDir
+	unmerged    *unmergedFolders
 }
 
 func newTLF(fl *FolderList, h *libkbfs.TlfHandle,
 	name libkbfs.PreferredTlfName) *TLF {
 	folder := newFolder(fl, h, name)
 	tlf := &TLF{
-		folder: folder,
+		folder:      folder,
+		archivedDir: newArchivedDir(folder),
+		deletedDir:  newDeletedDir(folder),
+		unmerged:    newUnmergedFolders(folder),
 	}
 	return tlf
 }
@@ -164,6 +171,17 @@ func (tlf *TLF) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.
 		}
 		return nil, fuse.ENOENT
 	}
+	switch req.Name {
+	case libfs.ArchivedDirName:
+		return tlf.archivedDir, nil
+	case libfs.DeletedDirName:
+		return tlf.deletedDir, nil
+	case libfs.UnmergedDirName:
+		// The unmerged changes come and go, so don't let the kernel
+		// cache the entry.
+		resp.EntryValid = 0
+		return tlf.unmerged.lookup(ctx)
+	}
 	return dir.Lookup(ctx, req, resp)
 }
 
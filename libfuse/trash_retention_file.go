@@ -0,0 +1,50 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// TrashRetentionFile represents a write-only file where a write sets
+// the trash retention of the folder to the duration written.
+type TrashRetentionFile struct {
+	folder *Folder
+}
+
+var _ fs.Node = (*TrashRetentionFile)(nil)
+
+// Attr implements the fs.Node interface for TrashRetentionFile.
+func (f *TrashRetentionFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Size = 0
+	a.Mode = 0222
+	return nil
+}
+
+var _ fs.Handle = (*TrashRetentionFile)(nil)
+
+var _ fs.HandleWriter = (*TrashRetentionFile)(nil)
+
+// Write implements the fs.HandleWriter interface for
+// TrashRetentionFile.
+func (f *TrashRetentionFile) Write(ctx context.Context, req *fuse.WriteRequest,
+	resp *fuse.WriteResponse) (err error) {
+	f.folder.fs.log.CDebugf(ctx, "TrashRetentionFile Write")
+	defer func() { f.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+	if len(req.Data) == 0 {
+		return nil
+	}
+	err = libfs.SetTrashRetention(ctx, f.folder.fs.config,
+		f.folder.getFolderBranch(), req.Data)
+	if err != nil {
+		return err
+	}
+	resp.Size = len(req.Data)
+	return nil
+}
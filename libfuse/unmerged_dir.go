@@ -0,0 +1,80 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"sync"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/keybase/kbfs/libkbfs"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// unmergedFolders keeps track of the folders holding the nodes of
+// read-only views of a TLF's local changes that were set aside for
+// manual conflict resolution.  The view is pinned to the head of the
+// unmerged branch, so each version of the branch gets its own
+// folder.
+type unmergedFolders struct {
+	folder *Folder
+
+	lock    sync.Mutex
+	folders map[libkbfs.FolderBranch]*Folder
+}
+
+func newUnmergedFolders(folder *Folder) *unmergedFolders {
+	return &unmergedFolders{
+		folder:  folder,
+		folders: make(map[libkbfs.FolderBranch]*Folder),
+	}
+}
+
+// lookup returns the root directory of the current view of the
+// TLF's unmerged changes, or ENOENT if there aren't any.
+func (uf *unmergedFolders) lookup(ctx context.Context) (
+	node fs.Node, err error) {
+	uf.folder.fs.log.CDebugf(ctx, "Unmerged dir Lookup")
+	defer func() { uf.folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+
+	uf.folder.handleMu.RLock()
+	h := uf.folder.h
+	name := uf.folder.hPreferredName
+	uf.folder.handleMu.RUnlock()
+
+	rootNode, _, err := uf.folder.fs.config.KBFSOps().GetUnmergedRootNode(
+		ctx, h)
+	if _, ok := errors.Cause(err).(libkbfs.NoUnmergedChangesError); ok {
+		return nil, fuse.ENOENT
+	} else if err != nil {
+		return nil, err
+	}
+
+	fb := rootNode.GetFolderBranch()
+	uf.lock.Lock()
+	defer uf.lock.Unlock()
+	f, ok := uf.folders[fb]
+	if !ok {
+		f = newFolder(uf.folder.list, h, name)
+		f.archived = true
+		uf.folders[fb] = f
+	}
+
+	f.nodesMu.Lock()
+	defer f.nodesMu.Unlock()
+	if n, ok := f.nodes[rootNode.GetID()]; ok {
+		return n, nil
+	}
+	if f.getFolderBranch() == (libkbfs.FolderBranch{}) {
+		err = f.setFolderBranch(fb)
+		if err != nil {
+			return nil, err
+		}
+	}
+	child := newDir(f, rootNode)
+	f.nodes[rootNode.GetID()] = child
+	return child, nil
+}
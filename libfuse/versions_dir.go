@@ -0,0 +1,240 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"os"
+	"syscall"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// VersionsDir is a node that contains one FileVersionsDir for each
+// file in its directory.
+type VersionsDir struct {
+	dir *Dir
+}
+
+func newVersionsDir(dir *Dir) *VersionsDir {
+	return &VersionsDir{dir: dir}
+}
+
+var _ fs.Node = (*VersionsDir)(nil)
+
+// Attr implements the fs.Node interface for VersionsDir.
+func (vd *VersionsDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeDir | 0700
+	a.Uid = uint32(os.Getuid())
+	return nil
+}
+
+// lookupFile looks up the node of the named file in the directory.
+func (vd *VersionsDir) lookupFile(ctx context.Context, name string) (
+	libkbfs.Node, libkbfs.EntryInfo, error) {
+	n, ei, err := vd.dir.folder.fs.config.KBFSOps().Lookup(
+		ctx, vd.dir.node, name)
+	if err != nil {
+		if isNoSuchNameError(err) {
+			return nil, libkbfs.EntryInfo{}, fuse.ENOENT
+		}
+		return nil, libkbfs.EntryInfo{}, err
+	}
+	if !ei.Type.IsFile() {
+		return nil, libkbfs.EntryInfo{}, fuse.ENOENT
+	}
+	return n, ei, nil
+}
+
+var _ fs.NodeRequestLookuper = (*VersionsDir)(nil)
+
+// Lookup implements the fs.NodeRequestLookuper interface for
+// VersionsDir.
+func (vd *VersionsDir) Lookup(ctx context.Context, req *fuse.LookupRequest,
+	resp *fuse.LookupResponse) (node fs.Node, err error) {
+	folder := vd.dir.folder
+	folder.fs.log.CDebugf(ctx, "VersionsDir Lookup %s", req.Name)
+	defer func() { folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+
+	n, ei, err := vd.lookupFile(ctx, req.Name)
+	if err != nil {
+		return nil, err
+	}
+	resp.EntryValid = 0
+	return &FileVersionsDir{
+		parent: vd, file: n, fileType: ei.Type}, nil
+}
+
+var _ fs.Handle = (*VersionsDir)(nil)
+
+var _ fs.HandleReadDirAller = (*VersionsDir)(nil)
+
+// ReadDirAll implements the fs.HandleReadDirAller interface for
+// VersionsDir.
+func (vd *VersionsDir) ReadDirAll(ctx context.Context) (
+	res []fuse.Dirent, err error) {
+	folder := vd.dir.folder
+	folder.fs.log.CDebugf(ctx, "VersionsDir ReadDirAll")
+	defer func() { folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+
+	children, err := folder.fs.config.KBFSOps().GetDirChildren(
+		ctx, vd.dir.node)
+	if err != nil {
+		return nil, err
+	}
+	for name, ei := range children {
+		if !ei.Type.IsFile() {
+			continue
+		}
+		res = append(res, fuse.Dirent{Type: fuse.DT_Dir, Name: name})
+	}
+	return res, nil
+}
+
+// FileVersionsDir is a node that lists the recent versions of a
+// file.  Renaming one of its entries onto the file restores that
+// version.
+type FileVersionsDir struct {
+	parent   *VersionsDir
+	file     libkbfs.Node
+	fileType libkbfs.EntryType
+}
+
+var _ fs.Node = (*FileVersionsDir)(nil)
+
+// Attr implements the fs.Node interface for FileVersionsDir.
+func (fvd *FileVersionsDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeDir | 0700
+	a.Uid = uint32(os.Getuid())
+	return nil
+}
+
+var _ fs.NodeRequestLookuper = (*FileVersionsDir)(nil)
+
+// Lookup implements the fs.NodeRequestLookuper interface for
+// FileVersionsDir.
+func (fvd *FileVersionsDir) Lookup(ctx context.Context,
+	req *fuse.LookupRequest, resp *fuse.LookupResponse) (
+	node fs.Node, err error) {
+	folder := fvd.parent.dir.folder
+	folder.fs.log.CDebugf(ctx, "FileVersionsDir Lookup %s", req.Name)
+	defer func() { folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+
+	version, err := libfs.LookupFileVersion(
+		ctx, folder.fs.config, fvd.file, req.Name)
+	if err != nil {
+		if isNoSuchNameError(err) {
+			return nil, fuse.ENOENT
+		}
+		return nil, err
+	}
+
+	// Versions expire, so don't let the kernel cache them.
+	resp.EntryValid = 0
+	return &FileVersionNode{
+		folder: folder, version: version, fileType: fvd.fileType}, nil
+}
+
+var _ fs.Handle = (*FileVersionsDir)(nil)
+
+var _ fs.HandleReadDirAller = (*FileVersionsDir)(nil)
+
+// ReadDirAll implements the fs.HandleReadDirAller interface for
+// FileVersionsDir.
+func (fvd *FileVersionsDir) ReadDirAll(ctx context.Context) (
+	res []fuse.Dirent, err error) {
+	folder := fvd.parent.dir.folder
+	folder.fs.log.CDebugf(ctx, "FileVersionsDir ReadDirAll")
+	defer func() { folder.reportErr(ctx, libkbfs.ReadMode, err) }()
+
+	versions, err := folder.fs.config.KBFSOps().GetFileVersions(
+		ctx, fvd.file)
+	if err != nil {
+		return nil, err
+	}
+	for _, version := range versions {
+		res = append(res, fuse.Dirent{
+			Type: fuse.DT_File,
+			Name: libfs.FileVersionName(version),
+		})
+	}
+	return res, nil
+}
+
+var _ fs.NodeRenamer = (*FileVersionsDir)(nil)
+
+// Rename implements the fs.NodeRenamer interface for
+// FileVersionsDir.  It restores the version, which can only be
+// renamed onto its own file.
+func (fvd *FileVersionsDir) Rename(ctx context.Context,
+	req *fuse.RenameRequest, newDir fs.Node) (err error) {
+	folder := fvd.parent.dir.folder
+	folder.fs.log.CDebugf(ctx, "FileVersionsDir Rename %s -> %s",
+		req.OldName, req.NewName)
+	defer func() { folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+
+	var realNewDir *Dir
+	switch newDir := newDir.(type) {
+	case *Dir:
+		realNewDir = newDir
+	case *TLF:
+		var err error
+		realNewDir, err = newDir.loadDir(ctx)
+		if err != nil {
+			return err
+		}
+	default:
+		return fuse.Errno(syscall.EACCES)
+	}
+	target, _, err := folder.fs.config.KBFSOps().Lookup(
+		ctx, realNewDir.node, req.NewName)
+	if err != nil && !isNoSuchNameError(err) {
+		return err
+	}
+	if target == nil || target.GetID() != fvd.file.GetID() {
+		// Versions can only be restored onto their own file.
+		return fuse.Errno(syscall.EACCES)
+	}
+
+	version, err := libfs.LookupFileVersion(
+		ctx, folder.fs.config, fvd.file, req.OldName)
+	if err != nil {
+		if isNoSuchNameError(err) {
+			return fuse.ENOENT
+		}
+		return err
+	}
+	return folder.fs.config.KBFSOps().RestoreFileVersion(
+		ctx, fvd.file, version)
+}
+
+// FileVersionNode represents an entry of a FileVersionsDir.  It only
+// has attributes; its contents can be read after restoring it.
+type FileVersionNode struct {
+	folder   *Folder
+	version  libkbfs.FileVersion
+	fileType libkbfs.EntryType
+}
+
+var _ fs.Node = (*FileVersionNode)(nil)
+
+// Attr implements the fs.Node interface for FileVersionNode.
+func (fvn *FileVersionNode) Attr(ctx context.Context, a *fuse.Attr) error {
+	ei := libfs.FileVersionInfo(fvn.version, fvn.fileType)
+	if err := fvn.folder.fillAttrWithUIDAndWritePerm(ctx, &ei, a); err != nil {
+		return err
+	}
+	// Old versions can only be restored, never modified.
+	a.Mode &^= 0222
+	if ei.Type == libkbfs.Exec {
+		a.Mode |= 0500
+	} else {
+		a.Mode |= 0400
+	}
+	return nil
+}
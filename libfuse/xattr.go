@@ -0,0 +1,125 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"fmt"
+
+	"bazil.org/fuse"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// These are the same on Linux and OS X.
+const (
+	xattrCreate  = 0x1
+	xattrReplace = 0x2
+)
+
+// reportXattrErr reports the given error, unless it just means that
+// a requested attribute doesn't exist, which happens all the time
+// during normal operation (e.g., Finder and `ls` probing for
+// attributes they know about).
+func (f *Folder) reportXattrErr(ctx context.Context,
+	mode libkbfs.ErrorModeType, err error) {
+	if _, ok := err.(libkbfs.NoSuchXattrError); ok {
+		f.fs.log.CDebugf(ctx, "No such xattr: %v", err)
+		return
+	}
+	f.reportErr(ctx, mode, err)
+}
+
+func (f *Folder) getxattr(ctx context.Context, node libkbfs.Node,
+	req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) (err error) {
+	ctx = f.fs.config.MaybeStartTrace(ctx, "Node.Getxattr",
+		fmt.Sprintf("%s %s", node.GetBasename(), req.Name))
+	defer func() { f.fs.config.MaybeFinishTrace(ctx, err) }()
+
+	f.fs.log.CDebugf(ctx, "Getxattr %s", req.Name)
+	defer func() { f.reportXattrErr(ctx, libkbfs.ReadMode, err) }()
+
+	value, err := f.fs.config.KBFSOps().GetXattr(ctx, node, req.Name)
+	if err != nil {
+		return err
+	}
+	// A non-zero position is only used by OS X, for resource forks.
+	if int(req.Position) > len(value) {
+		return fuse.ERANGE
+	}
+	resp.Xattr = value[req.Position:]
+	return nil
+}
+
+func (f *Folder) listxattr(ctx context.Context, node libkbfs.Node,
+	req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) (err error) {
+	ctx = f.fs.config.MaybeStartTrace(
+		ctx, "Node.Listxattr", node.GetBasename())
+	defer func() { f.fs.config.MaybeFinishTrace(ctx, err) }()
+
+	f.fs.log.CDebugf(ctx, "Listxattr")
+	defer func() { f.reportErr(ctx, libkbfs.ReadMode, err) }()
+
+	names, err := f.fs.config.KBFSOps().ListXattrs(ctx, node)
+	if err != nil {
+		return err
+	}
+	resp.Append(names...)
+	return nil
+}
+
+func (f *Folder) setxattr(ctx context.Context, node libkbfs.Node,
+	req *fuse.SetxattrRequest) (err error) {
+	ctx = f.fs.config.MaybeStartTrace(ctx, "Node.Setxattr",
+		fmt.Sprintf("%s %s", node.GetBasename(), req.Name))
+	defer func() { f.fs.config.MaybeFinishTrace(ctx, err) }()
+
+	f.fs.log.CDebugf(ctx, "Setxattr %s flags=%d pos=%d",
+		req.Name, req.Flags, req.Position)
+	defer func() { f.reportXattrErr(ctx, libkbfs.WriteMode, err) }()
+
+	flag := libkbfs.XattrSet
+	switch {
+	case req.Flags&xattrCreate != 0:
+		flag = libkbfs.XattrCreate
+	case req.Flags&xattrReplace != 0:
+		flag = libkbfs.XattrReplace
+	}
+
+	kbfsOps := f.fs.config.KBFSOps()
+	value := req.Xattr
+	if req.Position > 0 {
+		// OS X writes large resource forks in chunks, so splice
+		// this one into the existing value.  The create flag only
+		// applies to the first chunk.
+		old, err := kbfsOps.GetXattr(ctx, node, req.Name)
+		if err != nil {
+			return err
+		}
+		if int(req.Position) > len(old) {
+			return fuse.ERANGE
+		}
+		end := int(req.Position) + len(req.Xattr)
+		if end < len(old) {
+			end = len(old)
+		}
+		value = make([]byte, end)
+		copy(value, old)
+		copy(value[req.Position:], req.Xattr)
+		flag = libkbfs.XattrSet
+	}
+	return kbfsOps.SetXattr(ctx, node, req.Name, value, flag)
+}
+
+func (f *Folder) removexattr(ctx context.Context, node libkbfs.Node,
+	req *fuse.RemovexattrRequest) (err error) {
+	ctx = f.fs.config.MaybeStartTrace(ctx, "Node.Removexattr",
+		fmt.Sprintf("%s %s", node.GetBasename(), req.Name))
+	defer func() { f.fs.config.MaybeFinishTrace(ctx, err) }()
+
+	f.fs.log.CDebugf(ctx, "Removexattr %s", req.Name)
+	defer func() { f.reportXattrErr(ctx, libkbfs.WriteMode, err) }()
+
+	return f.fs.config.KBFSOps().RemoveXattr(ctx, node, req.Name)
+}
@@ -0,0 +1,66 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"bytes"
+	"path"
+	"syscall"
+	"testing"
+
+	"github.com/keybase/kbfs/ioutil"
+	"github.com/keybase/kbfs/libkbfs"
+)
+
+func TestXattrs(t *testing.T) {
+	ctx := libkbfs.BackgroundContextWithCancellationDelayer()
+	defer libkbfs.CleanupCancellationDelayer(ctx)
+	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
+	defer libkbfs.CheckConfigAndShutdown(ctx, t, config)
+	mnt, _, cancelFn := makeFS(t, ctx, config)
+	defer mnt.Close()
+	defer cancelFn()
+
+	p := path.Join(mnt.Dir, PrivateName, "jdoe", "myfile")
+	const input = "hello, world\n"
+	if err := ioutil.WriteFile(p, []byte(input), 0644); err != nil {
+		t.Fatal(err)
+	}
+	syncFilename(t, p)
+
+	if err := syscall.Setxattr(p, "user.tag", []byte("red"), 0); err != nil {
+		t.Fatal(err)
+	}
+	// XATTR_CREATE on an existing attribute must fail.
+	err := syscall.Setxattr(p, "user.tag", []byte("blue"), xattrCreate)
+	if err != syscall.EEXIST {
+		t.Fatalf("Unexpected error on create of existing xattr: %v", err)
+	}
+
+	buf := make([]byte, 64)
+	n, err := syscall.Getxattr(p, "user.tag", buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, e := string(buf[:n]), "red"; g != e {
+		t.Errorf("wrong xattr value: %q != %q", g, e)
+	}
+
+	n, err = syscall.Listxattr(p, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, e := buf[:n], []byte("user.tag\x00"); !bytes.Equal(g, e) {
+		t.Errorf("wrong xattr list: %q != %q", g, e)
+	}
+
+	if err := syscall.Removexattr(p, "user.tag"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = syscall.Getxattr(p, "user.tag", buf)
+	if err != syscall.ENODATA {
+		t.Fatalf("Unexpected error on get of removed xattr: %v", err)
+	}
+}
@@ -0,0 +1,360 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	metrics "github.com/rcrowley/go-metrics"
+	"golang.org/x/net/context"
+)
+
+// bandwidthBurstDuration is how much unused bandwidth can be saved
+// up and then used all at once, after an idle period.
+const bandwidthBurstDuration = time.Second
+
+// BandwidthScheduleEntry overrides the default bandwidth limits
+// during part of each day.
+type BandwidthScheduleEntry struct {
+	// Start and End are offsets from local midnight.  If End is
+	// before Start, the entry wraps around midnight.
+	Start, End time.Duration
+	// UploadKBps and DownloadKBps are the limits in effect during
+	// this part of the day, in KiB/s.  Zero means unlimited.
+	UploadKBps, DownloadKBps int
+}
+
+func (bse BandwidthScheduleEntry) contains(t time.Time) bool {
+	midnight := time.Date(
+		t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	offset := t.Sub(midnight)
+	if bse.Start <= bse.End {
+		return offset >= bse.Start && offset < bse.End
+	}
+	return offset >= bse.Start || offset < bse.End
+}
+
+// BandwidthLimits describes how fast KBFS may upload blocks to, and
+// download blocks from, the block server.
+type BandwidthLimits struct {
+	// UploadKBps and DownloadKBps are the limits in KiB/s, whenever
+	// no schedule entry applies.  Zero means unlimited.
+	UploadKBps, DownloadKBps int
+	// Schedule lists time-of-day overrides; the first entry that
+	// contains the current time applies.
+	Schedule []BandwidthScheduleEntry
+}
+
+// IsLimited returns whether these limits ever restrict bandwidth.
+func (bl BandwidthLimits) IsLimited() bool {
+	if bl.UploadKBps > 0 || bl.DownloadKBps > 0 {
+		return true
+	}
+	for _, entry := range bl.Schedule {
+		if entry.UploadKBps > 0 || entry.DownloadKBps > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// ratesAt returns the upload and download limits, in KiB/s, in
+// effect at the given time.
+func (bl BandwidthLimits) ratesAt(t time.Time) (upKBps, downKBps int) {
+	for _, entry := range bl.Schedule {
+		if entry.contains(t) {
+			return entry.UploadKBps, entry.DownloadKBps
+		}
+	}
+	return bl.UploadKBps, bl.DownloadKBps
+}
+
+func formatTimeOfDay(d time.Duration) string {
+	return fmt.Sprintf("%02d:%02d", int(d/time.Hour), int(d%time.Hour/time.Minute))
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, errors.Errorf("Bad time of day %q", s)
+	}
+	return time.Duration(t.Hour())*time.Hour +
+		time.Duration(t.Minute())*time.Minute, nil
+}
+
+// String implements the fmt.Stringer interface for BandwidthLimits.
+// The result can be parsed by ParseBandwidthLimits.
+func (bl BandwidthLimits) String() string {
+	parts := []string{
+		fmt.Sprintf("up=%d,down=%d", bl.UploadKBps, bl.DownloadKBps)}
+	for _, entry := range bl.Schedule {
+		parts = append(parts, fmt.Sprintf("%s-%s up=%d,down=%d",
+			formatTimeOfDay(entry.Start), formatTimeOfDay(entry.End),
+			entry.UploadKBps, entry.DownloadKBps))
+	}
+	return strings.Join(parts, ";")
+}
+
+// parseBandwidthRates parses a comma-separated list of "up=N" and
+// "down=N" rates, in KiB/s, into the given ints.
+func parseBandwidthRates(s string, upKBps, downKBps *int) error {
+	for _, rate := range strings.Split(s, ",") {
+		rate = strings.TrimSpace(rate)
+		if rate == "" {
+			continue
+		}
+		kv := strings.SplitN(rate, "=", 2)
+		if len(kv) != 2 {
+			return errors.Errorf("Bad bandwidth rate %q", rate)
+		}
+		kbps, err := strconv.Atoi(strings.TrimSpace(kv[1]))
+		if err != nil || kbps < 0 {
+			return errors.Errorf("Bad bandwidth rate %q", rate)
+		}
+		switch strings.TrimSpace(kv[0]) {
+		case "up":
+			*upKBps = kbps
+		case "down":
+			*downKBps = kbps
+		default:
+			return errors.Errorf("Unknown bandwidth direction in %q", rate)
+		}
+	}
+	return nil
+}
+
+// ParseBandwidthLimits parses bandwidth limits from a string like
+// "up=1024,down=4096;09:00-17:30 up=128".  Rates are in KiB/s, and 0
+// means unlimited.  The part without a time range sets the default
+// limits, and each part with a time range (in local time) adds a
+// schedule entry.  Rates left out of a schedule entry are the same
+// as the default ones.
+func ParseBandwidthLimits(s string) (BandwidthLimits, error) {
+	var limits BandwidthLimits
+	var scheduled []string
+	for _, part := range strings.Split(s, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if part[0] < '0' || part[0] > '9' {
+			// No time range, so these are the defaults.
+			err := parseBandwidthRates(
+				part, &limits.UploadKBps, &limits.DownloadKBps)
+			if err != nil {
+				return BandwidthLimits{}, err
+			}
+			continue
+		}
+		scheduled = append(scheduled, part)
+	}
+
+	for _, part := range scheduled {
+		fields := strings.SplitN(part, " ", 2)
+		times := strings.Split(fields[0], "-")
+		if len(times) != 2 {
+			return BandwidthLimits{}, errors.Errorf(
+				"Bad bandwidth schedule entry %q", part)
+		}
+		entry := BandwidthScheduleEntry{
+			UploadKBps:   limits.UploadKBps,
+			DownloadKBps: limits.DownloadKBps,
+		}
+		var err error
+		entry.Start, err = parseTimeOfDay(times[0])
+		if err != nil {
+			return BandwidthLimits{}, err
+		}
+		entry.End, err = parseTimeOfDay(times[1])
+		if err != nil {
+			return BandwidthLimits{}, err
+		}
+		if len(fields) == 2 {
+			err := parseBandwidthRates(
+				fields[1], &entry.UploadKBps, &entry.DownloadKBps)
+			if err != nil {
+				return BandwidthLimits{}, err
+			}
+		}
+		limits.Schedule = append(limits.Schedule, entry)
+	}
+	return limits, nil
+}
+
+// tokenBucket tracks how many bytes may be transferred right away,
+// at a given rate.  It allows the number of available tokens to go
+// negative, so that transfers bigger than the burst size are just
+// delayed for longer.  It is not goroutine-safe.
+type tokenBucket struct {
+	bytesPerSec float64
+	tokens      float64
+	last        time.Time
+}
+
+// take reserves `n` bytes at the given rate, and returns how long
+// the caller must wait before transferring them.  A rate of 0
+// means unlimited.
+func (tb *tokenBucket) take(now time.Time, kbps int, n int) time.Duration {
+	bytesPerSec := float64(kbps) * 1024
+	burst := bytesPerSec * bandwidthBurstDuration.Seconds()
+	if bytesPerSec != tb.bytesPerSec {
+		// Start over with a full bucket whenever the rate changes.
+		tb.bytesPerSec = bytesPerSec
+		tb.tokens = burst
+		tb.last = now
+	}
+	if bytesPerSec == 0 {
+		return 0
+	}
+
+	if now.After(tb.last) {
+		tb.tokens += now.Sub(tb.last).Seconds() * bytesPerSec
+		if tb.tokens > burst {
+			tb.tokens = burst
+		}
+		tb.last = now
+	}
+	tb.tokens -= float64(n)
+	if tb.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-tb.tokens / bytesPerSec * float64(time.Second))
+}
+
+// giveBack returns `n` bytes reserved by a transfer that never
+// happened.
+func (tb *tokenBucket) giveBack(n int) {
+	if tb.bytesPerSec != 0 {
+		tb.tokens += float64(n)
+	}
+}
+
+// BandwidthLimiterStatus describes the current state of a
+// BandwidthLimiter.
+type BandwidthLimiterStatus struct {
+	Limits                string
+	CurrentUploadKBps     int
+	CurrentDownloadKBps   int
+	UploadThrottledTime   time.Duration
+	DownloadThrottledTime time.Duration
+}
+
+// BandwidthLimiter delays block uploads and downloads to keep them
+// within the configured BandwidthLimits.  It is goroutine-safe.
+type BandwidthLimiter struct {
+	clock     Clock
+	upTimer   metrics.Timer
+	downTimer metrics.Timer
+
+	lock          sync.Mutex
+	limits        BandwidthLimits
+	up            tokenBucket
+	down          tokenBucket
+	upThrottled   time.Duration
+	downThrottled time.Duration
+}
+
+// NewBandwidthLimiter constructs a new BandwidthLimiter with no
+// limits.  If `r` is non-nil, the time spent throttled is recorded
+// in it.
+func NewBandwidthLimiter(clock Clock, r metrics.Registry) *BandwidthLimiter {
+	bl := &BandwidthLimiter{clock: clock}
+	if r != nil {
+		bl.upTimer = metrics.GetOrRegisterTimer(
+			"BandwidthLimiter.UploadThrottled", r)
+		bl.downTimer = metrics.GetOrRegisterTimer(
+			"BandwidthLimiter.DownloadThrottled", r)
+	}
+	return bl
+}
+
+// Limits returns the limits currently in effect.
+func (bl *BandwidthLimiter) Limits() BandwidthLimits {
+	bl.lock.Lock()
+	defer bl.lock.Unlock()
+	return bl.limits
+}
+
+// SetLimits replaces the limits currently in effect.
+func (bl *BandwidthLimiter) SetLimits(limits BandwidthLimits) {
+	bl.lock.Lock()
+	defer bl.lock.Unlock()
+	bl.limits = limits
+}
+
+// Status returns the current state of the limiter.
+func (bl *BandwidthLimiter) Status() BandwidthLimiterStatus {
+	bl.lock.Lock()
+	defer bl.lock.Unlock()
+	upKBps, downKBps := bl.limits.ratesAt(bl.clock.Now())
+	return BandwidthLimiterStatus{
+		Limits:                bl.limits.String(),
+		CurrentUploadKBps:     upKBps,
+		CurrentDownloadKBps:   downKBps,
+		UploadThrottledTime:   bl.upThrottled,
+		DownloadThrottledTime: bl.downThrottled,
+	}
+}
+
+func (bl *BandwidthLimiter) wait(
+	ctx context.Context, n int, upload bool) error {
+	var delay time.Duration
+	var timer metrics.Timer
+	func() {
+		bl.lock.Lock()
+		defer bl.lock.Unlock()
+		now := bl.clock.Now()
+		upKBps, downKBps := bl.limits.ratesAt(now)
+		if upload {
+			delay = bl.up.take(now, upKBps, n)
+			bl.upThrottled += delay
+			timer = bl.upTimer
+		} else {
+			delay = bl.down.take(now, downKBps, n)
+			bl.downThrottled += delay
+			timer = bl.downTimer
+		}
+	}()
+	if delay <= 0 {
+		return nil
+	}
+	if timer != nil {
+		timer.Update(delay)
+	}
+
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		bl.lock.Lock()
+		defer bl.lock.Unlock()
+		if upload {
+			bl.up.giveBack(n)
+		} else {
+			bl.down.giveBack(n)
+		}
+		return ctx.Err()
+	}
+}
+
+// WaitForUpload blocks until `n` more bytes can be uploaded without
+// exceeding the upload limit, or until `ctx` is canceled.
+func (bl *BandwidthLimiter) WaitForUpload(ctx context.Context, n int) error {
+	return bl.wait(ctx, n, true)
+}
+
+// WaitForDownload blocks until `n` more bytes can be downloaded
+// without exceeding the download limit, or until `ctx` is canceled.
+func (bl *BandwidthLimiter) WaitForDownload(
+	ctx context.Context, n int) error {
+	return bl.wait(ctx, n, false)
+}
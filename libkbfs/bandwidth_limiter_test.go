@@ -0,0 +1,145 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestParseBandwidthLimits(t *testing.T) {
+	limits, err := ParseBandwidthLimits(
+		"09:00-17:30 up=128; up=1024,down=4096;22:00-06:00 down=0")
+	require.NoError(t, err)
+	expected := BandwidthLimits{
+		UploadKBps:   1024,
+		DownloadKBps: 4096,
+		Schedule: []BandwidthScheduleEntry{
+			{
+				Start:        9 * time.Hour,
+				End:          17*time.Hour + 30*time.Minute,
+				UploadKBps:   128,
+				DownloadKBps: 4096,
+			},
+			{
+				Start:        22 * time.Hour,
+				End:          6 * time.Hour,
+				UploadKBps:   1024,
+				DownloadKBps: 0,
+			},
+		},
+	}
+	require.Equal(t, expected, limits)
+	require.True(t, limits.IsLimited())
+
+	t.Log("String() output can be parsed back")
+	require.Equal(t,
+		"up=1024,down=4096;09:00-17:30 up=128,down=4096;"+
+			"22:00-06:00 up=1024,down=0", limits.String())
+	limits2, err := ParseBandwidthLimits(limits.String())
+	require.NoError(t, err)
+	require.Equal(t, limits, limits2)
+
+	limits, err = ParseBandwidthLimits("")
+	require.NoError(t, err)
+	require.False(t, limits.IsLimited())
+
+	for _, bad := range []string{
+		"up", "up=x", "up=-1", "sideways=1", "9:00 up=1", "25:00-01:00 up=1",
+	} {
+		_, err := ParseBandwidthLimits(bad)
+		require.Error(t, err, bad)
+	}
+}
+
+func TestBandwidthLimitsSchedule(t *testing.T) {
+	limits, err := ParseBandwidthLimits(
+		"up=1024,down=4096;09:00-17:00 up=128;22:00-06:00 down=0")
+	require.NoError(t, err)
+	at := func(hour, min int) time.Time {
+		return time.Date(2018, 3, 1, hour, min, 0, 0, time.Local)
+	}
+
+	up, down := limits.ratesAt(at(8, 59))
+	require.Equal(t, 1024, up)
+	require.Equal(t, 4096, down)
+	up, down = limits.ratesAt(at(9, 0))
+	require.Equal(t, 128, up)
+	require.Equal(t, 4096, down)
+	up, _ = limits.ratesAt(at(17, 0))
+	require.Equal(t, 1024, up)
+
+	t.Log("Schedule entries can wrap around midnight")
+	_, down = limits.ratesAt(at(23, 0))
+	require.Equal(t, 0, down)
+	_, down = limits.ratesAt(at(5, 59))
+	require.Equal(t, 0, down)
+	_, down = limits.ratesAt(at(6, 0))
+	require.Equal(t, 4096, down)
+}
+
+func TestTokenBucket(t *testing.T) {
+	var tb tokenBucket
+	now := time.Now()
+
+	t.Log("Unlimited never waits")
+	require.Equal(t, time.Duration(0), tb.take(now, 0, 1<<30))
+
+	t.Log("A full burst can go right away")
+	require.Equal(t, time.Duration(0), tb.take(now, 1, 1024))
+	t.Log("Going over the rate waits until the bytes are paid for")
+	require.Equal(t, 2*time.Second, tb.take(now, 1, 2048))
+	now = now.Add(time.Second)
+	require.Equal(t, 2*time.Second, tb.take(now, 1, 1024))
+
+	t.Log("Giving back bandwidth shortens the wait")
+	tb.giveBack(2048)
+	require.Equal(t, 2*time.Second, tb.take(now, 1, 2048))
+
+	t.Log("Idle time only saves up one burst")
+	now = now.Add(time.Hour)
+	require.Equal(t, time.Duration(0), tb.take(now, 1, 1024))
+	require.Equal(t, time.Second, tb.take(now, 1, 1024))
+
+	t.Log("Changing the rate starts over")
+	require.Equal(t, time.Duration(0), tb.take(now, 2, 2048))
+}
+
+func TestBandwidthLimiterWait(t *testing.T) {
+	clock := newTestClockNow()
+	bl := NewBandwidthLimiter(clock, nil)
+	ctx := context.Background()
+
+	t.Log("No limits by default")
+	err := bl.WaitForUpload(ctx, 1<<30)
+	require.NoError(t, err)
+	err = bl.WaitForDownload(ctx, 1<<30)
+	require.NoError(t, err)
+
+	bl.SetLimits(BandwidthLimits{UploadKBps: 1})
+	err = bl.WaitForUpload(ctx, 1024)
+	require.NoError(t, err)
+	err = bl.WaitForDownload(ctx, 1<<30)
+	require.NoError(t, err)
+
+	canceledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	err = bl.WaitForUpload(canceledCtx, 1024)
+	require.Equal(t, context.Canceled, err)
+
+	status := bl.Status()
+	require.Equal(t, "up=1,down=0", status.Limits)
+	require.Equal(t, 1, status.CurrentUploadKBps)
+	require.Equal(t, time.Second, status.UploadThrottledTime)
+	require.Equal(t, time.Duration(0), status.DownloadThrottledTime)
+
+	t.Log("The canceled upload gave its bandwidth back")
+	clock.Add(time.Second)
+	err = bl.WaitForUpload(ctx, 1024)
+	require.NoError(t, err)
+}
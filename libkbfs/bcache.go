@@ -383,3 +383,19 @@ func (b *BlockCacheStandard) DeleteKnownPtr(tlf tlf.ID, block *FileBlock) error
 	b.ids.Remove(key)
 	return nil
 }
+
+// noDedupBlockCache is a BlockCache that never reports a known
+// pointer for a block, so that readying a block always makes a new
+// block instead of a new reference to an existing one.
+type noDedupBlockCache struct {
+	BlockCache
+}
+
+var _ BlockCache = noDedupBlockCache{}
+
+// CheckForKnownPtr implements the BlockCache interface for
+// noDedupBlockCache.
+func (c noDedupBlockCache) CheckForKnownPtr(
+	_ tlf.ID, _ *FileBlock) (BlockPointer, error) {
+	return BlockPointer{}, nil
+}
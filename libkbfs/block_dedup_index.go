@@ -0,0 +1,392 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"path/filepath"
+	"sync"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/kbfsblock"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/keybase/kbfs/kbfshash"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+const (
+	blockDedupIndexFolderName     string = "kbfs_dedup_index"
+	blockDedupIndexDbFilename     string = "dedupIndex.leveldb"
+	currentBlockDedupIndexVersion uint64 = 2
+	// Key prefixes for the two kinds of entries in the index.
+	dedupHashKeyPrefix  byte = 'h'
+	dedupBlockKeyPrefix byte = 'b'
+	// dedupKeyPurpose separates the keys used for the dedup index
+	// from the other keys derived from a TLF's crypt key.
+	dedupKeyPurpose = "Keybase-KBFS-Dedup-Index-1"
+)
+
+// BlockDedupKey identifies the plaintext of a direct file block in
+// the dedup index.  It is a keyed hash of the block's plaintext
+// hash, so that the index doesn't reveal which plaintexts a TLF
+// contains to anyone who can't read the TLF.
+type BlockDedupKey [sha256.Size]byte
+
+// makeBlockDedupKey returns the key under which a block with the
+// given plaintext hash is stored in the index of a TLF, given the
+// index key derived from that TLF's crypt key.
+func makeBlockDedupKey(
+	indexKey [32]byte, hash kbfshash.RawDefaultHash) BlockDedupKey {
+	mac := hmac.New(sha256.New, indexKey[:])
+	// Writes to a hash.Hash never fail.
+	_, _ = mac.Write(hash[:])
+	var key BlockDedupKey
+	copy(key[:], mac.Sum(nil))
+	return key
+}
+
+type blockDedupIndexConfig interface {
+	codecGetter
+	logMaker
+}
+
+// BlockDedupIndexStandard is the standard implementation of
+// BlockDedupIndex, backed by a leveldb database.  For each TLF, it
+// stores two kinds of entries: one from the dedup key of a block to
+// its pointer, and one from the block ID back to the dedup key, so
+// that entries can be removed when their blocks are deleted.
+type BlockDedupIndexStandard struct {
+	config blockDedupIndexConfig
+	log    logger.Logger
+
+	// Protects the db from being shutdown while it's being accessed.
+	lock sync.RWMutex
+	stor storage.Storage
+	db   *leveldb.DB
+}
+
+var _ BlockDedupIndex = (*BlockDedupIndexStandard)(nil)
+
+// newBlockDedupIndexStandardFromStorage creates a new
+// *BlockDedupIndexStandard with the passed-in storage.Storage as its
+// storage layer.  The index closes the storage on shutdown.
+func newBlockDedupIndexStandardFromStorage(
+	config blockDedupIndexConfig, stor storage.Storage) (
+	*BlockDedupIndexStandard, error) {
+	db, err := openLevelDB(stor)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &BlockDedupIndexStandard{
+		config: config,
+		log:    config.MakeLogger("BDI"),
+		stor:   stor,
+		db:     db,
+	}, nil
+}
+
+// newBlockDedupIndexStandard creates a new *BlockDedupIndexStandard
+// that stores its data under the given storage root.
+func newBlockDedupIndexStandard(
+	config blockDedupIndexConfig, storageRoot string) (
+	*BlockDedupIndexStandard, error) {
+	dirPath := filepath.Join(storageRoot, blockDedupIndexFolderName)
+	dbPath := filepath.Join(
+		versionPathFromVersion(dirPath, currentBlockDedupIndexVersion),
+		blockDedupIndexDbFilename)
+	stor, err := storage.OpenFile(dbPath, false)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	index, err := newBlockDedupIndexStandardFromStorage(config, stor)
+	if err != nil {
+		stor.Close()
+		return nil, err
+	}
+	return index, nil
+}
+
+func dedupHashKey(tlfID tlf.ID, dedupKey BlockDedupKey) []byte {
+	key := append([]byte{dedupHashKeyPrefix}, tlfID.Bytes()...)
+	return append(key, dedupKey[:]...)
+}
+
+func dedupBlockKey(tlfID tlf.ID, id kbfsblock.ID) []byte {
+	key := append([]byte{dedupBlockKeyPrefix}, tlfID.Bytes()...)
+	return append(key, id.Bytes()...)
+}
+
+func (i *BlockDedupIndexStandard) checkOpenLocked(op string) error {
+	if i.db == nil {
+		return errors.WithStack(BlockDedupIndexClosedError{op})
+	}
+	return nil
+}
+
+// Get implements the BlockDedupIndex interface for
+// BlockDedupIndexStandard.
+func (i *BlockDedupIndexStandard) Get(
+	tlfID tlf.ID, key BlockDedupKey) (BlockPointer, error) {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+	err := i.checkOpenLocked("Get")
+	if err != nil {
+		return BlockPointer{}, err
+	}
+
+	buf, err := i.db.Get(dedupHashKey(tlfID, key), nil)
+	if err == leveldb.ErrNotFound {
+		return BlockPointer{}, nil
+	} else if err != nil {
+		return BlockPointer{}, errors.WithStack(err)
+	}
+	var ptr BlockPointer
+	err = i.config.Codec().Decode(buf, &ptr)
+	if err != nil {
+		return BlockPointer{}, err
+	}
+	return ptr, nil
+}
+
+// Put implements the BlockDedupIndex interface for
+// BlockDedupIndexStandard.
+func (i *BlockDedupIndexStandard) Put(
+	tlfID tlf.ID, key BlockDedupKey, ptr BlockPointer) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	err := i.checkOpenLocked("Put")
+	if err != nil {
+		return err
+	}
+
+	// Blocks get put every time they're read, so avoid rewriting
+	// entries that are already known.  If a different block with
+	// the same plaintext is already known, keep using that one.
+	hashKey := dedupHashKey(tlfID, key)
+	known, err := i.db.Has(hashKey, nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if known {
+		return nil
+	}
+
+	// Only the block ID and its context matter for a new reference.
+	ptr.RefNonce = kbfsblock.ZeroRefNonce
+	buf, err := i.config.Codec().Encode(ptr)
+	if err != nil {
+		return err
+	}
+	batch := new(leveldb.Batch)
+	batch.Put(hashKey, buf)
+	batch.Put(dedupBlockKey(tlfID, ptr.ID), key[:])
+	return errors.WithStack(i.db.Write(batch, nil))
+}
+
+// Remove implements the BlockDedupIndex interface for
+// BlockDedupIndexStandard.
+func (i *BlockDedupIndexStandard) Remove(
+	tlfID tlf.ID, key BlockDedupKey) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	err := i.checkOpenLocked("Remove")
+	if err != nil {
+		return err
+	}
+
+	hashKey := dedupHashKey(tlfID, key)
+	buf, err := i.db.Get(hashKey, nil)
+	if err == leveldb.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return errors.WithStack(err)
+	}
+	var ptr BlockPointer
+	err = i.config.Codec().Decode(buf, &ptr)
+	if err != nil {
+		return err
+	}
+	batch := new(leveldb.Batch)
+	batch.Delete(hashKey)
+	batch.Delete(dedupBlockKey(tlfID, ptr.ID))
+	return errors.WithStack(i.db.Write(batch, nil))
+}
+
+// RemoveBlocks implements the BlockDedupIndex interface for
+// BlockDedupIndexStandard.
+func (i *BlockDedupIndexStandard) RemoveBlocks(
+	tlfID tlf.ID, ids []kbfsblock.ID) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	err := i.checkOpenLocked("RemoveBlocks")
+	if err != nil {
+		return err
+	}
+
+	batch := new(leveldb.Batch)
+	for _, id := range ids {
+		blockKey := dedupBlockKey(tlfID, id)
+		keyBytes, err := i.db.Get(blockKey, nil)
+		if err == leveldb.ErrNotFound {
+			continue
+		} else if err != nil {
+			return errors.WithStack(err)
+		}
+		var key BlockDedupKey
+		copy(key[:], keyBytes)
+		batch.Delete(blockKey)
+		batch.Delete(dedupHashKey(tlfID, key))
+	}
+	if batch.Len() == 0 {
+		return nil
+	}
+	i.log.Debug("Removing %d blocks from the dedup index for %s",
+		batch.Len()/2, tlfID)
+	return errors.WithStack(i.db.Write(batch, nil))
+}
+
+// Shutdown implements the BlockDedupIndex interface for
+// BlockDedupIndexStandard.
+func (i *BlockDedupIndexStandard) Shutdown() {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	if i.db == nil {
+		return
+	}
+	err := i.db.Close()
+	if err != nil {
+		i.log.Warning("Error closing the dedup index: %+v", err)
+	}
+	i.db = nil
+	// Release the storage lock, so the index can be opened again.
+	err = i.stor.Close()
+	if err != nil {
+		i.log.Warning("Error closing the dedup index storage: %+v", err)
+	}
+}
+
+type dedupKeyCacheGetter interface {
+	KeyCache() KeyCache
+}
+
+// dedupBlockCache is a BlockCache that falls back to a
+// BlockDedupIndex to find known pointers that have fallen out of
+// the in-memory cache, and keeps the index up to date with the
+// direct file blocks that pass through the cache.
+type dedupBlockCache struct {
+	index  BlockDedupIndex
+	log    logger.Logger
+	config dedupKeyCacheGetter
+	BlockCache
+}
+
+var _ BlockCache = dedupBlockCache{}
+
+// getDedupKey returns the key of the given block in the index of the
+// given TLF.  The index key is derived from the first key generation
+// of the TLF, which is only looked up in the key cache: a block
+// can't be checked against the index if the key needed to read the
+// TLF hasn't been fetched yet.
+func (d dedupBlockCache) getDedupKey(
+	tlfID tlf.ID, block *FileBlock) (BlockDedupKey, error) {
+	tlfKey, err := getFirstTLFCryptKey(tlfID,
+		func() ([]kbfscrypto.TLFCryptKey, error) {
+			key, err := d.config.KeyCache().GetTLFCryptKey(
+				tlfID, FirstValidKeyGen)
+			if err != nil {
+				return nil, err
+			}
+			return []kbfscrypto.TLFCryptKey{key}, nil
+		})
+	if err != nil {
+		return BlockDedupKey{}, err
+	}
+	indexKey := deriveTLFLocalKey(tlfKey, dedupKeyPurpose)
+	return makeBlockDedupKey(indexKey, block.GetHash()), nil
+}
+
+// CheckForKnownPtr implements the BlockCache interface for
+// dedupBlockCache.
+func (d dedupBlockCache) CheckForKnownPtr(
+	tlfID tlf.ID, block *FileBlock) (BlockPointer, error) {
+	ptr, err := d.BlockCache.CheckForKnownPtr(tlfID, block)
+	if err != nil || ptr.IsInitialized() {
+		return ptr, err
+	}
+
+	key, err := d.getDedupKey(tlfID, block)
+	if err != nil {
+		d.log.Debug("Couldn't get the dedup key for %s: %+v", tlfID, err)
+		return BlockPointer{}, nil
+	}
+	ptr, err = d.index.Get(tlfID, key)
+	if err != nil {
+		// The index is just an optimization, so don't fail the
+		// caller over it.
+		d.log.Debug("Couldn't check the dedup index: %+v", err)
+		return BlockPointer{}, nil
+	}
+	return ptr, nil
+}
+
+// Put implements the BlockCache interface for dedupBlockCache.
+func (d dedupBlockCache) Put(ptr BlockPointer, tlfID tlf.ID, block Block,
+	lifetime BlockCacheLifetime) error {
+	err := d.BlockCache.Put(ptr, tlfID, block, lifetime)
+	if err != nil {
+		return err
+	}
+
+	// Like the in-memory cache, only remember transient blocks,
+	// which are known to be on the server already.
+	if fBlock, ok := block.(*FileBlock); ok && !fBlock.IsInd &&
+		lifetime == TransientEntry {
+		key, err := d.getDedupKey(tlfID, fBlock)
+		if err != nil {
+			d.log.Debug("Couldn't get the dedup key for %s: %+v", tlfID, err)
+			return nil
+		}
+		err = d.index.Put(tlfID, key, ptr)
+		if err != nil {
+			d.log.Debug("Couldn't add %v to the dedup index: %+v", ptr, err)
+		}
+	}
+	return nil
+}
+
+// DeleteTransient implements the BlockCache interface for
+// dedupBlockCache.
+func (d dedupBlockCache) DeleteTransient(
+	ptr BlockPointer, tlfID tlf.ID) error {
+	err := d.index.RemoveBlocks(tlfID, []kbfsblock.ID{ptr.ID})
+	if err != nil {
+		return err
+	}
+	return d.BlockCache.DeleteTransient(ptr, tlfID)
+}
+
+// DeleteKnownPtr implements the BlockCache interface for
+// dedupBlockCache.
+func (d dedupBlockCache) DeleteKnownPtr(tlfID tlf.ID, block *FileBlock) error {
+	if block.IsInd {
+		return NotDirectFileBlockError{}
+	}
+	key, err := d.getDedupKey(tlfID, block)
+	if err != nil {
+		// Any entry left behind is removed by block ID once the
+		// block is deleted from the server.
+		d.log.Debug("Couldn't get the dedup key for %s: %+v", tlfID, err)
+	} else {
+		err = d.index.Remove(tlfID, key)
+		if err != nil {
+			return err
+		}
+	}
+	return d.BlockCache.DeleteKnownPtr(tlfID, block)
+}
@@ -0,0 +1,249 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/ioutil"
+	"github.com/keybase/kbfs/kbfsblock"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/keybase/kbfs/kbfshash"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+type testBlockDedupIndexConfig struct {
+	testCodecGetter
+	testLogMaker
+}
+
+func newTestBlockDedupIndexConfig(t *testing.T) testBlockDedupIndexConfig {
+	return testBlockDedupIndexConfig{
+		newTestCodecGetter(), newTestLogMaker(t)}
+}
+
+func makeTestDedupPtr(t *testing.T) BlockPointer {
+	id, err := kbfsblock.MakeTemporaryID()
+	require.NoError(t, err)
+	refNonce, err := kbfsblock.MakeRefNonce()
+	require.NoError(t, err)
+	return BlockPointer{
+		ID:         id,
+		KeyGen:     FirstValidKeyGen,
+		DataVer:    FirstValidDataVer,
+		DirectType: DirectBlock,
+		Context: kbfsblock.MakeContext(
+			"fake creator", "fake writer", refNonce,
+			keybase1.BlockType_DATA),
+	}
+}
+
+func TestBlockDedupIndexStandard(t *testing.T) {
+	tempdir, err := ioutil.TempDir(os.TempDir(), "dedup_index")
+	require.NoError(t, err)
+	defer func() {
+		err := ioutil.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+
+	config := newTestBlockDedupIndexConfig(t)
+	index, err := newBlockDedupIndexStandard(config, tempdir)
+	require.NoError(t, err)
+	defer func() {
+		index.Shutdown()
+	}()
+
+	tlfID := tlf.FakeID(1, tlf.Private)
+	indexKey := deriveTLFLocalKey(
+		kbfscrypto.MakeTLFCryptKey([32]byte{1}), dedupKeyPurpose)
+	_, rawHash1 := kbfshash.DoRawDefaultHash([]byte{1, 2, 3})
+	_, rawHash2 := kbfshash.DoRawDefaultHash([]byte{4, 5, 6})
+	hash1 := makeBlockDedupKey(indexKey, rawHash1)
+	hash2 := makeBlockDedupKey(indexKey, rawHash2)
+	require.NotEqual(t, rawHash1[:], hash1[:])
+	otherIndexKey := deriveTLFLocalKey(
+		kbfscrypto.MakeTLFCryptKey([32]byte{2}), dedupKeyPurpose)
+	require.NotEqual(t, hash1, makeBlockDedupKey(otherIndexKey, rawHash1))
+	ptr1 := makeTestDedupPtr(t)
+	ptr2 := makeTestDedupPtr(t)
+
+	ptr, err := index.Get(tlfID, hash1)
+	require.NoError(t, err)
+	require.False(t, ptr.IsInitialized())
+
+	err = index.Put(tlfID, hash1, ptr1)
+	require.NoError(t, err)
+	err = index.Put(tlfID, hash2, ptr2)
+	require.NoError(t, err)
+
+	t.Log("The ref nonce isn't stored.")
+	expectedPtr1 := ptr1
+	expectedPtr1.RefNonce = kbfsblock.ZeroRefNonce
+	expectedPtr2 := ptr2
+	expectedPtr2.RefNonce = kbfsblock.ZeroRefNonce
+	ptr, err = index.Get(tlfID, hash1)
+	require.NoError(t, err)
+	require.Equal(t, expectedPtr1, ptr)
+
+	t.Log("Other TLFs don't see the entry.")
+	ptr, err = index.Get(tlf.FakeID(2, tlf.Private), hash1)
+	require.NoError(t, err)
+	require.False(t, ptr.IsInitialized())
+
+	t.Log("A different block with the same contents doesn't replace " +
+		"the known one.")
+	err = index.Put(tlfID, hash1, ptr2)
+	require.NoError(t, err)
+	ptr, err = index.Get(tlfID, hash1)
+	require.NoError(t, err)
+	require.Equal(t, expectedPtr1, ptr)
+
+	t.Log("Entries survive a restart.")
+	index.Shutdown()
+	_, err = index.Get(tlfID, hash1)
+	require.IsType(t, BlockDedupIndexClosedError{}, errors.Cause(err))
+	index, err = newBlockDedupIndexStandard(config, tempdir)
+	require.NoError(t, err)
+	ptr, err = index.Get(tlfID, hash1)
+	require.NoError(t, err)
+	require.Equal(t, expectedPtr1, ptr)
+
+	t.Log("Remove entries by block ID and by hash.")
+	err = index.RemoveBlocks(tlfID, []kbfsblock.ID{ptr1.ID})
+	require.NoError(t, err)
+	ptr, err = index.Get(tlfID, hash1)
+	require.NoError(t, err)
+	require.False(t, ptr.IsInitialized())
+	ptr, err = index.Get(tlfID, hash2)
+	require.NoError(t, err)
+	require.Equal(t, expectedPtr2, ptr)
+	err = index.Remove(tlfID, hash2)
+	require.NoError(t, err)
+	ptr, err = index.Get(tlfID, hash2)
+	require.NoError(t, err)
+	require.False(t, ptr.IsInitialized())
+}
+
+func TestBlockDedupIndexAcrossCacheResets(t *testing.T) {
+	var userName libkb.NormalizedUsername = "test_user"
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, userName)
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	tempdir, err := ioutil.TempDir(os.TempDir(), "dedup_index")
+	require.NoError(t, err)
+	defer func() {
+		err := ioutil.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+	config.storageRoot = tempdir
+	err = config.MakeBlockDedupIndexIfNotExists()
+	require.NoError(t, err)
+	bserv := &bserverPutCounter{BlockServer: config.BlockServer()}
+	config.SetBlockServer(bserv)
+	defer config.SetBlockServer(bserv.BlockServer)
+
+	rootNode := GetRootNodeOrBust(
+		ctx, t, config, userName.String(), tlf.Private)
+	kbfsOps := config.KBFSOps()
+	data := makeRandomCDCTestData(t, 1, 256*1024)
+	writeFile := func(name string) {
+		fileNode, _, err := kbfsOps.CreateFile(
+			ctx, rootNode, name, false, NoExcl)
+		require.NoError(t, err)
+		err = kbfsOps.Write(ctx, fileNode, data, 0)
+		require.NoError(t, err)
+		err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+		require.NoError(t, err)
+	}
+	writeFile("a")
+	writeBytes := atomic.SwapInt64(&bserv.putBytes, 0)
+	require.True(t, writeBytes > int64(len(data)))
+
+	t.Log("After the in-memory cache is reset, a copy of the same data " +
+		"reuses the existing blocks.")
+	config.ResetCaches()
+	writeFile("b")
+	copyBytes := atomic.SwapInt64(&bserv.putBytes, 0)
+	require.True(t, copyBytes < int64(len(data))/4,
+		"Uploaded %d bytes for the copy", copyBytes)
+
+	fileNode, _, err := kbfsOps.Lookup(ctx, rootNode, "b")
+	require.NoError(t, err)
+	gotData := make([]byte, len(data))
+	n, err := kbfsOps.Read(ctx, fileNode, gotData, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	require.Equal(t, data, gotData)
+}
+
+func TestBlockDedupIndexQuotaReclamation(t *testing.T) {
+	var userName libkb.NormalizedUsername = "test_user"
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, userName)
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	clock, now := newTestClockAndTimeNow()
+	config.SetClock(clock)
+
+	tempdir, err := ioutil.TempDir(os.TempDir(), "dedup_index")
+	require.NoError(t, err)
+	defer func() {
+		err := ioutil.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+	config.storageRoot = tempdir
+	err = config.MakeBlockDedupIndexIfNotExists()
+	require.NoError(t, err)
+	index := config.BlockDedupIndex()
+
+	rootNode := GetRootNodeOrBust(
+		ctx, t, config, userName.String(), tlf.Private)
+	tlfID := rootNode.GetFolderBranch().Tlf
+	kbfsOps := config.KBFSOps()
+	// Small enough to fit in a single block.
+	data := makeRandomCDCTestData(t, 1, 1024)
+	_, rawHash := kbfshash.DoRawDefaultHash(data)
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	tlfKey, err := config.KeyCache().GetTLFCryptKey(tlfID, FirstValidKeyGen)
+	require.NoError(t, err)
+	hash := makeBlockDedupKey(
+		deriveTLFLocalKey(tlfKey, dedupKeyPurpose), rawHash)
+	ptr, err := index.Get(tlfID, hash)
+	require.NoError(t, err)
+	require.True(t, ptr.IsInitialized())
+
+	err = kbfsOps.RemoveEntry(ctx, rootNode, "a")
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	err = kbfsOps.SyncFromServerForTesting(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	// Make a new-enough revision, and then reclaim the old blocks.
+	clock.Set(now.Add(2 * config.QuotaReclamationMinUnrefAge()))
+	_, _, err = kbfsOps.CreateDir(ctx, rootNode, "b")
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	ops := kbfsOps.(*KBFSOpsStandard).getOpsByNode(ctx, rootNode)
+	ops.fbm.forceQuotaReclamation()
+	err = ops.fbm.waitForQuotaReclamations(ctx)
+	require.NoError(t, err)
+	err = kbfsOps.SyncFromServerForTesting(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	ptr, err = index.Get(tlfID, hash)
+	require.NoError(t, err)
+	require.False(t, ptr.IsInitialized())
+}
@@ -8,6 +8,8 @@ import (
 	"github.com/keybase/kbfs/kbfsblock"
 	"github.com/keybase/kbfs/kbfscrypto"
 	"github.com/keybase/kbfs/tlf"
+	metrics "github.com/rcrowley/go-metrics"
+	"golang.org/x/crypto/nacl/secretbox"
 	"golang.org/x/net/context"
 )
 
@@ -21,6 +23,8 @@ type blockOpsConfig interface {
 	keyGetterGetter
 	diskBlockCacheGetter
 	syncedTlfGetterSetter
+	blockCompressionGetterSetter
+	metricsRegistryGetter
 }
 
 // BlockOpsStandard implements the BlockOps interface by relaying
@@ -135,10 +139,20 @@ func (b *BlockOpsStandard) Ready(ctx context.Context, kmd KeyMetadata,
 	}
 
 	blockKey := kbfscrypto.UnmaskBlockCryptKey(serverHalf, tlfCryptKey)
-	plainSize, encryptedBlock, err := crypto.EncryptBlock(block, blockKey)
+	var encryptedBlock EncryptedBlock
+	if b.config.IsBlockCompressionEnabled(kmd.TlfID()) {
+		plainSize, encryptedBlock, err = crypto.EncryptCompressedBlock(
+			block, blockKey)
+	} else {
+		plainSize, encryptedBlock, err = crypto.EncryptBlock(block, blockKey)
+	}
 	if err != nil {
 		return
 	}
+	compressed := encryptedBlock.Version == EncryptionSecretboxWithSnappy
+	if compressed {
+		b.recordCompression(plainSize, encryptedBlock)
+	}
 
 	buf, err := b.config.Codec().Encode(encryptedBlock)
 	if err != nil {
@@ -151,7 +165,7 @@ func (b *BlockOpsStandard) Ready(ctx context.Context, kmd KeyMetadata,
 	}
 
 	encodedSize := readyBlockData.GetEncodedSize()
-	if encodedSize < plainSize {
+	if !compressed && encodedSize < plainSize {
 		err = TooLowByteCountError{
 			ExpectedMinByteCount: plainSize,
 			ByteCount:            encodedSize,
@@ -170,6 +184,23 @@ func (b *BlockOpsStandard) Ready(ctx context.Context, kmd KeyMetadata,
 	return
 }
 
+// recordCompression updates the compression metrics with the number
+// of bytes saved by compressing a block whose uncompressed encoded
+// size is `plainSize`.
+func (b *BlockOpsStandard) recordCompression(
+	plainSize int, encryptedBlock EncryptedBlock) {
+	r := b.config.MetricsRegistry()
+	if r == nil {
+		return
+	}
+	uncompressedLen := padPrefixSize + powerOfTwoEqualOrGreater(plainSize) +
+		secretbox.Overhead
+	saved := uncompressedLen - len(encryptedBlock.EncryptedData)
+	metrics.GetOrRegisterCounter("BlockOps.CompressedBlocks", r).Inc(1)
+	metrics.GetOrRegisterCounter(
+		"BlockOps.CompressionBytesSaved", r).Inc(int64(saved))
+}
+
 // Delete implements the BlockOps interface for BlockOpsStandard.
 func (b *BlockOpsStandard) Delete(ctx context.Context, tlfID tlf.ID,
 	ptrs []BlockPointer) (liveCounts map[kbfsblock.ID]int, err error) {
@@ -17,6 +17,7 @@ import (
 	"github.com/keybase/kbfs/kbfshash"
 	"github.com/keybase/kbfs/tlf"
 	"github.com/pkg/errors"
+	metrics "github.com/rcrowley/go-metrics"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/net/context"
 )
@@ -85,6 +86,7 @@ type testBlockOpsConfig struct {
 	cache   BlockCache
 	diskBlockCacheGetter
 	*testSyncedTlfGetterSetter
+	*testBlockCompressionGetterSetter
 }
 
 var _ blockOpsConfig = (*testBlockOpsConfig)(nil)
@@ -109,6 +111,10 @@ func (config testBlockOpsConfig) DataVersion() DataVer {
 	return ChildHolesDataVer
 }
 
+func (config testBlockOpsConfig) MetricsRegistry() metrics.Registry {
+	return nil
+}
+
 func makeTestBlockOpsConfig(t *testing.T) testBlockOpsConfig {
 	lm := newTestLogMaker(t)
 	codecGetter := newTestCodecGetter()
@@ -117,8 +123,9 @@ func makeTestBlockOpsConfig(t *testing.T) testBlockOpsConfig {
 	cache := NewBlockCacheStandard(10, getDefaultCleanBlockCacheCapacity())
 	dbcg := newTestDiskBlockCacheGetter(t, nil)
 	stgs := newTestSyncedTlfGetterSetter()
+	bcgs := newTestBlockCompressionGetterSetter()
 	return testBlockOpsConfig{codecGetter, lm, bserver, crypto, cache, dbcg,
-		stgs}
+		stgs, bcgs}
 }
 
 // TestBlockOpsReadySuccess checks that BlockOpsStandard.Ready()
@@ -165,6 +172,63 @@ func TestBlockOpsReadySuccess(t *testing.T) {
 	require.Equal(t, block, decryptedBlock)
 }
 
+// TestBlockOpsReadyCompressed checks that BlockOpsStandard.Ready()
+// compresses blocks only in TLFs with compression enabled.
+func TestBlockOpsReadyCompressed(t *testing.T) {
+	config := makeTestBlockOpsConfig(t)
+	bops := NewBlockOpsStandard(config, testBlockRetrievalWorkerQueueSize,
+		testPrefetchWorkerQueueSize)
+	defer bops.Shutdown()
+
+	tlfID := tlf.FakeID(0, tlf.Private)
+	var latestKeyGen KeyGen = 5
+	kmd := makeFakeKeyMetadata(tlfID, latestKeyGen)
+	otherTlfID := tlf.FakeID(1, tlf.Private)
+	otherKmd := makeFakeKeyMetadata(otherTlfID, latestKeyGen)
+
+	config.SetBlockCompression(true)
+	config.SetTlfBlockCompression(otherTlfID, false)
+
+	block := &FileBlock{
+		Contents: make([]byte, 100000),
+	}
+
+	encodedBlock, err := config.Codec().Encode(block)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	id, plainSize, readyBlockData, err := bops.Ready(ctx, kmd, block)
+	require.NoError(t, err)
+	require.Equal(t, len(encodedBlock), plainSize)
+	require.True(t, readyBlockData.GetEncodedSize() < plainSize)
+
+	err = kbfsblock.VerifyID(readyBlockData.buf, id)
+	require.NoError(t, err)
+
+	var encryptedBlock EncryptedBlock
+	err = config.Codec().Decode(readyBlockData.buf, &encryptedBlock)
+	require.NoError(t, err)
+	require.Equal(t, EncryptionSecretboxWithSnappy, encryptedBlock.Version)
+
+	blockCryptKey := kbfscrypto.UnmaskBlockCryptKey(
+		readyBlockData.serverHalf,
+		kmd.keys[latestKeyGen-FirstValidKeyGen])
+
+	decryptedBlock := &FileBlock{}
+	err = config.cryptoPure().DecryptBlock(
+		encryptedBlock, blockCryptKey, decryptedBlock)
+	require.NoError(t, err)
+	decryptedBlock.SetEncodedSize(uint32(readyBlockData.GetEncodedSize()))
+	require.Equal(t, block, decryptedBlock)
+
+	// The other TLF has compression turned off.
+	_, _, readyBlockData, err = bops.Ready(ctx, otherKmd, block)
+	require.NoError(t, err)
+	err = config.Codec().Decode(readyBlockData.buf, &encryptedBlock)
+	require.NoError(t, err)
+	require.Equal(t, EncryptionSecretbox, encryptedBlock.Version)
+}
+
 // TestBlockOpsReadyFailKeyGet checks that BlockOpsStandard.Ready()
 // fails properly if we fail to retrieve the key.
 func TestBlockOpsReadyFailKeyGet(t *testing.T) {
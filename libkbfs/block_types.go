@@ -108,6 +108,13 @@ func NewCommonBlock() Block {
 	return &CommonBlock{}
 }
 
+// indirectDirChild pairs an indirect pointer from an indirect dir
+// block with the direct child block it points to.
+type indirectDirChild struct {
+	ptr   IndirectDirPtr
+	block *DirBlock
+}
+
 // DirBlock is the contents of a directory
 type DirBlock struct {
 	CommonBlock
@@ -115,6 +122,13 @@ type DirBlock struct {
 	Children map[string]DirEntry `codec:"c,omitempty"`
 	// if indirect, contains the indirect pointers to the next level of blocks
 	IPtrs []IndirectDirPtr `codec:"i,omitempty"`
+
+	// If this direct block was assembled locally from the children
+	// of an indirect dir block, this records the child blocks it was
+	// assembled from, in order.  It is never serialized, and is only
+	// used to figure out which child blocks can be reused, and which
+	// must be unreferenced, when this block is next readied.
+	indirectChildren []indirectDirChild
 }
 
 // NewDirBlock creates a new, empty DirBlock.
@@ -129,6 +143,14 @@ func (db *DirBlock) NewEmpty() Block {
 	return NewDirBlock()
 }
 
+// DataVersion returns data version for this block.
+func (db *DirBlock) DataVersion() DataVer {
+	if db.IsInd {
+		return IndirectDirsDataVer
+	}
+	return FirstValidDataVer
+}
+
 // ToCommonBlock implements the Block interface for DirBlock.
 func (db *DirBlock) ToCommonBlock() *CommonBlock {
 	return &db.CommonBlock
@@ -140,6 +162,7 @@ func (db *DirBlock) Set(other Block) {
 	dbCopy := otherDb.DeepCopy()
 	db.Children = dbCopy.Children
 	db.IPtrs = dbCopy.IPtrs
+	db.indirectChildren = dbCopy.indirectChildren
 	db.ToCommonBlock().Set(dbCopy.ToCommonBlock())
 }
 
@@ -149,12 +172,18 @@ func (db *DirBlock) DeepCopy() *DirBlock {
 	for k, v := range db.Children {
 		childrenCopy[k] = v
 	}
-	// TODO KBFS-3: add a copy for IPtrs too once we support indirect dir
-	// blocks
+	var iptrsCopy []IndirectDirPtr
+	if db.IPtrs != nil {
+		iptrsCopy = make([]IndirectDirPtr, len(db.IPtrs))
+		copy(iptrsCopy, db.IPtrs)
+	}
 	return &DirBlock{
 		CommonBlock: db.CommonBlock.DeepCopy(),
 		Children:    childrenCopy,
-		IPtrs:       db.IPtrs,
+		IPtrs:       iptrsCopy,
+		// The recorded child blocks are never modified, so they
+		// can be shared between copies.
+		indirectChildren: db.indirectChildren,
 	}
 }
 
@@ -154,6 +154,45 @@ func (b *BlockServerDisk) Get(ctx context.Context, tlfID tlf.ID, id kbfsblock.ID
 	return data, keyServerHalf, nil
 }
 
+// getWithAnyRef is like Get, except that the block only needs to
+// have some reference in the TLF, instead of one matching a given
+// context.  Remote clients only send the block ID and creator when
+// getting a block, so this is what the RPC server uses.
+func (b *BlockServerDisk) getWithAnyRef(
+	ctx context.Context, tlfID tlf.ID, id kbfsblock.ID) (
+	data []byte, serverHalf kbfscrypto.BlockCryptKeyServerHalf, err error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, kbfscrypto.BlockCryptKeyServerHalf{}, err
+	}
+
+	defer func() {
+		err = translateToBlockServerError(err)
+	}()
+	b.log.CDebugf(ctx, "BlockServerDisk.getWithAnyRef id=%s tlfID=%s",
+		id, tlfID)
+	tlfStorage, err := b.getStorage(tlfID)
+	if err != nil {
+		return nil, kbfscrypto.BlockCryptKeyServerHalf{}, err
+	}
+
+	tlfStorage.lock.RLock()
+	defer tlfStorage.lock.RUnlock()
+	if tlfStorage.store == nil {
+		return nil, kbfscrypto.BlockCryptKeyServerHalf{},
+			errBlockServerDiskShutdown
+	}
+
+	hasRef, err := tlfStorage.store.hasAnyRef(id)
+	if err != nil {
+		return nil, kbfscrypto.BlockCryptKeyServerHalf{}, err
+	}
+	if !hasRef {
+		return nil, kbfscrypto.BlockCryptKeyServerHalf{},
+			blockNonExistentError{id}
+	}
+	return tlfStorage.store.getData(id)
+}
+
 // Put implements the BlockServer interface for BlockServerDisk.
 func (b *BlockServerDisk) Put(ctx context.Context, tlfID tlf.ID, id kbfsblock.ID,
 	context kbfsblock.Context, buf []byte,
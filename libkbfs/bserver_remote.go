@@ -279,6 +279,7 @@ type blockServerRemoteConfig interface {
 	codecGetter
 	signerGetter
 	currentSessionGetterGetter
+	bandwidthLimiterGetter
 	logMaker
 }
 
@@ -421,6 +422,13 @@ func (b *BlockServerRemote) Get(ctx context.Context, tlfID tlf.ID, id kbfsblock.
 	}
 
 	size = len(res.Buf)
+	// The size of a block isn't known until it's been downloaded,
+	// so throttle afterwards; this holds up the retrieval worker
+	// that asked for it, and so the next download.
+	err = b.config.BandwidthLimiter().WaitForDownload(ctx, size)
+	if err != nil {
+		return nil, kbfscrypto.BlockCryptKeyServerHalf{}, err
+	}
 	serverHalf, err = kbfscrypto.ParseBlockCryptKeyServerHalf(res.BlockKey)
 	if err != nil {
 		return nil, kbfscrypto.BlockCryptKeyServerHalf{}, err
@@ -451,6 +459,11 @@ func (b *BlockServerRemote) Put(ctx context.Context, tlfID tlf.ID, id kbfsblock.
 		}
 	}()
 
+	err = b.config.BandwidthLimiter().WaitForUpload(ctx, size)
+	if err != nil {
+		return err
+	}
+
 	arg := keybase1.PutBlockArg{
 		Bid: makeBlockIDCombo(id, bContext),
 		// BlockKey is misnamed -- it contains just the server
@@ -486,6 +499,11 @@ func (b *BlockServerRemote) PutAgain(ctx context.Context, tlfID tlf.ID, id kbfsb
 		}
 	}()
 
+	err = b.config.BandwidthLimiter().WaitForUpload(ctx, size)
+	if err != nil {
+		return err
+	}
+
 	arg := keybase1.PutBlockAgainArg{
 		BlockKey: serverHalf.String(),
 		Folder:   tlfID.String(),
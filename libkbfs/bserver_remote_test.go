@@ -6,12 +6,14 @@ package libkbfs
 
 import (
 	"testing"
+	"time"
 
 	"github.com/keybase/client/go/protocol/keybase1"
 	"github.com/keybase/go-framed-msgpack-rpc/rpc"
 	"github.com/keybase/kbfs/kbfsblock"
 	"github.com/keybase/kbfs/kbfscrypto"
 	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/net/context"
 )
@@ -71,6 +73,7 @@ type testBlockServerRemoteConfig struct {
 	signer         kbfscrypto.Signer
 	sessionGetter  CurrentSessionGetter
 	diskBlockCache DiskBlockCache
+	limiter        *BandwidthLimiter
 }
 
 var _ blockServerRemoteConfig = (*testBlockServerRemoteConfig)(nil)
@@ -87,6 +90,10 @@ func (c testBlockServerRemoteConfig) DiskBlockCache() DiskBlockCache {
 	return c.diskBlockCache
 }
 
+func (c testBlockServerRemoteConfig) BandwidthLimiter() *BandwidthLimiter {
+	return c.limiter
+}
+
 // Test that putting a block, and getting it back, works
 func TestBServerRemotePutAndGet(t *testing.T) {
 	currentUID := keybase1.MakeTestUID(1)
@@ -94,7 +101,8 @@ func TestBServerRemotePutAndGet(t *testing.T) {
 		entries: make(map[keybase1.BlockIdCombo]fakeBlockEntry),
 	}
 	config := testBlockServerRemoteConfig{newTestCodecGetter(),
-		newTestLogMaker(t), nil, nil, nil}
+		newTestLogMaker(t), nil, nil, nil,
+		NewBandwidthLimiter(wallClock{}, nil)}
 	b := newBlockServerRemoteWithClient(config, &fc)
 
 	tlfID := tlf.FakeID(2, tlf.Private)
@@ -137,7 +145,8 @@ func TestBServerRemotePutCanceled(t *testing.T) {
 	currentUID := keybase1.MakeTestUID(1)
 	serverConn, conn := rpc.MakeConnectionForTest(t)
 	config := testBlockServerRemoteConfig{newTestCodecGetter(),
-		newTestLogMaker(t), nil, nil, nil}
+		newTestLogMaker(t), nil, nil, nil,
+		NewBandwidthLimiter(wallClock{}, nil)}
 	b := newBlockServerRemoteWithClient(config,
 		keybase1.BlockClient{Cli: conn.GetClient()})
 
@@ -153,3 +162,49 @@ func TestBServerRemotePutCanceled(t *testing.T) {
 	}
 	testRPCWithCanceledContext(t, serverConn, f)
 }
+
+// Test that puts and gets wait for the bandwidth limiter.
+func TestBServerRemoteBandwidthLimits(t *testing.T) {
+	currentUID := keybase1.MakeTestUID(1)
+	fc := fakeBServerClient{
+		entries: make(map[keybase1.BlockIdCombo]fakeBlockEntry),
+	}
+	limiter := NewBandwidthLimiter(wallClock{}, nil)
+	config := testBlockServerRemoteConfig{newTestCodecGetter(),
+		newTestLogMaker(t), nil, nil, nil, limiter}
+	b := newBlockServerRemoteWithClient(config, &fc)
+
+	tlfID := tlf.FakeID(2, tlf.Private)
+	bCtx := kbfsblock.MakeFirstContext(
+		currentUID.AsUserOrTeam(), keybase1.BlockType_DATA)
+	// Twice the burst size at 1 KiB/s, so the second block would
+	// need to wait a few seconds.
+	data := make([]byte, 2048)
+	bID, err := kbfsblock.MakePermanentID(data)
+	require.NoError(t, err)
+	serverHalf, err := kbfscrypto.MakeRandomBlockCryptKeyServerHalf()
+	require.NoError(t, err)
+
+	limiter.SetLimits(BandwidthLimits{UploadKBps: 1, DownloadKBps: 1})
+	ctx := context.Background()
+	shortCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	err = b.Put(shortCtx, tlfID, bID, bCtx, data, serverHalf)
+	require.Equal(t, context.DeadlineExceeded, errors.Cause(err))
+
+	t.Log("Canceled transfers give back their bandwidth, so lifting " +
+		"the upload limit lets the put through")
+	limiter.SetLimits(BandwidthLimits{DownloadKBps: 1})
+	err = b.Put(ctx, tlfID, bID, bCtx, data, serverHalf)
+	require.NoError(t, err)
+
+	shortCtx, cancel2 := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel2()
+	_, _, err = b.Get(shortCtx, tlfID, bID, bCtx)
+	require.Equal(t, context.DeadlineExceeded, errors.Cause(err))
+
+	status := limiter.Status()
+	require.Equal(t, 1, status.CurrentDownloadKBps)
+	require.True(t, status.DownloadThrottledTime > 0)
+	require.True(t, status.UploadThrottledTime > 0)
+}
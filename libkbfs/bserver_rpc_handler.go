@@ -0,0 +1,337 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/kbfsblock"
+	"github.com/keybase/kbfs/kbfscodec"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/keybase/kbfs/tlf"
+	"golang.org/x/net/context"
+)
+
+// blockServerRPCHandler serves the block server RPC protocol for a
+// single connection, by translating it into calls on the
+// KBFSServer's BlockServerDisk.
+type blockServerRPCHandler struct {
+	ctx     context.Context
+	codec   kbfscodec.Codec
+	log     logger.Logger
+	auth    *kbfsServerAuth
+	bServer *BlockServerDisk
+}
+
+var _ keybase1.BlockInterface = (*blockServerRPCHandler)(nil)
+
+func newBlockServerRPCHandler(
+	ctx context.Context, s *KBFSServer) *blockServerRPCHandler {
+	return &blockServerRPCHandler{
+		ctx:     ctx,
+		codec:   s.codec,
+		log:     s.log,
+		auth:    newKBFSServerAuth(BServerTokenServer, BServerTokenExpireIn, s.clock),
+		bServer: s.bServer,
+	}
+}
+
+// checkAuth returns the session for the connection, or an error if
+// it hasn't authenticated yet or its token has expired.
+func (h *blockServerRPCHandler) checkAuth(ctx context.Context) (
+	SessionInfo, error) {
+	session, err := h.auth.GetCurrentSession(ctx)
+	if err != nil {
+		return SessionInfo{}, kbfsblock.BServerErrorUnauthorized{
+			Msg: err.Error()}
+	}
+	return session, nil
+}
+
+// checkWriter returns an error if the given reference would charge
+// someone other than the connection's user.
+func (h *blockServerRPCHandler) checkWriter(
+	ctx context.Context, ref keybase1.BlockReference) error {
+	session, err := h.checkAuth(ctx)
+	if err != nil {
+		return err
+	}
+	if ref.ChargedTo != session.UID.AsUserOrTeam() {
+		return kbfsblock.BServerErrorUnauthorized{
+			Msg: "Can't charge blocks to " + ref.ChargedTo.String()}
+	}
+	return nil
+}
+
+func (h *blockServerRPCHandler) parseTlfID(folder string) (tlf.ID, error) {
+	id, err := tlf.ParseID(folder)
+	if err != nil {
+		return tlf.NullID, kbfsblock.BServerErrorBadRequest{Msg: err.Error()}
+	}
+	return id, nil
+}
+
+// parseRef converts a block reference from the wire into the block ID
+// and context that BlockServerRemote made it from.
+func (h *blockServerRPCHandler) parseRef(ref keybase1.BlockReference) (
+	kbfsblock.ID, kbfsblock.Context, error) {
+	id, err := kbfsblock.IDFromString(ref.Bid.BlockHash)
+	if err != nil {
+		return kbfsblock.ID{}, kbfsblock.Context{},
+			kbfsblock.BServerErrorBadRequest{Msg: err.Error()}
+	}
+	bContext := kbfsblock.MakeContext(ref.Bid.ChargedTo, ref.ChargedTo,
+		kbfsblock.RefNonce(ref.Nonce), ref.Bid.BlockType)
+	// Reference maps compare contexts exactly, so leave out the
+	// writer if it's the creator, just like the client does.
+	bContext.SetWriter(ref.ChargedTo)
+	return id, bContext, nil
+}
+
+func (h *blockServerRPCHandler) parseRefs(refs []keybase1.BlockReference) (
+	kbfsblock.ContextMap, error) {
+	contexts := make(kbfsblock.ContextMap)
+	for _, ref := range refs {
+		id, bContext, err := h.parseRef(ref)
+		if err != nil {
+			return nil, err
+		}
+		contexts[id] = append(contexts[id], bContext)
+	}
+	return contexts, nil
+}
+
+// GetSessionChallenge implements the BlockInterface for
+// blockServerRPCHandler.
+func (h *blockServerRPCHandler) GetSessionChallenge(_ context.Context) (
+	keybase1.ChallengeInfo, error) {
+	return h.auth.getChallenge()
+}
+
+// AuthenticateSession implements the BlockInterface for
+// blockServerRPCHandler.
+func (h *blockServerRPCHandler) AuthenticateSession(
+	_ context.Context, signature string) error {
+	session, err := h.auth.authenticate(signature)
+	if err != nil {
+		return kbfsblock.BServerErrorUnauthorized{Msg: err.Error()}
+	}
+	h.log.CDebugf(h.ctx, "Authenticated block session for %s (%s)",
+		session.Name, session.UID)
+	return nil
+}
+
+// PutBlock implements the BlockInterface for blockServerRPCHandler.
+func (h *blockServerRPCHandler) PutBlock(
+	ctx context.Context, arg keybase1.PutBlockArg) error {
+	ref := keybase1.BlockReference{Bid: arg.Bid, ChargedTo: arg.Bid.ChargedTo}
+	if err := h.checkWriter(ctx, ref); err != nil {
+		return err
+	}
+	tlfID, err := h.parseTlfID(arg.Folder)
+	if err != nil {
+		return err
+	}
+	id, bContext, err := h.parseRef(ref)
+	if err != nil {
+		return err
+	}
+	serverHalf, err := kbfscrypto.ParseBlockCryptKeyServerHalf(arg.BlockKey)
+	if err != nil {
+		return kbfsblock.BServerErrorBadRequest{Msg: err.Error()}
+	}
+	return h.bServer.Put(ctx, tlfID, id, bContext, arg.Buf, serverHalf)
+}
+
+// PutBlockAgain implements the BlockInterface for
+// blockServerRPCHandler.
+func (h *blockServerRPCHandler) PutBlockAgain(
+	ctx context.Context, arg keybase1.PutBlockAgainArg) error {
+	if err := h.checkWriter(ctx, arg.Ref); err != nil {
+		return err
+	}
+	tlfID, err := h.parseTlfID(arg.Folder)
+	if err != nil {
+		return err
+	}
+	id, bContext, err := h.parseRef(arg.Ref)
+	if err != nil {
+		return err
+	}
+	serverHalf, err := kbfscrypto.ParseBlockCryptKeyServerHalf(arg.BlockKey)
+	if err != nil {
+		return kbfsblock.BServerErrorBadRequest{Msg: err.Error()}
+	}
+	return h.bServer.PutAgain(ctx, tlfID, id, bContext, arg.Buf, serverHalf)
+}
+
+// GetBlock implements the BlockInterface for blockServerRPCHandler.
+func (h *blockServerRPCHandler) GetBlock(
+	ctx context.Context, arg keybase1.GetBlockArg) (
+	keybase1.GetBlockRes, error) {
+	if _, err := h.checkAuth(ctx); err != nil {
+		return keybase1.GetBlockRes{}, err
+	}
+	tlfID, err := h.parseTlfID(arg.Folder)
+	if err != nil {
+		return keybase1.GetBlockRes{}, err
+	}
+	id, err := kbfsblock.IDFromString(arg.Bid.BlockHash)
+	if err != nil {
+		return keybase1.GetBlockRes{},
+			kbfsblock.BServerErrorBadRequest{Msg: err.Error()}
+	}
+	buf, serverHalf, err := h.bServer.getWithAnyRef(ctx, tlfID, id)
+	if err != nil {
+		return keybase1.GetBlockRes{}, err
+	}
+	return keybase1.GetBlockRes{
+		BlockKey: serverHalf.String(),
+		Buf:      buf,
+	}, nil
+}
+
+// AddReference implements the BlockInterface for
+// blockServerRPCHandler.
+func (h *blockServerRPCHandler) AddReference(
+	ctx context.Context, arg keybase1.AddReferenceArg) error {
+	if err := h.checkWriter(ctx, arg.Ref); err != nil {
+		return err
+	}
+	tlfID, err := h.parseTlfID(arg.Folder)
+	if err != nil {
+		return err
+	}
+	id, bContext, err := h.parseRef(arg.Ref)
+	if err != nil {
+		return err
+	}
+	return h.bServer.AddBlockReference(ctx, tlfID, id, bContext)
+}
+
+// DelReference implements the BlockInterface for
+// blockServerRPCHandler.
+func (h *blockServerRPCHandler) DelReference(
+	ctx context.Context, arg keybase1.DelReferenceArg) error {
+	_, err := h.DelReferenceWithCount(ctx, keybase1.DelReferenceWithCountArg{
+		Folder: arg.Folder,
+		Refs:   []keybase1.BlockReference{arg.Ref},
+	})
+	return err
+}
+
+// ArchiveReference implements the BlockInterface for
+// blockServerRPCHandler.
+func (h *blockServerRPCHandler) ArchiveReference(
+	ctx context.Context, arg keybase1.ArchiveReferenceArg) (
+	[]keybase1.BlockReference, error) {
+	_, err := h.ArchiveReferenceWithCount(ctx,
+		keybase1.ArchiveReferenceWithCountArg{
+			Folder: arg.Folder,
+			Refs:   arg.Refs,
+		})
+	if err != nil {
+		return nil, err
+	}
+	return arg.Refs, nil
+}
+
+// DelReferenceWithCount implements the BlockInterface for
+// blockServerRPCHandler.
+func (h *blockServerRPCHandler) DelReferenceWithCount(
+	ctx context.Context, arg keybase1.DelReferenceWithCountArg) (
+	keybase1.DowngradeReferenceRes, error) {
+	if _, err := h.checkAuth(ctx); err != nil {
+		return keybase1.DowngradeReferenceRes{}, err
+	}
+	tlfID, err := h.parseTlfID(arg.Folder)
+	if err != nil {
+		return keybase1.DowngradeReferenceRes{}, err
+	}
+	contexts, err := h.parseRefs(arg.Refs)
+	if err != nil {
+		return keybase1.DowngradeReferenceRes{}, err
+	}
+	liveCounts, err := h.bServer.RemoveBlockReferences(ctx, tlfID, contexts)
+	if err != nil {
+		return keybase1.DowngradeReferenceRes{}, err
+	}
+
+	var res keybase1.DowngradeReferenceRes
+	for _, ref := range arg.Refs {
+		// The refs were all parsed successfully above.
+		id, _ := kbfsblock.IDFromString(ref.Bid.BlockHash)
+		res.Completed = append(res.Completed, keybase1.BlockReferenceCount{
+			Ref:       ref,
+			LiveCount: liveCounts[id],
+		})
+	}
+	return res, nil
+}
+
+// ArchiveReferenceWithCount implements the BlockInterface for
+// blockServerRPCHandler.  The live counts aren't tracked for
+// archived references, so they're always reported as zero.
+func (h *blockServerRPCHandler) ArchiveReferenceWithCount(
+	ctx context.Context, arg keybase1.ArchiveReferenceWithCountArg) (
+	keybase1.DowngradeReferenceRes, error) {
+	if _, err := h.checkAuth(ctx); err != nil {
+		return keybase1.DowngradeReferenceRes{}, err
+	}
+	tlfID, err := h.parseTlfID(arg.Folder)
+	if err != nil {
+		return keybase1.DowngradeReferenceRes{}, err
+	}
+	contexts, err := h.parseRefs(arg.Refs)
+	if err != nil {
+		return keybase1.DowngradeReferenceRes{}, err
+	}
+	err = h.bServer.ArchiveBlockReferences(ctx, tlfID, contexts)
+	if err != nil {
+		return keybase1.DowngradeReferenceRes{}, err
+	}
+
+	var res keybase1.DowngradeReferenceRes
+	for _, ref := range arg.Refs {
+		res.Completed = append(res.Completed, keybase1.BlockReferenceCount{
+			Ref: ref,
+		})
+	}
+	return res, nil
+}
+
+// GetUserQuotaInfo implements the BlockInterface for
+// blockServerRPCHandler.
+func (h *blockServerRPCHandler) GetUserQuotaInfo(ctx context.Context) (
+	[]byte, error) {
+	if _, err := h.checkAuth(ctx); err != nil {
+		return nil, err
+	}
+	info, err := h.bServer.GetUserQuotaInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return info.ToBytes(h.codec)
+}
+
+// GetTeamQuotaInfo implements the BlockInterface for
+// blockServerRPCHandler.
+func (h *blockServerRPCHandler) GetTeamQuotaInfo(
+	ctx context.Context, tid keybase1.TeamID) ([]byte, error) {
+	if _, err := h.checkAuth(ctx); err != nil {
+		return nil, err
+	}
+	info, err := h.bServer.GetTeamQuotaInfo(ctx, tid)
+	if err != nil {
+		return nil, err
+	}
+	return info.ToBytes(h.codec)
+}
+
+// BlockPing implements the BlockInterface for blockServerRPCHandler.
+func (h *blockServerRPCHandler) BlockPing(_ context.Context) (
+	keybase1.BlockPingResponse, error) {
+	return keybase1.BlockPingResponse{}, nil
+}
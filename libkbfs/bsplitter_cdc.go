@@ -0,0 +1,159 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/keybase/kbfs/kbfscodec"
+)
+
+// gearWindowSize is the number of trailing bytes that determine the
+// value of a gear hash; older bytes have been shifted out of it.
+// Each byte is shifted one bit further left by every later byte, so
+// only the top bits of the hash depend on the whole window.
+const gearWindowSize = 64
+
+// gearTable maps each byte value to a pseudo-random 64-bit value for
+// the gear hash.  It's derived from a fixed string, rather than from
+// a random source, so that every client finds the same boundaries
+// in the same data.
+var gearTable = func() (table [256]uint64) {
+	for i := range table {
+		h := sha256.Sum256([]byte(fmt.Sprintf("Keybase-KBFS-Gear-%d", i)))
+		table[i] = binary.LittleEndian.Uint64(h[:8])
+	}
+	return table
+}()
+
+// BlockSplitterCDC implements the BlockSplitter interface by using
+// content-defined chunking to determine when to split file blocks.
+// A rolling gear hash over the file contents picks the block
+// boundaries, so inserting or removing bytes in a file only changes
+// the blocks around the edit; the rest of the file keeps the same
+// block contents, and can be deduplicated against blocks that are
+// already known.  Directories and indirect blocks are handled just
+// like in BlockSplitterSimple.
+type BlockSplitterCDC struct {
+	*BlockSplitterSimple
+	// Blocks are never split before minSize bytes.
+	minSize int64
+	// After minSize bytes, a block ends wherever the hash has all
+	// of these bits cleared, or at the max size.  These are the top
+	// bits of the hash, like in FastCDC, since the low bits only
+	// depend on the last few bytes.
+	mask uint64
+}
+
+var _ BlockSplitter = (*BlockSplitterCDC)(nil)
+
+// NewBlockSplitterCDC creates a new BlockSplitterCDC.  The max size
+// of a block is computed the same way as for BlockSplitterSimple, so
+// that no block is bigger than the desired block size once encoded.
+// Blocks average about half of that size.
+func NewBlockSplitterCDC(desiredBlockSize int64,
+	blockChangeEmbedMaxSize uint64, codec kbfscodec.Codec) (
+	*BlockSplitterCDC, error) {
+	bsplit, err := NewBlockSplitterSimple(
+		desiredBlockSize, blockChangeEmbedMaxSize, codec)
+	if err != nil {
+		return nil, err
+	}
+
+	minSize := bsplit.maxSize / 4
+	if minSize < gearWindowSize {
+		return nil, fmt.Errorf("Desired block size %d is too small for "+
+			"content-defined chunking", desiredBlockSize)
+	}
+	// Pick the largest power of 2 no bigger than the min size as the
+	// average distance to a boundary past the min size.
+	bits := uint(0)
+	for int64(1)<<(bits+1) <= minSize {
+		bits++
+	}
+	return &BlockSplitterCDC{
+		BlockSplitterSimple: bsplit,
+		minSize:             minSize,
+		mask:                ((uint64(1) << bits) - 1) << (64 - bits),
+	}, nil
+}
+
+// nextBoundary returns the position of the first block boundary in
+// `data`, starting from position `start`, assuming that `data` is
+// the beginning of a block and that no boundary comes before
+// `start`.  It returns -1 if there is no boundary yet.
+func (b *BlockSplitterCDC) nextBoundary(data []byte, start int64) int64 {
+	// The hash only depends on the last gearWindowSize bytes, so
+	// start hashing that far back to get the right value at `start`.
+	i := start - gearWindowSize
+	if i < 0 {
+		i = 0
+	}
+	var h uint64
+	for ; i < int64(len(data)); i++ {
+		h = (h << 1) + gearTable[data[i]]
+		pos := i + 1
+		if pos < start {
+			continue
+		}
+		if pos >= b.maxSize || (pos >= b.minSize && h&b.mask == 0) {
+			return pos
+		}
+	}
+	return -1
+}
+
+// CopyUntilSplit implements the BlockSplitter interface for
+// BlockSplitterCDC.  When appending to a block, it stops right after
+// the next content-defined boundary.  Otherwise, it copies
+// everything that fits, and leaves it up to CheckSplit to fix the
+// boundaries later.
+func (b *BlockSplitterCDC) CopyUntilSplit(
+	block *FileBlock, lastBlock bool, data []byte, off int64) int64 {
+	currLen := int64(len(block.Contents))
+	if off != currLen {
+		return b.BlockSplitterSimple.CopyUntilSplit(
+			block, lastBlock, data, off)
+	}
+	// Any boundary in the existing contents would have been found
+	// already, except maybe one right at the end.
+	start := currLen
+	if start == 0 {
+		start = 1
+	} else if b.nextBoundary(block.Contents, start) == currLen {
+		// The block is already complete.
+		return 0
+	}
+
+	toCopy := int64(len(data))
+	if currLen+toCopy > b.maxSize {
+		toCopy = b.maxSize - currLen
+	}
+	block.Contents = append(block.Contents, data[:toCopy]...)
+
+	if end := b.nextBoundary(block.Contents, start); end > 0 &&
+		end < int64(len(block.Contents)) {
+		block.Contents = block.Contents[:end]
+		toCopy = end - currLen
+	}
+	return toCopy
+}
+
+// CheckSplit implements the BlockSplitter interface for
+// BlockSplitterCDC.
+func (b *BlockSplitterCDC) CheckSplit(block *FileBlock) int64 {
+	end := b.nextBoundary(block.Contents, 1)
+	switch {
+	case end < 0:
+		// No boundary yet, so the block needs more bytes.
+		return -1
+	case end == int64(len(block.Contents)):
+		return 0
+	default:
+		return end
+	}
+}
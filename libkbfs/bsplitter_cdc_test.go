@@ -0,0 +1,229 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bytes"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+
+	"github.com/keybase/kbfs/kbfsblock"
+	"github.com/keybase/kbfs/kbfscodec"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func makeTestBlockSplitterCDC(t testing.TB) *BlockSplitterCDC {
+	bsplit, err := NewBlockSplitterCDC(
+		64*1024, 8*1024, kbfscodec.NewMsgpack())
+	require.NoError(t, err)
+	return bsplit
+}
+
+func makeRandomCDCTestData(t testing.TB, seed int64, n int) []byte {
+	data := make([]byte, n)
+	_, err := rand.New(rand.NewSource(seed)).Read(data)
+	require.NoError(t, err)
+	return data
+}
+
+// cdcSplitAll splits `data` into blocks by appending it in small
+// pieces, the way file writes fill blocks.
+func cdcSplitAll(bsplit *BlockSplitterCDC, data []byte) (blocks [][]byte) {
+	const writeSize = 1000
+	block := NewFileBlock().(*FileBlock)
+	for len(data) > 0 {
+		toWrite := data
+		if len(toWrite) > writeSize {
+			toWrite = toWrite[:writeSize]
+		}
+		n := bsplit.CopyUntilSplit(
+			block, false, toWrite, int64(len(block.Contents)))
+		data = data[n:]
+		if n < int64(len(toWrite)) {
+			blocks = append(blocks, block.Contents)
+			block = NewFileBlock().(*FileBlock)
+		}
+	}
+	if len(block.Contents) > 0 {
+		blocks = append(blocks, block.Contents)
+	}
+	return blocks
+}
+
+func TestBsplitterCDCTooSmall(t *testing.T) {
+	_, err := NewBlockSplitterCDC(256, 8*1024, kbfscodec.NewMsgpack())
+	require.Error(t, err)
+}
+
+func TestBsplitterCDCBoundaries(t *testing.T) {
+	bsplit := makeTestBlockSplitterCDC(t)
+	data := makeRandomCDCTestData(t, 1, 1024*1024)
+
+	blocks := cdcSplitAll(bsplit, data)
+	require.True(t, len(blocks) > 1)
+	require.Equal(t, data, bytes.Join(blocks, nil))
+	for i, block := range blocks {
+		require.True(t, int64(len(block)) <= bsplit.maxSize)
+		fblock := NewFileBlock().(*FileBlock)
+		fblock.Contents = block
+		if i < len(blocks)-1 {
+			require.True(t, int64(len(block)) >= bsplit.minSize)
+			require.Equal(t, int64(0), bsplit.CheckSplit(fblock),
+				"Block %d not split at a boundary", i)
+		} else {
+			// The last block just ends with the file.
+			require.True(t, bsplit.CheckSplit(fblock) <= 0)
+		}
+
+		// A full block doesn't take any more bytes.
+		if i < len(blocks)-1 {
+			n := bsplit.CopyUntilSplit(
+				fblock, false, []byte{1}, int64(len(block)))
+			require.Equal(t, int64(0), n)
+		}
+	}
+}
+
+func TestBsplitterCDCWholeWindow(t *testing.T) {
+	bsplit := makeTestBlockSplitterCDC(t)
+	data := makeRandomCDCTestData(t, 1, 1024*1024)
+	end := bsplit.nextBoundary(data, 1)
+	require.True(t, end > 0 && end < bsplit.maxSize)
+
+	// Changing a byte well inside the window, but far enough back
+	// to only affect the high bits of the hash, moves the boundary.
+	data[end-gearWindowSize/2] ^= 0xff
+	require.NotEqual(t, end, bsplit.nextBoundary(data, 1))
+}
+
+func TestBsplitterCDCCheckSplitOverfull(t *testing.T) {
+	bsplit := makeTestBlockSplitterCDC(t)
+	data := makeRandomCDCTestData(t, 2, 1024*1024)
+	blocks := cdcSplitAll(bsplit, data)
+	require.True(t, len(blocks) > 2)
+
+	// A block overwritten with too many bytes gets split at the same
+	// place where appending would have split it.
+	fblock := NewFileBlock().(*FileBlock)
+	fblock.Contents = append(append([]byte(nil), blocks[0]...),
+		blocks[1][:100]...)
+	require.Equal(t, int64(len(blocks[0])), bsplit.CheckSplit(fblock))
+}
+
+func TestBsplitterCDCInsertKeepsBlocks(t *testing.T) {
+	bsplit := makeTestBlockSplitterCDC(t)
+	data := makeRandomCDCTestData(t, 3, 1024*1024)
+	blocks := cdcSplitAll(bsplit, data)
+
+	var newData []byte
+	newData = append(newData, data[:1000]...)
+	newData = append(newData, []byte("inserted")...)
+	newData = append(newData, data[1000:]...)
+	newBlocks := cdcSplitAll(bsplit, newData)
+	require.Equal(t, newData, bytes.Join(newBlocks, nil))
+
+	// Only the first block should be different.
+	require.NotEqual(t, blocks[0], newBlocks[0])
+	require.Equal(t, blocks[1:], newBlocks[1:])
+}
+
+// bserverPutCounter counts the bytes of all the blocks put to the
+// wrapped block server.
+type bserverPutCounter struct {
+	BlockServer
+	putBytes int64
+}
+
+func (b *bserverPutCounter) Put(
+	ctx context.Context, tlfID tlf.ID, id kbfsblock.ID,
+	context kbfsblock.Context, buf []byte,
+	serverHalf kbfscrypto.BlockCryptKeyServerHalf) error {
+	atomic.AddInt64(&b.putBytes, int64(len(buf)))
+	return b.BlockServer.Put(ctx, tlfID, id, context, buf, serverHalf)
+}
+
+// uploadBytesForInsert writes a file of `size` random bytes, then
+// inserts a few bytes near the beginning of the file, and returns
+// the number of block bytes uploaded for each of those two syncs.
+// It also checks that the file contents can be read back.
+func uploadBytesForInsert(t testing.TB, bsplit BlockSplitter, size int) (
+	writeBytes, insertBytes int64) {
+	ctx := BackgroundContextWithCancellationDelayer()
+	defer CleanupCancellationDelayer(ctx)
+	config := MakeTestConfigOrBust(t, "alice")
+	defer CheckConfigAndShutdown(ctx, t, config)
+	config.SetBlockSplitter(bsplit)
+	bserv := &bserverPutCounter{BlockServer: config.BlockServer()}
+	config.SetBlockServer(bserv)
+	// The state checker needs the original block server.
+	defer config.SetBlockServer(bserv.BlockServer)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "alice", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+
+	data := makeRandomCDCTestData(t, 4, size)
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	writeBytes = atomic.SwapInt64(&bserv.putBytes, 0)
+
+	var newData []byte
+	newData = append(newData, data[:1000]...)
+	newData = append(newData, []byte("inserted")...)
+	newData = append(newData, data[1000:]...)
+	err = kbfsOps.Write(ctx, fileNode, newData, 0)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	insertBytes = atomic.LoadInt64(&bserv.putBytes)
+
+	config.ResetCaches()
+	fileNode, _, err = kbfsOps.Lookup(ctx, rootNode, "a")
+	require.NoError(t, err)
+	gotData := make([]byte, len(newData))
+	n, err := kbfsOps.Read(ctx, fileNode, gotData, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(newData)), n)
+	require.True(t, bytes.Equal(newData, gotData))
+	return writeBytes, insertBytes
+}
+
+func TestBsplitterCDCInsertReusesBlocks(t *testing.T) {
+	writeBytes, insertBytes := uploadBytesForInsert(
+		t, makeTestBlockSplitterCDC(t), 1024*1024)
+	t.Logf("Uploaded %d bytes for the write, %d bytes for the insert",
+		writeBytes, insertBytes)
+	// Only the blocks around the insert, and the top block, should
+	// be uploaded again.
+	require.True(t, insertBytes < writeBytes/4)
+}
+
+func benchmarkUploadBytesForInsert(b *testing.B, bsplit BlockSplitter) {
+	for i := 0; i < b.N; i++ {
+		writeBytes, insertBytes := uploadBytesForInsert(b, bsplit, 4*1024*1024)
+		if i == 0 {
+			b.Logf("Uploaded %d bytes for the write, %d bytes for the "+
+				"insert", writeBytes, insertBytes)
+		}
+	}
+}
+
+func BenchmarkUploadBytesForInsertSimple(b *testing.B) {
+	bsplit, err := NewBlockSplitterSimple(
+		64*1024, 8*1024, kbfscodec.NewMsgpack())
+	require.NoError(b, err)
+	benchmarkUploadBytesForInsert(b, bsplit)
+}
+
+func BenchmarkUploadBytesForInsertCDC(b *testing.B) {
+	benchmarkUploadBytesForInsert(b, makeTestBlockSplitterCDC(b))
+}
@@ -6,16 +6,22 @@ package libkbfs
 
 import (
 	"fmt"
+	"reflect"
+	"sort"
 
 	"github.com/keybase/kbfs/kbfscodec"
 )
 
+var deSize = int64(reflect.TypeOf(DirEntry{}).Size())
+
 // BlockSplitterSimple implements the BlockSplitter interface by using
 // a simple max-size algorithm to determine when to split blocks.
 type BlockSplitterSimple struct {
 	maxSize                 int64
 	maxPtrsPerBlock         int
 	blockChangeEmbedMaxSize uint64
+	// If non-positive, directories are never split.
+	maxDirEntriesPerBlock int
 }
 
 // NewBlockSplitterSimple creates a new BlockSplittleSimple and
@@ -83,10 +89,20 @@ func NewBlockSplitterSimple(desiredBlockSize int64,
 		maxPtrs = 2
 	}
 
+	// Assume every directory entry has a name of the maximum
+	// length, so that a full dir block doesn't end up much bigger
+	// than a full file block.
+	maxDirEntries := int(
+		.75 * float64(maxSize/(deSize+int64(maxNameBytesDefault))))
+	if maxDirEntries < 2 {
+		maxDirEntries = 2
+	}
+
 	return &BlockSplitterSimple{
 		maxSize:                 maxSize,
 		maxPtrsPerBlock:         maxPtrs,
 		blockChangeEmbedMaxSize: blockChangeEmbedMaxSize,
+		maxDirEntriesPerBlock:   maxDirEntries,
 	}, nil
 }
 
@@ -141,6 +157,87 @@ func (b *BlockSplitterSimple) MaxPtrsPerBlock() int {
 	return b.maxPtrsPerBlock
 }
 
+// SplitDirIfNeeded implements the BlockSplitter interface for
+// BlockSplitterSimple.  Entries are grouped by the previous offsets
+// first; any group that has grown past the max number of entries is
+// split into half-full blocks to leave room for future additions,
+// and adjacent groups are merged back together once they fit into a
+// half-full block.
+func (b *BlockSplitterSimple) SplitDirIfNeeded(
+	block *DirBlock, prevOffs []string) ([]*DirBlock, []string, error) {
+	if block.IsInd {
+		return nil, nil, fmt.Errorf("Can't split an indirect dir block")
+	}
+	if b.maxDirEntriesPerBlock <= 0 ||
+		len(block.Children) <= b.maxDirEntriesPerBlock {
+		return nil, nil, nil
+	}
+
+	names := make([]string, 0, len(block.Children))
+	for name := range block.Children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	halfFull := b.maxDirEntriesPerBlock / 2
+	if halfFull < 1 {
+		halfFull = 1
+	}
+	var groups [][]string
+	addGroup := func(groupNames []string) {
+		if len(groupNames) <= b.maxDirEntriesPerBlock {
+			groups = append(groups, groupNames)
+			return
+		}
+		// Chop overflowing groups into half-full pieces, to leave
+		// room for future insertions.
+		for len(groupNames) > halfFull {
+			groups = append(groups, groupNames[:halfFull])
+			groupNames = groupNames[halfFull:]
+		}
+		groups = append(groups, groupNames)
+	}
+
+	// The first offset always covers the beginning of the name
+	// space, so only the subsequent ones act as boundaries.
+	start := 0
+	for i := 1; i < len(prevOffs); i++ {
+		end := start + sort.SearchStrings(names[start:], prevOffs[i])
+		addGroup(names[start:end])
+		start = end
+	}
+	addGroup(names[start:])
+
+	var blocks []*DirBlock
+	var offs []string
+	for _, g := range groups {
+		if len(g) == 0 {
+			continue
+		}
+		if len(blocks) > 0 {
+			prev := blocks[len(blocks)-1]
+			if len(prev.Children)+len(g) <= halfFull {
+				for _, name := range g {
+					prev.Children[name] = block.Children[name]
+				}
+				continue
+			}
+		}
+
+		newBlock := NewDirBlock().(*DirBlock)
+		for _, name := range g {
+			newBlock.Children[name] = block.Children[name]
+		}
+		off := g[0]
+		if len(blocks) == 0 {
+			off = ""
+		}
+		blocks = append(blocks, newBlock)
+		offs = append(offs, off)
+	}
+	return blocks, offs, nil
+}
+
 // ShouldEmbedBlockChanges implements the BlockSplitter interface for
 // BlockSplitterSimple.
 func (b *BlockSplitterSimple) ShouldEmbedBlockChanges(
@@ -6,13 +6,15 @@ package libkbfs
 
 import (
 	"bytes"
+	"fmt"
+	"reflect"
 	"testing"
 
 	"github.com/keybase/kbfs/kbfscodec"
 )
 
 func TestBsplitterEmptyCopyAll(t *testing.T) {
-	bsplit := &BlockSplitterSimple{10, 5, 10}
+	bsplit := &BlockSplitterSimple{10, 5, 10, 0}
 	fblock := NewFileBlock().(*FileBlock)
 	data := []byte{1, 2, 3, 4, 5}
 
@@ -24,7 +26,7 @@ func TestBsplitterEmptyCopyAll(t *testing.T) {
 }
 
 func TestBsplitterNonemptyCopyAll(t *testing.T) {
-	bsplit := &BlockSplitterSimple{10, 5, 10}
+	bsplit := &BlockSplitterSimple{10, 5, 10, 0}
 	fblock := NewFileBlock().(*FileBlock)
 	fblock.Contents = []byte{10, 9}
 	data := []byte{1, 2, 3, 4, 5}
@@ -37,7 +39,7 @@ func TestBsplitterNonemptyCopyAll(t *testing.T) {
 }
 
 func TestBsplitterAppendAll(t *testing.T) {
-	bsplit := &BlockSplitterSimple{10, 5, 10}
+	bsplit := &BlockSplitterSimple{10, 5, 10, 0}
 	fblock := NewFileBlock().(*FileBlock)
 	fblock.Contents = []byte{10, 9}
 	data := []byte{1, 2, 3, 4, 5}
@@ -50,7 +52,7 @@ func TestBsplitterAppendAll(t *testing.T) {
 }
 
 func TestBsplitterAppendExact(t *testing.T) {
-	bsplit := &BlockSplitterSimple{10, 5, 10}
+	bsplit := &BlockSplitterSimple{10, 5, 10, 0}
 	fblock := NewFileBlock().(*FileBlock)
 	fblock.Contents = []byte{10, 9, 8, 7, 6}
 	data := []byte{1, 2, 3, 4, 5}
@@ -64,7 +66,7 @@ func TestBsplitterAppendExact(t *testing.T) {
 }
 
 func TestBsplitterSplitOne(t *testing.T) {
-	bsplit := &BlockSplitterSimple{10, 5, 10}
+	bsplit := &BlockSplitterSimple{10, 5, 10, 0}
 	fblock := NewFileBlock().(*FileBlock)
 	fblock.Contents = []byte{10, 9, 8, 7, 6}
 	data := []byte{1, 2, 3, 4, 5, 6}
@@ -78,7 +80,7 @@ func TestBsplitterSplitOne(t *testing.T) {
 }
 
 func TestBsplitterOverwriteMaxSizeBlock(t *testing.T) {
-	bsplit := &BlockSplitterSimple{5, 5, 10}
+	bsplit := &BlockSplitterSimple{5, 5, 10, 0}
 	fblock := NewFileBlock().(*FileBlock)
 	fblock.Contents = []byte{10, 9, 8, 7, 6}
 	data := []byte{1, 2, 3, 4, 5, 6, 7, 8}
@@ -91,7 +93,7 @@ func TestBsplitterOverwriteMaxSizeBlock(t *testing.T) {
 }
 
 func TestBsplitterBlockTooBig(t *testing.T) {
-	bsplit := &BlockSplitterSimple{3, 5, 10}
+	bsplit := &BlockSplitterSimple{3, 5, 10, 0}
 	fblock := NewFileBlock().(*FileBlock)
 	fblock.Contents = []byte{10, 9, 8, 7, 6}
 	data := []byte{1, 2, 3, 4, 5, 6}
@@ -104,7 +106,7 @@ func TestBsplitterBlockTooBig(t *testing.T) {
 }
 
 func TestBsplitterOffTooBig(t *testing.T) {
-	bsplit := &BlockSplitterSimple{10, 5, 10}
+	bsplit := &BlockSplitterSimple{10, 5, 10, 0}
 	fblock := NewFileBlock().(*FileBlock)
 	fblock.Contents = []byte{10, 9, 8, 7, 6}
 	data := []byte{1, 2, 3, 4, 5, 6}
@@ -118,7 +120,7 @@ func TestBsplitterOffTooBig(t *testing.T) {
 }
 
 func TestBsplitterShouldEmbed(t *testing.T) {
-	bsplit := &BlockSplitterSimple{10, 5, 10}
+	bsplit := &BlockSplitterSimple{10, 5, 10, 0}
 	bc := &BlockChanges{}
 	bc.sizeEstimate = 1
 	if !bsplit.ShouldEmbedBlockChanges(bc) {
@@ -131,7 +133,7 @@ func TestBsplitterShouldEmbed(t *testing.T) {
 }
 
 func TestBsplitterShouldNotEmbed(t *testing.T) {
-	bsplit := &BlockSplitterSimple{10, 5, 10}
+	bsplit := &BlockSplitterSimple{10, 5, 10, 0}
 	bc := &BlockChanges{}
 	bc.sizeEstimate = 11
 	if bsplit.ShouldEmbedBlockChanges(bc) {
@@ -139,6 +141,143 @@ func TestBsplitterShouldNotEmbed(t *testing.T) {
 	}
 }
 
+func makeBsplitterTestDirBlock(n int) *DirBlock {
+	dblock := NewDirBlock().(*DirBlock)
+	for i := 0; i < n; i++ {
+		dblock.Children[fmt.Sprintf("file%02d", i)] = DirEntry{
+			EntryInfo: EntryInfo{Type: File, Size: uint64(i)},
+		}
+	}
+	return dblock
+}
+
+func checkBsplitterDirSplit(t *testing.T, dblock *DirBlock,
+	blocks []*DirBlock, offs []string, maxEntries int) {
+	if len(blocks) != len(offs) {
+		t.Fatalf("Got %d blocks but %d offsets", len(blocks), len(offs))
+	}
+	if len(blocks) < 2 {
+		t.Fatalf("Directory wasn't split: %d blocks", len(blocks))
+	}
+	if offs[0] != "" {
+		t.Errorf("First offset isn't empty: %s", offs[0])
+	}
+	all := make(map[string]DirEntry)
+	for i, block := range blocks {
+		if len(block.Children) > maxEntries {
+			t.Errorf("Block %d has too many entries: %d", i,
+				len(block.Children))
+		}
+		for name, de := range block.Children {
+			if name < offs[i] || (i+1 < len(offs) && name >= offs[i+1]) {
+				t.Errorf("Entry %s is out of range for block %d", name, i)
+			}
+			all[name] = de
+		}
+	}
+	if !reflect.DeepEqual(all, dblock.Children) {
+		t.Errorf("Split blocks don't match the original entries")
+	}
+}
+
+func TestBsplitterSplitDirNotNeeded(t *testing.T) {
+	bsplit := &BlockSplitterSimple{10, 5, 10, 4}
+	blocks, offs, err := bsplit.SplitDirIfNeeded(
+		makeBsplitterTestDirBlock(4), nil)
+	if err != nil {
+		t.Fatalf("Couldn't split dir: %v", err)
+	} else if blocks != nil || offs != nil {
+		t.Errorf("Unexpected split into %d blocks", len(blocks))
+	}
+
+	// A non-positive max never splits.
+	bsplit = &BlockSplitterSimple{10, 5, 10, 0}
+	blocks, _, err = bsplit.SplitDirIfNeeded(
+		makeBsplitterTestDirBlock(100), nil)
+	if err != nil {
+		t.Fatalf("Couldn't split dir: %v", err)
+	} else if blocks != nil {
+		t.Errorf("Unexpected split into %d blocks", len(blocks))
+	}
+}
+
+func TestBsplitterSplitDir(t *testing.T) {
+	bsplit := &BlockSplitterSimple{10, 5, 10, 4}
+	dblock := makeBsplitterTestDirBlock(10)
+	blocks, offs, err := bsplit.SplitDirIfNeeded(dblock, nil)
+	if err != nil {
+		t.Fatalf("Couldn't split dir: %v", err)
+	}
+	checkBsplitterDirSplit(t, dblock, blocks, offs, 4)
+	// New blocks are only filled halfway.
+	if len(blocks) != 5 {
+		t.Errorf("Unexpected number of blocks: %d", len(blocks))
+	}
+}
+
+func TestBsplitterSplitDirStableOffsets(t *testing.T) {
+	bsplit := &BlockSplitterSimple{10, 5, 10, 4}
+	dblock := makeBsplitterTestDirBlock(10)
+	_, offs, err := bsplit.SplitDirIfNeeded(dblock, nil)
+	if err != nil {
+		t.Fatalf("Couldn't split dir: %v", err)
+	}
+
+	// Adding an entry should only affect the block that covers it.
+	dblock.Children["file03a"] = DirEntry{EntryInfo: EntryInfo{Type: File}}
+	blocks, newOffs, err := bsplit.SplitDirIfNeeded(dblock, offs)
+	if err != nil {
+		t.Fatalf("Couldn't split dir: %v", err)
+	}
+	checkBsplitterDirSplit(t, dblock, blocks, newOffs, 4)
+	if !reflect.DeepEqual(offs, newOffs) {
+		t.Errorf("Offsets changed after adding an entry: %v vs %v",
+			offs, newOffs)
+	}
+
+	// Overflowing a block splits only that block.
+	dblock.Children["file03b"] = DirEntry{EntryInfo: EntryInfo{Type: File}}
+	dblock.Children["file03c"] = DirEntry{EntryInfo: EntryInfo{Type: File}}
+	blocks, newOffs, err = bsplit.SplitDirIfNeeded(dblock, offs)
+	if err != nil {
+		t.Fatalf("Couldn't split dir: %v", err)
+	}
+	checkBsplitterDirSplit(t, dblock, blocks, newOffs, 4)
+	if len(newOffs) != len(offs)+2 {
+		t.Errorf("Unexpected number of blocks after overflow: %d",
+			len(newOffs))
+	}
+	for _, off := range offs {
+		found := false
+		for _, newOff := range newOffs {
+			if off == newOff {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("Offset %s was lost after overflow", off)
+		}
+	}
+
+	// Removing entries merges neighboring blocks back together.
+	dblock = NewDirBlock().(*DirBlock)
+	for i := 0; i < 10; i += 2 {
+		dblock.Children[fmt.Sprintf("file%02d", i)] = DirEntry{
+			EntryInfo: EntryInfo{Type: File},
+		}
+	}
+	blocks, newOffs, err = bsplit.SplitDirIfNeeded(dblock, offs)
+	if err != nil {
+		t.Fatalf("Couldn't split dir: %v", err)
+	}
+	checkBsplitterDirSplit(t, dblock, blocks, newOffs, 4)
+	if len(blocks) != 3 {
+		t.Errorf("Unexpected number of blocks after removal: %d",
+			len(blocks))
+	}
+}
+
 func TestBsplitterOverhead(t *testing.T) {
 	codec := kbfscodec.NewMsgpack()
 	desiredBlockSize := int64(64 * 1024)
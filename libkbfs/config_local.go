@@ -29,10 +29,11 @@ import (
 const (
 	// Max supported size of a directory entry name.
 	maxNameBytesDefault = 255
-	// Maximum supported plaintext size of a directory in KBFS. TODO:
-	// increase this once we support levels of indirection for
-	// directories.
-	maxDirBytesDefault = MaxBlockSizeBytesDefault
+	// Maximum supported plaintext size of a directory in KBFS.  Large
+	// directories are split into indirect blocks, but we only support
+	// one level of indirection for directories, so the top block must
+	// still be able to hold pointers to all the child blocks.
+	maxDirBytesDefault = 64 * MaxBlockSizeBytesDefault
 	// Default time after setting the rekey bit before prompting for a
 	// paper key.
 	rekeyWithPromptWaitTimeDefault = 10 * time.Minute
@@ -70,6 +71,7 @@ type ConfigLocal struct {
 	bcache         BlockCache
 	dirtyBcache    DirtyBlockCache
 	diskBlockCache DiskBlockCache
+	dedupIndex     BlockDedupIndex
 	codec          kbfscodec.Codec
 	mdops          MDOps
 	kops           KeyOps
@@ -85,6 +87,7 @@ type ConfigLocal struct {
 	clock          Clock
 	kbpki          KBPKI
 	renamer        ConflictRenamer
+	merger         ConflictMerger
 	registry       metrics.Registry
 	loggerFn       func(prefix string) logger.Logger
 	noBGFlush      bool // logic opposite so the default value is the common setting
@@ -92,6 +95,20 @@ type ConfigLocal struct {
 	diskLimiter    DiskLimiter
 	syncedTlfs     map[tlf.ID]bool
 
+	// Whether new blocks are compressed before encryption, globally
+	// and for TLFs that override the global setting.
+	blockCompression    bool
+	tlfBlockCompression map[tlf.ID]bool
+
+	// TLFs whose unmerged changes are left for manual resolution.
+	// It's nil until it's been loaded from the storage root.
+	manualCRTlfs map[tlf.ID]bool
+
+	// Per-TLF limits on the working set disk block cache.
+	diskCacheTlfLimits map[tlf.ID]DiskCacheTlfLimits
+
+	bandwidthLimiter *BandwidthLimiter
+
 	maxNameBytes uint32
 	maxDirBytes  uint64
 	rekeyQueue   RekeyQueue
@@ -127,6 +144,9 @@ type ConfigLocal struct {
 
 	quotaUsage      map[keybase1.UserOrTeamID]*EventuallyConsistentQuotaUsage
 	rekeyFSMLimiter *OngoingWorkLimiter
+
+	pathChangeServer *PathChangeServer
+	searchIndex      SearchIndex
 }
 
 var _ Config = (*ConfigLocal)(nil)
@@ -306,14 +326,18 @@ func getDefaultCleanBlockCacheCapacity() uint64 {
 func NewConfigLocal(mode InitMode, loggerFn func(module string) logger.Logger,
 	storageRoot string) *ConfigLocal {
 	config := &ConfigLocal{
-		loggerFn:    loggerFn,
-		storageRoot: storageRoot,
-		mode:        mode,
-		syncedTlfs:  make(map[tlf.ID]bool),
+		loggerFn:            loggerFn,
+		storageRoot:         storageRoot,
+		mode:                mode,
+		syncedTlfs:          make(map[tlf.ID]bool),
+		tlfBlockCompression: make(map[tlf.ID]bool),
+		diskCacheTlfLimits:  make(map[tlf.ID]DiskCacheTlfLimits),
 	}
 	config.SetClock(wallClock{})
 	config.SetReporter(NewReporterSimple(config.Clock(), 10))
 	config.SetConflictRenamer(WriterDeviceDateConflictRenamer{config})
+	config.SetConflictMerger(
+		TextConflictMerger{MaxSize: defaultConflictMergeMaxSize})
 	config.ResetCaches()
 	config.SetCodec(kbfscodec.NewMsgpack())
 	config.SetKeyOps(&KeyOpsStandard{config})
@@ -334,6 +358,8 @@ func NewConfigLocal(mode InitMode, loggerFn func(module string) logger.Logger,
 		registry := metrics.NewRegistry()
 		config.SetMetricsRegistry(registry)
 	}
+	config.bandwidthLimiter = NewBandwidthLimiter(
+		config.Clock(), config.MetricsRegistry())
 
 	config.tlfValidDuration = tlfValidDurationDefault
 	config.bgFlushDirOpBatchSize = bgFlushDirOpBatchSizeDefault
@@ -492,6 +518,20 @@ func (c *ConfigLocal) DiskBlockCache() DiskBlockCache {
 	return c.diskBlockCache
 }
 
+// BlockDedupIndex implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) BlockDedupIndex() BlockDedupIndex {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.dedupIndex
+}
+
+// SearchIndex implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SearchIndex() SearchIndex {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.searchIndex
+}
+
 // DiskLimiter implements the Config interface for ConfigLocal.
 func (c *ConfigLocal) DiskLimiter() DiskLimiter {
 	c.lock.RLock()
@@ -710,6 +750,20 @@ func (c *ConfigLocal) SetConflictRenamer(cr ConflictRenamer) {
 	c.renamer = cr
 }
 
+// ConflictMerger implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) ConflictMerger() ConflictMerger {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.merger
+}
+
+// SetConflictMerger implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetConflictMerger(cm ConflictMerger) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.merger = cm
+}
+
 // MetadataVersion implements the Config interface for ConfigLocal.
 func (c *ConfigLocal) MetadataVersion() MetadataVer {
 	c.lock.RLock()
@@ -726,7 +780,7 @@ func (c *ConfigLocal) SetMetadataVersion(mdVer MetadataVer) {
 
 // DataVersion implements the Config interface for ConfigLocal.
 func (c *ConfigLocal) DataVersion() DataVer {
-	return AtLeastTwoLevelsOfChildrenDataVer
+	return IndirectDirsDataVer
 }
 
 // DoBackgroundFlushes implements the Config interface for ConfigLocal.
@@ -834,6 +888,10 @@ func (c *ConfigLocal) resetCachesWithoutShutdown() DirtyBlockCache {
 			capacity)
 	}
 	c.bcache = NewBlockCacheStandard(10000, capacity)
+	if c.dedupIndex != nil {
+		c.bcache = dedupBlockCache{
+			c.dedupIndex, c.MakeLogger("BDI"), c, c.bcache}
+	}
 
 	if c.mode == InitMinimal {
 		// No blocks will be dirtied in minimal mode, so don't bother
@@ -1034,6 +1092,19 @@ func (c *ConfigLocal) Shutdown(ctx context.Context) error {
 		}
 	}
 
+	c.lock.Lock()
+	pathChangeServer := c.pathChangeServer
+	c.pathChangeServer = nil
+	c.lock.Unlock()
+	if pathChangeServer != nil {
+		pathChangeServer.Shutdown()
+	}
+	// Stop indexing before the TLFs being indexed are shut down.
+	searchIndex := c.SearchIndex()
+	if searchIndex != nil {
+		searchIndex.Shutdown()
+	}
+
 	var errorList []error
 	err := c.KBFSOps().Shutdown(ctx)
 	if err != nil {
@@ -1059,6 +1130,10 @@ func (c *ConfigLocal) Shutdown(ctx context.Context) error {
 	if dbc != nil {
 		dbc.Shutdown(ctx)
 	}
+	dedupIndex := c.BlockDedupIndex()
+	if dedupIndex != nil {
+		dedupIndex.Shutdown()
+	}
 
 	if len(errorList) == 1 {
 		return errorList[0]
@@ -1229,6 +1304,68 @@ func (c *ConfigLocal) MakeDiskBlockCacheIfNotExists() error {
 	return c.resetDiskBlockCacheLocked()
 }
 
+// MakeBlockDedupIndexIfNotExists implements the Config interface for
+// ConfigLocal.  It must be called before journaling is enabled, so
+// that the journal can keep de-duping turned off for journaled TLFs.
+func (c *ConfigLocal) MakeBlockDedupIndexIfNotExists() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.dedupIndex != nil {
+		return nil
+	}
+	if _, ok := c.bcache.(journalBlockCache); ok {
+		return errors.New(
+			"Can't make a dedup index after journaling is enabled")
+	}
+	index, err := newBlockDedupIndexStandard(c, c.storageRoot)
+	if err != nil {
+		return err
+	}
+	c.dedupIndex = index
+	c.bcache = dedupBlockCache{index, c.MakeLogger("BDI"), c, c.bcache}
+	return nil
+}
+
+// EnablePathChangeServer starts a PathChangeServer for this config,
+// listening on the unix socket at the given path.  It's stopped when
+// the config is shut down.
+func (c *ConfigLocal) EnablePathChangeServer(socketPath string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.pathChangeServer != nil {
+		return errors.New("The path change server is already enabled")
+	}
+	s, err := NewPathChangeServer(c, socketPath)
+	if err != nil {
+		return err
+	}
+	c.pathChangeServer = s
+	return nil
+}
+
+// EnableSearchIndex makes a SearchIndex for this config, stored
+// under its storage root, which indexes the TLFs marked for syncing
+// in the background.  If indexContents is true, the text contents of
+// files are indexed along with their names.
+func (c *ConfigLocal) EnableSearchIndex(indexContents bool) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.searchIndex != nil {
+		return errors.New("The search index is already enabled")
+	}
+	index, err := newSearchIndexStandard(c, c.storageRoot, indexContents)
+	if err != nil {
+		return err
+	}
+	c.searchIndex = index
+	for tlfID, isSynced := range c.syncedTlfs {
+		if isSynced {
+			index.StartIndexing(tlfID)
+		}
+	}
+	return nil
+}
+
 // IsSyncedTlf implements the isSyncedTlfGetter interface for ConfigLocal.
 func (c *ConfigLocal) IsSyncedTlf(tlfID tlf.ID) bool {
 	c.lock.RLock()
@@ -1250,9 +1387,135 @@ func (c *ConfigLocal) SetTlfSyncState(tlfID tlf.ID, isSynced bool) error {
 		}
 	}
 	c.syncedTlfs[tlfID] = isSynced
+	if c.searchIndex != nil {
+		if isSynced {
+			c.searchIndex.StartIndexing(tlfID)
+		} else {
+			c.searchIndex.StopIndexing(tlfID)
+		}
+	}
+	return nil
+}
+
+// IsBlockCompressionEnabled implements the
+// blockCompressionGetterSetter interface for ConfigLocal.
+func (c *ConfigLocal) IsBlockCompressionEnabled(tlfID tlf.ID) bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if enabled, ok := c.tlfBlockCompression[tlfID]; ok {
+		return enabled
+	}
+	return c.blockCompression
+}
+
+// SetBlockCompression implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetBlockCompression(enabled bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.blockCompression = enabled
+}
+
+// SetTlfBlockCompression implements the Config interface for
+// ConfigLocal.
+func (c *ConfigLocal) SetTlfBlockCompression(tlfID tlf.ID, enabled bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.tlfBlockCompression[tlfID] = enabled
+}
+
+// loadManualCRTlfsLocked loads the set of TLFs in manual conflict
+// resolution mode from the storage root, if it hasn't been loaded
+// yet.  `c.lock` must be held for writing.
+func (c *ConfigLocal) loadManualCRTlfsLocked() error {
+	if c.manualCRTlfs != nil {
+		return nil
+	}
+	if c.storageRoot == "" {
+		c.manualCRTlfs = make(map[tlf.ID]bool)
+		return nil
+	}
+	tlfs, err := readManualCRTlfs(c.codec, c.storageRoot)
+	if err != nil {
+		return err
+	}
+	c.manualCRTlfs = tlfs
+	return nil
+}
+
+// IsManualConflictResolution implements the
+// conflictResolutionModeGetterSetter interface for ConfigLocal.
+func (c *ConfigLocal) IsManualConflictResolution(tlfID tlf.ID) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	err := c.loadManualCRTlfsLocked()
+	if err != nil {
+		if log := c.MakeLogger(""); log != nil {
+			log.CWarningf(nil, "Couldn't load the manual conflict "+
+				"resolution TLFs: %+v", err)
+		}
+		return false
+	}
+	return c.manualCRTlfs[tlfID]
+}
+
+// SetManualConflictResolution implements the Config interface for
+// ConfigLocal.
+func (c *ConfigLocal) SetManualConflictResolution(
+	tlfID tlf.ID, manual bool) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	err := c.loadManualCRTlfsLocked()
+	if err != nil {
+		return err
+	}
+	if c.manualCRTlfs[tlfID] == manual {
+		return nil
+	}
+	tlfs := make(map[tlf.ID]bool, len(c.manualCRTlfs)+1)
+	for id := range c.manualCRTlfs {
+		tlfs[id] = true
+	}
+	if manual {
+		tlfs[tlfID] = true
+	} else {
+		delete(tlfs, tlfID)
+	}
+	if c.storageRoot != "" {
+		err := writeManualCRTlfs(c.codec, c.storageRoot, tlfs)
+		if err != nil {
+			return err
+		}
+	}
+	c.manualCRTlfs = tlfs
 	return nil
 }
 
+// DiskCacheTlfLimits implements the diskCacheTlfLimitsGetterSetter
+// interface for ConfigLocal.
+func (c *ConfigLocal) DiskCacheTlfLimits(tlfID tlf.ID) DiskCacheTlfLimits {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.diskCacheTlfLimits[tlfID]
+}
+
+// SetDiskCacheTlfLimits implements the Config interface for
+// ConfigLocal.
+func (c *ConfigLocal) SetDiskCacheTlfLimits(
+	tlfID tlf.ID, limits DiskCacheTlfLimits) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if limits.IsDefault() {
+		delete(c.diskCacheTlfLimits, tlfID)
+	} else {
+		c.diskCacheTlfLimits[tlfID] = limits
+	}
+}
+
+// BandwidthLimiter implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) BandwidthLimiter() *BandwidthLimiter {
+	return c.bandwidthLimiter
+}
+
 // GetRekeyFSMLimiter implements the Config interface for ConfigLocal.
 func (c *ConfigLocal) GetRekeyFSMLimiter() *OngoingWorkLimiter {
 	return c.rekeyFSMLimiter
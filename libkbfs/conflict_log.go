@@ -0,0 +1,234 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// maxConflictLogRecords is the most conflict records kept for each
+// TLF; the oldest ones are dropped as new ones come in.
+const maxConflictLogRecords = 100
+
+// conflictLogDir is the name of the directory, under the storage
+// root, holding the conflict logs of all TLFs.
+const conflictLogDir = "kbfs_conflicts"
+
+// conflictLogKeyPurpose names the key that conflict logs are
+// encrypted with.
+const conflictLogKeyPurpose = "Keybase-KBFS-Conflict-Log-1"
+
+// ConflictAction describes how conflict resolution dealt with a
+// conflicting entry.
+type ConflictAction string
+
+const (
+	// ConflictRenamedUnmerged means the local, unmerged version of
+	// the entry was moved aside to a new name, and the merged
+	// version kept the original name.
+	ConflictRenamedUnmerged ConflictAction = "renamed-unmerged"
+	// ConflictRenamedMerged means the merged version of the entry
+	// was moved aside to a new name, and the local, unmerged version
+	// took the original name.
+	ConflictRenamedMerged ConflictAction = "renamed-merged"
+	// ConflictMergedContents means that both versions of a file were
+	// merged into one (see ConflictMerger).
+	ConflictMergedContents ConflictAction = "merged"
+	// ConflictAcceptedUnmerged means that the local, unmerged
+	// version of a file replaced the merged version, because the
+	// user asked for it (see ResolveAcceptLocal).
+	ConflictAcceptedUnmerged ConflictAction = "accepted-unmerged"
+)
+
+// ConflictRecord describes one decision made while resolving a
+// conflict in a TLF.  It is suitable for encoding directly as JSON.
+type ConflictRecord struct {
+	Time   time.Time
+	Action ConflictAction
+	// Path is the full path of the conflicting entry, and NewPath
+	// is the full path that one of its versions was moved to, if
+	// any.
+	Path    string
+	NewPath string `json:",omitempty"`
+
+	// MergedWriter made the last change to the entry on the merged
+	// branch, in MergedRevision.  UnmergedWriter made the last local
+	// change to the entry, in UnmergedRevision of the local branch.
+	MergedWriter     libkb.NormalizedUsername
+	MergedRevision   kbfsmd.Revision
+	UnmergedWriter   libkb.NormalizedUsername
+	UnmergedRevision kbfsmd.Revision
+
+	// ResolvedRevision is the merged revision containing the
+	// resolution.
+	ResolvedRevision kbfsmd.Revision
+}
+
+// folderConflictLog keeps the most recent conflict records of a TLF,
+// in a diskJournal encrypted using getTLFLocalKey if there's a
+// storage root, and otherwise only in memory.
+type folderConflictLog struct {
+	config       Config
+	log          logger.Logger
+	folderBranch FolderBranch
+
+	lock sync.Mutex
+	// loaded is true once records has been read from j.
+	loaded bool
+	// j is nil if there's no storage root.
+	j   *diskJournal
+	key *[32]byte
+	// records holds every record in the log, oldest first.
+	records []ConflictRecord
+}
+
+func newFolderConflictLog(
+	config Config, fb FolderBranch, log logger.Logger) *folderConflictLog {
+	return &folderConflictLog{
+		config:       config,
+		log:          log,
+		folderBranch: fb,
+	}
+}
+
+func (fcl *folderConflictLog) getKeyLocked(
+	ctx context.Context, kmd KeyMetadata) ([32]byte, error) {
+	if fcl.key != nil {
+		return *fcl.key, nil
+	}
+	key, err := getTLFLocalKey(
+		ctx, fcl.config.KeyManager(), kmd, conflictLogKeyPurpose)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	fcl.key = &key
+	return key, nil
+}
+
+func (fcl *folderConflictLog) loadLocked(
+	ctx context.Context, kmd KeyMetadata) error {
+	if fcl.loaded {
+		return nil
+	}
+	storageRoot := fcl.config.StorageRoot()
+	if storageRoot == "" {
+		fcl.loaded = true
+		return nil
+	}
+
+	dir := filepath.Join(
+		storageRoot, conflictLogDir, fcl.folderBranch.Tlf.String())
+	j, err := makeDiskJournal(
+		fcl.config.Codec(), dir, reflect.TypeOf(encryptedData{}))
+	if err != nil {
+		return err
+	}
+	var records []ConflictRecord
+	if !j.empty() {
+		key, err := fcl.getKeyLocked(ctx, kmd)
+		if err != nil {
+			return err
+		}
+		earliest, err := j.readEarliestOrdinal()
+		if err != nil {
+			return err
+		}
+		latest, err := j.readLatestOrdinal()
+		if err != nil {
+			return err
+		}
+		crypto := MakeCryptoCommon(fcl.config.Codec())
+		for o := earliest; o <= latest; o++ {
+			entry, err := j.readJournalEntry(o)
+			if err != nil {
+				return err
+			}
+			buf, err := crypto.decryptData(entry.(encryptedData), key)
+			if err != nil {
+				return err
+			}
+			var record ConflictRecord
+			err = json.Unmarshal(buf, &record)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			records = append(records, record)
+		}
+	}
+	fcl.log.CDebugf(ctx, "Loaded %d conflict records", len(records))
+	fcl.j = j
+	fcl.records = records
+	fcl.loaded = true
+	return nil
+}
+
+// add appends the given records to the log, and drops any records
+// beyond maxConflictLogRecords.  `kmd` should be a recent revision
+// of the TLF, for the keys.
+func (fcl *folderConflictLog) add(ctx context.Context,
+	kmd KeyMetadata, records []ConflictRecord) error {
+	fcl.lock.Lock()
+	defer fcl.lock.Unlock()
+	err := fcl.loadLocked(ctx, kmd)
+	if err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		if fcl.j != nil {
+			key, err := fcl.getKeyLocked(ctx, kmd)
+			if err != nil {
+				return err
+			}
+			buf, err := json.Marshal(record)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			crypto := MakeCryptoCommon(fcl.config.Codec())
+			encrypted, err := crypto.encryptData(buf, key)
+			if err != nil {
+				return err
+			}
+			_, err = fcl.j.appendJournalEntry(nil, encrypted)
+			if err != nil {
+				return err
+			}
+		}
+		fcl.records = append(fcl.records, record)
+
+		if len(fcl.records) > maxConflictLogRecords {
+			if fcl.j != nil {
+				_, err := fcl.j.removeEarliest()
+				if err != nil {
+					return err
+				}
+			}
+			fcl.records = fcl.records[1:]
+		}
+	}
+	return nil
+}
+
+// getRecords returns all the records in the log, oldest first.
+func (fcl *folderConflictLog) getRecords(
+	ctx context.Context, kmd KeyMetadata) ([]ConflictRecord, error) {
+	fcl.lock.Lock()
+	defer fcl.lock.Unlock()
+	err := fcl.loadLocked(ctx, kmd)
+	if err != nil {
+		return nil, err
+	}
+	return append([]ConflictRecord(nil), fcl.records...), nil
+}
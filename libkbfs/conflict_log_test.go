@@ -0,0 +1,93 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/keybase/kbfs/ioutil"
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFolderConflictLog(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "alice")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	tempdir, err := ioutil.TempDir(os.TempDir(), "conflict_log")
+	require.NoError(t, err)
+	defer func() {
+		err := ioutil.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+	config.storageRoot = tempdir
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "alice", tlf.Private)
+	fb := rootNode.GetFolderBranch()
+	head := getOps(config, fb.Tlf).getTrustedHead(makeFBOLockState())
+
+	makeRecord := func(i int) ConflictRecord {
+		return ConflictRecord{
+			Time:   time.Unix(int64(i), 0).UTC(),
+			Action: ConflictRenamedUnmerged,
+			Path:   fmt.Sprintf("/keybase/private/alice/secret%d", i),
+			NewPath: fmt.Sprintf(
+				"/keybase/private/alice/secret%d.conflicted", i),
+			MergedWriter:     "alice",
+			MergedRevision:   kbfsmd.Revision(i),
+			UnmergedWriter:   "alice",
+			UnmergedRevision: kbfsmd.Revision(i + 1),
+			ResolvedRevision: kbfsmd.Revision(i + 2),
+		}
+	}
+	var expected []ConflictRecord
+	for i := 0; i < 3; i++ {
+		expected = append(expected, makeRecord(i))
+	}
+
+	fcl := newFolderConflictLog(config, fb, config.MakeLogger(""))
+	err = fcl.add(ctx, head, expected)
+	require.NoError(t, err)
+	records, err := fcl.getRecords(ctx, head)
+	require.NoError(t, err)
+	require.Equal(t, expected, records)
+
+	t.Log("Records are reloaded from disk, and the paths aren't " +
+		"stored in the clear")
+	fcl = newFolderConflictLog(config, fb, config.MakeLogger(""))
+	records, err = fcl.getRecords(ctx, head)
+	require.NoError(t, err)
+	require.Equal(t, expected, records)
+	dir := filepath.Join(tempdir, conflictLogDir, fb.Tlf.String())
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	for _, fi := range files {
+		buf, err := ioutil.ReadFile(filepath.Join(dir, fi.Name()))
+		require.NoError(t, err)
+		require.False(t, bytes.Contains(buf, []byte("secret")))
+	}
+
+	t.Log("Only the most recent records are kept")
+	var more []ConflictRecord
+	for i := 3; i < maxConflictLogRecords+5; i++ {
+		more = append(more, makeRecord(i))
+	}
+	err = fcl.add(ctx, head, more)
+	require.NoError(t, err)
+	expected = append(expected, more...)[5:]
+	records, err = fcl.getRecords(ctx, head)
+	require.NoError(t, err)
+	require.Equal(t, expected, records)
+	fcl = newFolderConflictLog(config, fb, config.MakeLogger(""))
+	records, err = fcl.getRecords(ctx, head)
+	require.NoError(t, err)
+	require.Equal(t, expected, records)
+}
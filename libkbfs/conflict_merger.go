@@ -0,0 +1,187 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+
+	"github.com/sergi/go-diff/diffmatchpatch"
+)
+
+// defaultConflictMergeMaxSize is the largest file that will be
+// merged by default, when conflict merging is enabled.
+const defaultConflictMergeMaxSize = 64 * 1024
+
+// TextConflictMerger merges text files that were written on both
+// branches of a conflict, line by line, against the version of the
+// file from before the branches diverged.  Only files with a name
+// matching one of Patterns (see filepath.Match), and no bigger than
+// MaxSize bytes, are merged; if Patterns is empty, nothing is.
+type TextConflictMerger struct {
+	Patterns []string
+	MaxSize  uint64
+}
+
+var _ ConflictMerger = TextConflictMerger{}
+
+// ShouldMerge implements the ConflictMerger interface for
+// TextConflictMerger.
+func (tcm TextConflictMerger) ShouldMerge(name string, size uint64) bool {
+	if size > tcm.MaxSize {
+		return false
+	}
+	for _, pattern := range tcm.Patterns {
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// ConflictMerge implements the ConflictMerger interface for
+// TextConflictMerger.
+func (tcm TextConflictMerger) ConflictMerge(
+	base, merged, unmerged []byte) ([]byte, bool) {
+	for _, data := range [][]byte{base, merged, unmerged} {
+		// Binary files can't be merged as text.
+		if bytes.IndexByte(data, 0) >= 0 {
+			return nil, false
+		}
+	}
+	return mergeTextLines(string(base), string(merged), string(unmerged))
+}
+
+// ParseConflictMergePatterns splits a comma-separated list of file
+// name patterns, suitable for TextConflictMerger.Patterns.
+func ParseConflictMergePatterns(s string) []string {
+	var patterns []string
+	for _, pattern := range strings.Split(s, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns
+}
+
+// textHunk replaces the base lines in [start, end) with `lines`.
+type textHunk struct {
+	start, end int
+	lines      []string
+}
+
+func (th textHunk) equals(other textHunk) bool {
+	if th.start != other.start || th.end != other.end ||
+		len(th.lines) != len(other.lines) {
+		return false
+	}
+	for i, line := range th.lines {
+		if other.lines[i] != line {
+			return false
+		}
+	}
+	return true
+}
+
+// diffmatchpatch encodes each line as a rune, so it can't tell
+// apart more lines than there are non-surrogate runes.
+const maxMergeableLines = 0xD800
+
+// textHunks returns the list of changes needed to turn `base` into
+// `other`, in order, along with the lines of `base`.
+func textHunks(base, other string) (
+	hunks []textHunk, baseLines []string, ok bool) {
+	dmp := diffmatchpatch.New()
+	baseRunes, otherRunes, lineArray := dmp.DiffLinesToRunes(base, other)
+	if len(lineArray) >= maxMergeableLines {
+		return nil, nil, false
+	}
+	for _, r := range baseRunes {
+		baseLines = append(baseLines, lineArray[r])
+	}
+
+	var curr *textHunk
+	pos := 0
+	for _, diff := range dmp.DiffMainRunes(baseRunes, otherRunes, false) {
+		runes := []rune(diff.Text)
+		if diff.Type == diffmatchpatch.DiffEqual {
+			if curr != nil {
+				hunks = append(hunks, *curr)
+				curr = nil
+			}
+			pos += len(runes)
+			continue
+		}
+
+		if curr == nil {
+			curr = &textHunk{start: pos, end: pos}
+		}
+		if diff.Type == diffmatchpatch.DiffDelete {
+			pos += len(runes)
+			curr.end = pos
+		} else {
+			for _, r := range runes {
+				curr.lines = append(curr.lines, lineArray[r])
+			}
+		}
+	}
+	if curr != nil {
+		hunks = append(hunks, *curr)
+	}
+	return hunks, baseLines, true
+}
+
+// mergeTextLines does a three-way merge of the lines changed between
+// `base` and each of `a` and `b`.  It returns false if any changes
+// from the two sides overlap or touch, unless they are identical.
+func mergeTextLines(base, a, b string) ([]byte, bool) {
+	aHunks, baseLines, ok := textHunks(base, a)
+	if !ok {
+		return nil, false
+	}
+	bHunks, _, ok := textHunks(base, b)
+	if !ok {
+		return nil, false
+	}
+
+	// Hunks from the same side never touch, since there's always
+	// at least one unchanged line between them, so each hunk only
+	// needs to be checked against the one before it.
+	var buf bytes.Buffer
+	pos := 0
+	var prev *textHunk
+	for len(aHunks) > 0 || len(bHunks) > 0 {
+		var h textHunk
+		if len(bHunks) == 0 ||
+			(len(aHunks) > 0 && aHunks[0].start <= bHunks[0].start) {
+			h, aHunks = aHunks[0], aHunks[1:]
+		} else {
+			h, bHunks = bHunks[0], bHunks[1:]
+		}
+
+		if prev != nil && h.start <= prev.end {
+			if h.equals(*prev) {
+				// Both sides made the same change.
+				continue
+			}
+			return nil, false
+		}
+
+		for _, line := range baseLines[pos:h.start] {
+			buf.WriteString(line)
+		}
+		for _, line := range h.lines {
+			buf.WriteString(line)
+		}
+		pos = h.end
+		prev = &h
+	}
+	for _, line := range baseLines[pos:] {
+		buf.WriteString(line)
+	}
+	return buf.Bytes(), true
+}
@@ -0,0 +1,67 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTextConflictMergerShouldMerge(t *testing.T) {
+	tcm := TextConflictMerger{
+		Patterns: ParseConflictMergePatterns("*.txt, config ,"),
+		MaxSize:  10,
+	}
+	require.Equal(t, []string{"*.txt", "config"}, tcm.Patterns)
+	require.True(t, tcm.ShouldMerge("a.txt", 10))
+	require.True(t, tcm.ShouldMerge("config", 0))
+	require.False(t, tcm.ShouldMerge("a.txt", 11))
+	require.False(t, tcm.ShouldMerge("a.go", 1))
+
+	require.False(t, TextConflictMerger{MaxSize: 10}.ShouldMerge("a.txt", 1))
+}
+
+func testTextConflictMerge(
+	t *testing.T, base, merged, unmerged, expected string) {
+	tcm := TextConflictMerger{}
+	data, ok := tcm.ConflictMerge(
+		[]byte(base), []byte(merged), []byte(unmerged))
+	if expected == "" {
+		require.False(t, ok, "Unexpected merge result %q", data)
+		return
+	}
+	require.True(t, ok)
+	require.Equal(t, expected, string(data))
+}
+
+func TestTextConflictMerge(t *testing.T) {
+	base := "a\nb\nc\nd\ne\n"
+
+	t.Log("Changes on different lines")
+	testTextConflictMerge(t, base,
+		"A\nb\nc\nd\ne\n", "a\nb\nc\nd\nE\n", "A\nb\nc\nd\nE\n")
+	t.Log("Inserts and deletes")
+	testTextConflictMerge(t, base,
+		"a\nb\nb2\nc\nd\ne\n", "a\nb\nc\ne\n", "a\nb\nb2\nc\ne\n")
+	t.Log("Appending to a file with no trailing newline")
+	testTextConflictMerge(t, "a\nb\nc",
+		"A\nb\nc", "a\nb\nc\nd\n", "A\nb\nc\nd\n")
+	t.Log("Identical changes")
+	testTextConflictMerge(t, base,
+		"a\nB\nc\nd\ne\n", "a\nB\nc\nd\nE\n", "a\nB\nc\nd\nE\n")
+	t.Log("Empty base")
+	testTextConflictMerge(t, "", "", "a\n", "a\n")
+
+	t.Log("Overlapping changes")
+	testTextConflictMerge(t, base, "a\nB\nc\nd\ne\n", "a\nb2\nc\nd\ne\n", "")
+	t.Log("Adjacent changes")
+	testTextConflictMerge(t, base, "a\nB\nc\nd\ne\n", "a\nb\nC\nd\ne\n", "")
+	t.Log("Different inserts at the same place")
+	testTextConflictMerge(t, base, "a\nx\nb\nc\nd\ne\n", "a\ny\nb\nc\nd\ne\n",
+		"")
+	t.Log("Binary data")
+	testTextConflictMerge(t, "a\x00\nb\n", "A\x00\nb\n", "a\x00\nB\n", "")
+}
@@ -12,6 +12,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/keybase/client/go/libkb"
 	"github.com/keybase/kbfs/kbfsblock"
 	"github.com/keybase/kbfs/kbfscrypto"
 	"github.com/keybase/kbfs/kbfsmd"
@@ -1657,8 +1658,8 @@ func (cr *ConflictResolver) fixRenameConflicts(ctx context.Context,
 				case *syncOp:
 					realOp.keepUnmergedTailName = true
 					unmergedParentPath = *op.getFinalPath().parentPath()
-				case *setAttrOp:
-					realOp.keepUnmergedTailName = true
+				case attrChanger:
+					realOp.attrOp().keepUnmergedTailName = true
 					unmergedParentPath = *op.getFinalPath().parentPath()
 				}
 			}
@@ -1967,7 +1968,7 @@ func collapseActions(unmergedChains *crChains, unmergedPaths []path,
 
 		fileActions := actionMap[p.tailPointer()]
 
-		// If this is a directory with setAttr(mtime)-related actions,
+		// If this is a directory with setAttr(mtime/xattr)-related actions,
 		// just those action should be collapsed into the parent.
 		if !chain.isFile() {
 			var parentActions crActionList
@@ -1976,7 +1977,8 @@ func collapseActions(unmergedChains *crChains, unmergedPaths []path,
 				moved := false
 				switch realAction := action.(type) {
 				case *copyUnmergedAttrAction:
-					if realAction.attr[0] == mtimeAttr && !realAction.moved {
+					if (realAction.attr[0] == mtimeAttr ||
+						realAction.attr[0] == xattrAttr) && !realAction.moved {
 						realAction.moved = true
 						parentActions = append(parentActions, realAction)
 						moved = true
@@ -2182,11 +2184,229 @@ func (cr *ConflictResolver) makeFileBlockDeepCopy(ctx context.Context,
 	return newPtr, nil
 }
 
+// fetchDirectFileContents returns the contents of the file with the
+// given pointer, or false if the file is too big to fit in a single
+// block.
+func (cr *ConflictResolver) fetchDirectFileContents(ctx context.Context,
+	lState *lockState, chains *crChains, ptr BlockPointer) (
+	[]byte, bool, error) {
+	if !ptr.IsInitialized() {
+		// An empty file.
+		return nil, true, nil
+	}
+	fblock, err := cr.fbo.blocks.GetFileBlockForReading(ctx, lState,
+		chains.mostRecentChainMDInfo.kmd, ptr, cr.fbo.branch(), path{})
+	if err != nil {
+		return nil, false, err
+	}
+	if fblock.IsInd {
+		return nil, false, nil
+	}
+	return fblock.Contents, true, nil
+}
+
+// makeMergeFileAction checks whether the file conflict represented
+// by the given renameUnmergedAction can be resolved by merging the
+// contents of the file from both branches, according to the
+// configured ConflictMerger.  If so, it returns an action to do
+// that, containing the merged file block; otherwise it returns nil.
+// If the user asked to accept their local changes, the action
+// instead copies the whole unmerged file over the merged one.
+func (cr *ConflictResolver) makeMergeFileAction(ctx context.Context,
+	lState *lockState, unmergedChains, mergedChains *crChains,
+	rua *renameUnmergedAction, mergedPath path,
+	unmergedBlock, mergedBlock *DirBlock) (
+	*mergeUnmergedFileAction, error) {
+	acceptLocal := cr.fbo.isAcceptingLocal(lState)
+	merger := cr.config.ConflictMerger()
+	if (merger == nil && !acceptLocal) || rua.symPath != "" ||
+		!rua.unmergedParentMostRecent.IsInitialized() {
+		// Not a conflict between two file writes.
+		return nil, nil
+	}
+
+	unmergedEntry, ok := unmergedBlock.Children[rua.fromName]
+	if !ok || unmergedEntry.Type == Dir || unmergedEntry.Type == Sym {
+		return nil, nil
+	}
+	mergedEntry, ok := mergedBlock.Children[rua.fromName]
+	if !ok || mergedEntry.Type == Dir || mergedEntry.Type == Sym {
+		return nil, nil
+	}
+	size := mergedEntry.Size
+	if unmergedEntry.Size > size {
+		size = unmergedEntry.Size
+	}
+	if !acceptLocal && !merger.ShouldMerge(rua.fromName, size) {
+		return nil, nil
+	}
+
+	// Only merge writes; any other unmerged changes to the file
+	// (like attributes) would be lost.
+	unmergedChain, ok := unmergedChains.byMostRecent[unmergedEntry.BlockPointer]
+	if !ok {
+		return nil, nil
+	}
+	for _, op := range unmergedChain.ops {
+		if _, ok := op.(*syncOp); !ok {
+			return nil, nil
+		}
+	}
+	mergedChain, ok := mergedChains.byOriginal[unmergedChain.original]
+	if !ok || mergedChain.mostRecent != mergedEntry.BlockPointer {
+		// The merged file was moved or replaced.
+		return nil, nil
+	}
+
+	if acceptLocal {
+		// The unmerged block tree is copied over when the action is
+		// done, so files of any size can be accepted.  Syncing the
+		// copy only replaces the top merged block, so the rest of
+		// the merged file needs to be unreferenced explicitly.
+		mergedInfos, err := cr.fbo.blocks.GetIndirectFileBlockInfos(ctx,
+			lState, mergedChains.mostRecentChainMDInfo.kmd,
+			mergedPath.ChildPath(rua.fromName, mergedEntry.BlockPointer))
+		if err != nil {
+			return nil, err
+		}
+		mergedChildPtrs := make([]BlockPointer, 0, len(mergedInfos))
+		for _, info := range mergedInfos {
+			mergedChildPtrs = append(mergedChildPtrs, info.BlockPointer)
+		}
+		cr.log.CDebugf(ctx, "Accepting the local version of %s",
+			rua.fromName)
+		return &mergeUnmergedFileAction{
+			name:            rua.fromName,
+			unmergedPtr:     unmergedEntry.BlockPointer,
+			mergedSize:      mergedEntry.Size,
+			unmergedSize:    unmergedEntry.Size,
+			acceptLocal:     true,
+			mergedChildPtrs: mergedChildPtrs,
+		}, nil
+	}
+	unmergedData, ok, err := cr.fetchDirectFileContents(
+		ctx, lState, unmergedChains, unmergedEntry.BlockPointer)
+	if err != nil || !ok {
+		return nil, err
+	}
+	mergedData, ok, err := cr.fetchDirectFileContents(
+		ctx, lState, mergedChains, mergedEntry.BlockPointer)
+	if err != nil || !ok {
+		return nil, err
+	}
+	// The common ancestor might already have been garbage-collected
+	// on the merged branch, so just fall back to a rename if it
+	// can't be read.
+	baseData, ok, err := cr.fetchDirectFileContents(
+		ctx, lState, unmergedChains, unmergedChain.original)
+	if err != nil {
+		cr.log.CDebugf(ctx, "Couldn't fetch the original version of %s: %+v",
+			rua.fromName, err)
+		return nil, nil
+	} else if !ok {
+		return nil, nil
+	}
+
+	data, ok := merger.ConflictMerge(baseData, mergedData, unmergedData)
+	if !ok {
+		cr.log.CDebugf(ctx, "Couldn't merge the changes to %s", rua.fromName)
+		return nil, nil
+	}
+
+	fblock := NewFileBlock().(*FileBlock)
+	fblock.Contents = data
+	if cr.config.BlockSplitter().CheckSplit(fblock) > 0 {
+		// Only single-block results are supported.
+		return nil, nil
+	}
+
+	cr.log.CDebugf(ctx, "Merged the changes to %s", rua.fromName)
+	return &mergeUnmergedFileAction{
+		name:         rua.fromName,
+		unmergedPtr:  unmergedEntry.BlockPointer,
+		mergedSize:   mergedEntry.Size,
+		unmergedSize: unmergedEntry.Size,
+		fblock:       fblock,
+	}, nil
+}
+
+// crConflict describes a decision made by conflict resolution about
+// one conflicting entry, in the merged directory `dir`.
+type crConflict struct {
+	action         ConflictAction
+	dir            path
+	name           string
+	newName        string
+	unmergedWriter writerInfo
+	mergedWriter   writerInfo
+}
+
+// crConflictNames returns the kind of conflict resolved by the given
+// action, if any, along with the original name of the conflicting
+// entry and the name it's been moved to.  The new name isn't final
+// until the action has been done.
+func crConflictNames(action crAction) (
+	kind ConflictAction, name, newName string) {
+	switch realAction := action.(type) {
+	case *renameUnmergedAction:
+		return ConflictRenamedUnmerged, realAction.fromName, realAction.toName
+	case *copyUnmergedEntryAction:
+		if realAction.unique {
+			return ConflictRenamedUnmerged, realAction.fromName,
+				realAction.toName
+		}
+	case *renameMergedAction:
+		return ConflictRenamedMerged, realAction.fromName, realAction.toName
+	case *mergeUnmergedFileAction:
+		if realAction.acceptLocal {
+			return ConflictAcceptedUnmerged, realAction.name, realAction.name
+		}
+		return ConflictMergedContents, realAction.name, realAction.name
+	}
+	return "", "", ""
+}
+
+// crLastWriter returns the info for the last op in `chains` that
+// changed the entry `name` of the given directory, either through
+// the entry's own chain or through the directory's.
+func crLastWriter(chains *crChains, dirMostRecent BlockPointer,
+	dirBlock *DirBlock, name string) (info writerInfo) {
+	if entry, ok := dirBlock.Children[name]; ok {
+		chain, ok := chains.byMostRecent[entry.BlockPointer]
+		if ok && len(chain.ops) > 0 {
+			return chain.ops[len(chain.ops)-1].getWriterInfo()
+		}
+	}
+
+	chain, ok := chains.byMostRecent[dirMostRecent]
+	if !ok {
+		return info
+	}
+	for _, op := range chain.ops {
+		var opName string
+		switch realOp := op.(type) {
+		case *createOp:
+			opName = realOp.NewName
+		case *rmOp:
+			opName = realOp.OldName
+		case entryMover:
+			opName = realOp.moveOp().NewName
+		case attrChanger:
+			opName = realOp.attrOp().Name
+		}
+		if opName == name {
+			info = op.getWriterInfo()
+		}
+	}
+	return info
+}
+
 func (cr *ConflictResolver) doActions(ctx context.Context,
 	lState *lockState, unmergedChains, mergedChains *crChains,
 	unmergedPaths []path, mergedPaths map[BlockPointer]path,
 	actionMap map[BlockPointer]crActionList, lbc localBcache,
-	newFileBlocks fileBlockMap, dirtyBcache DirtyBlockCache) error {
+	newFileBlocks fileBlockMap, dirtyBcache DirtyBlockCache) (
+	[]crConflict, error) {
 	// For each set of actions:
 	//   * Find the corresponding chains
 	//   * Make a reference to each slice of ops
@@ -2199,12 +2419,13 @@ func (cr *ConflictResolver) doActions(ctx context.Context,
 	// updated merged blocks.  A future phase will update the pointers
 	// in standard Merkle-tree-fashion.
 	doneActions := make(map[BlockPointer]bool)
+	var conflicts []crConflict
 	for _, unmergedPath := range unmergedPaths {
 		unmergedMostRecent := unmergedPath.tailPointer()
 		unmergedChain, ok :=
 			unmergedChains.byMostRecent[unmergedMostRecent]
 		if !ok {
-			return fmt.Errorf("Couldn't find unmerged chain for %v",
+			return nil, fmt.Errorf("Couldn't find unmerged chain for %v",
 				unmergedMostRecent)
 		}
 
@@ -2232,7 +2453,7 @@ func (cr *ConflictResolver) doActions(ctx context.Context,
 			unmergedChains.mostRecentChainMDInfo.kmd,
 			unmergedPath, lbc)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		// recreateOps update the merged paths using original
@@ -2248,7 +2469,7 @@ func (cr *ConflictResolver) doActions(ctx context.Context,
 				mergedChains.mostRecentChainMDInfo.kmd,
 				mergedPath, lbc)
 			if err != nil {
-				return err
+				return nil, err
 			}
 		}
 
@@ -2273,11 +2494,37 @@ func (cr *ConflictResolver) doActions(ctx context.Context,
 
 			// Execute each action and save the modified ops back into
 			// each chain.
-			for _, action := range actions {
+			for i, action := range actions {
+				// Files written in both branches might be mergeable,
+				// instead of needing a rename.
+				if rua, ok := action.(*renameUnmergedAction); ok {
+					mufa, err := cr.makeMergeFileAction(ctx, lState,
+						unmergedChains, mergedChains, rua, mergedPath,
+						unmergedBlock, mergedBlock)
+					if err != nil {
+						return nil, err
+					}
+					if mufa != nil {
+						mergedMostRecent := mergedPath.tailPointer()
+						if _, ok := newFileBlocks[mergedMostRecent]; !ok {
+							newFileBlocks[mergedMostRecent] =
+								make(map[string]*FileBlock)
+						}
+						if !mufa.acceptLocal {
+							newFileBlocks[mergedMostRecent][mufa.name] =
+								mufa.fblock
+						}
+						// Replace it in the list too, so the
+						// updateOps calls below see it.
+						actions[i] = mufa
+						action = mufa
+					}
+				}
+
 				swap, newPtr, err := action.swapUnmergedBlock(unmergedChains,
 					mergedChains, unmergedBlock)
 				if err != nil {
-					return err
+					return nil, err
 				}
 				uBlock := unmergedBlock
 				if swap {
@@ -2294,16 +2541,41 @@ func (cr *ConflictResolver) doActions(ctx context.Context,
 							mergedChains.mostRecentChainMDInfo.kmd, newPtr,
 							mergedPath.Branch, path{})
 						if err != nil {
-							return err
+							return nil, err
 						}
 						uBlock = dBlock
 					}
 				}
 
+				// Note who last changed any conflicting entry
+				// before the action moves it.
+				kind, name, _ := crConflictNames(action)
+				var unmergedWriter, mergedWriter writerInfo
+				if kind != "" {
+					unmergedWriter = crLastWriter(unmergedChains,
+						unmergedPath.tailPointer(), uBlock, name)
+					mergedWriter = crLastWriter(mergedChains,
+						mergedPath.tailPointer(), mergedBlock, name)
+				}
+
 				err = action.do(ctx, unmergedFetcher, mergedFetcher, uBlock,
 					mergedBlock)
 				if err != nil {
-					return err
+					return nil, err
+				}
+
+				kind, name, newName := crConflictNames(action)
+				if kind == ConflictMergedContents ||
+					kind == ConflictAcceptedUnmerged ||
+					(kind != "" && newName != name) {
+					conflicts = append(conflicts, crConflict{
+						action:         kind,
+						dir:            mergedPath,
+						name:           name,
+						newName:        newName,
+						unmergedWriter: unmergedWriter,
+						mergedWriter:   mergedWriter,
+					})
 				}
 			}
 		}
@@ -2323,11 +2595,11 @@ func (cr *ConflictResolver) doActions(ctx context.Context,
 			err := action.updateOps(unmergedMostRecent, mergedMostRecent,
 				unmergedBlock, mergedBlock, unmergedChains, mergedChains)
 			if err != nil {
-				return err
+				return nil, err
 			}
 		}
 	}
-	return nil
+	return conflicts, nil
 }
 
 type crRenameHelperKey struct {
@@ -2460,7 +2732,8 @@ func (cr *ConflictResolver) makeRevertedOps(ctx context.Context,
 				op = chains.copyOpAndRevertUnrefsToOriginals(op)
 				// The dir of renamed setAttrOps must be reverted to
 				// the new parent's original pointer.
-				if sao, ok := op.(*setAttrOp); ok {
+				if ac, ok := op.(attrChanger); ok {
+					sao := ac.attrOp()
 					if newDir, _, ok :=
 						otherChains.renamedParentAndName(sao.File); ok {
 						err := sao.Dir.setUnref(newDir)
@@ -3004,6 +3277,70 @@ outer:
 	return nil
 }
 
+// writerName returns the name of the given writer, or just its UID
+// if the name can't be found.
+func (cr *ConflictResolver) writerName(
+	ctx context.Context, info writerInfo) libkb.NormalizedUsername {
+	if info.uid.IsNil() {
+		return ""
+	}
+	name, err := cr.config.KBPKI().GetNormalizedUsername(
+		ctx, info.uid.AsUserOrTeam())
+	if err != nil {
+		cr.log.CDebugf(ctx, "Couldn't get the name of writer %s: %+v",
+			info.uid, err)
+		return libkb.NormalizedUsername(info.uid.String())
+	}
+	return name
+}
+
+// recordConflicts saves the decisions made by a successful
+// resolution in the TLF's conflict log, and notifies any UIs about
+// them, so that the user can go look at the affected files.
+func (cr *ConflictResolver) recordConflicts(ctx context.Context,
+	lState *lockState, conflicts []crConflict) {
+	if len(conflicts) == 0 {
+		return
+	}
+	head := cr.fbo.getTrustedHead(lState)
+	if head == (ImmutableRootMetadata{}) {
+		cr.log.CDebugf(ctx, "No trusted head for recording conflicts")
+		return
+	}
+
+	now := cr.config.Clock().Now()
+	records := make([]ConflictRecord, 0, len(conflicts))
+	for _, c := range conflicts {
+		record := ConflictRecord{
+			Time:             now,
+			Action:           c.action,
+			Path:             c.dir.ChildPathNoPtr(c.name).CanonicalPathString(),
+			MergedWriter:     cr.writerName(ctx, c.mergedWriter),
+			MergedRevision:   c.mergedWriter.revision,
+			UnmergedWriter:   cr.writerName(ctx, c.unmergedWriter),
+			UnmergedRevision: c.unmergedWriter.revision,
+			ResolvedRevision: head.Revision(),
+		}
+		if c.newName != c.name {
+			record.NewPath =
+				c.dir.ChildPathNoPtr(c.newName).CanonicalPathString()
+		}
+		cr.log.CDebugf(ctx, "Conflict resolved: %+v", record)
+		records = append(records, record)
+	}
+
+	err := cr.fbo.conflictLog.add(ctx, head, records)
+	if err != nil {
+		cr.log.CWarningf(ctx, "Couldn't save conflict records: %+v", err)
+	}
+	cr.fbo.status.signalChange()
+
+	for _, record := range records {
+		cr.config.Reporter().Notify(ctx,
+			conflictResolvedNotification(record, head.TlfID().Type()))
+	}
+}
+
 // CRWrapError wraps an error that happens during conflict resolution.
 type CRWrapError struct {
 	err error
@@ -3065,6 +3402,14 @@ func (cr *ConflictResolver) doResolve(ctx context.Context, ci conflictInput) {
 		}
 	}()
 
+	// If the user wants to resolve conflicts in this TLF by hand,
+	// just set the branch aside, unless we're resolving it at their
+	// request.
+	if cr.fbo.shouldParkBranch(lState) {
+		err = cr.fbo.parkUnmergedBranch(ctx, lState)
+		return
+	}
+
 	// Check if we need to deploy the nuclear option and completely
 	// block unmerged writes while we try to resolve.
 	doLock := func() bool {
@@ -3232,8 +3577,9 @@ func (cr *ConflictResolver) doResolve(ctx context.Context, ci conflictInput) {
 	dirtyBcache := simpleDirtyBlockCacheStandard()
 	// Simple dirty bcaches don't need to be shut down.
 
-	err = cr.doActions(ctx, lState, unmergedChains, mergedChains,
-		unmergedPaths, mergedPaths, actionMap, lbc, newFileBlocks, dirtyBcache)
+	conflicts, err := cr.doActions(ctx, lState, unmergedChains,
+		mergedChains, unmergedPaths, mergedPaths, actionMap, lbc,
+		newFileBlocks, dirtyBcache)
 	if err != nil {
 		return
 	}
@@ -3255,6 +3601,8 @@ func (cr *ConflictResolver) doResolve(ctx context.Context, ci conflictInput) {
 		return
 	}
 
+	cr.recordConflicts(ctx, lState, conflicts)
+
 	// TODO: If conflict resolution fails after some blocks were put,
 	// remember these and include them in the later resolution so they
 	// don't count against the quota forever.  (Though of course if we
@@ -683,7 +683,7 @@ func TestCRMergedChainsRenamedDirectory(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Couldn't make dir: %v", err)
 	}
-	err = config1.KBFSOps().Rename(ctx, dirB1, "dirC", dirD1, "dirC")
+	err = config1.KBFSOps().Rename(ctx, dirB1, "dirC", dirD1, "dirC", RenameReplace)
 	if err != nil {
 		t.Fatalf("Couldn't remove dir: %v", err)
 	}
@@ -825,7 +825,7 @@ func TestCRMergedChainsComplex(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Couldn't remove dir: %v", err)
 	}
-	err = config1.KBFSOps().Rename(ctx, dirG1, "dirH", dirA1, "dirI")
+	err = config1.KBFSOps().Rename(ctx, dirG1, "dirH", dirA1, "dirI", RenameReplace)
 	if err != nil {
 		t.Fatalf("Couldn't remove dir: %v", err)
 	}
@@ -851,7 +851,7 @@ func TestCRMergedChainsComplex(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Couldn't create file: %v", err)
 	}
-	err = config2.KBFSOps().Rename(ctx, dirC2, "file4", dirH2, "file4")
+	err = config2.KBFSOps().Rename(ctx, dirC2, "file4", dirH2, "file4", RenameReplace)
 	if err != nil {
 		t.Fatalf("Couldn't remove dir: %v", err)
 	}
@@ -968,7 +968,7 @@ func TestCRMergedChainsRenameCycleSimple(t *testing.T) {
 	}
 
 	// user1 moves dirB into dirA
-	err = config1.KBFSOps().Rename(ctx, dirRoot1, "dirB", dirA1, "dirB")
+	err = config1.KBFSOps().Rename(ctx, dirRoot1, "dirB", dirA1, "dirB", RenameReplace)
 	if err != nil {
 		t.Fatalf("Couldn't make dir: %v", err)
 	}
@@ -978,7 +978,7 @@ func TestCRMergedChainsRenameCycleSimple(t *testing.T) {
 	}
 
 	// user2 moves dirA into dirB
-	err = config2.KBFSOps().Rename(ctx, dirRoot2, "dirA", dirB2, "dirA")
+	err = config2.KBFSOps().Rename(ctx, dirRoot2, "dirA", dirB2, "dirA", RenameReplace)
 	if err != nil {
 		t.Fatalf("Couldn't make dir: %v", err)
 	}
@@ -1288,7 +1288,7 @@ func TestCRDoActionsSimple(t *testing.T) {
 	lbc := make(localBcache)
 	newFileBlocks := make(fileBlockMap)
 	dirtyBcache := simpleDirtyBlockCacheStandard()
-	err = cr2.doActions(ctx, lState, unmergedChains, mergedChains,
+	_, err = cr2.doActions(ctx, lState, unmergedChains, mergedChains,
 		unmergedPaths, mergedPaths, actionMap, lbc, newFileBlocks, dirtyBcache)
 	if err != nil {
 		t.Fatalf("Couldn't do actions: %v", err)
@@ -1411,7 +1411,7 @@ func TestCRDoActionsWriteConflict(t *testing.T) {
 	lbc := make(localBcache)
 	newFileBlocks := make(fileBlockMap)
 	dirtyBcache := simpleDirtyBlockCacheStandard()
-	err = cr2.doActions(ctx, lState, unmergedChains, mergedChains,
+	_, err = cr2.doActions(ctx, lState, unmergedChains, mergedChains,
 		unmergedPaths, mergedPaths, actionMap, lbc, newFileBlocks, dirtyBcache)
 	if err != nil {
 		t.Fatalf("Couldn't do actions: %v", err)
@@ -24,3 +24,7 @@ const mdserverReconnectBackoffWindow = 20 * time.Minute
 // registerForUpdatesFireNowThreshold is the maximum length of time that
 // KBFS can be idle for, in order to trigger FireNow from RegisterForUpdate.
 const registerForUpdatesFireNowThreshold = 10 * time.Minute
+
+// archivedFBOIdleTimeout is how long an archived folder-branch can go
+// unused, with no live nodes, before it is shut down and forgotten.
+const archivedFBOIdleTimeout = 10 * time.Minute
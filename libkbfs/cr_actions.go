@@ -57,11 +57,11 @@ func fixupNamesInOps(fromName string, toName string, ops []op,
 					}
 				}
 			}
-		case *setAttrOp:
-			if realOp.Name == fromName {
-				realOpCopy := *realOp
-				realOpCopy.Name = toName
-				retOps = append(retOps, &realOpCopy)
+		case attrChanger:
+			if realOp.attrOp().Name == fromName {
+				realOpCopy := realOp.deepCopy().(attrChanger)
+				realOpCopy.attrOp().Name = toName
+				retOps = append(retOps, realOpCopy)
 				done = true
 			}
 		}
@@ -99,8 +99,8 @@ func (cuea *copyUnmergedEntryAction) swapUnmergedBlock(
 			// As soon as we find an op that is NOT a setAttrOp, we
 			// should abort the swap.  Otherwise save the changed
 			// attributes so we can re-apply them during do().
-			if sao, ok := op.(*setAttrOp); ok {
-				cuea.attr = append(cuea.attr, sao.Attr)
+			if ac, ok := op.(attrChanger); ok {
+				cuea.attr = append(cuea.attr, ac.attrOp().Attr)
 			} else {
 				return false, zeroPtr, nil
 			}
@@ -190,6 +190,8 @@ func (cuea *copyUnmergedEntryAction) do(ctx context.Context,
 				unmergedEntry.Type = cuea.unmergedEntry.Type
 			case mtimeAttr:
 				unmergedEntry.Mtime = cuea.unmergedEntry.Mtime
+			case xattrAttr:
+				unmergedEntry.Xattrs = cuea.unmergedEntry.Xattrs
 			}
 		}
 	}
@@ -410,6 +412,8 @@ func (cuaa *copyUnmergedAttrAction) do(ctx context.Context,
 			mergedEntry.Type = unmergedEntry.Type
 		case mtimeAttr:
 			mergedEntry.Mtime = unmergedEntry.Mtime
+		case xattrAttr:
+			mergedEntry.Xattrs = unmergedEntry.Xattrs
 		case sizeAttr:
 			mergedEntry.Size = unmergedEntry.Size
 			mergedEntry.EncodedSize = unmergedEntry.EncodedSize
@@ -602,8 +606,8 @@ func (rua *renameUnmergedAction) updateOps(unmergedMostRecent BlockPointer,
 				// Nuke the previously referenced blocks, they are no
 				// longer relevant.
 				realOp.RefBlocks = nil
-			case *setAttrOp:
-				realOp.File = newMergedEntry.BlockPointer
+			case attrChanger:
+				realOp.attrOp().File = newMergedEntry.BlockPointer
 			}
 		}
 
@@ -708,6 +712,143 @@ func (rua *renameUnmergedAction) String() string {
 		rua.symPath)
 }
 
+// mergeUnmergedFileAction says that a file written in both branches
+// should have its merged entry replaced by a new file, containing
+// the given block, which combines the changes from both branches.
+// It takes the place of a renameUnmergedAction for the same file,
+// if the file's contents could be merged.  The new block is synced
+// under the merged entry's name, so that the merged file pointer is
+// updated (and unreferenced) by the resolution.  When accepting
+// local changes, there is no merged block; instead, the whole
+// unmerged file (which may be indirect) is copied under that name.
+type mergeUnmergedFileAction struct {
+	name         string
+	unmergedPtr  BlockPointer
+	mergedSize   uint64
+	unmergedSize uint64
+	fblock       *FileBlock // nil if acceptLocal
+	acceptLocal  bool
+	// The non-top blocks of the merged file, which are dropped
+	// when accepting local changes.
+	mergedChildPtrs []BlockPointer
+}
+
+func (mufa *mergeUnmergedFileAction) newSize() uint64 {
+	if mufa.acceptLocal {
+		return mufa.unmergedSize
+	}
+	return uint64(len(mufa.fblock.Contents))
+}
+
+// makeWholeFileWrites returns the write ranges for a sync that
+// replaces all of a file of size `oldSize` with `newSize` bytes.
+func makeWholeFileWrites(newSize, oldSize uint64) []WriteRange {
+	writes := []WriteRange{{Off: 0, Len: newSize}}
+	if newSize > 0 && oldSize > newSize {
+		writes = append(writes, WriteRange{Off: newSize})
+	}
+	return writes
+}
+
+func (mufa *mergeUnmergedFileAction) swapUnmergedBlock(
+	unmergedChains *crChains, mergedChains *crChains,
+	unmergedBlock *DirBlock) (bool, BlockPointer, error) {
+	return false, zeroPtr, nil
+}
+
+func (mufa *mergeUnmergedFileAction) do(ctx context.Context,
+	unmergedCopier fileBlockDeepCopier, mergedCopier fileBlockDeepCopier,
+	unmergedBlock *DirBlock, mergedBlock *DirBlock) error {
+	unmergedEntry, ok := unmergedBlock.Children[mufa.name]
+	if !ok {
+		return NoSuchNameError{mufa.name}
+	}
+	mergedEntry, ok := mergedBlock.Children[mufa.name]
+	if !ok {
+		return NoSuchNameError{mufa.name}
+	}
+
+	if mufa.acceptLocal {
+		// Copy the unmerged block tree into the new file blocks
+		// for the merged directory.
+		_, err := unmergedCopier(ctx, mufa.name, unmergedEntry.BlockPointer)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Keep the merged pointer for now; syncing the new block will
+	// replace it.
+	mergedEntry.Size = mufa.newSize()
+	if unmergedEntry.Mtime > mergedEntry.Mtime {
+		mergedEntry.Mtime = unmergedEntry.Mtime
+	}
+	if unmergedEntry.Ctime > mergedEntry.Ctime {
+		mergedEntry.Ctime = unmergedEntry.Ctime
+	}
+	mergedBlock.Children[mufa.name] = mergedEntry
+	return nil
+}
+
+func (mufa *mergeUnmergedFileAction) updateOps(unmergedMostRecent BlockPointer,
+	mergedMostRecent BlockPointer, unmergedBlock *DirBlock,
+	mergedBlock *DirBlock, unmergedChains *crChains,
+	mergedChains *crChains) error {
+	if unmergedMostRecent != mufa.unmergedPtr {
+		// Only the ops of the file itself need fixing.
+		return nil
+	}
+	unmergedChain, ok := unmergedChains.byMostRecent[unmergedMostRecent]
+	if !ok {
+		return fmt.Errorf("Couldn't find unmerged chain for %v",
+			unmergedMostRecent)
+	}
+
+	// The merge could have moved data anywhere in the file, so both
+	// the remote and the local syncs need to cover all of it.
+	newSize := mufa.newSize()
+	unrefsAdded := false
+	unmergedRefs := make(map[BlockPointer]bool)
+	for _, op := range unmergedChain.ops {
+		if so, ok := op.(*syncOp); ok {
+			so.Writes = makeWholeFileWrites(newSize, mufa.mergedSize)
+			for _, ptr := range so.RefBlocks {
+				unmergedRefs[ptr] = true
+			}
+			for _, ptr := range so.UnrefBlocks {
+				delete(unmergedRefs, ptr)
+			}
+			// The unmerged blocks are no longer relevant.
+			so.RefBlocks = nil
+			if !unrefsAdded {
+				for _, ptr := range mufa.mergedChildPtrs {
+					so.AddUnrefBlock(ptr)
+				}
+				unrefsAdded = true
+			}
+		}
+	}
+	if mufa.acceptLocal {
+		// The unmerged file was copied with new references, so
+		// the blocks it was written with need to be dropped.
+		for ptr := range unmergedRefs {
+			unmergedChains.toUnrefPointers[ptr] = true
+		}
+	}
+	if mergedChain, ok := mergedChains.byMostRecent[mergedMostRecent]; ok {
+		for _, op := range mergedChain.ops {
+			if so, ok := op.(*syncOp); ok {
+				so.Writes = makeWholeFileWrites(newSize, mufa.unmergedSize)
+			}
+		}
+	}
+	return nil
+}
+
+func (mufa *mergeUnmergedFileAction) String() string {
+	return fmt.Sprintf("mergeUnmergedFile: %s", mufa.name)
+}
+
 // renameMergedAction says that the merged copy of a file needs to be
 // renamed, and the unmerged entry should be added to the merged block
 // under the old from name.  Merged file blocks do not have to be
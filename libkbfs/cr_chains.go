@@ -252,6 +252,9 @@ func (cc *crChain) identifyType(ctx context.Context, fbo *folderBlockOps,
 			// We can't tell the file type from an mtimeAttr, so we
 			// may have to actually fetch the block to figure it out.
 			parentDir = realOp.Dir.Ref
+		case *setXattrOp:
+			// Same for extended attributes.
+			parentDir = realOp.Dir.Ref
 		default:
 			return nil
 		}
@@ -363,7 +366,7 @@ func (cc *crChain) hasSyncOp() bool {
 
 func (cc *crChain) hasSetAttrOp() bool {
 	for _, op := range cc.ops {
-		if _, ok := op.(*setAttrOp); ok {
+		if _, ok := op.(attrChanger); ok {
 			return true
 		}
 	}
@@ -459,6 +462,67 @@ func (ccs *crChains) addNoopChain(ptr BlockPointer) {
 	ccs.byMostRecent[ptr] = chain
 }
 
+// addRenamedCreateOp adds the create half of a split renameOp to the
+// chain for the new parent, and keeps track of the new parent of the
+// renamed node.  `oldDirRef` and `oldName` say where the renamed node
+// came from.
+func (ccs *crChains) addRenamedCreateOp(realOp *renameOp,
+	oldDirRef BlockPointer, oldName string, newDirUnref BlockPointer,
+	newDirRef BlockPointer, newName string, renamed BlockPointer,
+	renamedType EntryType) error {
+	co, err := newCreateOp(newName, newDirUnref, renamedType)
+	if err != nil {
+		return err
+	}
+	co.setWriterInfo(realOp.getWriterInfo())
+	co.setLocalTimestamp(realOp.getLocalTimestamp())
+	co.renamed = true
+	// newDirRef may be zero if this is a post-resolution chain,
+	// so set co.Dir.Ref manually.
+	co.Dir.Ref = newDirRef
+	err = ccs.addOp(newDirRef, co)
+	if err != nil {
+		return err
+	}
+
+	if !renamed.IsInitialized() {
+		return nil
+	}
+
+	newParentChain, ok := ccs.byMostRecent[newDirRef]
+	if !ok {
+		return fmt.Errorf("While renaming, couldn't find the chain "+
+			"for the new parent %v", newDirRef)
+	}
+	oldParentChain, ok := ccs.byMostRecent[oldDirRef]
+	if !ok {
+		return fmt.Errorf("While renaming, couldn't find the chain "+
+			"for the old parent %v", oldDirRef)
+	}
+
+	renamedOriginal := renamed
+	if renamedChain, ok := ccs.byMostRecent[renamed]; ok {
+		renamedOriginal = renamedChain.original
+	}
+	// Use the previous old info if there is one already,
+	// in case this node has been renamed multiple times.
+	ri, ok := ccs.renamedOriginals[renamedOriginal]
+	if !ok {
+		// Otherwise make a new one.
+		ri = renameInfo{
+			originalOldParent: oldParentChain.original,
+			oldName:           oldName,
+		}
+	}
+	ri.originalNewParent = newParentChain.original
+	ri.newName = newName
+	ccs.renamedOriginals[renamedOriginal] = ri
+	// Remember what you create, in case we need to merge
+	// directories after a rename.
+	co.AddRefBlock(renamedOriginal)
+	return nil
+}
+
 func (ccs *crChains) makeChainForOp(op op) error {
 	// Ignore gc ops -- their unref semantics differ from the other
 	// ops.  Note that this only matters for old gcOps: new gcOps
@@ -518,39 +582,41 @@ func (ccs *crChains) makeChainForOp(op op) error {
 		if err != nil {
 			return err
 		}
-	case *renameOp:
+	case entryMover:
+		rename := realOp.moveOp()
+		xo, isExchange := realOp.(*exchangeOp)
 		// split rename op into two separate operations, one for
 		// remove and one for create
-		ro, err := newRmOp(realOp.OldName, realOp.OldDir.Unref)
+		ro, err := newRmOp(rename.OldName, rename.OldDir.Unref)
 		if err != nil {
 			return err
 		}
-		ro.setWriterInfo(realOp.getWriterInfo())
-		ro.setLocalTimestamp(realOp.getLocalTimestamp())
-		// realOp.OldDir.Ref may be zero if this is a
+		ro.setWriterInfo(rename.getWriterInfo())
+		ro.setLocalTimestamp(rename.getLocalTimestamp())
+		// rename.OldDir.Ref may be zero if this is a
 		// post-resolution chain, so set ro.Dir.Ref manually.
-		ro.Dir.Ref = realOp.OldDir.Ref
-		err = ccs.addOp(realOp.OldDir.Ref, ro)
+		ro.Dir.Ref = rename.OldDir.Ref
+		err = ccs.addOp(rename.OldDir.Ref, ro)
 		if err != nil {
 			return err
 		}
 
-		ndu := realOp.NewDir.Unref
-		ndr := realOp.NewDir.Ref
-		if realOp.NewDir == (blockUpdate{}) {
+		ndu := rename.NewDir.Unref
+		ndr := rename.NewDir.Ref
+		if rename.NewDir == (blockUpdate{}) {
 			// this is a rename within the same directory
-			ndu = realOp.OldDir.Unref
-			ndr = realOp.OldDir.Ref
+			ndu = rename.OldDir.Unref
+			ndr = rename.OldDir.Ref
 		}
 
-		if len(realOp.Unrefs()) > 0 {
-			// Something was overwritten; make an explicit rm for it
-			// so we can check for conflicts.
-			roOverwrite, err := newRmOp(realOp.NewName, ndu)
+		if len(rename.Unrefs()) > 0 || isExchange {
+			// Something was overwritten or exchanged; make an
+			// explicit rm for it so we can check for conflicts.
+			roOverwrite, err := newRmOp(rename.NewName, ndu)
 			if err != nil {
 				return err
 			}
-			roOverwrite.setWriterInfo(realOp.getWriterInfo())
+			roOverwrite.setWriterInfo(rename.getWriterInfo())
 			err = roOverwrite.Dir.setRef(ndr)
 			if err != nil {
 				return err
@@ -560,78 +626,47 @@ func (ccs *crChains) makeChainForOp(op op) error {
 				return err
 			}
 			// Transfer any unrefs over.
-			for _, ptr := range realOp.Unrefs() {
+			for _, ptr := range rename.Unrefs() {
 				roOverwrite.AddUnrefBlock(ptr)
 			}
 		}
 
-		co, err := newCreateOp(realOp.NewName, ndu, realOp.RenamedType)
-		if err != nil {
-			return err
-		}
-		co.setWriterInfo(realOp.getWriterInfo())
-		co.setLocalTimestamp(realOp.getLocalTimestamp())
-		co.renamed = true
-		// ndr may be zero if this is a post-resolution chain,
-		// so set co.Dir.Ref manually.
-		co.Dir.Ref = ndr
-		err = ccs.addOp(ndr, co)
+		err = ccs.addRenamedCreateOp(rename, rename.OldDir.Ref,
+			rename.OldName, ndu, ndr, rename.NewName, rename.Renamed,
+			rename.RenamedType)
 		if err != nil {
 			return err
 		}
 
-		// also keep track of the new parent for the renamed node
-		if realOp.Renamed.IsInitialized() {
-			newParentChain, ok := ccs.byMostRecent[ndr]
-			if !ok {
-				return fmt.Errorf("While renaming, couldn't find the chain "+
-					"for the new parent %v", ndr)
-			}
-			oldParentChain, ok := ccs.byMostRecent[realOp.OldDir.Ref]
-			if !ok {
-				return fmt.Errorf("While renaming, couldn't find the chain "+
-					"for the old parent %v", ndr)
-			}
-
-			renamedOriginal := realOp.Renamed
-			if renamedChain, ok := ccs.byMostRecent[realOp.Renamed]; ok {
-				renamedOriginal = renamedChain.original
-			}
-			// Use the previous old info if there is one already,
-			// in case this node has been renamed multiple times.
-			ri, ok := ccs.renamedOriginals[renamedOriginal]
-			if !ok {
-				// Otherwise make a new one.
-				ri = renameInfo{
-					originalOldParent: oldParentChain.original,
-					oldName:           realOp.OldName,
-				}
+		if isExchange {
+			// The exchanged entry moves the other way, after both
+			// names have been removed.
+			err = ccs.addRenamedCreateOp(rename, ndr, rename.NewName,
+				rename.OldDir.Unref, rename.OldDir.Ref, rename.OldName,
+				xo.Exchanged, xo.ExchangedType)
+			if err != nil {
+				return err
 			}
-			ri.originalNewParent = newParentChain.original
-			ri.newName = realOp.NewName
-			ccs.renamedOriginals[renamedOriginal] = ri
-			// Remember what you create, in case we need to merge
-			// directories after a rename.
-			co.AddRefBlock(renamedOriginal)
 		}
 	case *syncOp:
 		err := ccs.addOp(realOp.File.Ref, op)
 		if err != nil {
 			return err
 		}
-	case *setAttrOp:
+	case attrChanger:
 		// Because the attributes apply to the file, which doesn't
 		// actually have an updated pointer, we may need to create a
 		// new chain.
-		_, ok := ccs.byMostRecent[realOp.File]
+		file := realOp.attrOp().File
+		_, ok := ccs.byMostRecent[file]
 		if !ok {
 			// pointer didn't change, so most recent is the same:
-			chain := &crChain{original: realOp.File, mostRecent: realOp.File}
-			ccs.byOriginal[realOp.File] = chain
-			ccs.byMostRecent[realOp.File] = chain
+			chain := &crChain{original: file, mostRecent: file}
+			ccs.byOriginal[file] = chain
+			ccs.byMostRecent[file] = chain
 		}
 
-		err := ccs.addOp(realOp.File, op)
+		err := ccs.addOp(file, op)
 		if err != nil {
 			return err
 		}
@@ -678,11 +713,12 @@ func (ccs *crChains) makeChainForNewOp(targetPtr BlockPointer, newOp op) error {
 		return ccs.makeChainForNewOpWithUpdate(targetPtr, newOp, &realOp.Dir)
 	case *rmOp:
 		return ccs.makeChainForNewOpWithUpdate(targetPtr, newOp, &realOp.Dir)
-	case *renameOp:
+	case entryMover:
 		// In this case, we don't want to split the rename chain, so
 		// just make up a new operation and later overwrite it with
 		// the rename op.
-		co, err := newCreateOp(realOp.NewName, realOp.NewDir.Unref, File)
+		ro := realOp.moveOp()
+		co, err := newCreateOp(ro.NewName, ro.NewDir.Unref, File)
 		if err != nil {
 			return err
 		}
@@ -701,8 +737,9 @@ func (ccs *crChains) makeChainForNewOp(targetPtr BlockPointer, newOp op) error {
 		}
 		chain.ops[0] = realOp
 		return nil
-	case *setAttrOp:
-		return ccs.makeChainForNewOpWithUpdate(targetPtr, newOp, &realOp.Dir)
+	case attrChanger:
+		return ccs.makeChainForNewOpWithUpdate(
+			targetPtr, newOp, &realOp.attrOp().Dir)
 	case *syncOp:
 		return ccs.makeChainForNewOpWithUpdate(targetPtr, newOp, &realOp.File)
 	default:
@@ -994,6 +1031,12 @@ func (ccs *crChains) copyOpAndRevertUnrefsToOriginals(currOp op) op {
 		unrefs = append(unrefs, &newRenameOp.OldDir.Unref,
 			&newRenameOp.NewDir.Unref, &newRenameOp.Renamed)
 		newOp = &newRenameOp
+	case *exchangeOp:
+		newExchangeOp := *realOp
+		unrefs = append(unrefs, &newExchangeOp.OldDir.Unref,
+			&newExchangeOp.NewDir.Unref, &newExchangeOp.Renamed,
+			&newExchangeOp.Exchanged)
+		newOp = &newExchangeOp
 	case *syncOp:
 		newSyncOp := *realOp
 		unrefs = append(unrefs, &newSyncOp.File.Unref)
@@ -1002,6 +1045,11 @@ func (ccs *crChains) copyOpAndRevertUnrefsToOriginals(currOp op) op {
 		newSetAttrOp := *realOp
 		unrefs = append(unrefs, &newSetAttrOp.Dir.Unref, &newSetAttrOp.File)
 		newOp = &newSetAttrOp
+	case *setXattrOp:
+		newSetXattrOp := *realOp
+		unrefs = append(unrefs,
+			&newSetXattrOp.Dir.Unref, &newSetXattrOp.File)
+		newOp = &newSetXattrOp
 	case *GCOp:
 		// No need to copy a GCOp, it won't be modified
 		newOp = realOp
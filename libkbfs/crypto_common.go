@@ -9,6 +9,7 @@ import (
 	"encoding/binary"
 	"io"
 
+	"github.com/golang/snappy"
 	"github.com/keybase/client/go/libkb"
 	"github.com/keybase/client/go/protocol/keybase1"
 	"github.com/keybase/kbfs/kbfsblock"
@@ -236,7 +237,13 @@ func (c CryptoCommon) decryptData(encryptedData encryptedData, key [32]byte) ([]
 		return nil, errors.WithStack(
 			UnknownEncryptionVer{encryptedData.Version})
 	}
+	return c.openSecretbox(encryptedData, key)
+}
 
+// openSecretbox decrypts the given data without checking its
+// version, which must be one that uses nacl/secretbox.
+func (c CryptoCommon) openSecretbox(
+	encryptedData encryptedData, key [32]byte) ([]byte, error) {
 	var nonce [24]byte
 	if len(encryptedData.Nonce) != len(nonce) {
 		return nil, errors.WithStack(
@@ -330,6 +337,28 @@ func (c CryptoCommon) depadBlock(paddedBlock []byte) ([]byte, error) {
 	return paddedBlock[padPrefixSize:blockEndPos], nil
 }
 
+// maxDecompressedBlockSize bounds how big a compressed block may
+// claim to be once decompressed, so that a malicious block can't
+// make us allocate arbitrary amounts of memory.  No valid block is
+// bigger than the largest allowed directory.
+const maxDecompressedBlockSize = maxDirBytesDefault
+
+func (c CryptoCommon) encryptEncodedBlock(
+	encodedBlock []byte, key kbfscrypto.BlockCryptKey,
+	ver EncryptionVer) (EncryptedBlock, error) {
+	paddedBlock, err := c.padBlock(encodedBlock)
+	if err != nil {
+		return EncryptedBlock{}, err
+	}
+
+	encryptedData, err := c.encryptData(paddedBlock, key.Data())
+	if err != nil {
+		return EncryptedBlock{}, err
+	}
+	encryptedData.Version = ver
+	return EncryptedBlock{encryptedData}, nil
+}
+
 // EncryptBlock implements the Crypto interface for CryptoCommon.
 func (c CryptoCommon) EncryptBlock(block Block, key kbfscrypto.BlockCryptKey) (
 	plainSize int, encryptedBlock EncryptedBlock, err error) {
@@ -338,18 +367,42 @@ func (c CryptoCommon) EncryptBlock(block Block, key kbfscrypto.BlockCryptKey) (
 		return -1, EncryptedBlock{}, err
 	}
 
-	paddedBlock, err := c.padBlock(encodedBlock)
+	encryptedBlock, err = c.encryptEncodedBlock(
+		encodedBlock, key, EncryptionSecretbox)
 	if err != nil {
 		return -1, EncryptedBlock{}, err
 	}
 
-	encryptedData, err := c.encryptData(paddedBlock, key.Data())
+	plainSize = len(encodedBlock)
+	return plainSize, encryptedBlock, nil
+}
+
+// EncryptCompressedBlock implements the Crypto interface for
+// CryptoCommon.
+func (c CryptoCommon) EncryptCompressedBlock(
+	block Block, key kbfscrypto.BlockCryptKey) (
+	plainSize int, encryptedBlock EncryptedBlock, err error) {
+	encodedBlock, err := c.codec.Encode(block)
 	if err != nil {
 		return -1, EncryptedBlock{}, err
 	}
-
 	plainSize = len(encodedBlock)
-	encryptedBlock = EncryptedBlock{encryptedData}
+
+	// Blocks are padded up to a power of two, so only compress if
+	// that makes the padded block smaller.  Otherwise, keep the
+	// block readable by clients that don't understand compression.
+	ver := EncryptionSecretbox
+	compressedBlock := snappy.Encode(nil, encodedBlock)
+	if powerOfTwoEqualOrGreater(len(compressedBlock)) <
+		powerOfTwoEqualOrGreater(plainSize) {
+		encodedBlock = compressedBlock
+		ver = EncryptionSecretboxWithSnappy
+	}
+
+	encryptedBlock, err = c.encryptEncodedBlock(encodedBlock, key, ver)
+	if err != nil {
+		return -1, EncryptedBlock{}, err
+	}
 	return plainSize, encryptedBlock, nil
 }
 
@@ -357,8 +410,16 @@ func (c CryptoCommon) EncryptBlock(block Block, key kbfscrypto.BlockCryptKey) (
 func (c CryptoCommon) DecryptBlock(
 	encryptedBlock EncryptedBlock, key kbfscrypto.BlockCryptKey,
 	block Block) error {
-	paddedBlock, err := c.decryptData(
-		encryptedBlock.encryptedData, key.Data())
+	var paddedBlock []byte
+	var err error
+	ver := encryptedBlock.Version
+	switch ver {
+	case EncryptionSecretbox, EncryptionSecretboxWithSnappy:
+		paddedBlock, err = c.openSecretbox(
+			encryptedBlock.encryptedData, key.Data())
+	default:
+		err = errors.WithStack(UnknownEncryptionVer{ver})
+	}
 	if err != nil {
 		return err
 	}
@@ -368,6 +429,13 @@ func (c CryptoCommon) DecryptBlock(
 		return err
 	}
 
+	if ver == EncryptionSecretboxWithSnappy {
+		encodedBlock, err = c.decompressBlock(encodedBlock)
+		if err != nil {
+			return err
+		}
+	}
+
 	err = c.codec.Decode(encodedBlock, &block)
 	if err != nil {
 		return errors.WithStack(BlockDecodeError{err})
@@ -375,6 +443,24 @@ func (c CryptoCommon) DecryptBlock(
 	return nil
 }
 
+func (c CryptoCommon) decompressBlock(compressedBlock []byte) (
+	[]byte, error) {
+	n, err := snappy.DecodedLen(compressedBlock)
+	if err != nil {
+		return nil, errors.WithStack(BlockDecodeError{err})
+	}
+	if n > maxDecompressedBlockSize {
+		return nil, errors.WithStack(BlockDecodeError{errors.Errorf(
+			"Decompressed block size %d is bigger than the maximum "+
+				"allowed (%d)", n, maxDecompressedBlockSize)})
+	}
+	encodedBlock, err := snappy.Decode(nil, compressedBlock)
+	if err != nil {
+		return nil, errors.WithStack(BlockDecodeError{err})
+	}
+	return encodedBlock, nil
+}
+
 // GetTLFCryptKeyServerHalfID implements the Crypto interface for CryptoCommon.
 func (c CryptoCommon) GetTLFCryptKeyServerHalfID(
 	user keybase1.UID, devicePubKey kbfscrypto.CryptPublicKey,
@@ -271,10 +271,11 @@ func checkDecryptionFailures(
 	decryptFn func(encryptedData encryptedData, key interface{}) error,
 	corruptKeyFn func(interface{}) interface{}) {
 
-	// Wrong version.
+	// Wrong version.  Blocks may use any known version, so pick
+	// one after all of them.
 
 	encryptedDataWrongVersion := encryptedData
-	encryptedDataWrongVersion.Version++
+	encryptedDataWrongVersion.Version = EncryptionSecretboxWithSnappy + 1
 	err := decryptFn(encryptedDataWrongVersion, key)
 	assert.Equal(t,
 		UnknownEncryptionVer{encryptedDataWrongVersion.Version},
@@ -432,6 +433,80 @@ func TestDecryptBlockFailures(t *testing.T) {
 		})
 }
 
+// Test that crypto.EncryptCompressedBlock() compresses a block that
+// compresses well, and that crypto.DecryptBlock() decompresses it.
+func TestEncryptDecryptCompressedBlock(t *testing.T) {
+	c := MakeCryptoCommon(kbfscodec.NewMsgpack())
+
+	cryptKey := makeFakeBlockCryptKey(t)
+
+	block := FileBlock{Contents: bytes.Repeat([]byte("kbfs "), 10000)}
+	expectedEncodedBlock, err := c.codec.Encode(&block)
+	require.NoError(t, err)
+
+	plainSize, encryptedBlock, err := c.EncryptCompressedBlock(
+		&block, cryptKey)
+	require.NoError(t, err)
+	require.Equal(t, len(expectedEncodedBlock), plainSize)
+	require.Equal(t, EncryptionSecretboxWithSnappy, encryptedBlock.Version)
+	require.True(t, len(encryptedBlock.EncryptedData) < plainSize)
+
+	var decryptedBlock FileBlock
+	err = c.DecryptBlock(encryptedBlock, cryptKey, &decryptedBlock)
+	require.NoError(t, err)
+	require.Equal(t, block.Contents, decryptedBlock.Contents)
+
+	// A client that doesn't know about compression must reject the
+	// block, rather than decode the compressed data.
+	_, err = c.decryptData(encryptedBlock.encryptedData, cryptKey.Data())
+	require.Equal(t,
+		UnknownEncryptionVer{EncryptionSecretboxWithSnappy},
+		errors.Cause(err))
+}
+
+// Test that crypto.EncryptCompressedBlock() leaves blocks
+// uncompressed if compressing them wouldn't save any space.
+func TestEncryptCompressedBlockIncompressible(t *testing.T) {
+	c := MakeCryptoCommon(kbfscodec.NewMsgpack())
+
+	cryptKey := makeFakeBlockCryptKey(t)
+
+	data := make([]byte, 10000)
+	err := kbfscrypto.RandRead(data)
+	require.NoError(t, err)
+	block := FileBlock{Contents: data}
+
+	_, encryptedBlock, err := c.EncryptCompressedBlock(&block, cryptKey)
+	require.NoError(t, err)
+	require.Equal(t, EncryptionSecretbox, encryptedBlock.Version)
+
+	var decryptedBlock FileBlock
+	err = c.DecryptBlock(encryptedBlock, cryptKey, &decryptedBlock)
+	require.NoError(t, err)
+	require.Equal(t, block.Contents, decryptedBlock.Contents)
+}
+
+// Test that crypto.DecryptBlock() refuses to decompress a block
+// that claims to be unreasonably large.
+func TestDecryptCompressedBlockTooBig(t *testing.T) {
+	c := MakeCryptoCommon(kbfscodec.NewMsgpack())
+
+	cryptKey := makeFakeBlockCryptKey(t)
+
+	// A snappy header claiming a length of 1 GiB.
+	compressedBlock := []byte{0x80, 0x80, 0x80, 0x80, 0x04}
+	paddedBlock, err := c.padBlock(compressedBlock)
+	require.NoError(t, err)
+	encryptedData := secretboxSealEncoded(
+		t, &c, paddedBlock, cryptKey.Data())
+	encryptedData.Version = EncryptionSecretboxWithSnappy
+
+	var decryptedBlock FileBlock
+	err = c.DecryptBlock(
+		EncryptedBlock{encryptedData}, cryptKey, &decryptedBlock)
+	require.IsType(t, BlockDecodeError{}, errors.Cause(err))
+}
+
 // Test padding of blocks results in a larger block, with length
 // equal to power of 2 + 4.
 func TestBlockPadding(t *testing.T) {
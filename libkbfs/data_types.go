@@ -8,6 +8,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"reflect"
+	"strconv"
 	"strings"
 	"time"
 
@@ -83,12 +84,20 @@ const (
 	// EncryptionSecretbox is the encryption version that uses
 	// nacl/secretbox or nacl/box.
 	EncryptionSecretbox EncryptionVer = 1
+	// EncryptionSecretboxWithSnappy is the encryption version for
+	// blocks whose encoded contents were compressed with snappy
+	// before being padded and encrypted with nacl/secretbox.
+	// Clients that don't know about it will reject such blocks with
+	// an UnknownEncryptionVer error.
+	EncryptionSecretboxWithSnappy EncryptionVer = 2
 )
 
 func (v EncryptionVer) String() string {
 	switch v {
 	case EncryptionSecretbox:
 		return "EncryptionSecretbox"
+	case EncryptionSecretboxWithSnappy:
+		return "EncryptionSecretboxWithSnappy"
 	default:
 		return fmt.Sprintf("EncryptionVer(%d)", v)
 	}
@@ -225,9 +234,10 @@ func (v MetadataVer) String() string {
 // anyone with the latest kbfs client), and stored only in pointers to
 // the block.
 //
-// 2.5) A file (or, in the future a dir) can in theory have any
-// arbitrary tree structure of blocks. However, we only write files
-// such that all paths to leaves have the same depth.
+// 2.5) A file or a dir can in theory have any arbitrary tree
+// structure of blocks. However, we only write files such that all
+// paths to leaves have the same depth, and we only write dirs with
+// at most one level of indirection.
 //
 // Currently, in addition to 2.5, we have the following constraints on block
 // tree structures:
@@ -244,6 +254,8 @@ func (v MetadataVer) String() string {
 // one indirect pointer with an indirect DirectType [although if it
 // holds for one, it should hold for all], and all of its indirect
 // pointers must have DataVer 3, by c).
+// e) Indirect dir blocks must be v4, and all of their indirect
+// pointers point to direct dir blocks, which are v1 by a).
 type DataVer int
 
 const (
@@ -258,6 +270,9 @@ const (
 	// blocks that have multiple levels of indirection below them
 	// (i.e., indirect blocks that point to other indirect blocks).
 	AtLeastTwoLevelsOfChildrenDataVer DataVer = 3
+	// IndirectDirsDataVer is the data version for a directory block
+	// that contains indirect pointers to other directory blocks.
+	IndirectDirsDataVer DataVer = 4
 )
 
 // BlockRef is a block ID/ref nonce pair, which defines a unique
@@ -464,8 +479,74 @@ const (
 	// folder.  Set to the empty string so that the default will be
 	// the master branch.
 	MasterBranch BranchName = ""
+
+	branchRevPrefix      = "rev="
+	branchUnmergedPrefix = "unmerged="
 )
 
+// MakeRevBranchName returns a branch name specifying an archive
+// branch pinned to the given revision number.
+func MakeRevBranchName(rev kbfsmd.Revision) BranchName {
+	return BranchName(branchRevPrefix + strconv.FormatInt(int64(rev), 10))
+}
+
+// MakeUnmergedRevBranchName returns a branch name specifying a
+// read-only branch pinned to the given revision of an unmerged branch.
+func MakeUnmergedRevBranchName(
+	bid BranchID, rev kbfsmd.Revision) BranchName {
+	return BranchName(branchUnmergedPrefix + bid.String() + ":" +
+		strconv.FormatInt(int64(rev), 10))
+}
+
+// IsArchived returns true if the branch specifies an archived
+// revision, either of the merged branch or of an unmerged branch.
+func (bn BranchName) IsArchived() bool {
+	if _, ok := bn.RevisionIfSpecified(); ok {
+		return true
+	}
+	_, _, ok := bn.UnmergedRevisionIfSpecified()
+	return ok
+}
+
+// RevisionIfSpecified returns a valid revision number and true if
+// `bn` is a revision branch.
+func (bn BranchName) RevisionIfSpecified() (kbfsmd.Revision, bool) {
+	if !strings.HasPrefix(string(bn), branchRevPrefix) {
+		return kbfsmd.RevisionUninitialized, false
+	}
+
+	i, err := strconv.ParseInt(string(bn[len(branchRevPrefix):]), 10, 64)
+	if err != nil || i < int64(kbfsmd.RevisionInitial) {
+		return kbfsmd.RevisionUninitialized, false
+	}
+
+	return kbfsmd.Revision(i), true
+}
+
+// UnmergedRevisionIfSpecified returns a valid branch ID and revision
+// number, and true, if `bn` is an unmerged revision branch.
+func (bn BranchName) UnmergedRevisionIfSpecified() (
+	BranchID, kbfsmd.Revision, bool) {
+	if !strings.HasPrefix(string(bn), branchUnmergedPrefix) {
+		return NullBranchID, kbfsmd.RevisionUninitialized, false
+	}
+
+	parts := strings.SplitN(string(bn[len(branchUnmergedPrefix):]), ":", 2)
+	if len(parts) != 2 {
+		return NullBranchID, kbfsmd.RevisionUninitialized, false
+	}
+	bid, err := ParseBranchID(parts[0])
+	if err != nil || bid == NullBranchID || bid == PendingLocalSquashBranchID {
+		return NullBranchID, kbfsmd.RevisionUninitialized, false
+	}
+	i, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || i < int64(kbfsmd.RevisionInitial) {
+		return NullBranchID, kbfsmd.RevisionUninitialized, false
+	}
+
+	return bid, kbfsmd.Revision(i), true
+}
+
 // FolderBranch represents a unique pair of top-level folder and a
 // branch of that folder.
 type FolderBranch struct {
@@ -622,6 +703,94 @@ func (o Excl) String() string {
 	}
 }
 
+// XattrFlag controls how SetXattr behaves when an extended attribute
+// with the given name does or doesn't already exist.
+type XattrFlag int
+
+const (
+	// XattrSet creates the attribute if it doesn't exist, and
+	// replaces it otherwise.
+	XattrSet XattrFlag = iota
+	// XattrCreate fails if the attribute already exists.
+	XattrCreate
+	// XattrReplace fails if the attribute doesn't already exist.
+	XattrReplace
+)
+
+func (f XattrFlag) String() string {
+	switch f {
+	case XattrSet:
+		return "set"
+	case XattrCreate:
+		return "create"
+	case XattrReplace:
+		return "replace"
+	default:
+		return "<invalid XattrFlag>"
+	}
+}
+
+// RenameMode controls how Rename treats an existing entry at the
+// destination, like the flags to Linux's renameat2(2).
+type RenameMode int
+
+const (
+	// RenameReplace replaces any existing destination entry.
+	RenameReplace RenameMode = iota
+	// RenameNoReplace fails if the destination entry already
+	// exists (RENAME_NOREPLACE).
+	RenameNoReplace
+	// RenameExchange atomically swaps the source and destination
+	// entries, which must both exist (RENAME_EXCHANGE).
+	RenameExchange
+)
+
+func (m RenameMode) String() string {
+	switch m {
+	case RenameReplace:
+		return "replace"
+	case RenameNoReplace:
+		return "noreplace"
+	case RenameExchange:
+		return "exchange"
+	default:
+		return "<invalid RenameMode>"
+	}
+}
+
+// UnmergedResolution says how to resolve local unmerged changes that
+// were set aside for manual conflict resolution.
+type UnmergedResolution int
+
+const (
+	// ResolveAutomatically resolves the unmerged changes with the
+	// usual conflict resolution rules.
+	ResolveAutomatically UnmergedResolution = iota
+	// ResolveAcceptLocal resolves the unmerged changes with the
+	// usual rules, except that the contents of each file written on
+	// both branches are replaced by the local version, in the same
+	// revision.  The merged version is still available in the
+	// folder's history.  Files that don't fit in a single block,
+	// and conflicts other than between two sets of writes, are
+	// resolved as usual.
+	ResolveAcceptLocal
+	// ResolveAcceptRemote throws away the unmerged changes.
+	ResolveAcceptRemote
+)
+
+func (r UnmergedResolution) String() string {
+	switch r {
+	case ResolveAutomatically:
+		return "auto"
+	case ResolveAcceptLocal:
+		return "accept-local"
+	case ResolveAcceptRemote:
+		return "accept-remote"
+	default:
+		return "<invalid UnmergedResolution>"
+	}
+}
+
 // EntryInfo is the (non-block-related) info a directory knows about
 // its child.
 //
@@ -639,6 +808,12 @@ type EntryInfo struct {
 	// If this is a team TLF, we want to track the last writer of an
 	// entry, since in the block, only the team ID will be tracked.
 	TeamWriter keybase1.UID `codec:"tw,omitempty"`
+	// Xattrs holds any extended attributes set on this entry.  Since
+	// entries are only ever stored within encrypted directory
+	// blocks, the names and values are encrypted along with the rest
+	// of the entry.  The map must be treated as immutable; callers
+	// that want to change it must make a copy first.
+	Xattrs map[string][]byte `codec:"xa,omitempty"`
 }
 
 // ReportedError represents an error reported by KBFS.
@@ -824,3 +999,136 @@ func (im InitMode) String() string {
 		return "unknown"
 	}
 }
+
+// DeletedEntry describes an entry that was removed from a TLF
+// recently enough that its blocks haven't been reclaimed yet, so it
+// can still be restored.
+type DeletedEntry struct {
+	// Path is the path of the removed entry relative to the TLF
+	// root, using the current names of its parent directories.
+	Path      string
+	Type      EntryType
+	Size      uint64
+	Revision  kbfsmd.Revision // the revision that removed the entry
+	Writer    keybase1.UID
+	LocalTime time.Time // reflects difference between server and local clock
+
+	tlfID tlf.ID
+	// The pointer to the parent directory in the revision just
+	// before the entry was removed.
+	dirPtr BlockPointer
+	// The first revision that removed anything from the subtree
+	// rooted at this entry.  A directory that was emptied before
+	// being removed is restored as of the revision before this one.
+	subtreeRev kbfsmd.Revision
+}
+
+// FileVersion describes one version of a file, as written by a
+// single revision of its TLF.
+type FileVersion struct {
+	Revision     kbfsmd.Revision // the revision that wrote this version
+	Writer       keybase1.UID
+	WriterDevice kbfscrypto.VerifyingKey
+	LocalTime    time.Time // reflects difference between server and local clock
+	Size         uint64
+
+	tlfID tlf.ID
+	// The pointer to the top block of the file in this version.
+	ptr BlockPointer
+}
+
+// PathChangeType indicates what kind of change happened to a path.
+type PathChangeType int
+
+const (
+	// PathCreated indicates a new entry.
+	PathCreated PathChangeType = iota
+	// PathWritten indicates a file that was written to.
+	PathWritten
+	// PathRenamed indicates an entry that was moved to a new path.
+	PathRenamed
+	// PathRemoved indicates an entry that was removed.
+	PathRemoved
+)
+
+func (t PathChangeType) String() string {
+	switch t {
+	case PathCreated:
+		return "create"
+	case PathWritten:
+		return "write"
+	case PathRenamed:
+		return "rename"
+	case PathRemoved:
+		return "remove"
+	default:
+		return "unknown"
+	}
+}
+
+// PathChange describes a change made to one path of a TLF by a
+// merged revision.
+type PathChange struct {
+	Type PathChangeType
+	// Path is relative to the TLF root, as of the revision that
+	// made the change.  For renames, it's the new path.
+	Path string
+	// OldPath is the path of a renamed entry before the rename.
+	OldPath   string
+	Revision  kbfsmd.Revision
+	Writer    keybase1.UID
+	LocalTime time.Time // reflects difference between server and local clock
+}
+
+// SearchResult describes an entry of a TLF that was found in its
+// local search index.
+type SearchResult struct {
+	// Path is the path of the entry, relative to the TLF root.
+	Path  string
+	Type  EntryType
+	Size  uint64
+	Mtime int64
+}
+
+// DiskUsage is the space taken up by a file, or by a directory and
+// everything under it.
+type DiskUsage struct {
+	// LogicalSize is the total size of the files.
+	LogicalSize uint64
+	// EncodedSize is the total encoded size of the blocks, including
+	// the blocks of the directories themselves.  This is what counts
+	// against the quota.
+	EncodedSize uint64
+	// Blocks is the total number of blocks.
+	Blocks uint64
+}
+
+func (u *DiskUsage) add(other DiskUsage) {
+	u.LogicalSize += other.LogicalSize
+	u.EncodedSize += other.EncodedSize
+	u.Blocks += other.Blocks
+}
+
+// sub removes `other`, which must be part of u, from u.
+func (u *DiskUsage) sub(other DiskUsage) {
+	u.LogicalSize -= other.LogicalSize
+	u.EncodedSize -= other.EncodedSize
+	u.Blocks -= other.Blocks
+}
+
+// DirDiskUsage is the disk usage of a directory, and of each of its
+// children, as of a merged revision.
+type DirDiskUsage struct {
+	Revision kbfsmd.Revision
+	Total    DiskUsage
+	// Children doesn't include symlinks, since they take up no
+	// blocks of their own.
+	Children map[string]DiskUsage
+}
+
+// FileExtent is a range of a file that contains data, as opposed to
+// a hole.
+type FileExtent struct {
+	Off int64
+	Len int64
+}
@@ -17,6 +17,7 @@ import (
 	"github.com/keybase/client/go/protocol/keybase1"
 	"github.com/keybase/kbfs/ioutil"
 	"github.com/keybase/kbfs/kbfsblock"
+	"github.com/keybase/kbfs/kbfscodec"
 	"github.com/keybase/kbfs/kbfscrypto"
 	"github.com/keybase/kbfs/kbfshash"
 	"github.com/keybase/kbfs/tlf"
@@ -38,6 +39,7 @@ const (
 	blockDbFilename               string = "diskCacheBlocks.leveldb"
 	metaDbFilename                string = "diskCacheMetadata.leveldb"
 	tlfDbFilename                 string = "diskCacheTLF.leveldb"
+	pinnedDirname                 string = "pinned"
 	versionFilename               string = "version"
 	initialDiskCacheVersion       uint64 = 1
 	currentDiskCacheVersion       uint64 = initialDiskCacheVersion
@@ -57,6 +59,13 @@ type DiskBlockCacheStandard struct {
 	// Track the aggregate size of blocks in the cache per TLF and overall.
 	tlfSizes  map[tlf.ID]uint64
 	currBytes uint64
+	// Blocks that must not be evicted, per TLF, and how many of
+	// them are in the cache.  If pinnedDir isn't empty, the pinned
+	// blocks of each TLF are saved in a file under it, so that
+	// they stay pinned across restarts.
+	pinnedBlocks map[tlf.ID]map[kbfsblock.ID]bool
+	pinnedCounts map[tlf.ID]int
+	pinnedDir    string
 	// Track the cache hit rate and eviction rate
 	hitMeter         *CountMeter
 	missMeter        *CountMeter
@@ -98,6 +107,17 @@ func rateMeterToStatus(m metrics.Meter) MeterStatus {
 	}
 }
 
+// DiskBlockCacheTlfStatus represents the status of a single TLF's
+// blocks in the disk cache.
+type DiskBlockCacheTlfStatus struct {
+	NumBlocks  uint64
+	BlockBytes uint64
+	// ByteLimit and Priority are only set for the working set
+	// cache.  A ByteLimit of 0 means the TLF has no limit of its own.
+	ByteLimit uint64 `json:",omitempty"`
+	Priority  string `json:",omitempty"`
+}
+
 // DiskBlockCacheStatus represents the status of the disk cache.
 type DiskBlockCacheStatus struct {
 	IsStarting      bool
@@ -112,6 +132,8 @@ type DiskBlockCacheStatus struct {
 	SizeEvicted     MeterStatus
 	NumDeleted      MeterStatus
 	SizeDeleted     MeterStatus
+	// Tlfs is keyed by TLF ID.
+	Tlfs map[string]DiskBlockCacheTlfStatus `json:",omitempty"`
 }
 
 // openLevelDB opens or recovers a leveldb.DB with a passed-in storage.Storage
@@ -129,13 +151,44 @@ func openLevelDB(stor storage.Storage) (db *leveldb.DB, err error) {
 	return db, err
 }
 
+// readPinnedBlocks returns the pinned blocks saved under `dir`, by
+// TLF.
+func readPinnedBlocks(codec kbfscodec.Codec, dir string) (
+	map[tlf.ID]map[kbfsblock.ID]bool, error) {
+	pinnedBlocks := map[tlf.ID]map[kbfsblock.ID]bool{}
+	fileInfos, err := ioutil.ReadDir(dir)
+	if ioutil.IsNotExist(err) {
+		return pinnedBlocks, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, fi := range fileInfos {
+		tlfID, err := tlf.ParseID(fi.Name())
+		if err != nil {
+			continue
+		}
+		var blockIDs []kbfsblock.ID
+		err = kbfscodec.DeserializeFromFile(
+			codec, filepath.Join(dir, fi.Name()), &blockIDs)
+		if err != nil {
+			return nil, err
+		}
+		pinned := make(map[kbfsblock.ID]bool, len(blockIDs))
+		for _, id := range blockIDs {
+			pinned[id] = true
+		}
+		pinnedBlocks[tlfID] = pinned
+	}
+	return pinnedBlocks, nil
+}
+
 // newDiskBlockCacheStandardFromStorage creates a new *DiskBlockCacheStandard
 // with the passed-in storage.Storage interfaces as storage layers for each
-// cache.
+// cache.  Pinned blocks are saved under `pinnedDir`, unless it's empty.
 func newDiskBlockCacheStandardFromStorage(
 	config diskBlockCacheConfig, cacheType diskLimitTrackerType,
-	blockStorage, metadataStorage, tlfStorage storage.Storage) (
-	cache *DiskBlockCacheStandard, err error) {
+	blockStorage, metadataStorage, tlfStorage storage.Storage,
+	pinnedDir string) (cache *DiskBlockCacheStandard, err error) {
 	defer func() {
 		if err != nil {
 			err = errors.WithStack(err)
@@ -184,6 +237,9 @@ func newDiskBlockCacheStandardFromStorage(
 		cacheType:        cacheType,
 		tlfCounts:        map[tlf.ID]int{},
 		tlfSizes:         map[tlf.ID]uint64{},
+		pinnedBlocks:     map[tlf.ID]map[kbfsblock.ID]bool{},
+		pinnedCounts:     map[tlf.ID]int{},
+		pinnedDir:        pinnedDir,
 		hitMeter:         NewCountMeter(),
 		missMeter:        NewCountMeter(),
 		putMeter:         NewCountMeter(),
@@ -343,7 +399,8 @@ func newDiskBlockCacheStandard(config diskBlockCacheConfig,
 		}
 	}()
 	return newDiskBlockCacheStandardFromStorage(config, cacheType,
-		blockStorage, metadataStorage, tlfStorage)
+		blockStorage, metadataStorage, tlfStorage,
+		filepath.Join(versionPath, pinnedDirname))
 }
 
 // WaitUntilStarted waits until this cache has started.
@@ -359,8 +416,22 @@ func (cache *DiskBlockCacheStandard) syncBlockCountsFromDb() error {
 	cache.lock.Lock()
 	defer cache.lock.Unlock()
 
+	// The saved pinned blocks are read here rather than in the
+	// constructor, since the config might be locked during that.
+	// Anything pinned since then has been saved already.
+	if cache.pinnedDir != "" {
+		pinnedBlocks, err := readPinnedBlocks(
+			cache.config.Codec(), cache.pinnedDir)
+		if err != nil {
+			cache.log.Warning("Couldn't read the pinned blocks: %+v", err)
+		} else {
+			cache.pinnedBlocks = pinnedBlocks
+		}
+	}
+
 	tlfCounts := make(map[tlf.ID]int)
 	tlfSizes := make(map[tlf.ID]uint64)
+	pinnedCounts := make(map[tlf.ID]int)
 	numBlocks := 0
 	totalSize := uint64(0)
 	iter := cache.metaDb.NewIterator(nil, nil)
@@ -376,8 +447,15 @@ func (cache *DiskBlockCacheStandard) syncBlockCountsFromDb() error {
 		tlfSizes[metadata.TlfID] += size
 		numBlocks++
 		totalSize += size
+		if pinned := cache.pinnedBlocks[metadata.TlfID]; pinned != nil {
+			blockID, err := kbfsblock.IDFromBytes(iter.Key())
+			if err == nil && pinned[blockID] {
+				pinnedCounts[metadata.TlfID]++
+			}
+		}
 	}
 	cache.tlfCounts = tlfCounts
+	cache.pinnedCounts = pinnedCounts
 	cache.numBlocks = numBlocks
 	cache.tlfSizes = tlfSizes
 	cache.currBytes = totalSize
@@ -553,6 +631,49 @@ func (cache *DiskBlockCacheStandard) evictUntilBytesAvailable(
 	return false, nil
 }
 
+// evictFromTLFUntilUnderLimitLocked evicts blocks from the given TLF
+// until another `encodedLen` bytes fit under the TLF's own byte
+// limit, if it has one.  It returns cachePutCacheFullError if the
+// block can't be made to fit.
+func (cache *DiskBlockCacheStandard) evictFromTLFUntilUnderLimitLocked(
+	ctx context.Context, tlfID tlf.ID, blockID kbfsblock.ID,
+	encodedLen int64) error {
+	maxBytes := cache.config.DiskCacheTlfLimits(tlfID).MaxBytes
+	if maxBytes == 0 {
+		return nil
+	}
+	encodedLenUint := uint64(encodedLen)
+	if encodedLenUint > maxBytes {
+		return cachePutCacheFullError{blockID}
+	}
+	for i := 0; cache.tlfSizes[tlfID]+encodedLenUint > maxBytes; i++ {
+		if i == maxEvictionsPerPut {
+			return cachePutCacheFullError{blockID}
+		}
+		cache.log.CDebugf(ctx, "TLF %s needs more bytes. Used: %d, limit: %d",
+			tlfID, cache.tlfSizes[tlfID], maxBytes)
+		// Only evict about as many blocks as needed to make room,
+		// since the TLF's limit may be much smaller than the cache.
+		over := cache.tlfSizes[tlfID] + encodedLenUint - maxBytes
+		avgSize := cache.tlfSizes[tlfID] / uint64(cache.tlfCounts[tlfID])
+		if avgSize == 0 {
+			avgSize = 1
+		}
+		numBlocks := int((over + avgSize - 1) / avgSize)
+		if numBlocks > defaultNumBlocksToEvict {
+			numBlocks = defaultNumBlocksToEvict
+		}
+		numRemoved, _, err := cache.evictFromTLFLocked(ctx, tlfID, numBlocks)
+		if err != nil {
+			return err
+		}
+		if numRemoved == 0 {
+			return cachePutCacheFullError{blockID}
+		}
+	}
+	return nil
+}
+
 // Put implements the DiskBlockCache interface for DiskBlockCacheStandard.
 func (cache *DiskBlockCacheStandard) Put(ctx context.Context, tlfID tlf.ID,
 	blockID kbfsblock.ID, buf []byte,
@@ -605,6 +726,11 @@ func (cache *DiskBlockCacheStandard) Put(ctx context.Context, tlfID tlf.ID,
 				return errors.New("Attempted to add a block of a synced " +
 					"TLF to the working set disk cache.")
 			}
+			err := cache.evictFromTLFUntilUnderLimitLocked(
+				ctx, tlfID, blockID, encodedLen)
+			if err != nil {
+				return err
+			}
 			hasEnoughSpace, err := cache.evictUntilBytesAvailable(ctx, encodedLen)
 			if err != nil {
 				return err
@@ -622,6 +748,9 @@ func (cache *DiskBlockCacheStandard) Put(ctx context.Context, tlfID tlf.ID,
 		cache.config.DiskLimiter().commitOrRollback(ctx, cache.cacheType,
 			encodedLen, 0, true, "")
 		cache.tlfCounts[tlfID]++
+		if cache.pinnedBlocks[tlfID][blockID] {
+			cache.pinnedCounts[tlfID]++
+		}
 		cache.numBlocks++
 		encodedLenUint := uint64(encodedLen)
 		cache.tlfSizes[tlfID] += encodedLenUint
@@ -691,6 +820,58 @@ func (cache *DiskBlockCacheStandard) Size() int64 {
 	return int64(cache.currBytes)
 }
 
+// savePinnedBlocksLocked saves the pinned blocks of the given TLF,
+// if there's a directory to save them in.
+func (cache *DiskBlockCacheStandard) savePinnedBlocksLocked(
+	tlfID tlf.ID, blockIDs []kbfsblock.ID) error {
+	if cache.pinnedDir == "" {
+		return nil
+	}
+	p := filepath.Join(cache.pinnedDir, tlfID.String())
+	if len(blockIDs) == 0 {
+		err := ioutil.Remove(p)
+		if ioutil.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return kbfscodec.SerializeToFile(cache.config.Codec(), blockIDs, p)
+}
+
+// SetPinnedBlocks implements the DiskBlockCache interface for
+// DiskBlockCacheStandard.
+func (cache *DiskBlockCacheStandard) SetPinnedBlocks(ctx context.Context,
+	tlfID tlf.ID, blockIDs []kbfsblock.ID) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	err := cache.savePinnedBlocksLocked(tlfID, blockIDs)
+	if err != nil {
+		cache.log.CWarningf(ctx, "Couldn't save the pinned blocks of %s: %+v",
+			tlfID, err)
+	}
+	if len(blockIDs) == 0 {
+		delete(cache.pinnedBlocks, tlfID)
+		delete(cache.pinnedCounts, tlfID)
+		return
+	}
+	pinned := make(map[kbfsblock.ID]bool, len(blockIDs))
+	numCached := 0
+	for _, id := range blockIDs {
+		if pinned[id] {
+			continue
+		}
+		pinned[id] = true
+		if cache.blockDb == nil {
+			continue
+		}
+		if ok, err := cache.blockDb.Has(id.Bytes(), nil); err == nil && ok {
+			numCached++
+		}
+	}
+	cache.pinnedBlocks[tlfID] = pinned
+	cache.pinnedCounts[tlfID] = numCached
+}
+
 // deleteLocked deletes a set of blocks from the disk block cache.
 func (cache *DiskBlockCacheStandard) deleteLocked(ctx context.Context,
 	blockEntries []kbfsblock.ID) (numRemoved int, sizeRemoved int64,
@@ -727,6 +908,9 @@ func (cache *DiskBlockCacheStandard) deleteLocked(ctx context.Context,
 		tlfDbKey := cache.tlfKey(metadata.TlfID, blockKey)
 		tlfBatch.Delete(tlfDbKey)
 		removalCounts[metadata.TlfID]++
+		if cache.pinnedBlocks[metadata.TlfID][entry] {
+			cache.pinnedCounts[metadata.TlfID]--
+		}
 		removalSizes[metadata.TlfID] += uint64(metadata.BlockSize)
 		sizeRemoved += int64(metadata.BlockSize)
 		numRemoved++
@@ -800,6 +984,10 @@ func (cache *DiskBlockCacheStandard) evictSomeBlocks(ctx context.Context,
 		cache.log.CDebugf(ctx, "Cache evictSomeBlocks numBlocksRequested=%d "+
 			"numBlocksEvicted=%d sizeBlocksEvicted=%d err=%+v", numBlocks,
 			numRemoved, sizeRemoved, err)
+		if err == nil {
+			cache.evictCountMeter.Mark(int64(numRemoved))
+			cache.evictSizeMeter.Mark(sizeRemoved)
+		}
 	}()
 	if len(blockIDs) <= numBlocks {
 		numBlocks = len(blockIDs)
@@ -814,10 +1002,11 @@ func (cache *DiskBlockCacheStandard) evictSomeBlocks(ctx context.Context,
 
 // evictFromTLFLocked evicts a number of blocks from the cache for a given TLF.
 // We choose a pivot variable b randomly. Then begin an iterator into
-// cache.tlfDb.Range(tlfID + b, tlfID + MaxBlockID) and iterate from there to
-// get numBlocks * evictionConsiderationFactor block IDs.  We sort the
+// cache.tlfDb.Range(tlfID + b, tlfID + MaxBlockID) and iterate from there,
+// wrapping around to tlfID + 0 if needed, to get numBlocks *
+// evictionConsiderationFactor block IDs.  We sort the
 // resulting blocks by value (LRU time) and pick the minimum numBlocks. We then
-// call cache.Delete() on that list of block IDs.
+// call cache.Delete() on that list of block IDs.  Pinned blocks are skipped.
 func (cache *DiskBlockCacheStandard) evictFromTLFLocked(ctx context.Context,
 	tlfID tlf.ID, numBlocks int) (numRemoved int, sizeRemoved int64, err error) {
 	tlfBytes := tlfID.Bytes()
@@ -826,27 +1015,58 @@ func (cache *DiskBlockCacheStandard) evictFromTLFLocked(ctx context.Context,
 	if err != nil {
 		return 0, 0, err
 	}
-	rng := &util.Range{
-		Start: append(tlfBytes, blockID.Bytes()...),
-		Limit: append(tlfBytes, cache.maxBlockID...),
+	// Wrap around to the start of the TLF's range if there aren't
+	// enough blocks after the pivot, since a TLF with a byte limit
+	// may only have a few blocks to pick from.
+	rngs := []*util.Range{{
+		Start: append(tlfBytes[:len(tlfBytes):len(tlfBytes)],
+			blockID.Bytes()...),
+		Limit: append(tlfBytes[:len(tlfBytes):len(tlfBytes)],
+			cache.maxBlockID...),
+	}, {
+		Start: tlfBytes,
+		Limit: append(tlfBytes[:len(tlfBytes):len(tlfBytes)],
+			blockID.Bytes()...),
+	}}
+
+	blockIDs := make(blockIDsByTime, 0, numElements)
+
+	for _, rng := range rngs {
+		blockIDs, err = cache.appendTLFBlocksToEvictLocked(
+			ctx, tlfID, rng, numElements, blockIDs)
+		if err != nil {
+			return 0, 0, err
+		}
 	}
+
+	return cache.evictSomeBlocks(ctx, numBlocks, blockIDs)
+}
+
+// appendTLFBlocksToEvictLocked appends the unpinned blocks of the
+// given TLF in `rng` to `blockIDs`, along with their LRU times, until
+// it holds `numElements` blocks.
+func (cache *DiskBlockCacheStandard) appendTLFBlocksToEvictLocked(
+	ctx context.Context, tlfID tlf.ID, rng *util.Range, numElements int,
+	blockIDs blockIDsByTime) (blockIDsByTime, error) {
+	tlfBytes := tlfID.Bytes()
 	iter := cache.tlfDb.NewIterator(rng, nil)
 	defer iter.Release()
 
-	blockIDs := make(blockIDsByTime, 0, numElements)
-
-	for i := 0; i < numElements; i++ {
+	for len(blockIDs) < numElements {
 		if !iter.Next() {
 			break
 		}
 		key := iter.Key()
 
 		blockIDBytes := key[len(tlfBytes):]
+		blockID, err := kbfsblock.IDFromBytes(blockIDBytes)
 		if err != nil {
 			cache.log.CWarningf(ctx, "Error decoding block ID %x", blockIDBytes)
 			continue
 		}
-		blockID, err := kbfsblock.IDFromBytes(blockIDBytes)
+		if cache.pinnedBlocks[tlfID][blockID] {
+			continue
+		}
 		lru, err := cache.getLRULocked(blockID)
 		if err != nil {
 			cache.log.CWarningf(ctx, "Error decoding LRU time for block %s",
@@ -855,24 +1075,61 @@ func (cache *DiskBlockCacheStandard) evictFromTLFLocked(ctx context.Context,
 		}
 		blockIDs = append(blockIDs, lruEntry{blockID, lru})
 	}
+	return blockIDs, iter.Error()
+}
 
-	return cache.evictSomeBlocks(ctx, numBlocks, blockIDs)
+// tlfToEvictLocked picks the TLF whose blocks should be evicted
+// next, according to the per-TLF limits: first any TLF over its own
+// byte limit, and otherwise the largest TLF in the lowest priority
+// class, if the cache holds blocks from more than one class.  It
+// returns false if blocks should be picked from across all TLFs
+// instead.
+func (cache *DiskBlockCacheStandard) tlfToEvictLocked() (tlf.ID, bool) {
+	lowestTlfID := tlf.NullID
+	var lowest, highest DiskCachePriority
+	for tlfID, count := range cache.tlfCounts {
+		if count == 0 || cache.pinnedCounts[tlfID] >= count {
+			// Nothing to evict from this TLF.
+			continue
+		}
+		limits := cache.config.DiskCacheTlfLimits(tlfID)
+		if limits.MaxBytes > 0 && cache.tlfSizes[tlfID] > limits.MaxBytes {
+			return tlfID, true
+		}
+		if lowestTlfID == tlf.NullID {
+			lowestTlfID = tlfID
+			lowest, highest = limits.Priority, limits.Priority
+			continue
+		}
+		if limits.Priority > highest {
+			highest = limits.Priority
+		}
+		if limits.Priority < lowest || (limits.Priority == lowest &&
+			cache.tlfSizes[tlfID] > cache.tlfSizes[lowestTlfID]) {
+			lowestTlfID = tlfID
+			lowest = limits.Priority
+		}
+	}
+	if lowestTlfID == tlf.NullID || lowest == highest {
+		return tlf.NullID, false
+	}
+	return lowestTlfID, true
 }
 
-// evictLocked evicts a number of blocks from the cache.  We choose a pivot
-// variable b randomly. Then begin an iterator into cache.metaDb.Range(b,
+// evictLocked evicts a number of blocks from the cache, never
+// picking pinned blocks.  If the per-TLF limits single out a TLF to
+// evict from (see tlfToEvictLocked), the blocks are evicted from that
+// TLF using evictFromTLFLocked.  Otherwise, we choose a pivot variable b
+// randomly. Then begin an iterator into cache.metaDb.Range(b,
 // MaxBlockID) and iterate from there to get numBlocks *
 // evictionConsiderationFactor block IDs.  We sort the resulting blocks by
 // value (LRU time) and pick the minimum numBlocks. We then call cache.Delete()
 // on that list of block IDs.
 func (cache *DiskBlockCacheStandard) evictLocked(ctx context.Context,
 	numBlocks int) (numRemoved int, sizeRemoved int64, err error) {
-	defer func() {
-		if err == nil {
-			cache.evictCountMeter.Mark(int64(numRemoved))
-			cache.evictSizeMeter.Mark(sizeRemoved)
-		}
-	}()
+	if tlfID, ok := cache.tlfToEvictLocked(); ok {
+		return cache.evictFromTLFLocked(ctx, tlfID, numBlocks)
+	}
 	numElements := numBlocks * evictionConsiderationFactor
 	blockID, err := cache.getRandomBlockID(numElements, cache.numBlocks)
 	if err != nil {
@@ -902,6 +1159,9 @@ func (cache *DiskBlockCacheStandard) evictLocked(ctx context.Context,
 				blockID)
 			continue
 		}
+		if cache.pinnedBlocks[metadata.TlfID][blockID] {
+			continue
+		}
 		blockIDs = append(blockIDs, lruEntry{blockID, metadata.LRUTime})
 	}
 
@@ -930,6 +1190,22 @@ func (cache *DiskBlockCacheStandard) Status(
 	limiterStatus :=
 		cache.config.DiskLimiter().getStatus(
 			ctx, keybase1.UserOrTeamID("")).(backpressureDiskLimiterStatus)
+	tlfs := make(map[string]DiskBlockCacheTlfStatus, len(cache.tlfCounts))
+	for tlfID, count := range cache.tlfCounts {
+		if count == 0 {
+			continue
+		}
+		tlfStatus := DiskBlockCacheTlfStatus{
+			NumBlocks:  uint64(count),
+			BlockBytes: cache.tlfSizes[tlfID],
+		}
+		if cache.cacheType == workingSetCacheLimitTrackerType {
+			limits := cache.config.DiskCacheTlfLimits(tlfID)
+			tlfStatus.ByteLimit = limits.MaxBytes
+			tlfStatus.Priority = limits.Priority.String()
+		}
+		tlfs[tlfID.String()] = tlfStatus
+	}
 	return map[string]DiskBlockCacheStatus{
 		name: {
 			NumBlocks:       uint64(cache.numBlocks),
@@ -943,6 +1219,7 @@ func (cache *DiskBlockCacheStandard) Status(
 			SizeEvicted:     rateMeterToStatus(cache.evictSizeMeter),
 			NumDeleted:      rateMeterToStatus(cache.deleteCountMeter),
 			SizeDeleted:     rateMeterToStatus(cache.deleteSizeMeter),
+			Tlfs:            tlfs,
 		},
 	}
 }
@@ -6,10 +6,12 @@ package libkbfs
 
 import (
 	"math"
+	"os"
 	"testing"
 	"time"
 
 	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/ioutil"
 	"github.com/keybase/kbfs/kbfsblock"
 	"github.com/keybase/kbfs/kbfscrypto"
 	"github.com/keybase/kbfs/tlf"
@@ -30,6 +32,7 @@ type testDiskBlockCacheConfig struct {
 	*testClockGetter
 	limiter DiskLimiter
 	syncedTlfGetterSetter
+	diskCacheTlfLimitsGetterSetter
 }
 
 func newTestDiskBlockCacheConfig(t *testing.T) *testDiskBlockCacheConfig {
@@ -39,6 +42,7 @@ func newTestDiskBlockCacheConfig(t *testing.T) *testDiskBlockCacheConfig {
 		newTestClockGetter(),
 		nil,
 		newTestSyncedTlfGetterSetter(),
+		newTestDiskCacheTlfLimitsGetterSetter(),
 	}
 }
 
@@ -51,13 +55,13 @@ func newDiskBlockCacheStandardForTest(config *testDiskBlockCacheConfig,
 	maxFiles := int64(10000)
 	workingSetCache, err := newDiskBlockCacheStandardFromStorage(
 		config, workingSetCacheLimitTrackerType, storage.NewMemStorage(),
-		storage.NewMemStorage(), storage.NewMemStorage())
+		storage.NewMemStorage(), storage.NewMemStorage(), "")
 	if err != nil {
 		return nil, err
 	}
 	syncCache, err := newDiskBlockCacheStandardFromStorage(
 		config, syncCacheLimitTrackerType, storage.NewMemStorage(),
-		storage.NewMemStorage(), storage.NewMemStorage())
+		storage.NewMemStorage(), storage.NewMemStorage(), "")
 	if err != nil {
 		return nil, err
 	}
@@ -582,3 +586,220 @@ func TestSyncBlockCacheStaticLimit(t *testing.T) {
 	require.Equal(t, int64(standardCache.currBytes), currBytes)
 	require.Equal(t, numBlocks, standardCache.numBlocks)
 }
+
+func TestDiskBlockCacheTlfByteLimit(t *testing.T) {
+	t.Parallel()
+	t.Log("Test that a TLF can't use more than its own byte limit.")
+	cache, config := initDiskBlockCacheTest(t)
+	wrappedCache := cache.(*diskBlockCacheWrapped)
+	standardCache := wrappedCache.workingSetCache.(*DiskBlockCacheStandard)
+	defer shutdownDiskBlockCacheTest(cache)
+
+	ctx := context.Background()
+	clock := config.TestClock()
+	tlf1 := tlf.FakeID(1, tlf.Private)
+	tlf2 := tlf.FakeID(2, tlf.Private)
+
+	t.Log("Put a block in each TLF to learn the block size.")
+	for _, tlfID := range []tlf.ID{tlf1, tlf2} {
+		blockPtr, _, blockEncoded, serverHalf := setupBlockForDiskCache(
+			t, config)
+		err := standardCache.Put(
+			ctx, tlfID, blockPtr.ID, blockEncoded, serverHalf)
+		require.NoError(t, err)
+		clock.Add(time.Second)
+	}
+	blockSize := standardCache.tlfSizes[tlf1]
+
+	t.Log("Limit tlf1 to 5 blocks, and put 20 blocks into each TLF.")
+	config.SetDiskCacheTlfLimits(tlf1, DiskCacheTlfLimits{
+		MaxBytes: 5 * blockSize,
+		Priority: DiskCachePriorityHigh,
+	})
+	for i := 0; i < 19; i++ {
+		for _, tlfID := range []tlf.ID{tlf1, tlf2} {
+			blockPtr, _, blockEncoded, serverHalf := setupBlockForDiskCache(
+				t, config)
+			err := standardCache.Put(
+				ctx, tlfID, blockPtr.ID, blockEncoded, serverHalf)
+			require.NoError(t, err)
+			clock.Add(time.Second)
+		}
+	}
+	require.Equal(t, 5, standardCache.tlfCounts[tlf1])
+	require.Equal(t, 5*blockSize, standardCache.tlfSizes[tlf1])
+	require.Equal(t, 20, standardCache.tlfCounts[tlf2])
+
+	t.Log("The per-TLF usage shows up in the status.")
+	status := cache.Status(ctx)[workingSetCacheName]
+	require.Equal(t, DiskBlockCacheTlfStatus{
+		NumBlocks:  5,
+		BlockBytes: 5 * blockSize,
+		ByteLimit:  5 * blockSize,
+		Priority:   "high",
+	}, status.Tlfs[tlf1.String()])
+	require.Equal(t, DiskBlockCacheTlfStatus{
+		NumBlocks:  20,
+		BlockBytes: 20 * blockSize,
+		Priority:   "normal",
+	}, status.Tlfs[tlf2.String()])
+
+	t.Log("A block bigger than the TLF's limit can't be cached.")
+	config.SetDiskCacheTlfLimits(tlf1, DiskCacheTlfLimits{MaxBytes: 1})
+	blockPtr, _, blockEncoded, serverHalf := setupBlockForDiskCache(t, config)
+	err := standardCache.Put(ctx, tlf1, blockPtr.ID, blockEncoded, serverHalf)
+	require.EqualError(t, err, cachePutCacheFullError{blockPtr.ID}.Error())
+}
+
+func TestDiskBlockCacheEvictByPriority(t *testing.T) {
+	t.Parallel()
+	t.Log("Test that disk cache eviction honors the TLF priorities.")
+	cache, config := initDiskBlockCacheTest(t)
+	wrappedCache := cache.(*diskBlockCacheWrapped)
+	standardCache := wrappedCache.workingSetCache.(*DiskBlockCacheStandard)
+	defer shutdownDiskBlockCacheTest(cache)
+
+	ctx := context.Background()
+	clock := config.TestClock()
+	lowTlf := tlf.FakeID(1, tlf.Public)
+	normalTlf := tlf.FakeID(2, tlf.Private)
+	highTlf := tlf.FakeID(3, tlf.SingleTeam)
+	config.SetDiskCacheTlfLimits(
+		lowTlf, DiskCacheTlfLimits{Priority: DiskCachePriorityLow})
+	config.SetDiskCacheTlfLimits(
+		highTlf, DiskCacheTlfLimits{Priority: DiskCachePriorityHigh})
+
+	t.Log("Put the high priority blocks in first, so they're the oldest.")
+	numBlocksPerTlf := 10
+	for _, tlfID := range []tlf.ID{highTlf, normalTlf, lowTlf} {
+		for i := 0; i < numBlocksPerTlf; i++ {
+			blockPtr, _, blockEncoded, serverHalf := setupBlockForDiskCache(
+				t, config)
+			err := standardCache.Put(
+				ctx, tlfID, blockPtr.ID, blockEncoded, serverHalf)
+			require.NoError(t, err)
+			clock.Add(time.Second)
+		}
+	}
+
+	t.Log("Pinned blocks that aren't cached don't protect the others.")
+	var uncached []kbfsblock.ID
+	for i := 0; i < numBlocksPerTlf; i++ {
+		uncached = append(uncached, makeRandomBlockPointer(t).ID)
+	}
+	cache.SetPinnedBlocks(ctx, lowTlf, uncached)
+
+	t.Log("Blocks from the lowest priority TLF are evicted first.")
+	numRemoved, _, err := standardCache.evictLocked(ctx, numBlocksPerTlf)
+	require.NoError(t, err)
+	require.Equal(t, numBlocksPerTlf, numRemoved)
+	require.Equal(t, 0, standardCache.tlfCounts[lowTlf])
+	require.Equal(t, numBlocksPerTlf, standardCache.tlfCounts[normalTlf])
+	require.Equal(t, numBlocksPerTlf, standardCache.tlfCounts[highTlf])
+
+	t.Log("A TLF over its own limit is evicted from before anything else.")
+	blockSize := standardCache.tlfSizes[highTlf] / uint64(numBlocksPerTlf)
+	config.SetDiskCacheTlfLimits(highTlf, DiskCacheTlfLimits{
+		MaxBytes: blockSize * uint64(numBlocksPerTlf-1),
+		Priority: DiskCachePriorityHigh,
+	})
+	numRemoved, _, err = standardCache.evictLocked(ctx, 1)
+	require.NoError(t, err)
+	require.Equal(t, 1, numRemoved)
+	require.Equal(t, numBlocksPerTlf, standardCache.tlfCounts[normalTlf])
+	require.Equal(t, numBlocksPerTlf-1, standardCache.tlfCounts[highTlf])
+
+	t.Log("Then the normal priority TLF is evicted from.")
+	numRemoved, _, err = standardCache.evictLocked(ctx, numBlocksPerTlf)
+	require.NoError(t, err)
+	require.Equal(t, numBlocksPerTlf, numRemoved)
+	require.Equal(t, 0, standardCache.tlfCounts[normalTlf])
+	require.Equal(t, numBlocksPerTlf-1, standardCache.tlfCounts[highTlf])
+}
+
+func TestDiskBlockCacheEvictSkipsPinned(t *testing.T) {
+	t.Parallel()
+	t.Log("Test that disk cache eviction never picks pinned blocks.")
+	cache, config := initDiskBlockCacheTest(t)
+	wrappedCache := cache.(*diskBlockCacheWrapped)
+	standardCache := wrappedCache.workingSetCache.(*DiskBlockCacheStandard)
+	defer shutdownDiskBlockCacheTest(cache)
+
+	ctx := context.Background()
+	clock := config.TestClock()
+	tlfID := tlf.FakeID(1, tlf.Private)
+	numBlocks := 10
+	var pinned []kbfsblock.ID
+	for i := 0; i < numBlocks; i++ {
+		blockPtr, _, blockEncoded, serverHalf := setupBlockForDiskCache(
+			t, config)
+		err := standardCache.Put(
+			ctx, tlfID, blockPtr.ID, blockEncoded, serverHalf)
+		require.NoError(t, err)
+		clock.Add(time.Second)
+		// Pin the oldest blocks, which would otherwise go first.
+		if i < numBlocks/2 {
+			pinned = append(pinned, blockPtr.ID)
+		}
+	}
+	cache.SetPinnedBlocks(ctx, tlfID, pinned)
+
+	t.Log("Only the unpinned blocks are evicted.")
+	numRemoved, _, err := standardCache.evictLocked(ctx, numBlocks)
+	require.NoError(t, err)
+	require.Equal(t, numBlocks/2, numRemoved)
+	for _, id := range pinned {
+		_, err := cache.GetMetadata(ctx, id)
+		require.NoError(t, err)
+	}
+
+	t.Log("Nothing is left to evict until the blocks are unpinned.")
+	numRemoved, _, err = standardCache.evictLocked(ctx, numBlocks)
+	require.NoError(t, err)
+	require.Equal(t, 0, numRemoved)
+	cache.SetPinnedBlocks(ctx, tlfID, nil)
+	numRemoved, _, err = standardCache.evictLocked(ctx, numBlocks)
+	require.NoError(t, err)
+	require.Equal(t, numBlocks/2, numRemoved)
+}
+
+func TestDiskBlockCachePinnedBlocksSaved(t *testing.T) {
+	t.Parallel()
+	t.Log("Test that the pinned blocks are saved across restarts.")
+	tempdir, err := ioutil.TempDir(os.TempDir(), "disk_block_cache_pinned")
+	require.NoError(t, err)
+	defer func() {
+		err := ioutil.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+	// Borrow the disk limiter of a test cache.
+	dbc, config := initDiskBlockCacheTest(t)
+	defer shutdownDiskBlockCacheTest(dbc)
+	newCache := func() *DiskBlockCacheStandard {
+		cache, err := newDiskBlockCacheStandardFromStorage(
+			config, workingSetCacheLimitTrackerType, storage.NewMemStorage(),
+			storage.NewMemStorage(), storage.NewMemStorage(), tempdir)
+		require.NoError(t, err)
+		cache.WaitUntilStarted()
+		return cache
+	}
+
+	ctx := context.Background()
+	tlfID := tlf.FakeID(1, tlf.Private)
+	pinned := []kbfsblock.ID{
+		makeRandomBlockPointer(t).ID, makeRandomBlockPointer(t).ID}
+	cache := newCache()
+	cache.SetPinnedBlocks(ctx, tlfID, pinned)
+	cache.Shutdown(ctx)
+
+	cache = newCache()
+	require.Equal(t, map[tlf.ID]map[kbfsblock.ID]bool{
+		tlfID: {pinned[0]: true, pinned[1]: true},
+	}, cache.pinnedBlocks)
+	cache.SetPinnedBlocks(ctx, tlfID, nil)
+	cache.Shutdown(ctx)
+
+	cache = newCache()
+	defer cache.Shutdown(ctx)
+	require.Len(t, cache.pinnedBlocks, 0)
+}
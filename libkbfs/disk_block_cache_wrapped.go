@@ -29,6 +29,7 @@ type diskBlockCacheConfig interface {
 	clockGetter
 	diskLimiterGetter
 	syncedTlfGetterSetter
+	diskCacheTlfLimitsGetterSetter
 }
 
 type diskBlockCacheWrapped struct {
@@ -175,6 +176,16 @@ func (cache *diskBlockCacheWrapped) UpdateMetadata(ctx context.Context,
 		finishedPrefetch)
 }
 
+// SetPinnedBlocks implements the DiskBlockCache interface for
+// diskBlockCacheWrapped.
+func (cache *diskBlockCacheWrapped) SetPinnedBlocks(ctx context.Context,
+	tlfID tlf.ID, blockIDs []kbfsblock.ID) {
+	cache.mtx.RLock()
+	defer cache.mtx.RUnlock()
+	// Only the working set cache ever evicts blocks.
+	cache.workingSetCache.SetPinnedBlocks(ctx, tlfID, blockIDs)
+}
+
 // Size implements the DiskBlockCache interface for diskBlockCacheWrapped.
 func (cache *diskBlockCacheWrapped) Size() int64 {
 	cache.mtx.RLock()
@@ -0,0 +1,125 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// DiskCachePriority is the eviction priority class of a TLF in the
+// working set disk block cache.  While the cache holds blocks from
+// TLFs in more than one class, blocks are only evicted from TLFs in
+// the lowest class present.
+type DiskCachePriority int
+
+const (
+	// DiskCachePriorityLow TLFs have their blocks evicted first.
+	DiskCachePriorityLow DiskCachePriority = -1
+	// DiskCachePriorityNormal is the default priority.
+	DiskCachePriorityNormal DiskCachePriority = 0
+	// DiskCachePriorityHigh TLFs have their blocks evicted last.
+	DiskCachePriorityHigh DiskCachePriority = 1
+)
+
+// String implements the fmt.Stringer interface for
+// DiskCachePriority.
+func (p DiskCachePriority) String() string {
+	switch p {
+	case DiskCachePriorityLow:
+		return "low"
+	case DiskCachePriorityNormal:
+		return "normal"
+	case DiskCachePriorityHigh:
+		return "high"
+	default:
+		return fmt.Sprintf("DiskCachePriority(%d)", int(p))
+	}
+}
+
+func parseDiskCachePriority(s string) (DiskCachePriority, error) {
+	switch strings.ToLower(s) {
+	case "low":
+		return DiskCachePriorityLow, nil
+	case "normal":
+		return DiskCachePriorityNormal, nil
+	case "high":
+		return DiskCachePriorityHigh, nil
+	default:
+		return DiskCachePriorityNormal, errors.Errorf(
+			"Unknown disk cache priority %q", s)
+	}
+}
+
+// DiskCacheTlfLimits describes how much of the working set disk block
+// cache a single TLF may use, and how eagerly its blocks are evicted.
+type DiskCacheTlfLimits struct {
+	// MaxBytes caps the number of bytes the TLF's blocks may take up
+	// in the cache.  Zero means the TLF is only limited by the size
+	// of the whole cache.
+	MaxBytes uint64
+	// Priority is the TLF's eviction priority class.
+	Priority DiskCachePriority
+}
+
+// IsDefault returns whether these limits are the same as for a TLF
+// that was never configured.
+func (l DiskCacheTlfLimits) IsDefault() bool {
+	return l == DiskCacheTlfLimits{}
+}
+
+// String implements the fmt.Stringer interface for
+// DiskCacheTlfLimits.  The result can be parsed by
+// ParseDiskCacheTlfLimits.
+func (l DiskCacheTlfLimits) String() string {
+	maxBytes := "0"
+	if l.MaxBytes > 0 {
+		v := int64(l.MaxBytes)
+		maxBytes = SizeFlag{&v}.String()
+	}
+	return fmt.Sprintf("max=%s,priority=%s", maxBytes, l.Priority)
+}
+
+// ParseDiskCacheTlfLimits parses per-TLF disk cache limits from a
+// string like "max=512Mi,priority=high".  Sizes may use the same
+// suffixes as SizeFlag, and a max of 0 means no per-TLF limit.
+// Settings left out keep their default values.
+func ParseDiskCacheTlfLimits(s string) (DiskCacheTlfLimits, error) {
+	var limits DiskCacheTlfLimits
+	for _, setting := range strings.Split(s, ",") {
+		setting = strings.TrimSpace(setting)
+		if setting == "" {
+			continue
+		}
+		kv := strings.SplitN(setting, "=", 2)
+		if len(kv) != 2 {
+			return DiskCacheTlfLimits{}, errors.Errorf(
+				"Bad disk cache setting %q", setting)
+		}
+		value := strings.TrimSpace(kv[1])
+		switch strings.TrimSpace(kv[0]) {
+		case "max":
+			var v int64
+			err := SizeFlag{&v}.Set(value)
+			if err != nil || v < 0 {
+				return DiskCacheTlfLimits{}, errors.Errorf(
+					"Bad disk cache size in %q", setting)
+			}
+			limits.MaxBytes = uint64(v)
+		case "priority":
+			p, err := parseDiskCachePriority(value)
+			if err != nil {
+				return DiskCacheTlfLimits{}, err
+			}
+			limits.Priority = p
+		default:
+			return DiskCacheTlfLimits{}, errors.Errorf(
+				"Unknown disk cache setting in %q", setting)
+		}
+	}
+	return limits, nil
+}
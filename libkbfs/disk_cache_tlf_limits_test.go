@@ -0,0 +1,43 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDiskCacheTlfLimits(t *testing.T) {
+	limits, err := ParseDiskCacheTlfLimits("max=512Mi, priority=high")
+	require.NoError(t, err)
+	require.Equal(t, DiskCacheTlfLimits{
+		MaxBytes: 512 << 20,
+		Priority: DiskCachePriorityHigh,
+	}, limits)
+
+	t.Log("String() output can be parsed back")
+	require.Equal(t, "max=512mi,priority=high", limits.String())
+	limits2, err := ParseDiskCacheTlfLimits(limits.String())
+	require.NoError(t, err)
+	require.Equal(t, limits, limits2)
+
+	limits, err = ParseDiskCacheTlfLimits("priority=low")
+	require.NoError(t, err)
+	require.Equal(t, DiskCacheTlfLimits{Priority: DiskCachePriorityLow},
+		limits)
+	require.Equal(t, "max=0,priority=low", limits.String())
+
+	limits, err = ParseDiskCacheTlfLimits("")
+	require.NoError(t, err)
+	require.True(t, limits.IsDefault())
+
+	for _, bad := range []string{
+		"max", "max=x", "max=1q", "priority=urgent", "min=1",
+	} {
+		_, err := ParseDiskCacheTlfLimits(bad)
+		require.Error(t, err, bad)
+	}
+}
@@ -6,6 +6,7 @@ package libkbfs
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/keybase/client/go/libkb"
 	"github.com/keybase/client/go/protocol/keybase1"
@@ -158,6 +159,16 @@ func (e RenameAcrossDirsError) Error() string {
 	return fmt.Sprintf("Cannot rename across directories")
 }
 
+// CopyAcrossFoldersError indicates that the user tried to clone an
+// entry into a different top-level folder.
+type CopyAcrossFoldersError struct {
+}
+
+// Error implements the error interface for CopyAcrossFoldersError
+func (e CopyAcrossFoldersError) Error() string {
+	return fmt.Sprintf("Cannot clone entries across top-level folders")
+}
+
 // ErrorFileAccessError indicates that the user tried to perform an
 // operation on the ErrorFile that is not allowed.
 type ErrorFileAccessError struct {
@@ -929,6 +940,43 @@ func (e NameTooLongError) Error() string {
 		"allowed number of bytes (%d)", e.name, e.maxAllowedBytes)
 }
 
+// NoSuchXattrError indicates that the user tried to access an
+// extended attribute that doesn't exist on an entry.
+type NoSuchXattrError struct {
+	Name string
+}
+
+// Error implements the error interface for NoSuchXattrError.
+func (e NoSuchXattrError) Error() string {
+	return fmt.Sprintf("Extended attribute %s doesn't exist", e.Name)
+}
+
+// XattrTooBigError indicates that the user tried to set an extended
+// attribute with a value bigger than KBFS's supported size.
+type XattrTooBigError struct {
+	Name            string
+	size            int
+	maxAllowedBytes int
+}
+
+// Error implements the error interface for XattrTooBigError.
+func (e XattrTooBigError) Error() string {
+	return fmt.Sprintf("Extended attribute %s has a value of %d bytes, "+
+		"more than the maximum allowed number of bytes (%d)",
+		e.Name, e.size, e.maxAllowedBytes)
+}
+
+// PathLockedError indicates that a path lock couldn't be acquired
+// because another device or user already holds it.
+type PathLockedError struct {
+	Path string
+}
+
+// Error implements the error interface for PathLockedError.
+func (e PathLockedError) Error() string {
+	return fmt.Sprintf("%s is locked by someone else", e.Path)
+}
+
 // DirTooBigError indicates that the user tried to write a directory
 // that would be bigger than KBFS's supported size.
 type DirTooBigError struct {
@@ -1284,6 +1332,30 @@ func (e DiskCacheStartingError) Error() string {
 		"still starting", e.op)
 }
 
+// BlockDedupIndexClosedError indicates that the block dedup index
+// has been shut down, and thus isn't accepting any more operations.
+type BlockDedupIndexClosedError struct {
+	op string
+}
+
+// Error implements the error interface for BlockDedupIndexClosedError.
+func (e BlockDedupIndexClosedError) Error() string {
+	return fmt.Sprintf("Error performing %s operation: the dedup index is "+
+		"closed", e.op)
+}
+
+// SearchIndexClosedError indicates that the search index has been
+// shut down, and thus isn't accepting any more operations.
+type SearchIndexClosedError struct {
+	op string
+}
+
+// Error implements the error interface for SearchIndexClosedError.
+func (e SearchIndexClosedError) Error() string {
+	return fmt.Sprintf("Error performing %s operation: the search index is "+
+		"closed", e.op)
+}
+
 // NoUpdatesWhileDirtyError indicates that updates aren't being
 // accepted while a TLF is locally dirty.
 type NoUpdatesWhileDirtyError struct{}
@@ -1292,3 +1364,126 @@ type NoUpdatesWhileDirtyError struct{}
 func (e NoUpdatesWhileDirtyError) Error() string {
 	return "Ignoring MD updates while writes are dirty"
 }
+
+// WriteToReadonlyNodeError indicates an error when trying to write a
+// node that belongs to a read-only view of a folder, such as an
+// archived revision.
+type WriteToReadonlyNodeError struct {
+	Filename string
+}
+
+// Error implements the error interface for WriteToReadonlyNodeError.
+func (e WriteToReadonlyNodeError) Error() string {
+	return fmt.Sprintf("Cannot write to %s: it is part of a read-only "+
+		"view of the folder", e.Filename)
+}
+
+// NoSuchRevisionError indicates that a requested revision of a TLF
+// does not exist.
+type NoSuchRevisionError struct {
+	Tlf tlf.ID
+	Rev kbfsmd.Revision
+}
+
+// Error implements the error interface for NoSuchRevisionError.
+func (e NoSuchRevisionError) Error() string {
+	return fmt.Sprintf("Revision %d of TLF %s does not exist", e.Rev, e.Tlf)
+}
+
+// NoRevisionAtTimeError indicates that a TLF had no merged revisions
+// at or before a given time.
+type NoRevisionAtTimeError struct {
+	Tlf  tlf.ID
+	Time time.Time
+}
+
+// Error implements the error interface for NoRevisionAtTimeError.
+func (e NoRevisionAtTimeError) Error() string {
+	return fmt.Sprintf("TLF %s has no revisions written at or before %s",
+		e.Tlf, e.Time.Format(time.RFC3339))
+}
+
+// PathChangesReclaimedError indicates that the path changes made
+// after a revision can't be listed, because quota reclamation has
+// already covered some of the revisions that follow it, and their
+// blocks might be gone.  Callers have to rescan the TLF, and can
+// then resume listing changes after LastGCRevision.
+type PathChangesReclaimedError struct {
+	Tlf            tlf.ID
+	Since          kbfsmd.Revision
+	LastGCRevision kbfsmd.Revision
+}
+
+// Error implements the error interface for PathChangesReclaimedError.
+func (e PathChangesReclaimedError) Error() string {
+	return fmt.Sprintf("The path changes of TLF %s after revision %d "+
+		"were reclaimed up to revision %d", e.Tlf, e.Since, e.LastGCRevision)
+}
+
+// UnmergedChangesPendingError indicates that a TLF can't be written
+// to, because it has local unmerged changes that were set aside for
+// manual conflict resolution and haven't been resolved yet.
+type UnmergedChangesPendingError struct {
+	Tlf tlf.ID
+	BID BranchID
+}
+
+// Error implements the error interface for UnmergedChangesPendingError.
+func (e UnmergedChangesPendingError) Error() string {
+	return fmt.Sprintf("TLF %s can't be written until the unmerged "+
+		"changes on branch %s are resolved", e.Tlf, e.BID)
+}
+
+// NoUnmergedChangesError indicates that a TLF has no local unmerged
+// changes waiting for manual conflict resolution.
+type NoUnmergedChangesError struct {
+	Tlf tlf.ID
+}
+
+// Error implements the error interface for NoUnmergedChangesError.
+func (e NoUnmergedChangesError) Error() string {
+	return fmt.Sprintf("TLF %s has no unmerged changes waiting to be "+
+		"resolved", e.Tlf)
+}
+
+// JournalBundleAlreadyImportedError indicates that a journal bundle
+// can't be imported, because it was already imported on this device.
+type JournalBundleAlreadyImportedError struct {
+	BundleID string
+}
+
+// Error implements the error interface for
+// JournalBundleAlreadyImportedError.
+func (e JournalBundleAlreadyImportedError) Error() string {
+	return fmt.Sprintf("Journal bundle %s was already imported", e.BundleID)
+}
+
+// JournalBundleAlreadyFlushedError indicates that all the revisions
+// in a journal bundle are already on the server, so there was nothing
+// left to import.
+type JournalBundleAlreadyFlushedError struct {
+	Tlf           tlf.ID
+	RevisionStart kbfsmd.Revision
+	RevisionEnd   kbfsmd.Revision
+}
+
+// Error implements the error interface for
+// JournalBundleAlreadyFlushedError.
+func (e JournalBundleAlreadyFlushedError) Error() string {
+	return fmt.Sprintf("Revisions %d-%d of TLF %s from the journal "+
+		"bundle were already flushed", e.RevisionStart, e.RevisionEnd, e.Tlf)
+}
+
+// JournalBundleConflictError indicates that a journal bundle can't be
+// flushed, because the server has different revisions in its place.
+// The exporting device's journal has to be resumed instead, so that
+// the conflict can be resolved there.
+type JournalBundleConflictError struct {
+	Tlf tlf.ID
+}
+
+// Error implements the error interface for JournalBundleConflictError.
+func (e JournalBundleConflictError) Error() string {
+	return fmt.Sprintf("The server has revisions of TLF %s that conflict "+
+		"with the journal bundle", e.Tlf)
+}
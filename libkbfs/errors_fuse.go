@@ -114,6 +114,22 @@ func (e NameTooLongError) Errno() fuse.Errno {
 	return fuse.Errno(syscall.ENAMETOOLONG)
 }
 
+var _ fuse.ErrorNumber = NoSuchXattrError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// NoSuchXattrError.
+func (e NoSuchXattrError) Errno() fuse.Errno {
+	return fuse.ErrNoXattr
+}
+
+var _ fuse.ErrorNumber = XattrTooBigError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// XattrTooBigError.
+func (e XattrTooBigError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.E2BIG)
+}
+
 var _ fuse.ErrorNumber = DirTooBigError{}
 
 // Errno implements the fuse.ErrorNumber interface for DirTooBigError.
@@ -144,6 +160,14 @@ func (e RenameAcrossDirsError) Errno() fuse.Errno {
 	return fuse.Errno(syscall.EXDEV)
 }
 
+var _ fuse.ErrorNumber = CopyAcrossFoldersError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// CopyAcrossFoldersError.
+func (e CopyAcrossFoldersError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.EXDEV)
+}
+
 var _ fuse.ErrorNumber = &ErrDiskLimitTimeout{}
 
 // Errno implements the fuse.ErrorNumber interface for
@@ -151,3 +175,43 @@ var _ fuse.ErrorNumber = &ErrDiskLimitTimeout{}
 func (e *ErrDiskLimitTimeout) Errno() fuse.Errno {
 	return fuse.Errno(syscall.ENOSPC)
 }
+
+var _ fuse.ErrorNumber = WriteToReadonlyNodeError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// WriteToReadonlyNodeError.
+func (e WriteToReadonlyNodeError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.EROFS)
+}
+
+var _ fuse.ErrorNumber = NoSuchRevisionError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// NoSuchRevisionError.
+func (e NoSuchRevisionError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.ENOENT)
+}
+
+var _ fuse.ErrorNumber = NoRevisionAtTimeError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// NoRevisionAtTimeError.
+func (e NoRevisionAtTimeError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.ENOENT)
+}
+
+var _ fuse.ErrorNumber = UnmergedChangesPendingError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// UnmergedChangesPendingError.
+func (e UnmergedChangesPendingError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.EROFS)
+}
+
+var _ fuse.ErrorNumber = NoUnmergedChangesError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// NoUnmergedChangesError.
+func (e NoUnmergedChangesError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.ENOENT)
+}
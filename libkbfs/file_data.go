@@ -653,6 +653,31 @@ func (fd *fileData) read(ctx context.Context, dest []byte, startOff int64) (
 	return currLen, nil
 }
 
+// getSize returns the size of the file, as given by the end of its
+// right-most leaf block.
+func (fd *fileData) getSize(ctx context.Context) (uint64, error) {
+	block, _, err := fd.getter(ctx, fd.kmd, fd.rootBlockPointer(),
+		fd.file, blockRead)
+	if err != nil {
+		return 0, err
+	}
+
+	off := int64(0)
+	for block.IsInd {
+		if len(block.IPtrs) == 0 {
+			return 0, nil
+		}
+		iptr := block.IPtrs[len(block.IPtrs)-1]
+		off = iptr.Off
+		block, _, err = fd.getter(ctx, fd.kmd, iptr.BlockPointer,
+			fd.file, blockRead)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return uint64(off) + uint64(len(block.Contents)), nil
+}
+
 // getBytes returns a buffer containing data from the file, in the
 // half-inclusive range `[startOff, endOff)`.  If `endOff` == -1, it
 // returns data until the end of the file.
@@ -677,6 +702,88 @@ func (fd *fileData) getBytes(ctx context.Context, startOff, endOff int64) (
 	return data, nil
 }
 
+// dataExtentsScanBytes is how much of the file's offset range
+// getDataExtents looks at each time it fetches leaf blocks.  Holes
+// between leaf blocks are skipped over without fetching anything.
+const dataExtentsScanBytes = 8 << 20
+
+// getDataExtents returns the ranges of the file that contain data,
+// ordered by offset, starting with the one that contains or follows
+// `off`.  Everything else before the end of the file is a hole that
+// reads as zeroes.  Adjacent leaf blocks are merged into a single
+// extent.  If `maxExtents` is greater than 0, at most that many
+// extents are returned.
+func (fd *fileData) getDataExtents(
+	ctx context.Context, off int64, maxExtents int) ([]FileExtent, error) {
+	if off < 0 {
+		return nil, fmt.Errorf("Bad offset %d", off)
+	}
+
+	topBlock, _, err := fd.getter(ctx, fd.kmd, fd.rootBlockPointer(),
+		fd.file, blockRead)
+	if err != nil {
+		return nil, err
+	}
+
+	if !topBlock.IsInd {
+		size := int64(len(topBlock.Contents))
+		if off >= size {
+			return nil, nil
+		}
+		return []FileExtent{{Off: 0, Len: size}}, nil
+	}
+
+	var extents []FileExtent
+	// addExtent returns false if there's no room left for the given
+	// range.
+	addExtent := func(start, end int64) bool {
+		if end <= start || end <= off {
+			return true
+		}
+		if len(extents) > 0 {
+			last := &extents[len(extents)-1]
+			if last.Off+last.Len >= start {
+				if end > last.Off+last.Len {
+					last.Len = end - last.Off
+				}
+				return true
+			}
+		}
+		if maxExtents > 0 && len(extents) == maxExtents {
+			return false
+		}
+		extents = append(extents, FileExtent{Off: start, Len: end - start})
+		return true
+	}
+
+	startOff := off
+	for {
+		pfr, blockMap, nextBlockOff, err := fd.getLeafBlocksForOffsetRange(
+			ctx, fd.rootBlockPointer(), topBlock, startOff,
+			startOff+dataExtentsScanBytes, false)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, p := range pfr {
+			if len(p) == 0 {
+				return nil, fmt.Errorf("Unexpected empty path to child for "+
+					"file %v", fd.rootBlockPointer())
+			}
+			iptr := p[len(p)-1].childIPtr()
+			block := blockMap[iptr.BlockPointer]
+			if !addExtent(iptr.Off, iptr.Off+int64(len(block.Contents))) {
+				return extents, nil
+			}
+		}
+
+		if nextBlockOff < 0 {
+			return extents, nil
+		}
+		startOff = nextBlockOff
+	}
+}
+
 // createIndirectBlock creates a new indirect block and pick a new id
 // for the existing block, and use the existing block's ID for the new
 // indirect block that becomes the parent.
@@ -1309,6 +1416,288 @@ func (fd *fileData) truncateExtend(ctx context.Context, size uint64,
 	return newDe, dirtyPtrs, nil
 }
 
+// holePunch tracks the changes made to a file while punching a hole
+// in the half-inclusive range `[off, endOff)`.
+type holePunch struct {
+	off, endOff            int64
+	dirtyMap               map[BlockPointer]bool
+	unrefs                 []BlockInfo
+	newlyDirtiedChildBytes int64
+	madeHole               bool
+}
+
+// getSubtreeBlockInfos returns the infos of all the synced blocks
+// under the given indirect block.  Only the indirect blocks are
+// fetched, not the leaf blocks.
+func (fd *fileData) getSubtreeBlockInfos(
+	ctx context.Context, pblock *FileBlock) ([]BlockInfo, error) {
+	var infos []BlockInfo
+	for _, iptr := range pblock.IPtrs {
+		if iptr.EncodedSize != 0 {
+			infos = append(infos, iptr.BlockInfo)
+		}
+		// As in getBlocksForOffsetRange, pointers of unknown type
+		// are direct.
+		if iptr.DirectType != IndirectBlock {
+			continue
+		}
+		block, _, err := fd.getter(
+			ctx, fd.kmd, iptr.BlockPointer, fd.file, blockReadParallel)
+		if err != nil {
+			return nil, err
+		}
+		childInfos, err := fd.getSubtreeBlockInfos(ctx, block)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, childInfos...)
+	}
+	return infos, nil
+}
+
+// punchHoleInLeaf punches the part of the hole that overlaps the
+// given leaf block, which starts at `startOff` and is followed by a
+// block starting at `nextOff` (or -1 if it's the last block of the
+// file).  If the hole covers the rest of the block, the block is cut
+// short; otherwise the covered bytes are zeroed, since the last block
+// of the file has to reach the end of the file.
+func (fd *fileData) punchHoleInLeaf(ctx context.Context, hp *holePunch,
+	parentBlocks []parentBlockAndChildIndex, ptr BlockPointer,
+	block *FileBlock, wasDirty bool, startOff, nextOff int64) error {
+	curr := hp.off
+	if curr < startOff {
+		curr = startOff
+	}
+	blockEnd := startOff + int64(len(block.Contents))
+	if curr >= blockEnd {
+		// This part of the range is already a hole.
+		return nil
+	}
+
+	oldLen := len(block.Contents)
+	if hp.endOff >= blockEnd && nextOff > 0 {
+		// Make a new slice so the dropped data can be
+		// garbage-collected.
+		block.Contents = append(
+			[]byte(nil), block.Contents[:curr-startOff]...)
+		hp.madeHole = true
+	} else {
+		end := hp.endOff
+		if end > blockEnd {
+			end = blockEnd
+		}
+		zeroes := block.Contents[curr-startOff : end-startOff]
+		for i := range zeroes {
+			zeroes[i] = 0
+		}
+	}
+
+	hp.newlyDirtiedChildBytes += int64(len(block.Contents))
+	if wasDirty {
+		hp.newlyDirtiedChildBytes -= int64(oldLen)
+	}
+
+	newDirtyPtrs, newUnrefs, err := fd.markParentsDirty(ctx, parentBlocks)
+	hp.unrefs = append(hp.unrefs, newUnrefs...)
+	if err != nil {
+		return err
+	}
+	for _, p := range newDirtyPtrs {
+		hp.dirtyMap[p] = true
+	}
+
+	// Keep the old block ID while it's dirty.
+	if err = fd.cacher(ptr, block); err != nil {
+		return err
+	}
+	hp.dirtyMap[ptr] = true
+	return nil
+}
+
+// punchHoleInIndirect punches the part of the hole that overlaps the
+// children of the given indirect block, which is followed by a block
+// starting at `nextOff` (or -1 if it's at the end of the file).
+// Synced children that lie entirely within the hole are removed from
+// the block and unreferenced without fetching them, except for the
+// first child, which has to stay to keep the block's starting offset
+// and is replaced by a new empty block instead.  Only the leaf blocks
+// at the edges of the hole, and dirty ones, are read and rewritten.
+func (fd *fileData) punchHoleInIndirect(ctx context.Context,
+	hp *holePunch, parentBlocks []parentBlockAndChildIndex,
+	ptr BlockPointer, pblock *FileBlock, nextOff int64) error {
+	changed := false
+	removed := make(map[int]bool)
+	for i, iptr := range pblock.IPtrs {
+		childNextOff := nextOff
+		if i < len(pblock.IPtrs)-1 {
+			childNextOff = pblock.IPtrs[i+1].Off
+		}
+		if childNextOff > 0 && childNextOff <= hp.off {
+			continue
+		}
+		if iptr.Off >= hp.endOff {
+			break
+		}
+
+		covered := iptr.Off >= hp.off && childNextOff > 0 &&
+			childNextOff <= hp.endOff
+		// A synced indirect block has no dirty blocks under it.
+		if covered && iptr.EncodedSize != 0 && i > 0 {
+			if iptr.DirectType == IndirectBlock {
+				block, _, err := fd.getter(
+					ctx, fd.kmd, iptr.BlockPointer, fd.file, blockReadParallel)
+				if err != nil {
+					return err
+				}
+				infos, err := fd.getSubtreeBlockInfos(ctx, block)
+				if err != nil {
+					return err
+				}
+				hp.unrefs = append(hp.unrefs, infos...)
+			}
+			hp.unrefs = append(hp.unrefs, iptr.BlockInfo)
+			removed[i] = true
+			hp.madeHole = true
+			continue
+		}
+		if covered && iptr.EncodedSize != 0 &&
+			iptr.DirectType == DirectBlock {
+			newID, err := fd.crypto.MakeTemporaryBlockID()
+			if err != nil {
+				return err
+			}
+			newPtr := BlockPointer{
+				ID:      newID,
+				KeyGen:  fd.kmd.LatestKeyGeneration(),
+				DataVer: iptr.DataVer,
+				Context: kbfsblock.MakeFirstContext(
+					fd.chargedTo, fd.rootBlockPointer().GetBlockType()),
+				DirectType: DirectBlock,
+			}
+			fd.log.CDebugf(ctx, "Replacing %v with empty block %v",
+				iptr.BlockPointer, newPtr)
+			err = fd.cacher(newPtr, &FileBlock{})
+			if err != nil {
+				return err
+			}
+			hp.dirtyMap[newPtr] = true
+			hp.unrefs = append(hp.unrefs, iptr.BlockInfo)
+			pblock.IPtrs[i].BlockInfo = BlockInfo{BlockPointer: newPtr}
+			changed = true
+			hp.madeHole = true
+			continue
+		}
+
+		childParents := make(
+			[]parentBlockAndChildIndex, len(parentBlocks), len(parentBlocks)+1)
+		copy(childParents, parentBlocks)
+		childParents = append(childParents, parentBlockAndChildIndex{pblock, i})
+		block, wasDirty, err := fd.getter(
+			ctx, fd.kmd, iptr.BlockPointer, fd.file, blockWrite)
+		if err != nil {
+			return err
+		}
+		if block.IsInd {
+			err = fd.punchHoleInIndirect(ctx, hp, childParents,
+				iptr.BlockPointer, block, childNextOff)
+		} else {
+			err = fd.punchHoleInLeaf(ctx, hp, childParents,
+				iptr.BlockPointer, block, wasDirty, iptr.Off, childNextOff)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(removed) > 0 {
+		iptrs := make([]IndirectFilePtr, 0, len(pblock.IPtrs)-len(removed))
+		for i, iptr := range pblock.IPtrs {
+			if !removed[i] {
+				iptrs = append(iptrs, iptr)
+			}
+		}
+		pblock.IPtrs = iptrs
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	newDirtyPtrs, newUnrefs, err := fd.markParentsDirty(ctx, parentBlocks)
+	hp.unrefs = append(hp.unrefs, newUnrefs...)
+	if err != nil {
+		return err
+	}
+	for _, p := range newDirtyPtrs {
+		hp.dirtyMap[p] = true
+	}
+	if err = fd.cacher(ptr, pblock); err != nil {
+		return err
+	}
+	hp.dirtyMap[ptr] = true
+	return nil
+}
+
+// punchHole replaces the data in the half-inclusive range `[off,
+// endOff)`, which must lie within the file, with zeroes.  Synced
+// blocks covered entirely by the range are dropped from their
+// parents and unreferenced without being fetched (see
+// punchHoleInIndirect), leaving a hole that takes up no space.  Only
+// the leaf blocks at the edges of the range are read and rewritten.
+// Return params:
+// * dirtyPtrs: a slice of the BlockPointers that have been dirtied
+//   while punching the hole.
+// * unrefs: a slice of BlockInfos that must be unreferenced as part of
+//   an eventual sync of this change.  May be non-nil even if err != nil.
+// * newlyDirtiedChildBytes is the total amount of block data dirtied,
+//   as for `write`.  It may be negative, and non-zero even if err != nil.
+func (fd *fileData) punchHole(ctx context.Context, off, endOff int64,
+	topBlock *FileBlock) (dirtyPtrs []BlockPointer, unrefs []BlockInfo,
+	newlyDirtiedChildBytes int64, err error) {
+	fd.log.CDebugf(ctx, "Punching a hole in [%d, %d)", off, endOff)
+
+	hp := &holePunch{
+		off:      off,
+		endOff:   endOff,
+		dirtyMap: make(map[BlockPointer]bool),
+	}
+	if topBlock.IsInd {
+		err = fd.punchHoleInIndirect(
+			ctx, hp, nil, fd.rootBlockPointer(), topBlock, -1)
+	} else {
+		var wasDirty bool
+		_, wasDirty, err = fd.getter(
+			ctx, fd.kmd, fd.rootBlockPointer(), fd.file, blockWrite)
+		if err == nil {
+			err = fd.punchHoleInLeaf(ctx, hp, nil, fd.rootBlockPointer(),
+				topBlock, wasDirty, 0, -1)
+		}
+	}
+	if err != nil {
+		return nil, hp.unrefs, hp.newlyDirtiedChildBytes, err
+	}
+
+	if hp.madeHole {
+		// As in truncateExtend, mark every top-level pointer.
+		for i := range topBlock.IPtrs {
+			topBlock.IPtrs[i].Holes = true
+		}
+	}
+
+	// Always make the top block dirty, so we will sync any indirect
+	// blocks, and so any write during a sync of this file is
+	// deferred.
+	if err = fd.cacher(fd.rootBlockPointer(), topBlock); err != nil {
+		return nil, hp.unrefs, hp.newlyDirtiedChildBytes, err
+	}
+	hp.dirtyMap[fd.rootBlockPointer()] = true
+
+	dirtyPtrs = make([]BlockPointer, 0, len(hp.dirtyMap))
+	for p := range hp.dirtyMap {
+		dirtyPtrs = append(dirtyPtrs, p)
+	}
+	return dirtyPtrs, hp.unrefs, hp.newlyDirtiedChildBytes, nil
+}
+
 // truncateShrink shrinks the file to the given size. Return params:
 // * newDe: a new directory entry with the EncodedSize cleared if the file
 //   shrunk.
@@ -1517,13 +1906,24 @@ func (fd *fileData) split(ctx context.Context, id tlf.ID,
 		}
 		off = nextBlockOff // Will be -1 if there are no more blocks.
 
+		// Leave blocks that are followed by a hole alone, since
+		// there are no bytes to move across the hole, and the next
+		// block doesn't start where this one ends.
+		if nextBlockOff >= 0 &&
+			nextBlockOff != startOff+int64(len(block.Contents)) {
+			continue
+		}
+
 		splitAt := fd.bsplit.CheckSplit(block)
 		switch {
 		case splitAt == 0:
 			continue
 		case splitAt > 0:
 			endOfBlock := startOff + int64(len(block.Contents))
-			extraBytes := block.Contents[splitAt:]
+			// Copy the extra bytes, so the next block doesn't share
+			// memory with this one.
+			extraBytes := make([]byte, int64(len(block.Contents))-splitAt)
+			copy(extraBytes, block.Contents[splitAt:])
 			block.Contents = block.Contents[:splitAt]
 			// put the extra bytes in front of the next block
 			if nextBlockOff < 0 {
@@ -5,7 +5,6 @@
 package libkbfs
 
 import (
-	"errors"
 	"fmt"
 	"sync"
 	"time"
@@ -17,13 +16,15 @@ import (
 	"github.com/keybase/kbfs/kbfsmd"
 	"github.com/keybase/kbfs/kbfssync"
 	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
 	"golang.org/x/net/context"
 )
 
 type fbmHelper interface {
 	getMostRecentFullyMergedMD(ctx context.Context) (
 		ImmutableRootMetadata, error)
-	finalizeGCOp(ctx context.Context, gco *GCOp) error
+	finalizeGCOp(ctx context.Context, gco *GCOp,
+		trashGCStartRev kbfsmd.Revision) error
 }
 
 const (
@@ -310,10 +311,14 @@ func isArchivableOp(op op) bool {
 		return true
 	case *renameOp:
 		return true
+	case *exchangeOp:
+		return true
 	case *syncOp:
 		return true
 	case *setAttrOp:
 		return true
+	case *setXattrOp:
+		return true
 	case *resolutionOp:
 		return true
 	default:
@@ -642,7 +647,8 @@ func (fbm *folderBlockManager) archiveBlocksInBackground() {
 					// Can be zeroPtr in weird failed sync scenarios.
 					// See syncInfo.replaceRemovedBlock for an example
 					// of how this can happen.
-					if ptr != zeroPtr {
+					if ptr != zeroPtr &&
+						!isTrashOp(op, md.data.TrashRetention) {
 						ptrs = append(ptrs, ptr)
 					}
 				}
@@ -727,6 +733,40 @@ func (fbm *folderBlockManager) deleteBlocksInBackground() {
 	}
 }
 
+// trashUnrefAge returns how long the blocks of entries removed from
+// a TLF with the given trash retention must have been unreferenced
+// before quota reclamation can delete them.
+func trashUnrefAge(config Config, retention time.Duration) time.Duration {
+	unrefAge := config.QuotaReclamationMinUnrefAge()
+	if retention > unrefAge {
+		return retention
+	}
+	return unrefAge
+}
+
+// isTrashOp returns true if the given op, from a revision of a TLF
+// with the given trash retention, removed an entry that can still be
+// restored.  The blocks unreferenced by such an op aren't archived,
+// since archived blocks can't get any new references.
+func isTrashOp(op op, retention time.Duration) bool {
+	_, isRmOp := op.(*rmOp)
+	return isRmOp && retention > 0
+}
+
+// isTrashRevision returns true if the given revision has any trash
+// ops.  Quota reclamation only deletes the blocks unreferenced by
+// such a revision once the trash retention is over, since restoring
+// a removed entry also needs the old blocks of its parent directory,
+// which might have been unreferenced by any op in the revision.
+func isTrashRevision(rmd ReadOnlyRootMetadata) bool {
+	for _, op := range rmd.data.Changes.Ops {
+		if isTrashOp(op, rmd.data.TrashRetention) {
+			return true
+		}
+	}
+	return false
+}
+
 func (fbm *folderBlockManager) isOldEnough(rmd ImmutableRootMetadata) bool {
 	// Trust the server's timestamp on this MD.
 	mtime := rmd.localTimestamp
@@ -830,33 +870,73 @@ func (fbm *folderBlockManager) getMostRecentOldEnoughAndGCRevisions(
 	return mostRecentOldEnoughRev, lastGCRev, nil
 }
 
+// getTrashRevisions returns the most recent revision of the given
+// head's TLF whose removed entries have been in the trash for long
+// enough to be reclaimed, as well as the latest revision whose
+// removed entries were already reclaimed, given the results of
+// getMostRecentOldEnoughAndGCRevisions.
+func (fbm *folderBlockManager) getTrashRevisions(
+	ctx context.Context, head ImmutableRootMetadata,
+	mostRecentOldEnoughRev, lastGCRev kbfsmd.Revision) (
+	trashOldEnoughRev, lastTrashGCRev kbfsmd.Revision, err error) {
+	lastTrashGCRev = head.data.lastTrashGCRevision(lastGCRev)
+	retention := head.data.TrashRetention
+	if retention <= fbm.config.QuotaReclamationMinUnrefAge() {
+		return mostRecentOldEnoughRev, lastTrashGCRev, nil
+	}
+
+	cutoff := fbm.config.Clock().Now().Add(-retention)
+	trashOldEnoughRev, err = getMergedRevisionForTime(
+		ctx, fbm.config, head, cutoff)
+	switch errors.Cause(err).(type) {
+	case nil:
+		fbm.log.CDebugf(ctx, "Revision %d is older than the trash "+
+			"retention %s", trashOldEnoughRev, retention)
+		return trashOldEnoughRev, lastTrashGCRev, nil
+	case NoRevisionAtTimeError:
+		return kbfsmd.RevisionUninitialized, lastTrashGCRev, nil
+	default:
+		return kbfsmd.RevisionUninitialized, kbfsmd.RevisionUninitialized, err
+	}
+}
+
 // getUnrefBlocks returns a slice containing all the block pointers
 // that were unreferenced after the earliestRev, up to and including
-// those in latestRev.  If the number of pointers is too large, it
-// will shorten the range of the revisions being reclaimed, and return
-// the latest revision represented in the returned slice of pointers.
+// those in latestRev, except for those unreferenced by trash
+// revisions (see isTrashRevision).  Those are instead included if
+// they were unreferenced after trashEarliestRev, up to and including
+// trashLatestRev, which must not be after latestRev.
+// If the number of pointers is too large, it will shorten the range
+// of the revisions being reclaimed, and return the latest revision
+// represented in the returned slice of pointers.
 func (fbm *folderBlockManager) getUnreferencedBlocks(
-	ctx context.Context, latestRev, earliestRev kbfsmd.Revision) (
+	ctx context.Context, latestRev, earliestRev,
+	trashLatestRev, trashEarliestRev kbfsmd.Revision) (
 	ptrs []BlockPointer, lastRevConsidered kbfsmd.Revision,
 	complete bool, err error) {
 	fbm.log.CDebugf(ctx, "Getting unreferenced blocks between revisions "+
-		"%d and %d", earliestRev, latestRev)
+		"%d and %d, and trashed blocks between revisions %d and %d",
+		earliestRev, latestRev, trashEarliestRev, trashLatestRev)
 	defer func() {
 		if err == nil {
-			fbm.log.CDebugf(ctx, "Found %d pointers to clean between "+
-				"revisions %d and %d", len(ptrs), earliestRev, latestRev)
+			fbm.log.CDebugf(ctx, "Found %d pointers to clean up to "+
+				"revision %d", len(ptrs), lastRevConsidered)
 		}
 	}()
 
-	if latestRev <= earliestRev {
+	if latestRev <= earliestRev && trashLatestRev <= trashEarliestRev {
 		// Nothing to do.
 		fbm.log.CDebugf(ctx, "Latest rev %d is included in the previous "+
 			"gc op (%d)", latestRev, earliestRev)
 		return nil, kbfsmd.RevisionUninitialized, true, nil
 	}
+	stopRev := earliestRev
+	if trashLatestRev > trashEarliestRev && trashEarliestRev < stopRev {
+		stopRev = trashEarliestRev
+	}
 
 	// Walk backward, starting from latestRev, until just after
-	// earliestRev, gathering block pointers.
+	// stopRev, gathering block pointers.
 	currHead := latestRev
 	revStartPositions := make(map[kbfsmd.Revision]int)
 outer:
@@ -875,11 +955,19 @@ outer:
 		numNew := len(rmds)
 		for i := len(rmds) - 1; i >= 0; i-- {
 			rmd := rmds[i]
-			if rmd.Revision() <= earliestRev {
+			if rmd.Revision() <= stopRev {
 				break outer
 			}
 			// Save the latest revision starting at this position:
 			revStartPositions[rmd.Revision()] = len(ptrs)
+			if isTrashRevision(rmd.ReadOnly()) {
+				if rmd.Revision() <= trashEarliestRev ||
+					rmd.Revision() > trashLatestRev {
+					continue
+				}
+			} else if rmd.Revision() <= earliestRev {
+				continue
+			}
 			for _, op := range rmd.data.Changes.Ops {
 				if _, ok := op.(*GCOp); ok {
 					continue
@@ -937,8 +1025,8 @@ outer:
 		if latestRev < origLatestRev {
 			ptrs = ptrs[revStartPositions[latestRev]:]
 			fbm.log.CDebugf(ctx, "Shortening GC range from [%d:%d] to [%d:%d],"+
-				" reducing pointers from %d to %d", earliestRev, origLatestRev,
-				earliestRev, latestRev, origPtrsLen, len(ptrs))
+				" reducing pointers from %d to %d", stopRev, origLatestRev,
+				stopRev, latestRev, origPtrsLen, len(ptrs))
 			complete = false
 		}
 	}
@@ -948,7 +1036,7 @@ outer:
 
 func (fbm *folderBlockManager) finalizeReclamation(ctx context.Context,
 	ptrs []BlockPointer, zeroRefCounts []kbfsblock.ID,
-	latestRev kbfsmd.Revision) error {
+	latestRev, trashGCStartRev kbfsmd.Revision) error {
 	gco := newGCOp(latestRev)
 	for _, id := range zeroRefCounts {
 		gco.AddUnrefBlock(BlockPointer{ID: id})
@@ -966,16 +1054,41 @@ func (fbm *folderBlockManager) finalizeReclamation(ctx context.Context,
 	// finalizeGCOp could wait indefinitely on locks, so run it in a
 	// goroutine.
 	return runUnlessCanceled(ctx,
-		func() error { return fbm.helper.finalizeGCOp(ctx, gco) })
+		func() error {
+			return fbm.helper.finalizeGCOp(ctx, gco, trashGCStartRev)
+		})
+}
+
+// isTrashReclaimable returns true if the earliest revision whose
+// removed entries are still in the trash, as of the given head, has
+// been there long enough to be reclaimed.
+func (fbm *folderBlockManager) isTrashReclaimable(
+	ctx context.Context, head ImmutableRootMetadata) bool {
+	startRev := head.data.TrashGCStartRevision
+	if startRev < kbfsmd.RevisionInitial {
+		return false
+	}
+	rmd, err := getSingleMD(
+		ctx, fbm.config, fbm.id, NullBranchID, startRev, Merged)
+	if err != nil {
+		fbm.log.CDebugf(ctx, "Couldn't get trash revision %d: %+v",
+			startRev, err)
+		return false
+	}
+	age := trashUnrefAge(fbm.config, head.data.TrashRetention)
+	return rmd.localTimestamp.Add(age).Before(fbm.config.Clock().Now())
 }
 
 func (fbm *folderBlockManager) isQRNecessary(
 	ctx context.Context, head ImmutableRootMetadata) bool {
-	fbm.lastQRLock.Lock()
-	defer fbm.lastQRLock.Unlock()
 	if head == (ImmutableRootMetadata{}) {
 		return false
 	}
+	// This might need to fetch an MD, so don't hold the lock for it.
+	trashReclaimable := fbm.isTrashReclaimable(ctx, head)
+
+	fbm.lastQRLock.Lock()
+	defer fbm.lastQRLock.Unlock()
 
 	session, err := fbm.config.KBPKI().GetCurrentSession(ctx)
 	if err != nil {
@@ -998,6 +1111,12 @@ func (fbm *folderBlockManager) isQRNecessary(
 		}
 	}
 
+	// Do QR if some removed entries have been in the trash for long
+	// enough, even if nothing else has changed.
+	if trashReclaimable {
+		return true
+	}
+
 	// If the head includes a single gcOp that covers everything up to
 	// the previous head, we can skip QR.
 	if len(head.data.Changes.Ops) == 1 {
@@ -1111,19 +1230,41 @@ func (fbm *folderBlockManager) doReclamation(timer *time.Timer) (err error) {
 	if err != nil {
 		return err
 	}
-	if mostRecentOldEnoughRev == kbfsmd.RevisionUninitialized ||
-		mostRecentOldEnoughRev <= lastGCRev {
-		// TODO: need a log level more fine-grained than Debug to
-		// print out that we're not doing reclamation.
-		complete = true
-		return nil
+	trashOldEnoughRev, lastTrashGCRev, err := fbm.getTrashRevisions(
+		ctx, head, mostRecentOldEnoughRev, lastGCRev)
+	if err != nil {
+		return err
 	}
 
 	// Don't try to do too many at a time.
 	shortened := false
-	if mostRecentOldEnoughRev-lastGCRev > numMaxRevisionsPerQR {
-		mostRecentOldEnoughRev = lastGCRev + numMaxRevisionsPerQR
-		shortened = true
+	latestRev := lastGCRev
+	if mostRecentOldEnoughRev > lastGCRev {
+		latestRev = mostRecentOldEnoughRev
+		if latestRev-lastGCRev > numMaxRevisionsPerQR {
+			latestRev = lastGCRev + numMaxRevisionsPerQR
+			shortened = true
+		}
+	}
+	// The removed entries can't be reclaimed past the new gc
+	// revision, since that's where the rest of the newer revisions
+	// will be reclaimed from next time.
+	trashLatestRev := lastTrashGCRev
+	if trashOldEnoughRev > lastTrashGCRev {
+		trashLatestRev = trashOldEnoughRev
+		if trashLatestRev-lastTrashGCRev > numMaxRevisionsPerQR {
+			trashLatestRev = lastTrashGCRev + numMaxRevisionsPerQR
+			shortened = true
+		}
+		if trashLatestRev > latestRev {
+			trashLatestRev = latestRev
+		}
+	}
+	if latestRev <= lastGCRev && trashLatestRev <= lastTrashGCRev {
+		// TODO: need a log level more fine-grained than Debug to
+		// print out that we're not doing reclamation.
+		complete = true
+		return nil
 	}
 
 	// Don't print these until we know for sure that we'll be
@@ -1134,17 +1275,36 @@ func (fbm *folderBlockManager) doReclamation(timer *time.Timer) (err error) {
 		reclamationTime = fbm.config.Clock().Now()
 	}()
 
-	ptrs, latestRev, complete, err :=
-		fbm.getUnreferencedBlocks(ctx, mostRecentOldEnoughRev, lastGCRev)
+	ptrs, lastRevConsidered, complete, err := fbm.getUnreferencedBlocks(
+		ctx, latestRev, lastGCRev, trashLatestRev, lastTrashGCRev)
 	if err != nil {
 		return err
 	}
+	if lastRevConsidered < latestRev {
+		latestRev = lastRevConsidered
+		if latestRev < lastGCRev {
+			latestRev = lastGCRev
+		}
+	}
+	if lastRevConsidered < trashLatestRev {
+		trashLatestRev = lastRevConsidered
+		if trashLatestRev < lastTrashGCRev {
+			trashLatestRev = lastTrashGCRev
+		}
+	}
+	// Remember where to start reclaiming the rest of the trash.
+	trashGCStartRev := kbfsmd.RevisionUninitialized
+	if trashLatestRev < latestRev {
+		trashGCStartRev = trashLatestRev + 1
+	}
+
 	if len(ptrs) == 0 && !shortened {
 		complete = true
 
 		// Add a new gcOp to show other clients that they don't need
 		// to explore this range again.
-		return fbm.finalizeReclamation(ctx, nil, nil, latestRev)
+		return fbm.finalizeReclamation(
+			ctx, nil, nil, latestRev, trashGCStartRev)
 	}
 
 	zeroRefCounts, err := fbm.deleteBlockRefs(ctx, head.TlfID(), ptrs)
@@ -1152,7 +1312,8 @@ func (fbm *folderBlockManager) doReclamation(timer *time.Timer) (err error) {
 		return err
 	}
 
-	return fbm.finalizeReclamation(ctx, ptrs, zeroRefCounts, latestRev)
+	return fbm.finalizeReclamation(
+		ctx, ptrs, zeroRefCounts, latestRev, trashGCStartRev)
 }
 
 func (fbm *folderBlockManager) reclaimQuotaInBackground() {
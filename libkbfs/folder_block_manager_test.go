@@ -800,3 +800,232 @@ func TestQuotaReclamationGCOpsForGCOps(t *testing.T) {
 		t.Fatalf("Last GCOp revision was unexpected: %d vs %d", g, e)
 	}
 }
+
+// Test that quota reclamation doesn't delete the blocks of a file
+// that are still referenced by a clone of that file.
+func TestQuotaReclamationCopiedFile(t *testing.T) {
+	var userName libkb.NormalizedUsername = "test_user"
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, userName)
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	clock := newTestClockNow()
+	config.SetClock(clock)
+
+	bsplit, err := NewBlockSplitterSimple(20, 8*1024, config.Codec())
+	if err != nil {
+		t.Fatalf("Couldn't make block splitter: %+v", err)
+	}
+	config.SetBlockSplitter(bsplit)
+
+	rootNode := GetRootNodeOrBust(
+		ctx, t, config, userName.String(), tlf.Private)
+	kbfsOps := config.KBFSOps()
+	data := make([]byte, 100)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	for _, name := range []string{"a", "b"} {
+		node, _, err := kbfsOps.CreateFile(ctx, rootNode, name, false, NoExcl)
+		if err != nil {
+			t.Fatalf("Couldn't create file: %+v", err)
+		}
+		err = kbfsOps.Write(ctx, node, data[:len(name)*50], 0)
+		if err != nil {
+			t.Fatalf("Couldn't write file: %+v", err)
+		}
+		_, _, err = kbfsOps.CopyFile(ctx, node, rootNode, name+"2")
+		if err != nil {
+			t.Fatalf("Couldn't copy file: %+v", err)
+		}
+		err = kbfsOps.RemoveEntry(ctx, rootNode, name)
+		if err != nil {
+			t.Fatalf("Couldn't remove file: %+v", err)
+		}
+	}
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync all: %v", err)
+	}
+
+	// Make a new revision after the unrefs are old enough to reclaim.
+	clock.Add(2 * config.QuotaReclamationMinUnrefAge())
+	_, _, err = kbfsOps.CreateDir(ctx, rootNode, "c")
+	if err != nil {
+		t.Fatalf("Couldn't create dir: %+v", err)
+	}
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync all: %v", err)
+	}
+
+	ops := kbfsOps.(*KBFSOpsStandard).getOpsByNode(ctx, rootNode)
+	ops.fbm.forceQuotaReclamation()
+	err = ops.fbm.waitForQuotaReclamations(ctx)
+	if err != nil {
+		t.Fatalf("Couldn't wait for QR: %+v", err)
+	}
+
+	// Read the copies back from the server.
+	config.ResetCaches()
+	for _, name := range []string{"a2", "b2"} {
+		node, ei, err := kbfsOps.Lookup(ctx, rootNode, name)
+		if err != nil {
+			t.Fatalf("Couldn't look up file: %+v", err)
+		}
+		data2 := make([]byte, ei.Size)
+		_, err = kbfsOps.Read(ctx, node, data2, 0)
+		if err != nil {
+			t.Fatalf("Couldn't read file: %+v", err)
+		}
+		if !bytes.Equal(data[:ei.Size], data2) {
+			t.Fatalf("Read bad data for %s: %v", name, data2)
+		}
+	}
+}
+
+func TestQuotaReclamationTrashRetention(t *testing.T) {
+	var userName libkb.NormalizedUsername = "test_user"
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, userName)
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	clock := newTestClockNow()
+	config.SetClock(clock)
+
+	rootNode := GetRootNodeOrBust(
+		ctx, t, config, userName.String(), tlf.Private)
+	kbfsOps := config.KBFSOps()
+	retention := 10 * config.QuotaReclamationMinUnrefAge()
+	err := kbfsOps.SetTrashRetention(
+		ctx, rootNode.GetFolderBranch(), retention)
+	if err != nil {
+		t.Fatalf("Couldn't set trash retention: %+v", err)
+	}
+	data := []byte{1, 2, 3, 4}
+	node, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %+v", err)
+	}
+	err = kbfsOps.Write(ctx, node, data, 0)
+	if err != nil {
+		t.Fatalf("Couldn't write file: %+v", err)
+	}
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync all: %v", err)
+	}
+
+	// Also overwrite another file, whose old block isn't in the
+	// trash.
+	otherNode, _, err := kbfsOps.CreateFile(
+		ctx, rootNode, "other", false, NoExcl)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %+v", err)
+	}
+	err = kbfsOps.Write(ctx, otherNode, []byte{5, 6, 7, 8}, 0)
+	if err != nil {
+		t.Fatalf("Couldn't write file: %+v", err)
+	}
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync all: %v", err)
+	}
+	md, err := kbfsOps.GetNodeMetadata(ctx, node)
+	if err != nil {
+		t.Fatalf("Couldn't get metadata: %+v", err)
+	}
+	removedID := md.BlockInfo.ID
+	md, err = kbfsOps.GetNodeMetadata(ctx, otherNode)
+	if err != nil {
+		t.Fatalf("Couldn't get metadata: %+v", err)
+	}
+	overwrittenID := md.BlockInfo.ID
+	err = kbfsOps.Write(ctx, otherNode, []byte{9, 10, 11, 12}, 0)
+	if err != nil {
+		t.Fatalf("Couldn't write file: %+v", err)
+	}
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync all: %v", err)
+	}
+
+	err = kbfsOps.RemoveEntry(ctx, rootNode, "a")
+	if err != nil {
+		t.Fatalf("Couldn't remove file: %+v", err)
+	}
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync all: %v", err)
+	}
+
+	ops := kbfsOps.(*KBFSOpsStandard).getOpsByNode(ctx, rootNode)
+	reclaimAfter := func(d time.Duration, name string) {
+		clock.Add(d)
+		_, _, err = kbfsOps.CreateDir(ctx, rootNode, name)
+		if err != nil {
+			t.Fatalf("Couldn't create dir: %+v", err)
+		}
+		err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+		if err != nil {
+			t.Fatalf("Couldn't sync all: %v", err)
+		}
+		ops.fbm.forceQuotaReclamation()
+		err = ops.fbm.waitForQuotaReclamations(ctx)
+		if err != nil {
+			t.Fatalf("Couldn't wait for QR: %+v", err)
+		}
+	}
+
+	bserverLocal, ok := config.BlockServer().(blockServerLocal)
+	if !ok {
+		t.Fatalf("Bad block server")
+	}
+	hasBlock := func(id kbfsblock.ID) bool {
+		blocks, err := bserverLocal.getAllRefsForTest(
+			ctx, rootNode.GetFolderBranch().Tlf)
+		if err != nil {
+			t.Fatalf("Couldn't get blocks: %+v", err)
+		}
+		_, ok := blocks[id]
+		return ok
+	}
+
+	// The removal is older than the unref age, but it's still in
+	// the trash, so its blocks must survive QR.  The overwritten
+	// block isn't in the trash, so it's reclaimed as usual.
+	reclaimAfter(2*config.QuotaReclamationMinUnrefAge(), "b")
+	if !hasBlock(removedID) {
+		t.Fatalf("Removed block %v was reclaimed", removedID)
+	}
+	if hasBlock(overwrittenID) {
+		t.Fatalf("Overwritten block %v wasn't reclaimed", overwrittenID)
+	}
+	entries, err := kbfsOps.GetDeletedEntries(ctx, rootNode.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't get deleted entries: %+v", err)
+	}
+	if len(entries) != 1 || entries[0].Path != "a" {
+		t.Fatalf("Unexpected deleted entries: %v", entries)
+	}
+	config.ResetCaches()
+	node, _, err = kbfsOps.RestoreDeletedEntry(ctx, entries[0], rootNode, "a")
+	if err != nil {
+		t.Fatalf("Couldn't restore file: %+v", err)
+	}
+	data2 := make([]byte, len(data))
+	_, err = kbfsOps.Read(ctx, node, data2, 0)
+	if err != nil {
+		t.Fatalf("Couldn't read file: %+v", err)
+	}
+	if !bytes.Equal(data, data2) {
+		t.Fatalf("Read bad data: %v", data2)
+	}
+
+	// Once the retention period is over, the removal disappears
+	// from the trash.
+	reclaimAfter(retention, "c")
+	entries, err = kbfsOps.GetDeletedEntries(ctx, rootNode.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't get deleted entries: %+v", err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("Unexpected deleted entries: %v", entries)
+	}
+}
@@ -7,6 +7,7 @@ package libkbfs
 import (
 	"fmt"
 	"path/filepath"
+	"sort"
 	"time"
 
 	"github.com/keybase/client/go/logger"
@@ -260,6 +261,10 @@ type folderBlockOps struct {
 	// call PathFromNode() only under blockLock (see nodeCache
 	// comments in folder_branch_ops.go).
 	nodeCache NodeCache
+
+	// readAhead tracks which files are being read sequentially.
+	// It is goroutine-safe.
+	readAhead *readAheadTracker
 }
 
 // Only exported methods of folderBlockOps should be used outside of this
@@ -533,15 +538,13 @@ func (fbo *folderBlockOps) GetCleanEncodedBlocksSizeSum(ctx context.Context,
 	return sum, nil
 }
 
-// getDirBlockHelperLocked retrieves the block pointed to by ptr, which
-// must be valid, either from the cache or from the server. An error
-// is returned if the retrieved block is not a dir block.
-//
-// This must be called only by GetDirBlockForReading() and
-// getDirLocked().
+// getRawDirBlockHelperLocked retrieves the block pointed to by ptr,
+// which must be valid, either from the cache or from the server,
+// without assembling it if it's an indirect dir block. An error is
+// returned if the retrieved block is not a dir block.
 //
 // p is used only when reporting errors, and can be empty.
-func (fbo *folderBlockOps) getDirBlockHelperLocked(ctx context.Context,
+func (fbo *folderBlockOps) getRawDirBlockHelperLocked(ctx context.Context,
 	lState *lockState, kmd KeyMetadata, ptr BlockPointer,
 	branch BranchName, p path, rtype blockReqType) (*DirBlock, error) {
 	if rtype != blockReadParallel {
@@ -564,6 +567,101 @@ func (fbo *folderBlockOps) getDirBlockHelperLocked(ctx context.Context,
 	return dblock, nil
 }
 
+// getDirectDirChildLocked retrieves the child block pointed to by
+// ptr from an indirect dir block.  An error is returned if the child
+// block is itself indirect, since we only support one level of
+// indirection for directories.
+func (fbo *folderBlockOps) getDirectDirChildLocked(ctx context.Context,
+	lState *lockState, kmd KeyMetadata, ptr BlockPointer,
+	branch BranchName, p path, rtype blockReqType) (*DirBlock, error) {
+	dblock, err := fbo.getRawDirBlockHelperLocked(
+		ctx, lState, kmd, ptr, branch, p, rtype)
+	if err != nil {
+		return nil, err
+	}
+	if dblock.IsInd {
+		return nil, errors.Errorf(
+			"Child dir block %v in %v is unexpectedly indirect", ptr, p)
+	}
+	return dblock, nil
+}
+
+// getDirBlockHelperLocked retrieves the block pointed to by ptr, which
+// must be valid, either from the cache or from the server. An error
+// is returned if the retrieved block is not a dir block.  If the
+// block is an indirect dir block, all of its children are fetched as
+// well, and a new direct block containing all the entries of the
+// directory is returned instead.
+//
+// This must be called only by GetDirBlockForReading() and
+// getDirLocked().
+//
+// p is used only when reporting errors, and can be empty.
+func (fbo *folderBlockOps) getDirBlockHelperLocked(ctx context.Context,
+	lState *lockState, kmd KeyMetadata, ptr BlockPointer,
+	branch BranchName, p path, rtype blockReqType) (*DirBlock, error) {
+	topBlock, err := fbo.getRawDirBlockHelperLocked(
+		ctx, lState, kmd, ptr, branch, p, rtype)
+	if err != nil {
+		return nil, err
+	}
+	if !topBlock.IsInd {
+		return topBlock, nil
+	}
+
+	// The children were most likely prefetched when the top block
+	// was fetched, so just get them one at a time.
+	dblock := NewDirBlock().(*DirBlock)
+	dblock.indirectChildren = make([]indirectDirChild, 0, len(topBlock.IPtrs))
+	for _, iptr := range topBlock.IPtrs {
+		childBlock, err := fbo.getDirectDirChildLocked(
+			ctx, lState, kmd, iptr.BlockPointer, branch, p, rtype)
+		if err != nil {
+			return nil, err
+		}
+		for name, de := range childBlock.Children {
+			dblock.Children[name] = de
+		}
+		dblock.indirectChildren = append(dblock.indirectChildren,
+			indirectDirChild{iptr, childBlock})
+	}
+	return dblock, nil
+}
+
+// getDirBlockForLookupLocked retrieves a dir block that would contain
+// the entry for the given name in the given directory.  If the
+// directory is made up of indirect blocks, only the child block
+// covering that name is fetched, and it is returned directly.
+func (fbo *folderBlockOps) getDirBlockForLookupLocked(ctx context.Context,
+	lState *lockState, kmd KeyMetadata, dir path, name string) (
+	*DirBlock, error) {
+	fbo.blockLock.AssertAnyLocked(lState)
+
+	if !dir.isValid() {
+		return nil, InvalidPathError{dir}
+	}
+
+	topBlock, err := fbo.getRawDirBlockHelperLocked(
+		ctx, lState, kmd, dir.tailPointer(), dir.Branch, dir, blockLookup)
+	if err != nil {
+		return nil, err
+	}
+	if !topBlock.IsInd {
+		return topBlock, nil
+	}
+
+	// Find the last child whose range starts at or before the name.
+	i := sort.Search(len(topBlock.IPtrs), func(i int) bool {
+		return topBlock.IPtrs[i].Off > name
+	}) - 1
+	if i < 0 {
+		return NewDirBlock().(*DirBlock), nil
+	}
+	return fbo.getDirectDirChildLocked(
+		ctx, lState, kmd, topBlock.IPtrs[i].BlockPointer, dir.Branch, dir,
+		blockLookup)
+}
+
 // GetFileBlockForReading retrieves the block pointed to by ptr, which
 // must be valid, either from the cache or from the server. An error
 // is returned if the retrieved block is not a file block.
@@ -757,8 +855,9 @@ func (fbo *folderBlockOps) UndupChildrenInCopy(ctx context.Context,
 	}
 	fd := fbo.newFileDataWithCache(
 		lState, file, chargedTo, kmd, dirtyBcache)
-	return fd.undupChildrenInCopy(ctx, fbo.config.BlockCache(),
-		fbo.config.BlockOps(), bps, topBlock)
+	return fd.undupChildrenInCopy(ctx,
+		noDedupBlockCache{fbo.config.BlockCache()}, fbo.config.BlockOps(),
+		bps, topBlock)
 }
 
 func (fbo *folderBlockOps) ReadyNonLeafBlocksInCopy(ctx context.Context,
@@ -778,6 +877,25 @@ func (fbo *folderBlockOps) ReadyNonLeafBlocksInCopy(ctx context.Context,
 		fbo.config.BlockOps(), bps, topBlock)
 }
 
+// GetIndirectDirBlockInfos returns a list of BlockInfos for all the
+// child blocks of the given directory, if the last synced version of
+// it is made up of indirect blocks.
+func (fbo *folderBlockOps) GetIndirectDirBlockInfos(ctx context.Context,
+	lState *lockState, kmd KeyMetadata, dir path) ([]BlockInfo, error) {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+	dblock, err := fbo.getDirLocked(ctx, lState, kmd, dir, blockRead)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]BlockInfo, 0, len(dblock.indirectChildren))
+	for _, child := range dblock.indirectChildren {
+		infos = append(infos, child.ptr.BlockInfo)
+	}
+	return infos, nil
+}
+
 // getDirLocked retrieves the block pointed to by the tail pointer of
 // the given path, which must be valid, either from the cache or from
 // the server. An error is returned if the retrieved block is not a
@@ -870,11 +988,14 @@ func (fbo *folderBlockOps) addDirEntryInCacheLocked(lState *lockState, dir path,
 			cacheEntry.adds = make(map[string]BlockPointer)
 		}
 		cacheEntry.adds[newName] = newDe.BlockPointer
+		// In case a symlink was added with this name before.
+		delete(cacheEntry.addedSyms, newName)
 	} else if newDe.Type == Sym {
 		if cacheEntry.addedSyms == nil {
 			cacheEntry.addedSyms = make(map[string]DirEntry)
 		}
 		cacheEntry.addedSyms[newName] = newDe
+		delete(cacheEntry.adds, newName)
 	} else {
 		panic("Unexpected uninitialized dir entry")
 	}
@@ -1073,6 +1194,73 @@ func (fbo *folderBlockOps) RenameDirEntryInCache(lState *lockState,
 	}), nil
 }
 
+// ExchangeDirEntriesInCache swaps the entries named `oldName` (in
+// `oldParent`) and `newName` (in `newParent`) in the cache, which
+// will get applied to the dirty blocks on subsequent fetches.  `oldDe`
+// and `newDe` are the entries currently at `oldName` and `newName`,
+// respectively, with their new ctimes.
+func (fbo *folderBlockOps) ExchangeDirEntriesInCache(lState *lockState,
+	oldParent path, oldName string, oldDe DirEntry, newParent path,
+	newName string, newDe DirEntry) (dirCacheUndoFn, error) {
+	fbo.blockLock.Lock(lState)
+	defer fbo.blockLock.Unlock(lState)
+	if newParent.tailPointer() == oldParent.tailPointer() &&
+		oldName == newName {
+		// Noop
+		return nil, nil
+	}
+
+	var undoFns []func()
+	undo := func() {
+		for i := len(undoFns) - 1; i >= 0; i-- {
+			if undoFns[i] != nil {
+				undoFns[i]()
+			}
+		}
+	}
+	undoFns = append(undoFns,
+		fbo.addDirEntryInCacheLocked(lState, newParent, newName, oldDe),
+		fbo.addDirEntryInCacheLocked(lState, oldParent, oldName, newDe))
+
+	for _, move := range []struct {
+		de     DirEntry
+		parent path
+		name   string
+	}{{oldDe, newParent, newName}, {newDe, oldParent, oldName}} {
+		if move.de.Type == Sym {
+			continue
+		}
+		parentNode := fbo.nodeCache.Get(move.parent.tailRef())
+		undoMove, err := fbo.nodeCache.Move(
+			move.de.Ref(), parentNode, move.name)
+		if err != nil {
+			undo()
+			return nil, err
+		}
+		undoFns = append(undoFns, undoMove)
+
+		// If there's already an entry for the target, only update
+		// the Ctime.
+		cacheEntry, ok := fbo.deCache[move.de.Ref()]
+		cacheEntryCopy := cacheEntry.deepCopy()
+		if ok && cacheEntry.dirEntry.IsInitialized() {
+			cacheEntry.dirEntry.Ctime = move.de.Ctime
+		} else {
+			cacheEntry.dirEntry = move.de
+		}
+		ref := move.de.Ref()
+		fbo.deCache[ref] = cacheEntry
+		undoFns = append(undoFns, func() {
+			if ok {
+				fbo.deCache[ref] = cacheEntryCopy
+			} else {
+				delete(fbo.deCache, ref)
+			}
+		})
+	}
+	return fbo.wrapWithBlockLock(undo), nil
+}
+
 func (fbo *folderBlockOps) setCachedAttrLocked(
 	lState *lockState, ref BlockRef, attr attrChange, realEntry *DirEntry,
 	doCreate bool) {
@@ -1090,6 +1278,8 @@ func (fbo *folderBlockOps) setCachedAttrLocked(
 		fileEntry.dirEntry.Type = realEntry.Type
 	case mtimeAttr:
 		fileEntry.dirEntry.Mtime = realEntry.Mtime
+	case xattrAttr:
+		fileEntry.dirEntry.Xattrs = realEntry.Xattrs
 	}
 	fileEntry.dirEntry.Ctime = realEntry.Ctime
 	fbo.deCache[ref] = fileEntry
@@ -1374,6 +1564,21 @@ func (fbo *folderBlockOps) getDirtyParentAndEntryLocked(ctx context.Context,
 		return nil, DirEntry{}, err
 	}
 
+	de, err := fbo.getDirtyEntryFromBlockLocked(
+		ctx, lState, file, dblock, includeDeleted)
+	if err != nil {
+		return nil, DirEntry{}, err
+	}
+	return dblock, de, nil
+}
+
+// getDirtyEntryFromBlockLocked looks up the entry for the given file
+// in the given (possibly dirty) parent block.
+func (fbo *folderBlockOps) getDirtyEntryFromBlockLocked(ctx context.Context,
+	lState *lockState, file path, dblock *DirBlock, includeDeleted bool) (
+	DirEntry, error) {
+	fbo.blockLock.AssertAnyLocked(lState)
+
 	// make sure it exists
 	name := file.tailName()
 	de, ok := dblock.Children[name]
@@ -1383,20 +1588,20 @@ func (fbo *folderBlockOps) getDirtyParentAndEntryLocked(ctx context.Context,
 			// Has the file been removed?
 			node := fbo.nodeCache.Get(file.tailRef())
 			if node == nil {
-				return nil, DirEntry{}, NoSuchNameError{name}
+				return DirEntry{}, NoSuchNameError{name}
 			}
 			if !fbo.nodeCache.IsUnlinked(node) {
-				return nil, DirEntry{}, NoSuchNameError{name}
+				return DirEntry{}, NoSuchNameError{name}
 			}
 			de = fbo.nodeCache.UnlinkedDirEntry(node)
 			// It's possible the unlinked file has been updated.
 			_, de = fbo.updateDirtyEntryFromCacheLocked(ctx, lState, de)
 		} else {
-			return nil, DirEntry{}, NoSuchNameError{name}
+			return DirEntry{}, NoSuchNameError{name}
 		}
 	}
 
-	return dblock, de, err
+	return de, nil
 }
 
 // GetDirtyParentAndEntry returns the parent DirBlock (which shouldn't
@@ -1418,11 +1623,28 @@ func (fbo *folderBlockOps) GetDirtyParentAndEntry(
 func (fbo *folderBlockOps) getDirtyEntryLocked(ctx context.Context,
 	lState *lockState, kmd KeyMetadata, file path, includeDeleted bool) (
 	DirEntry, error) {
-	// TODO: Since we only need a single DirEntry, avoid having to
-	// look up every entry in the DirBlock.
-	_, de, err := fbo.getDirtyParentAndEntryLocked(
-		ctx, lState, kmd, file, blockLookup, includeDeleted)
-	return de, err
+	fbo.blockLock.AssertAnyLocked(lState)
+
+	if !file.hasValidParent() {
+		return DirEntry{}, InvalidParentPathError{file}
+	}
+
+	// Since we only need a single DirEntry, avoid having to look up
+	// every entry in the directory if it's made up of indirect
+	// blocks.
+	parentPath := file.parentPath()
+	dblock, err := fbo.getDirBlockForLookupLocked(
+		ctx, lState, kmd, *parentPath, file.tailName())
+	if err != nil {
+		return DirEntry{}, err
+	}
+	dblock, err = fbo.updateWithDirtyEntriesLocked(
+		ctx, lState, *parentPath, dblock)
+	if err != nil {
+		return DirEntry{}, err
+	}
+	return fbo.getDirtyEntryFromBlockLocked(
+		ctx, lState, file, dblock, includeDeleted)
 }
 
 // GetDirtyEntry returns the possibly-dirty DirEntry of the given file
@@ -1793,9 +2015,141 @@ func (fbo *folderBlockOps) Read(
 
 	var id keybase1.UserOrTeamID // Data reads don't depend on the id.
 	fd := fbo.newFileData(lState, filePath, id, kmd)
+	n, err := fd.read(ctx, dest, off)
+	if err != nil {
+		return 0, err
+	}
+	if fbo.readAhead != nil {
+		start, end := fbo.readAhead.update(
+			file.GetID(), ctx.Value(CtxReadHandleKey), off, n)
+		if start < end {
+			fbo.readAheadLocked(ctx, lState, fd, start, end)
+		}
+	}
+	return n, nil
+}
+
+// collectReadAheadPtrs appends to `ptrs` the pointers of the
+// children of `pblock` that cover the offset range `[start, end)`,
+// walking down through any indirect children that are already
+// cached.  An uncached indirect child is returned itself instead,
+// since the prefetcher fetches all of its children once it's
+// retrieved.  Leaf blocks that start before the range were either
+// just read, or requested by an earlier read-ahead, so they're
+// skipped.
+func (fbo *folderBlockOps) collectReadAheadPtrs(
+	pblock *FileBlock, start, end int64, ptrs []BlockPointer) []BlockPointer {
+	for i, iptr := range pblock.IPtrs {
+		if i < len(pblock.IPtrs)-1 && start >= pblock.IPtrs[i+1].Off {
+			continue
+		}
+		if end <= iptr.Off {
+			break
+		}
+		if iptr.DirectType == IndirectBlock {
+			block, err := fbo.config.BlockCache().Get(iptr.BlockPointer)
+			if child, ok := block.(*FileBlock); ok && err == nil {
+				ptrs = fbo.collectReadAheadPtrs(child, start, end, ptrs)
+				continue
+			}
+		} else if iptr.Off < start {
+			continue
+		}
+		ptrs = append(ptrs, iptr.BlockPointer)
+	}
+	return ptrs
+}
+
+// readAheadLocked asks the prefetcher to fetch the blocks of the
+// file covering the offset range `[start, end)`, at a priority just
+// below on-demand requests.  It never waits for a block itself: it
+// only looks at the indirect blocks that are already cached, and
+// leaves any others to the prefetcher, so that reads holding
+// `blockLock` aren't held up.  Errors are only logged, since
+// read-ahead is best-effort.
+func (fbo *folderBlockOps) readAheadLocked(ctx context.Context,
+	lState *lockState, fd *fileData, start, end int64) {
+	fbo.blockLock.AssertAnyLocked(lState)
+
+	// Dirty files may have blocks that don't exist on the server
+	// yet, and any clean blocks will be in the cache anyway.
+	if _, ok := fbo.dirtyFiles[fd.rootBlockPointer()]; ok {
+		return
+	}
+
+	// The read that triggered this just fetched the top block.
+	block, err := fbo.config.BlockCache().Get(fd.rootBlockPointer())
+	if err != nil {
+		return
+	}
+	topBlock, ok := block.(*FileBlock)
+	if !ok || !topBlock.IsInd {
+		// The whole file is already in hand.
+		return
+	}
+
+	ptrs := fbo.collectReadAheadPtrs(topBlock, start, end, nil)
+	prefetcher := fbo.config.BlockOps().Prefetcher()
+	for i, ptr := range ptrs {
+		// Keep the blocks in file order within the queue.
+		err := prefetcher.PrefetchBlock(
+			&FileBlock{}, ptr, fd.kmd, readAheadPrefetchPriority-i)
+		if err != nil {
+			fbo.log.CDebugf(ctx, "Couldn't read ahead block %v: %+v",
+				ptr, err)
+			return
+		}
+	}
+	fbo.log.CDebugf(ctx, "Read ahead %d blocks in [%d, %d)",
+		len(ptrs), start, end)
+}
+
+// ReadPath reads from the given file into the given buffer at the
+// given offset, like Read.  It's meant for synced versions of files
+// that may no longer have a Node, like old versions of files, so it
+// doesn't reflect any dirty data.
+func (fbo *folderBlockOps) ReadPath(
+	ctx context.Context, lState *lockState, kmd KeyMetadata, file path,
+	dest []byte, off int64) (int64, error) {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+
+	fbo.log.CDebugf(ctx, "Reading from path %v", file.tailPointer())
+
+	var id keybase1.UserOrTeamID // Data reads don't depend on the id.
+	fd := fbo.newFileData(lState, file, id, kmd)
 	return fd.read(ctx, dest, off)
 }
 
+// GetSyncedFileSize returns the size of the synced version of the
+// given file, as stored in its blocks.
+func (fbo *folderBlockOps) GetSyncedFileSize(
+	ctx context.Context, lState *lockState, kmd KeyMetadata, file path) (
+	uint64, error) {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+
+	var id keybase1.UserOrTeamID // Data reads don't depend on the id.
+	fd := fbo.newFileData(lState, file, id, kmd)
+	return fd.getSize(ctx)
+}
+
+// GetFileDataExtents returns the ranges of the given file that
+// contain data, including any unsynced writes, starting with the one
+// that contains or follows `off`.
+func (fbo *folderBlockOps) GetFileDataExtents(
+	ctx context.Context, lState *lockState, kmd KeyMetadata, file Node,
+	off int64, maxExtents int) ([]FileExtent, error) {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+
+	filePath := fbo.nodeCache.PathFromNode(file)
+
+	var id keybase1.UserOrTeamID // Data reads don't depend on the id.
+	fd := fbo.newFileData(lState, filePath, id, kmd)
+	return fd.getDataExtents(ctx, off, maxExtents)
+}
+
 func (fbo *folderBlockOps) maybeWaitOnDeferredWrites(
 	ctx context.Context, lState *lockState, file Node,
 	c DirtyPermChan) error {
@@ -2297,6 +2651,150 @@ func (fbo *folderBlockOps) Truncate(
 	return nil
 }
 
+// Returns the set of blocks dirtied while punching this hole that
+// might need to be cleaned up if it's deferred.
+func (fbo *folderBlockOps) punchHoleLocked(
+	ctx context.Context, lState *lockState, kmd KeyMetadata,
+	file path, off, length int64) (*WriteRange, []BlockPointer, int64, error) {
+	if jServer, err := GetJournalServer(fbo.config); err == nil {
+		jServer.dirtyOpStart(fbo.id())
+		defer jServer.dirtyOpEnd(fbo.id())
+	}
+
+	fblock, err := fbo.writeGetFileLocked(ctx, lState, kmd, file)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	chargedTo, err := chargedToForTLF(
+		ctx, fbo.config.KBPKI(), fbo.config.KBPKI(), kmd.GetTlfHandle())
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	fd := fbo.newFileData(lState, file, chargedTo, kmd)
+
+	de, err := fbo.getDirtyEntryLocked(ctx, lState, kmd, file, true)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	// Punching a hole never changes the size of the file.
+	endOff := off + length
+	if endOff > int64(de.Size) {
+		endOff = int64(de.Size)
+	}
+	if off >= endOff {
+		return nil, nil, 0, nil
+	}
+
+	si, err := fbo.getOrCreateSyncInfoLocked(lState, de)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	dirtyPtrs, unrefs, newlyDirtiedChildBytes, err := fd.punchHole(
+		ctx, off, endOff, fblock)
+	// Record the unrefs and dirtied bytes before checking the error
+	// so we remember the state of newly dirtied blocks.
+	si.unrefs = append(si.unrefs, unrefs...)
+	df := fbo.getOrCreateDirtyFileLocked(lState, file)
+	df.updateNotYetSyncingBytes(newlyDirtiedChildBytes)
+	if err != nil {
+		return nil, nil, newlyDirtiedChildBytes, err
+	}
+
+	cacheEntry := fbo.deCache[file.tailRef()]
+	newDe := de
+	newDe.EncodedSize = 0
+	now := fbo.nowUnixNano()
+	newDe.Mtime = now
+	newDe.Ctime = now
+	cacheEntry.dirEntry = newDe
+	fbo.deCache[file.tailRef()] = cacheEntry
+
+	latestWrite := si.op.addWrite(uint64(off), uint64(endOff-off))
+	return &latestWrite, dirtyPtrs, newlyDirtiedChildBytes, nil
+}
+
+// PunchHole replaces `length` bytes of the given file, starting at
+// `off`, with a hole that reads as zeroes, without changing the size
+// of the file.  Any blocks entirely within the hole get unreferenced.
+// May block if there is too much unflushed data; in that case, it
+// will be unblocked by a future sync.
+func (fbo *folderBlockOps) PunchHole(
+	ctx context.Context, lState *lockState, kmd KeyMetadata,
+	file Node, off, length int64) error {
+	// At most the leaf blocks at either end of the hole are left
+	// with any dirty data, so there's no need to ask for room for
+	// the whole range.
+	estimatedDirtyBytes := length
+	if estimatedDirtyBytes > 2*MaxBlockSizeBytesDefault {
+		estimatedDirtyBytes = 2 * MaxBlockSizeBytesDefault
+	}
+	c, err := fbo.config.DirtyBlockCache().RequestPermissionToDirty(ctx,
+		fbo.id(), estimatedDirtyBytes)
+	if err != nil {
+		return err
+	}
+	defer fbo.config.DirtyBlockCache().UpdateUnsyncedBytes(fbo.id(),
+		-estimatedDirtyBytes, false)
+	err = fbo.maybeWaitOnDeferredWrites(ctx, lState, file, c)
+	if err != nil {
+		return err
+	}
+
+	fbo.blockLock.Lock(lState)
+	defer fbo.blockLock.Unlock(lState)
+
+	filePath, err := fbo.pathFromNodeForBlockWriteLocked(lState, file)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		fbo.doDeferWrite = false
+	}()
+
+	latestWrite, dirtyPtrs, newlyDirtiedChildBytes, err := fbo.punchHoleLocked(
+		ctx, lState, kmd, filePath, off, length)
+	if err != nil {
+		return err
+	}
+
+	if latestWrite != nil {
+		fbo.observers.localChange(ctx, file, *latestWrite)
+	}
+
+	if fbo.doDeferWrite {
+		// There's an ongoing sync, and this altered dirty blocks
+		// that are in the process of syncing.  So, we have to punch
+		// the hole again once the sync is complete, using the new
+		// file path.
+		fbo.log.CDebugf(ctx, "Deferring a hole punch to file %v "+
+			"off=%d len=%d", filePath.tailPointer(), off, length)
+		ds := fbo.deferred[filePath.tailRef()]
+		ds.dirtyDeletes = append(ds.dirtyDeletes, dirtyPtrs...)
+		ds.writes = append(ds.writes,
+			func(ctx context.Context, lState *lockState, kmd KeyMetadata, f path) error {
+				// We are about to re-dirty these bytes, so mark that
+				// they will no longer be synced via the old file.
+				df := fbo.getOrCreateDirtyFileLocked(lState, filePath)
+				df.updateNotYetSyncingBytes(-newlyDirtiedChildBytes)
+
+				// Punch the hole again.  We know this won't be
+				// deferred, so no need to check the new ptrs.
+				_, _, _, err := fbo.punchHoleLocked(
+					ctx, lState, kmd, f, off, length)
+				return err
+			})
+		ds.waitBytes += newlyDirtiedChildBytes
+		fbo.deferred[filePath.tailRef()] = ds
+	}
+
+	return nil
+}
+
 // IsDirty returns whether the given file is dirty; if false is
 // returned, then the file doesn't need to be synced.
 func (fbo *folderBlockOps) IsDirty(lState *lockState, file path) bool {
@@ -2408,11 +2906,7 @@ func ReadyBlock(ctx context.Context, bcache BlockCache, bops BlockOps,
 		if err != nil {
 			return
 		}
-	} else if dBlock, ok := block.(*DirBlock); ok {
-		if dBlock.IsInd {
-			panic("Indirect directory blocks aren't supported yet")
-		}
-		// TODO: support indirect directory blocks.
+	} else if dBlock, ok := block.(*DirBlock); ok && !dBlock.IsInd {
 		directType = DirectBlock
 	}
 
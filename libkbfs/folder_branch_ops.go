@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"os"
 	"reflect"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -92,6 +93,12 @@ const (
 	// If there are more than this many new revisions, fast forward
 	// rather than downloading them all.
 	fastForwardRevThresh = 50
+	// Maximum length of an extended attribute name, matching the
+	// limit on most local file systems.
+	maxXattrNameBytes = 255
+	// Maximum size of a single extended attribute value, since every
+	// value is stored inline in the parent directory block.
+	maxXattrValueBytes = 64 << 10
 )
 
 type fboMutexLevel mutexLevel
@@ -250,7 +257,8 @@ type folderBranchOps struct {
 	dirOps       []cachedDirOp
 
 	// protects access to head, headStatus, latestMergedRevision,
-	// and hasBeenCleared.
+	// hasBeenCleared, parkedBID, savedParkedBID, resolvingParked and
+	// acceptingLocal.
 	headLock   leveledRWMutex
 	head       ImmutableRootMetadata
 	headStatus headTrustStatus
@@ -258,6 +266,16 @@ type folderBranchOps struct {
 	latestMergedRevision kbfsmd.Revision
 	// Has this folder ever been cleared?
 	hasBeenCleared bool
+	// The unmerged branch that was set aside for manual conflict
+	// resolution, if any, and whether it's currently being resolved
+	// at the user's request (and if so, whether the local changes
+	// win every conflict).  savedParkedBID is the branch saved under
+	// the storage root, which stays set until the resolution is
+	// done, so that it isn't resolved automatically after a restart.
+	parkedBID       BranchID
+	savedParkedBID  BranchID
+	resolvingParked bool
+	acceptingLocal  bool
 
 	blocks  folderBlockOps
 	prepper folderUpdatePrepper
@@ -327,10 +345,25 @@ type folderBranchOps struct {
 	// Helper class for archiving and cleaning up the blocks for this TLF
 	fbm *folderBlockManager
 
+	// Path lock leases held by this device in this TLF
+	pathLocks *pathLockHolder
+
 	rekeyFSM RekeyFSM
 
 	editHistory *TlfEditHistory
 
+	// Recursive disk usage of the directories of this TLF
+	diskUsage *folderDiskUsage
+
+	// The most recent decisions made by conflict resolution
+	conflictLog *folderConflictLog
+
+	// Paths of this TLF that are kept available offline
+	pinner *folderPinner
+
+	// The revisions read by the last GetDeletedEntries call
+	deletedEntries deletedEntriesCache
+
 	branchChanges      kbfssync.RepeatedWaitGroup
 	mdFlushes          kbfssync.RepeatedWaitGroup
 	forcedFastForwards kbfssync.RepeatedWaitGroup
@@ -404,6 +437,7 @@ func newFolderBranchOps(ctx context.Context, config Config, fb FolderBranch,
 			unrefCache: make(map[BlockRef]*syncInfo),
 			deCache:    make(map[BlockRef]deCacheEntry),
 			nodeCache:  nodeCache,
+			readAhead:  newReadAheadTracker(readAheadMaxTrackedFiles),
 		},
 		nodeCache:       nodeCache,
 		log:             traceLogger{log},
@@ -421,9 +455,15 @@ func newFolderBranchOps(ctx context.Context, config Config, fb FolderBranch,
 	}
 	fbo.cr = NewConflictResolver(config, fbo)
 	fbo.fbm = newFolderBlockManager(config, fb, fbo)
+	fbo.pathLocks = newPathLockHolder(config, fb.Tlf, log)
 	fbo.editHistory = NewTlfEditHistory(config, fbo, log)
+	fbo.diskUsage = newFolderDiskUsage(
+		config, fb, log, fbo.getPathChangesForMD)
+	fbo.conflictLog = newFolderConflictLog(config, fb, log)
+	fbo.pinner = newFolderPinner(config, fb, log)
 	fbo.rekeyFSM = NewRekeyFSM(fbo)
-	if config.DoBackgroundFlushes() {
+	fbo.loadParkedBranchID(ctx)
+	if config.DoBackgroundFlushes() && !fbo.isReadOnly() {
 		go fbo.backgroundFlusher()
 	}
 
@@ -451,6 +491,8 @@ func (fbo *folderBranchOps) Shutdown(ctx context.Context) error {
 			fbo.log.CDebugf(ctx, "Skipping state-checking due to dirty state")
 		} else if !fbo.isMasterBranch(lState) {
 			fbo.log.CDebugf(ctx, "Skipping state-checking due to being staged")
+		} else if fbo.isReadOnly() {
+			fbo.log.CDebugf(ctx, "Skipping state-checking of a read-only view")
 		} else {
 			// Make sure we're up to date first
 			if err := fbo.SyncFromServerForTesting(ctx, fbo.folderBranch); err != nil {
@@ -465,11 +507,14 @@ func (fbo *folderBranchOps) Shutdown(ctx context.Context) error {
 		}
 	}
 
+	fbo.pathLocks.shutdown(ctx)
 	close(fbo.shutdownChan)
 	fbo.merkleFetches.Wait(ctx)
 	fbo.cr.Shutdown()
 	fbo.fbm.shutdown()
 	fbo.editHistory.Shutdown()
+	fbo.diskUsage.shutdown()
+	fbo.pinner.shutdown()
 	fbo.rekeyFSM.Shutdown()
 	// Wait for the update goroutine to finish, so that we don't have
 	// any races with logging during test reporting.
@@ -487,6 +532,37 @@ func (fbo *folderBranchOps) branch() BranchName {
 	return fbo.folderBranch.Branch
 }
 
+// isReadOnly returns true if this folder-branch doesn't accept any
+// writes, e.g. because it's an archived view of a past revision.
+func (fbo *folderBranchOps) isReadOnly() bool {
+	return fbo.bType == archive || fbo.bType == archiveOffline
+}
+
+// archivedRevision returns the branch ID, revision and merge status
+// of the MD to which this archived folder-branch is pinned.
+func (fbo *folderBranchOps) archivedRevision() (
+	BranchID, kbfsmd.Revision, MergeStatus, error) {
+	if rev, ok := fbo.branch().RevisionIfSpecified(); ok {
+		return NullBranchID, rev, Merged, nil
+	}
+	if bid, rev, ok := fbo.branch().UnmergedRevisionIfSpecified(); ok {
+		return bid, rev, Unmerged, nil
+	}
+	return NullBranchID, kbfsmd.RevisionUninitialized, Merged,
+		errors.Errorf("Branch %s is not pinned to a revision", fbo.branch())
+}
+
+// getArchivedMD fetches the MD for the revision to which this
+// archived folder-branch is pinned.
+func (fbo *folderBranchOps) getArchivedMD(ctx context.Context) (
+	ImmutableRootMetadata, error) {
+	bid, rev, mStatus, err := fbo.archivedRevision()
+	if err != nil {
+		return ImmutableRootMetadata{}, err
+	}
+	return getSingleMD(ctx, fbo.config, fbo.id(), bid, rev, mStatus)
+}
+
 func (fbo *folderBranchOps) GetFavorites(ctx context.Context) (
 	[]Favorite, error) {
 	return nil, errors.New("GetFavorites is not supported by folderBranchOps")
@@ -621,6 +697,120 @@ func (fbo *folderBranchOps) isMasterBranchLocked(lState *lockState) bool {
 	return fbo.bid == NullBranchID
 }
 
+func (fbo *folderBranchOps) getParkedBranchID(lState *lockState) BranchID {
+	fbo.headLock.RLock(lState)
+	defer fbo.headLock.RUnlock(lState)
+	return fbo.parkedBID
+}
+
+// loadParkedBranchID reads the ID of the branch that was set aside
+// for manual conflict resolution before the last restart, if any.
+func (fbo *folderBranchOps) loadParkedBranchID(ctx context.Context) {
+	storageRoot := fbo.config.StorageRoot()
+	if storageRoot == "" || fbo.branch() != MasterBranch ||
+		fbo.isReadOnly() {
+		return
+	}
+	bid, err := readParkedBranchID(
+		fbo.config.Codec(), storageRoot, fbo.id())
+	if err != nil {
+		fbo.log.CWarningf(ctx, "Couldn't read the parked branch ID: %+v",
+			err)
+		return
+	}
+	if bid == NullBranchID {
+		return
+	}
+	fbo.log.CDebugf(ctx, "Branch %s is still set aside for manual "+
+		"resolution", bid)
+	lState := makeFBOLockState()
+	fbo.headLock.Lock(lState)
+	defer fbo.headLock.Unlock(lState)
+	fbo.parkedBID = bid
+	fbo.savedParkedBID = bid
+}
+
+// saveParkedBranchIDLocked saves the given ID as the branch set
+// aside for manual conflict resolution, under the storage root.
+// `fbo.headLock` must be held for writing.
+func (fbo *folderBranchOps) saveParkedBranchIDLocked(
+	lState *lockState, bid BranchID) error {
+	fbo.headLock.AssertLocked(lState)
+	if fbo.savedParkedBID == bid {
+		return nil
+	}
+	if storageRoot := fbo.config.StorageRoot(); storageRoot != "" {
+		err := writeParkedBranchID(
+			fbo.config.Codec(), storageRoot, fbo.id(), bid)
+		if err != nil {
+			return err
+		}
+	}
+	fbo.savedParkedBID = bid
+	return nil
+}
+
+func (fbo *folderBranchOps) setParkedBranchIDLocked(
+	lState *lockState, bid BranchID) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+	fbo.headLock.Lock(lState)
+	defer fbo.headLock.Unlock(lState)
+	err := fbo.saveParkedBranchIDLocked(lState, bid)
+	if err != nil {
+		return err
+	}
+	fbo.parkedBID = bid
+	fbo.status.signalChange()
+	return nil
+}
+
+// shouldParkBranch returns true if conflict resolution should set
+// the current unmerged branch aside, instead of resolving it.
+func (fbo *folderBranchOps) shouldParkBranch(lState *lockState) bool {
+	manual := fbo.config.IsManualConflictResolution(fbo.id())
+	fbo.mdWriterLock.Lock(lState)
+	defer fbo.mdWriterLock.Unlock(lState)
+	fbo.headLock.RLock(lState)
+	defer fbo.headLock.RUnlock(lState)
+	if fbo.resolvingParked {
+		return false
+	}
+	// A branch saved before a restart stays parked, even if manual
+	// resolution has been turned off since.
+	return manual ||
+		(fbo.savedParkedBID != NullBranchID && fbo.savedParkedBID == fbo.bid)
+}
+
+func (fbo *folderBranchOps) isAcceptingLocal(lState *lockState) bool {
+	fbo.headLock.RLock(lState)
+	defer fbo.headLock.RUnlock(lState)
+	return fbo.resolvingParked && fbo.acceptingLocal
+}
+
+// finishResolvingParked marks the end of a resolution of the parked
+// branch, which forgets the saved branch ID if it succeeded.
+func (fbo *folderBranchOps) finishResolvingParked(
+	lState *lockState, succeeded bool) error {
+	fbo.headLock.Lock(lState)
+	defer fbo.headLock.Unlock(lState)
+	fbo.resolvingParked = false
+	fbo.acceptingLocal = false
+	if !succeeded {
+		return nil
+	}
+	return fbo.saveParkedBranchIDLocked(lState, NullBranchID)
+}
+
+// checkNotParked returns an error if writes to this folder-branch
+// are blocked, because its unmerged changes are waiting for manual
+// conflict resolution.
+func (fbo *folderBranchOps) checkNotParked(lState *lockState) error {
+	if bid := fbo.getParkedBranchID(lState); bid != NullBranchID {
+		return UnmergedChangesPendingError{fbo.id(), bid}
+	}
+	return nil
+}
+
 func (fbo *folderBranchOps) setBranchIDLocked(lState *lockState, bid BranchID) {
 	fbo.mdWriterLock.AssertLocked(lState)
 
@@ -726,8 +916,9 @@ func (fbo *folderBranchOps) setHeadLocked(
 
 	// If this is the first time the MD is being set, and we are
 	// operating on unmerged data, initialize the state properly and
-	// kick off conflict resolution.
-	if isFirstHead && md.MergedStatus() == Unmerged {
+	// kick off conflict resolution.  (Read-only views of unmerged
+	// branches are never resolved.)
+	if isFirstHead && md.MergedStatus() == Unmerged && !fbo.isReadOnly() {
 		fbo.setBranchIDLocked(lState, md.BID())
 		// Use uninitialized for the merged branch; the unmerged
 		// revision is enough to trigger conflict resolution.
@@ -796,6 +987,8 @@ func (fbo *folderBranchOps) setHeadLocked(
 		fbo.headStatus = headTrusted
 	}
 	fbo.status.setRootMetadata(md)
+	fbo.diskUsage.headChanged(md)
+	fbo.pinner.headChanged(md)
 	if isFirstHead {
 		// Start registering for updates right away, using this MD
 		// as a starting point. For now only the master branch can
@@ -1059,6 +1252,25 @@ func (fbo *folderBranchOps) getMDForWriteOrRekeyLocked(
 	// TODO: Make tests not take this code path.
 	fbo.mdWriterLock.AssertLocked(lState)
 
+	if fbo.isReadOnly() {
+		// Archived branches never move past the revision they are
+		// pinned to, so just re-fetch that one.
+		md, err = fbo.getArchivedMD(ctx)
+		if err != nil {
+			return ImmutableRootMetadata{}, err
+		}
+		fbo.headLock.Lock(lState)
+		defer fbo.headLock.Unlock(lState)
+		if fbo.head != (ImmutableRootMetadata{}) {
+			return fbo.head, nil
+		}
+		err = fbo.setHeadLocked(ctx, lState, md, headTrusted)
+		if err != nil {
+			return ImmutableRootMetadata{}, err
+		}
+		return md, nil
+	}
+
 	// Not in cache, fetch from server and add to cache.  First, see
 	// if this device has any unmerged commits -- take the latest one.
 	mdops := fbo.config.MDOps()
@@ -1223,6 +1435,13 @@ func (fbo *folderBranchOps) getMDForWriteLockedForFilename(
 	ImmutableRootMetadata, error) {
 	fbo.mdWriterLock.AssertLocked(lState)
 
+	if fbo.isReadOnly() {
+		return ImmutableRootMetadata{}, WriteToReadonlyNodeError{filename}
+	}
+	if err := fbo.checkNotParked(lState); err != nil {
+		return ImmutableRootMetadata{}, err
+	}
+
 	md, err := fbo.getMDForWriteOrRekeyLocked(ctx, lState, mdWrite)
 	if err != nil {
 		return ImmutableRootMetadata{}, err
@@ -1559,6 +1778,24 @@ func (fbo *folderBranchOps) GetRootNode(
 	return nil, EntryInfo{}, errors.New("GetRootNode is not supported by folderBranchOps")
 }
 
+func (fbo *folderBranchOps) GetArchivedRootNode(
+	ctx context.Context, h *TlfHandle, rev kbfsmd.Revision) (
+	node Node, ei EntryInfo, err error) {
+	return nil, EntryInfo{}, errors.New("GetArchivedRootNode is not supported by folderBranchOps")
+}
+
+func (fbo *folderBranchOps) GetUnmergedRootNode(
+	ctx context.Context, h *TlfHandle) (
+	node Node, ei EntryInfo, err error) {
+	return nil, EntryInfo{}, errors.New("GetUnmergedRootNode is not supported by folderBranchOps")
+}
+
+func (fbo *folderBranchOps) GetRevisionForTime(
+	ctx context.Context, h *TlfHandle, t time.Time) (
+	kbfsmd.Revision, error) {
+	return kbfsmd.RevisionUninitialized, errors.New("GetRevisionForTime is not supported by folderBranchOps")
+}
+
 func (fbo *folderBranchOps) checkNode(node Node) error {
 	fb := node.GetFolderBranch()
 	if fb != fbo.folderBranch {
@@ -1567,6 +1804,19 @@ func (fbo *folderBranchOps) checkNode(node Node) error {
 	return nil
 }
 
+// checkNodeForWrite is like checkNode, but it also returns an error
+// if this folder-branch is read-only.
+func (fbo *folderBranchOps) checkNodeForWrite(node Node) error {
+	err := fbo.checkNode(node)
+	if err != nil {
+		return err
+	}
+	if fbo.isReadOnly() {
+		return WriteToReadonlyNodeError{node.GetBasename()}
+	}
+	return fbo.checkNotParked(makeFBOLockState())
+}
+
 // SetInitialHeadFromServer sets the head to the given
 // ImmutableRootMetadata, which must be retrieved from the MD server.
 func (fbo *folderBranchOps) SetInitialHeadFromServer(
@@ -1604,6 +1854,21 @@ func (fbo *folderBranchOps) SetInitialHeadFromServer(
 
 	return runUnlessCanceled(ctx, func() error {
 		fb := FolderBranch{md.TlfID(), MasterBranch}
+		if fbo.isReadOnly() {
+			// Archived branches may only be initialized with the
+			// revision they are pinned to.
+			bid, rev, mStatus, err := fbo.archivedRevision()
+			if err != nil {
+				return err
+			}
+			if md.MergedStatus() != mStatus || md.BID() != bid ||
+				md.Revision() != rev {
+				return errors.Errorf(
+					"Can't set revision %d (%s) as the head of %s",
+					md.Revision(), md.MergedStatus(), fbo.folderBranch)
+			}
+			fb.Branch = fbo.branch()
+		}
 		if fb != fbo.folderBranch {
 			return WrongOpsError{fbo.folderBranch, fb}
 		}
@@ -2377,8 +2642,22 @@ func (fbo *folderBranchOps) finalizeMDRekeyWriteLocked(ctx context.Context,
 	return nil
 }
 
-func (fbo *folderBranchOps) finalizeGCOp(ctx context.Context, gco *GCOp) (
-	err error) {
+func (fbo *folderBranchOps) finalizeGCOp(ctx context.Context, gco *GCOp,
+	trashGCStartRev kbfsmd.Revision) (err error) {
+	return fbo.finalizeGCOpWith(ctx, func(md *RootMetadata) *GCOp {
+		// TODO: if the revision number of this new commit is
+		// sequential with `LatestRev`, we can probably change this
+		// to `gco.LatestRev+1`.
+		md.SetLastGCRevision(gco.LatestRev)
+		md.SetTrashGCStartRevision(trashGCStartRev)
+		return gco
+	})
+}
+
+// finalizeGCOpWith puts a new merged revision containing just the
+// gcOp returned by `makeGCOp`, which can also change the new MD.
+func (fbo *folderBranchOps) finalizeGCOpWith(ctx context.Context,
+	makeGCOp func(md *RootMetadata) *GCOp) (err error) {
 	lState := makeFBOLockState()
 	// Lock the folder so we can get an internally-consistent MD
 	// revision number.
@@ -2394,11 +2673,7 @@ func (fbo *folderBranchOps) finalizeGCOp(ctx context.Context, gco *GCOp) (
 		return UnexpectedUnmergedPutError{}
 	}
 
-	md.AddOp(gco)
-	// TODO: if the revision number of this new commit is sequential
-	// with `LatestRev`, we can probably change this to
-	// `gco.LatestRev+1`.
-	md.SetLastGCRevision(gco.LatestRev)
+	md.AddOp(makeGCOp(md))
 
 	bps, err := fbo.maybeUnembedAndPutBlocks(ctx, md)
 	if err != nil {
@@ -2868,7 +3143,7 @@ func (fbo *folderBranchOps) CreateDir(
 			getNodeIDStr(dir), path, getNodeIDStr(n), err)
 	}()
 
-	err = fbo.checkNode(dir)
+	err = fbo.checkNodeForWrite(dir)
 	if err != nil {
 		return nil, EntryInfo{}, err
 	}
@@ -2903,7 +3178,7 @@ func (fbo *folderBranchOps) CreateFile(
 			getNodeIDStr(n), err)
 	}()
 
-	err = fbo.checkNode(dir)
+	err = fbo.checkNodeForWrite(dir)
 	if err != nil {
 		return nil, EntryInfo{}, err
 	}
@@ -3080,7 +3355,7 @@ func (fbo *folderBranchOps) CreateLink(
 			getNodeIDStr(dir), fromName, toPath, err)
 	}()
 
-	err = fbo.checkNode(dir)
+	err = fbo.checkNodeForWrite(dir)
 	if err != nil {
 		return EntryInfo{}, err
 	}
@@ -3117,23 +3392,28 @@ func (fbo *folderBranchOps) unrefEntryLocked(ctx context.Context,
 	childPath := dir.ChildPath(name, de.BlockPointer)
 
 	// If this is an indirect block, we need to delete all of its
-	// children as well. NOTE: non-empty directories can't be
-	// removed, so no need to check for indirect directory blocks
-	// here.
-	if de.Type == File || de.Type == Exec {
-		blockInfos, err := fbo.blocks.GetIndirectFileBlockInfos(
+	// children as well.  Non-empty directories can't be removed, but
+	// a directory emptied since the last sync may still be made up
+	// of indirect blocks.
+	var blockInfos []BlockInfo
+	var err error
+	if de.Type == Dir {
+		blockInfos, err = fbo.blocks.GetIndirectDirBlockInfos(
+			ctx, lState, kmd, childPath)
+	} else {
+		blockInfos, err = fbo.blocks.GetIndirectFileBlockInfos(
 			ctx, lState, kmd, childPath)
-		if isRecoverableBlockErrorForRemoval(err) {
-			msg := fmt.Sprintf("Recoverable block error encountered for unrefEntry(%v); continuing", childPath)
-			fbo.log.CWarningf(ctx, "%s", msg)
-			fbo.log.CDebugf(ctx, "%s (err=%v)", msg, err)
-		} else if err != nil {
-			return err
-		}
-		fbo.prepper.cacheBlockInfos(blockInfos)
-		for _, blockInfo := range blockInfos {
-			unrefsToAdd[blockInfo.BlockPointer] = true
-		}
+	}
+	if isRecoverableBlockErrorForRemoval(err) {
+		msg := fmt.Sprintf("Recoverable block error encountered for unrefEntry(%v); continuing", childPath)
+		fbo.log.CWarningf(ctx, "%s", msg)
+		fbo.log.CDebugf(ctx, "%s (err=%v)", msg, err)
+	} else if err != nil {
+		return err
+	}
+	fbo.prepper.cacheBlockInfos(blockInfos)
+	for _, blockInfo := range blockInfos {
+		unrefsToAdd[blockInfo.BlockPointer] = true
 	}
 
 	// Any referenced blocks that were unreferenced since the last
@@ -3262,7 +3542,7 @@ func (fbo *folderBranchOps) RemoveDir(
 			getNodeIDStr(dir), dirName, err)
 	}()
 
-	err = fbo.checkNode(dir)
+	err = fbo.checkNodeForWrite(dir)
 	if err != nil {
 		return
 	}
@@ -3281,7 +3561,7 @@ func (fbo *folderBranchOps) RemoveEntry(ctx context.Context, dir Node,
 			getNodeIDStr(dir), name, err)
 	}()
 
-	err = fbo.checkNode(dir)
+	err = fbo.checkNodeForWrite(dir)
 	if err != nil {
 		return err
 	}
@@ -3307,7 +3587,7 @@ func (fbo *folderBranchOps) RemoveEntry(ctx context.Context, dir Node,
 
 func (fbo *folderBranchOps) renameLocked(
 	ctx context.Context, lState *lockState, oldParent Node, oldName string,
-	newParent Node, newName string) (err error) {
+	newParent Node, newName string, mode RenameMode) (err error) {
 	fbo.mdWriterLock.AssertLocked(lState)
 
 	if err := fbo.checkForUnlinkedDir(oldParent); err != nil {
@@ -3345,9 +3625,17 @@ func (fbo *folderBranchOps) renameLocked(
 		return err
 	}
 
+	if mode == RenameExchange {
+		return fbo.exchangeLocked(ctx, lState, md.ReadOnly(), oldParent,
+			oldParentPath, oldName, newParent, newParentPath, newName,
+			newPBlock, newDe, ro)
+	}
+
 	// does name exist?
 	replacedDe, ok := newPBlock.Children[newName]
-	if ok {
+	if ok && mode == RenameNoReplace {
+		return NameExistsError{newName}
+	} else if ok {
 		// Usually higher-level programs check these, but just in case.
 		if replacedDe.Type == Dir && newDe.Type != Dir {
 			return NotDirError{newParentPath.ChildPathNoPtr(newName)}
@@ -3396,18 +3684,81 @@ func (fbo *folderBranchOps) renameLocked(
 		ctx, lState, dirCacheUndoFn, nodesToDirty, ro, md.ReadOnly())
 }
 
+// exchangeLocked swaps the entries named `oldName` and `newName`,
+// using the rename op and the new parent block already prepared by
+// renameLocked, which becomes part of an exchange op.  `newDe` is the
+// entry at `oldName`.
+func (fbo *folderBranchOps) exchangeLocked(
+	ctx context.Context, lState *lockState, md ReadOnlyRootMetadata,
+	oldParent Node, oldParentPath path, oldName string, newParent Node,
+	newParentPath path, newName string, newPBlock *DirBlock, newDe DirEntry,
+	ro *renameOp) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	exchangedDe, ok := newPBlock.Children[newName]
+	if !ok {
+		return NoSuchNameError{newName}
+	}
+	if oldParentPath.tailPointer() == newParentPath.tailPointer() &&
+		oldName == newName {
+		return nil
+	}
+
+	// Neither entry may end up inside of itself.
+	for _, check := range []struct {
+		de     DirEntry
+		parent path
+	}{{newDe, newParentPath}, {exchangedDe, oldParentPath}} {
+		if check.de.Type != Dir {
+			continue
+		}
+		for _, pn := range check.parent.path {
+			if pn.BlockPointer == check.de.BlockPointer {
+				return errors.Errorf("Can't move %v into itself (%s)",
+					check.de.BlockPointer, check.parent)
+			}
+		}
+	}
+
+	// Only the ctimes change on the directory entries themselves.
+	now := fbo.nowUnixNano()
+	newDe.Ctime = now
+	exchangedDe.Ctime = now
+
+	xo := &exchangeOp{
+		renameOp:      *ro,
+		Exchanged:     exchangedDe.BlockPointer,
+		ExchangedType: exchangedDe.Type,
+	}
+
+	dirCacheUndoFn, err := fbo.blocks.ExchangeDirEntriesInCache(
+		lState, oldParentPath, oldName, newDe, newParentPath, newName,
+		exchangedDe)
+	if err != nil {
+		return err
+	}
+
+	nodesToDirty := []Node{oldParent}
+	if oldParent.GetID() != newParent.GetID() {
+		nodesToDirty = append(nodesToDirty, newParent)
+	}
+	return fbo.notifyAndSyncOrSignal(
+		ctx, lState, dirCacheUndoFn, nodesToDirty, xo, md)
+}
+
 func (fbo *folderBranchOps) Rename(
 	ctx context.Context, oldParent Node, oldName string, newParent Node,
-	newName string) (err error) {
-	fbo.log.CDebugf(ctx, "Rename %s/%s -> %s/%s", getNodeIDStr(oldParent),
-		oldName, getNodeIDStr(newParent), newName)
+	newName string, mode RenameMode) (err error) {
+	fbo.log.CDebugf(ctx, "Rename %s/%s -> %s/%s (%s)",
+		getNodeIDStr(oldParent), oldName, getNodeIDStr(newParent), newName,
+		mode)
 	defer func() {
 		fbo.deferLog.CDebugf(ctx, "Rename %s/%s -> %s/%s done: %+v",
 			getNodeIDStr(oldParent), oldName,
 			getNodeIDStr(newParent), newName, err)
 	}()
 
-	err = fbo.checkNode(newParent)
+	err = fbo.checkNodeForWrite(newParent)
 	if err != nil {
 		return err
 	}
@@ -3420,1848 +3771,3683 @@ func (fbo *folderBranchOps) Rename(
 			}
 
 			return fbo.renameLocked(ctx, lState, oldParent, oldName,
-				newParent, newName)
+				newParent, newName, mode)
 		})
 }
 
-func (fbo *folderBranchOps) Read(
-	ctx context.Context, file Node, dest []byte, off int64) (
-	n int64, err error) {
-	fbo.log.CDebugf(ctx, "Read %s %d %d", getNodeIDStr(file),
-		len(dest), off)
-	defer func() {
-		fbo.deferLog.CDebugf(ctx, "Read %s %d %d (n=%d) done: %+v",
-			getNodeIDStr(file), len(dest), off, n, err)
-	}()
-
-	err = fbo.checkNode(file)
-	if err != nil {
-		return 0, err
-	}
+// cloneEntryLocked returns a copy of the given directory entry that
+// shares the data of the original entry's blocks.  Every file block
+// in the copy gets a new reference to the existing block on the
+// server, except for indirect blocks which must be readied again
+// since their child pointers change.  If `undup` is true, every file
+// block is readied again too, which is needed when the original
+// blocks might have been archived.  Directories get brand new
+// blocks.  All new blocks and references are added to `bps` and
+// referenced in `md`.
+func (fbo *folderBranchOps) cloneEntryLocked(
+	ctx context.Context, lState *lockState, md *RootMetadata,
+	chargedTo keybase1.UserOrTeamID, p path, de DirEntry,
+	bps *blockPutState, now int64, undup bool) (DirEntry, error) {
+	fbo.mdWriterLock.AssertLocked(lState)
 
-	{
-		filePath, err := fbo.pathFromNodeForRead(file)
+	newDe := de
+	newDe.Mtime = now
+	newDe.Ctime = now
+
+	switch de.Type {
+	case Sym:
+		// Symlinks are embedded in the directory entry.
+		return newDe, nil
+	case Dir:
+		dblock, err := fbo.blocks.GetDir(
+			ctx, lState, md.ReadOnly(), p, blockRead)
 		if err != nil {
-			return 0, err
+			return DirEntry{}, err
 		}
-
-		// It seems git isn't handling EINTR from some of its read calls (likely
-		// fread), which causes it to get corrupted data (which leads to coredumps
-		// later) when a read system call on pack files gets interrupted. This
-		// enables delayed cancellation for Read if the file path contains `.git`.
-		//
-		// TODO: get a patch in git, wait for sufficiently long time for people to
-		// upgrade, and remove this.
-
-		// allow turning this feature off by env var to make life easier when we
-		// try to fix git.
-		if _, isSet := os.LookupEnv("KBFS_DISABLE_GIT_SPECIAL_CASE"); !isSet {
-			for _, n := range filePath.path {
-				if n.Name == ".git" {
-					EnableDelayedCancellationWithGracePeriod(ctx, fbo.config.DelayedCancellationGracePeriod())
-					break
-				}
+		newDblock := NewDirBlock().(*DirBlock)
+		for name, childDe := range dblock.Children {
+			newChildDe, err := fbo.cloneEntryLocked(
+				ctx, lState, md, chargedTo,
+				p.ChildPath(name, childDe.BlockPointer), childDe, bps, now,
+				undup)
+			if err != nil {
+				return DirEntry{}, err
 			}
+			newDblock.Children[name] = newChildDe
 		}
-	}
-
-	// Don't let the goroutine below write directly to the return
-	// variable, since if the context is canceled the goroutine might
-	// outlast this function call, and end up in a read/write race
-	// with the caller.
-	var bytesRead int64
-	err = runUnlessCanceled(ctx, func() error {
-		lState := makeFBOLockState()
-
-		// verify we have permission to read
-		md, err := fbo.getMDForReadNeedIdentify(ctx, lState)
+		info, plainSize, err := fbo.prepper.readyDirBlock(
+			ctx, md, newDblock, chargedTo, bps)
 		if err != nil {
-			return err
+			return DirEntry{}, err
 		}
+		md.AddRefBlock(info)
+		newDe.BlockInfo = info
+		newDe.Size = uint64(plainSize)
+		return newDe, nil
+	}
 
-		// Read using the `file` Node, not `filePath`, since the path
-		// could change until we take `blockLock` for reading.
-		bytesRead, err = fbo.blocks.Read(
-			ctx, lState, md.ReadOnly(), file, dest, off)
-		return err
-	})
+	dirtyBcache := simpleDirtyBlockCacheStandard()
+	newPtr, _, err := fbo.blocks.DeepCopyFile(
+		ctx, lState, md.ReadOnly(), p, dirtyBcache, fbo.config.DataVersion())
 	if err != nil {
-		return 0, err
+		return DirEntry{}, err
 	}
-	return bytesRead, nil
-}
-
-func (fbo *folderBranchOps) Write(
-	ctx context.Context, file Node, data []byte, off int64) (err error) {
-	fbo.log.CDebugf(ctx, "Write %s %d %d", getNodeIDStr(file),
-		len(data), off)
-	defer func() {
-		fbo.deferLog.CDebugf(ctx, "Write %s %d %d done: %+v",
-			getNodeIDStr(file), len(data), off, err)
-	}()
-
-	err = fbo.checkNode(file)
+	block, err := dirtyBcache.Get(fbo.id(), newPtr, fbo.branch())
 	if err != nil {
-		return err
+		return DirEntry{}, err
+	}
+	fblock, ok := block.(*FileBlock)
+	if !ok {
+		return DirEntry{}, NotFileBlockError{newPtr, fbo.branch(), p}
 	}
+	copyPath := p.parentPath().ChildPath(p.tailName(), newPtr)
 
-	return runUnlessCanceled(ctx, func() error {
-		lState := makeFBOLockState()
+	// If journaling is enabled, new references aren't supported.  We
+	// have to fetch each block and ready it.  TODO: remove this when
+	// KBFS-1149 is fixed.
+	undup = undup || TLFJournalEnabled(fbo.config, fbo.id())
 
-		// Get the MD for reading.  We won't modify it; we'll track the
-		// unref changes on the side, and put them into the MD during the
-		// sync.
-		md, err := fbo.getMDForReadLocked(ctx, lState, mdReadNeedIdentify)
+	if !fblock.IsInd && !undup {
+		// The copy of a direct file is just a new reference to the
+		// same block.
+		info := BlockInfo{BlockPointer: newPtr, EncodedSize: de.EncodedSize}
+		bps.addNewBlock(newPtr, nil, ReadyBlockData{}, nil)
+		md.AddRefBlock(info)
+		newDe.BlockInfo = info
+		return newDe, nil
+	}
+
+	var infos []BlockInfo
+	if undup {
+		infos, err = fbo.blocks.UndupChildrenInCopy(
+			ctx, lState, md.ReadOnly(), copyPath, bps, dirtyBcache, fblock)
 		if err != nil {
-			return err
+			return DirEntry{}, err
 		}
-
-		err = fbo.blocks.Write(
-			ctx, lState, md.ReadOnly(), file, data, off)
+	} else {
+		// Ready any mid-level internal children.
+		_, err = fbo.blocks.ReadyNonLeafBlocksInCopy(
+			ctx, lState, md.ReadOnly(), copyPath, bps, dirtyBcache, fblock)
 		if err != nil {
-			return err
+			return DirEntry{}, err
 		}
 
-		fbo.status.addDirtyNode(file)
-		fbo.signalWrite()
-		return nil
-	})
-}
+		infos, err = fbo.blocks.GetIndirectFileBlockInfosWithTopBlock(
+			ctx, lState, md.ReadOnly(), copyPath, fblock)
+		if err != nil {
+			return DirEntry{}, err
+		}
 
-func (fbo *folderBranchOps) Truncate(
-	ctx context.Context, file Node, size uint64) (err error) {
-	fbo.log.CDebugf(ctx, "Truncate %s %d", getNodeIDStr(file), size)
-	defer func() {
-		fbo.deferLog.CDebugf(ctx, "Truncate %s %d done: %+v",
-			getNodeIDStr(file), size, err)
-	}()
+		for _, info := range infos {
+			// The indirect blocks were already added to bps, so
+			// only add the dedup'd leaf blocks.
+			if info.RefNonce != kbfsblock.ZeroRefNonce {
+				bps.addNewBlock(info.BlockPointer, nil, ReadyBlockData{}, nil)
+			}
+		}
+	}
+	for _, info := range infos {
+		md.AddRefBlock(info)
+	}
 
-	err = fbo.checkNode(file)
+	// A direct top block must not be dedup'd against the original
+	// either.
+	bcache := fbo.config.BlockCache()
+	if undup {
+		bcache = noDedupBlockCache{bcache}
+	}
+	info, _, readyBlockData, err := ReadyBlock(
+		ctx, bcache, fbo.config.BlockOps(), fbo.config.cryptoPure(),
+		md.ReadOnly(), fblock, chargedTo, keybase1.BlockType_DATA)
 	if err != nil {
-		return err
+		return DirEntry{}, err
 	}
+	bps.addNewBlock(info.BlockPointer, fblock, readyBlockData, nil)
+	md.AddRefBlock(info)
+	newDe.BlockInfo = info
+	return newDe, nil
+}
 
-	return runUnlessCanceled(ctx, func() error {
-		lState := makeFBOLockState()
+// startCloneLocked checks that a clone can be made into a new entry
+// called `name` under `dir`, and returns the successor MD for it
+// along with the path of `dir`.
+func (fbo *folderBranchOps) startCloneLocked(
+	ctx context.Context, lState *lockState, dir Node, name string) (
+	*RootMetadata, path, error) {
+	fbo.mdWriterLock.AssertLocked(lState)
 
-		// Get the MD for reading.  We won't modify it; we'll track the
-		// unref changes on the side, and put them into the MD during the
-		// sync.
-		md, err := fbo.getMDForReadLocked(ctx, lState, mdReadNeedIdentify)
-		if err != nil {
-			return err
-		}
+	if err := checkDisallowedPrefixes(name, fbo.config.Mode()); err != nil {
+		return nil, path{}, err
+	}
 
-		err = fbo.blocks.Truncate(
-			ctx, lState, md.ReadOnly(), file, size)
-		if err != nil {
-			return err
-		}
+	if uint32(len(name)) > fbo.config.MaxNameBytes() {
+		return nil, path{}, NameTooLongError{name, fbo.config.MaxNameBytes()}
+	}
 
-		fbo.status.addDirtyNode(file)
-		fbo.signalWrite()
-		return nil
-	})
-}
+	if err := fbo.checkForUnlinkedDir(dir); err != nil {
+		return nil, path{}, err
+	}
 
-func (fbo *folderBranchOps) setExLocked(
-	ctx context.Context, lState *lockState, file Node, ex bool) (err error) {
-	fbo.mdWriterLock.AssertLocked(lState)
+	// The clone shares the source's blocks, so they must all be on
+	// the server first.
+	err := fbo.syncAllLocked(ctx, lState, NoExcl)
+	if err != nil {
+		return nil, path{}, err
+	}
 
-	filePath, err := fbo.pathFromNodeForMDWriteLocked(lState, file)
+	filename, err := fbo.canonicalPath(ctx, dir, name)
 	if err != nil {
-		return err
+		return nil, path{}, err
 	}
 
-	// Verify we have permission to write (no need to make a successor yet).
-	md, err := fbo.getMDForWriteLockedForFilename(ctx, lState, "")
+	md, err := fbo.getSuccessorMDForWriteLockedForFilename(
+		ctx, lState, filename)
 	if err != nil {
-		return
+		return nil, path{}, err
 	}
 
-	de, err := fbo.blocks.GetDirtyEntryEvenIfDeleted(
-		ctx, lState, md.ReadOnly(), filePath)
+	dirPath, err := fbo.pathFromNodeForMDWriteLocked(lState, dir)
 	if err != nil {
-		return err
+		return nil, path{}, err
 	}
+	return md, dirPath, nil
+}
 
-	// If the file is a symlink, do nothing (to match ext4
-	// behavior).
-	if de.Type == Sym || de.Type == Dir {
-		fbo.log.CDebugf(ctx, "Ignoring setex on type %s", de.Type)
-		return nil
+// copyEntryLocked clones the entry represented by `src` into a new
+// entry called `name` under `dir`, and syncs the result immediately.
+func (fbo *folderBranchOps) copyEntryLocked(
+	ctx context.Context, lState *lockState, src Node, dir Node,
+	name string, isDir bool) (childNode Node, de DirEntry, err error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	if fbo.nodeCache.IsUnlinked(src) {
+		return nil, DirEntry{}, NoSuchNameError{src.GetBasename()}
 	}
 
-	if ex && (de.Type == File) {
-		de.Type = Exec
-	} else if !ex && (de.Type == Exec) {
-		de.Type = File
+	md, dirPath, err := fbo.startCloneLocked(ctx, lState, dir, name)
+	if err != nil {
+		return nil, DirEntry{}, err
+	}
+
+	srcPath, err := fbo.pathFromNodeForMDWriteLocked(lState, src)
+	if err != nil {
+		return nil, DirEntry{}, err
+	}
+
+	var srcDe DirEntry
+	if srcPath.hasValidParent() {
+		srcDe, err = fbo.blocks.GetDirtyEntry(
+			ctx, lState, md.ReadOnly(), srcPath)
+		if err != nil {
+			return nil, DirEntry{}, err
+		}
 	} else {
-		// Treating this as a no-op, without updating the ctime, is a
-		// POSIX violation, but it's an important optimization to keep
-		// permissions-preserving rsyncs fast.
-		fbo.log.CDebugf(ctx, "Ignoring no-op setex")
-		return nil
+		// srcPath is just the root.
+		srcDe = md.data.Dir
+	}
+	if isDir && srcDe.Type != Dir {
+		return nil, DirEntry{}, NotDirError{srcPath}
+	} else if !isDir && srcDe.Type != File && srcDe.Type != Exec {
+		return nil, DirEntry{}, NotFileError{srcPath}
 	}
 
-	de.Ctime = fbo.nowUnixNano()
+	return fbo.finishCloneLocked(
+		ctx, lState, md, srcPath, srcDe, dir, dirPath, name)
+}
 
-	parentPtr := filePath.parentPath().tailPointer()
-	sao, err := newSetAttrOp(filePath.tailName(), parentPtr,
-		exAttr, filePath.tailPointer())
+// finishCloneLocked adds a clone of `srcDe`, found at `srcPath`, as a
+// new entry called `name` under `dir`, and syncs the result
+// immediately.  `md` and `dirPath` must come from startCloneLocked.
+func (fbo *folderBranchOps) finishCloneLocked(
+	ctx context.Context, lState *lockState, md *RootMetadata, srcPath path,
+	srcDe DirEntry, dir Node, dirPath path, name string) (
+	childNode Node, de DirEntry, err error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	dblock, err := fbo.blocks.GetDir(
+		ctx, lState, md.ReadOnly(), dirPath, blockWrite)
 	if err != nil {
-		return err
+		return nil, DirEntry{}, err
 	}
-	sao.AddSelfUpdate(parentPtr)
 
-	// If the node has been unlinked, we can safely ignore this setex.
-	if fbo.nodeCache.IsUnlinked(file) {
-		fbo.log.CDebugf(ctx, "Skipping setex for a removed file %v",
-			filePath.tailPointer())
-		fbo.blocks.UpdateCachedEntryAttributesOnRemovedFile(
-			ctx, lState, sao, de)
-		return nil
+	// does name already exist?
+	if _, ok := dblock.Children[name]; ok {
+		return nil, DirEntry{}, NameExistsError{name}
 	}
 
-	sao.setFinalPath(filePath)
+	if err := fbo.checkNewDirSize(
+		ctx, lState, md.ReadOnly(), dirPath, name); err != nil {
+		return nil, DirEntry{}, err
+	}
 
-	dirCacheUndoFn := fbo.blocks.SetAttrInDirEntryInCache(
-		lState, filePath, de, sao.Attr)
-	return fbo.notifyAndSyncOrSignal(
-		ctx, lState, dirCacheUndoFn, []Node{file}, sao, md.ReadOnly())
-}
+	co, err := newCreateOp(name, dirPath.tailPointer(), srcDe.Type)
+	if err != nil {
+		return nil, DirEntry{}, err
+	}
+	co.setFinalPath(dirPath)
+	md.AddOp(co)
 
-func (fbo *folderBranchOps) SetEx(
-	ctx context.Context, file Node, ex bool) (err error) {
-	fbo.log.CDebugf(ctx, "SetEx %s %t", getNodeIDStr(file), ex)
+	chargedTo, err := chargedToForTLF(
+		ctx, fbo.config.KBPKI(), fbo.config.KBPKI(), md.GetTlfHandle())
+	if err != nil {
+		return nil, DirEntry{}, err
+	}
+
+	bps := newBlockPutState(1)
 	defer func() {
-		fbo.deferLog.CDebugf(ctx, "SetEx %s %t done: %+v",
-			getNodeIDStr(file), ex, err)
+		if err != nil {
+			fbo.fbm.cleanUpBlockState(md.ReadOnly(), bps, blockDeleteOnMDFail)
+		}
 	}()
 
-	err = fbo.checkNode(file)
+	de, err = fbo.cloneEntryLocked(
+		ctx, lState, md, chargedTo, srcPath, srcDe, bps, fbo.nowUnixNano(),
+		false)
 	if err != nil {
-		return
+		return nil, DirEntry{}, err
 	}
+	dblock.Children[name] = de
 
-	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
-		func(lState *lockState) error {
-			return fbo.setExLocked(ctx, lState, file, ex)
-		})
-}
+	// Ready the parent directory and all of its ancestors.
+	_, _, newBps, err := fbo.prepper.prepUpdateForPath(
+		ctx, lState, chargedTo, md, dblock, *dirPath.parentPath(),
+		dirPath.tailName(), Dir, true, true, zeroPtr, make(localBcache))
+	if err != nil {
+		return nil, DirEntry{}, err
+	}
+	bps.mergeOtherBps(newBps)
 
-func (fbo *folderBranchOps) setMtimeLocked(
-	ctx context.Context, lState *lockState, file Node,
-	mtime *time.Time) error {
-	fbo.mdWriterLock.AssertLocked(lState)
+	_, err = doBlockPuts(ctx, fbo.config.BlockServer(),
+		fbo.config.BlockCache(), fbo.config.Reporter(), fbo.log, fbo.deferLog,
+		md.TlfID(), md.GetTlfHandle().GetCanonicalName(), *bps)
+	if err != nil {
+		return nil, DirEntry{}, err
+	}
 
-	filePath, err := fbo.pathFromNodeForMDWriteLocked(lState, file)
+	unembedBps, err := fbo.maybeUnembedAndPutBlocks(ctx, md)
 	if err != nil {
-		return err
+		return nil, DirEntry{}, err
+	}
+	if unembedBps != nil {
+		bps.mergeOtherBps(unembedBps)
 	}
 
-	// Verify we have permission to write (no need to make a successor yet).
-	md, err := fbo.getMDForWriteLockedForFilename(ctx, lState, "")
+	node, err := fbo.nodeCache.GetOrCreate(de.BlockPointer, name, dir)
 	if err != nil {
-		return err
+		return nil, DirEntry{}, err
 	}
 
-	de, err := fbo.blocks.GetDirtyEntryEvenIfDeleted(
-		ctx, lState, md.ReadOnly(), filePath)
+	err = fbo.finalizeMDWriteLocked(ctx, lState, md, bps, NoExcl,
+		func(md ImmutableRootMetadata) error {
+			return fbo.notifyBatchLocked(ctx, lState, md)
+		})
 	if err != nil {
-		return err
+		return nil, DirEntry{}, err
 	}
-	de.Mtime = mtime.UnixNano()
-	// setting the mtime counts as changing the file MD, so must set ctime too
-	de.Ctime = fbo.nowUnixNano()
+	return node, de, nil
+}
 
-	parentPtr := filePath.parentPath().tailPointer()
-	sao, err := newSetAttrOp(filePath.tailName(), parentPtr,
-		mtimeAttr, filePath.tailPointer())
+func (fbo *folderBranchOps) copyEntry(
+	ctx context.Context, src Node, dir Node, name string, isDir bool) (
+	Node, EntryInfo, error) {
+	err := fbo.checkNodeForWrite(dir)
 	if err != nil {
-		return err
+		return nil, EntryInfo{}, err
 	}
-	sao.AddSelfUpdate(parentPtr)
 
-	// If the node has been unlinked, we can safely ignore this
-	// setmtime.
-	if fbo.nodeCache.IsUnlinked(file) {
-		fbo.log.CDebugf(ctx, "Skipping setmtime for a removed file %v",
-			filePath.tailPointer())
-		fbo.blocks.UpdateCachedEntryAttributesOnRemovedFile(
-			ctx, lState, sao, de)
-		return nil
+	var retNode Node
+	var retEntryInfo EntryInfo
+	err = fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			// only works for paths within the same topdir
+			if src.GetFolderBranch() != dir.GetFolderBranch() {
+				return CopyAcrossFoldersError{}
+			}
+
+			// Don't set node and ei directly, as that can cause a
+			// race when the copy is canceled.
+			node, de, err :=
+				fbo.copyEntryLocked(ctx, lState, src, dir, name, isDir)
+			retNode = node
+			retEntryInfo = de.EntryInfo
+			return err
+		})
+	if err != nil {
+		return nil, EntryInfo{}, err
 	}
+	return retNode, retEntryInfo, nil
+}
 
-	sao.setFinalPath(filePath)
+func (fbo *folderBranchOps) CopyFile(
+	ctx context.Context, file Node, dir Node, name string) (
+	n Node, ei EntryInfo, err error) {
+	fbo.log.CDebugf(ctx, "CopyFile %s -> %s/%s", getNodeIDStr(file),
+		getNodeIDStr(dir), name)
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "CopyFile %s -> %s/%s done: %v %+v",
+			getNodeIDStr(file), getNodeIDStr(dir), name,
+			getNodeIDStr(n), err)
+	}()
 
-	dirCacheUndoFn := fbo.blocks.SetAttrInDirEntryInCache(
-		lState, filePath, de, sao.Attr)
-	return fbo.notifyAndSyncOrSignal(
-		ctx, lState, dirCacheUndoFn, []Node{file}, sao, md.ReadOnly())
+	return fbo.copyEntry(ctx, file, dir, name, false)
 }
 
-func (fbo *folderBranchOps) SetMtime(
-	ctx context.Context, file Node, mtime *time.Time) (err error) {
-	fbo.log.CDebugf(ctx, "SetMtime %s %v", getNodeIDStr(file), mtime)
+func (fbo *folderBranchOps) CopyDir(
+	ctx context.Context, src Node, dir Node, name string) (
+	n Node, ei EntryInfo, err error) {
+	fbo.log.CDebugf(ctx, "CopyDir %s -> %s/%s", getNodeIDStr(src),
+		getNodeIDStr(dir), name)
 	defer func() {
-		fbo.deferLog.CDebugf(ctx, "SetMtime %s %v done: %+v",
-			getNodeIDStr(file), mtime, err)
+		fbo.deferLog.CDebugf(ctx, "CopyDir %s -> %s/%s done: %v %+v",
+			getNodeIDStr(src), getNodeIDStr(dir), name,
+			getNodeIDStr(n), err)
 	}()
 
-	if mtime == nil {
-		// Can happen on some OSes (e.g. OSX) when trying to set the atime only
-		return nil
-	}
+	return fbo.copyEntry(ctx, src, dir, name, true)
+}
 
-	err = fbo.checkNode(file)
+// getDeletedEntrySourceLocked returns the path and directory entry
+// to clone in order to restore `entry`.  Usually that's the entry as
+// it was just before it was removed, but a directory that was
+// emptied first is taken from the revision before anything under it
+// was removed, if it can still be found at the same path.
+func (fbo *folderBranchOps) getDeletedEntrySourceLocked(
+	ctx context.Context, lState *lockState, kmd KeyMetadata,
+	entry DeletedEntry) (path, DirEntry, error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	names := strings.Split(entry.Path, "/")
+	name := names[len(names)-1]
+	dirPath := path{fbo.folderBranch, []pathNode{{entry.dirPtr, ""}}}
+	srcPath := dirPath.ChildPathNoPtr(name)
+	de, err := fbo.blocks.GetDirtyEntry(ctx, lState, kmd, srcPath)
 	if err != nil {
-		return
+		return path{}, DirEntry{}, err
+	}
+	srcPath = dirPath.ChildPath(name, de.BlockPointer)
+	if de.Type != Dir || entry.subtreeRev >= entry.Revision {
+		return srcPath, de, nil
 	}
 
-	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
-		func(lState *lockState) error {
-			return fbo.setMtimeLocked(ctx, lState, file, mtime)
-		})
+	rmd, err := getSingleMD(ctx, fbo.config, fbo.id(), NullBranchID,
+		entry.subtreeRev-1, Merged)
+	if err != nil {
+		return path{}, DirEntry{}, err
+	}
+	fullPath := path{fbo.folderBranch, []pathNode{
+		{rmd.data.Dir.BlockPointer, ""}}}
+	var fullDe DirEntry
+	for _, n := range names {
+		fullDe, err = fbo.blocks.GetDirtyEntry(
+			ctx, lState, rmd, fullPath.ChildPathNoPtr(n))
+		if _, ok := errors.Cause(err).(NoSuchNameError); ok {
+			fbo.log.CDebugf(ctx, "Couldn't find %s at revision %d; "+
+				"restoring it from revision %d", entry.Path,
+				entry.subtreeRev-1, entry.Revision-1)
+			return srcPath, de, nil
+		} else if err != nil {
+			return path{}, DirEntry{}, err
+		}
+		fullPath = fullPath.ChildPath(n, fullDe.BlockPointer)
+	}
+	if fullDe.Type != Dir {
+		return srcPath, de, nil
+	}
+	// Keep the attributes the entry had when it was removed.
+	de.BlockInfo = fullDe.BlockInfo
+	de.Size = fullDe.Size
+	return fullPath, de, nil
 }
 
-type cleanupFn func(context.Context, *lockState, []BlockPointer, error)
+func (fbo *folderBranchOps) restoreDeletedEntryLocked(
+	ctx context.Context, lState *lockState, entry DeletedEntry, dir Node,
+	name string) (Node, DirEntry, error) {
+	fbo.mdWriterLock.AssertLocked(lState)
 
-// startSyncLocked readies the blocks and other state needed to sync a
-// single file.  It returns:
-//
-// * `doSync`: Whether or not the sync should actually happen.
-// * `stillDirty`: Whether the file should still be considered dirty when
-//   this function returns.  (That is, if `doSync` is false, and `stillDirty`
-//   is true, then the file has outstanding changes but the sync was vetoed for
-//   some other reason.)
-// * `fblock`: the root file block for the file being sync'd.
-// * `lbc`: A local block cache consisting of a dirtied version of the parent
-//   directory for this file.
-// * `bps`: All the blocks that need to be put to the server.
-// * `syncState`: Must be passed to the `FinishSyncLocked` call after the
-//   update completes.
-// * `cleanupFn`: A function that, if non-nil, must be called after the sync
-//   is done.  `cleanupFn` should be passed the set of bad blocks that couldn't
-//   be sync'd (if any), and the error.
-// * `err`: The best, greatest return value, everyone says it's absolutely
-//   stunning.
-func (fbo *folderBranchOps) startSyncLocked(ctx context.Context,
-	lState *lockState, md *RootMetadata, node Node, file path) (
-	doSync, stillDirty bool, fblock *FileBlock, lbc localBcache,
-	bps *blockPutState, syncState fileSyncState,
-	cleanup cleanupFn, err error) {
-	fbo.mdWriterLock.AssertLocked(lState)
-
-	// if the cache for this file isn't dirty, we're done
-	if !fbo.blocks.IsDirty(lState, file) {
-		return false, false, nil, nil, nil, fileSyncState{}, nil, nil
-	}
-
-	// If the MD doesn't match the MD expected by the path, that
-	// implies we are using a cached path, which implies the node has
-	// been unlinked.  In that case, we can safely ignore this sync.
-	if fbo.nodeCache.IsUnlinked(node) {
-		fbo.log.CDebugf(ctx, "Skipping sync for a removed file %v",
-			file.tailPointer())
-		// Removing the cached info here is a little sketchy,
-		// since there's no guarantee that this sync comes
-		// from closing the file, and we still want to serve
-		// stat calls accurately if the user still has an open
-		// handle to this file.
-		//
-		// Note in particular that if a file just had a dirty
-		// directory entry cached (due to an attribute change on a
-		// removed file, for example), this will clear that attribute
-		// change.  If there's still an open file handle, the user
-		// won't be able to see the change anymore.
-		//
-		// TODO: Hook this in with the node cache GC logic to be
-		// perfectly accurate (but at the same time, we'd then have to
-		// fix up the intentional panic in the background flusher to
-		// be more tolerant of long-lived dirty, removed files).
-		err := fbo.blocks.ClearCacheInfo(lState, file)
-		if err != nil {
-			return false, false, nil, nil, nil, fileSyncState{}, nil, err
-		}
-		fbo.status.rmDirtyNode(node)
-		return false, true, nil, nil, nil, fileSyncState{}, nil, nil
-	}
-
-	if file.isValidForNotification() {
-		// notify the daemon that a write is being performed
-		fbo.config.Reporter().Notify(ctx, writeNotification(file, false))
-		defer fbo.config.Reporter().Notify(ctx, writeNotification(file, true))
+	md, dirPath, err := fbo.startCloneLocked(ctx, lState, dir, name)
+	if err != nil {
+		return nil, DirEntry{}, err
 	}
 
-	fblock, bps, lbc, syncState, err =
-		fbo.blocks.StartSync(ctx, lState, md, file)
-	cleanup = func(ctx context.Context, lState *lockState,
-		blocksToRemove []BlockPointer, err error) {
-		fbo.blocks.CleanupSyncState(
-			ctx, lState, md.ReadOnly(), file, blocksToRemove, syncState, err)
-	}
+	srcPath, srcDe, err := fbo.getDeletedEntrySourceLocked(
+		ctx, lState, md.ReadOnly(), entry)
 	if err != nil {
-		return false, true, nil, nil, nil, fileSyncState{}, cleanup, err
+		return nil, DirEntry{}, err
 	}
 
-	return true, true, fblock, lbc, bps, syncState, cleanup, nil
+	return fbo.finishCloneLocked(
+		ctx, lState, md, srcPath, srcDe, dir, dirPath, name)
 }
 
-func addSelfUpdatesAndParent(
-	p path, op op, parentsToAddChainsFor map[BlockPointer]bool) {
-	for i, pn := range p.path {
-		if i == len(p.path)-1 {
-			op.AddSelfUpdate(pn.BlockPointer)
-		} else {
-			parentsToAddChainsFor[pn.BlockPointer] = true
-		}
+func (fbo *folderBranchOps) RestoreDeletedEntry(
+	ctx context.Context, entry DeletedEntry, dir Node, name string) (
+	n Node, ei EntryInfo, err error) {
+	fbo.log.CDebugf(ctx, "RestoreDeletedEntry %s (rev %d) -> %s/%s",
+		entry.Path, entry.Revision, getNodeIDStr(dir), name)
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "RestoreDeletedEntry %s (rev %d) -> "+
+			"%s/%s done: %v %+v", entry.Path, entry.Revision,
+			getNodeIDStr(dir), name, getNodeIDStr(n), err)
+	}()
+
+	err = fbo.checkNodeForWrite(dir)
+	if err != nil {
+		return nil, EntryInfo{}, err
 	}
-}
 
-func (fbo *folderBranchOps) syncAllLocked(
-	ctx context.Context, lState *lockState, excl Excl) (err error) {
-	fbo.mdWriterLock.AssertLocked(lState)
+	var retNode Node
+	var retEntryInfo EntryInfo
+	err = fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			// only works for entries within the same topdir
+			if entry.tlfID != fbo.id() {
+				return CopyAcrossFoldersError{}
+			}
 
-	dirtyFiles := fbo.blocks.GetDirtyFileBlockRefs(lState)
-	dirtyDirs := fbo.blocks.GetDirtyDirBlockRefs(lState)
-	if len(dirtyFiles) == 0 && len(dirtyDirs) == 0 {
-		return nil
+			// Don't set node and ei directly, as that can cause a
+			// race when the restore is canceled.
+			node, de, err :=
+				fbo.restoreDeletedEntryLocked(ctx, lState, entry, dir, name)
+			retNode = node
+			retEntryInfo = de.EntryInfo
+			return err
+		})
+	if err != nil {
+		return nil, EntryInfo{}, err
 	}
+	return retNode, retEntryInfo, nil
+}
 
-	ctx = fbo.config.MaybeStartTrace(ctx, "FBO.SyncAll",
-		fmt.Sprintf("%d files, %d dirs", len(dirtyFiles), len(dirtyDirs)))
-	defer func() { fbo.config.MaybeFinishTrace(ctx, err) }()
+func (fbo *folderBranchOps) Read(
+	ctx context.Context, file Node, dest []byte, off int64) (
+	n int64, err error) {
+	fbo.log.CDebugf(ctx, "Read %s %d %d", getNodeIDStr(file),
+		len(dest), off)
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "Read %s %d %d (n=%d) done: %+v",
+			getNodeIDStr(file), len(dest), off, n, err)
+	}()
 
-	// Verify we have permission to write.  We do this after the dirty
-	// check because otherwise readers who call syncAll would get an
-	// error.
-	md, err := fbo.getSuccessorMDForWriteLocked(ctx, lState)
+	err = fbo.checkNode(file)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	bps := newBlockPutState(0)
-	resolvedPaths := make(map[BlockPointer]path)
-	lbc := make(localBcache)
-
-	var cleanups []func(context.Context, *lockState, error)
-	defer func() {
-		for _, cf := range cleanups {
-			cf(ctx, lState, err)
+	{
+		filePath, err := fbo.pathFromNodeForRead(file)
+		if err != nil {
+			return 0, err
 		}
-	}()
 
-	fbo.log.LazyTrace(ctx, "Syncing %d dir(s)", len(dirtyDirs))
+		// It seems git isn't handling EINTR from some of its read calls (likely
+		// fread), which causes it to get corrupted data (which leads to coredumps
+		// later) when a read system call on pack files gets interrupted. This
+		// enables delayed cancellation for Read if the file path contains `.git`.
+		//
+		// TODO: get a patch in git, wait for sufficiently long time for people to
+		// upgrade, and remove this.
 
-	// First prep all the directories.
-	fbo.log.CDebugf(ctx, "Syncing %d dir(s)", len(dirtyDirs))
-	for _, ref := range dirtyDirs {
-		node := fbo.nodeCache.Get(ref)
-		if node == nil {
-			continue
+		// allow turning this feature off by env var to make life easier when we
+		// try to fix git.
+		if _, isSet := os.LookupEnv("KBFS_DISABLE_GIT_SPECIAL_CASE"); !isSet {
+			for _, n := range filePath.path {
+				if n.Name == ".git" {
+					EnableDelayedCancellationWithGracePeriod(ctx, fbo.config.DelayedCancellationGracePeriod())
+					break
+				}
+			}
 		}
+	}
 
-		dir := fbo.nodeCache.PathFromNode(node)
-		dblock, err := fbo.blocks.GetDirtyDir(ctx, lState, md, dir, blockWrite)
+	// Don't let the goroutine below write directly to the return
+	// variable, since if the context is canceled the goroutine might
+	// outlast this function call, and end up in a read/write race
+	// with the caller.
+	var bytesRead int64
+	err = runUnlessCanceled(ctx, func() error {
+		lState := makeFBOLockState()
+
+		// verify we have permission to read
+		md, err := fbo.getMDForReadNeedIdentify(ctx, lState)
 		if err != nil {
 			return err
 		}
 
-		lbc[dir.tailPointer()] = dblock
-		if !fbo.nodeCache.IsUnlinked(node) {
-			resolvedPaths[dir.tailPointer()] = dir
-		}
-
-		// On a successful sync, clean up the cached entries and the
-		// dirty blocks.
-		cleanups = append(cleanups,
-			func(ctx context.Context, lState *lockState, err error) {
-				if err != nil {
-					return
-				}
-				fbo.blocks.ClearCachedDirEntry(lState, dir)
-				fbo.status.rmDirtyNode(node)
-			})
+		// Read using the `file` Node, not `filePath`, since the path
+		// could change until we take `blockLock` for reading.
+		bytesRead, err = fbo.blocks.Read(
+			ctx, lState, md.ReadOnly(), file, dest, off)
+		return err
+	})
+	if err != nil {
+		return 0, err
 	}
+	return bytesRead, nil
+}
+
+func (fbo *folderBranchOps) GetFileDataExtents(
+	ctx context.Context, file Node, off int64, maxExtents int) (
+	extents []FileExtent, err error) {
+	fbo.log.CDebugf(ctx, "GetFileDataExtents %s %d %d", getNodeIDStr(file),
+		off, maxExtents)
 	defer func() {
-		// If the sync is successful, we can clear out all buffered
-		// directory operations.
-		if err == nil {
-			fbo.dirOps = nil
-		}
+		fbo.deferLog.CDebugf(ctx, "GetFileDataExtents %s %d %d "+
+			"(n=%d) done: %+v", getNodeIDStr(file), off, maxExtents,
+			len(extents), err)
 	}()
 
-	fbo.log.LazyTrace(ctx, "Processing %d op(s)", len(fbo.dirOps))
-
-	newBlocks := make(map[BlockPointer]bool)
-	fileBlocks := make(fileBlockMap)
-	parentsToAddChainsFor := make(map[BlockPointer]bool)
-	for _, dop := range fbo.dirOps {
-		// Copy the op before modifying it, in case there's an error
-		// and we have to retry with the original ops.
-		newOp := dop.dirOp.deepCopy()
-		md.AddOp(newOp)
+	err = fbo.checkNode(file)
+	if err != nil {
+		return nil, err
+	}
 
-		// Add "updates" for all the op updates, and make chains for
-		// the rest of the parent directories, so they're treated like
-		// updates during the prepping.
-		for _, n := range dop.nodes {
-			p := fbo.nodeCache.PathFromNode(n)
-			if _, ok := newOp.(*setAttrOp); ok {
-				// For a setattr, the node is the file, but that
-				// doesn't get updated, so use the current parent
-				// node.
-				p = *p.parentPath()
-			}
+	err = runUnlessCanceled(ctx, func() error {
+		lState := makeFBOLockState()
 
-			addSelfUpdatesAndParent(p, newOp, parentsToAddChainsFor)
+		// verify we have permission to read
+		md, err := fbo.getMDForReadNeedIdentify(ctx, lState)
+		if err != nil {
+			return err
 		}
 
-		var ref BlockRef
-		switch realOp := newOp.(type) {
-		case *createOp:
-			if realOp.Type == Sym {
-				continue
-			}
+		extents, err = fbo.blocks.GetFileDataExtents(
+			ctx, lState, md.ReadOnly(), file, off, maxExtents)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return extents, nil
+}
 
-			// New files and directories explicitly need
-			// pointer-updating, because the sync process will turn
-			// them into simple refs and will forget about the local,
-			// temporary ID.
-			newNode := dop.nodes[1]
-			newPath := fbo.nodeCache.PathFromNode(newNode)
-			newPointer := newPath.tailPointer()
-			newBlocks[newPointer] = true
-
-			if realOp.Type != Dir {
-				continue
-			}
+func (fbo *folderBranchOps) Write(
+	ctx context.Context, file Node, data []byte, off int64) (err error) {
+	fbo.log.CDebugf(ctx, "Write %s %d %d", getNodeIDStr(file),
+		len(data), off)
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "Write %s %d %d done: %+v",
+			getNodeIDStr(file), len(data), off, err)
+	}()
 
-			dblock, ok := lbc[newPointer]
-			if !ok {
-				// New directories that aren't otherwise dirty need to
-				// be added to both the `lbc` and `resolvedPaths` so
-				// they are properly synced.
-				dblock, err = fbo.blocks.GetDirtyDir(
-					ctx, lState, md, newPath, blockWrite)
-				if err != nil {
-					return err
-				}
-				lbc[newPointer] = dblock
-				if !fbo.nodeCache.IsUnlinked(newNode) {
-					resolvedPaths[newPointer] = newPath
-				}
-			}
+	err = fbo.checkNodeForWrite(file)
+	if err != nil {
+		return err
+	}
 
-			if len(dblock.Children) > 0 {
-				continue
-			}
+	return runUnlessCanceled(ctx, func() error {
+		lState := makeFBOLockState()
 
-			// If the directory is empty, we need to explicitly clean
-			// up its entry after syncing.
-			ref = newPath.tailRef()
-		case *renameOp:
-			ref = realOp.Renamed.Ref()
-		case *setAttrOp:
-			ref = realOp.File.Ref()
-		default:
-			continue
+		// Get the MD for reading.  We won't modify it; we'll track the
+		// unref changes on the side, and put them into the MD during the
+		// sync.
+		md, err := fbo.getMDForReadLocked(ctx, lState, mdReadNeedIdentify)
+		if err != nil {
+			return err
 		}
 
-		// For create, rename and setattr ops, the target will have a
-		// dirty entry, but may not have any outstanding operations on
-		// it, so it needs to be cleaned up manually.
-		defer func() {
-			if err != nil {
-				return
-			}
-			wasCleared := fbo.blocks.ClearCachedRef(lState, ref)
-			if wasCleared {
-				node := fbo.nodeCache.Get(ref)
-				if node != nil {
-					fbo.status.rmDirtyNode(node)
-				}
-			}
-		}()
-	}
-
-	var blocksToRemove []BlockPointer
-	// TODO: find a way to avoid so many dynamic closure dispatches.
-	var afterUpdateFns []func() error
-
-	afterUpdateFns = append(afterUpdateFns, func() error {
-		// Any new files or directories need their pointers explicitly
-		// updated, because the sync will be treating them as a new
-		// ref, and not an update.
-		for _, bs := range bps.blockStates {
-			if newBlocks[bs.oldPtr] {
-				fbo.blocks.updatePointer(
-					md.ReadOnly(), bs.oldPtr, bs.blockPtr, false)
-			}
+		err = fbo.blocks.Write(
+			ctx, lState, md.ReadOnly(), file, data, off)
+		if err != nil {
+			return err
 		}
+
+		fbo.status.addDirtyNode(file)
+		fbo.signalWrite()
 		return nil
 	})
+}
 
-	fbo.log.LazyTrace(ctx, "Syncing %d file(s)", len(dirtyFiles))
+func (fbo *folderBranchOps) Truncate(
+	ctx context.Context, file Node, size uint64) (err error) {
+	fbo.log.CDebugf(ctx, "Truncate %s %d", getNodeIDStr(file), size)
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "Truncate %s %d done: %+v",
+			getNodeIDStr(file), size, err)
+	}()
 
-	fbo.log.CDebugf(ctx, "Syncing %d file(s)", len(dirtyFiles))
-	fileSyncBlocks := newBlockPutState(1)
-	for _, ref := range dirtyFiles {
-		node := fbo.nodeCache.Get(ref)
-		if node == nil {
-			continue
-		}
-		file := fbo.nodeCache.PathFromNode(node)
-		fbo.log.CDebugf(ctx, "Syncing file %v (%s)", ref, file)
+	err = fbo.checkNodeForWrite(file)
+	if err != nil {
+		return err
+	}
 
-		// Start the sync for this dirty file.
-		doSync, stillDirty, fblock, newLbc, newBps, syncState, cleanup, err :=
-			fbo.startSyncLocked(ctx, lState, md, node, file)
-		if cleanup != nil {
-			// Note: This passes the same `blocksToRemove` into each
-			// cleanup function.  That's ok, as only the ones
-			// pertaining to a particular syncing file will be acted
-			// on.
-			cleanups = append(cleanups,
-				func(ctx context.Context, lState *lockState, err error) {
-					cleanup(ctx, lState, blocksToRemove, err)
-				})
-		}
+	return runUnlessCanceled(ctx, func() error {
+		lState := makeFBOLockState()
+
+		// Get the MD for reading.  We won't modify it; we'll track the
+		// unref changes on the side, and put them into the MD during the
+		// sync.
+		md, err := fbo.getMDForReadLocked(ctx, lState, mdReadNeedIdentify)
 		if err != nil {
 			return err
 		}
-		if !doSync {
-			if !stillDirty {
-				fbo.status.rmDirtyNode(node)
-			}
-			continue
-		}
 
-		// Merge the per-file sync info into the batch sync info.
-		bps.mergeOtherBps(newBps)
-		fileSyncBlocks.mergeOtherBps(newBps)
-		resolvedPaths[file.tailPointer()] = file
-		parent := file.parentPath().tailPointer()
-		if _, ok := fileBlocks[parent]; !ok {
-			fileBlocks[parent] = make(map[string]*FileBlock)
+		err = fbo.blocks.Truncate(
+			ctx, lState, md.ReadOnly(), file, size)
+		if err != nil {
+			return err
 		}
-		fileBlocks[parent][file.tailName()] = fblock
 
-		// Collect its `afterUpdateFn` along with all the others, so
-		// they all get invoked under the same lock, to avoid any
-		// weird races.
-		afterUpdateFns = append(afterUpdateFns, func() error {
-			// This will be called after the node cache is updated, so
-			// this newPath will be correct.
-			newPath := fbo.nodeCache.PathFromNode(node)
-			stillDirty, err := fbo.blocks.FinishSyncLocked(
-				ctx, lState, file, newPath, md.ReadOnly(), syncState, fbo.fbm)
-			if !stillDirty {
-				fbo.status.rmDirtyNode(node)
-			}
-			return err
-		})
+		fbo.status.addDirtyNode(file)
+		fbo.signalWrite()
+		return nil
+	})
+}
 
-		// Add an "update" for all the parent directory updates, and
-		// make a chain for the file itself, so they're treated like
-		// updates during the prepping.
-		lastOp := md.Data().Changes.Ops[len(md.Data().Changes.Ops)-1]
-		addSelfUpdatesAndParent(file, lastOp, parentsToAddChainsFor)
+func (fbo *folderBranchOps) PunchHole(
+	ctx context.Context, file Node, off, length int64) (err error) {
+	fbo.log.CDebugf(ctx, "PunchHole %s %d %d", getNodeIDStr(file),
+		off, length)
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "PunchHole %s %d %d done: %+v",
+			getNodeIDStr(file), off, length, err)
+	}()
 
-		// Update the combined local block cache with this file's
-		// dirty entry.
-		parentPtr := file.parentPath().tailPointer()
-		if _, ok := lbc[parentPtr]; ok {
-			lbc[parentPtr].Children[file.tailName()] =
-				newLbc[parentPtr].Children[file.tailName()]
-		} else {
-			lbc[parentPtr] = newLbc[parentPtr]
-		}
+	if off < 0 || length < 0 {
+		return errors.Errorf("Bad hole range: off=%d len=%d", off, length)
 	}
 
-	session, err := fbo.config.KBPKI().GetCurrentSession(ctx)
+	err = fbo.checkNodeForWrite(file)
 	if err != nil {
 		return err
 	}
 
-	tempIRMD := ImmutableRootMetadata{
-		ReadOnlyRootMetadata:   md.ReadOnly(),
-		lastWriterVerifyingKey: session.VerifyingKey,
-	}
+	return runUnlessCanceled(ctx, func() error {
+		lState := makeFBOLockState()
 
-	fbo.log.LazyTrace(ctx, "Prepping update")
+		// Get the MD for reading.  We won't modify it; we'll track the
+		// unref changes on the side, and put them into the MD during the
+		// sync.
+		md, err := fbo.getMDForReadLocked(ctx, lState, mdReadNeedIdentify)
+		if err != nil {
+			return err
+		}
 
-	// Create a set of chains for this batch, a succinct summary of
-	// the file and directory blocks that need to change during this
-	// sync.
-	syncChains, err := newCRChains(
-		ctx, fbo.config.Codec(), []chainMetadata{tempIRMD}, &fbo.blocks, false)
+		err = fbo.blocks.PunchHole(
+			ctx, lState, md.ReadOnly(), file, off, length)
+		if err != nil {
+			return err
+		}
+
+		fbo.status.addDirtyNode(file)
+		fbo.signalWrite()
+		return nil
+	})
+}
+
+func (fbo *folderBranchOps) setExLocked(
+	ctx context.Context, lState *lockState, file Node, ex bool) (err error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	filePath, err := fbo.pathFromNodeForMDWriteLocked(lState, file)
 	if err != nil {
 		return err
 	}
-	for ptr := range parentsToAddChainsFor {
-		syncChains.addNoopChain(ptr)
-	}
 
-	// All originals never made it to the server, so don't unmerged
-	// them.
-	syncChains.doNotUnrefPointers = syncChains.createdOriginals
-	head, _ := fbo.getHead(lState)
-	dummyHeadChains := newCRChainsEmpty()
-	dummyHeadChains.mostRecentChainMDInfo = mostRecentChainMetadataInfo{
-		head, head.Data().Dir.BlockInfo}
+	// Verify we have permission to write (no need to make a successor yet).
+	md, err := fbo.getMDForWriteLockedForFilename(ctx, lState, "")
+	if err != nil {
+		return
+	}
 
-	// Squash the batch of updates together into a set of blocks and
-	// ready `md` for putting to the server.
-	md.AddOp(newResolutionOp())
-	_, newBps, blocksToDelete, err := fbo.prepper.prepUpdateForPaths(
-		ctx, lState, md, syncChains, dummyHeadChains, tempIRMD, head,
-		resolvedPaths, lbc, fileBlocks, fbo.config.DirtyBlockCache(),
-		prepFolderDontCopyIndirectFileBlocks)
+	de, err := fbo.blocks.GetDirtyEntryEvenIfDeleted(
+		ctx, lState, md.ReadOnly(), filePath)
 	if err != nil {
 		return err
 	}
-	if len(blocksToDelete) > 0 {
-		return errors.Errorf("Unexpectedly found unflushed blocks to delete "+
-			"during syncAllLocked: %v", blocksToDelete)
+
+	// If the file is a symlink, do nothing (to match ext4
+	// behavior).
+	if de.Type == Sym || de.Type == Dir {
+		fbo.log.CDebugf(ctx, "Ignoring setex on type %s", de.Type)
+		return nil
 	}
-	bps.mergeOtherBps(newBps)
 
-	defer func() {
-		if err != nil {
-			// Remove any blocks that are covered by file syncs --
-			// those might get reused upon sync retry.  All other
-			// blocks are fair game for cleanup though.
-			bps.removeOtherBps(fileSyncBlocks)
-			fbo.fbm.cleanUpBlockState(md.ReadOnly(), bps, blockDeleteOnMDFail)
-		}
-	}()
+	if ex && (de.Type == File) {
+		de.Type = Exec
+	} else if !ex && (de.Type == Exec) {
+		de.Type = File
+	} else {
+		// Treating this as a no-op, without updating the ctime, is a
+		// POSIX violation, but it's an important optimization to keep
+		// permissions-preserving rsyncs fast.
+		fbo.log.CDebugf(ctx, "Ignoring no-op setex")
+		return nil
+	}
 
-	// Put all the blocks.
-	blocksToRemove, err = doBlockPuts(ctx, fbo.config.BlockServer(),
-		fbo.config.BlockCache(), fbo.config.Reporter(), fbo.log, fbo.deferLog, md.TlfID(),
-		md.GetTlfHandle().GetCanonicalName(), *bps)
+	de.Ctime = fbo.nowUnixNano()
+
+	parentPtr := filePath.parentPath().tailPointer()
+	sao, err := newSetAttrOp(filePath.tailName(), parentPtr,
+		exAttr, filePath.tailPointer())
 	if err != nil {
 		return err
 	}
+	sao.AddSelfUpdate(parentPtr)
 
-	// Call this under the same blockLock as when the pointers are
-	// updated, so there's never any point in time where a read or
-	// write might slip in after the pointers are updated, but before
-	// the deferred writes are re-applied.
-	afterUpdateFn := func() error {
-		var errs []error
-		for _, auf := range afterUpdateFns {
-			err := auf()
-			if err != nil {
-				errs = append(errs, err)
-			}
-		}
-		if len(errs) == 1 {
-			return errs[0]
-		} else if len(errs) > 1 {
-			return errors.Errorf("Got errors %+v", errs)
-		}
+	// If the node has been unlinked, we can safely ignore this setex.
+	if fbo.nodeCache.IsUnlinked(file) {
+		fbo.log.CDebugf(ctx, "Skipping setex for a removed file %v",
+			filePath.tailPointer())
+		fbo.blocks.UpdateCachedEntryAttributesOnRemovedFile(
+			ctx, lState, sao, de)
 		return nil
 	}
 
-	return fbo.finalizeMDWriteLocked(ctx, lState, md, bps, excl,
-		func(md ImmutableRootMetadata) error {
-			// Just update the pointers using the resolutionOp, all
-			// the ops have already been notified.
-			err = fbo.blocks.UpdatePointers(
-				md, lState, md.data.Changes.Ops[0], false, afterUpdateFn)
-			if err != nil {
-				return err
-			}
-
-			fbo.editHistory.UpdateHistory(ctx, []ImmutableRootMetadata{md})
-			return nil
-		})
-}
+	sao.setFinalPath(filePath)
 
-func (fbo *folderBranchOps) syncAllUnlocked(
-	ctx context.Context, lState *lockState) error {
-	fbo.mdWriterLock.Lock(lState)
-	defer fbo.mdWriterLock.Unlock(lState)
-	return fbo.syncAllLocked(ctx, lState, NoExcl)
+	dirCacheUndoFn := fbo.blocks.SetAttrInDirEntryInCache(
+		lState, filePath, de, sao.Attr)
+	return fbo.notifyAndSyncOrSignal(
+		ctx, lState, dirCacheUndoFn, []Node{file}, sao, md.ReadOnly())
 }
 
-// SyncAll implements the KBFSOps interface for folderBranchOps.
-func (fbo *folderBranchOps) SyncAll(
-	ctx context.Context, folderBranch FolderBranch) (err error) {
-	fbo.log.CDebugf(ctx, "SyncAll")
-	defer func() { fbo.deferLog.CDebugf(ctx, "SyncAll done: %+v", err) }()
+func (fbo *folderBranchOps) SetEx(
+	ctx context.Context, file Node, ex bool) (err error) {
+	fbo.log.CDebugf(ctx, "SetEx %s %t", getNodeIDStr(file), ex)
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "SetEx %s %t done: %+v",
+			getNodeIDStr(file), ex, err)
+	}()
 
-	if folderBranch != fbo.folderBranch {
-		return WrongOpsError{fbo.folderBranch, folderBranch}
+	err = fbo.checkNodeForWrite(file)
+	if err != nil {
+		return
 	}
 
 	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
 		func(lState *lockState) error {
-			return fbo.syncAllLocked(ctx, lState, NoExcl)
+			return fbo.setExLocked(ctx, lState, file, ex)
 		})
 }
 
-func (fbo *folderBranchOps) FolderStatus(
-	ctx context.Context, folderBranch FolderBranch) (
-	fbs FolderBranchStatus, updateChan <-chan StatusUpdate, err error) {
-	fbo.log.CDebugf(ctx, "Status")
-	defer func() { fbo.deferLog.CDebugf(ctx, "Status done: %+v", err) }()
+func (fbo *folderBranchOps) setMtimeLocked(
+	ctx context.Context, lState *lockState, file Node,
+	mtime *time.Time) error {
+	fbo.mdWriterLock.AssertLocked(lState)
 
-	if folderBranch != fbo.folderBranch {
-		return FolderBranchStatus{}, nil,
-			WrongOpsError{fbo.folderBranch, folderBranch}
+	filePath, err := fbo.pathFromNodeForMDWriteLocked(lState, file)
+	if err != nil {
+		return err
 	}
 
-	return fbo.status.getStatus(ctx, &fbo.blocks)
-}
+	// Verify we have permission to write (no need to make a successor yet).
+	md, err := fbo.getMDForWriteLockedForFilename(ctx, lState, "")
+	if err != nil {
+		return err
+	}
 
-func (fbo *folderBranchOps) Status(
-	ctx context.Context) (
-	fbs KBFSStatus, updateChan <-chan StatusUpdate, err error) {
-	return KBFSStatus{}, nil, InvalidOpError{}
+	de, err := fbo.blocks.GetDirtyEntryEvenIfDeleted(
+		ctx, lState, md.ReadOnly(), filePath)
+	if err != nil {
+		return err
+	}
+	de.Mtime = mtime.UnixNano()
+	// setting the mtime counts as changing the file MD, so must set ctime too
+	de.Ctime = fbo.nowUnixNano()
+
+	parentPtr := filePath.parentPath().tailPointer()
+	sao, err := newSetAttrOp(filePath.tailName(), parentPtr,
+		mtimeAttr, filePath.tailPointer())
+	if err != nil {
+		return err
+	}
+	sao.AddSelfUpdate(parentPtr)
+
+	// If the node has been unlinked, we can safely ignore this
+	// setmtime.
+	if fbo.nodeCache.IsUnlinked(file) {
+		fbo.log.CDebugf(ctx, "Skipping setmtime for a removed file %v",
+			filePath.tailPointer())
+		fbo.blocks.UpdateCachedEntryAttributesOnRemovedFile(
+			ctx, lState, sao, de)
+		return nil
+	}
+
+	sao.setFinalPath(filePath)
+
+	dirCacheUndoFn := fbo.blocks.SetAttrInDirEntryInCache(
+		lState, filePath, de, sao.Attr)
+	return fbo.notifyAndSyncOrSignal(
+		ctx, lState, dirCacheUndoFn, []Node{file}, sao, md.ReadOnly())
 }
 
-// RegisterForChanges registers a single Observer to receive
-// notifications about this folder/branch.
-func (fbo *folderBranchOps) RegisterForChanges(obs Observer) error {
-	// It's the caller's responsibility to make sure
-	// RegisterForChanges isn't called twice for the same Observer
-	fbo.observers.add(obs)
-	return nil
+func (fbo *folderBranchOps) SetMtime(
+	ctx context.Context, file Node, mtime *time.Time) (err error) {
+	fbo.log.CDebugf(ctx, "SetMtime %s %v", getNodeIDStr(file), mtime)
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "SetMtime %s %v done: %+v",
+			getNodeIDStr(file), mtime, err)
+	}()
+
+	if mtime == nil {
+		// Can happen on some OSes (e.g. OSX) when trying to set the atime only
+		return nil
+	}
+
+	err = fbo.checkNodeForWrite(file)
+	if err != nil {
+		return
+	}
+
+	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			return fbo.setMtimeLocked(ctx, lState, file, mtime)
+		})
 }
 
-// UnregisterFromChanges stops an Observer from getting notifications
-// about the folder/branch.
-func (fbo *folderBranchOps) UnregisterFromChanges(obs Observer) error {
-	fbo.observers.remove(obs)
-	return nil
+func (fbo *folderBranchOps) getXattrs(
+	ctx context.Context, node Node) (map[string][]byte, error) {
+	de, err := fbo.statEntry(ctx, node)
+	if err != nil {
+		return nil, err
+	}
+	return de.Xattrs, nil
 }
 
-// notifyBatchLocked sends out a notification for all the ops in md.
-func (fbo *folderBranchOps) notifyBatchLocked(
-	ctx context.Context, lState *lockState, md ImmutableRootMetadata) error {
-	fbo.headLock.AssertLocked(lState)
+func (fbo *folderBranchOps) GetXattr(
+	ctx context.Context, node Node, name string) (value []byte, err error) {
+	fbo.log.CDebugf(ctx, "GetXattr %s %s", getNodeIDStr(node), name)
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "GetXattr %s %s done: %+v",
+			getNodeIDStr(node), name, err)
+	}()
 
-	for _, op := range md.data.Changes.Ops {
-		err := fbo.notifyOneOpLocked(ctx, lState, op, md.ReadOnly(), false)
+	err = runUnlessCanceled(ctx, func() error {
+		xattrs, err := fbo.getXattrs(ctx, node)
 		if err != nil {
 			return err
 		}
+		v, ok := xattrs[name]
+		if !ok {
+			return NoSuchXattrError{name}
+		}
+		value = make([]byte, len(v))
+		copy(value, v)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	fbo.editHistory.UpdateHistory(ctx, []ImmutableRootMetadata{md})
-	return nil
+	return value, nil
 }
 
-// searchForNode tries to figure out the path to the given
-// blockPointer, using only the block updates that happened as part of
-// a given MD update operation.
-func (fbo *folderBranchOps) searchForNode(ctx context.Context,
-	ptr BlockPointer, md ReadOnlyRootMetadata) (Node, error) {
-	// Record which pointers are new to this update, and thus worth
-	// searching.
-	newPtrs := make(map[BlockPointer]bool)
-	for _, op := range md.data.Changes.Ops {
-		for _, update := range op.allUpdates() {
-			newPtrs[update.Ref] = true
+func (fbo *folderBranchOps) ListXattrs(
+	ctx context.Context, node Node) (names []string, err error) {
+	fbo.log.CDebugf(ctx, "ListXattrs %s", getNodeIDStr(node))
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "ListXattrs %s done: %+v",
+			getNodeIDStr(node), err)
+	}()
+
+	err = runUnlessCanceled(ctx, func() error {
+		xattrs, err := fbo.getXattrs(ctx, node)
+		if err != nil {
+			return err
 		}
-		for _, ref := range op.Refs() {
-			newPtrs[ref] = true
+		names = make([]string, 0, len(xattrs))
+		for name := range xattrs {
+			names = append(names, name)
 		}
-	}
-
-	nodeMap, _, err := fbo.blocks.SearchForNodes(ctx, fbo.nodeCache,
-		[]BlockPointer{ptr}, newPtrs, md, md.data.Dir.BlockPointer)
+		sort.Strings(names)
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
+	return names, nil
+}
 
-	n, ok := nodeMap[ptr]
-	if !ok {
-		return nil, NodeNotFoundError{ptr}
+// setXattrLocked sets the extended attribute `name` on the given node
+// to `value`, or removes it if `remove` is true.
+func (fbo *folderBranchOps) setXattrLocked(
+	ctx context.Context, lState *lockState, node Node, name string,
+	value []byte, flag XattrFlag, remove bool) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	if len(name) == 0 {
+		return NoSuchXattrError{name}
+	}
+	if len(name) > maxXattrNameBytes {
+		return NameTooLongError{name, maxXattrNameBytes}
+	}
+	if len(value) > maxXattrValueBytes {
+		return XattrTooBigError{name, len(value), maxXattrValueBytes}
 	}
 
-	return n, nil
-}
+	nodePath, err := fbo.pathFromNodeForMDWriteLocked(lState, node)
+	if err != nil {
+		return err
+	}
 
-func (fbo *folderBranchOps) getUnlinkPathBeforeUpdatingPointers(
-	ctx context.Context, lState *lockState, md ReadOnlyRootMetadata, op op) (
-	unlinkPath path, unlinkDe DirEntry, toUnlink bool, err error) {
-	if len(md.data.Changes.Ops) == 0 {
-		return path{}, DirEntry{}, false, errors.New("md needs at least one op")
+	// Verify we have permission to write (no need to make a successor yet).
+	md, err := fbo.getMDForWriteLockedForFilename(ctx, lState, "")
+	if err != nil {
+		return err
 	}
 
-	var node Node
-	var childName string
+	de, err := fbo.blocks.GetDirtyEntryEvenIfDeleted(
+		ctx, lState, md.ReadOnly(), nodePath)
+	if err != nil {
+		return err
+	}
 
-	requireResFix := false
-	switch realOp := op.(type) {
-	case *rmOp:
-		if realOp.Dir.Ref == realOp.Dir.Unref {
-			requireResFix = true
-		}
-		node = fbo.nodeCache.Get(realOp.Dir.Unref.Ref())
-		childName = realOp.OldName
-	case *renameOp:
-		if realOp.NewDir.Unref != zeroPtr {
-			// moving to a new dir
-			if realOp.NewDir.Ref == realOp.NewDir.Unref {
-				requireResFix = true
-			}
-			node = fbo.nodeCache.Get(realOp.NewDir.Unref.Ref())
-		} else {
-			// moving to the same dir
-			if realOp.OldDir.Ref == realOp.OldDir.Unref {
-				requireResFix = true
-			}
-			node = fbo.nodeCache.Get(realOp.OldDir.Unref.Ref())
-		}
-		childName = realOp.NewName
-	}
-	if node == nil {
-		return path{}, DirEntry{}, false, nil
+	_, exists := de.Xattrs[name]
+	switch {
+	case remove && !exists:
+		return NoSuchXattrError{name}
+	case flag == XattrCreate && exists:
+		return NameExistsError{name}
+	case flag == XattrReplace && !exists:
+		return NoSuchXattrError{name}
 	}
 
-	p, err := fbo.pathFromNodeForRead(node)
-	if err != nil {
-		return path{}, DirEntry{}, false, err
+	// The existing map may be shared with cached copies of this
+	// entry, so never modify it in place.
+	xattrs := make(map[string][]byte, len(de.Xattrs)+1)
+	for k, v := range de.Xattrs {
+		xattrs[k] = v
 	}
-
-	// If the first op in this MD update is a resolutionOp, we need to
-	// inspect it to look for the *real* original pointer for this
-	// node.
-	if resOp, ok := md.data.Changes.Ops[0].(*resolutionOp); ok {
-		for _, update := range resOp.allUpdates() {
-			if update.Ref == p.tailPointer() {
-				fbo.log.CDebugf(ctx,
-					"Backing up ptr %v in op %s to original pointer %v",
-					p.tailPointer(), op, update.Unref)
-				p.path[len(p.path)-1].BlockPointer = update.Unref
-				requireResFix = false
-				break
-			}
-		}
+	if remove {
+		delete(xattrs, name)
+	} else {
+		valueCopy := make([]byte, len(value))
+		copy(valueCopy, value)
+		xattrs[name] = valueCopy
 	}
-
-	if requireResFix {
-		// If we didn't fix up the pointer using a resolutionOp, the
-		// directory was likely created during this md update, and so
-		// no unlinking is needed.
-		fbo.log.CDebugf(ctx,
-			"Ignoring unlink when resolutionOp never fixed up %v",
-			p.tailPointer())
-		return path{}, DirEntry{}, false, nil
+	if len(xattrs) == 0 {
+		xattrs = nil
 	}
+	de.Xattrs = xattrs
+	de.Ctime = fbo.nowUnixNano()
 
-	// If the original (clean) parent block is already GC'd from the
-	// server, this might not work, but hopefully we'd be
-	// fast-forwarding in that case anyway.
-	dblock, err := fbo.blocks.GetDir(ctx, lState, md, p, blockRead)
+	parentPtr := nodePath.parentPath().tailPointer()
+	sao, err := newSetXattrOp(
+		nodePath.tailName(), parentPtr, nodePath.tailPointer())
 	if err != nil {
-		fbo.log.CDebugf(ctx, "Couldn't get the dir entry for %s in %v: %+v",
-			childName, p.tailPointer(), err)
-		return path{}, DirEntry{}, false, nil
-	}
-	de, ok := dblock.Children[childName]
-	if !ok {
-		return path{}, DirEntry{}, false, nil
+		return err
 	}
-	childPath := p.ChildPath(childName, de.BlockPointer)
-	return childPath, de, true, nil
-}
-
-func (fbo *folderBranchOps) notifyOneOpLocked(ctx context.Context,
-	lState *lockState, op op, md ReadOnlyRootMetadata,
-	shouldPrefetch bool) error {
-	fbo.mdWriterLock.AssertLocked(lState)
-	fbo.headLock.AssertLocked(lState)
+	sao.AddSelfUpdate(parentPtr)
 
-	if fbo.config.Mode() == InitMinimal {
-		// There is no node cache in minimal mode, so there's nothing
-		// to update.
+	// If the node has been unlinked, we can safely ignore this
+	// change.
+	if fbo.nodeCache.IsUnlinked(node) {
+		fbo.log.CDebugf(ctx, "Skipping xattr change for a removed file %v",
+			nodePath.tailPointer())
+		fbo.blocks.UpdateCachedEntryAttributesOnRemovedFile(
+			ctx, lState, sao.attrOp(), de)
 		return nil
 	}
 
-	// We need to get unlinkPath before calling UpdatePointers so that
-	// nodeCache.Unlink can properly update cachedPath.
-	unlinkPath, unlinkDe, toUnlink, err :=
-		fbo.getUnlinkPathBeforeUpdatingPointers(ctx, lState, md.ReadOnly(), op)
+	sao.setFinalPath(nodePath)
+
+	dirCacheUndoFn := fbo.blocks.SetAttrInDirEntryInCache(
+		lState, nodePath, de, sao.Attr)
+	return fbo.notifyAndSyncOrSignal(
+		ctx, lState, dirCacheUndoFn, []Node{node}, sao, md.ReadOnly())
+}
+
+func (fbo *folderBranchOps) SetXattr(
+	ctx context.Context, node Node, name string, value []byte,
+	flag XattrFlag) (err error) {
+	fbo.log.CDebugf(ctx, "SetXattr %s %s (%s)",
+		getNodeIDStr(node), name, flag)
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "SetXattr %s %s (%s) done: %+v",
+			getNodeIDStr(node), name, flag, err)
+	}()
+
+	err = fbo.checkNodeForWrite(node)
 	if err != nil {
 		return err
 	}
 
-	err = fbo.blocks.UpdatePointers(md, lState, op, shouldPrefetch, nil)
+	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			return fbo.setXattrLocked(
+				ctx, lState, node, name, value, flag, false)
+		})
+}
+
+func (fbo *folderBranchOps) RemoveXattr(
+	ctx context.Context, node Node, name string) (err error) {
+	fbo.log.CDebugf(ctx, "RemoveXattr %s %s", getNodeIDStr(node), name)
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "RemoveXattr %s %s done: %+v",
+			getNodeIDStr(node), name, err)
+	}()
+
+	err = fbo.checkNodeForWrite(node)
 	if err != nil {
 		return err
 	}
 
-	var changes []NodeChange
-	switch realOp := op.(type) {
-	default:
-		fbo.log.CDebugf(ctx, "Unknown op: %s", op)
-		return nil
-	case *createOp:
-		node := fbo.nodeCache.Get(realOp.Dir.Ref.Ref())
-		if node == nil {
-			return nil // Nothing to do.
-		}
-		fbo.log.CDebugf(ctx, "notifyOneOp: create %s in node %s",
-			realOp.NewName, getNodeIDStr(node))
-		changes = append(changes, NodeChange{
-			Node:       node,
-			DirUpdated: []string{realOp.NewName},
-		})
-	case *rmOp:
-		node := fbo.nodeCache.Get(realOp.Dir.Ref.Ref())
-		if node == nil {
-			return nil // Nothing to do.
-		}
-		fbo.log.CDebugf(ctx, "notifyOneOp: remove %s in node %s",
-			realOp.OldName, getNodeIDStr(node))
-		changes = append(changes, NodeChange{
-			Node:       node,
-			DirUpdated: []string{realOp.OldName},
+	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			return fbo.setXattrLocked(
+				ctx, lState, node, name, nil, XattrSet, true)
 		})
+}
 
-		// If this node exists, then the child node might exist too,
-		// and we need to unlink it in the node cache.
-		if toUnlink {
-			_ = fbo.nodeCache.Unlink(unlinkDe.Ref(), unlinkPath, unlinkDe)
-		}
-	case *renameOp:
-		oldNode := fbo.nodeCache.Get(realOp.OldDir.Ref.Ref())
-		if oldNode != nil {
-			changes = append(changes, NodeChange{
-				Node:       oldNode,
-				DirUpdated: []string{realOp.OldName},
-			})
+// pathLockKeyForNode returns the key that identifies the path of
+// the given node to the MD server.  It is keyed with the first
+// generation of the TLF crypt key, so that the key for a path stays
+// the same across rekeys.
+func (fbo *folderBranchOps) pathLockKeyForNode(
+	ctx context.Context, lState *lockState, node Node) (
+	PathLockKey, string, error) {
+	md, err := fbo.getMDForReadNeedIdentify(ctx, lState)
+	if err != nil {
+		return PathLockKey{}, "", err
+	}
+
+	p := fbo.nodeCache.PathFromNode(node)
+	if !p.isValid() {
+		return PathLockKey{}, "", InvalidPathError{p}
+	}
+	names := make([]string, 0, len(p.path)-1)
+	for _, pn := range p.path[1:] {
+		names = append(names, pn.Name)
+	}
+	relPath := strings.Join(names, "/")
+
+	tlfCryptKey := kbfscrypto.PublicTLFCryptKey
+	if md.TlfID().Type() != tlf.Public {
+		keys, err := fbo.config.KeyManager().GetTLFCryptKeyOfAllGenerations(
+			ctx, md)
+		if err != nil {
+			return PathLockKey{}, "", err
 		}
-		var newNode Node
-		if realOp.NewDir.Ref != zeroPtr {
-			newNode = fbo.nodeCache.Get(realOp.NewDir.Ref.Ref())
-			if newNode != nil {
-				changes = append(changes, NodeChange{
-					Node:       newNode,
-					DirUpdated: []string{realOp.NewName},
-				})
-			}
-		} else {
-			newNode = oldNode
-			if oldNode != nil {
-				// Add another name to the existing NodeChange.
-				changes[len(changes)-1].DirUpdated =
-					append(changes[len(changes)-1].DirUpdated, realOp.NewName)
-			}
+		if len(keys) == 0 {
+			return PathLockKey{}, "", errors.Errorf(
+				"No crypt keys for TLF %s", fbo.id())
 		}
+		tlfCryptKey = keys[0]
+	}
+	return makePathLockKey(tlfCryptKey, relPath), p.String(), nil
+}
 
-		if oldNode != nil {
-			fbo.log.CDebugf(ctx, "notifyOneOp: rename %v from %s/%s to %s/%s",
-				realOp.Renamed, realOp.OldName, getNodeIDStr(oldNode),
-				realOp.NewName, getNodeIDStr(newNode))
+func (fbo *folderBranchOps) LockPath(
+	ctx context.Context, node Node, owner PathLockOwner) (err error) {
+	fbo.log.CDebugf(ctx, "LockPath %s for %d", getNodeIDStr(node), owner)
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "LockPath %s done: %+v",
+			getNodeIDStr(node), err)
+	}()
 
-			if newNode == nil {
-				if childNode :=
-					fbo.nodeCache.Get(realOp.Renamed.Ref()); childNode != nil {
-					// if the childNode exists, we still have to update
-					// its path to go through the new node.  That means
-					// creating nodes for all the intervening paths.
-					// Unfortunately we don't have enough information to
-					// know what the newPath is; we have to guess it from
-					// the updates.
-					var err error
-					newNode, err =
-						fbo.searchForNode(ctx, realOp.NewDir.Ref, md)
-					if newNode == nil {
-						fbo.log.CErrorf(ctx, "Couldn't find the new node: %v",
-							err)
-					}
-				}
-			}
+	err = fbo.checkNode(node)
+	if err != nil {
+		return err
+	}
 
-			if newNode != nil {
-				if toUnlink {
-					_ = fbo.nodeCache.Unlink(
-						unlinkDe.Ref(), unlinkPath, unlinkDe)
-				}
-				_, err := fbo.nodeCache.Move(
-					realOp.Renamed.Ref(), newNode, realOp.NewName)
-				if err != nil {
-					return err
-				}
-			}
-		}
-	case *syncOp:
-		node := fbo.nodeCache.Get(realOp.File.Ref.Ref())
-		if node == nil {
-			return nil // Nothing to do.
-		}
-		fbo.log.CDebugf(ctx, "notifyOneOp: sync %d writes in node %s",
-			len(realOp.Writes), getNodeIDStr(node))
+	lState := makeFBOLockState()
+	key, p, err := fbo.pathLockKeyForNode(ctx, lState, node)
+	if err != nil {
+		return err
+	}
+	err = fbo.pathLocks.acquire(ctx, node.GetID(), key, owner)
+	if _, ok := errors.Cause(err).(kbfsmd.ServerErrorLocked); ok {
+		return PathLockedError{p}
+	}
+	return err
+}
 
-		changes = append(changes, NodeChange{
-			Node:        node,
-			FileUpdated: realOp.Writes,
-		})
-	case *setAttrOp:
-		node := fbo.nodeCache.Get(realOp.Dir.Ref.Ref())
-		if node == nil {
-			return nil // Nothing to do.
-		}
-		fbo.log.CDebugf(ctx, "notifyOneOp: setAttr %s for file %s in node %s",
-			realOp.Attr, realOp.Name, getNodeIDStr(node))
+func (fbo *folderBranchOps) UnlockPath(
+	ctx context.Context, node Node, owner PathLockOwner) (err error) {
+	fbo.log.CDebugf(ctx, "UnlockPath %s for %d", getNodeIDStr(node), owner)
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "UnlockPath %s done: %+v",
+			getNodeIDStr(node), err)
+	}()
 
-		p, err := fbo.pathFromNodeForRead(node)
-		if err != nil {
-			return err
-		}
+	err = fbo.checkNode(node)
+	if err != nil {
+		return err
+	}
 
-		childNode, err := fbo.blocks.UpdateCachedEntryAttributes(
-			ctx, lState, md, p, realOp)
-		if err != nil {
-			return err
-		}
-		if childNode == nil {
-			return nil // Nothing to do.
-		}
+	return fbo.pathLocks.release(ctx, node.GetID(), owner)
+}
 
-		changes = append(changes, NodeChange{
-			Node: childNode,
-		})
-	case *GCOp:
-		// Unreferenced blocks in a GCOp mean that we shouldn't cache
-		// them anymore
-		fbo.log.CDebugf(ctx, "notifyOneOp: GCOp with latest rev %d and %d unref'd blocks", realOp.LatestRev, len(realOp.Unrefs()))
-		bcache := fbo.config.BlockCache()
-		idsToDelete := make([]kbfsblock.ID, 0, len(realOp.Unrefs()))
-		for _, ptr := range realOp.Unrefs() {
-			idsToDelete = append(idsToDelete, ptr.ID)
-			if err := bcache.DeleteTransient(ptr, fbo.id()); err != nil {
-				fbo.log.CDebugf(ctx,
-					"Couldn't delete transient entry for %v: %v", ptr, err)
-			}
-		}
-		diskCache := fbo.config.DiskBlockCache()
-		if diskCache != nil {
-			go diskCache.Delete(ctx, idsToDelete)
+type cleanupFn func(context.Context, *lockState, []BlockPointer, error)
+
+// startSyncLocked readies the blocks and other state needed to sync a
+// single file.  It returns:
+//
+// * `doSync`: Whether or not the sync should actually happen.
+// * `stillDirty`: Whether the file should still be considered dirty when
+//   this function returns.  (That is, if `doSync` is false, and `stillDirty`
+//   is true, then the file has outstanding changes but the sync was vetoed for
+//   some other reason.)
+// * `fblock`: the root file block for the file being sync'd.
+// * `lbc`: A local block cache consisting of a dirtied version of the parent
+//   directory for this file.
+// * `bps`: All the blocks that need to be put to the server.
+// * `syncState`: Must be passed to the `FinishSyncLocked` call after the
+//   update completes.
+// * `cleanupFn`: A function that, if non-nil, must be called after the sync
+//   is done.  `cleanupFn` should be passed the set of bad blocks that couldn't
+//   be sync'd (if any), and the error.
+// * `err`: The best, greatest return value, everyone says it's absolutely
+//   stunning.
+func (fbo *folderBranchOps) startSyncLocked(ctx context.Context,
+	lState *lockState, md *RootMetadata, node Node, file path) (
+	doSync, stillDirty bool, fblock *FileBlock, lbc localBcache,
+	bps *blockPutState, syncState fileSyncState,
+	cleanup cleanupFn, err error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	// if the cache for this file isn't dirty, we're done
+	if !fbo.blocks.IsDirty(lState, file) {
+		return false, false, nil, nil, nil, fileSyncState{}, nil, nil
+	}
+
+	// If the MD doesn't match the MD expected by the path, that
+	// implies we are using a cached path, which implies the node has
+	// been unlinked.  In that case, we can safely ignore this sync.
+	if fbo.nodeCache.IsUnlinked(node) {
+		fbo.log.CDebugf(ctx, "Skipping sync for a removed file %v",
+			file.tailPointer())
+		// Removing the cached info here is a little sketchy,
+		// since there's no guarantee that this sync comes
+		// from closing the file, and we still want to serve
+		// stat calls accurately if the user still has an open
+		// handle to this file.
+		//
+		// Note in particular that if a file just had a dirty
+		// directory entry cached (due to an attribute change on a
+		// removed file, for example), this will clear that attribute
+		// change.  If there's still an open file handle, the user
+		// won't be able to see the change anymore.
+		//
+		// TODO: Hook this in with the node cache GC logic to be
+		// perfectly accurate (but at the same time, we'd then have to
+		// fix up the intentional panic in the background flusher to
+		// be more tolerant of long-lived dirty, removed files).
+		err := fbo.blocks.ClearCacheInfo(lState, file)
+		if err != nil {
+			return false, false, nil, nil, nil, fileSyncState{}, nil, err
 		}
-	case *resolutionOp:
-		// If there are any unrefs of blocks that have a node, this is an
-		// implied rmOp (see KBFS-1424).
-		reverseUpdates := make(map[BlockPointer]BlockPointer)
-		for _, unref := range op.Unrefs() {
-			node := fbo.nodeCache.Get(unref.Ref())
-			if node == nil {
-				// TODO: even if we don't have the node that was
-				// unreferenced, we might have its parent, and that
-				// parent might need an invalidation.
-				continue
+		fbo.status.rmDirtyNode(node)
+		return false, true, nil, nil, nil, fileSyncState{}, nil, nil
+	}
+
+	if file.isValidForNotification() {
+		// notify the daemon that a write is being performed
+		fbo.config.Reporter().Notify(ctx, writeNotification(file, false))
+		defer fbo.config.Reporter().Notify(ctx, writeNotification(file, true))
+	}
+
+	fblock, bps, lbc, syncState, err =
+		fbo.blocks.StartSync(ctx, lState, md, file)
+	cleanup = func(ctx context.Context, lState *lockState,
+		blocksToRemove []BlockPointer, err error) {
+		fbo.blocks.CleanupSyncState(
+			ctx, lState, md.ReadOnly(), file, blocksToRemove, syncState, err)
+	}
+	if err != nil {
+		return false, true, nil, nil, nil, fileSyncState{}, cleanup, err
+	}
+
+	return true, true, fblock, lbc, bps, syncState, cleanup, nil
+}
+
+func addSelfUpdatesAndParent(
+	p path, op op, parentsToAddChainsFor map[BlockPointer]bool) {
+	for i, pn := range p.path {
+		if i == len(p.path)-1 {
+			op.AddSelfUpdate(pn.BlockPointer)
+		} else {
+			parentsToAddChainsFor[pn.BlockPointer] = true
+		}
+	}
+}
+
+func (fbo *folderBranchOps) syncAllLocked(
+	ctx context.Context, lState *lockState, excl Excl) (err error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	dirtyFiles := fbo.blocks.GetDirtyFileBlockRefs(lState)
+	dirtyDirs := fbo.blocks.GetDirtyDirBlockRefs(lState)
+	if len(dirtyFiles) == 0 && len(dirtyDirs) == 0 {
+		return nil
+	}
+
+	ctx = fbo.config.MaybeStartTrace(ctx, "FBO.SyncAll",
+		fmt.Sprintf("%d files, %d dirs", len(dirtyFiles), len(dirtyDirs)))
+	defer func() { fbo.config.MaybeFinishTrace(ctx, err) }()
+
+	// Verify we have permission to write.  We do this after the dirty
+	// check because otherwise readers who call syncAll would get an
+	// error.
+	md, err := fbo.getSuccessorMDForWriteLocked(ctx, lState)
+	if err != nil {
+		return err
+	}
+
+	bps := newBlockPutState(0)
+	resolvedPaths := make(map[BlockPointer]path)
+	lbc := make(localBcache)
+
+	var cleanups []func(context.Context, *lockState, error)
+	defer func() {
+		for _, cf := range cleanups {
+			cf(ctx, lState, err)
+		}
+	}()
+
+	fbo.log.LazyTrace(ctx, "Syncing %d dir(s)", len(dirtyDirs))
+
+	// First prep all the directories.
+	fbo.log.CDebugf(ctx, "Syncing %d dir(s)", len(dirtyDirs))
+	for _, ref := range dirtyDirs {
+		node := fbo.nodeCache.Get(ref)
+		if node == nil {
+			continue
+		}
+
+		dir := fbo.nodeCache.PathFromNode(node)
+		dblock, err := fbo.blocks.GetDirtyDir(ctx, lState, md, dir, blockWrite)
+		if err != nil {
+			return err
+		}
+
+		lbc[dir.tailPointer()] = dblock
+		if !fbo.nodeCache.IsUnlinked(node) {
+			resolvedPaths[dir.tailPointer()] = dir
+		}
+
+		// On a successful sync, clean up the cached entries and the
+		// dirty blocks.
+		cleanups = append(cleanups,
+			func(ctx context.Context, lState *lockState, err error) {
+				if err != nil {
+					return
+				}
+				fbo.blocks.ClearCachedDirEntry(lState, dir)
+				fbo.status.rmDirtyNode(node)
+			})
+	}
+	defer func() {
+		// If the sync is successful, we can clear out all buffered
+		// directory operations.
+		if err == nil {
+			fbo.dirOps = nil
+		}
+	}()
+
+	fbo.log.LazyTrace(ctx, "Processing %d op(s)", len(fbo.dirOps))
+
+	newBlocks := make(map[BlockPointer]bool)
+	fileBlocks := make(fileBlockMap)
+	parentsToAddChainsFor := make(map[BlockPointer]bool)
+	for _, dop := range fbo.dirOps {
+		// Copy the op before modifying it, in case there's an error
+		// and we have to retry with the original ops.
+		newOp := dop.dirOp.deepCopy()
+		md.AddOp(newOp)
+
+		// Add "updates" for all the op updates, and make chains for
+		// the rest of the parent directories, so they're treated like
+		// updates during the prepping.
+		for _, n := range dop.nodes {
+			p := fbo.nodeCache.PathFromNode(n)
+			if _, ok := newOp.(attrChanger); ok {
+				// For a setattr, the node is the file, but that
+				// doesn't get updated, so use the current parent
+				// node.
+				p = *p.parentPath()
 			}
 
-			// If there is a node, unlink and invalidate.
-			p, err := fbo.pathFromNodeForRead(node)
-			if err != nil {
-				fbo.log.CErrorf(ctx, "Couldn't get path: %v", err)
+			addSelfUpdatesAndParent(p, newOp, parentsToAddChainsFor)
+		}
+
+		var refs []BlockRef
+		switch realOp := newOp.(type) {
+		case *createOp:
+			if realOp.Type == Sym {
 				continue
 			}
-			if !p.hasValidParent() {
-				fbo.log.CErrorf(ctx, "Removed node %s has no parent", p)
+
+			// New files and directories explicitly need
+			// pointer-updating, because the sync process will turn
+			// them into simple refs and will forget about the local,
+			// temporary ID.
+			newNode := dop.nodes[1]
+			newPath := fbo.nodeCache.PathFromNode(newNode)
+			newPointer := newPath.tailPointer()
+			newBlocks[newPointer] = true
+
+			if realOp.Type != Dir {
 				continue
 			}
-			parentPath := p.parentPath()
-			parentNode := fbo.nodeCache.Get(parentPath.tailRef())
-			if parentNode != nil {
-				changes = append(changes, NodeChange{
-					Node:       parentNode,
-					DirUpdated: []string{p.tailName()},
-				})
+
+			dblock, ok := lbc[newPointer]
+			if !ok {
+				// New directories that aren't otherwise dirty need to
+				// be added to both the `lbc` and `resolvedPaths` so
+				// they are properly synced.
+				dblock, err = fbo.blocks.GetDirtyDir(
+					ctx, lState, md, newPath, blockWrite)
+				if err != nil {
+					return err
+				}
+				lbc[newPointer] = dblock
+				if !fbo.nodeCache.IsUnlinked(newNode) {
+					resolvedPaths[newPointer] = newPath
+				}
+			}
+
+			if len(dblock.Children) > 0 {
+				continue
 			}
 
-			fbo.log.CDebugf(ctx, "resolutionOp: remove %s, node %s",
-				p.tailPointer(), getNodeIDStr(node))
-			// Revert the path back to the original BlockPointers,
-			// before the updates were applied.
-			if len(reverseUpdates) == 0 {
-				for _, update := range op.allUpdates() {
-					reverseUpdates[update.Ref] = update.Unref
-				}
-			}
-			for i, pNode := range p.path {
-				if oldPtr, ok := reverseUpdates[pNode.BlockPointer]; ok {
-					p.path[i].BlockPointer = oldPtr
-				}
-			}
-			de, err := fbo.blocks.GetDirtyEntry(ctx, lState, md, p)
-			if err != nil {
-				fbo.log.CDebugf(ctx,
-					"Couldn't get the dir entry for %s/%v: %+v",
-					p, p.tailPointer(), err)
-			}
-			_ = fbo.nodeCache.Unlink(p.tailRef(), p, de)
-		}
-		if len(changes) == 0 {
-			return nil
-		}
+			// If the directory is empty, we need to explicitly clean
+			// up its entry after syncing.
+			refs = append(refs, newPath.tailRef())
+		case *renameOp:
+			refs = append(refs, realOp.Renamed.Ref())
+		case *exchangeOp:
+			refs = append(
+				refs, realOp.Renamed.Ref(), realOp.Exchanged.Ref())
+		case attrChanger:
+			refs = append(refs, realOp.attrOp().File.Ref())
+		default:
+			continue
+		}
+
+		// For create, rename and setattr ops, the target will have a
+		// dirty entry, but may not have any outstanding operations on
+		// it, so it needs to be cleaned up manually.
+		defer func() {
+			if err != nil {
+				return
+			}
+			for _, ref := range refs {
+				wasCleared := fbo.blocks.ClearCachedRef(lState, ref)
+				if wasCleared {
+					node := fbo.nodeCache.Get(ref)
+					if node != nil {
+						fbo.status.rmDirtyNode(node)
+					}
+				}
+			}
+		}()
+	}
+
+	var blocksToRemove []BlockPointer
+	// TODO: find a way to avoid so many dynamic closure dispatches.
+	var afterUpdateFns []func() error
+
+	afterUpdateFns = append(afterUpdateFns, func() error {
+		// Any new files or directories need their pointers explicitly
+		// updated, because the sync will be treating them as a new
+		// ref, and not an update.
+		for _, bs := range bps.blockStates {
+			if newBlocks[bs.oldPtr] {
+				fbo.blocks.updatePointer(
+					md.ReadOnly(), bs.oldPtr, bs.blockPtr, false)
+			}
+		}
+		return nil
+	})
+
+	fbo.log.LazyTrace(ctx, "Syncing %d file(s)", len(dirtyFiles))
+
+	fbo.log.CDebugf(ctx, "Syncing %d file(s)", len(dirtyFiles))
+	fileSyncBlocks := newBlockPutState(1)
+	for _, ref := range dirtyFiles {
+		node := fbo.nodeCache.Get(ref)
+		if node == nil {
+			continue
+		}
+		file := fbo.nodeCache.PathFromNode(node)
+		fbo.log.CDebugf(ctx, "Syncing file %v (%s)", ref, file)
+
+		// Start the sync for this dirty file.
+		doSync, stillDirty, fblock, newLbc, newBps, syncState, cleanup, err :=
+			fbo.startSyncLocked(ctx, lState, md, node, file)
+		if cleanup != nil {
+			// Note: This passes the same `blocksToRemove` into each
+			// cleanup function.  That's ok, as only the ones
+			// pertaining to a particular syncing file will be acted
+			// on.
+			cleanups = append(cleanups,
+				func(ctx context.Context, lState *lockState, err error) {
+					cleanup(ctx, lState, blocksToRemove, err)
+				})
+		}
+		if err != nil {
+			return err
+		}
+		if !doSync {
+			if !stillDirty {
+				fbo.status.rmDirtyNode(node)
+			}
+			continue
+		}
+
+		// Merge the per-file sync info into the batch sync info.
+		bps.mergeOtherBps(newBps)
+		fileSyncBlocks.mergeOtherBps(newBps)
+		resolvedPaths[file.tailPointer()] = file
+		parent := file.parentPath().tailPointer()
+		if _, ok := fileBlocks[parent]; !ok {
+			fileBlocks[parent] = make(map[string]*FileBlock)
+		}
+		fileBlocks[parent][file.tailName()] = fblock
+
+		// Collect its `afterUpdateFn` along with all the others, so
+		// they all get invoked under the same lock, to avoid any
+		// weird races.
+		afterUpdateFns = append(afterUpdateFns, func() error {
+			// This will be called after the node cache is updated, so
+			// this newPath will be correct.
+			newPath := fbo.nodeCache.PathFromNode(node)
+			stillDirty, err := fbo.blocks.FinishSyncLocked(
+				ctx, lState, file, newPath, md.ReadOnly(), syncState, fbo.fbm)
+			if !stillDirty {
+				fbo.status.rmDirtyNode(node)
+			}
+			return err
+		})
+
+		// Add an "update" for all the parent directory updates, and
+		// make a chain for the file itself, so they're treated like
+		// updates during the prepping.
+		lastOp := md.Data().Changes.Ops[len(md.Data().Changes.Ops)-1]
+		addSelfUpdatesAndParent(file, lastOp, parentsToAddChainsFor)
+
+		// Update the combined local block cache with this file's
+		// dirty entry.
+		parentPtr := file.parentPath().tailPointer()
+		if _, ok := lbc[parentPtr]; ok {
+			lbc[parentPtr].Children[file.tailName()] =
+				newLbc[parentPtr].Children[file.tailName()]
+		} else {
+			lbc[parentPtr] = newLbc[parentPtr]
+		}
+	}
+
+	session, err := fbo.config.KBPKI().GetCurrentSession(ctx)
+	if err != nil {
+		return err
+	}
+
+	tempIRMD := ImmutableRootMetadata{
+		ReadOnlyRootMetadata:   md.ReadOnly(),
+		lastWriterVerifyingKey: session.VerifyingKey,
+	}
+
+	fbo.log.LazyTrace(ctx, "Prepping update")
+
+	// Create a set of chains for this batch, a succinct summary of
+	// the file and directory blocks that need to change during this
+	// sync.
+	syncChains, err := newCRChains(
+		ctx, fbo.config.Codec(), []chainMetadata{tempIRMD}, &fbo.blocks, false)
+	if err != nil {
+		return err
+	}
+	for ptr := range parentsToAddChainsFor {
+		syncChains.addNoopChain(ptr)
+	}
+
+	// All originals never made it to the server, so don't unmerged
+	// them.
+	syncChains.doNotUnrefPointers = syncChains.createdOriginals
+	head, _ := fbo.getHead(lState)
+	dummyHeadChains := newCRChainsEmpty()
+	dummyHeadChains.mostRecentChainMDInfo = mostRecentChainMetadataInfo{
+		head, head.Data().Dir.BlockInfo}
+
+	// Squash the batch of updates together into a set of blocks and
+	// ready `md` for putting to the server.
+	md.AddOp(newResolutionOp())
+	_, newBps, blocksToDelete, err := fbo.prepper.prepUpdateForPaths(
+		ctx, lState, md, syncChains, dummyHeadChains, tempIRMD, head,
+		resolvedPaths, lbc, fileBlocks, fbo.config.DirtyBlockCache(),
+		prepFolderDontCopyIndirectFileBlocks)
+	if err != nil {
+		return err
+	}
+	if len(blocksToDelete) > 0 {
+		return errors.Errorf("Unexpectedly found unflushed blocks to delete "+
+			"during syncAllLocked: %v", blocksToDelete)
+	}
+	bps.mergeOtherBps(newBps)
+
+	defer func() {
+		if err != nil {
+			// Remove any blocks that are covered by file syncs --
+			// those might get reused upon sync retry.  All other
+			// blocks are fair game for cleanup though.
+			bps.removeOtherBps(fileSyncBlocks)
+			fbo.fbm.cleanUpBlockState(md.ReadOnly(), bps, blockDeleteOnMDFail)
+		}
+	}()
+
+	// Put all the blocks.
+	blocksToRemove, err = doBlockPuts(ctx, fbo.config.BlockServer(),
+		fbo.config.BlockCache(), fbo.config.Reporter(), fbo.log, fbo.deferLog, md.TlfID(),
+		md.GetTlfHandle().GetCanonicalName(), *bps)
+	if err != nil {
+		return err
+	}
+
+	// Call this under the same blockLock as when the pointers are
+	// updated, so there's never any point in time where a read or
+	// write might slip in after the pointers are updated, but before
+	// the deferred writes are re-applied.
+	afterUpdateFn := func() error {
+		var errs []error
+		for _, auf := range afterUpdateFns {
+			err := auf()
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+		if len(errs) == 1 {
+			return errs[0]
+		} else if len(errs) > 1 {
+			return errors.Errorf("Got errors %+v", errs)
+		}
+		return nil
+	}
+
+	return fbo.finalizeMDWriteLocked(ctx, lState, md, bps, excl,
+		func(md ImmutableRootMetadata) error {
+			// Just update the pointers using the resolutionOp, all
+			// the ops have already been notified.
+			err = fbo.blocks.UpdatePointers(
+				md, lState, md.data.Changes.Ops[0], false, afterUpdateFn)
+			if err != nil {
+				return err
+			}
+
+			fbo.editHistory.UpdateHistory(ctx, []ImmutableRootMetadata{md})
+			return nil
+		})
+}
+
+func (fbo *folderBranchOps) syncAllUnlocked(
+	ctx context.Context, lState *lockState) error {
+	fbo.mdWriterLock.Lock(lState)
+	defer fbo.mdWriterLock.Unlock(lState)
+	return fbo.syncAllLocked(ctx, lState, NoExcl)
+}
+
+// SyncAll implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) SyncAll(
+	ctx context.Context, folderBranch FolderBranch) (err error) {
+	fbo.log.CDebugf(ctx, "SyncAll")
+	defer func() { fbo.deferLog.CDebugf(ctx, "SyncAll done: %+v", err) }()
+
+	if folderBranch != fbo.folderBranch {
+		return WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+
+	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			return fbo.syncAllLocked(ctx, lState, NoExcl)
+		})
+}
+
+func (fbo *folderBranchOps) FolderStatus(
+	ctx context.Context, folderBranch FolderBranch) (
+	fbs FolderBranchStatus, updateChan <-chan StatusUpdate, err error) {
+	fbo.log.CDebugf(ctx, "Status")
+	defer func() { fbo.deferLog.CDebugf(ctx, "Status done: %+v", err) }()
+
+	if folderBranch != fbo.folderBranch {
+		return FolderBranchStatus{}, nil,
+			WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+
+	fbs, updateChan, err = fbo.status.getStatus(ctx, &fbo.blocks)
+	if err != nil {
+		return FolderBranchStatus{}, nil, err
+	}
+
+	lState := makeFBOLockState()
+	head := fbo.getTrustedHead(lState)
+	if head != (ImmutableRootMetadata{}) {
+		conflicts, err := fbo.conflictLog.getRecords(ctx, head)
+		if err != nil {
+			fbo.log.CWarningf(ctx, "Error getting conflict records: %+v",
+				err)
+		} else {
+			fbs.Conflicts = conflicts
+		}
+	}
+	fbs.ManualConflictResolution =
+		fbo.config.IsManualConflictResolution(fbo.id())
+	if bid := fbo.getParkedBranchID(lState); bid != NullBranchID {
+		fbs.ParkedBranchID = bid.String()
+	}
+	fbs.Pins = fbo.pinner.getStatus()
+	return fbs, updateChan, nil
+}
+
+func (fbo *folderBranchOps) Status(
+	ctx context.Context) (
+	fbs KBFSStatus, updateChan <-chan StatusUpdate, err error) {
+	return KBFSStatus{}, nil, InvalidOpError{}
+}
+
+// RegisterForChanges registers a single Observer to receive
+// notifications about this folder/branch.
+func (fbo *folderBranchOps) RegisterForChanges(obs Observer) error {
+	// It's the caller's responsibility to make sure
+	// RegisterForChanges isn't called twice for the same Observer
+	fbo.observers.add(obs)
+	return nil
+}
+
+// UnregisterFromChanges stops an Observer from getting notifications
+// about the folder/branch.
+func (fbo *folderBranchOps) UnregisterFromChanges(obs Observer) error {
+	fbo.observers.remove(obs)
+	return nil
+}
+
+// notifyBatchLocked sends out a notification for all the ops in md.
+func (fbo *folderBranchOps) notifyBatchLocked(
+	ctx context.Context, lState *lockState, md ImmutableRootMetadata) error {
+	fbo.headLock.AssertLocked(lState)
+
+	for _, op := range md.data.Changes.Ops {
+		err := fbo.notifyOneOpLocked(ctx, lState, op, md.ReadOnly(), false)
+		if err != nil {
+			return err
+		}
+	}
+	fbo.editHistory.UpdateHistory(ctx, []ImmutableRootMetadata{md})
+	return nil
+}
+
+// searchForNode tries to figure out the path to the given
+// blockPointer, using only the block updates that happened as part of
+// a given MD update operation.
+func (fbo *folderBranchOps) searchForNode(ctx context.Context,
+	ptr BlockPointer, md ReadOnlyRootMetadata) (Node, error) {
+	// Record which pointers are new to this update, and thus worth
+	// searching.
+	newPtrs := make(map[BlockPointer]bool)
+	for _, op := range md.data.Changes.Ops {
+		for _, update := range op.allUpdates() {
+			newPtrs[update.Ref] = true
+		}
+		for _, ref := range op.Refs() {
+			newPtrs[ref] = true
+		}
+	}
+
+	nodeMap, _, err := fbo.blocks.SearchForNodes(ctx, fbo.nodeCache,
+		[]BlockPointer{ptr}, newPtrs, md, md.data.Dir.BlockPointer)
+	if err != nil {
+		return nil, err
+	}
+
+	n, ok := nodeMap[ptr]
+	if !ok {
+		return nil, NodeNotFoundError{ptr}
+	}
+
+	return n, nil
+}
+
+func (fbo *folderBranchOps) getUnlinkPathBeforeUpdatingPointers(
+	ctx context.Context, lState *lockState, md ReadOnlyRootMetadata, op op) (
+	unlinkPath path, unlinkDe DirEntry, toUnlink bool, err error) {
+	if len(md.data.Changes.Ops) == 0 {
+		return path{}, DirEntry{}, false, errors.New("md needs at least one op")
+	}
+
+	var node Node
+	var childName string
+
+	requireResFix := false
+	switch realOp := op.(type) {
+	case *rmOp:
+		if realOp.Dir.Ref == realOp.Dir.Unref {
+			requireResFix = true
+		}
+		node = fbo.nodeCache.Get(realOp.Dir.Unref.Ref())
+		childName = realOp.OldName
+	case *exchangeOp:
+		// The entry at the new name moved to the old name, so
+		// nothing was unlinked.
+		return path{}, DirEntry{}, false, nil
+	case *renameOp:
+		if realOp.NewDir.Unref != zeroPtr {
+			// moving to a new dir
+			if realOp.NewDir.Ref == realOp.NewDir.Unref {
+				requireResFix = true
+			}
+			node = fbo.nodeCache.Get(realOp.NewDir.Unref.Ref())
+		} else {
+			// moving to the same dir
+			if realOp.OldDir.Ref == realOp.OldDir.Unref {
+				requireResFix = true
+			}
+			node = fbo.nodeCache.Get(realOp.OldDir.Unref.Ref())
+		}
+		childName = realOp.NewName
+	}
+	if node == nil {
+		return path{}, DirEntry{}, false, nil
+	}
+
+	p, err := fbo.pathFromNodeForRead(node)
+	if err != nil {
+		return path{}, DirEntry{}, false, err
+	}
+
+	// If the first op in this MD update is a resolutionOp, we need to
+	// inspect it to look for the *real* original pointer for this
+	// node.
+	if resOp, ok := md.data.Changes.Ops[0].(*resolutionOp); ok {
+		for _, update := range resOp.allUpdates() {
+			if update.Ref == p.tailPointer() {
+				fbo.log.CDebugf(ctx,
+					"Backing up ptr %v in op %s to original pointer %v",
+					p.tailPointer(), op, update.Unref)
+				p.path[len(p.path)-1].BlockPointer = update.Unref
+				requireResFix = false
+				break
+			}
+		}
+	}
+
+	if requireResFix {
+		// If we didn't fix up the pointer using a resolutionOp, the
+		// directory was likely created during this md update, and so
+		// no unlinking is needed.
+		fbo.log.CDebugf(ctx,
+			"Ignoring unlink when resolutionOp never fixed up %v",
+			p.tailPointer())
+		return path{}, DirEntry{}, false, nil
+	}
+
+	// If the original (clean) parent block is already GC'd from the
+	// server, this might not work, but hopefully we'd be
+	// fast-forwarding in that case anyway.
+	dblock, err := fbo.blocks.GetDir(ctx, lState, md, p, blockRead)
+	if err != nil {
+		fbo.log.CDebugf(ctx, "Couldn't get the dir entry for %s in %v: %+v",
+			childName, p.tailPointer(), err)
+		return path{}, DirEntry{}, false, nil
+	}
+	de, ok := dblock.Children[childName]
+	if !ok {
+		return path{}, DirEntry{}, false, nil
+	}
+	if isRenamedInMD(md, de.BlockPointer) {
+		// Conflict resolution splits an exchange into two renames,
+		// so the first one looks like it replaces an entry that the
+		// second one just moves.
+		fbo.log.CDebugf(ctx, "Ignoring unlink of %s, which is renamed "+
+			"by another op", childName)
+		return path{}, DirEntry{}, false, nil
+	}
+	childPath := p.ChildPath(childName, de.BlockPointer)
+	return childPath, de, true, nil
+}
+
+// isRenamedInMD returns whether any rename op in the given MD moves
+// the entry with the given (pre-update) pointer.
+func isRenamedInMD(md ReadOnlyRootMetadata, ptr BlockPointer) bool {
+	ptrs := map[BlockPointer]bool{ptr: true}
+	if resOp, ok := md.data.Changes.Ops[0].(*resolutionOp); ok {
+		for _, update := range resOp.allUpdates() {
+			if update.Unref == ptr {
+				ptrs[update.Ref] = true
+			}
+		}
+	}
+	for _, op := range md.data.Changes.Ops {
+		switch realOp := op.(type) {
+		case *renameOp:
+			if ptrs[realOp.Renamed] {
+				return true
+			}
+		case *exchangeOp:
+			if ptrs[realOp.Renamed] || ptrs[realOp.Exchanged] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (fbo *folderBranchOps) notifyOneOpLocked(ctx context.Context,
+	lState *lockState, op op, md ReadOnlyRootMetadata,
+	shouldPrefetch bool) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+	fbo.headLock.AssertLocked(lState)
+
+	if fbo.config.Mode() == InitMinimal {
+		// There is no node cache in minimal mode, so there's nothing
+		// to update.
+		return nil
+	}
+
+	// We need to get unlinkPath before calling UpdatePointers so that
+	// nodeCache.Unlink can properly update cachedPath.
+	unlinkPath, unlinkDe, toUnlink, err :=
+		fbo.getUnlinkPathBeforeUpdatingPointers(ctx, lState, md.ReadOnly(), op)
+	if err != nil {
+		return err
+	}
+
+	err = fbo.blocks.UpdatePointers(md, lState, op, shouldPrefetch, nil)
+	if err != nil {
+		return err
+	}
+
+	var changes []NodeChange
+	switch realOp := op.(type) {
+	default:
+		fbo.log.CDebugf(ctx, "Unknown op: %s", op)
+		return nil
+	case *createOp:
+		node := fbo.nodeCache.Get(realOp.Dir.Ref.Ref())
+		if node == nil {
+			return nil // Nothing to do.
+		}
+		fbo.log.CDebugf(ctx, "notifyOneOp: create %s in node %s",
+			realOp.NewName, getNodeIDStr(node))
+		changes = append(changes, NodeChange{
+			Node:       node,
+			DirUpdated: []string{realOp.NewName},
+		})
+	case *rmOp:
+		node := fbo.nodeCache.Get(realOp.Dir.Ref.Ref())
+		if node == nil {
+			return nil // Nothing to do.
+		}
+		fbo.log.CDebugf(ctx, "notifyOneOp: remove %s in node %s",
+			realOp.OldName, getNodeIDStr(node))
+		changes = append(changes, NodeChange{
+			Node:       node,
+			DirUpdated: []string{realOp.OldName},
+		})
+
+		// If this node exists, then the child node might exist too,
+		// and we need to unlink it in the node cache.
+		if toUnlink {
+			_ = fbo.nodeCache.Unlink(unlinkDe.Ref(), unlinkPath, unlinkDe)
+		}
+	case entryMover:
+		ro := realOp.moveOp()
+		oldNode := fbo.nodeCache.Get(ro.OldDir.Ref.Ref())
+		if oldNode != nil {
+			changes = append(changes, NodeChange{
+				Node:       oldNode,
+				DirUpdated: []string{ro.OldName},
+			})
+		}
+		var newNode Node
+		if ro.NewDir.Ref != zeroPtr {
+			newNode = fbo.nodeCache.Get(ro.NewDir.Ref.Ref())
+			if newNode != nil {
+				changes = append(changes, NodeChange{
+					Node:       newNode,
+					DirUpdated: []string{ro.NewName},
+				})
+			}
+		} else {
+			newNode = oldNode
+			if oldNode != nil {
+				// Add another name to the existing NodeChange.
+				changes[len(changes)-1].DirUpdated =
+					append(changes[len(changes)-1].DirUpdated, ro.NewName)
+			}
+		}
+
+		if oldNode != nil {
+			fbo.log.CDebugf(ctx, "notifyOneOp: rename %v from %s/%s to %s/%s",
+				ro.Renamed, ro.OldName, getNodeIDStr(oldNode),
+				ro.NewName, getNodeIDStr(newNode))
+
+			if newNode == nil {
+				if childNode :=
+					fbo.nodeCache.Get(ro.Renamed.Ref()); childNode != nil {
+					// if the childNode exists, we still have to update
+					// its path to go through the new node.  That means
+					// creating nodes for all the intervening paths.
+					// Unfortunately we don't have enough information to
+					// know what the newPath is; we have to guess it from
+					// the updates.
+					var err error
+					newNode, err =
+						fbo.searchForNode(ctx, ro.NewDir.Ref, md)
+					if newNode == nil {
+						fbo.log.CErrorf(ctx, "Couldn't find the new node: %v",
+							err)
+					}
+				}
+			}
+
+			if newNode != nil {
+				if toUnlink {
+					_ = fbo.nodeCache.Unlink(
+						unlinkDe.Ref(), unlinkPath, unlinkDe)
+				}
+				_, err := fbo.nodeCache.Move(
+					ro.Renamed.Ref(), newNode, ro.NewName)
+				if err != nil {
+					return err
+				}
+			}
+
+			if xo, ok := realOp.(*exchangeOp); ok {
+				_, err := fbo.nodeCache.Move(
+					xo.Exchanged.Ref(), oldNode, xo.OldName)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	case *syncOp:
+		node := fbo.nodeCache.Get(realOp.File.Ref.Ref())
+		if node == nil {
+			return nil // Nothing to do.
+		}
+		fbo.log.CDebugf(ctx, "notifyOneOp: sync %d writes in node %s",
+			len(realOp.Writes), getNodeIDStr(node))
+
+		changes = append(changes, NodeChange{
+			Node:        node,
+			FileUpdated: realOp.Writes,
+		})
+	case attrChanger:
+		sao := realOp.attrOp()
+		node := fbo.nodeCache.Get(sao.Dir.Ref.Ref())
+		if node == nil {
+			return nil // Nothing to do.
+		}
+		fbo.log.CDebugf(ctx, "notifyOneOp: setAttr %s for file %s in node %s",
+			sao.Attr, sao.Name, getNodeIDStr(node))
+
+		p, err := fbo.pathFromNodeForRead(node)
+		if err != nil {
+			return err
+		}
+
+		childNode, err := fbo.blocks.UpdateCachedEntryAttributes(
+			ctx, lState, md, p, sao)
+		if err != nil {
+			return err
+		}
+		if childNode == nil {
+			return nil // Nothing to do.
+		}
+
+		changes = append(changes, NodeChange{
+			Node: childNode,
+		})
+	case *GCOp:
+		// Unreferenced blocks in a GCOp mean that we shouldn't cache
+		// them anymore
+		fbo.log.CDebugf(ctx, "notifyOneOp: GCOp with latest rev %d and %d unref'd blocks", realOp.LatestRev, len(realOp.Unrefs()))
+		bcache := fbo.config.BlockCache()
+		idsToDelete := make([]kbfsblock.ID, 0, len(realOp.Unrefs()))
+		for _, ptr := range realOp.Unrefs() {
+			idsToDelete = append(idsToDelete, ptr.ID)
+			if err := bcache.DeleteTransient(ptr, fbo.id()); err != nil {
+				fbo.log.CDebugf(ctx,
+					"Couldn't delete transient entry for %v: %v", ptr, err)
+			}
+		}
+		diskCache := fbo.config.DiskBlockCache()
+		if diskCache != nil {
+			go diskCache.Delete(ctx, idsToDelete)
+		}
+	case *resolutionOp:
+		// If there are any unrefs of blocks that have a node, this is an
+		// implied rmOp (see KBFS-1424).
+		reverseUpdates := make(map[BlockPointer]BlockPointer)
+		for _, unref := range op.Unrefs() {
+			node := fbo.nodeCache.Get(unref.Ref())
+			if node == nil {
+				// TODO: even if we don't have the node that was
+				// unreferenced, we might have its parent, and that
+				// parent might need an invalidation.
+				continue
+			}
+
+			// If there is a node, unlink and invalidate.
+			p, err := fbo.pathFromNodeForRead(node)
+			if err != nil {
+				fbo.log.CErrorf(ctx, "Couldn't get path: %v", err)
+				continue
+			}
+			if !p.hasValidParent() {
+				fbo.log.CErrorf(ctx, "Removed node %s has no parent", p)
+				continue
+			}
+			parentPath := p.parentPath()
+			parentNode := fbo.nodeCache.Get(parentPath.tailRef())
+			if parentNode != nil {
+				changes = append(changes, NodeChange{
+					Node:       parentNode,
+					DirUpdated: []string{p.tailName()},
+				})
+			}
+
+			fbo.log.CDebugf(ctx, "resolutionOp: remove %s, node %s",
+				p.tailPointer(), getNodeIDStr(node))
+			// Revert the path back to the original BlockPointers,
+			// before the updates were applied.
+			if len(reverseUpdates) == 0 {
+				for _, update := range op.allUpdates() {
+					reverseUpdates[update.Ref] = update.Unref
+				}
+			}
+			for i, pNode := range p.path {
+				if oldPtr, ok := reverseUpdates[pNode.BlockPointer]; ok {
+					p.path[i].BlockPointer = oldPtr
+				}
+			}
+			de, err := fbo.blocks.GetDirtyEntry(ctx, lState, md, p)
+			if err != nil {
+				fbo.log.CDebugf(ctx,
+					"Couldn't get the dir entry for %s/%v: %+v",
+					p, p.tailPointer(), err)
+			}
+			_ = fbo.nodeCache.Unlink(p.tailRef(), p, de)
+		}
+		if len(changes) == 0 {
+			return nil
+		}
+	}
+
+	fbo.observers.batchChanges(ctx, changes)
+	return nil
+}
+
+func (fbo *folderBranchOps) notifyOneOp(ctx context.Context,
+	lState *lockState, op op, md ReadOnlyRootMetadata,
+	shouldPrefetch bool) error {
+	fbo.headLock.Lock(lState)
+	defer fbo.headLock.Unlock(lState)
+	return fbo.notifyOneOpLocked(ctx, lState, op, md, shouldPrefetch)
+}
+
+func (fbo *folderBranchOps) getCurrMDRevisionLocked(lState *lockState) kbfsmd.Revision {
+	fbo.headLock.AssertAnyLocked(lState)
+
+	if fbo.head != (ImmutableRootMetadata{}) {
+		return fbo.head.Revision()
+	}
+	return kbfsmd.RevisionUninitialized
+}
+
+func (fbo *folderBranchOps) getCurrMDRevision(
+	lState *lockState) kbfsmd.Revision {
+	fbo.headLock.RLock(lState)
+	defer fbo.headLock.RUnlock(lState)
+	return fbo.getCurrMDRevisionLocked(lState)
+}
+
+type applyMDUpdatesFunc func(context.Context, *lockState, []ImmutableRootMetadata) error
+
+func (fbo *folderBranchOps) applyMDUpdatesLocked(ctx context.Context,
+	lState *lockState, rmds []ImmutableRootMetadata) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	// If there's anything in the journal, don't apply these MDs.
+	// Wait for CR to happen.
+	if fbo.isMasterBranchLocked(lState) {
+		mergedRev, err := fbo.getJournalPredecessorRevision(ctx)
+		if err != nil {
+			return err
+		}
+		if mergedRev != kbfsmd.RevisionUninitialized {
+			if len(rmds) > 0 {
+				// We should update our view of the merged master though,
+				// to avoid re-registering for the same updates again.
+				func() {
+					fbo.headLock.Lock(lState)
+					defer fbo.headLock.Unlock(lState)
+					fbo.setLatestMergedRevisionLocked(
+						ctx, lState, rmds[len(rmds)-1].Revision(), false)
+				}()
+			}
+
+			fbo.log.CDebugf(ctx,
+				"Ignoring fetched revisions while MDs are in journal")
+			return nil
+		}
+	}
+
+	fbo.headLock.Lock(lState)
+	defer fbo.headLock.Unlock(lState)
+
+	// if we have staged changes, ignore all updates until conflict
+	// resolution kicks in.  TODO: cache these for future use.
+	if !fbo.isMasterBranchLocked(lState) {
+		if len(rmds) > 0 {
+			latestMerged := rmds[len(rmds)-1]
+			// Don't trust un-put updates here because they might have
+			// come from our own journal before the conflict was
+			// detected.  Assume we'll hear about the conflict via
+			// callbacks from the journal.
+			if !latestMerged.putToServer {
+				return UnmergedError{}
+			}
+
+			// setHeadLocked takes care of merged case
+			fbo.setLatestMergedRevisionLocked(
+				ctx, lState, latestMerged.Revision(), false)
+
+			unmergedRev := kbfsmd.RevisionUninitialized
+			if fbo.head != (ImmutableRootMetadata{}) {
+				unmergedRev = fbo.head.Revision()
+			}
+			fbo.cr.Resolve(ctx, unmergedRev, latestMerged.Revision())
+		}
+		return UnmergedError{}
+	}
+
+	// Don't allow updates while we're in the dirty state; the next
+	// sync will put us into an unmerged state anyway and we'll
+	// require conflict resolution.
+	if fbo.blocks.GetState(lState) != cleanState {
+		return errors.WithStack(NoUpdatesWhileDirtyError{})
+	}
+
+	appliedRevs := make([]ImmutableRootMetadata, 0, len(rmds))
+	for _, rmd := range rmds {
+		// check that we're applying the expected MD revision
+		if rmd.Revision() <= fbo.getCurrMDRevisionLocked(lState) {
+			// Already caught up!
+			continue
+		}
+		if err := isReadableOrError(ctx, fbo.config.KBPKI(), rmd.ReadOnly()); err != nil {
+			return err
+		}
+
+		err := fbo.setHeadSuccessorLocked(ctx, lState, rmd, false)
+		if err != nil {
+			return err
+		}
+		// No new operations in these.
+		if rmd.IsWriterMetadataCopiedSet() {
+			continue
+		}
+		for _, op := range rmd.data.Changes.Ops {
+			err := fbo.notifyOneOpLocked(ctx, lState, op, rmd.ReadOnly(), true)
+			if err != nil {
+				return err
+			}
+		}
+		if rmd.IsRekeySet() {
+			// One might have concern that a MD update written by the device
+			// itself can slip in here, for example during the rekey after
+			// setting paper prompt, and the event may cause the paper prompt
+			// to be unset. This is not a problem because 1) the revision check
+			// above shouldn't allow MD update written by this device to reach
+			// here; 2) the rekey FSM doesn't touch anything if it has the
+			// paper prompt set and is in scheduled state.
+			fbo.rekeyFSM.Event(NewRekeyRequestEvent())
+		} else {
+			fbo.rekeyFSM.Event(NewRekeyNotNeededEvent())
+		}
+		appliedRevs = append(appliedRevs, rmd)
+	}
+	if len(appliedRevs) > 0 {
+		fbo.editHistory.UpdateHistory(ctx, appliedRevs)
+	}
+	return nil
+}
+
+func (fbo *folderBranchOps) undoMDUpdatesLocked(ctx context.Context,
+	lState *lockState, rmds []ImmutableRootMetadata) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	fbo.headLock.Lock(lState)
+	defer fbo.headLock.Unlock(lState)
+
+	// Don't allow updates while we're in the dirty state; the next
+	// sync will put us into an unmerged state anyway and we'll
+	// require conflict resolution.
+	if fbo.blocks.GetState(lState) != cleanState {
+		return NotPermittedWhileDirtyError{}
+	}
+
+	// go backwards through the updates
+	for i := len(rmds) - 1; i >= 0; i-- {
+		rmd := rmds[i]
+		// on undo, it's ok to re-apply the current revision since you
+		// need to invert all of its ops.
+		//
+		// This duplicates a check in
+		// fbo.setHeadPredecessorLocked. TODO: Remove this
+		// duplication.
+		if rmd.Revision() != fbo.getCurrMDRevisionLocked(lState) &&
+			rmd.Revision() != fbo.getCurrMDRevisionLocked(lState)-1 {
+			return MDUpdateInvertError{rmd.Revision(),
+				fbo.getCurrMDRevisionLocked(lState)}
+		}
+
+		// TODO: Check that the revisions are equal only for
+		// the first iteration.
+		if rmd.Revision() < fbo.getCurrMDRevisionLocked(lState) {
+			err := fbo.setHeadPredecessorLocked(ctx, lState, rmd)
+			if err != nil {
+				return err
+			}
+		}
+
+		err := fbo.notifyInvertedOpsLocked(ctx, lState, rmd)
+		if err != nil {
+			return err
+		}
+	}
+	// TODO: update the edit history?
+	return nil
+}
+
+// notifyInvertedOpsLocked notifies the local node cache and any
+// observers as if the ops in the given MD were being undone.
+func (fbo *folderBranchOps) notifyInvertedOpsLocked(ctx context.Context,
+	lState *lockState, rmd ImmutableRootMetadata) error {
+	fbo.headLock.AssertLocked(lState)
+
+	// iterate the ops in reverse and invert each one
+	ops := rmd.data.Changes.Ops
+	for j := len(ops) - 1; j >= 0; j-- {
+		io, err := invertOpForLocalNotifications(ops[j])
+		if err != nil {
+			fbo.log.CWarningf(ctx,
+				"got error %v when invert op %v; "+
+					"skipping. Open file handles "+
+					"may now be in an invalid "+
+					"state, which can be fixed by "+
+					"either closing them all or "+
+					"restarting KBFS.",
+				err, ops[j])
+			continue
+		}
+		err = fbo.notifyOneOpLocked(ctx, lState, io, rmd.ReadOnly(), false)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fbo *folderBranchOps) applyMDUpdates(ctx context.Context,
+	lState *lockState, rmds []ImmutableRootMetadata) error {
+	fbo.mdWriterLock.Lock(lState)
+	defer fbo.mdWriterLock.Unlock(lState)
+	return fbo.applyMDUpdatesLocked(ctx, lState, rmds)
+}
+
+func (fbo *folderBranchOps) getLatestMergedRevision(lState *lockState) kbfsmd.Revision {
+	fbo.headLock.RLock(lState)
+	defer fbo.headLock.RUnlock(lState)
+	return fbo.latestMergedRevision
+}
+
+// caller should have held fbo.headLock
+func (fbo *folderBranchOps) setLatestMergedRevisionLocked(ctx context.Context, lState *lockState, rev kbfsmd.Revision, allowBackward bool) {
+	fbo.headLock.AssertLocked(lState)
+	if rev == kbfsmd.RevisionUninitialized {
+		panic("Cannot set latest merged revision to an uninitialized value")
+	}
+
+	if fbo.latestMergedRevision < rev || allowBackward {
+		fbo.latestMergedRevision = rev
+		fbo.log.CDebugf(ctx, "Updated latestMergedRevision to %d.", rev)
+	} else {
+		fbo.log.CDebugf(ctx, "Local latestMergedRevision (%d) is higher than "+
+			"the new revision (%d); won't update.", fbo.latestMergedRevision, rev)
+	}
+}
+
+// Assumes all necessary locking is either already done by caller, or
+// is done by applyFunc.
+func (fbo *folderBranchOps) getAndApplyMDUpdates(ctx context.Context,
+	lState *lockState, applyFunc applyMDUpdatesFunc) error {
+	// first look up all MD revisions newer than my current head
+	start := fbo.getLatestMergedRevision(lState) + 1
+	rmds, err := getMergedMDUpdates(ctx, fbo.config, fbo.id(), start)
+	if err != nil {
+		return err
+	}
+
+	err = applyFunc(ctx, lState, rmds)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (fbo *folderBranchOps) getAndApplyNewestUnmergedHead(ctx context.Context,
+	lState *lockState) error {
+	fbo.log.CDebugf(ctx, "Fetching the newest unmerged head")
+	bid := func() BranchID {
+		fbo.mdWriterLock.Lock(lState)
+		defer fbo.mdWriterLock.Unlock(lState)
+		return fbo.bid
+	}()
+
+	// We can only ever be at most one revision behind, so fetch the
+	// latest unmerged revision and apply it as a successor.
+	md, err := fbo.config.MDOps().GetUnmergedForTLF(ctx, fbo.id(), bid)
+	if err != nil {
+		return err
+	}
+
+	if md == (ImmutableRootMetadata{}) {
+		// There is no unmerged revision, oops!
+		return errors.New("Couldn't find an unmerged head")
+	}
+
+	fbo.mdWriterLock.Lock(lState)
+	defer fbo.mdWriterLock.Unlock(lState)
+	if fbo.bid != bid {
+		// The branches switched (apparently CR completed), so just
+		// try again.
+		fbo.log.CDebugf(ctx, "Branches switched while fetching unmerged head")
+		return nil
+	}
+
+	fbo.headLock.Lock(lState)
+	defer fbo.headLock.Unlock(lState)
+	if err := fbo.setHeadSuccessorLocked(ctx, lState, md, false); err != nil {
+		return err
+	}
+	if err := fbo.notifyBatchLocked(ctx, lState, md); err != nil {
+		return err
+	}
+	if err := fbo.config.MDCache().Put(md); err != nil {
+		return err
+	}
+	return nil
+}
+
+// getUnmergedMDUpdates returns a slice of the unmerged MDs for this
+// TLF's current unmerged branch and unmerged branch, between the
+// merge point for the branch and the current head.  The returned MDs
+// are the same instances that are stored in the MD cache, so they
+// should be modified with care.
+func (fbo *folderBranchOps) getUnmergedMDUpdates(
+	ctx context.Context, lState *lockState) (
+	kbfsmd.Revision, []ImmutableRootMetadata, error) {
+	// acquire mdWriterLock to read the current branch ID.
+	bid := func() BranchID {
+		fbo.mdWriterLock.Lock(lState)
+		defer fbo.mdWriterLock.Unlock(lState)
+		return fbo.bid
+	}()
+	return getUnmergedMDUpdates(ctx, fbo.config, fbo.id(),
+		bid, fbo.getCurrMDRevision(lState))
+}
+
+func (fbo *folderBranchOps) getUnmergedMDUpdatesLocked(
+	ctx context.Context, lState *lockState) (
+	kbfsmd.Revision, []ImmutableRootMetadata, error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	return getUnmergedMDUpdates(ctx, fbo.config, fbo.id(),
+		fbo.bid, fbo.getCurrMDRevision(lState))
+}
+
+// Returns a list of block pointers that were created during the
+// staged era.
+func (fbo *folderBranchOps) undoUnmergedMDUpdatesLocked(
+	ctx context.Context, lState *lockState) ([]BlockPointer, error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	currHead, unmergedRmds, err := fbo.getUnmergedMDUpdatesLocked(ctx, lState)
+	if err != nil {
+		return nil, err
+	}
+
+	err = fbo.undoMDUpdatesLocked(ctx, lState, unmergedRmds)
+	if err != nil {
+		return nil, err
+	}
+
+	// We have arrived at the branch point.  The new root is
+	// the previous revision from the current head.  Find it
+	// and apply.  TODO: somehow fake the current head into
+	// being currHead-1, so that future calls to
+	// applyMDUpdates will fetch this along with the rest of
+	// the updates.
+	fbo.setBranchIDLocked(lState, NullBranchID)
+
+	rmd, err := getSingleMD(ctx, fbo.config, fbo.id(), NullBranchID,
+		currHead, Merged)
+	if err != nil {
+		return nil, err
+	}
+	err = func() error {
+		fbo.headLock.Lock(lState)
+		defer fbo.headLock.Unlock(lState)
+		err = fbo.setHeadPredecessorLocked(ctx, lState, rmd)
+		if err != nil {
+			return err
+		}
+		fbo.setLatestMergedRevisionLocked(ctx, lState, rmd.Revision(), true)
+		return nil
+	}()
+	if err != nil {
+		return nil, err
+	}
+
+	// Return all new refs
+	return unmergedRefs(unmergedRmds), nil
+}
+
+// unmergedRefs returns all the block pointers that were created by
+// the given unmerged MDs.
+func unmergedRefs(unmergedRmds []ImmutableRootMetadata) []BlockPointer {
+	var unmergedPtrs []BlockPointer
+	for _, rmd := range unmergedRmds {
+		for _, op := range rmd.data.Changes.Ops {
+			for _, ptr := range op.Refs() {
+				if ptr != zeroPtr {
+					unmergedPtrs = append(unmergedPtrs, ptr)
+				}
+			}
+			for _, update := range op.allUpdates() {
+				if update.Ref != zeroPtr {
+					unmergedPtrs = append(unmergedPtrs, update.Ref)
+				}
+			}
+		}
+	}
+	return unmergedPtrs
+}
+
+func (fbo *folderBranchOps) unstageLocked(ctx context.Context,
+	lState *lockState) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	// fetch all of my unstaged updates, and undo them one at a time
+	bid, wasMasterBranch := fbo.bid, fbo.isMasterBranchLocked(lState)
+	unmergedPtrs, err := fbo.undoUnmergedMDUpdatesLocked(ctx, lState)
+	if err != nil {
+		return err
+	}
+
+	// let the server know we no longer have need
+	if !wasMasterBranch {
+		err = fbo.config.MDOps().PruneBranch(ctx, fbo.id(), bid)
+		if err != nil {
+			return err
+		}
+	}
+
+	// now go forward in time, if possible
+	err = fbo.getAndApplyMDUpdates(ctx, lState,
+		fbo.applyMDUpdatesLocked)
+	if err != nil {
+		return err
+	}
+
+	return fbo.unrefUnmergedBlocksLocked(ctx, lState, unmergedPtrs)
+}
+
+// unrefUnmergedBlocksLocked writes a new merged revision that
+// unreferences the given blocks, which were created on an unmerged
+// branch that has been thrown away.
+func (fbo *folderBranchOps) unrefUnmergedBlocksLocked(ctx context.Context,
+	lState *lockState, unmergedPtrs []BlockPointer) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	md, err := fbo.getSuccessorMDForWriteLocked(ctx, lState)
+	if err != nil {
+		return err
+	}
+
+	// Finally, create a resolutionOp with the newly-unref'd pointers.
+	resOp := newResolutionOp()
+	for _, ptr := range unmergedPtrs {
+		resOp.AddUnrefBlock(ptr)
+	}
+	md.AddOp(resOp)
+
+	bps, err := fbo.maybeUnembedAndPutBlocks(ctx, md)
+	if err != nil {
+		return err
+	}
+
+	return fbo.finalizeMDWriteLocked(ctx, lState, md, bps, NoExcl,
+		func(md ImmutableRootMetadata) error {
+			return fbo.notifyBatchLocked(ctx, lState, md)
+		})
+}
+
+// TODO: remove once we have automatic conflict resolution
+func (fbo *folderBranchOps) UnstageForTesting(
+	ctx context.Context, folderBranch FolderBranch) (err error) {
+	fbo.log.CDebugf(ctx, "UnstageForTesting")
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "UnstageForTesting done: %+v", err)
+	}()
+
+	if folderBranch != fbo.folderBranch {
+		return WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+
+	return runUnlessCanceled(ctx, func() error {
+		lState := makeFBOLockState()
+
+		if fbo.isMasterBranch(lState) {
+			// no-op
+			return nil
+		}
+
+		if fbo.blocks.GetState(lState) != cleanState {
+			return NotPermittedWhileDirtyError{}
+		}
+
+		// launch unstaging in a new goroutine, because we don't want to
+		// use the provided context because upper layers might ignore our
+		// notifications if we do.  But we still want to wait for the
+		// context to cancel.
+		c := make(chan error, 1)
+		freshCtx, cancel := fbo.newCtxWithFBOID()
+		defer cancel()
+		fbo.log.CDebugf(freshCtx, "Launching new context for UnstageForTesting")
+		go func() {
+			lState := makeFBOLockState()
+			c <- fbo.doMDWriteWithRetry(ctx, lState,
+				func(lState *lockState) error {
+					return fbo.unstageLocked(freshCtx, lState)
+				})
+		}()
+
+		select {
+		case err := <-c:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+}
+
+// mdWriterLock must be taken by the caller.
+func (fbo *folderBranchOps) rekeyLocked(ctx context.Context,
+	lState *lockState, promptPaper bool) (res RekeyResult, err error) {
+	fbo.log.CDebugf(ctx, "rekeyLocked")
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "rekeyLocked done: %+v %+v", res, err)
+	}()
+
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	if !fbo.isMasterBranchLocked(lState) {
+		return RekeyResult{}, errors.New("can't rekey while staged")
+	}
+
+	// untrusted head is ok here.
+	head, _ := fbo.getHead(lState)
+	if head != (ImmutableRootMetadata{}) {
+		// If we already have a cached revision, make sure we're
+		// up-to-date with the latest revision before inspecting the
+		// metadata, since Rekey doesn't let us go into CR mode, and
+		// we don't actually get folder update notifications when the
+		// rekey bit is set, just a "folder needs rekey" update.
+		if err := fbo.getAndApplyMDUpdates(
+			ctx, lState, fbo.applyMDUpdatesLocked); err != nil {
+			if applyErr, ok := err.(MDRevisionMismatch); !ok ||
+				applyErr.rev != applyErr.curr {
+				return RekeyResult{}, err
+			}
+		}
+	}
+
+	md, lastWriterVerifyingKey, rekeyWasSet, err :=
+		fbo.getMDForRekeyWriteLocked(ctx, lState)
+	if err != nil {
+		return RekeyResult{}, err
+	}
+
+	currKeyGen := md.LatestKeyGeneration()
+	rekeyDone, tlfCryptKey, err := fbo.config.KeyManager().
+		Rekey(ctx, md, promptPaper)
+
+	stillNeedsRekey := false
+	switch err.(type) {
+	case nil:
+		// TODO: implement a "forced" option that rekeys even when the
+		// devices haven't changed?
+		if !rekeyDone {
+			fbo.log.CDebugf(ctx, "No rekey necessary")
+			return RekeyResult{
+				DidRekey:      false,
+				NeedsPaperKey: false,
+			}, nil
+		}
+		// Clear the rekey bit if any.
+		md.clearRekeyBit()
+		session, err := fbo.config.KBPKI().GetCurrentSession(ctx)
+		if err != nil {
+			return RekeyResult{}, err
+		}
+		// Readers can't clear the last revision, because:
+		// 1) They don't have access to the writer metadata, so can't clear the
+		//    block changes.
+		// 2) Readers need the MetadataFlagWriterMetadataCopied bit set for
+		//	  MDServer to authorize the write.
+		// Without this check, MDServer returns an Unauthorized error.
+		if md.GetTlfHandle().IsWriter(session.UID) {
+			md.clearLastRevision()
+		}
+
+	case RekeyIncompleteError:
+		if !rekeyDone && rekeyWasSet {
+			// The rekey bit was already set, and there's nothing else
+			// we can to do, so don't put any new revisions.
+			fbo.log.CDebugf(ctx, "No further rekey possible by this user.")
+			return RekeyResult{
+				DidRekey:      false,
+				NeedsPaperKey: false,
+			}, nil
+		}
+
+		// Rekey incomplete, fallthrough without early exit, to ensure
+		// we write the metadata with any potential changes
+		fbo.log.CDebugf(ctx,
+			"Rekeyed reader devices, but still need writer rekey")
+
+	case NeedOtherRekeyError, NeedSelfRekeyError:
+		stillNeedsRekey = true
+
+	default:
+		if err == context.DeadlineExceeded {
+			fbo.log.CDebugf(ctx, "Paper key prompt timed out")
+			// Reschedule the prompt in the timeout case.
+			stillNeedsRekey = true
+		} else {
+			return RekeyResult{}, err
+		}
+	}
+
+	if stillNeedsRekey {
+		fbo.log.CDebugf(ctx, "Device doesn't have access to rekey")
+		// If we didn't have read access, then we don't have any
+		// unlocked paper keys.  Wait for some time, and then if we
+		// still aren't rekeyed, try again but this time prompt the
+		// user for any known paper keys.  We do this even if the
+		// rekey bit is already set, since we may have restarted since
+		// the previous rekey attempt, before prompting for the paper
+		// key.  Only schedule this as a one-time event, since direct
+		// folder accesses from the user will also cause a
+		// rekeyWithPrompt.
+
+		if rekeyWasSet {
+			// Devices not yet keyed shouldn't set the rekey bit again
+			fbo.log.CDebugf(ctx, "Rekey bit already set")
+			return RekeyResult{
+				DidRekey:      rekeyDone,
+				NeedsPaperKey: true,
+			}, nil
+		}
+		// This device hasn't been keyed yet, fall through to set the rekey bit
+	}
+
+	// add an empty operation to satisfy assumptions elsewhere
+	md.AddOp(newRekeyOp())
+
+	// we still let readers push a new md block that we validate against reader
+	// permissions
+	err = fbo.finalizeMDRekeyWriteLocked(
+		ctx, lState, md, lastWriterVerifyingKey)
+	if err != nil {
+		return RekeyResult{
+			DidRekey:      rekeyDone,
+			NeedsPaperKey: stillNeedsRekey,
+		}, err
+	}
+
+	// cache any new TLF crypt key
+	if tlfCryptKey != nil {
+		keyGen := md.LatestKeyGeneration()
+		err = fbo.config.KeyCache().PutTLFCryptKey(md.TlfID(), keyGen, *tlfCryptKey)
+		if err != nil {
+			return RekeyResult{
+				DidRekey:      rekeyDone,
+				NeedsPaperKey: stillNeedsRekey,
+			}, err
+		}
+	}
+
+	// send rekey finish notification
+	handle := md.GetTlfHandle()
+	if currKeyGen >= FirstValidKeyGen {
+		fbo.config.Reporter().Notify(ctx,
+			rekeyNotification(ctx, fbo.config, handle, true))
+	}
+
+	return RekeyResult{
+		DidRekey:      rekeyDone,
+		NeedsPaperKey: stillNeedsRekey,
+	}, nil
+}
+
+func (fbo *folderBranchOps) RequestRekey(_ context.Context, tlf tlf.ID) {
+	fb := FolderBranch{tlf, MasterBranch}
+	if fb != fbo.folderBranch {
+		// TODO: log instead of panic?
+		panic(WrongOpsError{fbo.folderBranch, fb})
+	}
+	fbo.rekeyFSM.Event(NewRekeyRequestEvent())
+}
+
+func (fbo *folderBranchOps) SyncFromServerForTesting(
+	ctx context.Context, folderBranch FolderBranch) (err error) {
+	fbo.log.CDebugf(ctx, "SyncFromServerForTesting")
+	defer func() {
+		fbo.deferLog.CDebugf(ctx,
+			"SyncFromServerForTesting done: %+v", err)
+	}()
+
+	if folderBranch != fbo.folderBranch {
+		return WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+
+	lState := makeFBOLockState()
+
+	// Make sure everything outstanding syncs to disk at least.
+	if err := fbo.syncAllUnlocked(ctx, lState); err != nil {
+		return err
+	}
+
+	// A journal flush before CR, if needed.
+	if err := WaitForTLFJournal(ctx, fbo.config, fbo.id(),
+		fbo.log); err != nil {
+		return err
+	}
+
+	if err := fbo.mdFlushes.Wait(ctx); err != nil {
+		return err
+	}
+
+	if err := fbo.branchChanges.Wait(ctx); err != nil {
+		return err
+	}
+
+	// Loop until we're fully updated on the master branch.
+	for {
+		if !fbo.isMasterBranch(lState) {
+			if err := fbo.cr.Wait(ctx); err != nil {
+				return err
+			}
+			// If we are still staged after the wait, then we have a problem.
+			if !fbo.isMasterBranch(lState) {
+				return errors.Errorf("Conflict resolution didn't take us out " +
+					"of staging.")
+			}
+		}
+
+		dirtyFiles := fbo.blocks.GetDirtyFileBlockRefs(lState)
+		if len(dirtyFiles) > 0 {
+			for _, ref := range dirtyFiles {
+				fbo.log.CDebugf(ctx, "DeCache entry left: %v", ref)
+			}
+			return errors.New("can't sync from server while dirty")
+		}
+
+		// A journal flush after CR, if needed.
+		if err := WaitForTLFJournal(ctx, fbo.config, fbo.id(),
+			fbo.log); err != nil {
+			return err
+		}
+
+		if err := fbo.mdFlushes.Wait(ctx); err != nil {
+			return err
+		}
+
+		if err := fbo.branchChanges.Wait(ctx); err != nil {
+			return err
+		}
+
+		if err := fbo.getAndApplyMDUpdates(
+			ctx, lState, fbo.applyMDUpdates); err != nil {
+			if applyErr, ok := err.(MDRevisionMismatch); ok {
+				if applyErr.rev == applyErr.curr {
+					fbo.log.CDebugf(ctx, "Already up-to-date with server")
+					return nil
+				}
+			}
+			if _, isUnmerged := err.(UnmergedError); isUnmerged {
+				continue
+			} else if err == errNoMergedRevWhileStaged {
+				continue
+			}
+			return err
+		}
+		break
+	}
+
+	// Wait for all the asynchronous block archiving and quota
+	// reclamation to hit the block server.
+	if err := fbo.fbm.waitForArchives(ctx); err != nil {
+		return err
+	}
+	if err := fbo.fbm.waitForDeletingBlocks(ctx); err != nil {
+		return err
+	}
+	if err := fbo.editHistory.Wait(ctx); err != nil {
+		return err
+	}
+	if err := fbo.fbm.waitForQuotaReclamations(ctx); err != nil {
+		return err
+	}
+
+	// A second journal flush if needed, to clear out any
+	// archive/remove calls caused by the above operations.
+	return WaitForTLFJournal(ctx, fbo.config, fbo.id(), fbo.log)
+}
+
+// CtxFBOTagKey is the type used for unique context tags within folderBranchOps
+type CtxFBOTagKey int
+
+const (
+	// CtxFBOIDKey is the type of the tag for unique operation IDs
+	// within folderBranchOps.
+	CtxFBOIDKey CtxFBOTagKey = iota
+)
+
+// CtxFBOOpID is the display name for the unique operation
+// folderBranchOps ID tag.
+const CtxFBOOpID = "FBOID"
+
+func (fbo *folderBranchOps) ctxWithFBOID(ctx context.Context) context.Context {
+	return CtxWithRandomIDReplayable(ctx, CtxFBOIDKey, CtxFBOOpID, fbo.log)
+}
+
+func (fbo *folderBranchOps) newCtxWithFBOID() (context.Context, context.CancelFunc) {
+	// No need to call NewContextReplayable since ctxWithFBOID calls
+	// ctxWithRandomIDReplayable, which attaches replayably.
+	ctx := fbo.ctxWithFBOID(context.Background())
+	ctx, cancelFunc := context.WithCancel(ctx)
+	ctx, err := NewContextWithCancellationDelayer(ctx)
+	if err != nil {
+		panic(err)
+	}
+	return ctx, cancelFunc
+}
+
+// Run the passed function with a context that's canceled on shutdown.
+func (fbo *folderBranchOps) runUnlessShutdown(fn func(ctx context.Context) error) error {
+	ctx, cancelFunc := fbo.newCtxWithFBOID()
+	defer cancelFunc()
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- fn(ctx)
+	}()
+
+	select {
+	case err := <-errChan:
+		return err
+	case <-fbo.shutdownChan:
+		return ShutdownHappenedError{}
+	}
+}
+
+func (fbo *folderBranchOps) doFastForwardLocked(ctx context.Context,
+	lState *lockState, currHead ImmutableRootMetadata) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+	fbo.headLock.AssertLocked(lState)
+
+	fbo.log.CDebugf(ctx, "Fast-forwarding from rev %d to rev %d",
+		fbo.latestMergedRevision, currHead.Revision())
+	changes, err := fbo.blocks.FastForwardAllNodes(
+		ctx, lState, currHead.ReadOnly())
+	if err != nil {
+		return err
+	}
+
+	err = fbo.setHeadSuccessorLocked(ctx, lState, currHead, true /*rebase*/)
+	if err != nil {
+		return err
+	}
+
+	// Invalidate all the affected nodes.
+	if len(changes) > 0 {
+		fbo.observers.batchChanges(ctx, changes)
 	}
 
-	fbo.observers.batchChanges(ctx, changes)
+	// Reset the edit history.  TODO: notify any listeners that we've
+	// done this.
+	fbo.editHistory.Shutdown()
+	fbo.editHistory = NewTlfEditHistory(fbo.config, fbo, fbo.log)
 	return nil
 }
 
-func (fbo *folderBranchOps) notifyOneOp(ctx context.Context,
-	lState *lockState, op op, md ReadOnlyRootMetadata,
-	shouldPrefetch bool) error {
+func (fbo *folderBranchOps) maybeFastForward(ctx context.Context,
+	lState *lockState, lastUpdate time.Time, currUpdate time.Time) (
+	fastForwardDone bool, err error) {
+	// Has it been long enough to try fast-forwarding?
+	if currUpdate.Before(lastUpdate.Add(fastForwardTimeThresh)) ||
+		!fbo.isMasterBranch(lState) {
+		return false, nil
+	}
+
+	fbo.log.CDebugf(ctx, "Checking head for possible "+
+		"fast-forwarding (last update time=%s)", lastUpdate)
+	currHead, err := fbo.config.MDOps().GetForTLF(ctx, fbo.id())
+	if err != nil {
+		return false, err
+	}
+	fbo.log.CDebugf(ctx, "Current head is revision %d", currHead.Revision())
+
+	fbo.mdWriterLock.Lock(lState)
+	defer fbo.mdWriterLock.Unlock(lState)
+	// If the journal has anything in it, don't fast-forward since we
+	// haven't finished flushing yet.  If there was really a remote
+	// update on the server, we'll end up in CR eventually.
+	mergedRev, err := fbo.getJournalPredecessorRevision(ctx)
+	if err != nil {
+		return false, err
+	}
+	if mergedRev != kbfsmd.RevisionUninitialized {
+		return false, nil
+	}
+
+	if !fbo.isMasterBranchLocked(lState) {
+		// Don't update if we're staged.
+		return false, nil
+	}
+
 	fbo.headLock.Lock(lState)
 	defer fbo.headLock.Unlock(lState)
-	return fbo.notifyOneOpLocked(ctx, lState, op, md, shouldPrefetch)
+
+	if currHead.Revision() < fbo.latestMergedRevision+fastForwardRevThresh {
+		// Might as well fetch all the revisions.
+		return false, nil
+	}
+
+	err = fbo.doFastForwardLocked(ctx, lState, currHead)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
 }
 
-func (fbo *folderBranchOps) getCurrMDRevisionLocked(lState *lockState) kbfsmd.Revision {
-	fbo.headLock.AssertAnyLocked(lState)
+func (fbo *folderBranchOps) locallyFinalizeTLF(ctx context.Context) {
+	lState := makeFBOLockState()
+	fbo.mdWriterLock.Lock(lState)
+	defer fbo.mdWriterLock.Unlock(lState)
+	fbo.headLock.Lock(lState)
+	defer fbo.headLock.Unlock(lState)
 
-	if fbo.head != (ImmutableRootMetadata{}) {
-		return fbo.head.Revision()
+	if fbo.head == (ImmutableRootMetadata{}) {
+		return
 	}
-	return kbfsmd.RevisionUninitialized
+
+	// It's safe to give this a finalized number of 1 and a fake user
+	// name.  The whole point here is to move the old finalized TLF
+	// name away to a new name, where the user won't be able to access
+	// it anymore, and if there's a conflict with a previously-moved
+	// TLF that shouldn't matter.
+	now := fbo.config.Clock().Now()
+	finalizedInfo, err := tlf.NewHandleExtension(
+		tlf.HandleExtensionFinalized, 1, libkb.NormalizedUsername("<unknown>"),
+		now)
+	if err != nil {
+		fbo.log.CErrorf(ctx, "Couldn't make finalized info: %+v", err)
+		return
+	}
+
+	fakeSignedHead := &RootMetadataSigned{MD: fbo.head.bareMd}
+	finalRmd, err := fakeSignedHead.MakeFinalCopy(
+		fbo.config.Codec(), now, finalizedInfo)
+	if err != nil {
+		fbo.log.CErrorf(ctx, "Couldn't finalize MD: %+v", err)
+		return
+	}
+
+	// Construct the data needed to fake a new head.
+	mdID, err := kbfsmd.MakeID(fbo.config.Codec(), finalRmd.MD)
+	if err != nil {
+		fbo.log.CErrorf(ctx, "Couldn't get finalized MD ID: %+v", err)
+		return
+	}
+	bareHandle, err := finalRmd.MD.MakeBareTlfHandle(fbo.head.Extra())
+	if err != nil {
+		fbo.log.CErrorf(ctx, "Couldn't get finalized bare handle: %+v", err)
+		return
+	}
+	handle, err := MakeTlfHandle(ctx, bareHandle, fbo.config.KBPKI())
+	if err != nil {
+		fbo.log.CErrorf(ctx, "Couldn't get finalized handle: %+v", err)
+		return
+	}
+	finalBrmd, ok := finalRmd.MD.(MutableBareRootMetadata)
+	if !ok {
+		fbo.log.CErrorf(ctx, "Couldn't get finalized mutable bare MD: %+v", err)
+		return
+	}
+
+	// We don't have a way to sign this with a valid key (and we might
+	// be logged out anyway), so just directly make the md immutable.
+	finalIrmd := ImmutableRootMetadata{
+		ReadOnlyRootMetadata: makeRootMetadata(
+			finalBrmd, fbo.head.Extra(), handle).ReadOnly(),
+		mdID: mdID,
+	}
+
+	// This will trigger the handle change notification to observers.
+	err = fbo.setHeadSuccessorLocked(ctx, lState, finalIrmd, false)
+	if err != nil {
+		fbo.log.CErrorf(ctx, "Couldn't set finalized MD: %+v", err)
+		return
+	}
+}
+
+func (fbo *folderBranchOps) registerAndWaitForUpdates() {
+	defer close(fbo.updateDoneChan)
+	childDone := make(chan struct{})
+	var lastUpdate time.Time
+	err := fbo.runUnlessShutdown(func(ctx context.Context) error {
+		defer close(childDone)
+		// If we fail to register for or process updates, try again
+		// with an exponential backoff, so we don't overwhelm the
+		// server or ourselves with too many attempts in a hopeless
+		// situation.
+		expBackoff := backoff.NewExponentialBackOff()
+		// Never give up hope until we shut down
+		expBackoff.MaxElapsedTime = 0
+		// Register and wait in a loop unless we hit an unrecoverable error
+		fbo.cancelUpdatesLock.Lock()
+		if fbo.cancelUpdates != nil {
+			// It should be impossible to get here without having
+			// already called the cancel function, but just in case
+			// call it here again.
+			fbo.cancelUpdates()
+		}
+		ctx, fbo.cancelUpdates = context.WithCancel(ctx)
+		fbo.cancelUpdatesLock.Unlock()
+		for {
+			err := backoff.RetryNotifyWithContext(ctx, func() error {
+				// Replace the FBOID one with a fresh id for every attempt
+				newCtx := fbo.ctxWithFBOID(ctx)
+				updateChan, err := fbo.registerForUpdates(newCtx)
+				if err != nil {
+					select {
+					case <-ctx.Done():
+						// Shortcut the retry, we're done.
+						return nil
+					default:
+						return err
+					}
+				}
+
+				currUpdate, err := fbo.waitForAndProcessUpdates(
+					newCtx, lastUpdate, updateChan)
+				switch errors.Cause(err).(type) {
+				case UnmergedError:
+					// skip the back-off timer and continue directly to next
+					// registerForUpdates
+					return nil
+				case NewMetadataVersionError:
+					fbo.log.CDebugf(ctx, "Abandoning updates since we can't "+
+						"read the newest metadata: %+v", err)
+					fbo.status.setPermErr(err)
+					// No need to lock here, since `cancelUpdates` is
+					// only set within this same goroutine.
+					fbo.cancelUpdates()
+					return context.Canceled
+				case kbfsmd.ServerErrorCannotReadFinalizedTLF:
+					fbo.log.CDebugf(ctx, "Abandoning updates since we can't "+
+						"read the finalized metadata for this TLF: %+v", err)
+					fbo.status.setPermErr(err)
+
+					// Locally finalize the TLF so new accesses
+					// through to the old folder name will find the
+					// new folder.
+					fbo.locallyFinalizeTLF(newCtx)
+
+					// No need to lock here, since `cancelUpdates` is
+					// only set within this same goroutine.
+					fbo.cancelUpdates()
+					return context.Canceled
+				}
+				select {
+				case <-ctx.Done():
+					// Shortcut the retry, we're done.
+					return nil
+				default:
+					if err == nil {
+						lastUpdate = currUpdate
+					}
+					return err
+				}
+			},
+				expBackoff,
+				func(err error, nextTime time.Duration) {
+					fbo.log.CDebugf(ctx,
+						"Retrying registerForUpdates in %s due to err: %v",
+						nextTime, err)
+				})
+			if err != nil {
+				return err
+			}
+		}
+	})
+
+	if err != nil && err != context.Canceled {
+		fbo.log.CWarningf(context.Background(),
+			"registerAndWaitForUpdates failed unexpectedly with an error: %v",
+			err)
+	}
+	<-childDone
 }
 
-func (fbo *folderBranchOps) getCurrMDRevision(
-	lState *lockState) kbfsmd.Revision {
-	fbo.headLock.RLock(lState)
-	defer fbo.headLock.RUnlock(lState)
-	return fbo.getCurrMDRevisionLocked(lState)
+// isIdleArchive returns true if this is an archived folder-branch
+// that nobody holds a node for, and that hasn't been used in at least
+// `timeout`.
+func (fbo *folderBranchOps) isIdleArchive(
+	now time.Time, timeout time.Duration) bool {
+	if !fbo.isReadOnly() || fbo.nodeCache == nil {
+		return false
+	}
+	if len(fbo.nodeCache.AllNodes()) > 0 {
+		return false
+	}
+	fbo.muLastGetHead.Lock()
+	defer fbo.muLastGetHead.Unlock()
+	return now.Sub(fbo.lastGetHead) >= timeout
 }
 
-type applyMDUpdatesFunc func(context.Context, *lockState, []ImmutableRootMetadata) error
-
-func (fbo *folderBranchOps) applyMDUpdatesLocked(ctx context.Context,
-	lState *lockState, rmds []ImmutableRootMetadata) error {
-	fbo.mdWriterLock.AssertLocked(lState)
+func (fbo *folderBranchOps) registerForUpdatesShouldFireNow() bool {
+	fbo.muLastGetHead.Lock()
+	defer fbo.muLastGetHead.Unlock()
+	return fbo.config.Clock().Now().Sub(fbo.lastGetHead) < registerForUpdatesFireNowThreshold
+}
 
-	// If there's anything in the journal, don't apply these MDs.
-	// Wait for CR to happen.
-	if fbo.isMasterBranchLocked(lState) {
-		mergedRev, err := fbo.getJournalPredecessorRevision(ctx)
-		if err != nil {
-			return err
-		}
-		if mergedRev != kbfsmd.RevisionUninitialized {
-			if len(rmds) > 0 {
-				// We should update our view of the merged master though,
-				// to avoid re-registering for the same updates again.
-				func() {
-					fbo.headLock.Lock(lState)
-					defer fbo.headLock.Unlock(lState)
-					fbo.setLatestMergedRevisionLocked(
-						ctx, lState, rmds[len(rmds)-1].Revision(), false)
-				}()
-			}
+func (fbo *folderBranchOps) registerForUpdates(ctx context.Context) (
+	updateChan <-chan error, err error) {
+	lState := makeFBOLockState()
+	currRev := fbo.getLatestMergedRevision(lState)
 
-			fbo.log.CDebugf(ctx,
-				"Ignoring fetched revisions while MDs are in journal")
-			return nil
-		}
+	fireNow := false
+	if fbo.registerForUpdatesShouldFireNow() {
+		ctx = rpc.WithFireNow(ctx)
+		fireNow = true
 	}
 
-	fbo.headLock.Lock(lState)
-	defer fbo.headLock.Unlock(lState)
+	fbo.log.CDebugf(ctx,
+		"Registering for updates (curr rev = %d, fire now = %v)",
+		currRev, fireNow)
+	defer func() {
+		fbo.deferLog.CDebugf(ctx,
+			"Registering for updates (curr rev = %d, fire now = %v) done: %+v",
+			currRev, fireNow, err)
+	}()
+	// RegisterForUpdate will itself retry on connectivity issues
+	return fbo.config.MDServer().RegisterForUpdate(ctx, fbo.id(), currRev)
+}
 
-	// if we have staged changes, ignore all updates until conflict
-	// resolution kicks in.  TODO: cache these for future use.
-	if !fbo.isMasterBranchLocked(lState) {
-		if len(rmds) > 0 {
-			latestMerged := rmds[len(rmds)-1]
-			// Don't trust un-put updates here because they might have
-			// come from our own journal before the conflict was
-			// detected.  Assume we'll hear about the conflict via
-			// callbacks from the journal.
-			if !latestMerged.putToServer {
-				return UnmergedError{}
-			}
+func (fbo *folderBranchOps) waitForAndProcessUpdates(
+	ctx context.Context, lastUpdate time.Time,
+	updateChan <-chan error) (currUpdate time.Time, err error) {
+	// successful registration; now, wait for an update or a shutdown
+	fbo.log.CDebugf(ctx, "Waiting for updates")
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "Waiting for updates done: %+v", err)
+	}()
 
-			// setHeadLocked takes care of merged case
-			fbo.setLatestMergedRevisionLocked(
-				ctx, lState, latestMerged.Revision(), false)
+	lState := makeFBOLockState()
 
-			unmergedRev := kbfsmd.RevisionUninitialized
-			if fbo.head != (ImmutableRootMetadata{}) {
-				unmergedRev = fbo.head.Revision()
+	for {
+		select {
+		case err := <-updateChan:
+			fbo.log.CDebugf(ctx, "Got an update: %v", err)
+			if err != nil {
+				return time.Time{}, err
 			}
-			fbo.cr.Resolve(ctx, unmergedRev, latestMerged.Revision())
-		}
-		return UnmergedError{}
-	}
-
-	// Don't allow updates while we're in the dirty state; the next
-	// sync will put us into an unmerged state anyway and we'll
-	// require conflict resolution.
-	if fbo.blocks.GetState(lState) != cleanState {
-		return errors.WithStack(NoUpdatesWhileDirtyError{})
-	}
+			// Getting and applying the updates requires holding
+			// locks, so make sure it doesn't take too long.
+			ctx, cancel := context.WithTimeout(ctx, backgroundTaskTimeout)
+			defer cancel()
 
-	appliedRevs := make([]ImmutableRootMetadata, 0, len(rmds))
-	for _, rmd := range rmds {
-		// check that we're applying the expected MD revision
-		if rmd.Revision() <= fbo.getCurrMDRevisionLocked(lState) {
-			// Already caught up!
-			continue
-		}
-		if err := isReadableOrError(ctx, fbo.config.KBPKI(), rmd.ReadOnly()); err != nil {
-			return err
-		}
+			currUpdate := fbo.config.Clock().Now()
+			ffDone, err :=
+				fbo.maybeFastForward(ctx, lState, lastUpdate, currUpdate)
+			if err != nil {
+				return time.Time{}, err
+			}
+			if ffDone {
+				return currUpdate, nil
+			}
 
-		err := fbo.setHeadSuccessorLocked(ctx, lState, rmd, false)
-		if err != nil {
-			return err
-		}
-		// No new operations in these.
-		if rmd.IsWriterMetadataCopiedSet() {
-			continue
-		}
-		for _, op := range rmd.data.Changes.Ops {
-			err := fbo.notifyOneOpLocked(ctx, lState, op, rmd.ReadOnly(), true)
+			err = fbo.getAndApplyMDUpdates(ctx, lState, fbo.applyMDUpdates)
 			if err != nil {
-				return err
+				fbo.log.CDebugf(ctx, "Got an error while applying "+
+					"updates: %v", err)
+				return time.Time{}, err
 			}
+			return currUpdate, nil
+		case unpause := <-fbo.updatePauseChan:
+			fbo.log.CInfof(ctx, "Updates paused")
+			// wait to be unpaused
+			select {
+			case <-unpause:
+				fbo.log.CInfof(ctx, "Updates unpaused")
+			case <-ctx.Done():
+				return time.Time{}, ctx.Err()
+			}
+		case <-ctx.Done():
+			return time.Time{}, ctx.Err()
 		}
-		if rmd.IsRekeySet() {
-			// One might have concern that a MD update written by the device
-			// itself can slip in here, for example during the rekey after
-			// setting paper prompt, and the event may cause the paper prompt
-			// to be unset. This is not a problem because 1) the revision check
-			// above shouldn't allow MD update written by this device to reach
-			// here; 2) the rekey FSM doesn't touch anything if it has the
-			// paper prompt set and is in scheduled state.
-			fbo.rekeyFSM.Event(NewRekeyRequestEvent())
-		} else {
-			fbo.rekeyFSM.Event(NewRekeyNotNeededEvent())
-		}
-		appliedRevs = append(appliedRevs, rmd)
 	}
-	if len(appliedRevs) > 0 {
-		fbo.editHistory.UpdateHistory(ctx, appliedRevs)
-	}
-	return nil
 }
 
-func (fbo *folderBranchOps) undoMDUpdatesLocked(ctx context.Context,
-	lState *lockState, rmds []ImmutableRootMetadata) error {
-	fbo.mdWriterLock.AssertLocked(lState)
+func (fbo *folderBranchOps) getCachedDirOpsCount(lState *lockState) int {
+	fbo.mdWriterLock.Lock(lState)
+	defer fbo.mdWriterLock.Unlock(lState)
+	return len(fbo.dirOps)
+}
 
-	fbo.headLock.Lock(lState)
-	defer fbo.headLock.Unlock(lState)
+func (fbo *folderBranchOps) backgroundFlusher() {
+	lState := makeFBOLockState()
+	var prevDirtyFileMap map[BlockRef]bool
+	sameDirtyFileCount := 0
+	for {
+		doSelect := true
+		if fbo.blocks.GetState(lState) == dirtyState &&
+			fbo.config.DirtyBlockCache().ShouldForceSync(fbo.id()) &&
+			sameDirtyFileCount < 10 {
+			// We have dirty files, and the system has a full buffer,
+			// so don't bother waiting for a signal, just get right to
+			// the main attraction.
+			doSelect = false
+		} else if fbo.getCachedDirOpsCount(lState) >=
+			fbo.config.BGFlushDirOpBatchSize() {
+			doSelect = false
+		}
 
-	// Don't allow updates while we're in the dirty state; the next
-	// sync will put us into an unmerged state anyway and we'll
-	// require conflict resolution.
-	if fbo.blocks.GetState(lState) != cleanState {
-		return NotPermittedWhileDirtyError{}
-	}
+		if doSelect {
+			// Wait until we really have a write waiting.
+			doWait := true
+			select {
+			case <-fbo.syncNeededChan:
+				if fbo.getCachedDirOpsCount(lState) >=
+					fbo.config.BGFlushDirOpBatchSize() {
+					doWait = false
+				}
+			case <-fbo.forceSyncChan:
+				doWait = false
+			case <-fbo.shutdownChan:
+				return
+			}
 
-	// go backwards through the updates
-	for i := len(rmds) - 1; i >= 0; i-- {
-		rmd := rmds[i]
-		// on undo, it's ok to re-apply the current revision since you
-		// need to invert all of its ops.
-		//
-		// This duplicates a check in
-		// fbo.setHeadPredecessorLocked. TODO: Remove this
-		// duplication.
-		if rmd.Revision() != fbo.getCurrMDRevisionLocked(lState) &&
-			rmd.Revision() != fbo.getCurrMDRevisionLocked(lState)-1 {
-			return MDUpdateInvertError{rmd.Revision(),
-				fbo.getCurrMDRevisionLocked(lState)}
+			if doWait {
+				timer := time.NewTimer(fbo.config.BGFlushPeriod())
+				// Loop until either a tick's worth of time passes,
+				// the batch size of directory ops is full, a sync is
+				// forced, or a shutdown happens.
+			loop:
+				for {
+					select {
+					case <-timer.C:
+						break loop
+					case <-fbo.syncNeededChan:
+						if fbo.getCachedDirOpsCount(lState) >=
+							fbo.config.BGFlushDirOpBatchSize() {
+							break loop
+						}
+					case <-fbo.forceSyncChan:
+						break loop
+					case <-fbo.shutdownChan:
+						return
+					}
+				}
+			}
 		}
 
-		// TODO: Check that the revisions are equal only for
-		// the first iteration.
-		if rmd.Revision() < fbo.getCurrMDRevisionLocked(lState) {
-			err := fbo.setHeadPredecessorLocked(ctx, lState, rmd)
-			if err != nil {
-				return err
-			}
+		dirtyFiles := fbo.blocks.GetDirtyFileBlockRefs(lState)
+		dirOpsCount := fbo.getCachedDirOpsCount(lState)
+		if len(dirtyFiles) == 0 && dirOpsCount == 0 {
+			sameDirtyFileCount = 0
+			continue
 		}
 
-		// iterate the ops in reverse and invert each one
-		ops := rmd.data.Changes.Ops
-		for j := len(ops) - 1; j >= 0; j-- {
-			io, err := invertOpForLocalNotifications(ops[j])
-			if err != nil {
-				fbo.log.CWarningf(ctx,
-					"got error %v when invert op %v; "+
-						"skipping. Open file handles "+
-						"may now be in an invalid "+
-						"state, which can be fixed by "+
-						"either closing them all or "+
-						"restarting KBFS.",
-					err, ops[j])
-				continue
+		// Make sure we are making some progress
+		currDirtyFileMap := make(map[BlockRef]bool)
+		for _, ref := range dirtyFiles {
+			currDirtyFileMap[ref] = true
+		}
+		if reflect.DeepEqual(currDirtyFileMap, prevDirtyFileMap) {
+			sameDirtyFileCount++
+		} else {
+			sameDirtyFileCount = 0
+		}
+		prevDirtyFileMap = currDirtyFileMap
+
+		fbo.runUnlessShutdown(func(ctx context.Context) (err error) {
+			// Denote that these are coming from a background
+			// goroutine, not directly from any user.
+			ctx = NewContextReplayable(ctx,
+				func(ctx context.Context) context.Context {
+					return context.WithValue(ctx, CtxBackgroundSyncKey, "1")
+				})
+
+			fbo.log.CDebugf(ctx, "Background sync triggered: %d dirty files, "+
+				"%d dir ops in batch", len(dirtyFiles), dirOpsCount)
+
+			if sameDirtyFileCount >= 100 {
+				// If the local journal is full, we might not be able to
+				// make progress until more data is flushed to the
+				// servers, so just warn here rather than just an outright
+				// panic.
+				fbo.log.CWarningf(ctx, "Making no Sync progress on dirty "+
+					"files after %d attempts: %v", sameDirtyFileCount,
+					dirtyFiles)
 			}
-			err = fbo.notifyOneOpLocked(ctx, lState, io, rmd.ReadOnly(), false)
+
+			// Just in case network access or a bug gets stuck for a
+			// long time, time out the sync eventually.
+			longCtx, longCancel :=
+				context.WithTimeout(ctx, backgroundTaskTimeout)
+			defer longCancel()
+			err = fbo.SyncAll(longCtx, fbo.folderBranch)
 			if err != nil {
-				return err
+				// Just log the warning and keep trying to
+				// sync the rest of the dirty files.
+				fbo.log.CWarningf(ctx, "Couldn't sync all: %+v", err)
 			}
-		}
+			return nil
+		})
 	}
-	// TODO: update the edit history?
-	return nil
 }
 
-func (fbo *folderBranchOps) applyMDUpdates(ctx context.Context,
-	lState *lockState, rmds []ImmutableRootMetadata) error {
+func (fbo *folderBranchOps) blockUnmergedWrites(lState *lockState) {
 	fbo.mdWriterLock.Lock(lState)
-	defer fbo.mdWriterLock.Unlock(lState)
-	return fbo.applyMDUpdatesLocked(ctx, lState, rmds)
 }
 
-func (fbo *folderBranchOps) getLatestMergedRevision(lState *lockState) kbfsmd.Revision {
-	fbo.headLock.RLock(lState)
-	defer fbo.headLock.RUnlock(lState)
-	return fbo.latestMergedRevision
+func (fbo *folderBranchOps) unblockUnmergedWrites(lState *lockState) {
+	fbo.mdWriterLock.Unlock(lState)
 }
 
-// caller should have held fbo.headLock
-func (fbo *folderBranchOps) setLatestMergedRevisionLocked(ctx context.Context, lState *lockState, rev kbfsmd.Revision, allowBackward bool) {
-	fbo.headLock.AssertLocked(lState)
-	if rev == kbfsmd.RevisionUninitialized {
-		panic("Cannot set latest merged revision to an uninitialized value")
+func (fbo *folderBranchOps) finalizeResolutionLocked(ctx context.Context,
+	lState *lockState, md *RootMetadata, bps *blockPutState,
+	newOps []op, blocksToDelete []kbfsblock.ID) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	// Put the blocks into the cache so that, even if we fail below,
+	// future attempts may reuse the blocks.
+	err := fbo.finalizeBlocks(bps)
+	if err != nil {
+		return err
 	}
 
-	if fbo.latestMergedRevision < rev || allowBackward {
-		fbo.latestMergedRevision = rev
-		fbo.log.CDebugf(ctx, "Updated latestMergedRevision to %d.", rev)
-	} else {
-		fbo.log.CDebugf(ctx, "Local latestMergedRevision (%d) is higher than "+
-			"the new revision (%d); won't update.", fbo.latestMergedRevision, rev)
+	// Last chance to get pre-empted.
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
 	}
-}
 
-// Assumes all necessary locking is either already done by caller, or
-// is done by applyFunc.
-func (fbo *folderBranchOps) getAndApplyMDUpdates(ctx context.Context,
-	lState *lockState, applyFunc applyMDUpdatesFunc) error {
-	// first look up all MD revisions newer than my current head
-	start := fbo.getLatestMergedRevision(lState) + 1
-	rmds, err := getMergedMDUpdates(ctx, fbo.config, fbo.id(), start)
+	session, err := fbo.config.KBPKI().GetCurrentSession(ctx)
 	if err != nil {
 		return err
 	}
-
-	err = applyFunc(ctx, lState, rmds)
-	if err != nil {
+	irmd, err := fbo.config.MDOps().ResolveBranch(ctx, fbo.id(), fbo.bid,
+		blocksToDelete, md, session.VerifyingKey)
+	doUnmergedPut := isRevisionConflict(err)
+	if doUnmergedPut {
+		fbo.log.CDebugf(ctx, "Got a conflict after resolution; aborting CR")
 		return err
 	}
-	return nil
-}
-
-func (fbo *folderBranchOps) getAndApplyNewestUnmergedHead(ctx context.Context,
-	lState *lockState) error {
-	fbo.log.CDebugf(ctx, "Fetching the newest unmerged head")
-	bid := func() BranchID {
-		fbo.mdWriterLock.Lock(lState)
-		defer fbo.mdWriterLock.Unlock(lState)
-		return fbo.bid
-	}()
-
-	// We can only ever be at most one revision behind, so fetch the
-	// latest unmerged revision and apply it as a successor.
-	md, err := fbo.config.MDOps().GetUnmergedForTLF(ctx, fbo.id(), bid)
 	if err != nil {
 		return err
 	}
 
-	if md == (ImmutableRootMetadata{}) {
-		// There is no unmerged revision, oops!
-		return errors.New("Couldn't find an unmerged head")
+	// Queue a rekey if the bit was set.
+	if md.IsRekeySet() {
+		defer fbo.config.RekeyQueue().Enqueue(md.TlfID())
 	}
 
-	fbo.mdWriterLock.Lock(lState)
-	defer fbo.mdWriterLock.Unlock(lState)
-	if fbo.bid != bid {
-		// The branches switched (apparently CR completed), so just
-		// try again.
-		fbo.log.CDebugf(ctx, "Branches switched while fetching unmerged head")
-		return nil
-	}
+	md.loadCachedBlockChanges(ctx, bps, fbo.log)
 
+	// Set the head to the new MD.
 	fbo.headLock.Lock(lState)
 	defer fbo.headLock.Unlock(lState)
-	if err := fbo.setHeadSuccessorLocked(ctx, lState, md, false); err != nil {
-		return err
-	}
-	if err := fbo.notifyBatchLocked(ctx, lState, md); err != nil {
-		return err
-	}
-	if err := fbo.config.MDCache().Put(md); err != nil {
-		return err
-	}
-	return nil
-}
-
-// getUnmergedMDUpdates returns a slice of the unmerged MDs for this
-// TLF's current unmerged branch and unmerged branch, between the
-// merge point for the branch and the current head.  The returned MDs
-// are the same instances that are stored in the MD cache, so they
-// should be modified with care.
-func (fbo *folderBranchOps) getUnmergedMDUpdates(
-	ctx context.Context, lState *lockState) (
-	kbfsmd.Revision, []ImmutableRootMetadata, error) {
-	// acquire mdWriterLock to read the current branch ID.
-	bid := func() BranchID {
-		fbo.mdWriterLock.Lock(lState)
-		defer fbo.mdWriterLock.Unlock(lState)
-		return fbo.bid
-	}()
-	return getUnmergedMDUpdates(ctx, fbo.config, fbo.id(),
-		bid, fbo.getCurrMDRevision(lState))
-}
-
-func (fbo *folderBranchOps) getUnmergedMDUpdatesLocked(
-	ctx context.Context, lState *lockState) (
-	kbfsmd.Revision, []ImmutableRootMetadata, error) {
-	fbo.mdWriterLock.AssertLocked(lState)
-
-	return getUnmergedMDUpdates(ctx, fbo.config, fbo.id(),
-		fbo.bid, fbo.getCurrMDRevision(lState))
-}
-
-// Returns a list of block pointers that were created during the
-// staged era.
-func (fbo *folderBranchOps) undoUnmergedMDUpdatesLocked(
-	ctx context.Context, lState *lockState) ([]BlockPointer, error) {
-	fbo.mdWriterLock.AssertLocked(lState)
-
-	currHead, unmergedRmds, err := fbo.getUnmergedMDUpdatesLocked(ctx, lState)
-	if err != nil {
-		return nil, err
-	}
-
-	err = fbo.undoMDUpdatesLocked(ctx, lState, unmergedRmds)
+	err = fbo.setHeadConflictResolvedLocked(ctx, lState, irmd)
 	if err != nil {
-		return nil, err
+		fbo.log.CWarningf(ctx, "Couldn't set local MD head after a "+
+			"successful put: %v", err)
+		return err
 	}
-
-	// We have arrived at the branch point.  The new root is
-	// the previous revision from the current head.  Find it
-	// and apply.  TODO: somehow fake the current head into
-	// being currHead-1, so that future calls to
-	// applyMDUpdates will fetch this along with the rest of
-	// the updates.
 	fbo.setBranchIDLocked(lState, NullBranchID)
 
-	rmd, err := getSingleMD(ctx, fbo.config, fbo.id(), NullBranchID,
-		currHead, Merged)
-	if err != nil {
-		return nil, err
-	}
-	err = func() error {
-		fbo.headLock.Lock(lState)
-		defer fbo.headLock.Unlock(lState)
-		err = fbo.setHeadPredecessorLocked(ctx, lState, rmd)
-		if err != nil {
-			return err
-		}
-		fbo.setLatestMergedRevisionLocked(ctx, lState, rmd.Revision(), true)
-		return nil
-	}()
-	if err != nil {
-		return nil, err
-	}
-
-	// Return all new refs
-	var unmergedPtrs []BlockPointer
-	for _, rmd := range unmergedRmds {
-		for _, op := range rmd.data.Changes.Ops {
-			for _, ptr := range op.Refs() {
-				if ptr != zeroPtr {
-					unmergedPtrs = append(unmergedPtrs, ptr)
-				}
-			}
-			for _, update := range op.allUpdates() {
-				if update.Ref != zeroPtr {
-					unmergedPtrs = append(unmergedPtrs, update.Ref)
-				}
-			}
-		}
-	}
-
-	return unmergedPtrs, nil
-}
-
-func (fbo *folderBranchOps) unstageLocked(ctx context.Context,
-	lState *lockState) error {
-	fbo.mdWriterLock.AssertLocked(lState)
+	// Archive the old, unref'd blocks if journaling is off.
+	if !TLFJournalEnabled(fbo.config, fbo.id()) {
+		fbo.fbm.archiveUnrefBlocks(irmd.ReadOnly())
+	}
 
-	// fetch all of my unstaged updates, and undo them one at a time
-	bid, wasMasterBranch := fbo.bid, fbo.isMasterBranchLocked(lState)
-	unmergedPtrs, err := fbo.undoUnmergedMDUpdatesLocked(ctx, lState)
+	mdCopyWithLocalOps, err := md.deepCopy(fbo.config.Codec())
 	if err != nil {
 		return err
 	}
+	mdCopyWithLocalOps.data.Changes.Ops = newOps
 
-	// let the server know we no longer have need
-	if !wasMasterBranch {
-		err = fbo.config.MDOps().PruneBranch(ctx, fbo.id(), bid)
+	// notifyOneOp for every fixed-up merged op.
+	for _, op := range newOps {
+		err := fbo.notifyOneOpLocked(
+			ctx, lState, op, mdCopyWithLocalOps.ReadOnly(), false)
 		if err != nil {
 			return err
 		}
 	}
+	fbo.editHistory.UpdateHistory(ctx, []ImmutableRootMetadata{irmd})
+	return nil
+}
 
-	// now go forward in time, if possible
-	err = fbo.getAndApplyMDUpdates(ctx, lState,
-		fbo.applyMDUpdatesLocked)
-	if err != nil {
-		return err
-	}
+// finalizeResolution caches all the blocks, and writes the new MD to
+// the merged branch, failing if there is a conflict.  It also sends
+// out the given newOps notifications locally.  This is used for
+// completing conflict resolution.
+func (fbo *folderBranchOps) finalizeResolution(ctx context.Context,
+	lState *lockState, md *RootMetadata, bps *blockPutState,
+	newOps []op, blocksToDelete []kbfsblock.ID) error {
+	// Take the writer lock.
+	fbo.mdWriterLock.Lock(lState)
+	defer fbo.mdWriterLock.Unlock(lState)
+	return fbo.finalizeResolutionLocked(
+		ctx, lState, md, bps, newOps, blocksToDelete)
+}
 
-	md, err := fbo.getSuccessorMDForWriteLocked(ctx, lState)
-	if err != nil {
-		return err
-	}
+func (fbo *folderBranchOps) unstageAfterFailedResolution(ctx context.Context,
+	lState *lockState) error {
+	// Take the writer lock.
+	fbo.mdWriterLock.Lock(lState)
+	defer fbo.mdWriterLock.Unlock(lState)
 
-	// Finally, create a resolutionOp with the newly-unref'd pointers.
-	resOp := newResolutionOp()
-	for _, ptr := range unmergedPtrs {
-		resOp.AddUnrefBlock(ptr)
+	// Last chance to get pre-empted.
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
 	}
-	md.AddOp(resOp)
 
-	bps, err := fbo.maybeUnembedAndPutBlocks(ctx, md)
-	if err != nil {
-		return err
-	}
+	// We don't want context cancellation after this point, so use a linked
+	// context. There is no race since the linked context has an independent
+	// Done channel.
+	//
+	// Generally we don't want to have any errors in unstageLocked since and
+	// this solution is chosen because:
+	// * If the error is caused by a cancelled context then the recovery (archiving)
+	//   would need to use a separate context anyways.
+	// * In such cases we would have to be very careful where the error occurs
+	//   and what to archive, making that solution much more complicated.
+	// * The other "common" error case is losing server connection and after
+	//   detecting that we won't have much luck archiving things anyways.
 
-	return fbo.finalizeMDWriteLocked(ctx, lState, md, bps, NoExcl,
-		func(md ImmutableRootMetadata) error {
-			return fbo.notifyBatchLocked(ctx, lState, md)
-		})
+	ctx = newLinkedContext(ctx)
+	fbo.log.CWarningf(ctx, "Unstaging branch %s after a resolution failure",
+		fbo.bid)
+	return fbo.unstageLocked(ctx, lState)
 }
 
-// TODO: remove once we have automatic conflict resolution
-func (fbo *folderBranchOps) UnstageForTesting(
-	ctx context.Context, folderBranch FolderBranch) (err error) {
-	fbo.log.CDebugf(ctx, "UnstageForTesting")
-	defer func() {
-		fbo.deferLog.CDebugf(ctx, "UnstageForTesting done: %+v", err)
-	}()
+// parkUnmergedBranch sets aside the current unmerged branch for
+// manual conflict resolution, instead of resolving it.  The branch
+// stays on the server (or in the journal), and can be browsed
+// read-only via GetUnmergedRootNode, while this folder-branch moves
+// back to the latest merged state.  Writes are blocked until the
+// branch is resolved with ResolveUnmerged.
+func (fbo *folderBranchOps) parkUnmergedBranch(ctx context.Context,
+	lState *lockState) error {
+	fbo.mdWriterLock.Lock(lState)
+	defer fbo.mdWriterLock.Unlock(lState)
 
-	if folderBranch != fbo.folderBranch {
-		return WrongOpsError{fbo.folderBranch, folderBranch}
+	// Last chance to get pre-empted.
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
 	}
 
-	return runUnlessCanceled(ctx, func() error {
-		lState := makeFBOLockState()
-
-		if fbo.isMasterBranch(lState) {
-			// no-op
-			return nil
-		}
-
-		if fbo.blocks.GetState(lState) != cleanState {
-			return NotPermittedWhileDirtyError{}
-		}
+	// Make sure the branch has all the local changes.
+	err := fbo.syncAllLocked(ctx, lState, NoExcl)
+	if err != nil {
+		return err
+	}
 
-		// launch unstaging in a new goroutine, because we don't want to
-		// use the provided context because upper layers might ignore our
-		// notifications if we do.  But we still want to wait for the
-		// context to cancel.
-		c := make(chan error, 1)
-		freshCtx, cancel := fbo.newCtxWithFBOID()
-		defer cancel()
-		fbo.log.CDebugf(freshCtx, "Launching new context for UnstageForTesting")
-		go func() {
-			lState := makeFBOLockState()
-			c <- fbo.doMDWriteWithRetry(ctx, lState,
-				func(lState *lockState) error {
-					return fbo.unstageLocked(freshCtx, lState)
-				})
-		}()
+	if fbo.isMasterBranchLocked(lState) {
+		return nil
+	}
+	bid := fbo.bid
+	fbo.log.CDebugf(ctx, "Setting aside branch %s for manual resolution",
+		bid)
+	_, err = fbo.undoUnmergedMDUpdatesLocked(ctx, lState)
+	if err != nil {
+		return err
+	}
+	err = fbo.setParkedBranchIDLocked(lState, bid)
+	if err != nil {
+		return err
+	}
 
-		select {
-		case err := <-c:
-			return err
-		case <-ctx.Done():
-			return ctx.Err()
-		}
-	})
+	// Now go forward in time, to show the merged state.
+	return fbo.getAndApplyMDUpdates(ctx, lState, fbo.applyMDUpdatesLocked)
 }
 
-// mdWriterLock must be taken by the caller.
-func (fbo *folderBranchOps) rekeyLocked(ctx context.Context,
-	lState *lockState, promptPaper bool) (res RekeyResult, err error) {
-	fbo.log.CDebugf(ctx, "rekeyLocked")
-	defer func() {
-		fbo.deferLog.CDebugf(ctx, "rekeyLocked done: %+v %+v", res, err)
-	}()
-
+// restageParkedBranchLocked puts this folder-branch back on the
+// given parked unmerged branch, so that conflict resolution can run
+// on it with the given resolution.  It returns the head revision of
+// the branch.  The saved branch ID stays until the resolution is
+// done.
+func (fbo *folderBranchOps) restageParkedBranchLocked(
+	ctx context.Context, lState *lockState, bid BranchID,
+	resolution UnmergedResolution) (
+	kbfsmd.Revision, error) {
 	fbo.mdWriterLock.AssertLocked(lState)
 
-	if !fbo.isMasterBranchLocked(lState) {
-		return RekeyResult{}, errors.New("can't rekey while staged")
+	unmergedHead, err := fbo.config.MDOps().GetUnmergedForTLF(
+		ctx, fbo.id(), bid)
+	if err != nil {
+		return kbfsmd.RevisionUninitialized, err
 	}
-
-	// untrusted head is ok here.
-	head, _ := fbo.getHead(lState)
-	if head != (ImmutableRootMetadata{}) {
-		// If we already have a cached revision, make sure we're
-		// up-to-date with the latest revision before inspecting the
-		// metadata, since Rekey doesn't let us go into CR mode, and
-		// we don't actually get folder update notifications when the
-		// rekey bit is set, just a "folder needs rekey" update.
-		if err := fbo.getAndApplyMDUpdates(
-			ctx, lState, fbo.applyMDUpdatesLocked); err != nil {
-			if applyErr, ok := err.(MDRevisionMismatch); !ok ||
-				applyErr.rev != applyErr.curr {
-				return RekeyResult{}, err
-			}
-		}
+	if unmergedHead == (ImmutableRootMetadata{}) {
+		return kbfsmd.RevisionUninitialized, NoUnmergedChangesError{fbo.id()}
 	}
-
-	md, lastWriterVerifyingKey, rekeyWasSet, err :=
-		fbo.getMDForRekeyWriteLocked(ctx, lState)
+	branchPoint, unmergedRmds, err := getUnmergedMDUpdates(
+		ctx, fbo.config, fbo.id(), bid, unmergedHead.Revision())
 	if err != nil {
-		return RekeyResult{}, err
+		return kbfsmd.RevisionUninitialized, err
 	}
 
-	currKeyGen := md.LatestKeyGeneration()
-	rekeyDone, tlfCryptKey, err := fbo.config.KeyManager().
-		Rekey(ctx, md, promptPaper)
-
-	stillNeedsRekey := false
-	switch err.(type) {
-	case nil:
-		// TODO: implement a "forced" option that rekeys even when the
-		// devices haven't changed?
-		if !rekeyDone {
-			fbo.log.CDebugf(ctx, "No rekey necessary")
-			return RekeyResult{
-				DidRekey:      false,
-				NeedsPaperKey: false,
-			}, nil
-		}
-		// Clear the rekey bit if any.
-		md.clearRekeyBit()
-		session, err := fbo.config.KBPKI().GetCurrentSession(ctx)
-		if err != nil {
-			return RekeyResult{}, err
-		}
-		// Readers can't clear the last revision, because:
-		// 1) They don't have access to the writer metadata, so can't clear the
-		//    block changes.
-		// 2) Readers need the MetadataFlagWriterMetadataCopied bit set for
-		//	  MDServer to authorize the write.
-		// Without this check, MDServer returns an Unauthorized error.
-		if md.GetTlfHandle().IsWriter(session.UID) {
-			md.clearLastRevision()
-		}
-
-	case RekeyIncompleteError:
-		if !rekeyDone && rekeyWasSet {
-			// The rekey bit was already set, and there's nothing else
-			// we can to do, so don't put any new revisions.
-			fbo.log.CDebugf(ctx, "No further rekey possible by this user.")
-			return RekeyResult{
-				DidRekey:      false,
-				NeedsPaperKey: false,
-			}, nil
-		}
+	// The merged updates since the branch point are undone for the
+	// benefit of the local notifications only; conflict resolution
+	// will apply them again along with the unmerged changes.
+	mergedRmds, err := getMDRange(ctx, fbo.config, fbo.id(), NullBranchID,
+		branchPoint+1, fbo.getCurrMDRevision(lState), Merged)
+	if err != nil {
+		return kbfsmd.RevisionUninitialized, err
+	}
 
-		// Rekey incomplete, fallthrough without early exit, to ensure
-		// we write the metadata with any potential changes
-		fbo.log.CDebugf(ctx,
-			"Rekeyed reader devices, but still need writer rekey")
+	fbo.headLock.Lock(lState)
+	defer fbo.headLock.Unlock(lState)
 
-	case NeedOtherRekeyError, NeedSelfRekeyError:
-		stillNeedsRekey = true
+	if fbo.blocks.GetState(lState) != cleanState {
+		return kbfsmd.RevisionUninitialized, NotPermittedWhileDirtyError{}
+	}
 
-	default:
-		if err == context.DeadlineExceeded {
-			fbo.log.CDebugf(ctx, "Paper key prompt timed out")
-			// Reschedule the prompt in the timeout case.
-			stillNeedsRekey = true
-		} else {
-			return RekeyResult{}, err
+	fbo.log.CDebugf(ctx, "Restaging branch %s at revision %d "+
+		"(branch point %d)", bid, unmergedHead.Revision(), branchPoint)
+	for i := len(mergedRmds) - 1; i >= 0; i-- {
+		err := fbo.notifyInvertedOpsLocked(ctx, lState, mergedRmds[i])
+		if err != nil {
+			return kbfsmd.RevisionUninitialized, err
 		}
 	}
-
-	if stillNeedsRekey {
-		fbo.log.CDebugf(ctx, "Device doesn't have access to rekey")
-		// If we didn't have read access, then we don't have any
-		// unlocked paper keys.  Wait for some time, and then if we
-		// still aren't rekeyed, try again but this time prompt the
-		// user for any known paper keys.  We do this even if the
-		// rekey bit is already set, since we may have restarted since
-		// the previous rekey attempt, before prompting for the paper
-		// key.  Only schedule this as a one-time event, since direct
-		// folder accesses from the user will also cause a
-		// rekeyWithPrompt.
-
-		if rekeyWasSet {
-			// Devices not yet keyed shouldn't set the rekey bit again
-			fbo.log.CDebugf(ctx, "Rekey bit already set")
-			return RekeyResult{
-				DidRekey:      rekeyDone,
-				NeedsPaperKey: true,
-			}, nil
+	fbo.setBranchIDLocked(lState, bid)
+	err = fbo.setHeadLocked(ctx, lState, unmergedHead, headTrusted)
+	if err != nil {
+		return kbfsmd.RevisionUninitialized, err
+	}
+	for _, rmd := range unmergedRmds {
+		err := fbo.notifyBatchLocked(ctx, lState, rmd)
+		if err != nil {
+			return kbfsmd.RevisionUninitialized, err
 		}
-		// This device hasn't been keyed yet, fall through to set the rekey bit
 	}
+	fbo.parkedBID = NullBranchID
+	fbo.resolvingParked = true
+	fbo.acceptingLocal = resolution == ResolveAcceptLocal
+	fbo.status.signalChange()
+	return unmergedHead.Revision(), nil
+}
 
-	// add an empty operation to satisfy assumptions elsewhere
-	md.AddOp(newRekeyOp())
+// discardParkedBranchLocked throws away the changes on the given
+// parked unmerged branch, leaving the merged state as it is.
+func (fbo *folderBranchOps) discardParkedBranchLocked(
+	ctx context.Context, lState *lockState, bid BranchID) error {
+	fbo.mdWriterLock.AssertLocked(lState)
 
-	// we still let readers push a new md block that we validate against reader
-	// permissions
-	err = fbo.finalizeMDRekeyWriteLocked(
-		ctx, lState, md, lastWriterVerifyingKey)
+	unmergedHead, err := fbo.config.MDOps().GetUnmergedForTLF(
+		ctx, fbo.id(), bid)
 	if err != nil {
-		return RekeyResult{
-			DidRekey:      rekeyDone,
-			NeedsPaperKey: stillNeedsRekey,
-		}, err
+		return err
 	}
-
-	// cache any new TLF crypt key
-	if tlfCryptKey != nil {
-		keyGen := md.LatestKeyGeneration()
-		err = fbo.config.KeyCache().PutTLFCryptKey(md.TlfID(), keyGen, *tlfCryptKey)
+	var unmergedPtrs []BlockPointer
+	if unmergedHead != (ImmutableRootMetadata{}) {
+		_, unmergedRmds, err := getUnmergedMDUpdates(
+			ctx, fbo.config, fbo.id(), bid, unmergedHead.Revision())
 		if err != nil {
-			return RekeyResult{
-				DidRekey:      rekeyDone,
-				NeedsPaperKey: stillNeedsRekey,
-			}, err
+			return err
 		}
+		unmergedPtrs = unmergedRefs(unmergedRmds)
 	}
 
-	// send rekey finish notification
-	handle := md.GetTlfHandle()
-	if currKeyGen >= FirstValidKeyGen {
-		fbo.config.Reporter().Notify(ctx,
-			rekeyNotification(ctx, fbo.config, handle, true))
+	fbo.log.CDebugf(ctx, "Discarding branch %s", bid)
+	err = fbo.config.MDOps().PruneBranch(ctx, fbo.id(), bid)
+	if err != nil {
+		return err
+	}
+	err = fbo.setParkedBranchIDLocked(lState, NullBranchID)
+	if err != nil {
+		return err
 	}
 
-	return RekeyResult{
-		DidRekey:      rekeyDone,
-		NeedsPaperKey: stillNeedsRekey,
-	}, nil
-}
-
-func (fbo *folderBranchOps) RequestRekey(_ context.Context, tlf tlf.ID) {
-	fb := FolderBranch{tlf, MasterBranch}
-	if fb != fbo.folderBranch {
-		// TODO: log instead of panic?
-		panic(WrongOpsError{fbo.folderBranch, fb})
+	err = fbo.getAndApplyMDUpdates(ctx, lState, fbo.applyMDUpdatesLocked)
+	if err != nil {
+		return err
 	}
-	fbo.rekeyFSM.Event(NewRekeyRequestEvent())
+	if len(unmergedPtrs) == 0 {
+		return nil
+	}
+	return fbo.unrefUnmergedBlocksLocked(ctx, lState, unmergedPtrs)
 }
 
-func (fbo *folderBranchOps) SyncFromServerForTesting(
-	ctx context.Context, folderBranch FolderBranch) (err error) {
-	fbo.log.CDebugf(ctx, "SyncFromServerForTesting")
+// ResolveUnmerged implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) ResolveUnmerged(ctx context.Context,
+	folderBranch FolderBranch, resolution UnmergedResolution) (err error) {
+	fbo.log.CDebugf(ctx, "ResolveUnmerged %s", resolution)
 	defer func() {
-		fbo.deferLog.CDebugf(ctx,
-			"SyncFromServerForTesting done: %+v", err)
+		fbo.deferLog.CDebugf(ctx, "ResolveUnmerged done: %+v", err)
 	}()
 
 	if folderBranch != fbo.folderBranch {
@@ -5269,226 +7455,183 @@ func (fbo *folderBranchOps) SyncFromServerForTesting(
 	}
 
 	lState := makeFBOLockState()
-
-	// Make sure everything outstanding syncs to disk at least.
-	if err := fbo.syncAllUnlocked(ctx, lState); err != nil {
-		return err
+	bid := fbo.getParkedBranchID(lState)
+	if bid == NullBranchID {
+		return NoUnmergedChangesError{fbo.id()}
 	}
 
-	// A journal flush before CR, if needed.
-	if err := WaitForTLFJournal(ctx, fbo.config, fbo.id(),
-		fbo.log); err != nil {
-		return err
+	switch resolution {
+	case ResolveAcceptRemote:
+		return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+			func(lState *lockState) error {
+				return fbo.discardParkedBranchLocked(ctx, lState, bid)
+			})
+	case ResolveAutomatically, ResolveAcceptLocal:
+	default:
+		return errors.Errorf("Unknown resolution %d", resolution)
 	}
 
-	if err := fbo.mdFlushes.Wait(ctx); err != nil {
+	var unmergedRev kbfsmd.Revision
+	err = fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) (err error) {
+			unmergedRev, err = fbo.restageParkedBranchLocked(
+				ctx, lState, bid, resolution)
+			return err
+		})
+	if err != nil {
 		return err
 	}
+	defer func() {
+		finishErr := fbo.finishResolvingParked(lState, err == nil)
+		if err == nil {
+			err = finishErr
+		}
+	}()
 
-	if err := fbo.branchChanges.Wait(ctx); err != nil {
+	fbo.cr.Resolve(ctx, unmergedRev, kbfsmd.RevisionUninitialized)
+	err = fbo.cr.Wait(ctx)
+	if err != nil {
 		return err
 	}
+	if !fbo.isMasterBranch(lState) {
+		return errors.Errorf(
+			"Conflict resolution of branch %s didn't complete", bid)
+	}
+	return nil
+}
 
-	// Loop until we're fully updated on the master branch.
-	for {
-		if !fbo.isMasterBranch(lState) {
-			if err := fbo.cr.Wait(ctx); err != nil {
-				return err
-			}
-			// If we are still staged after the wait, then we have a problem.
-			if !fbo.isMasterBranch(lState) {
-				return errors.Errorf("Conflict resolution didn't take us out " +
-					"of staging.")
-			}
-		}
-
-		dirtyFiles := fbo.blocks.GetDirtyFileBlockRefs(lState)
-		if len(dirtyFiles) > 0 {
-			for _, ref := range dirtyFiles {
-				fbo.log.CDebugf(ctx, "DeCache entry left: %v", ref)
-			}
-			return errors.New("can't sync from server while dirty")
-		}
-
-		// A journal flush after CR, if needed.
-		if err := WaitForTLFJournal(ctx, fbo.config, fbo.id(),
-			fbo.log); err != nil {
-			return err
-		}
-
-		if err := fbo.mdFlushes.Wait(ctx); err != nil {
-			return err
-		}
+func (fbo *folderBranchOps) handleTLFBranchChange(ctx context.Context,
+	newBID BranchID) {
+	lState := makeFBOLockState()
+	fbo.mdWriterLock.Lock(lState)
+	defer fbo.mdWriterLock.Unlock(lState)
 
-		if err := fbo.branchChanges.Wait(ctx); err != nil {
-			return err
-		}
+	fbo.log.CDebugf(ctx, "Journal branch change: %s", newBID)
 
-		if err := fbo.getAndApplyMDUpdates(
-			ctx, lState, fbo.applyMDUpdates); err != nil {
-			if applyErr, ok := err.(MDRevisionMismatch); ok {
-				if applyErr.rev == applyErr.curr {
-					fbo.log.CDebugf(ctx, "Already up-to-date with server")
-					return nil
-				}
-			}
-			if _, isUnmerged := err.(UnmergedError); isUnmerged {
-				continue
-			} else if err == errNoMergedRevWhileStaged {
-				continue
-			}
-			return err
+	if !fbo.isMasterBranchLocked(lState) {
+		if fbo.bid == newBID {
+			fbo.log.CDebugf(ctx, "Already on branch %s", newBID)
+			return
 		}
-		break
+		panic(fmt.Sprintf("Cannot switch to branch %s while on branch %s",
+			newBID, fbo.bid))
 	}
 
-	// Wait for all the asynchronous block archiving and quota
-	// reclamation to hit the block server.
-	if err := fbo.fbm.waitForArchives(ctx); err != nil {
-		return err
-	}
-	if err := fbo.fbm.waitForDeletingBlocks(ctx); err != nil {
-		return err
-	}
-	if err := fbo.editHistory.Wait(ctx); err != nil {
-		return err
-	}
-	if err := fbo.fbm.waitForQuotaReclamations(ctx); err != nil {
-		return err
+	md, err := fbo.config.MDOps().GetUnmergedForTLF(ctx, fbo.id(), newBID)
+	if err != nil {
+		fbo.log.CWarningf(ctx,
+			"No unmerged head on journal branch change (bid=%s)", newBID)
+		return
 	}
 
-	// A second journal flush if needed, to clear out any
-	// archive/remove calls caused by the above operations.
-	return WaitForTLFJournal(ctx, fbo.config, fbo.id(), fbo.log)
-}
-
-// CtxFBOTagKey is the type used for unique context tags within folderBranchOps
-type CtxFBOTagKey int
-
-const (
-	// CtxFBOIDKey is the type of the tag for unique operation IDs
-	// within folderBranchOps.
-	CtxFBOIDKey CtxFBOTagKey = iota
-)
+	if md == (ImmutableRootMetadata{}) || md.MergedStatus() != Unmerged ||
+		md.BID() != newBID {
+		// This can happen if CR got kicked off in some other way and
+		// completed before we took the lock to process this
+		// notification.
+		fbo.log.CDebugf(ctx, "Ignoring stale branch change: md=%v, newBID=%d",
+			md, newBID)
+		return
+	}
 
-// CtxFBOOpID is the display name for the unique operation
-// folderBranchOps ID tag.
-const CtxFBOOpID = "FBOID"
+	// Everything we thought we knew about quota reclamation is now
+	// called into question.
+	fbo.fbm.clearLastQRData()
 
-func (fbo *folderBranchOps) ctxWithFBOID(ctx context.Context) context.Context {
-	return CtxWithRandomIDReplayable(ctx, CtxFBOIDKey, CtxFBOOpID, fbo.log)
-}
+	// Kick off conflict resolution and set the head to the correct branch.
+	fbo.setBranchIDLocked(lState, newBID)
+	fbo.cr.Resolve(ctx, md.Revision(), kbfsmd.RevisionUninitialized)
 
-func (fbo *folderBranchOps) newCtxWithFBOID() (context.Context, context.CancelFunc) {
-	// No need to call NewContextReplayable since ctxWithFBOID calls
-	// ctxWithRandomIDReplayable, which attaches replayably.
-	ctx := fbo.ctxWithFBOID(context.Background())
-	ctx, cancelFunc := context.WithCancel(ctx)
-	ctx, err := NewContextWithCancellationDelayer(ctx)
+	fbo.headLock.Lock(lState)
+	defer fbo.headLock.Unlock(lState)
+	err = fbo.setHeadSuccessorLocked(ctx, lState, md, true /*rebased*/)
 	if err != nil {
-		panic(err)
+		fbo.log.CWarningf(ctx,
+			"Could not set head on journal branch change: %v", err)
+		return
 	}
-	return ctx, cancelFunc
 }
 
-// Run the passed function with a context that's canceled on shutdown.
-func (fbo *folderBranchOps) runUnlessShutdown(fn func(ctx context.Context) error) error {
-	ctx, cancelFunc := fbo.newCtxWithFBOID()
-	defer cancelFunc()
-	errChan := make(chan error, 1)
+func (fbo *folderBranchOps) onTLFBranchChange(newBID BranchID) {
+	fbo.branchChanges.Add(1)
+
 	go func() {
-		errChan <- fn(ctx)
-	}()
+		defer fbo.branchChanges.Done()
+		ctx, cancelFunc := fbo.newCtxWithFBOID()
+		defer cancelFunc()
 
-	select {
-	case err := <-errChan:
-		return err
-	case <-fbo.shutdownChan:
-		return ShutdownHappenedError{}
-	}
+		// This only happens on a `PruneBranch` call, in which case we
+		// would have already updated fbo's local view of the branch/head.
+		if newBID == NullBranchID {
+			fbo.log.CDebugf(ctx, "Ignoring branch change back to master")
+			return
+		}
+
+		fbo.handleTLFBranchChange(ctx, newBID)
+	}()
 }
 
-func (fbo *folderBranchOps) doFastForwardLocked(ctx context.Context,
-	lState *lockState, currHead ImmutableRootMetadata) error {
-	fbo.mdWriterLock.AssertLocked(lState)
-	fbo.headLock.AssertLocked(lState)
+func (fbo *folderBranchOps) handleMDFlush(ctx context.Context, bid BranchID,
+	rev kbfsmd.Revision) {
+	fbo.log.CDebugf(ctx, "Considering archiving references for flushed MD revision %d", rev)
 
-	fbo.log.CDebugf(ctx, "Fast-forwarding from rev %d to rev %d",
-		fbo.latestMergedRevision, currHead.Revision())
-	changes, err := fbo.blocks.FastForwardAllNodes(
-		ctx, lState, currHead.ReadOnly())
-	if err != nil {
-		return err
-	}
+	lState := makeFBOLockState()
+	func() {
+		fbo.headLock.Lock(lState)
+		defer fbo.headLock.Unlock(lState)
+		fbo.setLatestMergedRevisionLocked(ctx, lState, rev, false)
+	}()
 
-	err = fbo.setHeadSuccessorLocked(ctx, lState, currHead, true /*rebase*/)
+	// Get that revision.
+	rmd, err := getSingleMD(ctx, fbo.config, fbo.id(), NullBranchID,
+		rev, Merged)
 	if err != nil {
-		return err
+		fbo.log.CWarningf(ctx, "Couldn't get revision %d for archiving: %v",
+			rev, err)
+		return
 	}
 
-	// Invalidate all the affected nodes.
-	if len(changes) > 0 {
-		fbo.observers.batchChanges(ctx, changes)
+	if err := isArchivableMDOrError(rmd.ReadOnly()); err != nil {
+		fbo.log.CDebugf(
+			ctx, "Skipping archiving references for flushed MD revision %d: %s", rev, err)
+		return
 	}
 
-	// Reset the edit history.  TODO: notify any listeners that we've
-	// done this.
-	fbo.editHistory.Shutdown()
-	fbo.editHistory = NewTlfEditHistory(fbo.config, fbo, fbo.log)
-	return nil
+	fbo.fbm.archiveUnrefBlocks(rmd.ReadOnly())
 }
 
-func (fbo *folderBranchOps) maybeFastForward(ctx context.Context,
-	lState *lockState, lastUpdate time.Time, currUpdate time.Time) (
-	fastForwardDone bool, err error) {
-	// Has it been long enough to try fast-forwarding?
-	if currUpdate.Before(lastUpdate.Add(fastForwardTimeThresh)) ||
-		!fbo.isMasterBranch(lState) {
-		return false, nil
-	}
-
-	fbo.log.CDebugf(ctx, "Checking head for possible "+
-		"fast-forwarding (last update time=%s)", lastUpdate)
-	currHead, err := fbo.config.MDOps().GetForTLF(ctx, fbo.id())
-	if err != nil {
-		return false, err
-	}
-	fbo.log.CDebugf(ctx, "Current head is revision %d", currHead.Revision())
+func (fbo *folderBranchOps) onMDFlush(bid BranchID, rev kbfsmd.Revision) {
+	fbo.mdFlushes.Add(1)
 
-	fbo.mdWriterLock.Lock(lState)
-	defer fbo.mdWriterLock.Unlock(lState)
-	// If the journal has anything in it, don't fast-forward since we
-	// haven't finished flushing yet.  If there was really a remote
-	// update on the server, we'll end up in CR eventually.
-	mergedRev, err := fbo.getJournalPredecessorRevision(ctx)
-	if err != nil {
-		return false, err
-	}
-	if mergedRev != kbfsmd.RevisionUninitialized {
-		return false, nil
-	}
+	go func() {
+		defer fbo.mdFlushes.Done()
+		ctx, cancelFunc := fbo.newCtxWithFBOID()
+		defer cancelFunc()
 
-	if !fbo.isMasterBranchLocked(lState) {
-		// Don't update if we're staged.
-		return false, nil
-	}
+		if bid != NullBranchID {
+			fbo.log.CDebugf(ctx, "Ignoring MD flush on branch %v for "+
+				"revision %d", bid, rev)
+			return
+		}
 
-	fbo.headLock.Lock(lState)
-	defer fbo.headLock.Unlock(lState)
+		fbo.handleMDFlush(ctx, bid, rev)
+	}()
+}
 
-	if currHead.Revision() < fbo.latestMergedRevision+fastForwardRevThresh {
-		// Might as well fetch all the revisions.
-		return false, nil
-	}
+// TeamNameChanged implements the KBFSOps interface for folderBranchOps
+func (fbo *folderBranchOps) TeamNameChanged(
+	ctx context.Context, tid keybase1.TeamID) {
+	ctx, cancelFunc := fbo.newCtxWithFBOID()
+	defer cancelFunc()
+	fbo.log.CDebugf(ctx, "Starting name change for team %s", tid)
 
-	err = fbo.doFastForwardLocked(ctx, lState, currHead)
+	newName, err := fbo.config.KBPKI().GetNormalizedUsername(
+		ctx, tid.AsUserOrTeam())
 	if err != nil {
-		return false, err
+		fbo.log.CWarningf(ctx, "Error getting new team name: %+v", err)
+		return
 	}
-	return true, nil
-}
 
-func (fbo *folderBranchOps) locallyFinalizeTLF(ctx context.Context) {
 	lState := makeFBOLockState()
 	fbo.mdWriterLock.Lock(lState)
 	defer fbo.mdWriterLock.Unlock(lState)
@@ -5496,766 +7639,997 @@ func (fbo *folderBranchOps) locallyFinalizeTLF(ctx context.Context) {
 	defer fbo.headLock.Unlock(lState)
 
 	if fbo.head == (ImmutableRootMetadata{}) {
+		fbo.log.CWarningf(ctx, "No head to update")
 		return
 	}
 
-	// It's safe to give this a finalized number of 1 and a fake user
-	// name.  The whole point here is to move the old finalized TLF
-	// name away to a new name, where the user won't be able to access
-	// it anymore, and if there's a conflict with a previously-moved
-	// TLF that shouldn't matter.
-	now := fbo.config.Clock().Now()
-	finalizedInfo, err := tlf.NewHandleExtension(
-		tlf.HandleExtensionFinalized, 1, libkb.NormalizedUsername("<unknown>"),
-		now)
-	if err != nil {
-		fbo.log.CErrorf(ctx, "Couldn't make finalized info: %+v", err)
-		return
-	}
+	oldHandle := fbo.head.GetTlfHandle()
 
-	fakeSignedHead := &RootMetadataSigned{MD: fbo.head.bareMd}
-	finalRmd, err := fakeSignedHead.MakeFinalCopy(
-		fbo.config.Codec(), now, finalizedInfo)
-	if err != nil {
-		fbo.log.CErrorf(ctx, "Couldn't finalize MD: %+v", err)
+	if string(oldHandle.GetCanonicalName()) == string(newName) {
+		fbo.log.CDebugf(ctx, "Name didn't change: %s", newName)
 		return
 	}
 
-	// Construct the data needed to fake a new head.
-	mdID, err := kbfsmd.MakeID(fbo.config.Codec(), finalRmd.MD)
-	if err != nil {
-		fbo.log.CErrorf(ctx, "Couldn't get finalized MD ID: %+v", err)
-		return
-	}
-	bareHandle, err := finalRmd.MD.MakeBareTlfHandle(fbo.head.Extra())
-	if err != nil {
-		fbo.log.CErrorf(ctx, "Couldn't get finalized bare handle: %+v", err)
+	if oldHandle.FirstResolvedWriter() != tid.AsUserOrTeam() {
+		fbo.log.CWarningf(ctx,
+			"Old handle doesn't include changed team ID: %s",
+			oldHandle.FirstResolvedWriter())
 		return
 	}
-	handle, err := MakeTlfHandle(ctx, bareHandle, fbo.config.KBPKI())
+
+	// Make a copy of `head` with the new handle.
+	newHandle := oldHandle.deepCopy()
+	newHandle.name = CanonicalTlfName(newName)
+	newHandle.resolvedWriters[tid.AsUserOrTeam()] = newName
+	newHead, err := fbo.head.deepCopy(fbo.config.Codec())
 	if err != nil {
-		fbo.log.CErrorf(ctx, "Couldn't get finalized handle: %+v", err)
-		return
-	}
-	finalBrmd, ok := finalRmd.MD.(MutableBareRootMetadata)
-	if !ok {
-		fbo.log.CErrorf(ctx, "Couldn't get finalized mutable bare MD: %+v", err)
+		fbo.log.CWarningf(ctx, "Error copying head: %+v", err)
 		return
 	}
+	newHead.tlfHandle = newHandle
 
-	// We don't have a way to sign this with a valid key (and we might
-	// be logged out anyway), so just directly make the md immutable.
-	finalIrmd := ImmutableRootMetadata{
-		ReadOnlyRootMetadata: makeRootMetadata(
-			finalBrmd, fbo.head.Extra(), handle).ReadOnly(),
-		mdID: mdID,
-	}
-
-	// This will trigger the handle change notification to observers.
-	err = fbo.setHeadSuccessorLocked(ctx, lState, finalIrmd, false)
+	fbo.log.CDebugf(ctx, "Team name changed from %s to %s",
+		oldHandle.GetCanonicalName(), newHandle.GetCanonicalName())
+	fbo.head = MakeImmutableRootMetadata(
+		newHead, fbo.head.lastWriterVerifyingKey, fbo.head.mdID,
+		fbo.head.localTimestamp, fbo.head.putToServer)
 	if err != nil {
-		fbo.log.CErrorf(ctx, "Couldn't set finalized MD: %+v", err)
+		fbo.log.CWarningf(ctx, "Error setting head: %+v", err)
 		return
 	}
-}
 
-func (fbo *folderBranchOps) registerAndWaitForUpdates() {
-	defer close(fbo.updateDoneChan)
-	childDone := make(chan struct{})
-	var lastUpdate time.Time
-	err := fbo.runUnlessShutdown(func(ctx context.Context) error {
-		defer close(childDone)
-		// If we fail to register for or process updates, try again
-		// with an exponential backoff, so we don't overwhelm the
-		// server or ourselves with too many attempts in a hopeless
-		// situation.
-		expBackoff := backoff.NewExponentialBackOff()
-		// Never give up hope until we shut down
-		expBackoff.MaxElapsedTime = 0
-		// Register and wait in a loop unless we hit an unrecoverable error
-		fbo.cancelUpdatesLock.Lock()
-		if fbo.cancelUpdates != nil {
-			// It should be impossible to get here without having
-			// already called the cancel function, but just in case
-			// call it here again.
-			fbo.cancelUpdates()
-		}
-		ctx, fbo.cancelUpdates = context.WithCancel(ctx)
-		fbo.cancelUpdatesLock.Unlock()
-		for {
-			err := backoff.RetryNotifyWithContext(ctx, func() error {
-				// Replace the FBOID one with a fresh id for every attempt
-				newCtx := fbo.ctxWithFBOID(ctx)
-				updateChan, err := fbo.registerForUpdates(newCtx)
-				if err != nil {
-					select {
-					case <-ctx.Done():
-						// Shortcut the retry, we're done.
-						return nil
-					default:
-						return err
-					}
-				}
+	fbo.observers.tlfHandleChange(ctx, newHandle)
+}
 
-				currUpdate, err := fbo.waitForAndProcessUpdates(
-					newCtx, lastUpdate, updateChan)
-				switch errors.Cause(err).(type) {
-				case UnmergedError:
-					// skip the back-off timer and continue directly to next
-					// registerForUpdates
-					return nil
-				case NewMetadataVersionError:
-					fbo.log.CDebugf(ctx, "Abandoning updates since we can't "+
-						"read the newest metadata: %+v", err)
-					fbo.status.setPermErr(err)
-					// No need to lock here, since `cancelUpdates` is
-					// only set within this same goroutine.
-					fbo.cancelUpdates()
-					return context.Canceled
-				case kbfsmd.ServerErrorCannotReadFinalizedTLF:
-					fbo.log.CDebugf(ctx, "Abandoning updates since we can't "+
-						"read the finalized metadata for this TLF: %+v", err)
-					fbo.status.setPermErr(err)
+// GetUpdateHistory implements the KBFSOps interface for folderBranchOps
+func (fbo *folderBranchOps) GetUpdateHistory(ctx context.Context,
+	folderBranch FolderBranch) (history TLFUpdateHistory, err error) {
+	fbo.log.CDebugf(ctx, "GetUpdateHistory")
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "GetUpdateHistory done: %+v", err)
+	}()
 
-					// Locally finalize the TLF so new accesses
-					// through to the old folder name will find the
-					// new folder.
-					fbo.locallyFinalizeTLF(newCtx)
+	if folderBranch != fbo.folderBranch {
+		return TLFUpdateHistory{}, WrongOpsError{fbo.folderBranch, folderBranch}
+	}
 
-					// No need to lock here, since `cancelUpdates` is
-					// only set within this same goroutine.
-					fbo.cancelUpdates()
-					return context.Canceled
-				}
-				select {
-				case <-ctx.Done():
-					// Shortcut the retry, we're done.
-					return nil
-				default:
-					if err == nil {
-						lastUpdate = currUpdate
-					}
-					return err
-				}
-			},
-				expBackoff,
-				func(err error, nextTime time.Duration) {
-					fbo.log.CDebugf(ctx,
-						"Retrying registerForUpdates in %s due to err: %v",
-						nextTime, err)
-				})
+	rmds, err := getMergedMDUpdates(ctx, fbo.config, fbo.id(),
+		kbfsmd.RevisionInitial)
+	if err != nil {
+		return TLFUpdateHistory{}, err
+	}
+
+	if len(rmds) > 0 {
+		rmd := rmds[len(rmds)-1]
+		history.ID = rmd.TlfID().String()
+		history.Name = rmd.GetTlfHandle().GetCanonicalPath()
+	}
+	history.Updates = make([]UpdateSummary, 0, len(rmds))
+	writerNames := make(map[keybase1.UID]string)
+	for _, rmd := range rmds {
+		writer, ok := writerNames[rmd.LastModifyingWriter()]
+		if !ok {
+			name, err := fbo.config.KBPKI().GetNormalizedUsername(
+				ctx, rmd.LastModifyingWriter().AsUserOrTeam())
 			if err != nil {
-				return err
+				return TLFUpdateHistory{}, err
 			}
+			writer = string(name)
+			writerNames[rmd.LastModifyingWriter()] = writer
 		}
-	})
-
-	if err != nil && err != context.Canceled {
-		fbo.log.CWarningf(context.Background(),
-			"registerAndWaitForUpdates failed unexpectedly with an error: %v",
-			err)
+		updateSummary := UpdateSummary{
+			Revision:  rmd.Revision(),
+			Date:      rmd.localTimestamp,
+			Writer:    writer,
+			LiveBytes: rmd.DiskUsage(),
+			Ops:       make([]OpSummary, 0, len(rmd.data.Changes.Ops)),
+		}
+		for _, op := range rmd.data.Changes.Ops {
+			opSummary := OpSummary{
+				Op:      op.String(),
+				Refs:    make([]string, 0, len(op.Refs())),
+				Unrefs:  make([]string, 0, len(op.Unrefs())),
+				Updates: make(map[string]string),
+			}
+			for _, ptr := range op.Refs() {
+				opSummary.Refs = append(opSummary.Refs, ptr.String())
+			}
+			for _, ptr := range op.Unrefs() {
+				opSummary.Unrefs = append(opSummary.Unrefs, ptr.String())
+			}
+			for _, update := range op.allUpdates() {
+				opSummary.Updates[update.Unref.String()] = update.Ref.String()
+			}
+			updateSummary.Ops = append(updateSummary.Ops, opSummary)
+		}
+		history.Updates = append(history.Updates, updateSummary)
 	}
-	<-childDone
+	return history, nil
 }
 
-func (fbo *folderBranchOps) registerForUpdatesShouldFireNow() bool {
-	fbo.muLastGetHead.Lock()
-	defer fbo.muLastGetHead.Unlock()
-	return fbo.config.Clock().Now().Sub(fbo.lastGetHead) < registerForUpdatesFireNowThreshold
-}
+// GetEditHistory implements the KBFSOps interface for folderBranchOps
+func (fbo *folderBranchOps) GetEditHistory(ctx context.Context,
+	folderBranch FolderBranch) (edits TlfWriterEdits, err error) {
+	fbo.log.CDebugf(ctx, "GetEditHistory")
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "GetEditHistory done: %+v", err)
+	}()
 
-func (fbo *folderBranchOps) registerForUpdates(ctx context.Context) (
-	updateChan <-chan error, err error) {
-	lState := makeFBOLockState()
-	currRev := fbo.getLatestMergedRevision(lState)
+	if folderBranch != fbo.folderBranch {
+		return nil, WrongOpsError{fbo.folderBranch, folderBranch}
+	}
 
-	fireNow := false
-	if fbo.registerForUpdatesShouldFireNow() {
-		ctx = rpc.WithFireNow(ctx)
-		fireNow = true
+	lState := makeFBOLockState()
+	head, err := fbo.getMDForReadNeedIdentify(ctx, lState)
+	if err != nil {
+		return nil, err
 	}
 
-	fbo.log.CDebugf(ctx,
-		"Registering for updates (curr rev = %d, fire now = %v)",
-		currRev, fireNow)
-	defer func() {
-		fbo.deferLog.CDebugf(ctx,
-			"Registering for updates (curr rev = %d, fire now = %v) done: %+v",
-			currRev, fireNow, err)
-	}()
-	// RegisterForUpdate will itself retry on connectivity issues
-	return fbo.config.MDServer().RegisterForUpdate(ctx, fbo.id(), currRev)
+	return fbo.editHistory.GetComplete(ctx, head)
 }
 
-func (fbo *folderBranchOps) waitForAndProcessUpdates(
-	ctx context.Context, lastUpdate time.Time,
-	updateChan <-chan error) (currUpdate time.Time, err error) {
-	// successful registration; now, wait for an update or a shutdown
-	fbo.log.CDebugf(ctx, "Waiting for updates")
+// getFirstUnreclaimedRevision returns the first merged revision
+// that QR can't have touched yet, as of the given head, given the
+// last revision that QR is known to have reclaimed and how old
+// unreferenced blocks must be before QR can reclaim them.  The
+// blocks unreferenced by that revision or any later one are still
+// available, but anything unreferenced before it might already be
+// gone.
+func (fbo *folderBranchOps) getFirstUnreclaimedRevision(
+	ctx context.Context, head ImmutableRootMetadata,
+	lastReclaimedRev kbfsmd.Revision, unrefAge time.Duration) (
+	kbfsmd.Revision, error) {
+	// QR might be in the middle of reclaiming anything older than
+	// the unref age.
+	cutoff := fbo.config.Clock().Now().Add(-unrefAge)
+	cutoffRev, err := getMergedRevisionForTime(ctx, fbo.config, head, cutoff)
+	switch errors.Cause(err).(type) {
+	case nil:
+	case NoRevisionAtTimeError:
+		// The whole history of the TLF is recent enough.
+		cutoffRev = kbfsmd.RevisionUninitialized
+	default:
+		return kbfsmd.RevisionUninitialized, err
+	}
+	if lastReclaimedRev > cutoffRev {
+		cutoffRev = lastReclaimedRev
+	}
+	return cutoffRev + 1, nil
+}
+
+// SetTrashRetention implements the KBFSOps interface for
+// folderBranchOps.
+func (fbo *folderBranchOps) SetTrashRetention(ctx context.Context,
+	folderBranch FolderBranch, retention time.Duration) (err error) {
+	fbo.log.CDebugf(ctx, "SetTrashRetention %s", retention)
 	defer func() {
-		fbo.deferLog.CDebugf(ctx, "Waiting for updates done: %+v", err)
+		fbo.deferLog.CDebugf(ctx, "SetTrashRetention done: %+v", err)
 	}()
 
-	lState := makeFBOLockState()
+	if folderBranch != fbo.folderBranch {
+		return WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+	if retention < 0 {
+		return errors.Errorf("Invalid trash retention %s", retention)
+	}
 
-	for {
-		select {
-		case err := <-updateChan:
-			fbo.log.CDebugf(ctx, "Got an update: %v", err)
-			if err != nil {
-				return time.Time{}, err
-			}
-			// Getting and applying the updates requires holding
-			// locks, so make sure it doesn't take too long.
-			ctx, cancel := context.WithTimeout(ctx, backgroundTaskTimeout)
-			defer cancel()
+	return fbo.finalizeGCOpWith(ctx, func(md *RootMetadata) *GCOp {
+		md.SetTrashRetention(retention)
+		// The setting rides along with a gcOp that doesn't reclaim
+		// anything new, so that clients that don't know about it
+		// can still read this revision.
+		return newGCOp(md.data.LastGCRevision)
+	})
+}
 
-			currUpdate := fbo.config.Clock().Now()
-			ffDone, err :=
-				fbo.maybeFastForward(ctx, lState, lastUpdate, currUpdate)
-			if err != nil {
-				return time.Time{}, err
-			}
-			if ffDone {
-				return currUpdate, nil
-			}
+// deletedEntriesCache remembers the merged revisions read by the last
+// GetDeletedEntries call, along with the entries found in them, so
+// that listing the deleted entries again only has to fetch the
+// revisions made since then.
+type deletedEntriesCache struct {
+	lock sync.Mutex
+	// rmds are the consecutive merged revisions starting at
+	// startRev, up to the head that entries were found for.
+	startRev kbfsmd.Revision
+	rmds     []ImmutableRootMetadata
+	entries  []DeletedEntry
+}
+
+// getDeletedEntriesMDsLocked returns the merged revisions from
+// startRev up to the given head, reusing the ones that are already
+// cached, and whether they're exactly the revisions that the cached
+// entries were found in.  `fbo.deletedEntries.lock` must be taken
+// before calling.
+func (fbo *folderBranchOps) getDeletedEntriesMDsLocked(ctx context.Context,
+	head ImmutableRootMetadata, startRev kbfsmd.Revision) (
+	rmds []ImmutableRootMetadata, unchanged bool, err error) {
+	c := &fbo.deletedEntries
+	rmds = c.rmds
+	// Drop the revisions that might have been reclaimed since.
+	for len(rmds) > 0 && rmds[0].Revision() < startRev {
+		rmds = rmds[1:]
+	}
+	if len(rmds) > 0 && rmds[0].Revision() != startRev {
+		rmds = nil
+	}
+	fetchStart := startRev
+	if len(rmds) > 0 {
+		last := rmds[len(rmds)-1]
+		switch {
+		case last.MdID() == head.MdID():
+			return rmds, c.startRev == startRev, nil
+		case last.Revision() < head.Revision():
+			fetchStart = last.Revision() + 1
+		default:
+			// The head was replaced, e.g. by conflict resolution.
+			rmds = nil
+		}
+	}
 
-			err = fbo.getAndApplyMDUpdates(ctx, lState, fbo.applyMDUpdates)
-			if err != nil {
-				fbo.log.CDebugf(ctx, "Got an error while applying "+
-					"updates: %v", err)
-				return time.Time{}, err
-			}
-			return currUpdate, nil
-		case unpause := <-fbo.updatePauseChan:
-			fbo.log.CInfof(ctx, "Updates paused")
-			// wait to be unpaused
-			select {
-			case <-unpause:
-				fbo.log.CInfof(ctx, "Updates unpaused")
-			case <-ctx.Done():
-				return time.Time{}, ctx.Err()
-			}
-		case <-ctx.Done():
-			return time.Time{}, ctx.Err()
+	newRmds, err := getMDRange(ctx, fbo.config, fbo.id(), NullBranchID,
+		fetchStart, head.Revision(), Merged)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(rmds) > 0 && (len(newRmds) == 0 ||
+		newRmds[0].PrevRoot() != rmds[len(rmds)-1].MdID()) {
+		// The cached revisions aren't part of this history anymore.
+		fbo.log.CDebugf(ctx, "Refetching the revisions since %d", startRev)
+		rmds = nil
+		newRmds, err = getMDRange(ctx, fbo.config, fbo.id(), NullBranchID,
+			startRev, head.Revision(), Merged)
+		if err != nil {
+			return nil, false, err
 		}
 	}
+	// Copy on append, so the old cached slice isn't modified.
+	return append(rmds[:len(rmds):len(rmds)], newRmds...), false, nil
 }
 
-func (fbo *folderBranchOps) getCachedDirOpsCount(lState *lockState) int {
-	fbo.mdWriterLock.Lock(lState)
-	defer fbo.mdWriterLock.Unlock(lState)
-	return len(fbo.dirOps)
-}
+// GetDeletedEntries implements the KBFSOps interface for
+// folderBranchOps.
+func (fbo *folderBranchOps) GetDeletedEntries(ctx context.Context,
+	folderBranch FolderBranch) (entries []DeletedEntry, err error) {
+	fbo.log.CDebugf(ctx, "GetDeletedEntries")
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "GetDeletedEntries done (%d entries): %+v",
+			len(entries), err)
+	}()
+
+	if folderBranch != fbo.folderBranch {
+		return nil, WrongOpsError{fbo.folderBranch, folderBranch}
+	}
 
-func (fbo *folderBranchOps) backgroundFlusher() {
 	lState := makeFBOLockState()
-	var prevDirtyFileMap map[BlockRef]bool
-	sameDirtyFileCount := 0
-	for {
-		doSelect := true
-		if fbo.blocks.GetState(lState) == dirtyState &&
-			fbo.config.DirtyBlockCache().ShouldForceSync(fbo.id()) &&
-			sameDirtyFileCount < 10 {
-			// We have dirty files, and the system has a full buffer,
-			// so don't bother waiting for a signal, just get right to
-			// the main attraction.
-			doSelect = false
-		} else if fbo.getCachedDirOpsCount(lState) >=
-			fbo.config.BGFlushDirOpBatchSize() {
-			doSelect = false
+	head, err := fbo.getMDForReadNeedIdentify(ctx, lState)
+	if err != nil {
+		return nil, err
+	}
+	if head.MergedStatus() != Merged {
+		return nil, UnmergedError{}
+	}
+
+	startRev, err := fbo.getFirstUnreclaimedRevision(ctx, head,
+		head.data.lastTrashGCRevision(head.data.LastGCRevision),
+		trashUnrefAge(fbo.config, head.data.TrashRetention))
+	if err != nil {
+		return nil, err
+	}
+	if startRev > head.Revision() {
+		return nil, nil
+	}
+
+	fbo.deletedEntries.lock.Lock()
+	defer fbo.deletedEntries.lock.Unlock()
+	rmds, unchanged, err := fbo.getDeletedEntriesMDsLocked(
+		ctx, head, startRev)
+	if err != nil {
+		return nil, err
+	}
+	if unchanged {
+		fbo.log.CDebugf(ctx, "Using the cached deleted entries")
+		return append([]DeletedEntry(nil), fbo.deletedEntries.entries...), nil
+	}
+	defer func() {
+		if err == nil {
+			fbo.deletedEntries.startRev = startRev
+			fbo.deletedEntries.rmds = rmds
+			fbo.deletedEntries.entries =
+				append([]DeletedEntry(nil), entries...)
 		}
+	}()
+	if len(rmds) == 0 {
+		return nil, nil
+	}
 
-		if doSelect {
-			// Wait until we really have a write waiting.
-			doWait := true
-			select {
-			case <-fbo.syncNeededChan:
-				if fbo.getCachedDirOpsCount(lState) >=
-					fbo.config.BGFlushDirOpBatchSize() {
-					doWait = false
+	// The chains are only used to follow the pointers of the parent
+	// directories up to the head revision, since the ops of entries
+	// created within these revisions get collapsed away.
+	chains, err := newCRChainsForIRMDs(
+		ctx, fbo.config.Codec(), rmds, &fbo.blocks, false)
+	if err != nil {
+		return nil, err
+	}
+
+	type removal struct {
+		ro     *rmOp
+		rmd    ImmutableRootMetadata
+		parent BlockPointer // original pointer of the parent dir
+		oldDir BlockPointer // parent dir pointer before the removal
+	}
+	var removals []removal
+	byParent := make(map[BlockPointer][]removal)
+	// The chains only know the original and most recent pointers of
+	// each directory, so track the intermediate ones separately.
+	originals := make(map[BlockPointer]BlockPointer)
+	originalOf := func(ptr BlockPointer) BlockPointer {
+		if original, ok := originals[ptr]; ok {
+			return original
+		}
+		return ptr
+	}
+	for _, rmd := range rmds {
+		ops := rmd.data.Changes.Ops
+		if rmd.data.Changes.Info.BlockPointer.IsInitialized() {
+			ops = rmd.data.cachedChanges.Ops
+		}
+		// Batched syncs only record self-updates in the dir ops,
+		// and put the real pointer updates in a resolution op.
+		oldPtrs := make(map[BlockPointer]BlockPointer)
+		for _, op := range ops {
+			if resOp, ok := op.(*resolutionOp); ok {
+				for _, update := range resOp.allUpdates() {
+					oldPtrs[update.Ref] = update.Unref
+					originals[update.Ref] = originalOf(update.Unref)
 				}
-			case <-fbo.forceSyncChan:
-				doWait = false
-			case <-fbo.shutdownChan:
-				return
 			}
-
-			if doWait {
-				timer := time.NewTimer(fbo.config.BGFlushPeriod())
-				// Loop until either a tick's worth of time passes,
-				// the batch size of directory ops is full, a sync is
-				// forced, or a shutdown happens.
-			loop:
-				for {
-					select {
-					case <-timer.C:
-						break loop
-					case <-fbo.syncNeededChan:
-						if fbo.getCachedDirOpsCount(lState) >=
-							fbo.config.BGFlushDirOpBatchSize() {
-							break loop
-						}
-					case <-fbo.forceSyncChan:
-						break loop
-					case <-fbo.shutdownChan:
-						return
-					}
+		}
+		for _, op := range ops {
+			ro, ok := op.(*rmOp)
+			if !ok {
+				continue
+			}
+			parent := originalOf(ro.Dir.Ref)
+			oldDir := ro.Dir.Unref
+			if oldPtr, ok := oldPtrs[ro.Dir.Ref]; ok && oldDir == ro.Dir.Ref {
+				oldDir = oldPtr
+			}
+			r := removal{ro, rmd, parent, oldDir}
+			removals = append(removals, r)
+			byParent[parent] = append(byParent[parent], r)
+		}
+	}
+	if len(removals) == 0 {
+		return nil, nil
+	}
+
+	// A removed directory was probably emptied first, so find the
+	// first revision that removed anything from under it.  The
+	// unrefs of a removal include the pointer of a removed
+	// directory, which leads to the removals of its children.
+	var firstRemovalRev func(r removal) kbfsmd.Revision
+	firstRemovalRev = func(r removal) kbfsmd.Revision {
+		first := r.rmd.Revision()
+		for _, ptr := range r.ro.Unrefs() {
+			for _, child := range byParent[originalOf(ptr)] {
+				if rev := firstRemovalRev(child); rev < first {
+					first = rev
 				}
 			}
 		}
+		return first
+	}
 
-		dirtyFiles := fbo.blocks.GetDirtyFileBlockRefs(lState)
-		dirOpsCount := fbo.getCachedDirOpsCount(lState)
-		if len(dirtyFiles) == 0 && dirOpsCount == 0 {
-			sameDirtyFileCount = 0
+	// Find the current paths of the parent directories that still
+	// exist.  Entries removed along with their parent are skipped.
+	newPtrs := make(map[BlockPointer]bool)
+	for ptr := range chains.byMostRecent {
+		newPtrs[ptr] = true
+	}
+	parentPtrs := make(map[BlockPointer]BlockPointer)
+	var ptrs []BlockPointer
+	for _, r := range removals {
+		if _, ok := parentPtrs[r.parent]; ok ||
+			chains.isDeleted(r.parent) {
 			continue
 		}
+		mostRecent, err := chains.mostRecentFromOriginalOrSame(r.parent)
+		if err != nil {
+			return nil, err
+		}
+		parentPtrs[r.parent] = mostRecent
+		ptrs = append(ptrs, mostRecent)
+	}
+	paths, err := fbo.blocks.SearchForPaths(ctx, fbo.nodeCache, ptrs,
+		newPtrs, head, head.data.Dir.BlockPointer)
+	if err != nil {
+		return nil, err
+	}
 
-		// Make sure we are making some progress
-		currDirtyFileMap := make(map[BlockRef]bool)
-		for _, ref := range dirtyFiles {
-			currDirtyFileMap[ref] = true
+	for _, r := range removals {
+		// The blocks of entries removed without any trash
+		// retention are archived, so they can't be restored.
+		if !isTrashOp(r.ro, r.rmd.data.TrashRetention) {
+			continue
 		}
-		if reflect.DeepEqual(currDirtyFileMap, prevDirtyFileMap) {
-			sameDirtyFileCount++
-		} else {
-			sameDirtyFileCount = 0
+		mostRecent, ok := parentPtrs[r.parent]
+		if !ok {
+			continue
+		}
+		dirPath, ok := paths[mostRecent]
+		if !ok || !dirPath.isValid() {
+			continue
 		}
-		prevDirtyFileMap = currDirtyFileMap
-
-		fbo.runUnlessShutdown(func(ctx context.Context) (err error) {
-			// Denote that these are coming from a background
-			// goroutine, not directly from any user.
-			ctx = NewContextReplayable(ctx,
-				func(ctx context.Context) context.Context {
-					return context.WithValue(ctx, CtxBackgroundSyncKey, "1")
-				})
-
-			fbo.log.CDebugf(ctx, "Background sync triggered: %d dirty files, "+
-				"%d dir ops in batch", len(dirtyFiles), dirOpsCount)
-
-			if sameDirtyFileCount >= 100 {
-				// If the local journal is full, we might not be able to
-				// make progress until more data is flushed to the
-				// servers, so just warn here rather than just an outright
-				// panic.
-				fbo.log.CWarningf(ctx, "Making no Sync progress on dirty "+
-					"files after %d attempts: %v", sameDirtyFileCount,
-					dirtyFiles)
-			}
 
-			// Just in case network access or a bug gets stuck for a
-			// long time, time out the sync eventually.
-			longCtx, longCancel :=
-				context.WithTimeout(ctx, backgroundTaskTimeout)
-			defer longCancel()
-			err = fbo.SyncAll(longCtx, fbo.folderBranch)
-			if err != nil {
-				// Just log the warning and keep trying to
-				// sync the rest of the dirty files.
-				fbo.log.CWarningf(ctx, "Couldn't sync all: %+v", err)
-			}
-			return nil
+		oldDirPath := path{fbo.folderBranch, []pathNode{
+			{r.oldDir, dirPath.tailName()}}}
+		de, err := fbo.blocks.GetDirtyEntry(
+			ctx, lState, head, oldDirPath.ChildPathNoPtr(r.ro.OldName))
+		if _, ok := errors.Cause(err).(NoSuchNameError); ok {
+			// The entry was created and removed in the same revision.
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		names := make([]string, 0, len(dirPath.path))
+		for _, n := range dirPath.path[1:] {
+			names = append(names, n.Name)
+		}
+		names = append(names, r.ro.OldName)
+		entries = append(entries, DeletedEntry{
+			Path:       strings.Join(names, "/"),
+			Type:       de.Type,
+			Size:       de.Size,
+			Revision:   r.rmd.Revision(),
+			Writer:     r.rmd.LastModifyingWriter(),
+			LocalTime:  r.rmd.localTimestamp,
+			tlfID:      fbo.id(),
+			dirPtr:     r.oldDir,
+			subtreeRev: firstRemovalRev(r),
 		})
 	}
-}
-
-func (fbo *folderBranchOps) blockUnmergedWrites(lState *lockState) {
-	fbo.mdWriterLock.Lock(lState)
-}
 
-func (fbo *folderBranchOps) unblockUnmergedWrites(lState *lockState) {
-	fbo.mdWriterLock.Unlock(lState)
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Revision != entries[j].Revision {
+			return entries[i].Revision > entries[j].Revision
+		}
+		return entries[i].Path < entries[j].Path
+	})
+	return entries, nil
 }
 
-func (fbo *folderBranchOps) finalizeResolutionLocked(ctx context.Context,
-	lState *lockState, md *RootMetadata, bps *blockPutState,
-	newOps []op, blocksToDelete []kbfsblock.ID) error {
-	fbo.mdWriterLock.AssertLocked(lState)
+// GetFileVersions implements the KBFSOps interface for
+// folderBranchOps.
+func (fbo *folderBranchOps) GetFileVersions(
+	ctx context.Context, file Node) (versions []FileVersion, err error) {
+	fbo.log.CDebugf(ctx, "GetFileVersions %s", getNodeIDStr(file))
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "GetFileVersions %s done (%d versions): "+
+			"%+v", getNodeIDStr(file), len(versions), err)
+	}()
 
-	// Put the blocks into the cache so that, even if we fail below,
-	// future attempts may reuse the blocks.
-	err := fbo.finalizeBlocks(bps)
+	err = fbo.checkNode(file)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// Last chance to get pre-empted.
-	select {
-	case <-ctx.Done():
-		return ctx.Err()
-	default:
+	lState := makeFBOLockState()
+	head, err := fbo.getMDForReadNeedIdentify(ctx, lState)
+	if err != nil {
+		return nil, err
+	}
+	if head.MergedStatus() != Merged {
+		return nil, UnmergedError{}
 	}
 
-	session, err := fbo.config.KBPKI().GetCurrentSession(ctx)
+	filePath, err := fbo.pathFromNodeForRead(file)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	irmd, err := fbo.config.MDOps().ResolveBranch(ctx, fbo.id(), fbo.bid,
-		blocksToDelete, md, session.VerifyingKey)
-	doUnmergedPut := isRevisionConflict(err)
-	if doUnmergedPut {
-		fbo.log.CDebugf(ctx, "Got a conflict after resolution; aborting CR")
-		return err
+	if !filePath.hasValidParent() {
+		return nil, NotFileError{filePath}
 	}
+	de, err := fbo.blocks.GetDirtyEntry(ctx, lState, head, filePath)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if de.Type != File && de.Type != Exec {
+		return nil, NotFileError{filePath}
 	}
 
-	// Queue a rekey if the bit was set.
-	if md.IsRekeySet() {
-		defer fbo.config.RekeyQueue().Enqueue(md.TlfID())
+	startRev, err := fbo.getFirstUnreclaimedRevision(ctx, head,
+		head.data.LastGCRevision, fbo.config.QuotaReclamationMinUnrefAge())
+	if err != nil {
+		return nil, err
+	}
+	if startRev > head.Revision() {
+		return nil, nil
+	}
+	rmds, err := getMDRange(ctx, fbo.config, fbo.id(), NullBranchID,
+		startRev, head.Revision(), Merged)
+	if err != nil {
+		return nil, err
 	}
 
-	md.loadCachedBlockChanges(ctx, bps, fbo.log)
+	// Walk backwards through the revisions, following each version
+	// of the file to the one it replaced.  Batched syncs only
+	// record self-updates in their sync ops, and put the real
+	// updates in a resolution op, so look through the updates of
+	// every op.  A revision that only references the pointer, or
+	// self-updates it, created the file.
+	ptr := de.BlockPointer
+	for i := len(rmds) - 1; i >= 0 && ptr.IsInitialized(); i-- {
+		rmd := rmds[i]
+		ops := rmd.data.Changes.Ops
+		if rmd.data.Changes.Info.BlockPointer.IsInitialized() {
+			ops = rmd.data.cachedChanges.Ops
+		}
+		var oldPtr BlockPointer
+		found := false
+		for _, op := range ops {
+			for _, update := range op.allUpdates() {
+				if update.Ref != ptr {
+					continue
+				}
+				found = true
+				if update.Unref != ptr {
+					oldPtr = update.Unref
+				}
+			}
+			for _, ref := range op.Refs() {
+				if ref == ptr {
+					found = true
+				}
+			}
+		}
+		if !found {
+			continue
+		}
 
-	// Set the head to the new MD.
-	fbo.headLock.Lock(lState)
-	defer fbo.headLock.Unlock(lState)
-	err = fbo.setHeadConflictResolvedLocked(ctx, lState, irmd)
-	if err != nil {
-		fbo.log.CWarningf(ctx, "Couldn't set local MD head after a "+
-			"successful put: %v", err)
-		return err
+		versionPath := path{fbo.folderBranch, []pathNode{
+			{ptr, filePath.tailName()}}}
+		size, err := fbo.blocks.GetSyncedFileSize(
+			ctx, lState, head, versionPath)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, FileVersion{
+			Revision:     rmd.Revision(),
+			Writer:       rmd.LastModifyingWriter(),
+			WriterDevice: rmd.LastModifyingWriterVerifyingKey(),
+			LocalTime:    rmd.localTimestamp,
+			Size:         size,
+			tlfID:        fbo.id(),
+			ptr:          ptr,
+		})
+		ptr = oldPtr
 	}
-	fbo.setBranchIDLocked(lState, NullBranchID)
+	return versions, nil
+}
 
-	// Archive the old, unref'd blocks if journaling is off.
-	if !TLFJournalEnabled(fbo.config, fbo.id()) {
-		fbo.fbm.archiveUnrefBlocks(irmd.ReadOnly())
+// restoreFileVersionLocked replaces the contents of `file` with a
+// clone of the given older version, as a single sync of that file.
+func (fbo *folderBranchOps) restoreFileVersionLocked(
+	ctx context.Context, lState *lockState, file Node,
+	version FileVersion) (err error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	if fbo.nodeCache.IsUnlinked(file) {
+		return NoSuchNameError{file.GetBasename()}
 	}
 
-	mdCopyWithLocalOps, err := md.deepCopy(fbo.config.Codec())
+	filePath, err := fbo.pathFromNodeForMDWriteLocked(lState, file)
 	if err != nil {
 		return err
 	}
-	mdCopyWithLocalOps.data.Changes.Ops = newOps
+	if !filePath.hasValidParent() {
+		return NotFileError{filePath}
+	}
 
-	// notifyOneOp for every fixed-up merged op.
-	for _, op := range newOps {
-		err := fbo.notifyOneOpLocked(
-			ctx, lState, op, mdCopyWithLocalOps.ReadOnly(), false)
+	// Unsynced writes to the file would be lost when its entry is
+	// replaced, and pending directory changes might still hold
+	// unsynced entries of its parent directories, so those have to
+	// go to the server first.  Unrelated dirty files are left alone.
+	if fbo.blocks.IsDirty(lState, filePath) || len(fbo.dirOps) > 0 {
+		err := fbo.syncAllLocked(ctx, lState, NoExcl)
+		if err != nil {
+			return err
+		}
+		filePath, err = fbo.pathFromNodeForMDWriteLocked(lState, file)
 		if err != nil {
 			return err
 		}
 	}
-	fbo.editHistory.UpdateHistory(ctx, []ImmutableRootMetadata{irmd})
-	return nil
-}
-
-// finalizeResolution caches all the blocks, and writes the new MD to
-// the merged branch, failing if there is a conflict.  It also sends
-// out the given newOps notifications locally.  This is used for
-// completing conflict resolution.
-func (fbo *folderBranchOps) finalizeResolution(ctx context.Context,
-	lState *lockState, md *RootMetadata, bps *blockPutState,
-	newOps []op, blocksToDelete []kbfsblock.ID) error {
-	// Take the writer lock.
-	fbo.mdWriterLock.Lock(lState)
-	defer fbo.mdWriterLock.Unlock(lState)
-	return fbo.finalizeResolutionLocked(
-		ctx, lState, md, bps, newOps, blocksToDelete)
-}
 
-func (fbo *folderBranchOps) unstageAfterFailedResolution(ctx context.Context,
-	lState *lockState) error {
-	// Take the writer lock.
-	fbo.mdWriterLock.Lock(lState)
-	defer fbo.mdWriterLock.Unlock(lState)
-
-	// Last chance to get pre-empted.
-	select {
-	case <-ctx.Done():
-		return ctx.Err()
-	default:
+	md, err := fbo.getSuccessorMDForWriteLocked(ctx, lState)
+	if err != nil {
+		return err
 	}
 
-	// We don't want context cancellation after this point, so use a linked
-	// context. There is no race since the linked context has an independent
-	// Done channel.
-	//
-	// Generally we don't want to have any errors in unstageLocked since and
-	// this solution is chosen because:
-	// * If the error is caused by a cancelled context then the recovery (archiving)
-	//   would need to use a separate context anyways.
-	// * In such cases we would have to be very careful where the error occurs
-	//   and what to archive, making that solution much more complicated.
-	// * The other "common" error case is losing server connection and after
-	//   detecting that we won't have much luck archiving things anyways.
-
-	ctx = newLinkedContext(ctx)
-	fbo.log.CWarningf(ctx, "Unstaging branch %s after a resolution failure",
-		fbo.bid)
-	return fbo.unstageLocked(ctx, lState)
-}
-
-func (fbo *folderBranchOps) handleTLFBranchChange(ctx context.Context,
-	newBID BranchID) {
-	lState := makeFBOLockState()
-	fbo.mdWriterLock.Lock(lState)
-	defer fbo.mdWriterLock.Unlock(lState)
-
-	fbo.log.CDebugf(ctx, "Journal branch change: %s", newBID)
-
-	if !fbo.isMasterBranchLocked(lState) {
-		if fbo.bid == newBID {
-			fbo.log.CDebugf(ctx, "Already on branch %s", newBID)
-			return
-		}
-		panic(fmt.Sprintf("Cannot switch to branch %s while on branch %s",
-			newBID, fbo.bid))
+	dirPath := *filePath.parentPath()
+	dblock, err := fbo.blocks.GetDir(
+		ctx, lState, md.ReadOnly(), dirPath, blockWrite)
+	if err != nil {
+		return err
+	}
+	oldDe, ok := dblock.Children[filePath.tailName()]
+	if !ok {
+		return NoSuchNameError{filePath.tailName()}
+	}
+	if oldDe.Type != File && oldDe.Type != Exec {
+		return NotFileError{filePath}
 	}
 
-	md, err := fbo.config.MDOps().GetUnmergedForTLF(ctx, fbo.id(), newBID)
+	versionDe := oldDe
+	versionDe.BlockInfo = BlockInfo{BlockPointer: version.ptr}
+	versionDe.Size = version.Size
+	versionPath := dirPath.ChildPath(filePath.tailName(), version.ptr)
+
+	so, err := newSyncOp(oldDe.BlockPointer)
 	if err != nil {
-		fbo.log.CWarningf(ctx,
-			"No unmerged head on journal branch change (bid=%s)", newBID)
-		return
+		return err
+	}
+	so.addTruncate(0)
+	if version.Size > 0 {
+		so.addWrite(0, version.Size)
 	}
+	so.setFinalPath(filePath)
+	md.AddOp(so)
 
-	if md == (ImmutableRootMetadata{}) || md.MergedStatus() != Unmerged ||
-		md.BID() != newBID {
-		// This can happen if CR got kicked off in some other way and
-		// completed before we took the lock to process this
-		// notification.
-		fbo.log.CDebugf(ctx, "Ignoring stale branch change: md=%v, newBID=%d",
-			md, newBID)
-		return
+	chargedTo, err := chargedToForTLF(
+		ctx, fbo.config.KBPKI(), fbo.config.KBPKI(), md.GetTlfHandle())
+	if err != nil {
+		return err
 	}
 
-	// Everything we thought we knew about quota reclamation is now
-	// called into question.
-	fbo.fbm.clearLastQRData()
+	bps := newBlockPutState(1)
+	defer func() {
+		if err != nil {
+			fbo.fbm.cleanUpBlockState(md.ReadOnly(), bps, blockDeleteOnMDFail)
+		}
+	}()
 
-	// Kick off conflict resolution and set the head to the correct branch.
-	fbo.setBranchIDLocked(lState, newBID)
-	fbo.cr.Resolve(ctx, md.Revision(), kbfsmd.RevisionUninitialized)
+	// The blocks of an old version were archived when it was
+	// overwritten, so they can't get new references.
+	newDe, err := fbo.cloneEntryLocked(
+		ctx, lState, md, chargedTo, versionPath, versionDe, bps,
+		fbo.nowUnixNano(), true)
+	if err != nil {
+		return err
+	}
 
-	fbo.headLock.Lock(lState)
-	defer fbo.headLock.Unlock(lState)
-	err = fbo.setHeadSuccessorLocked(ctx, lState, md, true /*rebased*/)
+	// The clone counted its top block as a new reference; record it
+	// as the file's update instead, and unreference all the blocks
+	// of the current contents.
+	so.DelRefBlock(newDe.BlockPointer)
+	so.AddUpdate(oldDe.BlockPointer, newDe.BlockPointer)
+	md.AddUnrefBytes(uint64(oldDe.EncodedSize))
+	md.SetDiskUsage(md.DiskUsage() - uint64(oldDe.EncodedSize))
+	infos, err := fbo.blocks.GetIndirectFileBlockInfos(
+		ctx, lState, md.ReadOnly(), filePath)
 	if err != nil {
-		fbo.log.CWarningf(ctx,
-			"Could not set head on journal branch change: %v", err)
-		return
+		return err
 	}
-}
+	for _, info := range infos {
+		md.AddUnrefBlock(info)
+	}
+	dblock.Children[filePath.tailName()] = newDe
 
-func (fbo *folderBranchOps) onTLFBranchChange(newBID BranchID) {
-	fbo.branchChanges.Add(1)
+	// Ready the parent directory and all of its ancestors.
+	_, _, newBps, err := fbo.prepper.prepUpdateForPath(
+		ctx, lState, chargedTo, md, dblock, *dirPath.parentPath(),
+		dirPath.tailName(), Dir, false, false, zeroPtr, make(localBcache))
+	if err != nil {
+		return err
+	}
+	bps.mergeOtherBps(newBps)
 
-	go func() {
-		defer fbo.branchChanges.Done()
-		ctx, cancelFunc := fbo.newCtxWithFBOID()
-		defer cancelFunc()
+	_, err = doBlockPuts(ctx, fbo.config.BlockServer(),
+		fbo.config.BlockCache(), fbo.config.Reporter(), fbo.log, fbo.deferLog,
+		md.TlfID(), md.GetTlfHandle().GetCanonicalName(), *bps)
+	if err != nil {
+		return err
+	}
 
-		// This only happens on a `PruneBranch` call, in which case we
-		// would have already updated fbo's local view of the branch/head.
-		if newBID == NullBranchID {
-			fbo.log.CDebugf(ctx, "Ignoring branch change back to master")
-			return
-		}
+	unembedBps, err := fbo.maybeUnembedAndPutBlocks(ctx, md)
+	if err != nil {
+		return err
+	}
+	if unembedBps != nil {
+		bps.mergeOtherBps(unembedBps)
+	}
 
-		fbo.handleTLFBranchChange(ctx, newBID)
-	}()
+	return fbo.finalizeMDWriteLocked(ctx, lState, md, bps, NoExcl,
+		func(md ImmutableRootMetadata) error {
+			return fbo.notifyBatchLocked(ctx, lState, md)
+		})
 }
 
-func (fbo *folderBranchOps) handleMDFlush(ctx context.Context, bid BranchID,
-	rev kbfsmd.Revision) {
-	fbo.log.CDebugf(ctx, "Considering archiving references for flushed MD revision %d", rev)
-
-	lState := makeFBOLockState()
-	func() {
-		fbo.headLock.Lock(lState)
-		defer fbo.headLock.Unlock(lState)
-		fbo.setLatestMergedRevisionLocked(ctx, lState, rev, false)
+// RestoreFileVersion implements the KBFSOps interface for
+// folderBranchOps.
+func (fbo *folderBranchOps) RestoreFileVersion(
+	ctx context.Context, file Node, version FileVersion) (err error) {
+	fbo.log.CDebugf(ctx, "RestoreFileVersion %s (rev %d)",
+		getNodeIDStr(file), version.Revision)
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "RestoreFileVersion %s (rev %d) done: %+v",
+			getNodeIDStr(file), version.Revision, err)
 	}()
 
-	// Get that revision.
-	rmd, err := getSingleMD(ctx, fbo.config, fbo.id(), NullBranchID,
-		rev, Merged)
+	err = fbo.checkNodeForWrite(file)
 	if err != nil {
-		fbo.log.CWarningf(ctx, "Couldn't get revision %d for archiving: %v",
-			rev, err)
-		return
+		return err
 	}
-
-	if err := isArchivableMDOrError(rmd.ReadOnly()); err != nil {
-		fbo.log.CDebugf(
-			ctx, "Skipping archiving references for flushed MD revision %d: %s", rev, err)
-		return
+	// only works for versions within the same topdir
+	if version.tlfID != fbo.id() {
+		return CopyAcrossFoldersError{}
 	}
 
-	fbo.fbm.archiveUnrefBlocks(rmd.ReadOnly())
+	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			return fbo.restoreFileVersionLocked(ctx, lState, file, version)
+		})
 }
 
-func (fbo *folderBranchOps) onMDFlush(bid BranchID, rev kbfsmd.Revision) {
-	fbo.mdFlushes.Add(1)
-
-	go func() {
-		defer fbo.mdFlushes.Done()
-		ctx, cancelFunc := fbo.newCtxWithFBOID()
-		defer cancelFunc()
-
-		if bid != NullBranchID {
-			fbo.log.CDebugf(ctx, "Ignoring MD flush on branch %v for "+
-				"revision %d", bid, rev)
-			return
-		}
-
-		fbo.handleMDFlush(ctx, bid, rev)
+// GetDiskUsage implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) GetDiskUsage(
+	ctx context.Context, dir Node) (usage DirDiskUsage, err error) {
+	fbo.log.CDebugf(ctx, "GetDiskUsage %s", getNodeIDStr(dir))
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "GetDiskUsage %s done (revision %d): %+v",
+			getNodeIDStr(dir), usage.Revision, err)
 	}()
-}
-
-// TeamNameChanged implements the KBFSOps interface for folderBranchOps
-func (fbo *folderBranchOps) TeamNameChanged(
-	ctx context.Context, tid keybase1.TeamID) {
-	ctx, cancelFunc := fbo.newCtxWithFBOID()
-	defer cancelFunc()
-	fbo.log.CDebugf(ctx, "Starting name change for team %s", tid)
 
-	newName, err := fbo.config.KBPKI().GetNormalizedUsername(
-		ctx, tid.AsUserOrTeam())
+	err = fbo.checkNode(dir)
 	if err != nil {
-		fbo.log.CWarningf(ctx, "Error getting new team name: %+v", err)
-		return
+		return DirDiskUsage{}, err
 	}
 
 	lState := makeFBOLockState()
-	fbo.mdWriterLock.Lock(lState)
-	defer fbo.mdWriterLock.Unlock(lState)
-	fbo.headLock.Lock(lState)
-	defer fbo.headLock.Unlock(lState)
-
-	if fbo.head == (ImmutableRootMetadata{}) {
-		fbo.log.CWarningf(ctx, "No head to update")
-		return
+	head, err := fbo.getMDForReadNeedIdentify(ctx, lState)
+	if err != nil {
+		return DirDiskUsage{}, err
 	}
-
-	oldHandle := fbo.head.GetTlfHandle()
-
-	if string(oldHandle.GetCanonicalName()) == string(newName) {
-		fbo.log.CDebugf(ctx, "Name didn't change: %s", newName)
-		return
+	if head.MergedStatus() != Merged {
+		return DirDiskUsage{}, UnmergedError{}
 	}
 
-	if oldHandle.FirstResolvedWriter() != tid.AsUserOrTeam() {
-		fbo.log.CWarningf(ctx,
-			"Old handle doesn't include changed team ID: %s",
-			oldHandle.FirstResolvedWriter())
-		return
+	dirPath, err := fbo.pathFromNodeForRead(dir)
+	if err != nil {
+		return DirDiskUsage{}, err
 	}
+	return fbo.diskUsage.getDirUsage(ctx, head, dirPath)
+}
 
-	// Make a copy of `head` with the new handle.
-	newHandle := oldHandle.deepCopy()
-	newHandle.name = CanonicalTlfName(newName)
-	newHandle.resolvedWriters[tid.AsUserOrTeam()] = newName
-	newHead, err := fbo.head.deepCopy(fbo.config.Codec())
-	if err != nil {
-		fbo.log.CWarningf(ctx, "Error copying head: %+v", err)
-		return
+// PinPath implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) PinPath(
+	ctx context.Context, folderBranch FolderBranch, p string) (err error) {
+	fbo.log.CDebugf(ctx, "PinPath %q", p)
+	defer func() { fbo.deferLog.CDebugf(ctx, "PinPath %q done: %+v", p, err) }()
+
+	if folderBranch != fbo.folderBranch {
+		return WrongOpsError{fbo.folderBranch, folderBranch}
 	}
-	newHead.tlfHandle = newHandle
 
-	fbo.log.CDebugf(ctx, "Team name changed from %s to %s",
-		oldHandle.GetCanonicalName(), newHandle.GetCanonicalName())
-	fbo.head = MakeImmutableRootMetadata(
-		newHead, fbo.head.lastWriterVerifyingKey, fbo.head.mdID,
-		fbo.head.localTimestamp, fbo.head.putToServer)
+	lState := makeFBOLockState()
+	head, err := fbo.getMDForReadNeedIdentify(ctx, lState)
 	if err != nil {
-		fbo.log.CWarningf(ctx, "Error setting head: %+v", err)
-		return
+		return err
 	}
-
-	fbo.observers.tlfHandleChange(ctx, newHandle)
+	if head.MergedStatus() != Merged {
+		return UnmergedError{}
+	}
+	return fbo.pinner.pin(ctx, head, p)
 }
 
-// GetUpdateHistory implements the KBFSOps interface for folderBranchOps
-func (fbo *folderBranchOps) GetUpdateHistory(ctx context.Context,
-	folderBranch FolderBranch) (history TLFUpdateHistory, err error) {
-	fbo.log.CDebugf(ctx, "GetUpdateHistory")
+// UnpinPath implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) UnpinPath(
+	ctx context.Context, folderBranch FolderBranch, p string) (err error) {
+	fbo.log.CDebugf(ctx, "UnpinPath %q", p)
 	defer func() {
-		fbo.deferLog.CDebugf(ctx, "GetUpdateHistory done: %+v", err)
+		fbo.deferLog.CDebugf(ctx, "UnpinPath %q done: %+v", p, err)
 	}()
 
 	if folderBranch != fbo.folderBranch {
-		return TLFUpdateHistory{}, WrongOpsError{fbo.folderBranch, folderBranch}
+		return WrongOpsError{fbo.folderBranch, folderBranch}
 	}
 
-	rmds, err := getMergedMDUpdates(ctx, fbo.config, fbo.id(),
-		kbfsmd.RevisionInitial)
+	lState := makeFBOLockState()
+	head, err := fbo.getMDForReadNeedIdentify(ctx, lState)
 	if err != nil {
-		return TLFUpdateHistory{}, err
+		return err
 	}
+	return fbo.pinner.unpin(ctx, head, p)
+}
 
-	if len(rmds) > 0 {
-		rmd := rmds[len(rmds)-1]
-		history.ID = rmd.TlfID().String()
-		history.Name = rmd.GetTlfHandle().GetCanonicalPath()
+// maxPathChangeRevisions is the most merged revisions that a single
+// call to GetPathChanges covers.
+const maxPathChangeRevisions = 100
+
+// tlfRelativePath returns the given path as a string relative to
+// the root of its TLF.
+func tlfRelativePath(p path) string {
+	names := make([]string, 0, len(p.path))
+	for _, n := range p.path[1:] {
+		names = append(names, n.Name)
 	}
-	history.Updates = make([]UpdateSummary, 0, len(rmds))
-	writerNames := make(map[keybase1.UID]string)
-	for _, rmd := range rmds {
-		writer, ok := writerNames[rmd.LastModifyingWriter()]
-		if !ok {
-			name, err := fbo.config.KBPKI().GetNormalizedUsername(
-				ctx, rmd.LastModifyingWriter().AsUserOrTeam())
-			if err != nil {
-				return TLFUpdateHistory{}, err
+	return strings.Join(names, "/")
+}
+
+// getPathChangesForMD returns the path changes made by the given
+// merged revision.
+func (fbo *folderBranchOps) getPathChangesForMD(
+	ctx context.Context, rmd ImmutableRootMetadata) ([]PathChange, error) {
+	ops := rmd.data.Changes.Ops
+	if rmd.data.Changes.Info.BlockPointer.IsInitialized() {
+		ops = rmd.data.cachedChanges.Ops
+	}
+
+	// Find the paths of the directories and files touched by the
+	// ops, as of this revision.  Only the updated pointers need to
+	// be searched, since every change updates all its parents.
+	newPtrs := make(map[BlockPointer]bool)
+	var ptrs []BlockPointer
+	for _, op := range ops {
+		for _, update := range op.allUpdates() {
+			newPtrs[update.Ref] = true
+		}
+		switch realOp := op.(type) {
+		case *createOp:
+			ptrs = append(ptrs, realOp.Dir.Ref)
+		case *rmOp:
+			ptrs = append(ptrs, realOp.Dir.Ref)
+		case entryMover:
+			ro := realOp.moveOp()
+			ptrs = append(ptrs, ro.OldDir.Ref)
+			if ro.NewDir != (blockUpdate{}) {
+				ptrs = append(ptrs, ro.NewDir.Ref)
 			}
-			writer = string(name)
-			writerNames[rmd.LastModifyingWriter()] = writer
+		case *syncOp:
+			ptrs = append(ptrs, realOp.File.Ref)
 		}
-		updateSummary := UpdateSummary{
+	}
+	if len(ptrs) == 0 {
+		return nil, nil
+	}
+	// Use a throwaway node cache, since these paths might not
+	// exist anymore.
+	paths, err := fbo.blocks.SearchForPaths(
+		ctx, newNodeCacheStandard(fbo.folderBranch), ptrs, newPtrs, rmd,
+		rmd.data.Dir.BlockPointer)
+	if err != nil {
+		return nil, err
+	}
+	pathString := func(ptr BlockPointer, name string) (string, bool) {
+		p, ok := paths[ptr]
+		if !ok || !p.isValid() {
+			// The entry was probably removed again later in the
+			// same revision.
+			fbo.log.CDebugf(ctx, "No path found for %v in revision %d",
+				ptr, rmd.Revision())
+			return "", false
+		}
+		if name != "" {
+			p = p.ChildPathNoPtr(name)
+		}
+		return tlfRelativePath(p), true
+	}
+
+	var changes []PathChange
+	for _, op := range ops {
+		change := PathChange{
 			Revision:  rmd.Revision(),
-			Date:      rmd.localTimestamp,
-			Writer:    writer,
-			LiveBytes: rmd.DiskUsage(),
-			Ops:       make([]OpSummary, 0, len(rmd.data.Changes.Ops)),
+			Writer:    rmd.LastModifyingWriter(),
+			LocalTime: rmd.localTimestamp,
 		}
-		for _, op := range rmd.data.Changes.Ops {
-			opSummary := OpSummary{
-				Op:      op.String(),
-				Refs:    make([]string, 0, len(op.Refs())),
-				Unrefs:  make([]string, 0, len(op.Unrefs())),
-				Updates: make(map[string]string),
-			}
-			for _, ptr := range op.Refs() {
-				opSummary.Refs = append(opSummary.Refs, ptr.String())
+		var ok bool
+		switch realOp := op.(type) {
+		case *createOp:
+			change.Type = PathCreated
+			change.Path, ok = pathString(realOp.Dir.Ref, realOp.NewName)
+		case *rmOp:
+			change.Type = PathRemoved
+			change.Path, ok = pathString(realOp.Dir.Ref, realOp.OldName)
+		case entryMover:
+			ro := realOp.moveOp()
+			change.Type = PathRenamed
+			change.OldPath, ok = pathString(ro.OldDir.Ref, ro.OldName)
+			if !ok {
+				continue
 			}
-			for _, ptr := range op.Unrefs() {
-				opSummary.Unrefs = append(opSummary.Unrefs, ptr.String())
+			newDir := ro.NewDir.Ref
+			if ro.NewDir == (blockUpdate{}) {
+				newDir = ro.OldDir.Ref
 			}
-			for _, update := range op.allUpdates() {
-				opSummary.Updates[update.Unref.String()] = update.Ref.String()
+			change.Path, ok = pathString(newDir, ro.NewName)
+			if _, isExchange := realOp.(*exchangeOp); ok && isExchange {
+				// The other entry moved the opposite way.
+				reverse := change
+				reverse.OldPath, reverse.Path = change.Path, change.OldPath
+				changes = append(changes, change, reverse)
+				continue
 			}
-			updateSummary.Ops = append(updateSummary.Ops, opSummary)
+		case *syncOp:
+			change.Type = PathWritten
+			change.Path, ok = pathString(realOp.File.Ref, "")
+		}
+		if ok {
+			changes = append(changes, change)
 		}
-		history.Updates = append(history.Updates, updateSummary)
 	}
-	return history, nil
+	return changes, nil
 }
 
-// GetEditHistory implements the KBFSOps interface for folderBranchOps
-func (fbo *folderBranchOps) GetEditHistory(ctx context.Context,
-	folderBranch FolderBranch) (edits TlfWriterEdits, err error) {
-	fbo.log.CDebugf(ctx, "GetEditHistory")
+// GetPathChanges implements the KBFSOps interface for
+// folderBranchOps.
+func (fbo *folderBranchOps) GetPathChanges(
+	ctx context.Context, folderBranch FolderBranch, since kbfsmd.Revision) (
+	changes []PathChange, lastRev kbfsmd.Revision, err error) {
+	fbo.log.CDebugf(ctx, "GetPathChanges since %d", since)
 	defer func() {
-		fbo.deferLog.CDebugf(ctx, "GetEditHistory done: %+v", err)
+		fbo.deferLog.CDebugf(ctx, "GetPathChanges since %d done (%d "+
+			"changes, last revision %d): %+v", since, len(changes),
+			lastRev, err)
 	}()
 
 	if folderBranch != fbo.folderBranch {
-		return nil, WrongOpsError{fbo.folderBranch, folderBranch}
+		return nil, kbfsmd.RevisionUninitialized,
+			WrongOpsError{fbo.folderBranch, folderBranch}
 	}
 
 	lState := makeFBOLockState()
+	// Make sure we have permission to read, and have a head.
 	head, err := fbo.getMDForReadNeedIdentify(ctx, lState)
 	if err != nil {
-		return nil, err
+		return nil, kbfsmd.RevisionUninitialized, err
 	}
 
-	return fbo.editHistory.GetComplete(ctx, head)
+	// The blocks needed to find the paths changed by revisions that
+	// QR has already covered might be gone, so the caller has to
+	// rescan instead of silently missing those changes.
+	if since < head.data.LastGCRevision {
+		return nil, kbfsmd.RevisionUninitialized, PathChangesReclaimedError{
+			fbo.id(), since, head.data.LastGCRevision}
+	}
+	startRev := since
+
+	latestRev := fbo.getLatestMergedRevision(lState)
+	if startRev >= latestRev {
+		return nil, startRev, nil
+	}
+	end := latestRev
+	if end-startRev > maxPathChangeRevisions {
+		end = startRev + maxPathChangeRevisions
+	}
+	rmds, err := getMDRange(ctx, fbo.config, fbo.id(), NullBranchID,
+		startRev+1, end, Merged)
+	if err != nil {
+		return nil, kbfsmd.RevisionUninitialized, err
+	}
+
+	lastRev = startRev
+	for _, rmd := range rmds {
+		select {
+		case <-ctx.Done():
+			return nil, kbfsmd.RevisionUninitialized, ctx.Err()
+		default:
+		}
+
+		rmdChanges, err := fbo.getPathChangesForMD(ctx, rmd)
+		if err != nil && lastRev > startRev {
+			// Return the changes up to the failed revision; the
+			// caller will get the error when it asks for the rest.
+			fbo.log.CDebugf(ctx, "Couldn't get the path changes for "+
+				"revision %d: %+v", rmd.Revision(), err)
+			break
+		} else if err != nil {
+			return nil, kbfsmd.RevisionUninitialized, err
+		}
+		changes = append(changes, rmdChanges...)
+		lastRev = rmd.Revision()
+	}
+	return changes, lastRev, nil
 }
 
 // PushStatusChange forces a new status be fetched by status listeners.
@@ -6328,7 +8702,13 @@ func (fbo *folderBranchOps) ForceFastForward(ctx context.Context) {
 		defer cancelFunc()
 
 		fbo.log.CDebugf(ctx, "Forcing a fast-forward")
-		currHead, err := fbo.config.MDOps().GetForTLF(ctx, fbo.id())
+		var currHead ImmutableRootMetadata
+		var err error
+		if fbo.isReadOnly() {
+			currHead, err = fbo.getArchivedMD(ctx)
+		} else {
+			currHead, err = fbo.config.MDOps().GetForTLF(ctx, fbo.id())
+		}
 		if err != nil {
 			fbo.log.CDebugf(ctx, "Fast-forward failed: %v", err)
 			return
@@ -39,6 +39,19 @@ type FolderBranchStatus struct {
 
 	Journal *TLFJournalStatus `json:",omitempty"`
 
+	// Conflicts are the most recent decisions made by conflict
+	// resolution, oldest first.
+	Conflicts []ConflictRecord `json:",omitempty"`
+
+	// ManualConflictResolution is true if unmerged changes are set
+	// aside for the user to resolve, and ParkedBranchID is the ID of
+	// the branch holding such changes, if any.
+	ManualConflictResolution bool   `json:",omitempty"`
+	ParkedBranchID           string `json:",omitempty"`
+
+	// Pins describe the paths being kept available offline.
+	Pins []PinStatus `json:",omitempty"`
+
 	PermanentErr string `json:",omitempty"`
 }
 
@@ -53,6 +66,7 @@ type KBFSStatus struct {
 	FailingServices map[string]error
 	JournalServer   *JournalServerStatus            `json:",omitempty"`
 	DiskCacheStatus map[string]DiskBlockCacheStatus `json:",omitempty"`
+	Bandwidth       *BandwidthLimiterStatus         `json:",omitempty"`
 }
 
 // StatusUpdate is a dummy type used to indicate status has been updated.
@@ -119,6 +133,14 @@ func (fbsk *folderBranchStatusKeeper) setCRSummary(unmerged []*crChainSummary,
 	fbsk.signalChangeLocked()
 }
 
+// signalChange notifies listeners of a change to the status that
+// isn't stored in fbsk, like a new conflict record.
+func (fbsk *folderBranchStatusKeeper) signalChange() {
+	fbsk.dataMutex.Lock()
+	defer fbsk.dataMutex.Unlock()
+	fbsk.signalChangeLocked()
+}
+
 func (fbsk *folderBranchStatusKeeper) setPermErr(err error) {
 	fbsk.dataMutex.Lock()
 	defer fbsk.dataMutex.Unlock()
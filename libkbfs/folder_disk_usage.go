@@ -0,0 +1,677 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/ioutil"
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/keybase/kbfs/kbfssync"
+	"golang.org/x/net/context"
+)
+
+const (
+	// diskUsageDir is the name of the directory, under the storage
+	// root, holding the saved disk usages of all TLFs.
+	diskUsageDir = "kbfs_disk_usage"
+	// diskUsageKeyPurpose separates the key used for the saved disk
+	// usages from the other keys derived from a TLF's crypt key.
+	diskUsageKeyPurpose = "Keybase-KBFS-Disk-Usage-1"
+)
+
+// CtxFolderDiskUsageTagKey is the type used for unique context tags
+// within the folder disk usage tracker.
+type CtxFolderDiskUsageTagKey int
+
+const (
+	// CtxFolderDiskUsageIDKey is the type of the tag for unique
+	// operation IDs within the folder disk usage tracker.
+	CtxFolderDiskUsageIDKey CtxFolderDiskUsageTagKey = iota
+)
+
+// CtxFolderDiskUsageOpID is the display name for the unique
+// operation folder disk usage ID tag.
+const CtxFolderDiskUsageOpID = "DUID"
+
+// diskUsageEntry is the usage of one file or directory of a TLF.
+type diskUsageEntry struct {
+	// Ptr is the pointer of the entry that the usage was computed
+	// for.
+	Ptr BlockPointer `codec:"p"`
+	// Own is the usage of the entry's own blocks, which is all of
+	// the usage of a file.
+	Own DiskUsage `codec:"o"`
+	// Total is the recursive usage of the entry.
+	Total DiskUsage `codec:"t"`
+	// Children are the names of the entries of a directory, not
+	// including symlinks.
+	Children []string `codec:"c,omitempty"`
+}
+
+// diskUsageState is the saved state of a folderDiskUsage.
+type diskUsageState struct {
+	MdID     kbfsmd.ID                 `codec:"i"`
+	Revision kbfsmd.Revision           `codec:"r"`
+	Usages   map[string]diskUsageEntry `codec:"u"`
+}
+
+// folderDiskUsage keeps the recursive disk usages of a TLF up to date
+// with the ops of each merged head, and saves them using getTLFLocalKey.
+type folderDiskUsage struct {
+	config       Config
+	log          logger.Logger
+	folderBranch FolderBranch
+	// getChanges returns the paths changed by the given merged
+	// revision.
+	getChanges func(context.Context, ImmutableRootMetadata) (
+		[]PathChange, error)
+
+	updateCh chan struct{}
+	// updates counts the signaled updates that haven't been applied
+	// yet.
+	updates kbfssync.RepeatedWaitGroup
+	wg      sync.WaitGroup
+
+	// pendingLock protects the fields below, and is never held
+	// while waiting for `lock`, so that setting a new head doesn't
+	// have to wait for blocks to be fetched.
+	pendingLock sync.Mutex
+	// checked is true once it's known whether there are saved
+	// usages to keep up to date.
+	checked bool
+	// pending holds the merged heads that haven't been applied to
+	// the usages yet, oldest first.
+	pending []ImmutableRootMetadata
+	cancel  context.CancelFunc
+
+	lock sync.Mutex
+	// loaded is true once usages has been read from disk.
+	loaded bool
+	// dirty is true if usages has changed since it was last saved.
+	dirty bool
+	key   *[32]byte
+	// mdID and rev identify the merged revision that usages is up
+	// to date with.
+	mdID kbfsmd.ID
+	rev  kbfsmd.Revision
+	// usages maps the paths of files and directories to their
+	// usages.  It's either empty, or covers the whole tree.
+	usages map[string]diskUsageEntry
+}
+
+func newFolderDiskUsage(config Config, fb FolderBranch, log logger.Logger,
+	getChanges func(context.Context, ImmutableRootMetadata) (
+		[]PathChange, error)) *folderDiskUsage {
+	return &folderDiskUsage{
+		config:       config,
+		log:          log,
+		folderBranch: fb,
+		getChanges:   getChanges,
+		updateCh:     make(chan struct{}, 1),
+		rev:          kbfsmd.RevisionUninitialized,
+		usages:       make(map[string]diskUsageEntry),
+	}
+}
+
+func (du *folderDiskUsage) statePath() string {
+	return filepath.Join(du.config.StorageRoot(), diskUsageDir,
+		du.folderBranch.Tlf.String())
+}
+
+func (du *folderDiskUsage) getKeyLocked(
+	ctx context.Context, kmd KeyMetadata) ([32]byte, error) {
+	if du.key != nil {
+		return *du.key, nil
+	}
+	key, err := getTLFLocalKey(
+		ctx, du.config.KeyManager(), kmd, diskUsageKeyPurpose)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	du.key = &key
+	return key, nil
+}
+
+func (du *folderDiskUsage) loadLocked(
+	ctx context.Context, kmd KeyMetadata) error {
+	if du.loaded {
+		return nil
+	}
+	if du.config.StorageRoot() == "" {
+		du.loaded = true
+		return nil
+	}
+	key, err := du.getKeyLocked(ctx, kmd)
+	if err != nil {
+		return err
+	}
+	var state diskUsageState
+	ok, err := readTLFLocalFile(du.config.Codec(), key, du.statePath(), &state)
+	if err != nil {
+		// The usages can always be computed again.
+		du.log.CDebugf(ctx, "Couldn't read the saved disk usages: %+v", err)
+	} else if _, hasRoot := state.Usages[""]; ok && hasRoot {
+		du.log.CDebugf(ctx, "Loaded %d saved disk usages as of revision %d",
+			len(state.Usages), state.Revision)
+		du.mdID = state.MdID
+		du.rev = state.Revision
+		du.usages = state.Usages
+	}
+	du.loaded = true
+	return nil
+}
+
+func (du *folderDiskUsage) saveLocked(
+	ctx context.Context, kmd KeyMetadata) error {
+	if !du.dirty || du.config.StorageRoot() == "" {
+		return nil
+	}
+	key, err := du.getKeyLocked(ctx, kmd)
+	if err != nil {
+		return err
+	}
+	err = writeTLFLocalFile(du.config.Codec(), key, du.statePath(),
+		diskUsageState{MdID: du.mdID, Revision: du.rev, Usages: du.usages})
+	if err != nil {
+		return err
+	}
+	du.dirty = false
+	return nil
+}
+
+// removeLocked forgets the usage of the entry at the given path, and
+// of everything under it.
+func (du *folderDiskUsage) removeLocked(p string) {
+	entry, ok := du.usages[p]
+	if !ok {
+		return
+	}
+	for _, name := range entry.Children {
+		du.removeLocked(joinTlfRelativePath(p, name))
+	}
+	delete(du.usages, p)
+	du.dirty = true
+}
+
+// resetLocked forgets all the usages, after they couldn't be
+// updated.
+func (du *folderDiskUsage) resetLocked() {
+	du.mdID = kbfsmd.ID{}
+	du.rev = kbfsmd.RevisionUninitialized
+	du.usages = make(map[string]diskUsageEntry)
+	du.dirty = true
+}
+
+// detachLocked forgets the usages of the entry at the given path and
+// of everything under it, and returns them by their paths relative
+// to the entry.
+func (du *folderDiskUsage) detachLocked(p string) map[string]diskUsageEntry {
+	entries := make(map[string]diskUsageEntry)
+	var collect func(p, rel string)
+	collect = func(p, rel string) {
+		entry, ok := du.usages[p]
+		if !ok {
+			return
+		}
+		entries[rel] = entry
+		for _, name := range entry.Children {
+			collect(joinTlfRelativePath(p, name),
+				joinTlfRelativePath(rel, name))
+		}
+	}
+	collect(p, "")
+	du.removeLocked(p)
+	return entries
+}
+
+// attachLocked puts usages returned by detachLocked back, under the
+// given path, replacing anything there.
+func (du *folderDiskUsage) attachLocked(
+	p string, entries map[string]diskUsageEntry) {
+	du.removeLocked(p)
+	for rel, entry := range entries {
+		if rel == "" {
+			du.usages[p] = entry
+		} else {
+			du.usages[joinTlfRelativePath(p, rel)] = entry
+		}
+	}
+	du.dirty = true
+}
+
+// getBlockLocked returns the synced version of the block with the
+// given pointer.  Unlike folderBlockOps, it ignores any dirty version
+// of the block, since that isn't part of any revision yet.
+func (du *folderDiskUsage) getBlockLocked(ctx context.Context,
+	kmd KeyMetadata, ptr BlockPointer, newBlock makeNewBlock) (
+	Block, error) {
+	if block, err := du.config.BlockCache().Get(ptr); err == nil {
+		return block, nil
+	}
+	block := newBlock()
+	err := du.config.BlockOps().Get(ctx, kmd, ptr, block, TransientEntry)
+	if err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+// getDirChildrenLocked returns the entries of the directory with the
+// given pointer, along with the infos of its indirect child blocks,
+// if it has any.
+func (du *folderDiskUsage) getDirChildrenLocked(ctx context.Context,
+	kmd KeyMetadata, ptr BlockPointer) (
+	map[string]DirEntry, []BlockInfo, error) {
+	block, err := du.getBlockLocked(ctx, kmd, ptr, NewDirBlock)
+	if err != nil {
+		return nil, nil, err
+	}
+	dblock, ok := block.(*DirBlock)
+	if !ok {
+		return nil, nil, NotDirBlockError{ptr, du.folderBranch.Branch, path{}}
+	}
+	if !dblock.IsInd {
+		return dblock.Children, nil, nil
+	}
+
+	children := make(map[string]DirEntry)
+	infos := make([]BlockInfo, 0, len(dblock.IPtrs))
+	for _, iptr := range dblock.IPtrs {
+		infos = append(infos, iptr.BlockInfo)
+		block, err := du.getBlockLocked(
+			ctx, kmd, iptr.BlockPointer, NewDirBlock)
+		if err != nil {
+			return nil, nil, err
+		}
+		childBlock, ok := block.(*DirBlock)
+		if !ok {
+			return nil, nil, NotDirBlockError{
+				iptr.BlockPointer, du.folderBranch.Branch, path{}}
+		}
+		for name, de := range childBlock.Children {
+			children[name] = de
+		}
+	}
+	return children, infos, nil
+}
+
+// addIndirectFileBlocksLocked adds the child blocks of the given file
+// block to `u`, if it's an indirect block.
+func (du *folderDiskUsage) addIndirectFileBlocksLocked(ctx context.Context,
+	kmd KeyMetadata, ptr BlockPointer, u *DiskUsage) error {
+	block, err := du.getBlockLocked(ctx, kmd, ptr, NewFileBlock)
+	if err != nil {
+		return err
+	}
+	fblock, ok := block.(*FileBlock)
+	if !ok {
+		return NotFileBlockError{ptr, du.folderBranch.Branch, path{}}
+	}
+	if !fblock.IsInd {
+		return nil
+	}
+	for _, iptr := range fblock.IPtrs {
+		u.EncodedSize += uint64(iptr.EncodedSize)
+		u.Blocks++
+		if iptr.DirectType == DirectBlock {
+			continue
+		}
+		err := du.addIndirectFileBlocksLocked(ctx, kmd, iptr.BlockPointer, u)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dirUsageLocked computes the usage of the given directory entry, at
+// the given path.  The usages already known for its children are
+// reused if their pointers haven't changed, except for the
+// directories in `changed`, which are always read again.
+func (du *folderDiskUsage) dirUsageLocked(ctx context.Context,
+	kmd KeyMetadata, p string, de DirEntry, changed map[string]bool) (
+	DiskUsage, error) {
+	children, infos, err := du.getDirChildrenLocked(ctx, kmd, de.BlockPointer)
+	if err != nil {
+		return DiskUsage{}, err
+	}
+	own := DiskUsage{EncodedSize: uint64(de.EncodedSize), Blocks: 1}
+	for _, info := range infos {
+		own.EncodedSize += uint64(info.EncodedSize)
+		own.Blocks++
+	}
+
+	oldChildren := make(map[string]bool)
+	if old, ok := du.usages[p]; ok {
+		for _, name := range old.Children {
+			oldChildren[name] = true
+		}
+	}
+	total := own
+	names := make([]string, 0, len(children))
+	for name, child := range children {
+		if child.Type == Sym {
+			continue
+		}
+		names = append(names, name)
+		delete(oldChildren, name)
+		childPath := joinTlfRelativePath(p, name)
+		var u DiskUsage
+		if child.Type == Dir && changed[childPath] {
+			u, err = du.dirUsageLocked(ctx, kmd, childPath, child, changed)
+		} else {
+			u, err = du.usageLocked(ctx, kmd, childPath, child)
+		}
+		if err != nil {
+			return DiskUsage{}, err
+		}
+		total.add(u)
+	}
+	// Any old children that are left have been removed.
+	for name := range oldChildren {
+		du.removeLocked(joinTlfRelativePath(p, name))
+	}
+
+	sort.Strings(names)
+	du.usages[p] = diskUsageEntry{
+		Ptr:      de.BlockPointer,
+		Own:      own,
+		Total:    total,
+		Children: names,
+	}
+	du.dirty = true
+	return total, nil
+}
+
+// usageLocked returns the usage of the given directory entry, at the
+// given path, reusing the usages already known for it and anything
+// under it.
+func (du *folderDiskUsage) usageLocked(ctx context.Context,
+	kmd KeyMetadata, p string, de DirEntry) (DiskUsage, error) {
+	if entry, ok := du.usages[p]; ok && entry.Ptr == de.BlockPointer {
+		return entry.Total, nil
+	}
+
+	switch de.Type {
+	case Dir:
+		return du.dirUsageLocked(ctx, kmd, p, de, nil)
+	case File, Exec:
+		u := DiskUsage{
+			LogicalSize: de.Size,
+			EncodedSize: uint64(de.EncodedSize),
+			Blocks:      1,
+		}
+		// Old blocks don't record their type in their pointers, so
+		// they have to be fetched to find out.
+		if de.DirectType != DirectBlock {
+			err := du.addIndirectFileBlocksLocked(
+				ctx, kmd, de.BlockPointer, &u)
+			if err != nil {
+				return DiskUsage{}, err
+			}
+		}
+		// In case it used to be a directory.
+		du.removeLocked(p)
+		du.usages[p] = diskUsageEntry{Ptr: de.BlockPointer, Own: u, Total: u}
+		du.dirty = true
+		return u, nil
+	default:
+		return DiskUsage{}, nil
+	}
+}
+
+// updateLocked brings the usages of the whole tree up to date with
+// the given head.  Only the directories in `changed`, and the
+// entries whose pointers have changed, are read again.
+func (du *folderDiskUsage) updateLocked(ctx context.Context,
+	head ImmutableRootMetadata, changed map[string]bool) error {
+	_, err := du.dirUsageLocked(ctx, head, "", head.data.Dir, changed)
+	if err != nil {
+		return err
+	}
+	du.mdID = head.mdID
+	du.rev = head.Revision()
+	du.dirty = true
+	return nil
+}
+
+// applyHeadLocked updates the usages with the changes made by the
+// given merged head.
+func (du *folderDiskUsage) applyHeadLocked(
+	ctx context.Context, head ImmutableRootMetadata) error {
+	err := du.loadLocked(ctx, head)
+	if err != nil {
+		return err
+	}
+	if _, ok := du.usages[""]; !ok {
+		// Nothing has been computed yet.
+		return nil
+	}
+	if head.Revision() < du.rev ||
+		(head.Revision() == du.rev && head.mdID == du.mdID) {
+		return nil
+	}
+	if head.Revision() != du.rev+1 || head.PrevRoot() != du.mdID {
+		du.log.CDebugf(ctx, "Revision %d doesn't follow revision %d, "+
+			"checking the whole tree", head.Revision(), du.rev)
+		return du.updateLocked(ctx, head, nil)
+	}
+	changes, err := du.getChanges(ctx, head)
+	if err != nil {
+		du.log.CDebugf(ctx, "Couldn't get the changes made by revision "+
+			"%d, checking the whole tree: %+v", head.Revision(), err)
+		return du.updateLocked(ctx, head, nil)
+	}
+
+	// Every change updates all the parents of its path.  Changes
+	// that don't show up here, like setattrs, are still picked up
+	// since they change the pointers of their entries.
+	changed := map[string]bool{"": true}
+	markParents := func(p string) {
+		for p != "" {
+			p, _ = splitTlfRelativePath(p)
+			changed[p] = true
+		}
+	}
+	// Move the usages of renamed entries along with them.  They
+	// all have to be detached before any of them are put back,
+	// since an exchange swaps two of them.
+	moved := make(map[string]map[string]diskUsageEntry)
+	for _, change := range changes {
+		markParents(change.Path)
+		if change.Type != PathRenamed {
+			continue
+		}
+		markParents(change.OldPath)
+		if entries := du.detachLocked(change.OldPath); len(entries) > 0 {
+			moved[change.Path] = entries
+		}
+	}
+	for p, entries := range moved {
+		du.attachLocked(p, entries)
+	}
+	return du.updateLocked(ctx, head, changed)
+}
+
+// applyPendingLocked applies all the pending merged heads to the
+// usages, and saves them.
+func (du *folderDiskUsage) applyPendingLocked(ctx context.Context) {
+	du.pendingLock.Lock()
+	heads := du.pending
+	du.pending = nil
+	du.pendingLock.Unlock()
+
+	for _, head := range heads {
+		err := du.applyHeadLocked(ctx, head)
+		if ctx.Err() != nil {
+			// Don't save anything that was only partly updated.
+			return
+		} else if err != nil {
+			// The usages can always be computed again.
+			du.log.CDebugf(ctx, "Couldn't update the disk usages to "+
+				"revision %d: %+v", head.Revision(), err)
+			du.resetLocked()
+		}
+	}
+	if len(heads) == 0 {
+		return
+	}
+	err := du.saveLocked(ctx, heads[len(heads)-1])
+	if err != nil {
+		du.log.CDebugf(ctx, "Couldn't save the disk usages: %+v", err)
+	}
+}
+
+// startLocked starts the background goroutine, if it isn't running
+// yet.  du.pendingLock must be held.
+func (du *folderDiskUsage) startLocked() {
+	if du.cancel != nil {
+		return
+	}
+	var runCtx context.Context
+	runCtx, du.cancel = context.WithCancel(CtxWithRandomIDReplayable(
+		context.Background(), CtxFolderDiskUsageIDKey,
+		CtxFolderDiskUsageOpID, du.log))
+	du.wg.Add(1)
+	go du.run(runCtx)
+}
+
+// headChanged lets the tracker know about a new head, so that the
+// usages can be updated with its changes.
+func (du *folderDiskUsage) headChanged(head ImmutableRootMetadata) {
+	if head.MergedStatus() != Merged {
+		return
+	}
+	du.pendingLock.Lock()
+	defer du.pendingLock.Unlock()
+	if !du.checked {
+		du.checked = true
+		if du.config.StorageRoot() != "" {
+			_, err := ioutil.Stat(du.statePath())
+			if !ioutil.IsNotExist(err) {
+				// Keep the usages saved before the last restart up
+				// to date.
+				du.startLocked()
+			}
+		}
+	}
+	if du.cancel == nil {
+		// Nothing has been computed yet, so there's nothing to
+		// update.
+		return
+	}
+	du.pending = append(du.pending, head)
+	du.updates.Add(1)
+	select {
+	case du.updateCh <- struct{}{}:
+	default:
+		// An update is already pending.
+		du.updates.Done()
+	}
+}
+
+func (du *folderDiskUsage) run(ctx context.Context) {
+	defer du.wg.Done()
+	for {
+		select {
+		case <-du.updateCh:
+		case <-ctx.Done():
+			return
+		}
+
+		du.lock.Lock()
+		du.applyPendingLocked(ctx)
+		du.lock.Unlock()
+		du.updates.Done()
+	}
+}
+
+// waitForUpdates blocks until all the updates signaled so far have
+// been applied.
+func (du *folderDiskUsage) waitForUpdates(ctx context.Context) error {
+	return du.updates.Wait(ctx)
+}
+
+func (du *folderDiskUsage) shutdown() {
+	du.pendingLock.Lock()
+	if du.cancel != nil {
+		du.cancel()
+	}
+	du.pendingLock.Unlock()
+	du.wg.Wait()
+}
+
+// getDirUsage returns the usage of the directory at the given path,
+// and of each of its children, as of the given merged head.
+func (du *folderDiskUsage) getDirUsage(ctx context.Context,
+	head ImmutableRootMetadata, dir path) (DirDiskUsage, error) {
+	du.lock.Lock()
+	defer du.lock.Unlock()
+	err := du.loadLocked(ctx, head)
+	if err != nil {
+		return DirDiskUsage{}, err
+	}
+
+	// Apply the heads that the background goroutine hasn't gotten
+	// to yet.  If that still doesn't reach this head, which is
+	// always the case the first time, walk the whole tree instead.
+	du.applyPendingLocked(ctx)
+	if _, ok := du.usages[""]; !ok || du.mdID != head.mdID {
+		err := du.updateLocked(ctx, head, nil)
+		if err != nil {
+			du.resetLocked()
+			return DirDiskUsage{}, err
+		}
+	}
+	du.pendingLock.Lock()
+	du.checked = true
+	du.startLocked()
+	du.pendingLock.Unlock()
+
+	// Look the directory up by name as of the head, since the
+	// pointers in the path may refer to unsynced versions of it.
+	de := head.data.Dir
+	p := ""
+	for _, n := range dir.path[1:] {
+		children, _, err := du.getDirChildrenLocked(ctx, head, de.BlockPointer)
+		if err != nil {
+			return DirDiskUsage{}, err
+		}
+		child, ok := children[n.Name]
+		if !ok {
+			return DirDiskUsage{}, NoSuchNameError{n.Name}
+		}
+		if child.Type != Dir {
+			return DirDiskUsage{}, NotDirError{dir}
+		}
+		de = child
+		p = joinTlfRelativePath(p, n.Name)
+	}
+
+	total, err := du.usageLocked(ctx, head, p, de)
+	if err != nil {
+		return DirDiskUsage{}, err
+	}
+	entry := du.usages[p]
+	usage := DirDiskUsage{
+		Revision: head.Revision(),
+		Total:    total,
+		Children: make(map[string]DiskUsage, len(entry.Children)),
+	}
+	for _, name := range entry.Children {
+		usage.Children[name] = du.usages[joinTlfRelativePath(p, name)].Total
+	}
+
+	err = du.saveLocked(ctx, head)
+	if err != nil {
+		// The usages can always be computed again.
+		du.log.CDebugf(ctx, "Couldn't save the disk usages: %+v", err)
+	}
+	return usage, nil
+}
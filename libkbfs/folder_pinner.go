@@ -0,0 +1,756 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/ioutil"
+	"github.com/keybase/kbfs/kbfsblock"
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/keybase/kbfs/kbfssync"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+const (
+	// pinRetryInterval is how long a folderPinner waits before
+	// trying again to fetch the blocks of its pinned paths, after
+	// an error.
+	pinRetryInterval = time.Minute
+	// pinsDir is the name of the directory, under the storage root,
+	// holding the saved pinned paths of all TLFs.
+	pinsDir = "kbfs_pins"
+	// pinsKeyPurpose separates the key used for the saved pinned
+	// paths from the other keys derived from a TLF's crypt key.
+	pinsKeyPurpose = "Keybase-KBFS-Pins-1"
+)
+
+// CtxFolderPinnerTagKey is the type used for unique context tags
+// within the folder pinner.
+type CtxFolderPinnerTagKey int
+
+const (
+	// CtxFolderPinnerIDKey is the type of the tag for unique
+	// operation IDs within the folder pinner.
+	CtxFolderPinnerIDKey CtxFolderPinnerTagKey = iota
+)
+
+// CtxFolderPinnerOpID is the display name for the unique operation
+// folder pinner ID tag.
+const CtxFolderPinnerOpID = "PINID"
+
+// PinStatus describes how much of a pinned path is available
+// offline.
+type PinStatus struct {
+	// Path is relative to the root of the TLF; the empty string
+	// means the whole TLF.
+	Path string
+	// Revision is the merged revision the other fields describe.
+	Revision kbfsmd.Revision
+	// PinnedBytes counts the encoded sizes of the blocks under the
+	// path that are already in the disk block cache, and
+	// MissingBytes the ones that still need to be fetched.
+	PinnedBytes  uint64
+	MissingBytes uint64
+	// Error is the last error hit while fetching the path's blocks,
+	// if any.
+	Error string `json:",omitempty"`
+}
+
+// cleanPinPath returns the canonical form of a TLF-relative path to
+// be pinned, without any empty or "." components.
+func cleanPinPath(p string) (string, error) {
+	var names []string
+	for _, name := range strings.Split(p, "/") {
+		switch name {
+		case "", ".":
+			continue
+		case "..":
+			return "", errors.Errorf("Can't pin a path containing ..: %s", p)
+		}
+		names = append(names, name)
+	}
+	return strings.Join(names, "/"), nil
+}
+
+// pinnerState is the saved state of a folderPinner.
+type pinnerState struct {
+	Paths []string `codec:"p"`
+}
+
+type pinState struct {
+	status PinStatus
+	// blockIDs are the blocks under the path (and those of its
+	// ancestor directories) as of status.Revision.
+	blockIDs []kbfsblock.ID
+}
+
+// folderPinner keeps the blocks under a set of pinned paths of a TLF
+// in the disk block cache, refetching them in the background whenever
+// the merged head changes.  The paths are saved using getTLFLocalKey.
+type folderPinner struct {
+	config       Config
+	log          logger.Logger
+	folderBranch FolderBranch
+
+	refreshCh chan struct{}
+	// refreshes counts the signaled refreshes that haven't finished
+	// yet.
+	refreshes kbfssync.RepeatedWaitGroup
+	wg        sync.WaitGroup
+
+	lock sync.Mutex
+	head ImmutableRootMetadata
+	// loaded is true once the saved pinned paths have been read
+	// from disk.
+	loaded bool
+	key    *[32]byte
+	pins   map[string]*pinState
+	cancel context.CancelFunc
+
+	// fileBlocks maps the pointers of the pinned files to the infos
+	// of their indirect blocks.  It's only used by the background
+	// goroutine.
+	fileBlocks map[BlockPointer][]BlockInfo
+}
+
+func newFolderPinner(
+	config Config, fb FolderBranch, log logger.Logger) *folderPinner {
+	return &folderPinner{
+		config:       config,
+		log:          log,
+		folderBranch: fb,
+		refreshCh:    make(chan struct{}, 1),
+		pins:         make(map[string]*pinState),
+		fileBlocks:   make(map[BlockPointer][]BlockInfo),
+	}
+}
+
+func (fp *folderPinner) statePath() string {
+	return filepath.Join(fp.config.StorageRoot(), pinsDir,
+		fp.folderBranch.Tlf.String())
+}
+
+func (fp *folderPinner) getKeyLocked(
+	ctx context.Context, kmd KeyMetadata) ([32]byte, error) {
+	if fp.key != nil {
+		return *fp.key, nil
+	}
+	key, err := getTLFLocalKey(
+		ctx, fp.config.KeyManager(), kmd, pinsKeyPurpose)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	fp.key = &key
+	return key, nil
+}
+
+// checkSavedPinsLocked returns true if there are saved pinned paths
+// that haven't been read yet.  If there aren't any, there's nothing
+// left to load.
+func (fp *folderPinner) checkSavedPinsLocked() bool {
+	if fp.loaded {
+		return false
+	}
+	if fp.config.StorageRoot() != "" {
+		_, err := ioutil.Stat(fp.statePath())
+		if !ioutil.IsNotExist(err) {
+			return true
+		}
+	}
+	fp.loaded = true
+	return false
+}
+
+// loadLocked adds the saved pinned paths, if it hasn't already.
+func (fp *folderPinner) loadLocked(
+	ctx context.Context, kmd KeyMetadata) error {
+	if fp.loaded {
+		return nil
+	}
+	if fp.config.StorageRoot() == "" {
+		fp.loaded = true
+		return nil
+	}
+	key, err := fp.getKeyLocked(ctx, kmd)
+	if err != nil {
+		return err
+	}
+	var state pinnerState
+	ok, err := readTLFLocalFile(fp.config.Codec(), key, fp.statePath(), &state)
+	if err != nil {
+		return err
+	}
+	if ok {
+		fp.log.CDebugf(ctx, "Loaded %d saved pinned paths", len(state.Paths))
+	}
+	for _, p := range state.Paths {
+		if _, ok := fp.pins[p]; !ok {
+			fp.pins[p] = &pinState{status: PinStatus{Path: p}}
+		}
+	}
+	fp.loaded = true
+	return nil
+}
+
+// saveLocked saves the current set of pinned paths.
+func (fp *folderPinner) saveLocked(
+	ctx context.Context, kmd KeyMetadata) error {
+	if fp.config.StorageRoot() == "" {
+		return nil
+	}
+	if len(fp.pins) == 0 {
+		err := ioutil.Remove(fp.statePath())
+		if ioutil.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	key, err := fp.getKeyLocked(ctx, kmd)
+	if err != nil {
+		return err
+	}
+	state := pinnerState{Paths: make([]string, 0, len(fp.pins))}
+	for p := range fp.pins {
+		state.Paths = append(state.Paths, p)
+	}
+	sort.Strings(state.Paths)
+	return writeTLFLocalFile(fp.config.Codec(), key, fp.statePath(), state)
+}
+
+// startLocked starts the background goroutine, if it isn't running
+// yet.
+func (fp *folderPinner) startLocked() {
+	if fp.cancel != nil {
+		return
+	}
+	var runCtx context.Context
+	runCtx, fp.cancel = context.WithCancel(CtxWithRandomIDReplayable(
+		context.Background(), CtxFolderPinnerIDKey,
+		CtxFolderPinnerOpID, fp.log))
+	fp.wg.Add(1)
+	go fp.run(runCtx)
+}
+
+func (fp *folderPinner) signalRefreshLocked() {
+	if fp.cancel == nil || (fp.loaded && len(fp.pins) == 0) {
+		return
+	}
+	fp.refreshes.Add(1)
+	select {
+	case fp.refreshCh <- struct{}{}:
+	default:
+		// A refresh is already pending.
+		fp.refreshes.Done()
+	}
+}
+
+// headChanged lets the pinner know about a new head, so that it can
+// pin the blocks of any new versions of the pinned paths.
+func (fp *folderPinner) headChanged(head ImmutableRootMetadata) {
+	if head.MergedStatus() != Merged {
+		return
+	}
+	fp.lock.Lock()
+	defer fp.lock.Unlock()
+	if fp.head != (ImmutableRootMetadata{}) &&
+		head.Revision() < fp.head.Revision() {
+		return
+	}
+	fp.head = head
+	if fp.checkSavedPinsLocked() {
+		// Pick up the paths pinned before the last restart.
+		fp.startLocked()
+	}
+	fp.signalRefreshLocked()
+}
+
+// getBlock returns the synced version of the block with the given
+// pointer.
+func (fp *folderPinner) getBlock(ctx context.Context,
+	kmd KeyMetadata, ptr BlockPointer, newBlock makeNewBlock) (
+	Block, error) {
+	if block, err := fp.config.BlockCache().Get(ptr); err == nil {
+		return block, nil
+	}
+	block := newBlock()
+	err := fp.config.BlockOps().Get(ctx, kmd, ptr, block, TransientEntry)
+	if err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+// getDirChildren returns the entries of the directory with the given
+// pointer, along with the infos of its indirect child blocks, if it
+// has any.
+func (fp *folderPinner) getDirChildren(ctx context.Context,
+	kmd KeyMetadata, ptr BlockPointer) (
+	map[string]DirEntry, []BlockInfo, error) {
+	block, err := fp.getBlock(ctx, kmd, ptr, NewDirBlock)
+	if err != nil {
+		return nil, nil, err
+	}
+	dblock, ok := block.(*DirBlock)
+	if !ok {
+		return nil, nil, NotDirBlockError{ptr, fp.folderBranch.Branch, path{}}
+	}
+	if !dblock.IsInd {
+		return dblock.Children, nil, nil
+	}
+
+	children := make(map[string]DirEntry)
+	infos := make([]BlockInfo, 0, len(dblock.IPtrs))
+	for _, iptr := range dblock.IPtrs {
+		infos = append(infos, iptr.BlockInfo)
+		block, err := fp.getBlock(ctx, kmd, iptr.BlockPointer, NewDirBlock)
+		if err != nil {
+			return nil, nil, err
+		}
+		childBlock, ok := block.(*DirBlock)
+		if !ok {
+			return nil, nil, NotDirBlockError{
+				iptr.BlockPointer, fp.folderBranch.Branch, path{}}
+		}
+		for name, de := range childBlock.Children {
+			children[name] = de
+		}
+	}
+	return children, infos, nil
+}
+
+// lookup returns the entry for the given cleaned, TLF-relative path
+// as of the given head, along with the infos of the blocks of all
+// its ancestor directories.
+func (fp *folderPinner) lookup(ctx context.Context,
+	head ImmutableRootMetadata, p string) (DirEntry, []BlockInfo, error) {
+	de := head.data.Dir
+	if p == "" {
+		return de, nil, nil
+	}
+
+	dirPath := path{fp.folderBranch, []pathNode{{de.BlockPointer, ""}}}
+	var infos []BlockInfo
+	for _, name := range strings.Split(p, "/") {
+		if de.Type != Dir {
+			return DirEntry{}, nil, NotDirError{dirPath}
+		}
+		children, dirInfos, err := fp.getDirChildren(
+			ctx, head, de.BlockPointer)
+		if err != nil {
+			return DirEntry{}, nil, err
+		}
+		infos = append(infos, de.BlockInfo)
+		infos = append(infos, dirInfos...)
+		child, ok := children[name]
+		if !ok {
+			return DirEntry{}, nil, NoSuchNameError{name}
+		}
+		dirPath = dirPath.ChildPathNoPtr(name)
+		de = child
+	}
+	return de, infos, nil
+}
+
+// getFileBlockInfos returns the infos of the indirect blocks under
+// the given file block.
+func (fp *folderPinner) getFileBlockInfos(ctx context.Context,
+	kmd KeyMetadata, ptr BlockPointer) ([]BlockInfo, error) {
+	block, err := fp.getBlock(ctx, kmd, ptr, NewFileBlock)
+	if err != nil {
+		return nil, err
+	}
+	fblock, ok := block.(*FileBlock)
+	if !ok {
+		return nil, NotFileBlockError{ptr, fp.folderBranch.Branch, path{}}
+	}
+	if !fblock.IsInd {
+		return nil, nil
+	}
+	var infos []BlockInfo
+	for _, iptr := range fblock.IPtrs {
+		infos = append(infos, iptr.BlockInfo)
+		if iptr.DirectType == DirectBlock {
+			continue
+		}
+		childInfos, err := fp.getFileBlockInfos(ctx, kmd, iptr.BlockPointer)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, childInfos...)
+	}
+	return infos, nil
+}
+
+// addSubtreeBlocks appends the infos of all the blocks under the
+// given entry to `infos`.  `fileBlocks` collects the indirect block
+// infos of the files it finds, to be reused by the next walk.
+func (fp *folderPinner) addSubtreeBlocks(ctx context.Context,
+	kmd KeyMetadata, de DirEntry, fileBlocks map[BlockPointer][]BlockInfo,
+	infos *[]BlockInfo) error {
+	switch de.Type {
+	case Dir:
+		children, dirInfos, err := fp.getDirChildren(
+			ctx, kmd, de.BlockPointer)
+		if err != nil {
+			return err
+		}
+		*infos = append(*infos, de.BlockInfo)
+		*infos = append(*infos, dirInfos...)
+		for _, child := range children {
+			if child.Type == Sym {
+				continue
+			}
+			err := fp.addSubtreeBlocks(ctx, kmd, child, fileBlocks, infos)
+			if err != nil {
+				return err
+			}
+		}
+	case File, Exec:
+		*infos = append(*infos, de.BlockInfo)
+		// Old blocks don't record their type in their pointers, so
+		// they have to be fetched to find out.
+		if de.DirectType == DirectBlock {
+			return nil
+		}
+		fileInfos, ok := fp.fileBlocks[de.BlockPointer]
+		if !ok {
+			var err error
+			fileInfos, err = fp.getFileBlockInfos(ctx, kmd, de.BlockPointer)
+			if err != nil {
+				return err
+			}
+		}
+		fileBlocks[de.BlockPointer] = fileInfos
+		*infos = append(*infos, fileInfos...)
+	}
+	return nil
+}
+
+// getPinnedBlockInfos returns the infos of all the blocks needed to
+// read the given path offline, as of the given head, without
+// duplicates.
+func (fp *folderPinner) getPinnedBlockInfos(ctx context.Context,
+	head ImmutableRootMetadata, p string,
+	fileBlocks map[BlockPointer][]BlockInfo) ([]BlockInfo, error) {
+	de, infos, err := fp.lookup(ctx, head, p)
+	if err != nil {
+		return nil, err
+	}
+	err = fp.addSubtreeBlocks(ctx, head, de, fileBlocks, &infos)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[kbfsblock.ID]bool, len(infos))
+	unique := infos[:0]
+	for _, info := range infos {
+		if seen[info.ID] {
+			continue
+		}
+		seen[info.ID] = true
+		unique = append(unique, info)
+	}
+	return unique, nil
+}
+
+// setPinnedBlocksLocked tells the disk block cache about the union
+// of the blocks of all the pinned paths.
+func (fp *folderPinner) setPinnedBlocksLocked(
+	ctx context.Context, dbc DiskBlockCache) {
+	seen := make(map[kbfsblock.ID]bool)
+	var blockIDs []kbfsblock.ID
+	for _, ps := range fp.pins {
+		for _, id := range ps.blockIDs {
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			blockIDs = append(blockIDs, id)
+		}
+	}
+	dbc.SetPinnedBlocks(ctx, fp.folderBranch.Tlf, blockIDs)
+}
+
+// updateStatus sets the status of the given pinned path, unless it
+// has been unpinned or refreshed for a newer revision in the
+// meantime.
+func (fp *folderPinner) updateStatus(status PinStatus) {
+	fp.lock.Lock()
+	defer fp.lock.Unlock()
+	ps, ok := fp.pins[status.Path]
+	if !ok || ps.status.Revision != status.Revision {
+		return
+	}
+	ps.status = status
+}
+
+// fetchMissingBlocks puts the given blocks into the disk block cache,
+// if they're not already there, keeping the status of the given path
+// up to date along the way.
+func (fp *folderPinner) fetchMissingBlocks(ctx context.Context,
+	dbc DiskBlockCache, status PinStatus, infos []BlockInfo) error {
+	var missing []BlockInfo
+	for _, info := range infos {
+		if _, err := dbc.GetMetadata(ctx, info.ID); err == nil {
+			status.PinnedBytes += uint64(info.EncodedSize)
+		} else {
+			status.MissingBytes += uint64(info.EncodedSize)
+			missing = append(missing, info)
+		}
+	}
+	fp.updateStatus(status)
+
+	tlfID := fp.folderBranch.Tlf
+	for _, info := range missing {
+		buf, serverHalf, err := fp.config.BlockServer().Get(
+			ctx, tlfID, info.ID, info.Context)
+		if err == nil {
+			err = dbc.Put(ctx, tlfID, info.ID, buf, serverHalf)
+		}
+		if err != nil {
+			status.Error = err.Error()
+			fp.updateStatus(status)
+			return err
+		}
+		status.PinnedBytes += uint64(info.EncodedSize)
+		status.MissingBytes -= uint64(info.EncodedSize)
+		fp.updateStatus(status)
+	}
+	return nil
+}
+
+// refresh pins the blocks of every pinned path as of the latest
+// known head, and fetches the ones that aren't cached yet.  It
+// returns the first error hit, after trying all of the paths.
+func (fp *folderPinner) refresh(ctx context.Context) error {
+	fp.lock.Lock()
+	head := fp.head
+	if head != (ImmutableRootMetadata{}) {
+		err := fp.loadLocked(ctx, head)
+		if err != nil {
+			fp.lock.Unlock()
+			return err
+		}
+	}
+	paths := make([]string, 0, len(fp.pins))
+	for p := range fp.pins {
+		paths = append(paths, p)
+	}
+	fp.lock.Unlock()
+	if head == (ImmutableRootMetadata{}) || len(paths) == 0 {
+		return nil
+	}
+
+	dbc := fp.config.DiskBlockCache()
+	if dbc == nil {
+		fp.lock.Lock()
+		defer fp.lock.Unlock()
+		for _, ps := range fp.pins {
+			ps.status.Error = "No disk block cache is available"
+		}
+		return nil
+	}
+
+	fileBlocks := make(map[BlockPointer][]BlockInfo)
+	pathInfos := make(map[string][]BlockInfo, len(paths))
+	pathErrs := make(map[string]error)
+	for _, p := range paths {
+		infos, err := fp.getPinnedBlockInfos(ctx, head, p, fileBlocks)
+		if err != nil {
+			pathErrs[p] = err
+			continue
+		}
+		pathInfos[p] = infos
+	}
+	fp.fileBlocks = fileBlocks
+
+	statuses := make(map[string]PinStatus, len(pathInfos))
+	func() {
+		fp.lock.Lock()
+		defer fp.lock.Unlock()
+		for p, err := range pathErrs {
+			// Keep the blocks of the last version that could be
+			// listed.
+			if ps, ok := fp.pins[p]; ok {
+				ps.status.Error = err.Error()
+			}
+		}
+		for p, infos := range pathInfos {
+			ps, ok := fp.pins[p]
+			if !ok {
+				continue
+			}
+			ps.blockIDs = make([]kbfsblock.ID, 0, len(infos))
+			for _, info := range infos {
+				ps.blockIDs = append(ps.blockIDs, info.ID)
+			}
+			ps.status = PinStatus{
+				Path:         p,
+				Revision:     head.Revision(),
+				PinnedBytes:  ps.status.PinnedBytes,
+				MissingBytes: ps.status.MissingBytes,
+			}
+			statuses[p] = ps.status
+		}
+		fp.setPinnedBlocksLocked(ctx, dbc)
+	}()
+
+	var firstErr error
+	for _, err := range pathErrs {
+		firstErr = err
+		break
+	}
+	for p, infos := range pathInfos {
+		status := statuses[p]
+		status.PinnedBytes = 0
+		status.MissingBytes = 0
+		err := fp.fetchMissingBlocks(ctx, dbc, status, infos)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (fp *folderPinner) run(ctx context.Context) {
+	defer fp.wg.Done()
+	var retryCh <-chan time.Time
+	for {
+		signaled := false
+		select {
+		case <-fp.refreshCh:
+			signaled = true
+		case <-retryCh:
+		case <-ctx.Done():
+			return
+		}
+
+		retryCh = nil
+		err := fp.refresh(ctx)
+		if signaled {
+			fp.refreshes.Done()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			fp.log.CDebugf(ctx, "Couldn't fetch all pinned blocks, "+
+				"will retry: %+v", err)
+			retryCh = time.After(pinRetryInterval)
+		}
+	}
+}
+
+// pin starts keeping the blocks under the given path available
+// offline, as of the given merged head and any later ones.
+func (fp *folderPinner) pin(
+	ctx context.Context, head ImmutableRootMetadata, p string) error {
+	p, err := cleanPinPath(p)
+	if err != nil {
+		return err
+	}
+	// Make sure the path exists.
+	_, _, err = fp.lookup(ctx, head, p)
+	if err != nil {
+		return err
+	}
+
+	fp.lock.Lock()
+	defer fp.lock.Unlock()
+	err = fp.loadLocked(ctx, head)
+	if err != nil {
+		return err
+	}
+	if _, ok := fp.pins[p]; ok {
+		return nil
+	}
+	fp.log.CDebugf(ctx, "Pinning %q", p)
+	fp.pins[p] = &pinState{status: PinStatus{Path: p}}
+	err = fp.saveLocked(ctx, head)
+	if err != nil {
+		delete(fp.pins, p)
+		return err
+	}
+	if fp.head == (ImmutableRootMetadata{}) ||
+		head.Revision() > fp.head.Revision() {
+		fp.head = head
+	}
+	fp.startLocked()
+	fp.signalRefreshLocked()
+	return nil
+}
+
+// unpin lets the blocks under the given path be evicted again.
+// Unpinning a path that isn't pinned does nothing.  `kmd` is only
+// used to save the remaining pinned paths.
+func (fp *folderPinner) unpin(
+	ctx context.Context, kmd KeyMetadata, p string) error {
+	p, err := cleanPinPath(p)
+	if err != nil {
+		return err
+	}
+
+	fp.lock.Lock()
+	defer fp.lock.Unlock()
+	err = fp.loadLocked(ctx, kmd)
+	if err != nil {
+		return err
+	}
+	ps, ok := fp.pins[p]
+	if !ok {
+		return nil
+	}
+	fp.log.CDebugf(ctx, "Unpinning %q", p)
+	delete(fp.pins, p)
+	err = fp.saveLocked(ctx, kmd)
+	if err != nil {
+		fp.pins[p] = ps
+		return err
+	}
+	if dbc := fp.config.DiskBlockCache(); dbc != nil {
+		fp.setPinnedBlocksLocked(ctx, dbc)
+	}
+	return nil
+}
+
+// getStatus returns the status of each pinned path, sorted by path.
+func (fp *folderPinner) getStatus() []PinStatus {
+	fp.lock.Lock()
+	defer fp.lock.Unlock()
+	if len(fp.pins) == 0 {
+		return nil
+	}
+	statuses := make([]PinStatus, 0, len(fp.pins))
+	for _, ps := range fp.pins {
+		statuses = append(statuses, ps.status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Path < statuses[j].Path
+	})
+	return statuses
+}
+
+// waitForRefreshes blocks until all the refreshes signaled so far
+// have finished.
+func (fp *folderPinner) waitForRefreshes(ctx context.Context) error {
+	return fp.refreshes.Wait(ctx)
+}
+
+// shutdown stops the background goroutine, if there is one.
+func (fp *folderPinner) shutdown() {
+	fp.lock.Lock()
+	if fp.cancel != nil {
+		fp.cancel()
+	}
+	fp.lock.Unlock()
+	fp.wg.Wait()
+}
@@ -6,6 +6,7 @@ package libkbfs
 
 import (
 	"fmt"
+	"reflect"
 	"sync"
 
 	"github.com/keybase/client/go/logger"
@@ -57,6 +58,95 @@ func (fup *folderUpdatePrepper) readyBlockMultiple(ctx context.Context,
 	return
 }
 
+// readyDirBlock readies the given direct dir block, first splitting
+// it into an indirect dir block if it has grown too big.  If the
+// block was assembled from the children of an indirect dir block,
+// any children whose contents haven't changed are reused as-is, and
+// the rest are unreferenced.  New child blocks are referenced in
+// `md`, while the caller is responsible for referencing the returned
+// top block.  The returned plain size covers the top block and all
+// of its children.
+func (fup *folderUpdatePrepper) readyDirBlock(ctx context.Context,
+	md *RootMetadata, dblock *DirBlock, chargedTo keybase1.UserOrTeamID,
+	bps *blockPutState) (info BlockInfo, plainSize int, err error) {
+	if dblock.IsInd {
+		return BlockInfo{}, 0, errors.New(
+			"Can't ready an indirect dir block that hasn't been assembled")
+	}
+
+	prevOffs := make([]string, len(dblock.indirectChildren))
+	prevChildren := make(map[string]indirectDirChild, len(prevOffs))
+	for i, child := range dblock.indirectChildren {
+		prevOffs[i] = child.ptr.Off
+		prevChildren[child.ptr.Off] = child
+	}
+	newBlocks, offs, err := fup.config.BlockSplitter().SplitDirIfNeeded(
+		dblock, prevOffs)
+	if err != nil {
+		return BlockInfo{}, 0, err
+	}
+
+	reused := make(map[BlockPointer]bool)
+	topBlock := dblock
+	if len(newBlocks) > 0 {
+		topBlock = &DirBlock{
+			CommonBlock: CommonBlock{IsInd: true},
+			IPtrs:       make([]IndirectDirPtr, 0, len(newBlocks)),
+		}
+		for i, newBlock := range newBlocks {
+			var childInfo BlockInfo
+			var childSize int
+			prevChild, ok := prevChildren[offs[i]]
+			if ok && reflect.DeepEqual(
+				prevChild.block.Children, newBlock.Children) {
+				// Nothing changed in this range, so there's no
+				// need to put the block again.
+				buf, err := fup.config.Codec().Encode(prevChild.block)
+				if err != nil {
+					return BlockInfo{}, 0, err
+				}
+				childInfo = prevChild.ptr.BlockInfo
+				childSize = len(buf)
+				reused[childInfo.BlockPointer] = true
+			} else {
+				childInfo, childSize, err = fup.readyBlockMultiple(
+					ctx, md.ReadOnly(), newBlock, chargedTo, bps,
+					keybase1.BlockType_DATA)
+				if err != nil {
+					return BlockInfo{}, 0, err
+				}
+				md.AddRefBlock(childInfo)
+			}
+			topBlock.IPtrs = append(topBlock.IPtrs, IndirectDirPtr{
+				BlockInfo: childInfo,
+				Off:       offs[i],
+			})
+			plainSize += childSize
+		}
+	} else if len(dblock.indirectChildren) > 0 {
+		// The directory shrank back down into a single direct
+		// block, so make sure the cached version of the new block
+		// doesn't refer to the old children anymore.
+		topBlock = dblock.DeepCopy()
+		topBlock.indirectChildren = nil
+	}
+
+	for _, child := range dblock.indirectChildren {
+		if !reused[child.ptr.BlockPointer] {
+			md.AddUnrefBlock(child.ptr.BlockInfo)
+		}
+	}
+
+	// The top block must be readied last, since callers may save the
+	// old pointer for the most recent block in `bps`.
+	info, topSize, err := fup.readyBlockMultiple(
+		ctx, md.ReadOnly(), topBlock, chargedTo, bps, keybase1.BlockType_DATA)
+	if err != nil {
+		return BlockInfo{}, 0, err
+	}
+	return info, plainSize + topSize, nil
+}
+
 func (fup *folderUpdatePrepper) unembedBlockChanges(
 	ctx context.Context, bps *blockPutState, md *RootMetadata,
 	changes *BlockChanges, chargedTo keybase1.UserOrTeamID) error {
@@ -194,8 +284,17 @@ func (fup *folderUpdatePrepper) prepUpdateForPath(
 	now := fup.nowUnixNano()
 	var uid keybase1.UID
 	for len(newPath.path) < len(dir.path)+1 {
-		info, plainSize, err := fup.readyBlockMultiple(
-			ctx, md.ReadOnly(), currBlock, chargedTo, bps, keybase1.BlockType_DATA)
+		var info BlockInfo
+		var plainSize int
+		var err error
+		if dblock, ok := currBlock.(*DirBlock); ok {
+			info, plainSize, err = fup.readyDirBlock(
+				ctx, md, dblock, chargedTo, bps)
+		} else {
+			info, plainSize, err = fup.readyBlockMultiple(
+				ctx, md.ReadOnly(), currBlock, chargedTo, bps,
+				keybase1.BlockType_DATA)
+		}
 		if err != nil {
 			return path{}, DirEntry{}, nil, err
 		}
@@ -271,9 +370,8 @@ func (fup *folderUpdatePrepper) prepUpdateForPath(
 		}
 
 		if de.Type == Dir {
-			// TODO: When we use indirect dir blocks,
-			// we'll have to calculate the size some other
-			// way.
+			// For indirect dir blocks, this includes the size of
+			// all the child blocks.
 			de.Size = uint64(plainSize)
 		}
 
@@ -737,6 +835,29 @@ func (fup *folderUpdatePrepper) updateResolutionUsageAndPointersLockedCache(
 	for ptr := range unmergedChains.toUnrefPointers {
 		toUnref[ptr] = true
 	}
+	// The children of indirect directory blocks don't have chains of
+	// their own, so find the ones created on the unmerged branch via
+	// their dropped parent blocks.
+	for _, chain := range unmergedChains.byOriginal {
+		ptr := chain.mostRecent
+		if chain.isFile() || !toUnref[ptr] ||
+			ptr.DirectType != IndirectBlock {
+			continue
+		}
+		dblock, err := fup.blocks.GetDirBlockForReading(
+			ctx, lState, md.ReadOnly(), ptr, fup.branch(), path{})
+		if err != nil {
+			return nil, err
+		}
+		for _, child := range dblock.indirectChildren {
+			childPtr := child.ptr.BlockPointer
+			if unmergedChains.createdOriginals[childPtr] &&
+				!unmergedChains.deletedOriginals[childPtr] &&
+				!refs[childPtr] && !unrefs[childPtr] {
+				toUnref[childPtr] = true
+			}
+		}
+	}
 	deletedBlocks := make(map[BlockPointer]bool)
 	for ptr := range toUnref {
 		if ptr == zeroPtr || unmergedChains.doNotUnrefPointers[ptr] {
@@ -912,24 +1033,29 @@ func fixOpPointersForUpdate(oldOps []op, updates map[BlockPointer]BlockPointer,
 			}
 			// The leading resolutionOp will take care of the updates.
 			realOp.Updates = nil
-		case *renameOp:
-			updatesToFix = append(updatesToFix, &realOp.OldDir, &realOp.NewDir)
-			ptrsToFix = append(ptrsToFix, &realOp.Renamed)
+		case entryMover:
+			ro := realOp.moveOp()
+			updatesToFix = append(updatesToFix, &ro.OldDir, &ro.NewDir)
+			ptrsToFix = append(ptrsToFix, &ro.Renamed)
+			if xo, ok := realOp.(*exchangeOp); ok {
+				ptrsToFix = append(ptrsToFix, &xo.Exchanged)
+			}
 			// Hack: we need to fixup local conflict renames so that the block
 			// update changes to the new block pointer.
-			for i := range realOp.Updates {
-				ptrsToFix = append(ptrsToFix, &realOp.Updates[i].Ref)
+			for i := range ro.Updates {
+				ptrsToFix = append(ptrsToFix, &ro.Updates[i].Ref)
 			}
 			// Note: Unrefs from the original renameOp are now in a
 			// separate rm operation.
 		case *syncOp:
 			updatesToFix = append(updatesToFix, &realOp.File)
 			realOp.Updates = nil
-		case *setAttrOp:
-			updatesToFix = append(updatesToFix, &realOp.Dir)
-			ptrsToFix = append(ptrsToFix, &realOp.File)
+		case attrChanger:
+			sao := realOp.attrOp()
+			updatesToFix = append(updatesToFix, &sao.Dir)
+			ptrsToFix = append(ptrsToFix, &sao.File)
 			// The leading resolutionOp will take care of the updates.
-			realOp.Updates = nil
+			sao.Updates = nil
 		}
 
 		for _, update := range updatesToFix {
@@ -32,6 +32,16 @@ const (
 	InitSingleOpString = "singleOp"
 )
 
+const (
+	// BlockSplitterSimpleString splits file blocks only when they
+	// reach the max block size.
+	BlockSplitterSimpleString = "simple"
+	// BlockSplitterCDCString splits file blocks at content-defined
+	// boundaries, so that unchanged parts of edited files can reuse
+	// existing blocks.
+	BlockSplitterCDCString = "cdc"
+)
+
 // InitParams contains the initialization parameters for Init(). It is
 // usually filled in by the flags parser passed into AddFlags().
 type InitParams struct {
@@ -92,6 +102,21 @@ type InitParams struct {
 	// StorageRoot data directory.
 	EnableDiskCache bool
 
+	// EnableDedupIndex toggles whether a persistent index of known
+	// file blocks is kept in the StorageRoot data directory, so that
+	// duplicate data can be de-duplicated across restarts.  It is
+	// opt-in, since it keeps a record of the TLFs' blocks on disk.
+	EnableDedupIndex bool
+
+	// EnableSearchIndex toggles whether a local, encrypted search
+	// index of the TLFs marked for syncing is kept in the
+	// StorageRoot data directory.
+	EnableSearchIndex bool
+
+	// SearchIndexContents toggles whether the search index includes
+	// the text contents of files, as well as their names.
+	SearchIndexContents bool
+
 	// StorageRoot, if non-empty, points to a local directory to put its local
 	// databases for things like the journal or disk cache.
 	StorageRoot string
@@ -105,6 +130,36 @@ type InitParams struct {
 	// flush.
 	BGFlushDirOpBatchSize int
 
+	// CompressBlocks, if true, compresses new blocks in all TLFs
+	// before encrypting them.  Clients too old to understand
+	// compressed blocks won't be able to read them.
+	CompressBlocks bool
+
+	// BlockSplitter picks how file data is split into blocks (one of
+	// BlockSplitterSimpleString or BlockSplitterCDCString).
+	BlockSplitter string
+
+	// ConflictMergePatterns is a comma-separated list of file name
+	// patterns (see filepath.Match).  Text files matching one of
+	// them, that were written on both sides of a conflict, are
+	// merged line by line rather than renamed, when the changes
+	// don't overlap.
+	ConflictMergePatterns string
+
+	// ConflictMergeMaxSize is the size of the largest file that
+	// will be merged, as described above.
+	ConflictMergeMaxSize int64
+
+	// PathChangeSocket, if non-empty, is the path of a unix socket
+	// on which to serve streams of TLF path changes to local
+	// clients (see PathChangeServer).
+	PathChangeSocket string
+
+	// BandwidthLimits, if non-empty, limits how fast blocks are
+	// uploaded and downloaded, in the format accepted by
+	// ParseBandwidthLimits.
+	BandwidthLimits string
+
 	// Mode describes how KBFS should initialize itself.
 	Mode string
 }
@@ -174,6 +229,8 @@ func DefaultInitParams(ctx Context) InitParams {
 		BGFlushDirOpBatchSize:          bgFlushDirOpBatchSizeDefault,
 		EnableJournal:                  true,
 		EnableDiskCache:                true,
+		BlockSplitter:                  BlockSplitterSimpleString,
+		ConflictMergeMaxSize:           defaultConflictMergeMaxSize,
 		Mode:                           InitDefaultString,
 	}
 }
@@ -226,6 +283,18 @@ func AddFlagsWithDefaults(
 	flags.BoolVar(&params.EnableDiskCache, "enable-disk-cache",
 		defaultParams.EnableDiskCache,
 		"Enables the disk cache for the directory specified by -storage-root.")
+	flags.BoolVar(&params.EnableDedupIndex, "enable-dedup-index",
+		defaultParams.EnableDedupIndex,
+		"Enables a persistent index of known blocks for de-duplicating "+
+			"file data, in the directory specified by -storage-root.")
+	flags.BoolVar(&params.EnableSearchIndex, "enable-search-index",
+		defaultParams.EnableSearchIndex,
+		"Enables a local search index of synced TLFs, in the directory "+
+			"specified by -storage-root.")
+	flags.BoolVar(&params.SearchIndexContents, "search-index-contents",
+		defaultParams.SearchIndexContents,
+		"Index the text contents of files, and not just their names, "+
+			"when -enable-search-index is set.")
 	flags.BoolVar(&params.EnableJournal, "enable-journal",
 		defaultParams.EnableJournal, "Enables write journaling for TLFs.")
 
@@ -243,6 +312,31 @@ func AddFlagsWithDefaults(
 		"The number of unflushed directory operations in a TLF that will "+
 			"trigger an immediate data sync.")
 
+	flags.BoolVar(&params.CompressBlocks, "compress-blocks",
+		defaultParams.CompressBlocks,
+		"Compresses new blocks before encrypting them, when that saves "+
+			"space. Older clients won't be able to read compressed blocks.")
+	flags.StringVar(&params.BlockSplitter, "block-splitter",
+		defaultParams.BlockSplitter,
+		fmt.Sprintf("How to split file data into blocks (%s or %s)",
+			BlockSplitterSimpleString, BlockSplitterCDCString))
+	flags.StringVar(&params.ConflictMergePatterns, "conflict-merge",
+		defaultParams.ConflictMergePatterns,
+		"Comma-separated file name patterns (e.g. '*.txt,*.conf') of text "+
+			"files to merge, instead of rename, on non-overlapping conflicts.")
+	params.ConflictMergeMaxSize = defaultParams.ConflictMergeMaxSize
+	flags.Var(SizeFlag{&params.ConflictMergeMaxSize}, "conflict-merge-max-size",
+		"The largest file that -conflict-merge will merge.")
+	flags.StringVar(&params.PathChangeSocket, "path-change-socket",
+		defaultParams.PathChangeSocket,
+		"If non-empty, the path of a unix socket on which local clients "+
+			"can subscribe to the path changes of a TLF.")
+	flags.StringVar(&params.BandwidthLimits, "bandwidth-limits",
+		defaultParams.BandwidthLimits,
+		"Block upload and download limits in KiB/s, with optional "+
+			"local time-of-day overrides, e.g. "+
+			"'up=1024,down=0;09:00-18:00 up=256'. 0 means unlimited.")
+
 	flags.IntVar((*int)(&params.MetadataVersion), "md-version",
 		int(defaultParams.MetadataVersion),
 		"Metadata version to use when creating new metadata")
@@ -576,8 +670,19 @@ func doInit(
 	}
 	config.SetBlockOps(NewBlockOpsStandard(config, workers, prefetchWorkers))
 
-	bsplitter, err := NewBlockSplitterSimple(MaxBlockSizeBytesDefault, 8*1024,
-		config.Codec())
+	var bsplitter BlockSplitter
+	var err error
+	switch params.BlockSplitter {
+	case "", BlockSplitterSimpleString:
+		bsplitter, err = NewBlockSplitterSimple(
+			MaxBlockSizeBytesDefault, 8*1024, config.Codec())
+	case BlockSplitterCDCString:
+		bsplitter, err = NewBlockSplitterCDC(
+			MaxBlockSizeBytesDefault, 8*1024, config.Codec())
+	default:
+		return nil, fmt.Errorf("Unexpected block splitter %s",
+			params.BlockSplitter)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -596,6 +701,17 @@ func doInit(
 	config.SetMetadataVersion(MetadataVer(params.MetadataVersion))
 	config.SetTLFValidDuration(params.TLFValidDuration)
 	config.SetBGFlushPeriod(params.BGFlushPeriod)
+	config.SetConflictMerger(TextConflictMerger{
+		Patterns: ParseConflictMergePatterns(params.ConflictMergePatterns),
+		MaxSize:  uint64(params.ConflictMergeMaxSize),
+	})
+	if params.BandwidthLimits != "" {
+		limits, err := ParseBandwidthLimits(params.BandwidthLimits)
+		if err != nil {
+			return nil, err
+		}
+		config.BandwidthLimiter().SetLimits(limits)
+	}
 
 	kbfsOps := NewKBFSOpsStandard(config)
 	config.SetKBFSOps(kbfsOps)
@@ -672,6 +788,16 @@ func doInit(
 	}
 	ctx10s, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
+	// The dedup index has to come before journaling, so that the
+	// journal can still turn off de-duping for journaled TLFs.
+	if params.EnableDedupIndex && config.Mode() == InitDefault {
+		err = config.MakeBlockDedupIndexIfNotExists()
+		if err != nil {
+			log.CWarningf(ctx, "Could not initialize dedup index: %+v", err)
+		} else {
+			log.CDebugf(ctx, "Dedup index enabled")
+		}
+	}
 	// TODO: Don't turn on journaling if either -bserver or
 	// -mdserver point to local implementations.
 	if params.EnableJournal && config.Mode() != InitMinimal {
@@ -698,6 +824,26 @@ func doInit(
 		}
 	}
 
+	if params.PathChangeSocket != "" {
+		err = config.EnablePathChangeServer(params.PathChangeSocket)
+		if err != nil {
+			log.CWarningf(ctx, "Could not start the path change server: %+v",
+				err)
+		} else {
+			log.CDebugf(ctx, "Serving path changes on %s",
+				params.PathChangeSocket)
+		}
+	}
+
+	if params.EnableSearchIndex && config.Mode() == InitDefault {
+		err = config.EnableSearchIndex(params.SearchIndexContents)
+		if err != nil {
+			log.CWarningf(ctx, "Could not initialize search index: %+v", err)
+		} else {
+			log.CDebugf(ctx, "Search index enabled")
+		}
+	}
+
 	if params.BGFlushDirOpBatchSize < 1 {
 		return nil, fmt.Errorf(
 			"Illegal sync batch size: %d", params.BGFlushDirOpBatchSize)
@@ -706,6 +852,11 @@ func doInit(
 		params.BGFlushDirOpBatchSize)
 	config.SetBGFlushDirOpBatchSize(params.BGFlushDirOpBatchSize)
 
+	if params.CompressBlocks {
+		log.CDebugf(ctx, "Enabling block compression")
+		config.SetBlockCompression(true)
+	}
+
 	return config, nil
 }
 
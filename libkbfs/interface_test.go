@@ -75,3 +75,55 @@ func (t *testSyncedTlfGetterSetter) SetTlfSyncState(tlfID tlf.ID,
 	t.syncedTlfs[tlfID] = isSynced
 	return nil
 }
+
+type testBlockCompressionGetterSetter struct {
+	enabled    bool
+	tlfEnabled map[tlf.ID]bool
+}
+
+var _ blockCompressionGetterSetter = (*testBlockCompressionGetterSetter)(nil)
+
+func newTestBlockCompressionGetterSetter() *testBlockCompressionGetterSetter {
+	return &testBlockCompressionGetterSetter{
+		tlfEnabled: make(map[tlf.ID]bool),
+	}
+}
+
+func (t *testBlockCompressionGetterSetter) IsBlockCompressionEnabled(
+	tlfID tlf.ID) bool {
+	if enabled, ok := t.tlfEnabled[tlfID]; ok {
+		return enabled
+	}
+	return t.enabled
+}
+
+func (t *testBlockCompressionGetterSetter) SetBlockCompression(enabled bool) {
+	t.enabled = enabled
+}
+
+func (t *testBlockCompressionGetterSetter) SetTlfBlockCompression(
+	tlfID tlf.ID, enabled bool) {
+	t.tlfEnabled[tlfID] = enabled
+}
+
+type testDiskCacheTlfLimitsGetterSetter struct {
+	tlfLimits map[tlf.ID]DiskCacheTlfLimits
+}
+
+var _ diskCacheTlfLimitsGetterSetter = (*testDiskCacheTlfLimitsGetterSetter)(nil)
+
+func newTestDiskCacheTlfLimitsGetterSetter() *testDiskCacheTlfLimitsGetterSetter {
+	return &testDiskCacheTlfLimitsGetterSetter{
+		tlfLimits: make(map[tlf.ID]DiskCacheTlfLimits),
+	}
+}
+
+func (t *testDiskCacheTlfLimitsGetterSetter) DiskCacheTlfLimits(
+	tlfID tlf.ID) DiskCacheTlfLimits {
+	return t.tlfLimits[tlfID]
+}
+
+func (t *testDiskCacheTlfLimitsGetterSetter) SetDiskCacheTlfLimits(
+	tlfID tlf.ID, limits DiskCacheTlfLimits) {
+	t.tlfLimits[tlfID] = limits
+}
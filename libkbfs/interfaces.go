@@ -68,6 +68,18 @@ type diskBlockCacheSetter interface {
 	MakeDiskBlockCacheIfNotExists() error
 }
 
+type blockDedupIndexGetter interface {
+	BlockDedupIndex() BlockDedupIndex
+}
+
+type blockDedupIndexSetter interface {
+	MakeBlockDedupIndexIfNotExists() error
+}
+
+type searchIndexGetter interface {
+	SearchIndex() SearchIndex
+}
+
 type clockGetter interface {
 	Clock() Clock
 }
@@ -81,6 +93,49 @@ type syncedTlfGetterSetter interface {
 	SetTlfSyncState(tlfID tlf.ID, isSynced bool) error
 }
 
+type blockCompressionGetterSetter interface {
+	// IsBlockCompressionEnabled returns whether new blocks in the
+	// given TLF should be compressed before they are encrypted.
+	IsBlockCompressionEnabled(tlfID tlf.ID) bool
+	// SetBlockCompression sets whether new blocks should be
+	// compressed, for all TLFs without their own setting.
+	SetBlockCompression(enabled bool)
+	// SetTlfBlockCompression sets whether new blocks in the given
+	// TLF should be compressed, overriding the global setting.
+	SetTlfBlockCompression(tlfID tlf.ID, enabled bool)
+}
+
+type conflictResolutionModeGetterSetter interface {
+	// IsManualConflictResolution returns whether local unmerged
+	// changes in the given TLF should be set aside for the user to
+	// resolve, instead of being resolved automatically.
+	IsManualConflictResolution(tlfID tlf.ID) bool
+	// SetManualConflictResolution sets whether local unmerged
+	// changes in the given TLF should be set aside for the user to
+	// resolve.  The setting is saved under the storage root, if
+	// there is one.
+	SetManualConflictResolution(tlfID tlf.ID, manual bool) error
+}
+
+type diskCacheTlfLimitsGetterSetter interface {
+	// DiskCacheTlfLimits returns the limits on how the given TLF
+	// may use the working set disk block cache.
+	DiskCacheTlfLimits(tlfID tlf.ID) DiskCacheTlfLimits
+	// SetDiskCacheTlfLimits sets the limits on how the given TLF
+	// may use the working set disk block cache.
+	SetDiskCacheTlfLimits(tlfID tlf.ID, limits DiskCacheTlfLimits)
+}
+
+type bandwidthLimiterGetter interface {
+	// BandwidthLimiter returns the limiter that keeps block
+	// uploads and downloads within the configured rates.
+	BandwidthLimiter() *BandwidthLimiter
+}
+
+type metricsRegistryGetter interface {
+	MetricsRegistry() metrics.Registry
+}
+
 // Block just needs to be (de)serialized using msgpack
 type Block interface {
 	dataVersioner
@@ -196,6 +251,29 @@ type KBFSOps interface {
 	GetRootNode(
 		ctx context.Context, h *TlfHandle, branch BranchName) (
 		node Node, ei EntryInfo, err error)
+	// GetArchivedRootNode returns a read-only root node and root
+	// entry info for the given TLF, as it existed at the given merged
+	// revision.  Any attempts to modify the returned node, or nodes
+	// looked up from it, will fail with a WriteToReadonlyNodeError.
+	// This is a remote-access operation.
+	GetArchivedRootNode(
+		ctx context.Context, h *TlfHandle, rev kbfsmd.Revision) (
+		node Node, ei EntryInfo, err error)
+	// GetUnmergedRootNode returns a read-only root node and root
+	// entry info for the local unmerged changes of the given TLF
+	// that were set aside for manual conflict resolution.  It
+	// returns a NoUnmergedChangesError if there aren't any.  This is
+	// a remote-access operation.
+	GetUnmergedRootNode(ctx context.Context, h *TlfHandle) (
+		node Node, ei EntryInfo, err error)
+	// GetRevisionForTime returns the latest merged revision of the
+	// given TLF whose MD was written at or before the given time,
+	// according to the local timestamps of the MDs.  It returns a
+	// NoRevisionAtTimeError if the TLF has no such revision.  This
+	// is a remote-access operation.
+	GetRevisionForTime(
+		ctx context.Context, h *TlfHandle, t time.Time) (
+		kbfsmd.Revision, error)
 	// GetDirChildren returns a map of children in the directory,
 	// mapped to their EntryInfo, if the logged-in user has read
 	// permission for the top-level folder.  This is a remote-access
@@ -246,10 +324,110 @@ type KBFSOps interface {
 	// that folder, and will return an error if nodes from different
 	// folders are passed in.  Also returns an error if the new name
 	// already has an entry corresponding to an existing directory
-	// (only non-dir types may be renamed over).  This is a
-	// remote-sync operation.
+	// (only non-dir types may be renamed over).  With
+	// RenameNoReplace, it returns NameExistsError if the new name
+	// has any entry at all; with RenameExchange, the new name must
+	// have an entry, and the two entries are swapped in a single
+	// revision.  This is a remote-sync operation.
 	Rename(ctx context.Context, oldParent Node, oldName string, newParent Node,
-		newName string) error
+		newName string, mode RenameMode) error
+	// CopyFile creates a new file with the given name under the
+	// given directory, with the same contents as the given file.
+	// Rather than re-uploading the data, the new file shares the
+	// blocks of the original file via new block references.  Returns
+	// an error if the file and directory are in different top-level
+	// folders, or if the name already exists.  Returns the new Node
+	// for the copy, and its new entry info.  This is a remote-sync
+	// operation.
+	CopyFile(ctx context.Context, file Node, dir Node, name string) (
+		Node, EntryInfo, error)
+	// CopyDir recursively clones the directory tree rooted at the
+	// given source directory into a new subdirectory with the given
+	// name under the given directory, sharing the blocks of all the
+	// files in the tree via new block references.  It has the same
+	// restrictions as CopyFile.  This is a remote-sync operation.
+	CopyDir(ctx context.Context, src Node, dir Node, name string) (
+		Node, EntryInfo, error)
+	// GetDeletedEntries returns the entries that were removed from
+	// the given folder recently enough that their blocks can't have
+	// been reclaimed yet (see SetTrashRetention), most recent first.
+	// Entries removed along with one of their parent directories
+	// are only represented by the removed directory.  This is a
+	// remote-access operation.
+	GetDeletedEntries(ctx context.Context, folderBranch FolderBranch) (
+		[]DeletedEntry, error)
+	// SetTrashRetention sets how long entries removed from the
+	// given folder stay restorable, before quota reclamation can
+	// delete their blocks.  The setting is kept in the folder's
+	// metadata, so it applies to all the folder's writers, and only
+	// to entries removed after it's set.  Zero turns the trash
+	// off.  This is a remote-sync operation.
+	SetTrashRetention(ctx context.Context, folderBranch FolderBranch,
+		retention time.Duration) error
+	// RestoreDeletedEntry re-creates the given removed entry as a
+	// new entry with the given name under the given directory, by
+	// adding new references to the blocks that made up the entry
+	// when it was removed.  The directory must be in the same
+	// top-level folder as the removed entry.  Returns the new Node
+	// for the entry, and its new entry info.  This is a remote-sync
+	// operation.
+	RestoreDeletedEntry(
+		ctx context.Context, entry DeletedEntry, dir Node, name string) (
+		Node, EntryInfo, error)
+	// GetFileVersions returns the versions of the given file that
+	// were written recently enough that their blocks can't have been
+	// reclaimed yet, most recent (i.e., the current version) first.
+	// The history only follows the file back through revisions that
+	// wrote new contents to it.  This is a remote-access operation.
+	GetFileVersions(ctx context.Context, file Node) ([]FileVersion, error)
+	// RestoreFileVersion makes the contents of the given version of
+	// the given file its current contents, as a new revision.  The
+	// version must have come from GetFileVersions for the same file.
+	// This is a remote-sync operation.
+	RestoreFileVersion(
+		ctx context.Context, file Node, version FileVersion) error
+	// GetPathChanges returns the changes made to the paths of the
+	// given folder by the merged revisions after `since`, in order,
+	// along with the last revision they cover.  To bound the work
+	// done by each call, it may not cover all the revisions up to
+	// the current head, so callers should keep calling it with the
+	// returned revision until it stops advancing.  If quota
+	// reclamation has already covered any revision after `since`,
+	// their blocks might be gone, so PathChangesReclaimedError is
+	// returned, and the caller has to rescan the folder before
+	// resuming after its LastGCRevision.  If the changes made by any
+	// other revision can't be read, the result stops just before it,
+	// or the error is returned if it's the first revision.  This is a
+	// remote-access operation.
+	GetPathChanges(ctx context.Context, folderBranch FolderBranch,
+		since kbfsmd.Revision) ([]PathChange, kbfsmd.Revision, error)
+	// GetDiskUsage returns the recursive disk usage of the given
+	// directory, and of each of its children, as of the latest
+	// merged revision of its folder.  Unsynced local changes aren't
+	// counted.  The usages are kept up to date as new revisions are
+	// made, so only the first call for a folder needs to look at all
+	// of its blocks.  This is a remote-access operation.
+	GetDiskUsage(ctx context.Context, dir Node) (DirDiskUsage, error)
+	// PinPath keeps all the blocks under the given path, relative to
+	// the root of the given folder, in the disk block cache so that
+	// they're available offline.  The pinned blocks are fetched and
+	// protected from eviction in the background, including the
+	// blocks of any new versions of the path's contents.  Pins are
+	// saved locally, so pinned blocks stay protected across
+	// restarts, and their progress is reported by FolderStatus.
+	PinPath(ctx context.Context, folderBranch FolderBranch, p string) error
+	// UnpinPath undoes a previous PinPath for the given path, letting
+	// its blocks be evicted from the disk block cache again.
+	UnpinPath(ctx context.Context, folderBranch FolderBranch, p string) error
+	// GetFileDataExtents returns the ranges of the given file that
+	// contain data rather than holes, ordered by offset and starting
+	// with the one that contains or follows `off`, if the logged-in
+	// user has read permission to the top-level folder.  Like Read,
+	// it reflects any outstanding writes to the file.  If
+	// `maxExtents` is greater than 0, at most that many extents are
+	// returned.  This is a remote-access operation.
+	GetFileDataExtents(ctx context.Context, file Node, off int64,
+		maxExtents int) ([]FileExtent, error)
 	// Read fills in the given buffer with data from the file at the
 	// given node starting at the given offset, if the logged-in user
 	// has read permission to the top-level folder.  The read data
@@ -281,6 +459,13 @@ type KBFSOps interface {
 	// on whether or not the necessary blocks have been locally
 	// cached.  This is a remote-access operation.
 	Truncate(ctx context.Context, file Node, size uint64) error
+	// PunchHole replaces `length` bytes of the given file, starting
+	// at `off`, with zeroes, if the logged-in user has write
+	// permission to the top-level folder.  The size of the file
+	// doesn't change.  Any blocks that end up entirely within the
+	// hole are unreferenced, rather than replaced with blocks full
+	// of zeroes.  This is a remote-access operation.
+	PunchHole(ctx context.Context, file Node, off, length int64) error
 	// SetEx turns on or off the executable bit on the file
 	// represented by a given node, if the logged-in user has write
 	// permissions to the top-level folder.  This is a remote-sync
@@ -291,6 +476,43 @@ type KBFSOps interface {
 	// the top-level folder.  If mtime is nil, it is a noop.  This is
 	// a remote-sync operation.
 	SetMtime(ctx context.Context, file Node, mtime *time.Time) error
+	// GetXattr returns the value of the extended attribute `name` on
+	// the entry represented by the given node.  If there is no such
+	// attribute, it returns NoSuchXattrError.
+	GetXattr(ctx context.Context, node Node, name string) ([]byte, error)
+	// ListXattrs returns the sorted names of all the extended
+	// attributes set on the entry represented by the given node.
+	ListXattrs(ctx context.Context, node Node) ([]string, error)
+	// SetXattr sets the extended attribute `name` on the entry
+	// represented by the given node, if the logged-in user has write
+	// permissions to the top-level folder.  `flag` controls whether
+	// an existing attribute may or must be replaced.  The attributes
+	// are stored encrypted, along with the rest of the entry, in its
+	// parent directory.  This is a remote-sync operation.
+	SetXattr(ctx context.Context, node Node, name string, value []byte,
+		flag XattrFlag) error
+	// RemoveXattr removes the extended attribute `name` from the
+	// entry represented by the given node, if the logged-in user has
+	// write permissions to the top-level folder.  This is a
+	// remote-sync operation.
+	RemoveXattr(ctx context.Context, node Node, name string) error
+	// LockPath takes an advisory lock on the path of the given node
+	// on behalf of `owner`, shared with every other device and user
+	// accessing the top-level folder through the MD server.  It
+	// returns PathLockedError if anyone else, including another
+	// owner on this device, already holds the lock.  The lock is
+	// renewed in the background until it is released with
+	// UnlockPath, or until this device can no longer reach the
+	// server before the lock's lease expires.  Locking a path the
+	// owner already holds is a no-op.  These locks are only taken
+	// through libfs.File.Lock: the vendored FUSE library doesn't
+	// deliver flock or fcntl lock requests, so those are still only
+	// enforced locally by the kernel on a FUSE mount.
+	LockPath(ctx context.Context, node Node, owner PathLockOwner) error
+	// UnlockPath releases an advisory lock taken by `owner` with
+	// LockPath on the path of the given node.  Unlocking a path that
+	// the owner doesn't hold is a no-op.
+	UnlockPath(ctx context.Context, node Node, owner PathLockOwner) error
 	// SyncAll flushes all outstanding writes and truncates for any
 	// dirty files to the KBFS servers within the given folder, if the
 	// logged-in user has write permissions to the top-level folder.
@@ -311,6 +533,13 @@ type KBFSOps interface {
 	// KBFSStatus can be non-empty even if there is an error.
 	Status(ctx context.Context) (
 		KBFSStatus, <-chan StatusUpdate, error)
+	// ResolveUnmerged resolves the local unmerged changes that were
+	// set aside for manual conflict resolution in the given
+	// folder-branch, and unblocks writes to it.  It returns a
+	// NoUnmergedChangesError if there aren't any.  This is a
+	// remote-sync operation.
+	ResolveUnmerged(ctx context.Context, folderBranch FolderBranch,
+		resolution UnmergedResolution) error
 	// UnstageForTesting clears out this device's staged state, if
 	// any, and fast-forwards to the current head of this
 	// folder-branch.
@@ -948,6 +1177,11 @@ type DiskBlockCache interface {
 	// changing it.
 	GetMetadata(ctx context.Context, blockID kbfsblock.ID) (
 		metadata DiskBlockCacheMetadata, err error)
+	// SetPinnedBlocks replaces the set of blocks of the given TLF
+	// that must not be evicted from the disk cache.  Pinned blocks
+	// can still be deleted explicitly.
+	SetPinnedBlocks(ctx context.Context, tlfID tlf.ID,
+		blockIDs []kbfsblock.ID)
 	// Size returns the size in bytes of the disk cache.
 	Size() int64
 	// Status returns the current status of the disk cache.
@@ -956,6 +1190,52 @@ type DiskBlockCache interface {
 	Shutdown(ctx context.Context)
 }
 
+// BlockDedupIndex persistently maps keyed hashes of the plaintext
+// of direct file blocks (see BlockDedupKey) to pointers of blocks
+// with that plaintext that are already on the server, so that new
+// copies of the same data can just add references to the existing
+// blocks, even after a restart.
+type BlockDedupIndex interface {
+	// Get returns a pointer to a known block in the given TLF with
+	// the given dedup key, or a zero pointer if there isn't one.
+	Get(tlfID tlf.ID, key BlockDedupKey) (BlockPointer, error)
+	// Put records that the block pointed to by `ptr` in the given
+	// TLF has the given dedup key.
+	Put(tlfID tlf.ID, key BlockDedupKey, ptr BlockPointer) error
+	// Remove forgets the pointer for the given dedup key in the
+	// given TLF, if there is one.
+	Remove(tlfID tlf.ID, key BlockDedupKey) error
+	// RemoveBlocks forgets any pointers to the given blocks in the
+	// given TLF, e.g. because they have been deleted from the
+	// server.
+	RemoveBlocks(tlfID tlf.ID, ids []kbfsblock.ID) error
+	// Shutdown cleanly shuts down the index.
+	Shutdown()
+}
+
+// SearchIndex keeps a local, encrypted index of the names, and
+// optionally the text contents, of the entries in TLFs, so that they
+// can be found without fetching every block of a TLF.
+type SearchIndex interface {
+	// StartIndexing starts keeping the index of the given TLF up to
+	// date in the background, as changes to the TLF arrive.
+	StartIndexing(tlfID tlf.ID)
+	// StopIndexing stops the background indexing of the given TLF.
+	// Its index is kept, and is brought up to date again by the
+	// next search.
+	StopIndexing(tlfID tlf.ID)
+	// Search brings the index of the given TLF up to date, and
+	// returns the entries under `dir` (relative to the TLF root)
+	// whose names or contents contain all the words in `query`,
+	// ordered by path.  If maxResults is greater than 0, at most
+	// that many entries are returned.
+	Search(ctx context.Context, h *TlfHandle, dir string, query string,
+		maxResults int) ([]SearchResult, error)
+	// Shutdown stops all background indexing, and cleanly shuts
+	// down the index.
+	Shutdown()
+}
+
 // cryptoPure contains all methods of Crypto that don't depend on
 // implicit state, i.e. they're pure functions of the input.
 type cryptoPure interface {
@@ -1024,9 +1304,19 @@ type cryptoPure interface {
 	EncryptBlock(block Block, key kbfscrypto.BlockCryptKey) (
 		plainSize int, encryptedBlock EncryptedBlock, err error)
 
-	// DecryptBlock decrypts a block. Similar to EncryptBlock(),
-	// DecryptBlock() must guarantee that (size of the decrypted
-	// block) <= len(encryptedBlock).
+	// EncryptCompressedBlock is like EncryptBlock, except that it
+	// first compresses the encoded block if that makes the
+	// encrypted block smaller.  plainSize is still the size of the
+	// uncompressed encoded block, so the guarantee made by
+	// EncryptBlock() only holds if the block wasn't compressed,
+	// i.e. if its version is EncryptionSecretbox.
+	EncryptCompressedBlock(block Block, key kbfscrypto.BlockCryptKey) (
+		plainSize int, encryptedBlock EncryptedBlock, err error)
+
+	// DecryptBlock decrypts a block, decompressing it if needed.
+	// Similar to EncryptBlock(), DecryptBlock() must guarantee that
+	// (size of the decrypted block) <= len(encryptedBlock) for
+	// uncompressed blocks.
 	DecryptBlock(encryptedBlock EncryptedBlock,
 		key kbfscrypto.BlockCryptKey, block Block) error
 
@@ -1359,6 +1649,26 @@ type MDServer interface {
 	// released.
 	TruncateUnlock(ctx context.Context, id tlf.ID) (bool, error)
 
+	// AcquirePathLock attempts to take the advisory lease identified
+	// by `leaseID` on the given path lock key within this folder,
+	// lasting for `duration`.  If the key is already leased by
+	// another unexpired holder, it returns kbfsmd.ServerErrorLocked.
+	// Acquiring a lease that `leaseID` already holds renews it.  It
+	// returns the time at which the lease will expire.
+	AcquirePathLock(ctx context.Context, id tlf.ID, key PathLockKey,
+		leaseID PathLeaseID, duration time.Duration) (time.Time, error)
+	// RenewPathLock extends the unexpired lease held by `leaseID` on
+	// the given path lock key for another `duration`.  If the lease
+	// has expired or is held by someone else, it returns
+	// kbfsmd.ServerErrorLocked.  It returns the time at which the
+	// lease will expire.
+	RenewPathLock(ctx context.Context, id tlf.ID, key PathLockKey,
+		leaseID PathLeaseID, duration time.Duration) (time.Time, error)
+	// ReleasePathLock releases the lease held by `leaseID` on the
+	// given path lock key, if there is one.
+	ReleasePathLock(ctx context.Context, id tlf.ID, key PathLockKey,
+		leaseID PathLeaseID) error
+
 	// DisableRekeyUpdatesForTesting disables processing rekey updates
 	// received from the mdserver while testing.
 	DisableRekeyUpdatesForTesting()
@@ -1537,6 +1847,18 @@ type BlockSplitter interface {
 	// can fit into one indirect block.
 	MaxPtrsPerBlock() int
 
+	// SplitDirIfNeeded, given a direct DirBlock holding all the
+	// entries of a directory, returns nil if the entries fit into a
+	// single block.  Otherwise, it returns the entries split into a
+	// list of new direct blocks, sorted by name, along with the
+	// offset (i.e., the first name covered) of each new block.  The
+	// first offset is always the empty string.  `prevOffs` contains
+	// the offsets from the previous split of this directory, if any,
+	// and implementations should try to keep those boundaries stable,
+	// so that unchanged blocks can be reused.
+	SplitDirIfNeeded(block *DirBlock, prevOffs []string) (
+		[]*DirBlock, []string, error)
+
 	// ShouldEmbedBlockChanges decides whether we should keep the
 	// block changes embedded in the MD or not.
 	ShouldEmbedBlockChanges(bc *BlockChanges) bool
@@ -1623,6 +1945,19 @@ type ConflictRenamer interface {
 		string, error)
 }
 
+// ConflictMerger decides whether, and how, to merge the contents of
+// a file that was written on both branches of a conflict, instead of
+// renaming one of the copies.
+type ConflictMerger interface {
+	// ShouldMerge returns true if a file with the given name, and
+	// with copies no bigger than `size` bytes, should be merged.
+	ShouldMerge(name string, size uint64) bool
+	// ConflictMerge merges the merged and unmerged contents of a
+	// file, given the contents of their common ancestor.  It
+	// returns false if the two sets of changes can't be combined.
+	ConflictMerge(base, merged, unmerged []byte) ([]byte, bool)
+}
+
 // Tracer maybe adds traces to contexts.
 type Tracer interface {
 	// MaybeStartTrace, if tracing is on, returns a new context
@@ -1651,9 +1986,16 @@ type Config interface {
 	currentSessionGetterGetter
 	diskBlockCacheGetter
 	diskBlockCacheSetter
+	blockDedupIndexGetter
+	blockDedupIndexSetter
+	searchIndexGetter
 	clockGetter
 	diskLimiterGetter
 	syncedTlfGetterSetter
+	blockCompressionGetterSetter
+	conflictResolutionModeGetterSetter
+	diskCacheTlfLimitsGetterSetter
+	bandwidthLimiterGetter
 	Tracer
 	KBFSOps() KBFSOps
 	SetKBFSOps(KBFSOps)
@@ -1694,6 +2036,8 @@ type Config interface {
 	SetClock(Clock)
 	ConflictRenamer() ConflictRenamer
 	SetConflictRenamer(ConflictRenamer)
+	ConflictMerger() ConflictMerger
+	SetConflictMerger(ConflictMerger)
 	MetadataVersion() MetadataVer
 	SetMetadataVersion(MetadataVer)
 	RekeyQueue() RekeyQueue
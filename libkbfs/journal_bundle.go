@@ -0,0 +1,612 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/ioutil"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+const (
+	// journalBundleVersion is the version of the bundle format
+	// written by ExportBundle.
+	journalBundleVersion = 1
+	// journalBundleManifestName is the name of the last entry in a
+	// bundle, which describes the rest of it.
+	journalBundleManifestName = "manifest.json"
+)
+
+// JournalBundleManifest describes the contents of a journal bundle,
+// which holds the unflushed MD and block journals of a single TLF
+// journal, so that they can be carried to, and flushed by, another
+// device of the same user.
+type JournalBundleManifest struct {
+	Version  int
+	BundleID string
+	// UID, VerifyingKey, TlfID and ChargedTo are the same as in the
+	// exported TLF journal's info file.  VerifyingKey is the key of
+	// the exporting device.
+	UID           keybase1.UID
+	VerifyingKey  kbfscrypto.VerifyingKey
+	TlfID         tlf.ID
+	ChargedTo     keybase1.UserOrTeamID
+	RevisionStart kbfsmd.Revision
+	RevisionEnd   kbfsmd.Revision
+	// MDIDs holds the ID of each revision from RevisionStart to
+	// RevisionEnd, in order, as strings since kbfsmd.ID can't be
+	// encoded as JSON.
+	MDIDs []string
+	// Files maps the path of each journal file in the bundle to
+	// the hex-encoded SHA-256 hash of its contents.
+	Files map[string]string
+}
+
+// journalBundleConfig is the tlfJournalConfig for a journal imported
+// from a bundle.  Its revisions were written by another device, so
+// they can't be squashed here.
+type journalBundleConfig struct {
+	tlfJournalConfigAdapter
+}
+
+func (jbc journalBundleConfig) BGFlushDirOpBatchSize() int {
+	// Anything other than 1 keeps the journal from converting its
+	// revisions to a local squash branch.
+	return 0
+}
+
+// getUnflushedMDIDsLocked returns the first revision, and the IDs of
+// all the revisions, in the MD journal, which must not be on a
+// branch.
+func (j *tlfJournal) getUnflushedMDIDsLocked(ctx context.Context) (
+	start kbfsmd.Revision, ids []kbfsmd.ID, err error) {
+	if err := j.checkEnabledLocked(); err != nil {
+		return kbfsmd.RevisionUninitialized, nil, err
+	}
+	if bid := j.mdJournal.getBranchID(); bid != NullBranchID {
+		return kbfsmd.RevisionUninitialized, nil, errors.Errorf(
+			"The journal for %s is on branch %s", j.tlfID, bid)
+	}
+	if j.mdJournal.length() == 0 {
+		return kbfsmd.RevisionUninitialized, nil, nil
+	}
+
+	start, err = j.mdJournal.readEarliestRevision()
+	if err != nil {
+		return kbfsmd.RevisionUninitialized, nil, err
+	}
+	end, err := j.mdJournal.readLatestRevision()
+	if err != nil {
+		return kbfsmd.RevisionUninitialized, nil, err
+	}
+	ibrmds, err := j.mdJournal.getRange(ctx, NullBranchID, start, end)
+	if err != nil {
+		return kbfsmd.RevisionUninitialized, nil, err
+	}
+	ids = make([]kbfsmd.ID, 0, len(ibrmds))
+	for _, ibrmd := range ibrmds {
+		// Before MDv3, the writer metadata is signed once by the
+		// device that wrote it, and the server only accepts it
+		// from that same device.
+		if ibrmd.Version() < SegregatedKeyBundlesVer {
+			return kbfsmd.RevisionUninitialized, nil, errors.Errorf(
+				"Revision %d of %s has metadata version %s, which "+
+					"can only be flushed by the device that wrote it",
+				ibrmd.RevisionNumber(), j.tlfID, ibrmd.Version())
+		}
+		ids = append(ids, ibrmd.mdID)
+	}
+	return start, ids, nil
+}
+
+// exportBundle writes all the journal's files to `w`, followed by a
+// manifest describing them.  It blocks flushes and new journal
+// entries until it's done.
+func (j *tlfJournal) exportBundle(
+	ctx context.Context, bundleID string, w io.Writer) (
+	manifest JournalBundleManifest, err error) {
+	j.flushLock.Lock()
+	defer j.flushLock.Unlock()
+	j.journalLock.RLock()
+	defer j.journalLock.RUnlock()
+
+	start, ids, err := j.getUnflushedMDIDsLocked(ctx)
+	if err != nil {
+		return JournalBundleManifest{}, err
+	}
+	if len(ids) == 0 {
+		return JournalBundleManifest{}, errors.Errorf(
+			"The journal for %s has no unflushed revisions", j.tlfID)
+	}
+
+	manifest = JournalBundleManifest{
+		Version:       journalBundleVersion,
+		BundleID:      bundleID,
+		UID:           j.uid,
+		VerifyingKey:  j.key,
+		TlfID:         j.tlfID,
+		ChargedTo:     j.chargedTo,
+		RevisionStart: start,
+		RevisionEnd:   start + kbfsmd.Revision(len(ids)) - 1,
+		MDIDs:         make([]string, 0, len(ids)),
+		Files:         make(map[string]string),
+	}
+
+	for _, id := range ids {
+		manifest.MDIDs = append(manifest.MDIDs, id.String())
+	}
+
+	tw := tar.NewWriter(w)
+	err = filepath.Walk(j.dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(j.dir, p)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		name := filepath.ToSlash(rel)
+
+		hdr, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		hdr.Name = name
+		err = tw.WriteHeader(hdr)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		f, err := ioutil.OpenFile(p, os.O_RDONLY, 0)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		h := sha256.New()
+		_, err = io.Copy(io.MultiWriter(tw, h), f)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		manifest.Files[name] = hex.EncodeToString(h.Sum(nil))
+		return nil
+	})
+	if err != nil {
+		return JournalBundleManifest{}, err
+	}
+
+	buf, err := json.Marshal(manifest)
+	if err != nil {
+		return JournalBundleManifest{}, errors.WithStack(err)
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Name:     journalBundleManifestName,
+		Mode:     0600,
+		Size:     int64(len(buf)),
+		Typeflag: tar.TypeReg,
+	})
+	if err != nil {
+		return JournalBundleManifest{}, errors.WithStack(err)
+	}
+	_, err = tw.Write(buf)
+	if err != nil {
+		return JournalBundleManifest{}, errors.WithStack(err)
+	}
+	err = tw.Close()
+	if err != nil {
+		return JournalBundleManifest{}, errors.WithStack(err)
+	}
+	return manifest, nil
+}
+
+// ExportBundle writes the unflushed MD and block journals of the
+// given TLF to a new bundle file at `bundlePath`, which must not
+// exist yet.  The journal entries are already signed and encrypted,
+// so the bundle can be carried to another device of the same user
+// and flushed there with ImportBundle.
+//
+// The journal's background work is left paused afterwards, so that
+// this device doesn't race the importing one.  Resuming it is safe
+// though: revisions that were already flushed from the bundle are
+// recognized by their MD IDs, both when checking the server for
+// conflicts and when flushing them, and skipped.
+func (j *JournalServer) ExportBundle(
+	ctx context.Context, tlfID tlf.ID, bundlePath string) (err error) {
+	j.log.CDebugf(ctx, "Exporting journal for %s to %s", tlfID, bundlePath)
+	defer func() {
+		if err != nil {
+			j.deferLog.CDebugf(ctx,
+				"Error when exporting journal for %s: %+v", tlfID, err)
+		}
+	}()
+
+	tlfJournal, ok := j.getTLFJournal(tlfID, nil)
+	if !ok {
+		return errors.Errorf("Journal not enabled for %s", tlfID)
+	}
+	bundleID, err := MakeRandomRequestID()
+	if err != nil {
+		return err
+	}
+
+	tlfJournal.pauseBackgroundWork()
+
+	f, err := ioutil.OpenFile(
+		bundlePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	exportSucceeded := false
+	defer func() {
+		if !exportSucceeded {
+			_ = f.Close()
+			_ = ioutil.Remove(bundlePath)
+		}
+	}()
+
+	manifest, err := tlfJournal.exportBundle(ctx, bundleID, f)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = f.Close()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	exportSucceeded = true
+
+	j.log.CDebugf(ctx, "Exported bundle %s with revisions %d-%d of %s; "+
+		"leaving the journal paused", manifest.BundleID,
+		manifest.RevisionStart, manifest.RevisionEnd, tlfID)
+	return nil
+}
+
+// isValidBundleEntryName returns whether `name` is a relative path
+// that stays within the directory a bundle is extracted into.
+func isValidBundleEntryName(name string) bool {
+	if name == "" || strings.ContainsAny(name, "\\:") {
+		return false
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == "" || part == "." || part == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// extractJournalBundle extracts all the journal files in the bundle
+// read from `r` into `dir`, and checks them against the bundle's
+// manifest.
+func extractJournalBundle(r io.Reader, dir string) (
+	manifest JournalBundleManifest, err error) {
+	tr := tar.NewReader(r)
+	hashes := make(map[string]string)
+	gotManifest := false
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return JournalBundleManifest{}, errors.WithStack(err)
+		}
+		if gotManifest {
+			return JournalBundleManifest{}, errors.Errorf(
+				"Unexpected bundle entry %q after the manifest", hdr.Name)
+		}
+
+		if hdr.Name == journalBundleManifestName {
+			err := json.NewDecoder(tr).Decode(&manifest)
+			if err != nil {
+				return JournalBundleManifest{}, errors.Wrap(
+					err, "Couldn't decode the bundle manifest")
+			}
+			gotManifest = true
+			continue
+		}
+
+		if hdr.Typeflag != tar.TypeReg || !isValidBundleEntryName(hdr.Name) {
+			return JournalBundleManifest{}, errors.Errorf(
+				"Invalid bundle entry %q", hdr.Name)
+		}
+		if _, ok := hashes[hdr.Name]; ok {
+			return JournalBundleManifest{}, errors.Errorf(
+				"Duplicate bundle entry %q", hdr.Name)
+		}
+		p := filepath.Join(dir, filepath.FromSlash(hdr.Name))
+		err = ioutil.MkdirAll(filepath.Dir(p), 0700)
+		if err != nil {
+			return JournalBundleManifest{}, err
+		}
+		hash, err := func() (string, error) {
+			f, err := ioutil.OpenFile(
+				p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+			if err != nil {
+				return "", err
+			}
+			defer f.Close()
+			h := sha256.New()
+			_, err = io.Copy(io.MultiWriter(f, h), tr)
+			if err != nil {
+				return "", errors.WithStack(err)
+			}
+			return hex.EncodeToString(h.Sum(nil)), nil
+		}()
+		if err != nil {
+			return JournalBundleManifest{}, err
+		}
+		hashes[hdr.Name] = hash
+	}
+
+	if !gotManifest {
+		return JournalBundleManifest{}, errors.New(
+			"The bundle has no manifest")
+	}
+	if manifest.Version != journalBundleVersion {
+		return JournalBundleManifest{}, errors.Errorf(
+			"Unsupported bundle version %d", manifest.Version)
+	}
+	if manifest.RevisionEnd-manifest.RevisionStart+1 !=
+		kbfsmd.Revision(len(manifest.MDIDs)) {
+		return JournalBundleManifest{}, errors.Errorf(
+			"The bundle has %d MD IDs for revisions %d-%d",
+			len(manifest.MDIDs), manifest.RevisionStart,
+			manifest.RevisionEnd)
+	}
+	if len(hashes) != len(manifest.Files) {
+		return JournalBundleManifest{}, errors.Errorf(
+			"The bundle has %d files, but its manifest lists %d",
+			len(hashes), len(manifest.Files))
+	}
+	for name, hash := range manifest.Files {
+		if hashes[name] != hash {
+			return JournalBundleManifest{}, errors.Errorf(
+				"Bundle entry %q doesn't match its hash in the manifest",
+				name)
+		}
+	}
+	return manifest, nil
+}
+
+// checkBundleAgainstServer compares the bundle's revisions with the
+// ones already on the server.  It returns the number of revisions
+// from the bundle that were already flushed.
+func (j *JournalServer) checkBundleAgainstServer(
+	ctx context.Context, manifest JournalBundleManifest) (int, error) {
+	mdServer := j.config.MDServer()
+	head, err := mdServer.GetForTLF(
+		ctx, manifest.TlfID, NullBranchID, Merged)
+	if err != nil {
+		return 0, err
+	}
+	headRev := kbfsmd.RevisionUninitialized
+	if head != nil {
+		headRev = head.MD.RevisionNumber()
+	}
+	if headRev+1 < manifest.RevisionStart {
+		return 0, errors.Errorf(
+			"The bundle starts at revision %d of %s, but the server "+
+				"only has revisions up to %d",
+			manifest.RevisionStart, manifest.TlfID, headRev)
+	}
+
+	flushed := 0
+	for rev := manifest.RevisionStart; rev <= headRev &&
+		rev <= manifest.RevisionEnd; rev++ {
+		mdID, err := getMdID(ctx, mdServer, j.config.Codec(),
+			manifest.TlfID, NullBranchID, Merged, rev)
+		if err != nil {
+			return 0, err
+		}
+		if mdID.String() != manifest.MDIDs[rev-manifest.RevisionStart] {
+			return 0, JournalBundleConflictError{manifest.TlfID}
+		}
+		flushed++
+	}
+	return flushed, nil
+}
+
+func (j *JournalServer) recordImportedBundle(bundleID string) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.serverConfig.ImportedBundleIDs = append(
+		j.serverConfig.ImportedBundleIDs, bundleID)
+	return j.writeConfig()
+}
+
+// ImportBundle flushes the journal entries in the bundle at
+// `bundlePath`, which must have been written for the given TLF by
+// ExportBundle on another device of the current user.  The bundle's
+// contents are checked against its manifest, and its MDs are checked
+// against their signatures, before anything is flushed.  A bundle
+// can only be imported once, and it isn't flushed at all if the
+// server already has any conflicting revisions.
+func (j *JournalServer) ImportBundle(
+	ctx context.Context, tlfID tlf.ID, bundlePath string) (err error) {
+	j.log.CDebugf(ctx, "Importing journal bundle %s", bundlePath)
+	defer func() {
+		if err != nil {
+			j.deferLog.CDebugf(ctx,
+				"Error when importing journal bundle %s: %+v",
+				bundlePath, err)
+		}
+	}()
+
+	j.importLock.Lock()
+	defer j.importLock.Unlock()
+
+	currentUID, currentVerifyingKey, imported := func() (
+		keybase1.UID, kbfscrypto.VerifyingKey, map[string]bool) {
+		j.lock.RLock()
+		defer j.lock.RUnlock()
+		imported := make(map[string]bool)
+		for _, id := range j.serverConfig.ImportedBundleIDs {
+			imported[id] = true
+		}
+		return j.currentUID, j.currentVerifyingKey, imported
+	}()
+	if currentUID == keybase1.UID("") {
+		return errors.New("Current UID is empty")
+	}
+
+	// Extract the bundle outside of the root path, so that
+	// EnableExistingJournals never picks it up.
+	err = ioutil.MkdirAll(j.dir, 0700)
+	if err != nil {
+		return err
+	}
+	stagingDir, err := ioutil.TempDir(j.dir, "import_bundle")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		removeErr := ioutil.RemoveAll(stagingDir)
+		if removeErr != nil {
+			j.log.CWarningf(ctx, "Couldn't remove %s: %+v",
+				stagingDir, removeErr)
+		}
+	}()
+
+	manifest, err := func() (JournalBundleManifest, error) {
+		f, err := ioutil.OpenFile(bundlePath, os.O_RDONLY, 0)
+		if err != nil {
+			return JournalBundleManifest{}, err
+		}
+		defer f.Close()
+		return extractJournalBundle(f, stagingDir)
+	}()
+	if err != nil {
+		return err
+	}
+	if manifest.TlfID != tlfID {
+		return errors.Errorf("The bundle is for %s, not %s",
+			manifest.TlfID, tlfID)
+	}
+	if manifest.UID != currentUID {
+		return errors.Errorf("The bundle was exported by user %s, not %s",
+			manifest.UID, currentUID)
+	}
+	if manifest.VerifyingKey == currentVerifyingKey {
+		return errors.Errorf("The bundle was exported by this device; "+
+			"resume the journal for %s instead", tlfID)
+	}
+	if imported[manifest.BundleID] {
+		return JournalBundleAlreadyImportedError{manifest.BundleID}
+	}
+	if tj, ok := j.getTLFJournal(tlfID, nil); ok {
+		_, mdEntryCount, err := tj.getJournalEntryCounts()
+		if err != nil {
+			return err
+		}
+		if mdEntryCount > 0 {
+			return errors.Errorf("Can't import a bundle for %s while "+
+				"its local journal has unflushed revisions", tlfID)
+		}
+	}
+
+	flushed, err := j.checkBundleAgainstServer(ctx, manifest)
+	if err != nil {
+		return err
+	}
+	if flushed == len(manifest.MDIDs) {
+		err := j.recordImportedBundle(manifest.BundleID)
+		if err != nil {
+			return err
+		}
+		return JournalBundleAlreadyFlushedError{
+			tlfID, manifest.RevisionStart, manifest.RevisionEnd}
+	}
+
+	// The journal has to act as the exporting device, to be able
+	// to verify the MDs it wrote.  Flushed MDs are re-signed by
+	// this device.
+	tj, err := makeTLFJournal(
+		ctx, manifest.UID, manifest.VerifyingKey, stagingDir, tlfID,
+		manifest.ChargedTo,
+		journalBundleConfig{tlfJournalConfigAdapter{j.config}},
+		j.delegateBlockServer, TLFJournalBackgroundWorkPaused, nil, nil,
+		nil, j.config.DiskLimiter())
+	if err != nil {
+		return err
+	}
+	defer tj.shutdown(ctx)
+
+	start, ids, err := func() (kbfsmd.Revision, []kbfsmd.ID, error) {
+		tj.journalLock.RLock()
+		defer tj.journalLock.RUnlock()
+		return tj.getUnflushedMDIDsLocked(ctx)
+	}()
+	if err != nil {
+		return err
+	}
+	if start != manifest.RevisionStart || len(ids) != len(manifest.MDIDs) {
+		return errors.Errorf("The bundle's MD journal doesn't match " +
+			"its manifest")
+	}
+	for i, id := range ids {
+		if id.String() != manifest.MDIDs[i] {
+			return errors.Errorf("The bundle's MD journal doesn't "+
+				"match its manifest at revision %d", start+kbfsmd.Revision(i))
+		}
+	}
+
+	func() {
+		// Revisions that the exporting device flushed itself are
+		// skipped during the flush, so there's no need to check
+		// the server again before the first revision is flushed.
+		tj.flushLock.Lock()
+		defer tj.flushLock.Unlock()
+		tj.lastServerMDCheck = j.config.Clock().Now()
+	}()
+	err = tj.flush(ctx)
+	if err != nil {
+		return err
+	}
+	isConflict, err := tj.isOnConflictBranch()
+	if err != nil {
+		return err
+	} else if isConflict {
+		// Someone else wrote to the TLF while the bundle was being
+		// flushed.
+		return JournalBundleConflictError{tlfID}
+	}
+	blockEntryCount, mdEntryCount, err := tj.getJournalEntryCounts()
+	if err != nil {
+		return err
+	}
+	if blockEntryCount > 0 || mdEntryCount > 0 {
+		// The flush was canceled.
+		return errors.Errorf("Flushing the bundle for %s stopped with "+
+			"%d block entries and %d MD entries left: %v", tlfID,
+			blockEntryCount, mdEntryCount, ctx.Err())
+	}
+
+	err = j.recordImportedBundle(manifest.BundleID)
+	if err != nil {
+		return err
+	}
+	j.log.CDebugf(ctx, "Imported and flushed bundle %s with revisions "+
+		"%d-%d of %s", manifest.BundleID, manifest.RevisionStart,
+		manifest.RevisionEnd, tlfID)
+	return nil
+}
@@ -0,0 +1,133 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/ioutil"
+	"github.com/keybase/kbfs/kbfsblock"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJournalBundleExportImport(t *testing.T) {
+	tempdir, ctx, cancel, config, _, jServer := setupJournalServerTest(t)
+	defer teardownJournalServerTest(t, tempdir, ctx, cancel, config)
+
+	session, err := config.KBPKI().GetCurrentSession(ctx)
+	require.NoError(t, err)
+
+	// Give the user a second device, with its own journal.  The
+	// configs don't share a Keybase Daemon so we have to add the
+	// device in both places.
+	config2 := ConfigAsUser(config, "test_user1")
+	defer CheckConfigAndShutdown(ctx, t, config2)
+	AddDeviceForLocalUserOrBust(t, config, session.UID)
+	devIndex := AddDeviceForLocalUserOrBust(t, config2, session.UID)
+	SwitchDeviceForLocalUserOrBust(t, config2, devIndex)
+	tempdir2 := filepath.Join(tempdir, "dev2")
+	err = config2.EnableDiskLimiter(tempdir2)
+	require.NoError(t, err)
+	err = config2.EnableJournaling(
+		ctx, tempdir2, TLFJournalBackgroundWorkEnabled)
+	require.NoError(t, err)
+	jServer2, err := GetJournalServer(config2)
+	require.NoError(t, err)
+
+	tlfID := tlf.FakeID(2, tlf.Private)
+	err = jServer.Enable(ctx, tlfID, nil, TLFJournalBackgroundWorkPaused)
+	require.NoError(t, err)
+
+	h, err := ParseTlfHandle(ctx, config.KBPKI(), "test_user1", tlf.Private)
+	require.NoError(t, err)
+	id := h.ResolvedWriters()[0]
+
+	// Put an MD into the first device's journal, after more blocks
+	// than are flushed in one batch, so that the server gets checked
+	// for conflicts before the MD is flushed.
+
+	bCtx := kbfsblock.MakeFirstContext(id, keybase1.BlockType_DATA)
+	var data []byte
+	var bID kbfsblock.ID
+	var serverHalf kbfscrypto.BlockCryptKeyServerHalf
+	for i := 0; i <= maxJournalBlockFlushBatchSize; i++ {
+		data = []byte{1, 2, 3, byte(i)}
+		bID, err = kbfsblock.MakePermanentID(data)
+		require.NoError(t, err)
+		serverHalf, err = kbfscrypto.MakeRandomBlockCryptKeyServerHalf()
+		require.NoError(t, err)
+		err = config.BlockServer().Put(
+			ctx, tlfID, bID, bCtx, data, serverHalf)
+		require.NoError(t, err)
+	}
+
+	rmd, err := makeInitialRootMetadata(config.MetadataVersion(), tlfID, h)
+	require.NoError(t, err)
+	rekeyDone, _, err := config.KeyManager().Rekey(ctx, rmd, false)
+	require.NoError(t, err)
+	require.True(t, rekeyDone)
+	_, err = config.MDOps().Put(ctx, rmd, session.VerifyingKey)
+	require.NoError(t, err)
+
+	bundlePath := filepath.Join(tempdir, "bundle")
+	err = jServer.ExportBundle(ctx, tlfID, bundlePath)
+	require.NoError(t, err)
+
+	t.Log("An existing file isn't overwritten")
+	err = jServer.ExportBundle(ctx, tlfID, bundlePath)
+	require.Error(t, err)
+
+	t.Log("A corrupted bundle can't be imported")
+	buf, err := ioutil.ReadFile(bundlePath)
+	require.NoError(t, err)
+	// Flip a byte in the contents of the first file.
+	buf[512] ^= 0xff
+	corruptPath := filepath.Join(tempdir, "corrupt")
+	err = ioutil.WriteFile(corruptPath, buf, 0600)
+	require.NoError(t, err)
+	err = jServer2.ImportBundle(ctx, tlfID, corruptPath)
+	require.Error(t, err)
+
+	t.Log("The exporting device can't import its own bundle")
+	err = jServer.ImportBundle(ctx, tlfID, bundlePath)
+	require.Error(t, err)
+
+	err = jServer2.ImportBundle(ctx, tlfID, bundlePath)
+	require.NoError(t, err)
+
+	head, err := config2.MDServer().GetForTLF(ctx, tlfID, NullBranchID, Merged)
+	require.NoError(t, err)
+	require.NotNil(t, head)
+	require.Equal(t, rmd.Revision(), head.MD.RevisionNumber())
+	gotData, gotServerHalf, err := jServer2.delegateBlockServer.Get(
+		ctx, tlfID, bID, bCtx)
+	require.NoError(t, err)
+	require.Equal(t, data, gotData)
+	require.Equal(t, serverHalf, gotServerHalf)
+
+	t.Log("The same bundle can't be imported twice")
+	err = jServer2.ImportBundle(ctx, tlfID, bundlePath)
+	require.IsType(t, JournalBundleAlreadyImportedError{}, errors.Cause(err))
+
+	t.Log("Even if the record is lost, nothing is flushed twice")
+	jServer2.serverConfig.ImportedBundleIDs = nil
+	err = jServer2.ImportBundle(ctx, tlfID, bundlePath)
+	require.IsType(t, JournalBundleAlreadyFlushedError{}, errors.Cause(err))
+
+	t.Log("The exporting device skips the flushed revisions")
+	jServer.ResumeBackgroundWork(ctx, tlfID)
+	err = jServer.Wait(ctx, tlfID)
+	require.NoError(t, err)
+	status, err := jServer.JournalStatus(tlfID)
+	require.NoError(t, err)
+	require.Equal(t, kbfsmd.RevisionUninitialized, status.RevisionStart)
+	require.Equal(t, NullBranchID.String(), status.BranchID)
+}
@@ -32,6 +32,10 @@ type journalServerConfig struct {
 	// EnableAutoSetByUser means the user has explicitly set the
 	// value of EnableAuto (after this field was added).
 	EnableAutoSetByUser bool
+
+	// ImportedBundleIDs lists the journal bundles that were already
+	// imported, so they're never flushed twice.
+	ImportedBundleIDs []string `json:",omitempty"`
 }
 
 func (jsc journalServerConfig) getEnableAuto(currentUID keybase1.UID) (
@@ -131,6 +135,9 @@ type JournalServer struct {
 	lastDiskLimitErrorLock sync.Mutex
 	lastDiskLimitError     time.Time
 
+	// Serializes journal bundle imports.
+	importLock sync.Mutex
+
 	// Protects all fields below.
 	lock                sync.RWMutex
 	currentUID          keybase1.UID
@@ -5,6 +5,7 @@
 package libkbfs
 
 import (
+	"fmt"
 	"os"
 	"sync"
 	"testing"
@@ -14,6 +15,7 @@ import (
 	"github.com/keybase/kbfs/ioutil"
 	"github.com/keybase/kbfs/kbfsmd"
 	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/net/context"
@@ -139,7 +141,7 @@ func testMultipleMDUpdates(t *testing.T, unembedChanges bool) {
 	rootNode2 := GetRootNodeOrBust(ctx, t, config2, name, tlf.Private)
 
 	// now user 1 renames the old file, and creates a new one
-	err = kbfsOps1.Rename(ctx, rootNode1, "a", rootNode1, "b")
+	err = kbfsOps1.Rename(ctx, rootNode1, "a", rootNode1, "b", RenameReplace)
 	require.NoError(t, err)
 	_, _, err = kbfsOps1.CreateFile(ctx, rootNode1, "c", false, NoExcl)
 	require.NoError(t, err)
@@ -559,6 +561,104 @@ func TestBasicCRNoConflictWithUnembeddedBlockChanges(t *testing.T) {
 	testBasicCRNoConflict(t, true)
 }
 
+// Tests that two users adding entries to a directory made up of
+// indirect blocks can be resolved without a conflict.
+func TestBasicCRNoConflictLargeDirectory(t *testing.T) {
+	// simulate two users
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx, cancel := kbfsOpsConcurInit(t, userName1, userName2)
+	defer kbfsConcurTestShutdown(t, config1, ctx, cancel)
+
+	config2 := ConfigAsUser(config1, userName2)
+	defer CheckConfigAndShutdown(ctx, t, config2)
+
+	bss1, ok1 := config1.BlockSplitter().(*BlockSplitterSimple)
+	require.True(t, ok1)
+	bss2, ok2 := config2.BlockSplitter().(*BlockSplitterSimple)
+	require.True(t, ok2)
+	bss1.maxDirEntriesPerBlock = 4
+	bss2.maxDirEntriesPerBlock = 4
+
+	name := userName1.String() + "," + userName2.String()
+
+	// user1 creates a large directory in a shared dir
+	rootNode1 := GetRootNodeOrBust(ctx, t, config1, name, tlf.Private)
+
+	kbfsOps1 := config1.KBFSOps()
+	dirNode1, _, err := kbfsOps1.CreateDir(ctx, rootNode1, "a")
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		_, _, err = kbfsOps1.CreateFile(
+			ctx, dirNode1, fmt.Sprintf("f%02d", i), false, NoExcl)
+		require.NoError(t, err)
+	}
+	err = kbfsOps1.SyncAll(ctx, rootNode1.GetFolderBranch())
+	require.NoError(t, err)
+
+	// look it up on user2
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, name, tlf.Private)
+
+	kbfsOps2 := config2.KBFSOps()
+	dirNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+
+	// disable updates on user 2
+	c, err := DisableUpdatesForTesting(config2, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	err = DisableCRForTesting(config2, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+
+	// User 1 makes new files and removes an old one
+	for i := 10; i < 15; i++ {
+		_, _, err = kbfsOps1.CreateFile(
+			ctx, dirNode1, fmt.Sprintf("f%02d", i), false, NoExcl)
+		require.NoError(t, err)
+	}
+	err = kbfsOps1.RemoveEntry(ctx, dirNode1, "f00")
+	require.NoError(t, err)
+	err = kbfsOps1.SyncAll(ctx, rootNode1.GetFolderBranch())
+	require.NoError(t, err)
+
+	// User 2 makes different new files
+	for i := 0; i < 5; i++ {
+		_, _, err = kbfsOps2.CreateFile(
+			ctx, dirNode2, fmt.Sprintf("f%02da", i), false, NoExcl)
+		require.NoError(t, err)
+	}
+	err = kbfsOps2.SyncAll(ctx, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+
+	// re-enable updates, and wait for CR to complete
+	c <- struct{}{}
+	err = RestartCRForTesting(
+		BackgroundContextWithCancellationDelayer(), config2,
+		rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	err = kbfsOps2.SyncFromServerForTesting(ctx, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+
+	err = kbfsOps1.SyncFromServerForTesting(ctx, rootNode1.GetFolderBranch())
+	require.NoError(t, err)
+
+	// Make sure they both see the same set of children
+	children1, err := kbfsOps1.GetDirChildren(ctx, dirNode1)
+	require.NoError(t, err)
+	children2, err := kbfsOps2.GetDirChildren(ctx, dirNode2)
+	require.NoError(t, err)
+	require.Len(t, children1, 19)
+	require.Equal(t, children1, children2)
+	_, ok := children1["f00"]
+	require.False(t, ok)
+	for i := 1; i < 15; i++ {
+		_, ok := children1[fmt.Sprintf("f%02d", i)]
+		require.True(t, ok)
+	}
+	for i := 0; i < 5; i++ {
+		_, ok := children1[fmt.Sprintf("f%02da", i)]
+		require.True(t, ok)
+	}
+}
+
 type registerForUpdateRecord struct {
 	id       tlf.ID
 	currHead kbfsmd.Revision
@@ -717,6 +817,8 @@ func TestBasicCRFileConflict(t *testing.T) {
 	require.NoError(t, err)
 	err = kbfsOps1.SyncAll(ctx, fileB1.GetFolderBranch())
 	require.NoError(t, err)
+	status1, _, err := kbfsOps1.FolderStatus(ctx, fileB1.GetFolderBranch())
+	require.NoError(t, err)
 
 	// User 2 makes a new different file
 	data2 := []byte{5, 4, 3, 2, 1}
@@ -757,6 +859,558 @@ func TestBasicCRFileConflict(t *testing.T) {
 	}
 
 	require.Equal(t, children1, children2)
+
+	// User 2 should have a record of the rename.
+	status2, _, err := kbfsOps2.FolderStatus(ctx, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	require.Len(t, status2.Conflicts, 1)
+	record := status2.Conflicts[0]
+	require.Equal(t, ConflictRenamedUnmerged, record.Action)
+	require.Equal(t, "/keybase/private/u1,u2/a/b", record.Path)
+	require.Equal(t, "/keybase/private/u1,u2/a/"+expectedChildren[1],
+		record.NewPath)
+	require.Equal(t, userName1, record.MergedWriter)
+	require.Equal(t, status1.Revision, record.MergedRevision)
+	require.Equal(t, userName2, record.UnmergedWriter)
+	require.Equal(t, status2.Revision, record.ResolvedRevision)
+	require.Equal(t, kbfsmd.Revision(3), record.UnmergedRevision)
+	require.Equal(t, now, record.Time)
+}
+
+// testCRManualResolution has two users write different versions of
+// a file while user 2 has manual conflict resolution turned on, and
+// checks that user 2's changes are set aside and browsable until
+// they are resolved in the given way, in `numRevs` new merged
+// revisions.  User 1 writes `data1` and user 2 writes `data2`; if
+// `bsplit` is non-nil, both users split their files with it.  It
+// returns the children of the parent directory, and the contents of
+// the file, as seen by both users after resolution.
+func testCRManualResolution(t *testing.T, resolution UnmergedResolution,
+	numRevs kbfsmd.Revision, data1, data2 []byte, bsplit BlockSplitter) (
+	children1, children2 map[string]EntryInfo, read1, read2 []byte) {
+	// simulate two users
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx, cancel := kbfsOpsConcurInit(t, userName1, userName2)
+	defer kbfsConcurTestShutdown(t, config1, ctx, cancel)
+
+	config2 := ConfigAsUser(config1, userName2)
+	defer CheckConfigAndShutdown(ctx, t, config2)
+	config2.SetClock(newTestClockNow())
+	if bsplit != nil {
+		config1.SetBlockSplitter(bsplit)
+		config2.SetBlockSplitter(bsplit)
+	}
+
+	name := userName1.String() + "," + userName2.String()
+
+	// user1 creates a file in a shared dir
+	rootNode1 := GetRootNodeOrBust(ctx, t, config1, name, tlf.Private)
+
+	kbfsOps1 := config1.KBFSOps()
+	dirA1, _, err := kbfsOps1.CreateDir(ctx, rootNode1, "a")
+	require.NoError(t, err)
+	fileB1, _, err := kbfsOps1.CreateFile(ctx, dirA1, "b", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps1.SyncAll(ctx, rootNode1.GetFolderBranch())
+	require.NoError(t, err)
+
+	// look it up on user2
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, name, tlf.Private)
+	err = config2.SetManualConflictResolution(
+		rootNode2.GetFolderBranch().Tlf, true)
+	require.NoError(t, err)
+
+	kbfsOps2 := config2.KBFSOps()
+	dirA2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	fileB2, _, err := kbfsOps2.Lookup(ctx, dirA2, "b")
+	require.NoError(t, err)
+
+	// disable updates on user 2
+	c, err := DisableUpdatesForTesting(config2, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	err = DisableCRForTesting(config2, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+
+	// User 1 writes the file
+	err = kbfsOps1.Write(ctx, fileB1, data1, 0)
+	require.NoError(t, err)
+	err = kbfsOps1.SyncAll(ctx, fileB1.GetFolderBranch())
+	require.NoError(t, err)
+
+	// User 2 writes a different version
+	err = kbfsOps2.Write(ctx, fileB2, data2, 0)
+	require.NoError(t, err)
+	err = kbfsOps2.SyncAll(ctx, fileB2.GetFolderBranch())
+	require.NoError(t, err)
+
+	// re-enable updates, and wait for CR to set the branch aside
+	c <- struct{}{}
+	err = RestartCRForTesting(
+		BackgroundContextWithCancellationDelayer(), config2,
+		rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	err = kbfsOps2.SyncFromServerForTesting(ctx, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+
+	status2, _, err := kbfsOps2.FolderStatus(ctx, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	require.True(t, status2.ManualConflictResolution)
+	require.NotEqual(t, "", status2.ParkedBranchID)
+	require.False(t, status2.Staged)
+
+	// The main view shows user 1's version.
+	buf := make([]byte, len(data1))
+	_, err = kbfsOps2.Read(ctx, fileB2, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, data1, buf)
+
+	// The unmerged view shows user 2's version, read-only.
+	h, err := ParseTlfHandle(ctx, config2.KBPKI(), name, tlf.Private)
+	require.NoError(t, err)
+	unmergedRoot, _, err := kbfsOps2.GetUnmergedRootNode(ctx, h)
+	require.NoError(t, err)
+	bid, _, ok := unmergedRoot.GetFolderBranch().Branch.
+		UnmergedRevisionIfSpecified()
+	require.True(t, ok)
+	require.Equal(t, status2.ParkedBranchID, bid.String())
+	unmergedA, _, err := kbfsOps2.Lookup(ctx, unmergedRoot, "a")
+	require.NoError(t, err)
+	unmergedB, _, err := kbfsOps2.Lookup(ctx, unmergedA, "b")
+	require.NoError(t, err)
+	buf = make([]byte, len(data2))
+	_, err = kbfsOps2.Read(ctx, unmergedB, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, data2, buf)
+	err = kbfsOps2.Write(ctx, unmergedB, data1, 0)
+	require.IsType(t, WriteToReadonlyNodeError{}, errors.Cause(err))
+
+	// Writes to the main view are blocked until resolution.
+	_, _, err = kbfsOps2.CreateFile(ctx, dirA2, "c", false, NoExcl)
+	require.IsType(t, UnmergedChangesPendingError{}, errors.Cause(err))
+
+	lState := makeFBOLockState()
+	ops1 := getOps(config1, rootNode1.GetFolderBranch().Tlf)
+	mergedRev := ops1.getCurrMDRevision(lState)
+	err = kbfsOps2.ResolveUnmerged(
+		ctx, rootNode2.GetFolderBranch(), resolution)
+	require.NoError(t, err)
+	err = kbfsOps2.ResolveUnmerged(
+		ctx, rootNode2.GetFolderBranch(), resolution)
+	require.IsType(t, NoUnmergedChangesError{}, errors.Cause(err))
+	err = kbfsOps2.SyncFromServerForTesting(ctx, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	err = kbfsOps1.SyncFromServerForTesting(ctx, rootNode1.GetFolderBranch())
+	require.NoError(t, err)
+
+	status2, _, err = kbfsOps2.FolderStatus(ctx, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	require.Equal(t, "", status2.ParkedBranchID)
+	require.Equal(t, mergedRev+numRevs, ops1.getCurrMDRevision(lState))
+
+	children1, err = kbfsOps1.GetDirChildren(ctx, dirA1)
+	require.NoError(t, err)
+	children2, err = kbfsOps2.GetDirChildren(ctx, dirA2)
+	require.NoError(t, err)
+
+	fileB1, _, err = kbfsOps1.Lookup(ctx, dirA1, "b")
+	require.NoError(t, err)
+	readLen := len(data1)
+	if len(data2) > readLen {
+		readLen = len(data2)
+	}
+	read1 = make([]byte, readLen)
+	n, err := kbfsOps1.Read(ctx, fileB1, read1, 0)
+	require.NoError(t, err)
+	read1 = read1[:n]
+	fileB2, _, err = kbfsOps2.Lookup(ctx, dirA2, "b")
+	require.NoError(t, err)
+	read2 = make([]byte, readLen)
+	n, err = kbfsOps2.Read(ctx, fileB2, read2, 0)
+	require.NoError(t, err)
+	read2 = read2[:n]
+	return children1, children2, read1, read2
+}
+
+func TestCRManualResolutionAutomatic(t *testing.T) {
+	children1, children2, read1, read2 :=
+		testCRManualResolution(t, ResolveAutomatically, 1,
+			[]byte{1, 2, 3, 4, 5}, []byte{5, 4, 3, 2, 1}, nil)
+	require.Len(t, children1, 2)
+	require.Equal(t, children1, children2)
+	require.Equal(t, []byte{1, 2, 3, 4, 5}, read1)
+	require.Equal(t, read1, read2)
+}
+
+func TestCRManualResolutionAcceptLocal(t *testing.T) {
+	children1, children2, read1, read2 :=
+		testCRManualResolution(t, ResolveAcceptLocal, 1,
+			[]byte{1, 2, 3, 4, 5}, []byte{5, 4, 3, 2, 1}, nil)
+	require.Len(t, children1, 1)
+	require.Equal(t, children1, children2)
+	require.Equal(t, []byte{5, 4, 3, 2, 1}, read1)
+	require.Equal(t, read1, read2)
+}
+
+// Test that accepting local changes works for files that span
+// multiple blocks in both branches.
+func TestCRManualResolutionAcceptLocalMultiBlock(t *testing.T) {
+	// Make the blocks small, with multiple levels of indirection.
+	bsplit := &BlockSplitterSimple{5, 2, 100 * 1024, 0}
+	var data1, data2 []byte
+	for i := 0; i < 30; i++ {
+		data1 = append(data1, byte(i))
+		data2 = append(data2, byte(100-i))
+	}
+	data2 = append(data2, data2[:12]...)
+	children1, children2, read1, read2 :=
+		testCRManualResolution(t, ResolveAcceptLocal, 1, data1, data2, bsplit)
+	require.Len(t, children1, 1)
+	require.Equal(t, children1, children2)
+	require.Equal(t, data2, read1)
+	require.Equal(t, read1, read2)
+}
+
+func TestCRManualResolutionAcceptRemote(t *testing.T) {
+	// The one revision unreferences the blocks of the discarded
+	// branch.
+	children1, children2, read1, read2 :=
+		testCRManualResolution(t, ResolveAcceptRemote, 1,
+			[]byte{1, 2, 3, 4, 5}, []byte{5, 4, 3, 2, 1}, nil)
+	require.Len(t, children1, 1)
+	require.Equal(t, children1, children2)
+	require.Equal(t, []byte{1, 2, 3, 4, 5}, read1)
+	require.Equal(t, read1, read2)
+}
+
+// testCRFileMerge has two users write different versions of a text
+// file that the ConflictMerger is configured to merge, and returns
+// the children of the parent directory, and the contents of the
+// file, as seen by both users after resolution.
+func testCRFileMerge(t *testing.T, base, data1, data2 string) (
+	children1, children2 map[string]EntryInfo, read1, read2 []byte) {
+	// simulate two users
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx, cancel := kbfsOpsConcurInit(t, userName1, userName2)
+	defer kbfsConcurTestShutdown(t, config1, ctx, cancel)
+
+	config2 := ConfigAsUser(config1, userName2)
+	defer CheckConfigAndShutdown(ctx, t, config2)
+	config2.SetConflictMerger(TextConflictMerger{
+		Patterns: []string{"*.txt"},
+		MaxSize:  defaultConflictMergeMaxSize,
+	})
+
+	name := userName1.String() + "," + userName2.String()
+
+	// user1 creates a text file in a shared dir
+	rootNode1 := GetRootNodeOrBust(ctx, t, config1, name, tlf.Private)
+
+	kbfsOps1 := config1.KBFSOps()
+	dirA1, _, err := kbfsOps1.CreateDir(ctx, rootNode1, "a")
+	require.NoError(t, err)
+	fileB1, _, err := kbfsOps1.CreateFile(ctx, dirA1, "b.txt", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps1.Write(ctx, fileB1, []byte(base), 0)
+	require.NoError(t, err)
+	err = kbfsOps1.SyncAll(ctx, rootNode1.GetFolderBranch())
+	require.NoError(t, err)
+
+	// look it up on user2
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, name, tlf.Private)
+
+	kbfsOps2 := config2.KBFSOps()
+	dirA2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	fileB2, _, err := kbfsOps2.Lookup(ctx, dirA2, "b.txt")
+	require.NoError(t, err)
+
+	// disable updates on user 2
+	c, err := DisableUpdatesForTesting(config2, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	err = DisableCRForTesting(config2, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+
+	t.Log("Both users rewrite the file")
+	err = kbfsOps1.Truncate(ctx, fileB1, 0)
+	require.NoError(t, err)
+	err = kbfsOps1.Write(ctx, fileB1, []byte(data1), 0)
+	require.NoError(t, err)
+	err = kbfsOps1.SyncAll(ctx, fileB1.GetFolderBranch())
+	require.NoError(t, err)
+
+	err = kbfsOps2.Truncate(ctx, fileB2, 0)
+	require.NoError(t, err)
+	err = kbfsOps2.Write(ctx, fileB2, []byte(data2), 0)
+	require.NoError(t, err)
+	err = kbfsOps2.SyncAll(ctx, fileB2.GetFolderBranch())
+	require.NoError(t, err)
+
+	// re-enable updates, and wait for CR to complete
+	c <- struct{}{}
+	err = RestartCRForTesting(
+		BackgroundContextWithCancellationDelayer(), config2,
+		rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	err = kbfsOps2.SyncFromServerForTesting(ctx, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+
+	err = kbfsOps1.SyncFromServerForTesting(ctx, rootNode1.GetFolderBranch())
+	require.NoError(t, err)
+
+	children1, err = kbfsOps1.GetDirChildren(ctx, dirA1)
+	require.NoError(t, err)
+	children2, err = kbfsOps2.GetDirChildren(ctx, dirA2)
+	require.NoError(t, err)
+
+	read := func(kbfsOps KBFSOps, dir Node, size uint64) []byte {
+		file, _, err := kbfsOps.Lookup(ctx, dir, "b.txt")
+		require.NoError(t, err)
+		buf := make([]byte, size)
+		n, err := kbfsOps.Read(ctx, file, buf, 0)
+		require.NoError(t, err)
+		return buf[:n]
+	}
+	read1 = read(kbfsOps1, dirA1, children1["b.txt"].Size)
+	read2 = read(kbfsOps2, dirA2, children2["b.txt"].Size)
+	if len(children2) == 1 {
+		// A merge keeps the same node for the file.
+		fileB2New, _, err := kbfsOps2.Lookup(ctx, dirA2, "b.txt")
+		require.NoError(t, err)
+		require.Equal(t, fileB2.GetID(), fileB2New.GetID())
+	}
+	return children1, children2, read1, read2
+}
+
+// Tests that non-overlapping writes to a mergeable text file get
+// merged during conflict resolution, rather than renamed.
+func TestBasicCRFileMerge(t *testing.T) {
+	base := "one\ntwo\nthree\nfour\nfive\n"
+	data1 := "one\ntwo\nthree\nfour\nfive, six\n"
+	data2 := "zero\none\ntwo\nthree\nfour\nfive\n"
+	children1, children2, read1, read2 := testCRFileMerge(
+		t, base, data1, data2)
+
+	require.Len(t, children1, 1)
+	require.Equal(t, children1, children2)
+
+	expected := "zero\none\ntwo\nthree\nfour\nfive, six\n"
+	require.Equal(t, expected, string(read1))
+	require.Equal(t, expected, string(read2))
+}
+
+// Tests that overlapping writes to a mergeable text file fall back to
+// renaming the unmerged copy.
+func TestBasicCRFileMergeOverlap(t *testing.T) {
+	base := "one\ntwo\nthree\n"
+	data1 := "one\n2\nthree\n"
+	data2 := "one\nTWO\nthree\n"
+	children1, children2, read1, read2 := testCRFileMerge(
+		t, base, data1, data2)
+
+	require.Len(t, children1, 2)
+	require.Equal(t, children1, children2)
+	require.Equal(t, data1, string(read1))
+	require.Equal(t, data1, string(read2))
+}
+
+// Tests that extended attributes set on an unmerged branch survive
+// conflict resolution, without causing a conflict rename.
+func TestBasicCRXattrs(t *testing.T) {
+	// simulate two users
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx, cancel := kbfsOpsConcurInit(t, userName1, userName2)
+	defer kbfsConcurTestShutdown(t, config1, ctx, cancel)
+
+	config2 := ConfigAsUser(config1, userName2)
+	defer CheckConfigAndShutdown(ctx, t, config2)
+
+	name := userName1.String() + "," + userName2.String()
+
+	// user1 creates a file in a shared dir
+	rootNode1 := GetRootNodeOrBust(ctx, t, config1, name, tlf.Private)
+
+	kbfsOps1 := config1.KBFSOps()
+	dirA1, _, err := kbfsOps1.CreateDir(ctx, rootNode1, "a")
+	require.NoError(t, err)
+	fileB1, _, err := kbfsOps1.CreateFile(ctx, dirA1, "b", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps1.SyncAll(ctx, rootNode1.GetFolderBranch())
+	require.NoError(t, err)
+
+	// look it up on user2
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, name, tlf.Private)
+
+	kbfsOps2 := config2.KBFSOps()
+	dirA2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	fileB2, _, err := kbfsOps2.Lookup(ctx, dirA2, "b")
+	require.NoError(t, err)
+
+	// disable updates on user 2
+	c, err := DisableUpdatesForTesting(config2, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	err = DisableCRForTesting(config2, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+
+	// User 1 writes the file and tags it
+	data1 := []byte{1, 2, 3, 4, 5}
+	err = kbfsOps1.Write(ctx, fileB1, data1, 0)
+	require.NoError(t, err)
+	err = kbfsOps1.SetXattr(ctx, fileB1, "user.u1", []byte("1"), XattrSet)
+	require.NoError(t, err)
+	err = kbfsOps1.SyncAll(ctx, fileB1.GetFolderBranch())
+	require.NoError(t, err)
+
+	// User 2 tags the file and the directory
+	err = kbfsOps2.SetXattr(ctx, fileB2, "user.u2", []byte("2"), XattrSet)
+	require.NoError(t, err)
+	err = kbfsOps2.SetXattr(ctx, dirA2, "user.u2", []byte("2"), XattrSet)
+	require.NoError(t, err)
+	err = kbfsOps2.SyncAll(ctx, fileB2.GetFolderBranch())
+	require.NoError(t, err)
+
+	// re-enable updates, and wait for CR to complete
+	c <- struct{}{}
+	err = RestartCRForTesting(
+		BackgroundContextWithCancellationDelayer(), config2,
+		rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	err = kbfsOps2.SyncFromServerForTesting(ctx, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+
+	err = kbfsOps1.SyncFromServerForTesting(ctx, rootNode1.GetFolderBranch())
+	require.NoError(t, err)
+
+	// There should be no conflict copies, the unmerged attributes
+	// should win, and the merged write should be intact.
+	for _, kbfsOps := range []KBFSOps{kbfsOps1, kbfsOps2} {
+		rootNode := rootNode1
+		if kbfsOps == kbfsOps2 {
+			rootNode = rootNode2
+		}
+		dirA, _, err := kbfsOps.Lookup(ctx, rootNode, "a")
+		require.NoError(t, err)
+		children, err := kbfsOps.GetDirChildren(ctx, dirA)
+		require.NoError(t, err)
+		require.Len(t, children, 1)
+		fileB, _, err := kbfsOps.Lookup(ctx, dirA, "b")
+		require.NoError(t, err)
+
+		names, err := kbfsOps.ListXattrs(ctx, fileB)
+		require.NoError(t, err)
+		require.Equal(t, []string{"user.u2"}, names)
+		names, err = kbfsOps.ListXattrs(ctx, dirA)
+		require.NoError(t, err)
+		require.Equal(t, []string{"user.u2"}, names)
+
+		buf := make([]byte, len(data1))
+		_, err = kbfsOps.Read(ctx, fileB, buf, 0)
+		require.NoError(t, err)
+		require.Equal(t, data1, buf)
+	}
+}
+
+// Tests that an unmerged exchange of a file and a directory is
+// resolved against merged changes to both of them, which follow the
+// entries to their new names.
+func TestBasicCRExchange(t *testing.T) {
+	// simulate two users
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx, cancel := kbfsOpsConcurInit(t, userName1, userName2)
+	defer kbfsConcurTestShutdown(t, config1, ctx, cancel)
+
+	config2 := ConfigAsUser(config1, userName2)
+	defer CheckConfigAndShutdown(ctx, t, config2)
+
+	name := userName1.String() + "," + userName2.String()
+
+	// user1 creates a file and a directory in a shared dir
+	rootNode1 := GetRootNodeOrBust(ctx, t, config1, name, tlf.Private)
+
+	kbfsOps1 := config1.KBFSOps()
+	dirA1, _, err := kbfsOps1.CreateDir(ctx, rootNode1, "a")
+	require.NoError(t, err)
+	fileB1, _, err := kbfsOps1.CreateFile(ctx, dirA1, "b", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps1.Write(ctx, fileB1, []byte("b"), 0)
+	require.NoError(t, err)
+	dirC1, _, err := kbfsOps1.CreateDir(ctx, rootNode1, "c")
+	require.NoError(t, err)
+	err = kbfsOps1.SyncAll(ctx, rootNode1.GetFolderBranch())
+	require.NoError(t, err)
+
+	// look it up on user2
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, name, tlf.Private)
+
+	kbfsOps2 := config2.KBFSOps()
+	dirA2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+
+	// disable updates on user 2
+	c, err := DisableUpdatesForTesting(config2, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	err = DisableCRForTesting(config2, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+
+	// User 1 writes to the file, and creates a file in the directory.
+	data1 := []byte("merged")
+	err = kbfsOps1.Write(ctx, fileB1, data1, 0)
+	require.NoError(t, err)
+	_, _, err = kbfsOps1.CreateFile(ctx, dirC1, "d", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps1.SyncAll(ctx, fileB1.GetFolderBranch())
+	require.NoError(t, err)
+
+	// User 2 exchanges them.
+	err = kbfsOps2.Rename(ctx, dirA2, "b", rootNode2, "c", RenameExchange)
+	require.NoError(t, err)
+	err = kbfsOps2.SyncAll(ctx, dirA2.GetFolderBranch())
+	require.NoError(t, err)
+
+	// re-enable updates, and wait for CR to complete
+	c <- struct{}{}
+	err = RestartCRForTesting(
+		BackgroundContextWithCancellationDelayer(), config2,
+		rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	err = kbfsOps2.SyncFromServerForTesting(ctx, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+
+	err = kbfsOps1.SyncFromServerForTesting(ctx, rootNode1.GetFolderBranch())
+	require.NoError(t, err)
+
+	// There should be no conflict copies, and the merged changes
+	// should show up under the new names.
+	for _, kbfsOps := range []KBFSOps{kbfsOps1, kbfsOps2} {
+		rootNode := rootNode1
+		if kbfsOps == kbfsOps2 {
+			rootNode = rootNode2
+		}
+		children, err := kbfsOps.GetDirChildren(ctx, rootNode)
+		require.NoError(t, err)
+		require.Len(t, children, 2)
+		require.Equal(t, File, children["c"].Type)
+		fileC, _, err := kbfsOps.Lookup(ctx, rootNode, "c")
+		require.NoError(t, err)
+		buf := make([]byte, len(data1)+1)
+		n, err := kbfsOps.Read(ctx, fileC, buf, 0)
+		require.NoError(t, err)
+		require.Equal(t, data1, buf[:n])
+
+		dirA, _, err := kbfsOps.Lookup(ctx, rootNode, "a")
+		require.NoError(t, err)
+		dirB, _, err := kbfsOps.Lookup(ctx, dirA, "b")
+		require.NoError(t, err)
+		children, err = kbfsOps.GetDirChildren(ctx, dirB)
+		require.NoError(t, err)
+		require.Len(t, children, 1)
+		require.Contains(t, children, "d")
+	}
+
+	// User 1's existing nodes moved along with the entries.
+	require.Equal(t, "c", fileB1.GetBasename())
+	require.Equal(t, "b", dirC1.GetBasename())
 }
 
 // Tests that two users can create the same file simultaneously, and
@@ -1276,7 +1930,7 @@ func TestCRSyncParallelBlocksErrorCleanup(t *testing.T) {
 	// make the unembedded size large, so we don't create thousands of
 	// unembedded block change blocks.
 	blockSize := int64(5)
-	bsplit := &BlockSplitterSimple{blockSize, 2, 100 * 1024}
+	bsplit := &BlockSplitterSimple{blockSize, 2, 100 * 1024, 0}
 	config1.SetBlockSplitter(bsplit)
 
 	// create and write to a file
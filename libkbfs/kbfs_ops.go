@@ -34,6 +34,8 @@ type KBFSOpsStandard struct {
 	// Closing this channel will shutdown the reidentification
 	// watcher.
 	reIdentifyControlChan chan chan<- struct{}
+	// Closed on shutdown, to stop evicting idle archived fbos.
+	shutdownChan chan struct{}
 
 	favs *Favorites
 
@@ -53,11 +55,13 @@ func NewKBFSOpsStandard(config Config) *KBFSOpsStandard {
 		ops:                   make(map[FolderBranch]*folderBranchOps),
 		opsByFav:              make(map[Favorite]*folderBranchOps),
 		reIdentifyControlChan: make(chan chan<- struct{}),
+		shutdownChan:          make(chan struct{}),
 		favs:       NewFavorites(config),
 		quotaUsage: NewEventuallyConsistentQuotaUsage(config, "KBFSOps"),
 	}
 	kops.currentStatus.Init()
 	go kops.markForReIdentifyIfNeededLoop()
+	go kops.evictIdleArchivedOpsLoop()
 	return kops
 }
 
@@ -103,10 +107,54 @@ func (fs *KBFSOpsStandard) markForReIdentifyIfNeeded(
 	}
 }
 
+func (fs *KBFSOpsStandard) evictIdleArchivedOpsLoop() {
+	ticker := time.NewTicker(archivedFBOIdleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			fs.evictIdleArchivedOps(
+				context.Background(), fs.config.Clock().Now())
+		case <-fs.shutdownChan:
+			return
+		}
+	}
+}
+
+// evictIdleArchivedOps shuts down and forgets every archived fbo that
+// has no live nodes and hasn't been used recently.  A new one is made
+// the next time that archived view is requested.
+func (fs *KBFSOpsStandard) evictIdleArchivedOps(
+	ctx context.Context, now time.Time) {
+	var idle []*folderBranchOps
+	func() {
+		fs.opsLock.Lock()
+		defer fs.opsLock.Unlock()
+		for fb, ops := range fs.ops {
+			if !fb.Branch.IsArchived() ||
+				!ops.isIdleArchive(now, archivedFBOIdleTimeout) {
+				continue
+			}
+			delete(fs.ops, fb)
+			idle = append(idle, ops)
+		}
+	}()
+
+	for _, ops := range idle {
+		fs.log.CDebugf(ctx, "Shutting down idle archived folder-branch %s",
+			ops.folderBranch)
+		if err := ops.Shutdown(ctx); err != nil {
+			fs.log.CDebugf(ctx, "Couldn't shut down %s: %+v",
+				ops.folderBranch, err)
+		}
+	}
+}
+
 // Shutdown safely shuts down any background goroutines that may have
 // been launched by KBFSOpsStandard.
 func (fs *KBFSOpsStandard) Shutdown(ctx context.Context) error {
 	close(fs.reIdentifyControlChan)
+	close(fs.shutdownChan)
 	var errors []error
 	if err := fs.favs.Shutdown(); err != nil {
 		errors = append(errors, err)
@@ -249,8 +297,17 @@ func (fs *KBFSOpsStandard) getOpsNoAdd(
 	ops, ok := fs.ops[fb]
 	if !ok {
 		// TODO: add some interface for specifying the type of the
-		// branch; for now assume online and read-write.
-		ops = newFolderBranchOps(ctx, fs.config, fb, standard)
+		// branch; for now assume online, and read-write unless the
+		// branch name pins it to an archived revision.
+		bType := standard
+		if fb.Branch.IsArchived() {
+			bType = archive
+		}
+		ops = newFolderBranchOps(ctx, fs.config, fb, bType)
+		if bType == archive {
+			// Don't let it be evicted before its first use.
+			ops.updateLastGetHeadTimestamp()
+		}
 		fs.ops[fb] = ops
 	}
 	return ops
@@ -527,6 +584,123 @@ func (fs *KBFSOpsStandard) GetRootNode(
 	return fs.getMaybeCreateRootNode(ctx, h, branch, false)
 }
 
+// GetArchivedRootNode implements the KBFSOps interface for
+// KBFSOpsStandard.
+func (fs *KBFSOpsStandard) GetArchivedRootNode(
+	ctx context.Context, h *TlfHandle, rev kbfsmd.Revision) (
+	node Node, ei EntryInfo, err error) {
+	fs.log.CDebugf(ctx, "GetArchivedRootNode(%s, %d)",
+		h.GetCanonicalPath(), rev)
+	defer func() { fs.deferLog.CDebugf(ctx, "Done: %+v", err) }()
+
+	id, head, err := fs.config.MDOps().GetForHandle(ctx, h, Merged)
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+	if head == (ImmutableRootMetadata{}) || rev < kbfsmd.RevisionInitial ||
+		rev > head.Revision() {
+		return nil, EntryInfo{}, NoSuchRevisionError{id, rev}
+	}
+
+	md := head
+	if rev != head.Revision() {
+		md, err = getSingleMD(
+			ctx, fs.config, id, NullBranchID, rev, Merged)
+		if err != nil {
+			return nil, EntryInfo{}, err
+		}
+	}
+
+	if err := isReadableOrError(
+		ctx, fs.config.KBPKI(), md.ReadOnly()); err != nil {
+		return nil, EntryInfo{}, err
+	}
+
+	// Archived views are never added to the favorites list, and
+	// aren't indexed by favorite, so that they don't get confused
+	// with the live version of the TLF.
+	fb := FolderBranch{Tlf: id, Branch: MakeRevBranchName(rev)}
+	ops := fs.getOpsNoAdd(ctx, fb)
+
+	err = ops.SetInitialHeadFromServer(ctx, md)
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+
+	node, ei, _, err = ops.getRootNode(ctx)
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+	return node, ei, nil
+}
+
+// GetUnmergedRootNode implements the KBFSOps interface for
+// KBFSOpsStandard.
+func (fs *KBFSOpsStandard) GetUnmergedRootNode(
+	ctx context.Context, h *TlfHandle) (
+	node Node, ei EntryInfo, err error) {
+	fs.log.CDebugf(ctx, "GetUnmergedRootNode(%s)", h.GetCanonicalPath())
+	defer func() { fs.deferLog.CDebugf(ctx, "Done: %+v", err) }()
+
+	rmd, err := fs.getMDByHandle(ctx, h, FavoritesOpNoChange)
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+	id := rmd.TlfID()
+
+	master := fs.getOpsNoAdd(ctx, FolderBranch{Tlf: id, Branch: MasterBranch})
+	bid := master.getParkedBranchID(makeFBOLockState())
+	if bid == NullBranchID {
+		return nil, EntryInfo{}, NoUnmergedChangesError{id}
+	}
+	md, err := fs.config.MDOps().GetUnmergedForTLF(ctx, id, bid)
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+	if md == (ImmutableRootMetadata{}) {
+		return nil, EntryInfo{}, NoUnmergedChangesError{id}
+	}
+
+	// Like archived views, the unmerged view is pinned to a single
+	// revision, so it gets a new folder-branch whenever the unmerged
+	// branch changes.
+	fb := FolderBranch{
+		Tlf:    id,
+		Branch: MakeUnmergedRevBranchName(bid, md.Revision()),
+	}
+	ops := fs.getOpsNoAdd(ctx, fb)
+
+	err = ops.SetInitialHeadFromServer(ctx, md)
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+
+	node, ei, _, err = ops.getRootNode(ctx)
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+	return node, ei, nil
+}
+
+// GetRevisionForTime implements the KBFSOps interface for
+// KBFSOpsStandard.
+func (fs *KBFSOpsStandard) GetRevisionForTime(
+	ctx context.Context, h *TlfHandle, t time.Time) (
+	rev kbfsmd.Revision, err error) {
+	fs.log.CDebugf(ctx, "GetRevisionForTime(%s, %s)",
+		h.GetCanonicalPath(), t)
+	defer func() { fs.deferLog.CDebugf(ctx, "Done: %d %+v", rev, err) }()
+
+	id, head, err := fs.config.MDOps().GetForHandle(ctx, h, Merged)
+	if err != nil {
+		return kbfsmd.RevisionUninitialized, err
+	}
+	if head == (ImmutableRootMetadata{}) {
+		return kbfsmd.RevisionUninitialized, NoRevisionAtTimeError{id, t}
+	}
+	return getMergedRevisionForTime(ctx, fs.config, head, t)
+}
+
 // GetDirChildren implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) GetDirChildren(ctx context.Context, dir Node) (
 	map[string]EntryInfo, error) {
@@ -588,7 +762,7 @@ func (fs *KBFSOpsStandard) RemoveEntry(
 // Rename implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) Rename(
 	ctx context.Context, oldParent Node, oldName string, newParent Node,
-	newName string) error {
+	newName string, mode RenameMode) error {
 	oldFB := oldParent.GetFolderBranch()
 	newFB := newParent.GetFolderBranch()
 
@@ -598,7 +772,122 @@ func (fs *KBFSOpsStandard) Rename(
 	}
 
 	ops := fs.getOpsByNode(ctx, oldParent)
-	return ops.Rename(ctx, oldParent, oldName, newParent, newName)
+	return ops.Rename(ctx, oldParent, oldName, newParent, newName, mode)
+}
+
+// CopyFile implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) CopyFile(
+	ctx context.Context, file Node, dir Node, name string) (
+	Node, EntryInfo, error) {
+	// only works for nodes within the same topdir
+	if file.GetFolderBranch() != dir.GetFolderBranch() {
+		return nil, EntryInfo{}, CopyAcrossFoldersError{}
+	}
+
+	ops := fs.getOpsByNode(ctx, dir)
+	return ops.CopyFile(ctx, file, dir, name)
+}
+
+// CopyDir implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) CopyDir(
+	ctx context.Context, src Node, dir Node, name string) (
+	Node, EntryInfo, error) {
+	// only works for nodes within the same topdir
+	if src.GetFolderBranch() != dir.GetFolderBranch() {
+		return nil, EntryInfo{}, CopyAcrossFoldersError{}
+	}
+
+	ops := fs.getOpsByNode(ctx, dir)
+	return ops.CopyDir(ctx, src, dir, name)
+}
+
+// GetDeletedEntries implements the KBFSOps interface for
+// KBFSOpsStandard
+func (fs *KBFSOpsStandard) GetDeletedEntries(
+	ctx context.Context, folderBranch FolderBranch) ([]DeletedEntry, error) {
+	ops := fs.getOps(ctx, folderBranch, FavoritesOpNoChange)
+	return ops.GetDeletedEntries(ctx, folderBranch)
+}
+
+// SetTrashRetention implements the KBFSOps interface for
+// KBFSOpsStandard
+func (fs *KBFSOpsStandard) SetTrashRetention(ctx context.Context,
+	folderBranch FolderBranch, retention time.Duration) error {
+	ops := fs.getOps(ctx, folderBranch, FavoritesOpNoChange)
+	return ops.SetTrashRetention(ctx, folderBranch, retention)
+}
+
+// RestoreDeletedEntry implements the KBFSOps interface for
+// KBFSOpsStandard
+func (fs *KBFSOpsStandard) RestoreDeletedEntry(
+	ctx context.Context, entry DeletedEntry, dir Node, name string) (
+	Node, EntryInfo, error) {
+	// only works for entries within the same topdir
+	if entry.tlfID != dir.GetFolderBranch().Tlf {
+		return nil, EntryInfo{}, CopyAcrossFoldersError{}
+	}
+
+	ops := fs.getOpsByNode(ctx, dir)
+	return ops.RestoreDeletedEntry(ctx, entry, dir, name)
+}
+
+// GetFileVersions implements the KBFSOps interface for
+// KBFSOpsStandard.
+func (fs *KBFSOpsStandard) GetFileVersions(
+	ctx context.Context, file Node) ([]FileVersion, error) {
+	ops := fs.getOpsByNode(ctx, file)
+	return ops.GetFileVersions(ctx, file)
+}
+
+// RestoreFileVersion implements the KBFSOps interface for
+// KBFSOpsStandard.
+func (fs *KBFSOpsStandard) RestoreFileVersion(
+	ctx context.Context, file Node, version FileVersion) error {
+	if version.tlfID != file.GetFolderBranch().Tlf {
+		return CopyAcrossFoldersError{}
+	}
+
+	ops := fs.getOpsByNode(ctx, file)
+	return ops.RestoreFileVersion(ctx, file, version)
+}
+
+// GetPathChanges implements the KBFSOps interface for
+// KBFSOpsStandard.
+func (fs *KBFSOpsStandard) GetPathChanges(
+	ctx context.Context, folderBranch FolderBranch, since kbfsmd.Revision) (
+	[]PathChange, kbfsmd.Revision, error) {
+	ops := fs.getOps(ctx, folderBranch, FavoritesOpNoChange)
+	return ops.GetPathChanges(ctx, folderBranch, since)
+}
+
+// GetDiskUsage implements the KBFSOps interface for KBFSOpsStandard.
+func (fs *KBFSOpsStandard) GetDiskUsage(
+	ctx context.Context, dir Node) (DirDiskUsage, error) {
+	ops := fs.getOpsByNode(ctx, dir)
+	return ops.GetDiskUsage(ctx, dir)
+}
+
+// PinPath implements the KBFSOps interface for KBFSOpsStandard.
+func (fs *KBFSOpsStandard) PinPath(
+	ctx context.Context, folderBranch FolderBranch, p string) error {
+	ops := fs.getOps(ctx, folderBranch, FavoritesOpNoChange)
+	return ops.PinPath(ctx, folderBranch, p)
+}
+
+// UnpinPath implements the KBFSOps interface for KBFSOpsStandard.
+func (fs *KBFSOpsStandard) UnpinPath(
+	ctx context.Context, folderBranch FolderBranch, p string) error {
+	ops := fs.getOps(ctx, folderBranch, FavoritesOpNoChange)
+	return ops.UnpinPath(ctx, folderBranch, p)
+}
+
+// GetFileDataExtents implements the KBFSOps interface for
+// KBFSOpsStandard
+func (fs *KBFSOpsStandard) GetFileDataExtents(
+	ctx context.Context, file Node, off int64, maxExtents int) (
+	[]FileExtent, error) {
+	ops := fs.getOpsByNode(ctx, file)
+	return ops.GetFileDataExtents(ctx, file, off, maxExtents)
 }
 
 // Read implements the KBFSOps interface for KBFSOpsStandard
@@ -623,6 +912,13 @@ func (fs *KBFSOpsStandard) Truncate(
 	return ops.Truncate(ctx, file, size)
 }
 
+// PunchHole implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) PunchHole(
+	ctx context.Context, file Node, off, length int64) error {
+	ops := fs.getOpsByNode(ctx, file)
+	return ops.PunchHole(ctx, file, off, length)
+}
+
 // SetEx implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) SetEx(
 	ctx context.Context, file Node, ex bool) error {
@@ -637,6 +933,49 @@ func (fs *KBFSOpsStandard) SetMtime(
 	return ops.SetMtime(ctx, file, mtime)
 }
 
+// GetXattr implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) GetXattr(
+	ctx context.Context, node Node, name string) ([]byte, error) {
+	ops := fs.getOpsByNode(ctx, node)
+	return ops.GetXattr(ctx, node, name)
+}
+
+// ListXattrs implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) ListXattrs(
+	ctx context.Context, node Node) ([]string, error) {
+	ops := fs.getOpsByNode(ctx, node)
+	return ops.ListXattrs(ctx, node)
+}
+
+// SetXattr implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) SetXattr(
+	ctx context.Context, node Node, name string, value []byte,
+	flag XattrFlag) error {
+	ops := fs.getOpsByNode(ctx, node)
+	return ops.SetXattr(ctx, node, name, value, flag)
+}
+
+// RemoveXattr implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) RemoveXattr(
+	ctx context.Context, node Node, name string) error {
+	ops := fs.getOpsByNode(ctx, node)
+	return ops.RemoveXattr(ctx, node, name)
+}
+
+// LockPath implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) LockPath(
+	ctx context.Context, node Node, owner PathLockOwner) error {
+	ops := fs.getOpsByNode(ctx, node)
+	return ops.LockPath(ctx, node, owner)
+}
+
+// UnlockPath implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) UnlockPath(
+	ctx context.Context, node Node, owner PathLockOwner) error {
+	ops := fs.getOpsByNode(ctx, node)
+	return ops.UnlockPath(ctx, node, owner)
+}
+
 // SyncAll implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) SyncAll(
 	ctx context.Context, folderBranch FolderBranch) error {
@@ -696,6 +1035,13 @@ func (fs *KBFSOpsStandard) Status(ctx context.Context) (
 		dbcStatus = dbc.Status(ctx)
 	}
 
+	var bwStatus *BandwidthLimiterStatus
+	if bl := fs.config.BandwidthLimiter(); bl != nil &&
+		bl.Limits().IsLimited() {
+		status := bl.Status()
+		bwStatus = &status
+	}
+
 	return KBFSStatus{
 		CurrentUser:     session.Name.String(),
 		IsConnected:     fs.config.MDServer().IsConnected(),
@@ -704,9 +1050,17 @@ func (fs *KBFSOpsStandard) Status(ctx context.Context) (
 		FailingServices: failures,
 		JournalServer:   jServerStatus,
 		DiskCacheStatus: dbcStatus,
+		Bandwidth:       bwStatus,
 	}, ch, err
 }
 
+// ResolveUnmerged implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) ResolveUnmerged(ctx context.Context,
+	folderBranch FolderBranch, resolution UnmergedResolution) error {
+	ops := fs.getOps(ctx, folderBranch, FavoritesOpNoChange)
+	return ops.ResolveUnmerged(ctx, folderBranch, resolution)
+}
+
 // UnstageForTesting implements the KBFSOps interface for KBFSOpsStandard
 // TODO: remove once we have automatic conflict resolution
 func (fs *KBFSOpsStandard) UnstageForTesting(
@@ -760,7 +1114,7 @@ func (fs *KBFSOpsStandard) TeamNameChanged(
 	// We have to search for the tid since we don't know the old name
 	// of the team here.  Should we add an index for this?
 	for fb, fbo := range fs.ops {
-		if fb.Tlf.Type() != tlf.SingleTeam {
+		if fb.Tlf.Type() != tlf.SingleTeam || fb.Branch != MasterBranch {
 			continue
 		}
 
@@ -8,6 +8,8 @@ import (
 	"bytes"
 	"fmt"
 	"math/rand"
+	"os"
+	"reflect"
 	"testing"
 	"time"
 
@@ -15,6 +17,7 @@ import (
 	"github.com/keybase/client/go/libkb"
 	"github.com/keybase/client/go/protocol/keybase1"
 	"github.com/keybase/go-codec/codec"
+	"github.com/keybase/kbfs/ioutil"
 	"github.com/keybase/kbfs/kbfsblock"
 	"github.com/keybase/kbfs/kbfscodec"
 	"github.com/keybase/kbfs/kbfscrypto"
@@ -22,6 +25,7 @@ import (
 	"github.com/keybase/kbfs/kbfsmd"
 	"github.com/keybase/kbfs/tlf"
 	"github.com/pkg/errors"
+	metrics "github.com/rcrowley/go-metrics"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/net/context"
@@ -724,7 +728,7 @@ func TestKBFSOpsGetBaseDirChildrenHidesFiles(t *testing.T) {
 	for c, ei := range children {
 		if de, ok := dirBlock.Children[c]; !ok {
 			t.Errorf("No such child: %s", c)
-		} else if de.EntryInfo != ei {
+		} else if !reflect.DeepEqual(de.EntryInfo, ei) {
 			t.Errorf("Wrong EntryInfo for child %s: %v", c, ei)
 		}
 	}
@@ -757,7 +761,7 @@ func TestKBFSOpsGetBaseDirChildrenCacheSuccess(t *testing.T) {
 	for c, ei := range children {
 		if de, ok := dirBlock.Children[c]; !ok {
 			t.Errorf("No such child: %s", c)
-		} else if de.EntryInfo != ei {
+		} else if !reflect.DeepEqual(de.EntryInfo, ei) {
 			t.Errorf("Wrong EntryInfo for child %s: %v", c, ei)
 		}
 	}
@@ -889,7 +893,7 @@ func TestKBFSOpsGetNestedDirChildrenCacheSuccess(t *testing.T) {
 	for c, ei := range children {
 		if de, ok := dirBlock.Children[c]; !ok {
 			t.Errorf("No such child: %s", c)
-		} else if de.EntryInfo != ei {
+		} else if !reflect.DeepEqual(de.EntryInfo, ei) {
 			t.Errorf("Wrong EntryInfo for child %s: %v", c, ei)
 		}
 	}
@@ -931,7 +935,7 @@ func TestKBFSOpsLookupSuccess(t *testing.T) {
 	bPath := ops.nodeCache.PathFromNode(bn)
 	expectedBNode := pathNode{makeBP(bID, rmd, config, u), "b"}
 	expectedBNode.KeyGen = 1
-	if ei != dirBlock.Children["b"].EntryInfo {
+	if !reflect.DeepEqual(ei, dirBlock.Children["b"].EntryInfo) {
 		t.Errorf("Lookup returned a bad entry info: %v vs %v",
 			ei, dirBlock.Children["b"].EntryInfo)
 	} else if bPath.path[2] != expectedBNode {
@@ -972,7 +976,7 @@ func TestKBFSOpsLookupSymlinkSuccess(t *testing.T) {
 	if err != nil {
 		t.Errorf("Error on Lookup: %+v", err)
 	}
-	if ei != dirBlock.Children["b"].EntryInfo {
+	if !reflect.DeepEqual(ei, dirBlock.Children["b"].EntryInfo) {
 		t.Errorf("Lookup returned a bad directory entry: %v vs %v",
 			ei, dirBlock.Children["b"].EntryInfo)
 	} else if bn != nil {
@@ -1093,7 +1097,7 @@ func TestKBFSOpsStatSuccess(t *testing.T) {
 	if err != nil {
 		t.Errorf("Error on Stat: %+v", err)
 	}
-	if ei != dirBlock.Children["b"].EntryInfo {
+	if !reflect.DeepEqual(ei, dirBlock.Children["b"].EntryInfo) {
 		t.Errorf("Stat returned a bad entry info: %v vs %v",
 			ei, dirBlock.Children["b"].EntryInfo)
 	}
@@ -1562,7 +1566,7 @@ func TestRenameFailAcrossTopLevelFolders(t *testing.T) {
 
 	expectedErr := RenameAcrossDirsError{}
 
-	if err := config.KBFSOps().Rename(ctx, n1, "b", n2, "c"); err == nil {
+	if err := config.KBFSOps().Rename(ctx, n1, "b", n2, "c", RenameReplace); err == nil {
 		t.Errorf("Got no expected error on rename")
 	} else if err.Error() != expectedErr.Error() {
 		t.Errorf("Got unexpected error on rename: %+v", err)
@@ -1592,7 +1596,7 @@ func TestRenameFailAcrossBranches(t *testing.T) {
 	n2 := nodeFromPath(t, ops2, p2)
 
 	expectedErr := RenameAcrossDirsError{}
-	if err := config.KBFSOps().Rename(ctx, n1, "b", n2, "c"); err == nil {
+	if err := config.KBFSOps().Rename(ctx, n1, "b", n2, "c", RenameReplace); err == nil {
 		t.Errorf("Got no expected error on rename")
 	} else if err.Error() != expectedErr.Error() {
 		t.Errorf("Got unexpected error on rename: %+v", err)
@@ -3046,7 +3050,7 @@ func TestKBFSOpsWriteRenameStat(t *testing.T) {
 	}
 
 	// Rename it.
-	err = kbfsOps.Rename(ctx, rootNode, "a", rootNode, "b")
+	err = kbfsOps.Rename(ctx, rootNode, "a", rootNode, "b", RenameReplace)
 	if err != nil {
 		t.Fatalf("Couldn't rename; %+v", err)
 	}
@@ -3094,7 +3098,7 @@ func TestKBFSOpsWriteRenameGetDirChildren(t *testing.T) {
 	}
 
 	// Rename it.
-	err = kbfsOps.Rename(ctx, rootNode, "a", rootNode, "b")
+	err = kbfsOps.Rename(ctx, rootNode, "a", rootNode, "b", RenameReplace)
 	if err != nil {
 		t.Fatalf("Couldn't rename; %+v", err)
 	}
@@ -3154,7 +3158,7 @@ func TestKBFSOpsMultiBlockSyncWithArchivedBlock(t *testing.T) {
 	// make the unembedded size large, so we don't create thousands of
 	// unembedded block change blocks.
 	blockSize := int64(5)
-	bsplit := &BlockSplitterSimple{blockSize, 2, 100 * 1024}
+	bsplit := &BlockSplitterSimple{blockSize, 2, 100 * 1024, 0}
 	config.SetBlockSplitter(bsplit)
 
 	// create a file.
@@ -3561,3 +3565,1343 @@ func TestKBFSOpsBasicTeamTLF(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, u1, ei.LastWriterUnverified)
 }
+
+func TestKBFSOpsArchivedRootNode(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "alice")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	t.Log("Write the first version of a file.")
+	rootNode := GetRootNodeOrBust(ctx, t, config, "alice", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	nodeA, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	data1 := []byte{1, 2, 3}
+	err = kbfsOps.Write(ctx, nodeA, data1, 0)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	rev1 := ops.getCurrMDRevision(lState)
+
+	t.Log("Overwrite it, and add a second file.")
+	data2 := []byte{4, 5, 6}
+	err = kbfsOps.Write(ctx, nodeA, data2, 0)
+	require.NoError(t, err)
+	_, _, err = kbfsOps.CreateFile(ctx, rootNode, "b", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	t.Log("The archived view should only see the first version.")
+	h, err := ParseTlfHandle(
+		ctx, config.KBPKI(), "alice", tlf.Private)
+	require.NoError(t, err)
+	archivedRoot, _, err := kbfsOps.GetArchivedRootNode(ctx, h, rev1)
+	require.NoError(t, err)
+	require.Equal(t, MakeRevBranchName(rev1),
+		archivedRoot.GetFolderBranch().Branch)
+	children, err := kbfsOps.GetDirChildren(ctx, archivedRoot)
+	require.NoError(t, err)
+	require.Len(t, children, 1)
+	archivedA, _, err := kbfsOps.Lookup(ctx, archivedRoot, "a")
+	require.NoError(t, err)
+	gotData := make([]byte, len(data1))
+	_, err = kbfsOps.Read(ctx, archivedA, gotData, 0)
+	require.NoError(t, err)
+	require.Equal(t, data1, gotData)
+
+	t.Log("Writes to the archived view should fail.")
+	err = kbfsOps.Write(ctx, archivedA, data2, 0)
+	require.IsType(t, WriteToReadonlyNodeError{}, errors.Cause(err))
+	_, _, err = kbfsOps.CreateFile(ctx, archivedRoot, "c", false, NoExcl)
+	require.IsType(t, WriteToReadonlyNodeError{}, errors.Cause(err))
+	err = kbfsOps.RemoveEntry(ctx, archivedRoot, "a")
+	require.IsType(t, WriteToReadonlyNodeError{}, errors.Cause(err))
+
+	t.Log("The live view should be unaffected.")
+	_, err = kbfsOps.Read(ctx, nodeA, gotData, 0)
+	require.NoError(t, err)
+	require.Equal(t, data2, gotData)
+
+	t.Log("Revisions past the head don't exist.")
+	_, _, err = kbfsOps.GetArchivedRootNode(ctx, h, rev1+10)
+	require.IsType(t, NoSuchRevisionError{}, errors.Cause(err))
+
+	t.Log("Idle archived views without nodes are evicted.")
+	kops := kbfsOps.(*KBFSOpsStandard)
+	idleFB := FolderBranch{
+		Tlf:    rootNode.GetFolderBranch().Tlf,
+		Branch: MakeRevBranchName(rev1 + 1),
+	}
+	idleOps := kops.getOpsNoAdd(ctx, idleFB)
+	now := config.Clock().Now()
+	kops.evictIdleArchivedOps(ctx, now)
+	require.True(t, idleOps == kops.getOpsNoAdd(ctx, idleFB))
+	kops.evictIdleArchivedOps(ctx, now.Add(archivedFBOIdleTimeout))
+	kops.opsLock.RLock()
+	_, idleOK := kops.ops[idleFB]
+	_, archivedOK := kops.ops[archivedRoot.GetFolderBranch()]
+	_, liveOK := kops.ops[rootNode.GetFolderBranch()]
+	kops.opsLock.RUnlock()
+	require.False(t, idleOK)
+	require.True(t, archivedOK)
+	require.True(t, liveOK)
+
+	t.Log("The archived view is still usable.")
+	_, err = kbfsOps.Read(ctx, archivedA, gotData, 0)
+	require.NoError(t, err)
+	require.Equal(t, data1, gotData)
+}
+
+func TestKBFSOpsGetRevisionForTime(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "alice")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	clock, t0 := newTestClockAndTimeNow()
+	config.SetClock(clock)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "alice", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+
+	t.Log("Make a bunch of revisions, one minute apart.")
+	revTimes := make(map[kbfsmd.Revision]time.Time)
+	revTimes[ops.getCurrMDRevision(lState)] = t0
+	for i := 0; i < 10; i++ {
+		clock.Add(1 * time.Minute)
+		_, _, err := kbfsOps.CreateFile(
+			ctx, rootNode, fmt.Sprintf("f%d", i), false, NoExcl)
+		require.NoError(t, err)
+		err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+		require.NoError(t, err)
+		revTimes[ops.getCurrMDRevision(lState)] = clock.Now()
+	}
+	head := ops.getCurrMDRevision(lState)
+
+	h, err := ParseTlfHandle(ctx, config.KBPKI(), "alice", tlf.Private)
+	require.NoError(t, err)
+	for rev, revTime := range revTimes {
+		gotRev, err := kbfsOps.GetRevisionForTime(ctx, h, revTime)
+		require.NoError(t, err)
+		require.Equal(t, rev, gotRev)
+
+		gotRev, err = kbfsOps.GetRevisionForTime(
+			ctx, h, revTime.Add(30*time.Second))
+		require.NoError(t, err)
+		require.Equal(t, rev, gotRev)
+	}
+
+	t.Log("Times after the head map to the head.")
+	gotRev, err := kbfsOps.GetRevisionForTime(
+		ctx, h, clock.Now().Add(1*time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, head, gotRev)
+
+	t.Log("Times before the TLF existed have no revision.")
+	_, err = kbfsOps.GetRevisionForTime(ctx, h, t0.Add(-1*time.Minute))
+	require.IsType(t, NoRevisionAtTimeError{}, errors.Cause(err))
+}
+
+func TestKBFSOpsLargeDirectory(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "alice")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	// Split directories once they have more than 4 entries.
+	config.SetBlockSplitter(&BlockSplitterSimple{
+		64 * 1024, 64 * 1024 / int(bpSize), 8 * 1024, 4})
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "alice", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	getDirBlock := func(n Node) (BlockPointer, *DirBlock) {
+		ptr := ops.nodeCache.PathFromNode(n).tailPointer()
+		block, err := config.BlockCache().Get(ptr)
+		require.NoError(t, err)
+		dblock, ok := block.(*DirBlock)
+		require.True(t, ok)
+		return ptr, dblock
+	}
+
+	t.Log("Fill a directory with enough entries to split it.")
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		_, _, err = kbfsOps.CreateFile(
+			ctx, dirNode, fmt.Sprintf("f%02d", i), false, NoExcl)
+		require.NoError(t, err)
+	}
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	ptr, dblock := getDirBlock(dirNode)
+	require.Equal(t, IndirectDirsDataVer, ptr.DataVer)
+	require.True(t, dblock.IsInd)
+	require.Len(t, dblock.IPtrs, 5)
+	oldIPtrs := dblock.IPtrs
+
+	children, err := kbfsOps.GetDirChildren(ctx, dirNode)
+	require.NoError(t, err)
+	require.Len(t, children, 10)
+	for i := 0; i < 10; i++ {
+		_, _, err = kbfsOps.Lookup(ctx, dirNode, fmt.Sprintf("f%02d", i))
+		require.NoError(t, err)
+	}
+
+	t.Log("Adding an entry should only rewrite one child block.")
+	_, _, err = kbfsOps.CreateFile(ctx, dirNode, "f03a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	_, dblock = getDirBlock(dirNode)
+	require.True(t, dblock.IsInd)
+	require.Len(t, dblock.IPtrs, 5)
+	reused := 0
+	for i, iptr := range dblock.IPtrs {
+		if iptr.BlockPointer == oldIPtrs[i].BlockPointer {
+			reused++
+		}
+	}
+	require.Equal(t, 4, reused)
+
+	t.Log("Shrinking the directory makes it direct again.")
+	for i := 0; i < 7; i++ {
+		err = kbfsOps.RemoveEntry(ctx, dirNode, fmt.Sprintf("f%02d", i))
+		require.NoError(t, err)
+	}
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	ptr, dblock = getDirBlock(dirNode)
+	require.Equal(t, FirstValidDataVer, ptr.DataVer)
+	require.False(t, dblock.IsInd)
+	require.Len(t, dblock.Children, 4)
+
+	t.Log("Grow it again, then remove it without syncing in between.")
+	for i := 0; i < 7; i++ {
+		_, _, err = kbfsOps.CreateFile(
+			ctx, dirNode, fmt.Sprintf("f%02d", i), false, NoExcl)
+		require.NoError(t, err)
+	}
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	_, dblock = getDirBlock(dirNode)
+	require.True(t, dblock.IsInd)
+	children, err = kbfsOps.GetDirChildren(ctx, dirNode)
+	require.NoError(t, err)
+	for name := range children {
+		err = kbfsOps.RemoveEntry(ctx, dirNode, name)
+		require.NoError(t, err)
+	}
+	err = kbfsOps.RemoveDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+}
+
+func TestKBFSOpsCopyFile(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "alice")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	// Use small blocks, so that files get indirect blocks easily.
+	bsplit, err := NewBlockSplitterSimple(20, 8*1024, config.Codec())
+	require.NoError(t, err)
+	config.SetBlockSplitter(bsplit)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "alice", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	getFileBlock := func(n Node) (BlockPointer, *FileBlock) {
+		lState := makeFBOLockState()
+		head, _ := ops.getHead(lState)
+		ptr := ops.nodeCache.PathFromNode(n).tailPointer()
+		fblock, err := ops.blocks.GetFileBlockForReading(
+			ctx, lState, head, ptr, ops.branch(), path{})
+		require.NoError(t, err)
+		return ptr, fblock
+	}
+	getInfos := func(n Node) []BlockInfo {
+		lState := makeFBOLockState()
+		head, _ := ops.getHead(lState)
+		infos, err := ops.blocks.GetIndirectFileBlockInfos(
+			ctx, lState, head, ops.nodeCache.PathFromNode(n))
+		require.NoError(t, err)
+		return infos
+	}
+	checkData := func(n Node, expected []byte) {
+		data := make([]byte, len(expected)+1)
+		nr, err := kbfsOps.Read(ctx, n, data, 0)
+		require.NoError(t, err)
+		require.Equal(t, expected, data[:nr])
+	}
+
+	t.Log("Make one direct file and one indirect file.")
+	smallData := []byte{1, 2, 3}
+	smallNode, _, err := kbfsOps.CreateFile(
+		ctx, rootNode, "small", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, smallNode, smallData, 0)
+	require.NoError(t, err)
+	bigData := make([]byte, 100)
+	for i := range bigData {
+		bigData[i] = byte(i)
+	}
+	bigNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "big", true, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, bigNode, bigData, 0)
+	require.NoError(t, err)
+
+	t.Log("Copying should sync the dirty source files first.")
+	smallCopy, ei, err := kbfsOps.CopyFile(ctx, smallNode, rootNode, "small2")
+	require.NoError(t, err)
+	require.Equal(t, File, ei.Type)
+	require.Equal(t, uint64(len(smallData)), ei.Size)
+	checkData(smallCopy, smallData)
+	bigCopy, ei, err := kbfsOps.CopyFile(ctx, bigNode, rootNode, "big2")
+	require.NoError(t, err)
+	require.Equal(t, Exec, ei.Type)
+	checkData(bigCopy, bigData)
+
+	t.Log("The copy of a direct file is a new reference to the same block.")
+	smallPtr, _ := getFileBlock(smallNode)
+	smallCopyPtr, _ := getFileBlock(smallCopy)
+	require.Equal(t, smallPtr.ID, smallCopyPtr.ID)
+	require.NotEqual(t, smallPtr.RefNonce, smallCopyPtr.RefNonce)
+
+	t.Log("The copy of an indirect file shares all of its leaf blocks.")
+	bigPtr, _ := getFileBlock(bigNode)
+	bigCopyPtr, bigCopyBlock := getFileBlock(bigCopy)
+	require.NotEqual(t, bigPtr.ID, bigCopyPtr.ID)
+	require.True(t, bigCopyBlock.IsInd)
+	leafIDs := make(map[kbfsblock.ID]bool)
+	for _, info := range getInfos(bigNode) {
+		if info.DirectType == DirectBlock {
+			leafIDs[info.ID] = true
+		}
+	}
+	numShared := 0
+	for _, info := range getInfos(bigCopy) {
+		if info.DirectType == DirectBlock {
+			require.True(t, leafIDs[info.ID])
+			require.NotEqual(t, kbfsblock.ZeroRefNonce, info.RefNonce)
+			numShared++
+		}
+	}
+	require.Equal(t, len(leafIDs), numShared)
+
+	t.Log("Writes to a copy don't affect the original.")
+	err = kbfsOps.Write(ctx, bigCopy, []byte{42}, 0)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	checkData(bigNode, bigData)
+
+	t.Log("Copies can't replace existing entries, or cross folders.")
+	_, _, err = kbfsOps.CopyFile(ctx, smallNode, rootNode, "big")
+	require.IsType(t, NameExistsError{}, errors.Cause(err))
+	_, _, err = kbfsOps.CopyDir(ctx, smallNode, rootNode, "small3")
+	require.IsType(t, NotDirError{}, errors.Cause(err))
+	pubRootNode := GetRootNodeOrBust(ctx, t, config, "alice", tlf.Public)
+	_, _, err = kbfsOps.CopyFile(ctx, smallNode, pubRootNode, "small")
+	require.IsType(t, CopyAcrossFoldersError{}, errors.Cause(err))
+
+	t.Log("Removing the originals leaves the copies intact.")
+	err = kbfsOps.RemoveEntry(ctx, rootNode, "small")
+	require.NoError(t, err)
+	err = kbfsOps.RemoveEntry(ctx, rootNode, "big")
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	config.ResetCaches()
+	checkData(smallCopy, smallData)
+	checkData(bigCopy, append([]byte{42}, bigData[1:]...))
+}
+
+func TestKBFSOpsCopyDir(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "alice")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "alice", tlf.Private)
+	kbfsOps := config.KBFSOps()
+
+	t.Log("Make a tree with a file, a subdirectory and a symlink.")
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	fileNode, _, err := kbfsOps.CreateFile(ctx, dirNode, "f", false, NoExcl)
+	require.NoError(t, err)
+	data := []byte{1, 2, 3, 4}
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+	subdirNode, _, err := kbfsOps.CreateDir(ctx, dirNode, "b")
+	require.NoError(t, err)
+	_, _, err = kbfsOps.CreateDir(ctx, subdirNode, "c")
+	require.NoError(t, err)
+	_, err = kbfsOps.CreateLink(ctx, subdirNode, "link", "../f")
+	require.NoError(t, err)
+
+	t.Log("Clone the whole tree.")
+	copyNode, ei, err := kbfsOps.CopyDir(ctx, dirNode, rootNode, "a2")
+	require.NoError(t, err)
+	require.Equal(t, Dir, ei.Type)
+
+	children, err := kbfsOps.GetDirChildren(ctx, copyNode)
+	require.NoError(t, err)
+	require.Len(t, children, 2)
+	fileCopy, _, err := kbfsOps.Lookup(ctx, copyNode, "f")
+	require.NoError(t, err)
+	buf := make([]byte, len(data))
+	_, err = kbfsOps.Read(ctx, fileCopy, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, data, buf)
+	subdirCopy, _, err := kbfsOps.Lookup(ctx, copyNode, "b")
+	require.NoError(t, err)
+	children, err = kbfsOps.GetDirChildren(ctx, subdirCopy)
+	require.NoError(t, err)
+	require.Len(t, children, 2)
+	require.Equal(t, Dir, children["c"].Type)
+	require.Equal(t, Sym, children["link"].Type)
+	require.Equal(t, "../f", children["link"].SymPath)
+
+	t.Log("Changes to the original tree don't show up in the copy.")
+	err = kbfsOps.RemoveEntry(ctx, dirNode, "f")
+	require.NoError(t, err)
+	err = kbfsOps.RemoveDir(ctx, subdirNode, "c")
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	children, err = kbfsOps.GetDirChildren(ctx, subdirCopy)
+	require.NoError(t, err)
+	require.Len(t, children, 2)
+	_, err = kbfsOps.Read(ctx, fileCopy, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, data, buf)
+
+	t.Log("A file can't be cloned with CopyDir.")
+	_, _, err = kbfsOps.CopyFile(ctx, dirNode, rootNode, "a3")
+	require.IsType(t, NotFileError{}, errors.Cause(err))
+}
+
+func TestKBFSOpsCopyFileWithJournal(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "alice")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	bsplit, err := NewBlockSplitterSimple(20, 8*1024, config.Codec())
+	require.NoError(t, err)
+	config.SetBlockSplitter(bsplit)
+
+	tempdir, err := ioutil.TempDir(os.TempDir(), "journal_for_copy_file")
+	require.NoError(t, err)
+	defer func() {
+		err := ioutil.RemoveAll(tempdir)
+		assert.NoError(t, err)
+	}()
+	err = config.EnableDiskLimiter(tempdir)
+	require.NoError(t, err)
+	err = config.EnableJournaling(
+		ctx, tempdir, TLFJournalBackgroundWorkEnabled)
+	require.NoError(t, err)
+	jServer, err := GetJournalServer(config)
+	require.NoError(t, err)
+	jServer.EnableAuto(ctx)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "alice", tlf.Private)
+	kbfsOps := config.KBFSOps()
+
+	t.Log("New references aren't supported by the journal, so the " +
+		"copied blocks are put again instead.")
+	for i, size := range []int{5, 100} {
+		data := make([]byte, size)
+		for j := range data {
+			data[j] = byte(j)
+		}
+		name := fmt.Sprintf("f%d", i)
+		node, _, err := kbfsOps.CreateFile(ctx, rootNode, name, false, NoExcl)
+		require.NoError(t, err)
+		err = kbfsOps.Write(ctx, node, data, 0)
+		require.NoError(t, err)
+		copyNode, _, err := kbfsOps.CopyFile(ctx, node, rootNode, name+"copy")
+		require.NoError(t, err)
+		buf := make([]byte, size)
+		_, err = kbfsOps.Read(ctx, copyNode, buf, 0)
+		require.NoError(t, err)
+		require.Equal(t, data, buf)
+	}
+
+	err = jServer.Wait(ctx, rootNode.GetFolderBranch().Tlf)
+	require.NoError(t, err)
+}
+
+func TestKBFSOpsXattrs(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "alice")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "alice", tlf.Private)
+	kbfsOps := config.KBFSOps()
+
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	fileNode, _, err := kbfsOps.CreateFile(ctx, dirNode, "b", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	t.Log("Set some attributes on a file and a directory.")
+	err = kbfsOps.SetXattr(ctx, fileNode, "user.tag", []byte("red"), XattrSet)
+	require.NoError(t, err)
+	err = kbfsOps.SetXattr(
+		ctx, fileNode, "user.cache", []byte{1, 2, 3}, XattrCreate)
+	require.NoError(t, err)
+	err = kbfsOps.SetXattr(ctx, dirNode, "user.tag", []byte("blue"), XattrSet)
+	require.NoError(t, err)
+
+	value, err := kbfsOps.GetXattr(ctx, fileNode, "user.tag")
+	require.NoError(t, err)
+	require.Equal(t, []byte("red"), value)
+	names, err := kbfsOps.ListXattrs(ctx, fileNode)
+	require.NoError(t, err)
+	require.Equal(t, []string{"user.cache", "user.tag"}, names)
+	ei, err := kbfsOps.Stat(ctx, fileNode)
+	require.NoError(t, err)
+	require.Len(t, ei.Xattrs, 2)
+
+	t.Log("Create and replace flags are respected.")
+	err = kbfsOps.SetXattr(ctx, fileNode, "user.tag", []byte("x"), XattrCreate)
+	require.IsType(t, NameExistsError{}, errors.Cause(err))
+	err = kbfsOps.SetXattr(ctx, fileNode, "user.new", []byte("x"), XattrReplace)
+	require.IsType(t, NoSuchXattrError{}, errors.Cause(err))
+	err = kbfsOps.SetXattr(
+		ctx, fileNode, "user.tag", []byte("green"), XattrReplace)
+	require.NoError(t, err)
+
+	t.Log("Oversized values are rejected.")
+	err = kbfsOps.SetXattr(ctx, fileNode, "user.big",
+		make([]byte, maxXattrValueBytes+1), XattrSet)
+	require.IsType(t, XattrTooBigError{}, errors.Cause(err))
+
+	t.Log("Remove an attribute.")
+	err = kbfsOps.RemoveXattr(ctx, fileNode, "user.cache")
+	require.NoError(t, err)
+	_, err = kbfsOps.GetXattr(ctx, fileNode, "user.cache")
+	require.IsType(t, NoSuchXattrError{}, errors.Cause(err))
+	err = kbfsOps.RemoveXattr(ctx, fileNode, "user.cache")
+	require.IsType(t, NoSuchXattrError{}, errors.Cause(err))
+
+	t.Log("The attributes survive a sync and a cache reset.")
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	config.ResetCaches()
+	dirNode, _, err = kbfsOps.Lookup(ctx, rootNode, "a")
+	require.NoError(t, err)
+	fileNode, _, err = kbfsOps.Lookup(ctx, dirNode, "b")
+	require.NoError(t, err)
+	names, err = kbfsOps.ListXattrs(ctx, fileNode)
+	require.NoError(t, err)
+	require.Equal(t, []string{"user.tag"}, names)
+	value, err = kbfsOps.GetXattr(ctx, fileNode, "user.tag")
+	require.NoError(t, err)
+	require.Equal(t, []byte("green"), value)
+	value, err = kbfsOps.GetXattr(ctx, dirNode, "user.tag")
+	require.NoError(t, err)
+	require.Equal(t, []byte("blue"), value)
+}
+
+func TestKBFSOpsCompressedBlocks(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "alice")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	config.SetBlockCompression(true)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "alice", tlf.Private)
+	kbfsOps := config.KBFSOps()
+
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	data := bytes.Repeat([]byte("compress me "), 10000)
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	r := config.MetricsRegistry()
+	require.NotNil(t, r)
+	saved := metrics.GetOrRegisterCounter("BlockOps.CompressionBytesSaved", r)
+	require.True(t, saved.Count() > 0)
+
+	t.Log("The compressed data can be read back from the server.")
+	config.ResetCaches()
+	fileNode, _, err = kbfsOps.Lookup(ctx, rootNode, "a")
+	require.NoError(t, err)
+	gotData := make([]byte, len(data))
+	n, err := kbfsOps.Read(ctx, fileNode, gotData, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	require.Equal(t, data, gotData)
+}
+
+func TestKBFSOpsDeletedEntries(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "alice")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "alice", tlf.Private)
+	fb := rootNode.GetFolderBranch()
+	kbfsOps := config.KBFSOps()
+	err := kbfsOps.SetTrashRetention(ctx, fb, 1*time.Hour)
+	require.NoError(t, err)
+	writeFile := func(dir Node, name string, data []byte) {
+		fileNode, _, err := kbfsOps.CreateFile(ctx, dir, name, false, NoExcl)
+		require.NoError(t, err)
+		err = kbfsOps.Write(ctx, fileNode, data, 0)
+		require.NoError(t, err)
+	}
+	readFile := func(dir Node, name string) []byte {
+		fileNode, ei, err := kbfsOps.Lookup(ctx, dir, name)
+		require.NoError(t, err)
+		data := make([]byte, ei.Size)
+		_, err = kbfsOps.Read(ctx, fileNode, data, 0)
+		require.NoError(t, err)
+		return data
+	}
+	syncAll := func() {
+		err := kbfsOps.SyncAll(ctx, fb)
+		require.NoError(t, err)
+	}
+
+	t.Log("Make a tree with a couple of files, and a top-level file.")
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	subdirNode, _, err := kbfsOps.CreateDir(ctx, dirNode, "sub")
+	require.NoError(t, err)
+	dataF := []byte{1, 2, 3, 4}
+	dataG := []byte{5, 6, 7}
+	dataB := []byte{8, 9}
+	writeFile(dirNode, "f", dataF)
+	writeFile(subdirNode, "g", dataG)
+	writeFile(rootNode, "b", dataB)
+	writeFile(rootNode, "c", []byte{10})
+	syncAll()
+
+	entries, err := kbfsOps.GetDeletedEntries(ctx, fb)
+	require.NoError(t, err)
+	require.Len(t, entries, 0)
+
+	t.Log("Remove the file, rename another one, and then remove the " +
+		"tree one entry at a time.")
+	err = kbfsOps.RemoveEntry(ctx, rootNode, "b")
+	require.NoError(t, err)
+	syncAll()
+	err = kbfsOps.Rename(ctx, rootNode, "c", rootNode, "d", RenameReplace)
+	require.NoError(t, err)
+	syncAll()
+	err = kbfsOps.RemoveEntry(ctx, subdirNode, "g")
+	require.NoError(t, err)
+	syncAll()
+	err = kbfsOps.RemoveDir(ctx, dirNode, "sub")
+	require.NoError(t, err)
+	syncAll()
+	err = kbfsOps.RemoveEntry(ctx, dirNode, "f")
+	require.NoError(t, err)
+	syncAll()
+	err = kbfsOps.RemoveDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	syncAll()
+
+	t.Log("Only the top-level removals are listed, most recent first.")
+	entries, err = kbfsOps.GetDeletedEntries(ctx, fb)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.Equal(t, "a", entries[0].Path)
+	require.Equal(t, Dir, entries[0].Type)
+	require.Equal(t, "b", entries[1].Path)
+	require.Equal(t, File, entries[1].Type)
+	require.Equal(t, uint64(len(dataB)), entries[1].Size)
+	require.True(t, entries[0].Revision > entries[1].Revision)
+
+	t.Log("Listing again without any new revisions gives the same " +
+		"entries.")
+	entries2, err := kbfsOps.GetDeletedEntries(ctx, fb)
+	require.NoError(t, err)
+	require.Equal(t, entries, entries2)
+
+	t.Log("A new removal shows up along with the older ones.")
+	writeFile(rootNode, "e", []byte{11})
+	syncAll()
+	err = kbfsOps.RemoveEntry(ctx, rootNode, "e")
+	require.NoError(t, err)
+	syncAll()
+	entries2, err = kbfsOps.GetDeletedEntries(ctx, fb)
+	require.NoError(t, err)
+	require.Len(t, entries2, 3)
+	require.Equal(t, "e", entries2[0].Path)
+	require.Equal(t, entries, entries2[1:])
+
+	t.Log("Restore the file under its old name.")
+	_, ei, err := kbfsOps.RestoreDeletedEntry(ctx, entries[1], rootNode, "b")
+	require.NoError(t, err)
+	require.Equal(t, File, ei.Type)
+	require.Equal(t, dataB, readFile(rootNode, "b"))
+
+	t.Log("The directory comes back with everything that was in it.")
+	restoredDir, ei, err := kbfsOps.RestoreDeletedEntry(
+		ctx, entries[0], rootNode, "a2")
+	require.NoError(t, err)
+	require.Equal(t, Dir, ei.Type)
+	require.Equal(t, dataF, readFile(restoredDir, "f"))
+	restoredSubdir, _, err := kbfsOps.Lookup(ctx, restoredDir, "sub")
+	require.NoError(t, err)
+	require.Equal(t, dataG, readFile(restoredSubdir, "g"))
+
+	t.Log("Existing names aren't overwritten.")
+	_, _, err = kbfsOps.RestoreDeletedEntry(ctx, entries[1], rootNode, "d")
+	require.IsType(t, NameExistsError{}, errors.Cause(err))
+
+	t.Log("The restored data can be read back from the server.")
+	syncAll()
+	config.ResetCaches()
+	require.Equal(t, dataB, readFile(rootNode, "b"))
+	require.Equal(t, dataF, readFile(restoredDir, "f"))
+}
+
+func TestKBFSOpsFileVersions(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "alice")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	// Use a small block size so that some versions have indirect
+	// blocks.
+	bsplit, err := NewBlockSplitterSimple(20, 8*1024, config.Codec())
+	require.NoError(t, err)
+	config.SetBlockSplitter(bsplit)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "alice", tlf.Private)
+	fb := rootNode.GetFolderBranch()
+	kbfsOps := config.KBFSOps()
+	syncAll := func() {
+		err := kbfsOps.SyncAll(ctx, fb)
+		require.NoError(t, err)
+	}
+	readFile := func(fileNode Node) []byte {
+		ei, err := kbfsOps.Stat(ctx, fileNode)
+		require.NoError(t, err)
+		data := make([]byte, ei.Size)
+		_, err = kbfsOps.Read(ctx, fileNode, data, 0)
+		require.NoError(t, err)
+		return data
+	}
+
+	t.Log("Write a few versions of a file, with some unrelated " +
+		"changes in between.")
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	data1 := []byte{1, 2, 3, 4}
+	err = kbfsOps.Write(ctx, fileNode, data1, 0)
+	require.NoError(t, err)
+	syncAll()
+	_, _, err = kbfsOps.CreateDir(ctx, rootNode, "b")
+	require.NoError(t, err)
+	syncAll()
+	data2 := make([]byte, 100)
+	for i := range data2 {
+		data2[i] = byte(i)
+	}
+	err = kbfsOps.Write(ctx, fileNode, data2, 0)
+	require.NoError(t, err)
+	syncAll()
+	err = kbfsOps.Rename(ctx, rootNode, "a", rootNode, "c", RenameReplace)
+	require.NoError(t, err)
+	syncAll()
+	err = kbfsOps.Truncate(ctx, fileNode, 2)
+	require.NoError(t, err)
+	syncAll()
+
+	t.Log("All the versions are listed, most recent first.")
+	versions, err := kbfsOps.GetFileVersions(ctx, fileNode)
+	require.NoError(t, err)
+	require.Len(t, versions, 3)
+	require.Equal(t, uint64(2), versions[0].Size)
+	require.Equal(t, uint64(len(data2)), versions[1].Size)
+	require.Equal(t, uint64(len(data1)), versions[2].Size)
+	session, err := config.KBPKI().GetCurrentSession(ctx)
+	require.NoError(t, err)
+	for i, v := range versions {
+		require.Equal(t, session.UID, v.Writer)
+		require.Equal(t, session.VerifyingKey, v.WriterDevice)
+		if i > 0 {
+			require.True(t, v.Revision < versions[i-1].Revision)
+		}
+	}
+
+	t.Log("Restore the multi-block version as a new version, without " +
+		"syncing an unrelated dirty file.")
+	otherNode, _, err := kbfsOps.CreateFile(
+		ctx, rootNode, "d", false, NoExcl)
+	require.NoError(t, err)
+	syncAll()
+	err = kbfsOps.Write(ctx, otherNode, data1, 0)
+	require.NoError(t, err)
+	err = kbfsOps.RestoreFileVersion(ctx, fileNode, versions[1])
+	require.NoError(t, err)
+	require.Equal(t, data2, readFile(fileNode))
+	ops := kbfsOps.(*KBFSOpsStandard).getOpsByNode(ctx, rootNode)
+	require.Len(t, ops.blocks.GetDirtyFileBlockRefs(makeFBOLockState()), 1)
+	syncAll()
+	newVersions, err := kbfsOps.GetFileVersions(ctx, fileNode)
+	require.NoError(t, err)
+	require.Len(t, newVersions, 4)
+	require.Equal(t, uint64(len(data2)), newVersions[0].Size)
+
+	t.Log("Restore the first version, and read it back from the server.")
+	err = kbfsOps.RestoreFileVersion(ctx, fileNode, versions[2])
+	require.NoError(t, err)
+	config.ResetCaches()
+	require.Equal(t, data1, readFile(fileNode))
+
+	t.Log("Directories have no versions.")
+	_, err = kbfsOps.GetFileVersions(ctx, rootNode)
+	require.IsType(t, NotFileError{}, errors.Cause(err))
+}
+
+func TestKBFSOpsPathChanges(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "alice")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	clock, now := newTestClockAndTimeNow()
+	config.SetClock(clock)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "alice", tlf.Private)
+	fb := rootNode.GetFolderBranch()
+	kbfsOps := config.KBFSOps()
+	syncAll := func() {
+		err := kbfsOps.SyncAll(ctx, fb)
+		require.NoError(t, err)
+	}
+	_, startRev, err := kbfsOps.GetPathChanges(
+		ctx, fb, kbfsmd.RevisionUninitialized)
+	require.NoError(t, err)
+
+	t.Log("Make a few changes, some of them in the same revision.")
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	syncAll()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, dirNode, "f", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+	syncAll()
+	err = kbfsOps.Rename(ctx, dirNode, "f", rootNode, "g", RenameReplace)
+	require.NoError(t, err)
+	syncAll()
+	err = kbfsOps.RemoveDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	syncAll()
+
+	changes, lastRev, err := kbfsOps.GetPathChanges(ctx, fb, startRev)
+	require.NoError(t, err)
+	require.True(t, lastRev > startRev)
+	type change struct {
+		t       PathChangeType
+		p, oldP string
+	}
+	var gotChanges []change
+	for i, c := range changes {
+		if i > 0 {
+			require.True(t, c.Revision >= changes[i-1].Revision)
+		}
+		require.True(t, c.Revision > startRev && c.Revision <= lastRev)
+		gotChanges = append(gotChanges, change{c.Type, c.Path, c.OldPath})
+	}
+	require.Equal(t, []change{
+		{PathCreated, "a", ""},
+		{PathCreated, "a/f", ""},
+		{PathWritten, "a/f", ""},
+		{PathRenamed, "g", "a/f"},
+		{PathRemoved, "a", ""},
+	}, gotChanges)
+
+	t.Log("Resuming from the last revision returns nothing new.")
+	changes, newLastRev, err := kbfsOps.GetPathChanges(ctx, fb, lastRev)
+	require.NoError(t, err)
+	require.Len(t, changes, 0)
+	require.Equal(t, lastRev, newLastRev)
+
+	t.Log("Resuming from the middle only returns the later changes.")
+	changes, _, err = kbfsOps.GetPathChanges(ctx, fb, lastRev-1)
+	require.NoError(t, err)
+	require.Len(t, changes, 1)
+	require.Equal(t, PathRemoved, changes[0].Type)
+
+	t.Log("Revisions already covered by QR are reported as reclaimed, " +
+		"instead of failing on their blocks or being skipped.")
+	clock.Set(now.Add(2 * config.QuotaReclamationMinUnrefAge()))
+	ops := getOps(config, fb.Tlf)
+	ops.fbm.forceQuotaReclamation()
+	err = ops.fbm.waitForQuotaReclamations(ctx)
+	require.NoError(t, err)
+	_, _, err = kbfsOps.GetPathChanges(ctx, fb, startRev)
+	require.IsType(t, PathChangesReclaimedError{}, errors.Cause(err))
+	gcRev := errors.Cause(err).(PathChangesReclaimedError).LastGCRevision
+	require.True(t, gcRev >= lastRev)
+
+	t.Log("Changes can be listed again after the last GC revision.")
+	changes, newLastRev, err = kbfsOps.GetPathChanges(ctx, fb, gcRev)
+	require.NoError(t, err)
+	require.Len(t, changes, 0)
+	require.True(t, newLastRev > lastRev)
+}
+
+func TestKBFSOpsDiskUsage(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "alice")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	tempdir, err := ioutil.TempDir(os.TempDir(), "disk_usage")
+	require.NoError(t, err)
+	defer func() {
+		err := ioutil.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+	config.storageRoot = tempdir
+
+	// Use small blocks, so that files get indirect blocks easily.
+	bsplit, err := NewBlockSplitterSimple(20, 8*1024, config.Codec())
+	require.NoError(t, err)
+	config.SetBlockSplitter(bsplit)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "alice", tlf.Private)
+	fb := rootNode.GetFolderBranch()
+	kbfsOps := config.KBFSOps()
+	ops := getOps(config, fb.Tlf)
+	writeFile := func(dir Node, name string, size int) Node {
+		n, _, err := kbfsOps.CreateFile(ctx, dir, name, false, NoExcl)
+		require.NoError(t, err)
+		err = kbfsOps.Write(ctx, n, make([]byte, size), 0)
+		require.NoError(t, err)
+		err = kbfsOps.SyncAll(ctx, fb)
+		require.NoError(t, err)
+		return n
+	}
+	checkRootUsage := func() DirDiskUsage {
+		usage, err := kbfsOps.GetDiskUsage(ctx, rootNode)
+		require.NoError(t, err)
+		lState := makeFBOLockState()
+		head, _ := ops.getHead(lState)
+		require.Equal(t, head.Revision(), usage.Revision)
+		require.Equal(t, head.DiskUsage(), usage.Total.EncodedSize)
+		return usage
+	}
+	// getUsage returns the usage of the given path once the
+	// background updates are done, without asking for it.
+	getUsage := func(p string) diskUsageEntry {
+		err := ops.diskUsage.waitForUpdates(ctx)
+		require.NoError(t, err)
+		ops.diskUsage.lock.Lock()
+		defer ops.diskUsage.lock.Unlock()
+		lState := makeFBOLockState()
+		head, _ := ops.getHead(lState)
+		require.Equal(t, head.Revision(), ops.diskUsage.rev)
+		return ops.diskUsage.usages[p]
+	}
+
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	bigNode := writeFile(dirNode, "big", 100)
+	smallNode := writeFile(rootNode, "small", 3)
+	_, err = kbfsOps.CreateLink(ctx, rootNode, "link", "a/big")
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+
+	t.Log("The totals match the usage recorded in the MD.")
+	usage := checkRootUsage()
+	require.Equal(t, uint64(103), usage.Total.LogicalSize)
+	require.Len(t, usage.Children, 2)
+	require.Equal(t, DiskUsage{
+		LogicalSize: 3,
+		EncodedSize: usage.Children["small"].EncodedSize,
+		Blocks:      1,
+	}, usage.Children["small"])
+	dirUsage := usage.Children["a"]
+	require.Equal(t, uint64(100), dirUsage.LogicalSize)
+	require.True(t, dirUsage.Blocks > 2)
+	aUsage, err := kbfsOps.GetDiskUsage(ctx, dirNode)
+	require.NoError(t, err)
+	require.Equal(t, dirUsage, aUsage.Total)
+	require.Equal(t, aUsage.Total.Blocks-1, aUsage.Children["big"].Blocks)
+
+	t.Log("Later changes are applied in the background, and only " +
+		"replace the usages of what they touched.")
+	dirPtr := ops.nodeCache.PathFromNode(dirNode).tailPointer()
+	oldSmallPtr := ops.nodeCache.PathFromNode(smallNode).tailPointer()
+	err = kbfsOps.Write(ctx, smallNode, make([]byte, 5), 3)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	require.Equal(t, uint64(108), getUsage("").Total.LogicalSize)
+	require.Equal(t, dirPtr, getUsage("a").Ptr)
+	require.NotEqual(t, oldSmallPtr, getUsage("small").Ptr)
+	usage = checkRootUsage()
+	require.Equal(t, uint64(108), usage.Total.LogicalSize)
+	require.Equal(t, dirUsage, usage.Children["a"])
+
+	t.Log("Renamed entries keep their usages.")
+	bigUsage := getUsage("a/big")
+	err = kbfsOps.Rename(ctx, rootNode, "a", rootNode, "b", RenameReplace)
+	require.NoError(t, err)
+	err = kbfsOps.RemoveEntry(ctx, rootNode, "small")
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	require.Equal(t, bigUsage, getUsage("b/big"))
+	require.NotContains(t, ops.diskUsage.usages, "a/big")
+	require.NotContains(t, ops.diskUsage.usages, "small")
+	usage = checkRootUsage()
+	require.Len(t, usage.Children, 1)
+	require.Equal(t, dirUsage, usage.Children["b"])
+
+	t.Log("The usages are saved across restarts, and kept up to date " +
+		"from the first new head.")
+	savedUsages := ops.diskUsage.usages
+	ops.diskUsage.shutdown()
+	ops.diskUsage = newFolderDiskUsage(
+		config, fb, ops.log, ops.getPathChangesForMD)
+	writeFile(rootNode, "new", 7)
+	require.Equal(t, uint64(107), getUsage("").Total.LogicalSize)
+	require.Equal(t, savedUsages["b"], getUsage("b"))
+	usage = checkRootUsage()
+	require.Equal(t, uint64(107), usage.Total.LogicalSize)
+
+	t.Log("Only directories have a disk usage listing.")
+	_, err = kbfsOps.GetDiskUsage(ctx, bigNode)
+	require.IsType(t, NotDirError{}, errors.Cause(err))
+}
+
+func TestKBFSOpsPinPath(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "alice")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	tempdir, err := ioutil.TempDir(os.TempDir(), "pin_path")
+	require.NoError(t, err)
+	defer func() {
+		err := ioutil.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+	config.storageRoot = tempdir
+
+	dbcConfig := newTestDiskBlockCacheConfig(t)
+	dbc, err := newDiskBlockCacheStandardForTest(
+		dbcConfig, testDiskBlockCacheMaxBytes)
+	require.NoError(t, err)
+	config.diskBlockCache = dbc
+
+	// Use small blocks, so that files get indirect blocks easily.
+	bsplit, err := NewBlockSplitterSimple(20, 8*1024, config.Codec())
+	require.NoError(t, err)
+	config.SetBlockSplitter(bsplit)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "alice", tlf.Private)
+	fb := rootNode.GetFolderBranch()
+	kbfsOps := config.KBFSOps()
+	ops := getOps(config, fb.Tlf)
+
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	bigNode, _, err := kbfsOps.CreateFile(ctx, dirNode, "big", false, NoExcl)
+	require.NoError(t, err)
+	// Avoid repeated data, since the disk cache only stores
+	// deduplicated blocks once.
+	data := make([]byte, 150)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	err = kbfsOps.Write(ctx, bigNode, data[:100], 0)
+	require.NoError(t, err)
+	_, _, err = kbfsOps.CreateFile(ctx, rootNode, "other", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+
+	checkPin := func() PinStatus {
+		err := ops.pinner.waitForRefreshes(ctx)
+		require.NoError(t, err)
+		status, _, err := kbfsOps.FolderStatus(ctx, fb)
+		require.NoError(t, err)
+		require.Len(t, status.Pins, 1)
+		pin := status.Pins[0]
+		require.Equal(t, "a", pin.Path)
+		require.Equal(t, "", pin.Error)
+		require.Equal(t, status.Revision, pin.Revision)
+		require.Equal(t, uint64(0), pin.MissingBytes)
+
+		// The pinned bytes are those of the directory, plus the
+		// root directory above it.
+		usage, err := kbfsOps.GetDiskUsage(ctx, dirNode)
+		require.NoError(t, err)
+		lState := makeFBOLockState()
+		head, _ := ops.getHead(lState)
+		require.Equal(t,
+			usage.Total.EncodedSize+uint64(head.data.Dir.EncodedSize),
+			pin.PinnedBytes)
+		return pin
+	}
+
+	t.Log("Pinning a path fetches all of its blocks into the cache.")
+	err = kbfsOps.PinPath(ctx, fb, "./a/")
+	require.NoError(t, err)
+	checkPin()
+	ops.pinner.lock.Lock()
+	blockIDs := ops.pinner.pins["a"].blockIDs
+	ops.pinner.lock.Unlock()
+	for _, id := range blockIDs {
+		_, err := dbc.GetMetadata(ctx, id)
+		require.NoError(t, err)
+	}
+
+	t.Log("New versions of the pinned path are pinned too.")
+	err = kbfsOps.Write(ctx, bigNode, data[100:], 100)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	checkPin()
+
+	t.Log("Pinned paths are saved across restarts.")
+	ops.pinner.shutdown()
+	ops.pinner = newFolderPinner(config, fb, ops.log)
+	lState := makeFBOLockState()
+	head, _ := ops.getHead(lState)
+	ops.pinner.headChanged(head)
+	checkPin()
+
+	t.Log("Pinning a missing path fails.")
+	err = kbfsOps.PinPath(ctx, fb, "b")
+	require.Equal(t, NoSuchNameError{"b"}, errors.Cause(err))
+	err = kbfsOps.PinPath(ctx, fb, "other/c")
+	require.IsType(t, NotDirError{}, errors.Cause(err))
+	err = kbfsOps.PinPath(ctx, fb, "../a")
+	require.Error(t, err)
+
+	t.Log("Unpinning lets the blocks be evicted again.")
+	err = kbfsOps.UnpinPath(ctx, fb, "a")
+	require.NoError(t, err)
+	status, _, err := kbfsOps.FolderStatus(ctx, fb)
+	require.NoError(t, err)
+	require.Len(t, status.Pins, 0)
+	standardCache := dbc.(*diskBlockCacheWrapped).
+		workingSetCache.(*DiskBlockCacheStandard)
+	standardCache.lock.RLock()
+	defer standardCache.lock.RUnlock()
+	require.NotContains(t, standardCache.pinnedBlocks, fb.Tlf)
+}
+
+func TestKBFSOpsFileDataExtentsAndPunchHole(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "alice")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	// Use small blocks, so that holes can cover whole blocks.
+	bsplit, err := NewBlockSplitterSimple(20, 8*1024, config.Codec())
+	require.NoError(t, err)
+	config.SetBlockSplitter(bsplit)
+	bs := bsplit.maxSize
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "alice", tlf.Private)
+	fb := rootNode.GetFolderBranch()
+	kbfsOps := config.KBFSOps()
+	ops := getOps(config, fb.Tlf)
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	data := bytes.Repeat([]byte{1}, int(10*bs))
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, data[:5], 20*bs)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+
+	checkExtents := func(expected []FileExtent) {
+		extents, err := kbfsOps.GetFileDataExtents(ctx, fileNode, 0, 0)
+		require.NoError(t, err)
+		require.Equal(t, expected, extents)
+	}
+	checkData := func(expected []byte) {
+		buf := make([]byte, len(expected)+1)
+		n, err := kbfsOps.Read(ctx, fileNode, buf, 0)
+		require.NoError(t, err)
+		require.Equal(t, expected, buf[:n])
+	}
+	getLeafInfos := func() map[BlockPointer]bool {
+		lState := makeFBOLockState()
+		head, _ := ops.getHead(lState)
+		infos, err := ops.blocks.GetIndirectFileBlockInfos(
+			ctx, lState, head, ops.nodeCache.PathFromNode(fileNode))
+		require.NoError(t, err)
+		ptrs := make(map[BlockPointer]bool)
+		for _, info := range infos {
+			ptrs[info.BlockPointer] = true
+		}
+		return ptrs
+	}
+
+	t.Log("Writing past the end of the file leaves a hole.")
+	checkExtents([]FileExtent{{Off: 0, Len: 10 * bs}, {Off: 20 * bs, Len: 5}})
+	extents, err := kbfsOps.GetFileDataExtents(ctx, fileNode, 15*bs, 1)
+	require.NoError(t, err)
+	require.Equal(t, []FileExtent{{Off: 20 * bs, Len: 5}}, extents)
+	extents, err = kbfsOps.GetFileDataExtents(ctx, fileNode, 20*bs+5, 0)
+	require.NoError(t, err)
+	require.Len(t, extents, 0)
+
+	t.Log("Punching a hole drops the blocks it covers.")
+	oldPtrs := getLeafInfos()
+	err = kbfsOps.PunchHole(ctx, fileNode, bs/2, 4*bs-bs/2)
+	require.NoError(t, err)
+	expectedData := make([]byte, 20*bs+5)
+	copy(expectedData, data)
+	copy(expectedData[20*bs:], data[:5])
+	for i := bs / 2; i < 4*bs; i++ {
+		expectedData[i] = 0
+	}
+	expectedExtents := []FileExtent{
+		{Off: 0, Len: bs / 2}, {Off: 4 * bs, Len: 6 * bs},
+		{Off: 20 * bs, Len: 5}}
+	checkExtents(expectedExtents)
+	checkData(expectedData)
+	extents, err = kbfsOps.GetFileDataExtents(ctx, fileNode, 2*bs, 1)
+	require.NoError(t, err)
+	require.Equal(t, []FileExtent{{Off: 4 * bs, Len: 6 * bs}}, extents)
+
+	t.Log("The dropped blocks are unreferenced by the sync.")
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	checkExtents(expectedExtents)
+	checkData(expectedData)
+	newPtrs := getLeafInfos()
+	require.True(t, len(newPtrs) < len(oldPtrs))
+	lState := makeFBOLockState()
+	head, _ := ops.getHead(lState)
+	unrefs := make(map[BlockPointer]bool)
+	for _, op := range head.data.Changes.Ops {
+		for _, ptr := range op.Unrefs() {
+			unrefs[ptr] = true
+		}
+	}
+	var removed int
+	for ptr := range oldPtrs {
+		if !newPtrs[ptr] {
+			removed++
+			require.True(t, unrefs[ptr])
+		}
+	}
+	require.True(t, removed >= 4)
+
+	t.Log("A hole at the end of the file doesn't change its size.")
+	err = kbfsOps.PunchHole(ctx, fileNode, 20*bs+2, 100)
+	require.NoError(t, err)
+	for i := 20*bs + 2; i < 20*bs+5; i++ {
+		expectedData[i] = 0
+	}
+	checkData(expectedData)
+	ei, err := kbfsOps.Stat(ctx, fileNode)
+	require.NoError(t, err)
+	require.Equal(t, uint64(20*bs+5), ei.Size)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	checkData(expectedData)
+}
+
+func TestKBFSOpsRenameModes(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "alice")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "alice", tlf.Private)
+	fb := rootNode.GetFolderBranch()
+	kbfsOps := config.KBFSOps()
+	ops := getOps(config, fb.Tlf)
+	lState := makeFBOLockState()
+	aNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, aNode, []byte("aaa"), 0)
+	require.NoError(t, err)
+	dNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "d")
+	require.NoError(t, err)
+	bNode, _, err := kbfsOps.CreateFile(ctx, dNode, "b", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, bNode, []byte("bbbb"), 0)
+	require.NoError(t, err)
+	_, _, err = kbfsOps.CreateFile(ctx, rootNode, "c", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+
+	readAll := func(n Node) string {
+		buf := make([]byte, 10)
+		nr, err := kbfsOps.Read(ctx, n, buf, 0)
+		require.NoError(t, err)
+		return string(buf[:nr])
+	}
+	checkPath := func(n Node, expected string) {
+		p := ops.nodeCache.PathFromNode(n)
+		require.Equal(t, expected, tlfRelativePath(p))
+	}
+
+	t.Log("A no-replace rename fails if the target exists.")
+	err = kbfsOps.Rename(ctx, rootNode, "a", rootNode, "c", RenameNoReplace)
+	require.IsType(t, NameExistsError{}, errors.Cause(err))
+	err = kbfsOps.Rename(ctx, rootNode, "c", rootNode, "e", RenameNoReplace)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+
+	t.Log("An exchange fails if the target doesn't exist.")
+	err = kbfsOps.Rename(ctx, rootNode, "a", rootNode, "c", RenameExchange)
+	require.IsType(t, NoSuchNameError{}, errors.Cause(err))
+
+	t.Log("Exchange two files in different directories.")
+	head, _ := ops.getHead(lState)
+	err = kbfsOps.Rename(ctx, rootNode, "a", dNode, "b", RenameExchange)
+	require.NoError(t, err)
+	checkPath(aNode, "d/b")
+	checkPath(bNode, "a")
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	newHead, _ := ops.getHead(lState)
+	require.Equal(t, head.Revision()+1, newHead.Revision())
+	n, _, err := kbfsOps.Lookup(ctx, rootNode, "a")
+	require.NoError(t, err)
+	require.Equal(t, bNode.GetID(), n.GetID())
+	require.Equal(t, "bbbb", readAll(n))
+	n, _, err = kbfsOps.Lookup(ctx, dNode, "b")
+	require.NoError(t, err)
+	require.Equal(t, aNode.GetID(), n.GetID())
+	require.Equal(t, "aaa", readAll(n))
+
+	t.Log("Exchange a file and a directory in the same directory.")
+	err = kbfsOps.Rename(ctx, rootNode, "e", rootNode, "d", RenameExchange)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	checkPath(dNode, "e")
+	checkPath(aNode, "e/b")
+	_, ei, err := kbfsOps.Lookup(ctx, rootNode, "d")
+	require.NoError(t, err)
+	require.Equal(t, File, ei.Type)
+
+	t.Log("Another device sees the same result.")
+	config2 := ConfigAsUser(config, "alice")
+	defer CheckConfigAndShutdown(ctx, t, config2)
+	kbfsOps2 := config2.KBFSOps()
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, "alice", tlf.Private)
+	children, err := kbfsOps2.GetDirChildren(ctx, rootNode2)
+	require.NoError(t, err)
+	require.Len(t, children, 3)
+	require.Equal(t, Dir, children["e"].Type)
+	require.Equal(t, File, children["d"].Type)
+	require.Equal(t, uint64(4), children["a"].Size)
+	eNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "e")
+	require.NoError(t, err)
+	_, ei, err = kbfsOps2.Lookup(ctx, eNode2, "b")
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), ei.Size)
+
+	t.Log("Each exchange shows up as two renames.")
+	changes, _, err := kbfsOps.GetPathChanges(ctx, fb, head.Revision())
+	require.NoError(t, err)
+	require.Len(t, changes, 4)
+	require.Equal(t, PathRenamed, changes[0].Type)
+	require.Equal(t, "d/b", changes[0].Path)
+	require.Equal(t, "a", changes[0].OldPath)
+	require.Equal(t, "a", changes[1].Path)
+	require.Equal(t, "d/b", changes[1].OldPath)
+}
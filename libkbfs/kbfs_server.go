@@ -0,0 +1,402 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"net"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/auth"
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/go-framed-msgpack-rpc/rpc"
+	"github.com/keybase/kbfs/kbfscodec"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// KBFSServer serves the MD server, key server and block server RPC
+// protocols (the ones spoken by MDServerRemote and
+// BlockServerRemote) from local disk storage, so that unmodified
+// clients can use it as their remote servers.  Both protocols are
+// served on every connection.
+//
+// There is no Keybase API server to check with, so a device is
+// trusted to belong to whatever user it claims in its auth token,
+// as long as it can sign with the key in that token.  Team TLFs are
+// not supported, and block accesses aren't checked against TLF
+// membership, just like with BlockServerDisk.
+type KBFSServer struct {
+	codec  kbfscodec.Codec
+	crypto cryptoPure
+	clock  Clock
+	log    logger.Logger
+
+	mdServer  *MDServerDisk
+	bServer   *BlockServerDisk
+	keyServer *KeyServerLocal
+
+	lock     sync.Mutex
+	conns    map[net.Conn]bool
+	listener net.Listener
+	shutdown bool
+}
+
+// NewKBFSServerDir constructs a new KBFSServer that stores its data
+// in the given directory, using the same layout as a "dir:" server
+// address does for a local client.
+func NewKBFSServerDir(
+	log logger.Logger, dirPath string) (s *KBFSServer, err error) {
+	codec := kbfscodec.NewMsgpack()
+	s = &KBFSServer{
+		codec:  codec,
+		crypto: MakeCryptoCommon(codec),
+		clock:  wallClock{},
+		log:    log,
+		conns:  make(map[net.Conn]bool),
+	}
+	defer func() {
+		if err != nil {
+			s.Shutdown()
+		}
+	}()
+
+	s.mdServer, err = NewMDServerDir(
+		kbfsServerConnConfig{s, kbfsServerNoSession{}},
+		filepath.Join(dirPath, "kbfs_md"))
+	if err != nil {
+		return nil, err
+	}
+	s.keyServer, err = NewKeyServerDir(
+		kbfsServerConnConfig{s, kbfsServerNoSession{}},
+		filepath.Join(dirPath, "kbfs_key"))
+	if err != nil {
+		return nil, err
+	}
+	s.bServer = NewBlockServerDir(
+		codec, log, filepath.Join(dirPath, "kbfs_block"))
+	return s, nil
+}
+
+// Clock returns the clock used by the server.
+func (s *KBFSServer) Clock() Clock {
+	return s.clock
+}
+
+// Codec returns the codec used by the server.
+func (s *KBFSServer) Codec() kbfscodec.Codec {
+	return s.codec
+}
+
+// MetadataVersion returns the newest metadata version the server
+// accepts.
+func (s *KBFSServer) MetadataVersion() MetadataVer {
+	return SegregatedKeyBundlesVer
+}
+
+// MakeLogger returns the server's logger.
+func (s *KBFSServer) MakeLogger(_ string) logger.Logger {
+	return s.log
+}
+
+func (s *KBFSServer) cryptoPure() cryptoPure {
+	return s.crypto
+}
+
+func (s *KBFSServer) teamMembershipChecker() TeamMembershipChecker {
+	return kbfsServerTeamMembershipChecker{}
+}
+
+// Serve accepts connections on the given listener, and serves each
+// of them in its own goroutine.  It returns when the listener fails
+// or the server is shut down.
+func (s *KBFSServer) Serve(l net.Listener) error {
+	err := func() error {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if s.shutdown {
+			return errors.New("KBFSServer is shut down")
+		}
+		s.listener = l
+		return nil
+	}()
+	if err != nil {
+		return err
+	}
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.lock.Lock()
+			defer s.lock.Unlock()
+			if s.shutdown {
+				return nil
+			}
+			return err
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// ServeConn serves the RPC protocols on the given connection, and
+// returns once the connection is closed.
+func (s *KBFSServer) ServeConn(conn net.Conn) {
+	ctx := CtxWithRandomIDReplayable(
+		context.Background(), CtxKBFSServerIDKey, CtxKBFSServerOpID, s.log)
+	s.log.CDebugf(ctx, "New connection from %s", conn.RemoteAddr())
+
+	added := func() bool {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if s.shutdown {
+			return false
+		}
+		s.conns[conn] = true
+		return true
+	}()
+	if !added {
+		conn.Close()
+		return
+	}
+	defer func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		delete(s.conns, conn)
+		conn.Close()
+	}()
+
+	xp := rpc.NewTransport(conn, nil, wrapKBFSServerError)
+	srv := rpc.NewServer(xp, wrapKBFSServerError)
+	updateClient := keybase1.MetadataUpdateClient{
+		Cli: rpc.NewClient(xp, libkb.ErrorUnwrapper{}, nil),
+	}
+
+	mdHandler, err := newMDServerRPCHandler(ctx, s, updateClient)
+	if err != nil {
+		s.log.CWarningf(ctx, "Couldn't make MD handler: %+v", err)
+		return
+	}
+	defer mdHandler.shutdown()
+	bHandler := newBlockServerRPCHandler(ctx, s)
+
+	err = srv.Register(keybase1.MetadataProtocol(mdHandler))
+	if err != nil {
+		s.log.CWarningf(ctx, "Couldn't register MD protocol: %+v", err)
+		return
+	}
+	err = srv.Register(keybase1.BlockProtocol(bHandler))
+	if err != nil {
+		s.log.CWarningf(ctx, "Couldn't register block protocol: %+v", err)
+		return
+	}
+
+	<-srv.Run()
+	s.log.CDebugf(ctx, "Connection from %s done: %v",
+		conn.RemoteAddr(), srv.Err())
+}
+
+// Shutdown stops accepting connections, closes all the open ones,
+// and shuts down the underlying storage.
+func (s *KBFSServer) Shutdown() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.shutdown {
+		return
+	}
+	s.shutdown = true
+
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+
+	if s.mdServer != nil {
+		s.mdServer.Shutdown()
+	}
+	if s.keyServer != nil {
+		s.keyServer.Shutdown()
+	}
+	if s.bServer != nil {
+		s.bServer.Shutdown(context.Background())
+	}
+}
+
+// CtxKBFSServerTagKey is the type used for unique context tags within
+// KBFSServer.
+type CtxKBFSServerTagKey int
+
+const (
+	// CtxKBFSServerIDKey is the type of the tag for unique connection
+	// IDs within KBFSServer.
+	CtxKBFSServerIDKey CtxKBFSServerTagKey = iota
+)
+
+// CtxKBFSServerOpID is the display name for the unique connection
+// KBFSServer ID tag.
+const CtxKBFSServerOpID = "KSID"
+
+// wrapKBFSServerError converts errors returned by the handlers into
+// statuses that the clients' error unwrappers understand.  Unlike
+// libkb.WrapError, it doesn't need a libkb global context.
+func wrapKBFSServerError(err error) interface{} {
+	if err == nil {
+		return nil
+	}
+	if ee, ok := errors.Cause(err).(libkb.ExportableError); ok {
+		status := ee.ToStatus()
+		return &status
+	}
+	return &keybase1.Status{
+		Name: "GENERIC",
+		Code: libkb.SCGeneric,
+		Desc: err.Error(),
+	}
+}
+
+// kbfsServerConnConfig is the mdServerLocalConfig and
+// keyServerLocalConfig for the local servers that act on behalf of
+// a single connection.
+type kbfsServerConnConfig struct {
+	*KBFSServer
+	csg CurrentSessionGetter
+}
+
+func (c kbfsServerConnConfig) currentSessionGetter() CurrentSessionGetter {
+	return c.csg
+}
+
+// CurrentSessionGetter returns the session of the connection.
+func (c kbfsServerConnConfig) CurrentSessionGetter() CurrentSessionGetter {
+	return c.csg
+}
+
+var errKBFSServerNotAuthenticated = errors.New(
+	"Session not authenticated")
+
+// kbfsServerNoSession is the session getter for the shared local
+// servers, which should only ever be used through per-connection
+// copies.
+type kbfsServerNoSession struct{}
+
+func (kbfsServerNoSession) GetCurrentSession(_ context.Context) (
+	SessionInfo, error) {
+	return SessionInfo{}, errKBFSServerNotAuthenticated
+}
+
+// kbfsServerTeamMembershipChecker rejects all team membership
+// checks, since the server can't look up teams.
+type kbfsServerTeamMembershipChecker struct{}
+
+var errKBFSServerNoTeams = errors.New(
+	"Team TLFs are not supported by this server")
+
+func (kbfsServerTeamMembershipChecker) IsTeamWriter(
+	_ context.Context, _ keybase1.TeamID, _ keybase1.UID,
+	_ kbfscrypto.VerifyingKey) (bool, error) {
+	return false, errKBFSServerNoTeams
+}
+
+func (kbfsServerTeamMembershipChecker) IsTeamReader(
+	_ context.Context, _ keybase1.TeamID, _ keybase1.UID) (bool, error) {
+	return false, errKBFSServerNoTeams
+}
+
+// kbfsServerAuth keeps track of the challenge given to, and the
+// session authenticated by, one side (MD or block) of a connection.
+type kbfsServerAuth struct {
+	tokenServer string
+	maxExpireIn int
+	clock       Clock
+
+	lock      sync.Mutex
+	challenge string
+	session   *SessionInfo
+	expiry    time.Time
+}
+
+var _ CurrentSessionGetter = (*kbfsServerAuth)(nil)
+
+func newKBFSServerAuth(
+	tokenServer string, maxExpireIn int, clock Clock) *kbfsServerAuth {
+	return &kbfsServerAuth{
+		tokenServer: tokenServer,
+		maxExpireIn: maxExpireIn,
+		clock:       clock,
+	}
+}
+
+// getChallenge makes a new challenge for the client to sign.  Any
+// previous challenge can't be used anymore, but a session that was
+// already authenticated stays valid until its token expires.
+func (a *kbfsServerAuth) getChallenge() (keybase1.ChallengeInfo, error) {
+	challenge, err := auth.GenerateChallenge()
+	if err != nil {
+		return keybase1.ChallengeInfo{}, err
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.challenge = challenge
+	return keybase1.ChallengeInfo{
+		Now:       a.clock.Now().Unix(),
+		Challenge: challenge,
+	}, nil
+}
+
+// authenticate verifies the given signed auth token against the
+// last challenge, and makes the user and device in it the current
+// session.
+func (a *kbfsServerAuth) authenticate(signature string) (
+	SessionInfo, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.challenge == "" {
+		return SessionInfo{}, errors.New("No challenge was requested")
+	}
+	// Each challenge can only be used once.
+	challenge := a.challenge
+	a.challenge = ""
+
+	token, err := auth.VerifyToken(
+		signature, a.tokenServer, challenge, a.maxExpireIn)
+	if err != nil {
+		return SessionInfo{}, err
+	}
+	if token.UID().IsNil() {
+		return SessionInfo{}, errors.New("Token has no UID")
+	}
+
+	// The server never learns a device's crypt key, so the
+	// verifying key stands in for it wherever a device has to be
+	// identified (e.g., for branches and truncate locks).
+	session := SessionInfo{
+		Name:           token.Username(),
+		UID:            token.UID(),
+		VerifyingKey:   kbfscrypto.MakeVerifyingKey(token.KID()),
+		CryptPublicKey: kbfscrypto.MakeCryptPublicKey(token.KID()),
+	}
+	a.session = &session
+	a.expiry = a.clock.Now().Add(
+		time.Duration(token.TimeRemaining()) * time.Second)
+	return session, nil
+}
+
+// GetCurrentSession implements the CurrentSessionGetter interface for
+// kbfsServerAuth.
+func (a *kbfsServerAuth) GetCurrentSession(_ context.Context) (
+	SessionInfo, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.session == nil || !a.clock.Now().Before(a.expiry) {
+		return SessionInfo{}, errKBFSServerNotAuthenticated
+	}
+	return *a.session, nil
+}
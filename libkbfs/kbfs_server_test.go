@@ -0,0 +1,272 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/go-framed-msgpack-rpc/rpc"
+	"github.com/keybase/kbfs/ioutil"
+	"github.com/keybase/kbfs/kbfsblock"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// connectToKBFSServerForTest serves a new in-memory connection on
+// the given server, and returns MD and block clients for it.
+func connectToKBFSServerForTest(t *testing.T, s *KBFSServer) (
+	keybase1.MetadataClient, keybase1.BlockClient, func()) {
+	serverConn, clientConn := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.ServeConn(serverConn)
+	}()
+	xp := rpc.NewTransport(clientConn, nil, nil)
+	mdClient := keybase1.MetadataClient{
+		Cli: rpc.NewClient(xp, kbfsmd.ServerErrorUnwrapper{}, nil),
+	}
+	bClient := keybase1.BlockClient{
+		Cli: rpc.NewClient(xp, kbfsblock.BServerErrorUnwrapper{}, nil),
+	}
+	return mdClient, bClient, func() {
+		clientConn.Close()
+		<-done
+	}
+}
+
+func signKBFSServerChallengeForTest(t *testing.T, config Config,
+	tokenServer string, challenge keybase1.ChallengeInfo) string {
+	ctx := context.Background()
+	session, err := config.KBPKI().GetCurrentSession(ctx)
+	require.NoError(t, err)
+	authToken := kbfscrypto.NewAuthToken(config.Crypto(), tokenServer,
+		MdServerTokenExpireIn, "libkbfs_test", VersionString(), nil)
+	defer authToken.Shutdown()
+	signature, err := authToken.Sign(ctx, session.Name, session.UID,
+		session.VerifyingKey, challenge)
+	require.NoError(t, err)
+	return signature
+}
+
+func setupKBFSServerTest(t *testing.T) (
+	config *ConfigLocal, s *KBFSServer, tempdir string) {
+	config = MakeTestConfigOrBust(t, "test_user")
+	tempdir, err := ioutil.TempDir(os.TempDir(), "kbfs_server")
+	require.NoError(t, err)
+	s, err = NewKBFSServerDir(logger.NewTestLogger(t), tempdir)
+	require.NoError(t, err)
+	return config, s, tempdir
+}
+
+func teardownKBFSServerTest(
+	t *testing.T, config *ConfigLocal, s *KBFSServer, tempdir string) {
+	s.Shutdown()
+	CheckConfigAndShutdown(context.Background(), t, config)
+	err := ioutil.RemoveAll(tempdir)
+	require.NoError(t, err)
+}
+
+func TestKBFSServerBlocks(t *testing.T) {
+	config, s, tempdir := setupKBFSServerTest(t)
+	defer teardownKBFSServerTest(t, config, s, tempdir)
+	ctx := context.Background()
+
+	_, bClient, closeConn := connectToKBFSServerForTest(t, s)
+	defer closeConn()
+	bServer := newBlockServerRemoteWithClient(config, bClient)
+
+	session, err := config.KBPKI().GetCurrentSession(ctx)
+	require.NoError(t, err)
+	tlfID := tlf.FakeID(1, tlf.Private)
+	bCtx := kbfsblock.MakeFirstContext(
+		session.UID.AsUserOrTeam(), keybase1.BlockType_DATA)
+	data := []byte{1, 2, 3, 4}
+	bID, err := kbfsblock.MakePermanentID(data)
+	require.NoError(t, err)
+	serverHalf, err := kbfscrypto.MakeRandomBlockCryptKeyServerHalf()
+	require.NoError(t, err)
+
+	t.Log("Nothing works before authenticating")
+	err = bServer.Put(ctx, tlfID, bID, bCtx, data, serverHalf)
+	require.IsType(t, kbfsblock.BServerErrorUnauthorized{}, err)
+
+	challenge, err := bClient.GetSessionChallenge(ctx)
+	require.NoError(t, err)
+	t.Log("A token for the wrong server is rejected")
+	err = bClient.AuthenticateSession(ctx, signKBFSServerChallengeForTest(
+		t, config, MdServerTokenServer, challenge))
+	require.IsType(t, kbfsblock.BServerErrorUnauthorized{}, err)
+	challenge, err = bClient.GetSessionChallenge(ctx)
+	require.NoError(t, err)
+	err = bClient.AuthenticateSession(ctx, signKBFSServerChallengeForTest(
+		t, config, BServerTokenServer, challenge))
+	require.NoError(t, err)
+
+	err = bServer.Put(ctx, tlfID, bID, bCtx, data, serverHalf)
+	require.NoError(t, err)
+	gotData, gotServerHalf, err := bServer.Get(ctx, tlfID, bID, bCtx)
+	require.NoError(t, err)
+	require.Equal(t, data, gotData)
+	require.Equal(t, serverHalf, gotServerHalf)
+
+	t.Log("Blocks can't be charged to other users")
+	otherCtx := kbfsblock.MakeFirstContext(
+		keybase1.MakeTestUID(100).AsUserOrTeam(), keybase1.BlockType_DATA)
+	err = bServer.Put(ctx, tlfID, bID, otherCtx, data, serverHalf)
+	require.IsType(t, kbfsblock.BServerErrorUnauthorized{}, err)
+
+	refNonce, err := kbfsblock.MakeRefNonce()
+	require.NoError(t, err)
+	bCtx2 := kbfsblock.MakeContext(session.UID.AsUserOrTeam(),
+		session.UID.AsUserOrTeam(), refNonce, keybase1.BlockType_DATA)
+	err = bServer.AddBlockReference(ctx, tlfID, bID, bCtx2)
+	require.NoError(t, err)
+
+	liveCounts, err := bServer.RemoveBlockReferences(
+		ctx, tlfID, kbfsblock.ContextMap{bID: {bCtx}})
+	require.NoError(t, err)
+	require.Equal(t, map[kbfsblock.ID]int{bID: 1}, liveCounts)
+	liveCounts, err = bServer.RemoveBlockReferences(
+		ctx, tlfID, kbfsblock.ContextMap{bID: {bCtx2}})
+	require.NoError(t, err)
+	require.Equal(t, map[kbfsblock.ID]int{bID: 0}, liveCounts)
+
+	_, _, err = bServer.Get(ctx, tlfID, bID, bCtx)
+	require.IsType(t, kbfsblock.BServerErrorBlockNonExistent{}, err)
+}
+
+func TestKBFSServerMetadataAndKeys(t *testing.T) {
+	config, s, tempdir := setupKBFSServerTest(t)
+	defer teardownKBFSServerTest(t, config, s, tempdir)
+	ctx := context.Background()
+
+	mdClient, _, closeConn := connectToKBFSServerForTest(t, s)
+	defer closeConn()
+	log := config.MakeLogger("")
+	mdServer := &MDServerRemote{
+		config:    config,
+		log:       traceLogger{log},
+		deferLog:  traceLogger{log.CloneWithAddedDepth(1)},
+		client:    mdClient,
+		observers: make(map[tlf.ID]chan<- error),
+	}
+
+	session, err := config.KBPKI().GetCurrentSession(ctx)
+	require.NoError(t, err)
+	uid := session.UID
+	h, err := tlf.MakeHandle(
+		[]keybase1.UserOrTeamID{uid.AsUserOrTeam()}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	_, _, err = mdServer.GetForHandle(ctx, h, Merged)
+	require.IsType(t, kbfsmd.ServerErrorUnauthorized{}, err)
+
+	challenge, err := mdClient.GetChallenge(ctx)
+	require.NoError(t, err)
+	_, err = mdClient.Authenticate(ctx, signKBFSServerChallengeForTest(
+		t, config, MdServerTokenServer, challenge))
+	require.NoError(t, err)
+	t.Log("A challenge can't be reused")
+	_, err = mdClient.Authenticate(ctx, signKBFSServerChallengeForTest(
+		t, config, MdServerTokenServer, challenge))
+	require.IsType(t, kbfsmd.ServerErrorUnauthorized{}, err)
+
+	id, rmds, err := mdServer.GetForHandle(ctx, h, Merged)
+	require.NoError(t, err)
+	require.Nil(t, rmds)
+
+	prevRoot := kbfsmd.ID{}
+	for i := kbfsmd.Revision(1); i <= 3; i++ {
+		brmd := makeBRMDForTest(
+			t, config.Codec(), config.Crypto(), id, h, i, uid, prevRoot)
+		rmds := signRMDSForTest(t, config.Codec(), config.Crypto(), brmd)
+		err = mdServer.Put(ctx, rmds, nil)
+		require.NoError(t, err)
+		prevRoot, err = kbfsmd.MakeID(config.Codec(), rmds.MD)
+		require.NoError(t, err)
+	}
+
+	head, err := mdServer.GetForTLF(ctx, id, NullBranchID, Merged)
+	require.NoError(t, err)
+	require.NotNil(t, head)
+	require.Equal(t, kbfsmd.Revision(3), head.MD.RevisionNumber())
+	rmdses, err := mdServer.GetRange(ctx, id, NullBranchID, Merged, 1, 10)
+	require.NoError(t, err)
+	require.Len(t, rmdses, 3)
+	gotHandle, err := mdServer.GetLatestHandleForTLF(ctx, id)
+	require.NoError(t, err)
+	require.Equal(t, h, gotHandle)
+
+	t.Log("Conflicts come back as such")
+	brmd := makeBRMDForTest(
+		t, config.Codec(), config.Crypto(), id, h, 3, uid, prevRoot)
+	rmds = signRMDSForTest(t, config.Codec(), config.Crypto(), brmd)
+	err = mdServer.Put(ctx, rmds, nil)
+	require.IsType(t, kbfsmd.ServerErrorConflictRevision{}, err)
+
+	serverHalf, err := kbfscrypto.MakeRandomTLFCryptKeyServerHalf()
+	require.NoError(t, err)
+	err = mdServer.PutTLFCryptKeyServerHalves(ctx, UserDeviceKeyServerHalves{
+		uid: {session.CryptPublicKey: serverHalf},
+	})
+	require.NoError(t, err)
+	serverHalfID, err := config.Crypto().GetTLFCryptKeyServerHalfID(
+		uid, session.CryptPublicKey, serverHalf)
+	require.NoError(t, err)
+	gotServerHalf, err := mdServer.GetTLFCryptKeyServerHalf(
+		ctx, serverHalfID, session.CryptPublicKey)
+	require.NoError(t, err)
+	require.Equal(t, serverHalf, gotServerHalf)
+
+	t.Log("Path locks are exclusive across connections")
+	mdClient2, _, closeConn2 := connectToKBFSServerForTest(t, s)
+	defer closeConn2()
+	challenge, err = mdClient2.GetChallenge(ctx)
+	require.NoError(t, err)
+	_, err = mdClient2.Authenticate(ctx, signKBFSServerChallengeForTest(
+		t, config, MdServerTokenServer, challenge))
+	require.NoError(t, err)
+	lockArg := keybase1.LockArg{
+		FolderID: id.String(),
+		LockID:   makePathLockKey(kbfscrypto.TLFCryptKey{}, "a").lockID(),
+	}
+	err = mdClient.Lock(ctx, lockArg)
+	require.NoError(t, err)
+	err = mdClient.Lock(ctx, lockArg)
+	require.NoError(t, err)
+	err = mdClient2.Lock(ctx, lockArg)
+	require.IsType(t, kbfsmd.ServerErrorThrottle{}, err)
+	err = mdClient.ReleaseLock(ctx, keybase1.ReleaseLockArg(lockArg))
+	require.NoError(t, err)
+	err = mdClient2.Lock(ctx, lockArg)
+	require.NoError(t, err)
+
+	t.Log("Locks are released when the connection goes away")
+	closeConn2()
+	err = mdClient.Lock(ctx, lockArg)
+	require.NoError(t, err)
+}
+
+// Exportable errors keep their status codes, and everything else
+// becomes a generic error.
+func TestKBFSServerWrapError(t *testing.T) {
+	status := wrapKBFSServerError(kbfsmd.ServerErrorLocked{})
+	require.Equal(t, &keybase1.Status{
+		Name: "LOCKED",
+		Code: kbfsmd.StatusCodeServerErrorLocked,
+		Desc: kbfsmd.ServerErrorLocked{}.Error(),
+	}, status)
+	status = wrapKBFSServerError(errKBFSServerNoTeams)
+	require.Equal(t, libkb.SCGeneric, status.(*keybase1.Status).Code)
+}
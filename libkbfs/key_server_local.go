@@ -20,9 +20,18 @@ import (
 	"golang.org/x/net/context"
 )
 
+// keyServerLocalConfig is the subset of the Config interface needed
+// by KeyServerLocal.
+type keyServerLocalConfig interface {
+	codecGetter
+	cryptoPureGetter
+	currentSessionGetterGetter
+	logMaker
+}
+
 // KeyServerLocal puts/gets key server halves in/from a local leveldb instance.
 type KeyServerLocal struct {
-	config Config
+	config keyServerLocalConfig
 	db     *leveldb.DB // TLFCryptKeyServerHalfID -> TLFCryptKeyServerHalf
 	log    logger.Logger
 
@@ -34,7 +43,7 @@ type KeyServerLocal struct {
 // Test that KeyServerLocal fully implements the KeyServer interface.
 var _ KeyServer = (*KeyServerLocal)(nil)
 
-func newKeyServerLocal(config Config, storage storage.Storage,
+func newKeyServerLocal(config keyServerLocalConfig, storage storage.Storage,
 	shutdownFunc func(logger.Logger)) (*KeyServerLocal, error) {
 	db, err := leveldb.Open(storage, leveldbOptions)
 	if err != nil {
@@ -47,12 +56,12 @@ func newKeyServerLocal(config Config, storage storage.Storage,
 
 // NewKeyServerMemory returns a KeyServerLocal with an in-memory leveldb
 // instance.
-func NewKeyServerMemory(config Config) (*KeyServerLocal, error) {
+func NewKeyServerMemory(config keyServerLocalConfig) (*KeyServerLocal, error) {
 	return newKeyServerLocal(config, storage.NewMemStorage(), nil)
 }
 
 func newKeyServerDisk(
-	config Config, dirPath string, shutdownFunc func(logger.Logger)) (
+	config keyServerLocalConfig, dirPath string, shutdownFunc func(logger.Logger)) (
 	*KeyServerLocal, error) {
 	keyPath := filepath.Join(dirPath, "keys")
 	storage, err := storage.OpenFile(keyPath, false)
@@ -64,13 +73,13 @@ func newKeyServerDisk(
 
 // NewKeyServerDir constructs a new KeyServerLocal that stores its
 // data in the given directory.
-func NewKeyServerDir(config Config, dirPath string) (*KeyServerLocal, error) {
+func NewKeyServerDir(config keyServerLocalConfig, dirPath string) (*KeyServerLocal, error) {
 	return newKeyServerDisk(config, dirPath, nil)
 }
 
 // NewKeyServerTempDir constructs a new KeyServerLocal that stores its
 // data in a temp directory which is cleaned up on shutdown.
-func NewKeyServerTempDir(config Config) (*KeyServerLocal, error) {
+func NewKeyServerTempDir(config keyServerLocalConfig) (*KeyServerLocal, error) {
 	tempdir, err := ioutil.TempDir(os.TempDir(), "kbfs_keyserver_tmp")
 	if err != nil {
 		return nil, err
@@ -108,12 +117,12 @@ func (ks *KeyServerLocal) GetTLFCryptKeyServerHalf(ctx context.Context,
 		return kbfscrypto.TLFCryptKeyServerHalf{}, err
 	}
 
-	session, err := ks.config.KBPKI().GetCurrentSession(ctx)
+	session, err := ks.config.CurrentSessionGetter().GetCurrentSession(ctx)
 	if err != nil {
 		return kbfscrypto.TLFCryptKeyServerHalf{}, err
 	}
 
-	err = ks.config.Crypto().VerifyTLFCryptKeyServerHalfID(
+	err = ks.config.cryptoPure().VerifyTLFCryptKeyServerHalfID(
 		serverHalfID, session.UID, key, serverHalf)
 	if err != nil {
 		ks.log.CDebugf(ctx, "error verifying server half ID: %+v", err)
@@ -138,7 +147,7 @@ func (ks *KeyServerLocal) PutTLFCryptKeyServerHalves(ctx context.Context,
 
 	// batch up the writes such that they're atomic.
 	batch := &leveldb.Batch{}
-	crypto := ks.config.Crypto()
+	crypto := ks.config.cryptoPure()
 	for uid, deviceMap := range keyServerHalves {
 		for deviceKey, serverHalf := range deviceMap {
 			buf, err := ks.config.Codec().Encode(serverHalf)
@@ -179,7 +188,7 @@ func (ks *KeyServerLocal) DeleteTLFCryptKeyServerHalf(ctx context.Context,
 }
 
 // Copies a key server but swaps the config.
-func (ks *KeyServerLocal) copy(config Config) *KeyServerLocal {
+func (ks *KeyServerLocal) copy(config keyServerLocalConfig) *KeyServerLocal {
 	return &KeyServerLocal{config, ks.db, config.MakeLogger(""),
 		ks.shutdownLock, ks.shutdown, ks.shutdownFunc}
 }
@@ -0,0 +1,92 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"path/filepath"
+
+	"github.com/keybase/kbfs/ioutil"
+	"github.com/keybase/kbfs/kbfscodec"
+	"github.com/keybase/kbfs/tlf"
+)
+
+// manualCRDir is the name of the directory, under the storage root,
+// holding the saved manual conflict resolution state: the TLFs that
+// are in manual mode, and the unmerged branch of each TLF that was
+// set aside for manual resolution, if any.  Both need to survive a
+// restart, or a set-aside branch would be resolved automatically as
+// soon as KBFS started up again.
+const manualCRDir = "kbfs_manual_cr"
+
+func manualCRTlfsPath(storageRoot string) string {
+	return filepath.Join(storageRoot, manualCRDir, "tlfs")
+}
+
+func parkedBranchIDPath(storageRoot string, tlfID tlf.ID) string {
+	return filepath.Join(storageRoot, manualCRDir, "parked", tlfID.String())
+}
+
+// readManualCRTlfs returns the saved set of TLFs in manual conflict
+// resolution mode.
+func readManualCRTlfs(codec kbfscodec.Codec, storageRoot string) (
+	map[tlf.ID]bool, error) {
+	tlfs := make(map[tlf.ID]bool)
+	var tlfIDs []tlf.ID
+	err := kbfscodec.DeserializeFromFile(
+		codec, manualCRTlfsPath(storageRoot), &tlfIDs)
+	if ioutil.IsNotExist(err) {
+		return tlfs, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, tlfID := range tlfIDs {
+		tlfs[tlfID] = true
+	}
+	return tlfs, nil
+}
+
+// writeManualCRTlfs saves the given set of TLFs in manual conflict
+// resolution mode.
+func writeManualCRTlfs(codec kbfscodec.Codec, storageRoot string,
+	tlfs map[tlf.ID]bool) error {
+	tlfIDs := make([]tlf.ID, 0, len(tlfs))
+	for tlfID := range tlfs {
+		tlfIDs = append(tlfIDs, tlfID)
+	}
+	return kbfscodec.SerializeToFile(
+		codec, tlfIDs, manualCRTlfsPath(storageRoot))
+}
+
+// readParkedBranchID returns the saved ID of the unmerged branch of
+// the given TLF that was set aside for manual conflict resolution,
+// or NullBranchID if there isn't one.
+func readParkedBranchID(codec kbfscodec.Codec, storageRoot string,
+	tlfID tlf.ID) (BranchID, error) {
+	var bid BranchID
+	err := kbfscodec.DeserializeFromFile(
+		codec, parkedBranchIDPath(storageRoot, tlfID), &bid)
+	if ioutil.IsNotExist(err) {
+		return NullBranchID, nil
+	} else if err != nil {
+		return NullBranchID, err
+	}
+	return bid, nil
+}
+
+// writeParkedBranchID saves the ID of the unmerged branch of the
+// given TLF that was set aside for manual conflict resolution.
+// Saving NullBranchID removes the saved ID.
+func writeParkedBranchID(codec kbfscodec.Codec, storageRoot string,
+	tlfID tlf.ID, bid BranchID) error {
+	p := parkedBranchIDPath(storageRoot, tlfID)
+	if bid == NullBranchID {
+		err := ioutil.Remove(p)
+		if ioutil.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return kbfscodec.SerializeToFile(codec, bid, p)
+}
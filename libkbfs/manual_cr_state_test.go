@@ -0,0 +1,58 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"os"
+	"testing"
+
+	"github.com/keybase/kbfs/ioutil"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManualCRStatePersisted(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "alice")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	tempdir, err := ioutil.TempDir(os.TempDir(), "manual_cr_state")
+	require.NoError(t, err)
+	defer func() {
+		err := ioutil.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+	config.storageRoot = tempdir
+	config.manualCRTlfs = nil
+
+	id := tlf.FakeID(1, tlf.Private)
+	require.False(t, config.IsManualConflictResolution(id))
+	err = config.SetManualConflictResolution(id, true)
+	require.NoError(t, err)
+
+	t.Log("Manual mode is reloaded after a restart")
+	config.manualCRTlfs = nil
+	require.True(t, config.IsManualConflictResolution(id))
+	err = config.SetManualConflictResolution(id, false)
+	require.NoError(t, err)
+	config.manualCRTlfs = nil
+	require.False(t, config.IsManualConflictResolution(id))
+
+	t.Log("The parked branch ID is saved until it's cleared")
+	bid, err := readParkedBranchID(config.Codec(), tempdir, id)
+	require.NoError(t, err)
+	require.Equal(t, NullBranchID, bid)
+	err = writeParkedBranchID(config.Codec(), tempdir, id, FakeBranchID(1))
+	require.NoError(t, err)
+	bid, err = readParkedBranchID(config.Codec(), tempdir, id)
+	require.NoError(t, err)
+	require.Equal(t, FakeBranchID(1), bid)
+	err = writeParkedBranchID(config.Codec(), tempdir, id, NullBranchID)
+	require.NoError(t, err)
+	bid, err = readParkedBranchID(config.Codec(), tempdir, id)
+	require.NoError(t, err)
+	require.Equal(t, NullBranchID, bid)
+	err = writeParkedBranchID(config.Codec(), tempdir, id, NullBranchID)
+	require.NoError(t, err)
+}
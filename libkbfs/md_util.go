@@ -6,6 +6,7 @@ package libkbfs
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/keybase/client/go/libkb"
 	"github.com/keybase/client/go/logger"
@@ -181,6 +182,45 @@ func getSingleMD(ctx context.Context, config Config, id tlf.ID, bid BranchID,
 	return rmds[0], nil
 }
 
+// getMergedRevisionForTime returns the latest merged revision of the
+// given TLF whose MD was written at or before the given time,
+// according to the local timestamps of the MDs.  `head` must be the
+// current merged head of the TLF.  It does a binary search over the
+// merged revisions, so it only fetches O(log n) MDs, and it relies on
+// local timestamps increasing along with revision numbers.
+func getMergedRevisionForTime(ctx context.Context, config Config,
+	head ImmutableRootMetadata, t time.Time) (kbfsmd.Revision, error) {
+	id := head.TlfID()
+	if !head.localTimestamp.After(t) {
+		return head.Revision(), nil
+	}
+
+	// Invariant: `lo` was written at or before `t`, and `hi` was
+	// written after `t`.
+	lo, hi := kbfsmd.RevisionInitial, head.Revision()
+	first, err := getSingleMD(ctx, config, id, NullBranchID, lo, Merged)
+	if err != nil {
+		return kbfsmd.RevisionUninitialized, err
+	}
+	if first.localTimestamp.After(t) {
+		return kbfsmd.RevisionUninitialized, NoRevisionAtTimeError{id, t}
+	}
+
+	for hi-lo > 1 {
+		mid := lo + (hi-lo)/2
+		rmd, err := getSingleMD(ctx, config, id, NullBranchID, mid, Merged)
+		if err != nil {
+			return kbfsmd.RevisionUninitialized, err
+		}
+		if rmd.localTimestamp.After(t) {
+			hi = mid
+		} else {
+			lo = mid
+		}
+	}
+	return lo, nil
+}
+
 // getMergedMDUpdates returns a slice of all the merged MDs for a TLF,
 // starting from the given startRev.  The returned MDs are the same
 // instances that are stored in the MD cache, so they should be
@@ -25,8 +25,8 @@ import (
 type mdServerDiskShared struct {
 	dirPath string
 
-	// Protects handleDb, branchDb, tlfStorage, and
-	// truncateLockManager. After Shutdown() is called, handleDb,
+	// Protects handleDb, branchDb, tlfStorage, truncateLockManager
+	// and pathLockManager. After Shutdown() is called, handleDb,
 	// branchDb, tlfStorage, and truncateLockManager are nil.
 	lock sync.RWMutex
 	// Bare TLF handle -> TLF ID
@@ -37,6 +37,7 @@ type mdServerDiskShared struct {
 	// Always use memory for the lock storage, so it gets wiped
 	// after a restart.
 	truncateLockManager *mdServerLocalTruncateLockManager
+	pathLockManager     *mdServerLocalPathLockManager
 
 	updateManager *mdServerLocalUpdateManager
 
@@ -69,12 +70,14 @@ func newMDServerDisk(config mdServerLocalConfig, dirPath string,
 	}
 	log := config.MakeLogger("MDSD")
 	truncateLockManager := newMDServerLocalTruncatedLockManager()
+	pathLockManager := newMDServerLocalPathLockManager()
 	shared := mdServerDiskShared{
 		dirPath:             dirPath,
 		handleDb:            handleDb,
 		branchDb:            branchDb,
 		tlfStorage:          make(map[tlf.ID]*mdServerTlfStorage),
 		truncateLockManager: &truncateLockManager,
+		pathLockManager:     &pathLockManager,
 		updateManager:       newMDServerLocalUpdateManager(),
 		shutdownFunc:        shutdownFunc,
 	}
@@ -540,6 +543,62 @@ func (md *MDServerDisk) TruncateUnlock(ctx context.Context, id tlf.ID) (
 	return md.truncateLockManager.truncateUnlock(session.CryptPublicKey, id)
 }
 
+// AcquirePathLock implements the MDServer interface for MDServerDisk.
+func (md *MDServerDisk) AcquirePathLock(ctx context.Context, id tlf.ID,
+	key PathLockKey, leaseID PathLeaseID, duration time.Duration) (
+	time.Time, error) {
+	if err := checkContext(ctx); err != nil {
+		return time.Time{}, err
+	}
+
+	md.lock.Lock()
+	defer md.lock.Unlock()
+	err := md.checkShutdownLocked()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return md.pathLockManager.acquire(
+		md.config.Clock().Now(), id, key, leaseID, duration)
+}
+
+// RenewPathLock implements the MDServer interface for MDServerDisk.
+func (md *MDServerDisk) RenewPathLock(ctx context.Context, id tlf.ID,
+	key PathLockKey, leaseID PathLeaseID, duration time.Duration) (
+	time.Time, error) {
+	if err := checkContext(ctx); err != nil {
+		return time.Time{}, err
+	}
+
+	md.lock.Lock()
+	defer md.lock.Unlock()
+	err := md.checkShutdownLocked()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return md.pathLockManager.renew(
+		md.config.Clock().Now(), id, key, leaseID, duration)
+}
+
+// ReleasePathLock implements the MDServer interface for MDServerDisk.
+func (md *MDServerDisk) ReleasePathLock(ctx context.Context, id tlf.ID,
+	key PathLockKey, leaseID PathLeaseID) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	md.lock.Lock()
+	defer md.lock.Unlock()
+	err := md.checkShutdownLocked()
+	if err != nil {
+		return err
+	}
+
+	md.pathLockManager.release(id, key, leaseID)
+	return nil
+}
+
 // Shutdown implements the MDServer interface for MDServerDisk.
 func (md *MDServerDisk) Shutdown() {
 	md.lock.Lock()
@@ -6,6 +6,7 @@ package libkbfs
 
 import (
 	"sync"
+	"time"
 
 	"github.com/keybase/client/go/protocol/keybase1"
 	"github.com/keybase/kbfs/kbfscodec"
@@ -125,6 +126,73 @@ func (m mdServerLocalTruncateLockManager) truncateUnlock(
 	return false, kbfsmd.ServerErrorLocked{}
 }
 
+type mdServerLocalPathLease struct {
+	leaseID PathLeaseID
+	expiry  time.Time
+}
+
+// mdServerLocalPathLockManager manages the path lock leases for a
+// set of TLFs. Note that it is not goroutine-safe.
+type mdServerLocalPathLockManager struct {
+	// TLF ID -> path lock key -> lease
+	locksDb map[tlf.ID]map[PathLockKey]mdServerLocalPathLease
+}
+
+func newMDServerLocalPathLockManager() mdServerLocalPathLockManager {
+	return mdServerLocalPathLockManager{
+		locksDb: make(map[tlf.ID]map[PathLockKey]mdServerLocalPathLease),
+	}
+}
+
+func (m mdServerLocalPathLockManager) acquire(
+	now time.Time, id tlf.ID, key PathLockKey, leaseID PathLeaseID,
+	duration time.Duration) (time.Time, error) {
+	leases, ok := m.locksDb[id]
+	if !ok {
+		leases = make(map[PathLockKey]mdServerLocalPathLease)
+		m.locksDb[id] = leases
+	}
+
+	lease, ok := leases[key]
+	if ok && lease.leaseID != leaseID && now.Before(lease.expiry) {
+		// Leased by someone else.
+		return time.Time{}, kbfsmd.ServerErrorLocked{}
+	}
+
+	expiry := now.Add(duration)
+	leases[key] = mdServerLocalPathLease{leaseID, expiry}
+	return expiry, nil
+}
+
+func (m mdServerLocalPathLockManager) renew(
+	now time.Time, id tlf.ID, key PathLockKey, leaseID PathLeaseID,
+	duration time.Duration) (time.Time, error) {
+	lease, ok := m.locksDb[id][key]
+	if !ok || lease.leaseID != leaseID || !now.Before(lease.expiry) {
+		// The lease was lost, and someone else might have taken
+		// and released it in the meantime.
+		return time.Time{}, kbfsmd.ServerErrorLocked{}
+	}
+
+	expiry := now.Add(duration)
+	m.locksDb[id][key] = mdServerLocalPathLease{leaseID, expiry}
+	return expiry, nil
+}
+
+func (m mdServerLocalPathLockManager) release(
+	id tlf.ID, key PathLockKey, leaseID PathLeaseID) {
+	leases, ok := m.locksDb[id]
+	if !ok {
+		return
+	}
+	if lease, ok := leases[key]; ok && lease.leaseID == leaseID {
+		delete(leases, key)
+	}
+	if len(leases) == 0 {
+		delete(m.locksDb, id)
+	}
+}
+
 // mdServerLocalUpdateManager manages the observers for a set of TLFs
 // referenced by multiple mdServerLocal instances sharing the same
 // data. It is goroutine-safe.
@@ -55,9 +55,9 @@ type mdBlockMemList struct {
 }
 
 type mdServerMemShared struct {
-	// Protects all *db variables and truncateLockManager. After
-	// Shutdown() is called, all *db variables and
-	// truncateLockManager are nil.
+	// Protects all *db variables and the lock managers. After
+	// Shutdown() is called, all *db variables and the lock managers
+	// are nil.
 	lock sync.RWMutex
 	// Bare TLF handle -> TLF ID
 	handleDb map[mdHandleKey]tlf.ID
@@ -72,6 +72,7 @@ type mdServerMemShared struct {
 	// (TLF ID, crypt public key) -> branch ID
 	branchDb            map[mdBranchKey]BranchID
 	truncateLockManager *mdServerLocalTruncateLockManager
+	pathLockManager     *mdServerLocalPathLockManager
 
 	updateManager *mdServerLocalUpdateManager
 }
@@ -97,6 +98,7 @@ func NewMDServerMemory(config mdServerLocalConfig) (*MDServerMemory, error) {
 	readerKeyBundleDb := make(map[mdExtraReaderKey]TLFReaderKeyBundleV3)
 	log := config.MakeLogger("MDSM")
 	truncateLockManager := newMDServerLocalTruncatedLockManager()
+	pathLockManager := newMDServerLocalPathLockManager()
 	shared := mdServerMemShared{
 		handleDb:            handleDb,
 		latestHandleDb:      latestHandleDb,
@@ -105,6 +107,7 @@ func NewMDServerMemory(config mdServerLocalConfig) (*MDServerMemory, error) {
 		writerKeyBundleDb:   writerKeyBundleDb,
 		readerKeyBundleDb:   readerKeyBundleDb,
 		truncateLockManager: &truncateLockManager,
+		pathLockManager:     &pathLockManager,
 		updateManager:       newMDServerLocalUpdateManager(),
 	}
 	mdserv := &MDServerMemory{config, log, &shared}
@@ -681,6 +684,62 @@ func (md *MDServerMemory) TruncateUnlock(ctx context.Context, id tlf.ID) (
 	return md.truncateLockManager.truncateUnlock(myKey, id)
 }
 
+// AcquirePathLock implements the MDServer interface for MDServerMemory.
+func (md *MDServerMemory) AcquirePathLock(ctx context.Context, id tlf.ID,
+	key PathLockKey, leaseID PathLeaseID, duration time.Duration) (
+	time.Time, error) {
+	if err := checkContext(ctx); err != nil {
+		return time.Time{}, err
+	}
+
+	md.lock.Lock()
+	defer md.lock.Unlock()
+	err := md.checkShutdownRLocked()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return md.pathLockManager.acquire(
+		md.config.Clock().Now(), id, key, leaseID, duration)
+}
+
+// RenewPathLock implements the MDServer interface for MDServerMemory.
+func (md *MDServerMemory) RenewPathLock(ctx context.Context, id tlf.ID,
+	key PathLockKey, leaseID PathLeaseID, duration time.Duration) (
+	time.Time, error) {
+	if err := checkContext(ctx); err != nil {
+		return time.Time{}, err
+	}
+
+	md.lock.Lock()
+	defer md.lock.Unlock()
+	err := md.checkShutdownRLocked()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return md.pathLockManager.renew(
+		md.config.Clock().Now(), id, key, leaseID, duration)
+}
+
+// ReleasePathLock implements the MDServer interface for MDServerMemory.
+func (md *MDServerMemory) ReleasePathLock(ctx context.Context, id tlf.ID,
+	key PathLockKey, leaseID PathLeaseID) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	md.lock.Lock()
+	defer md.lock.Unlock()
+	err := md.checkShutdownRLocked()
+	if err != nil {
+		return err
+	}
+
+	md.pathLockManager.release(id, key, leaseID)
+	return nil
+}
+
 // Shutdown implements the MDServer interface for MDServerMemory.
 func (md *MDServerMemory) Shutdown() {
 	md.lock.Lock()
@@ -689,6 +748,7 @@ func (md *MDServerMemory) Shutdown() {
 	md.latestHandleDb = nil
 	md.branchDb = nil
 	md.truncateLockManager = nil
+	md.pathLockManager = nil
 }
 
 // IsConnected implements the MDServer interface for MDServerMemory.
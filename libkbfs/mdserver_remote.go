@@ -37,6 +37,9 @@ const (
 	// MdServerPingTimeout is how long to wait for a ping response
 	// before breaking the connection and trying to reconnect.
 	MdServerPingTimeout = 30 * time.Second
+	// mdServerPathLockTimeout is how long to wait for a path lock
+	// held by another session before giving up.
+	mdServerPathLockTimeout = 5 * time.Second
 )
 
 // MDServerRemote is an implementation of the MDServer interface.
@@ -831,6 +834,70 @@ func (md *MDServerRemote) TruncateUnlock(ctx context.Context, id tlf.ID) (
 	return md.getClient().TruncateUnlock(ctx, id.String())
 }
 
+// lockPath takes the server-side lock for the given path lock key.
+// The server identifies lock holders by session rather than by lease
+// ID, and picks its own lease TTL, so `duration` is only used to
+// compute the expiry reported to the caller.
+func (md *MDServerRemote) lockPath(ctx context.Context, id tlf.ID,
+	key PathLockKey, duration time.Duration) (time.Time, error) {
+	// The server makes the RPC layer retry while another session
+	// holds the lock, so bound how long we're willing to wait.
+	lockCtx, cancel := context.WithTimeout(ctx, mdServerPathLockTimeout)
+	defer cancel()
+	err := md.getClient().Lock(lockCtx, keybase1.LockArg{
+		FolderID: id.String(),
+		LockID:   key.lockID(),
+	})
+	if err == context.DeadlineExceeded && ctx.Err() == nil {
+		return time.Time{}, kbfsmd.ServerErrorLocked{}
+	} else if err != nil {
+		return time.Time{}, err
+	}
+	return md.config.Clock().Now().Add(duration), nil
+}
+
+// AcquirePathLock implements the MDServer interface for MDServerRemote.
+func (md *MDServerRemote) AcquirePathLock(ctx context.Context, id tlf.ID,
+	key PathLockKey, leaseID PathLeaseID, duration time.Duration) (
+	expiry time.Time, err error) {
+	ctx = rpc.WithFireNow(ctx)
+	md.log.LazyTrace(ctx, "MDServer: AcquirePathLock %s %s", id, key)
+	defer func() {
+		md.deferLog.LazyTrace(ctx, "MDServer: AcquirePathLock %s %s (err=%v)",
+			id, key, err)
+	}()
+	return md.lockPath(ctx, id, key, duration)
+}
+
+// RenewPathLock implements the MDServer interface for MDServerRemote.
+func (md *MDServerRemote) RenewPathLock(ctx context.Context, id tlf.ID,
+	key PathLockKey, leaseID PathLeaseID, duration time.Duration) (
+	expiry time.Time, err error) {
+	ctx = rpc.WithFireNow(ctx)
+	md.log.LazyTrace(ctx, "MDServer: RenewPathLock %s %s", id, key)
+	defer func() {
+		md.deferLog.LazyTrace(ctx, "MDServer: RenewPathLock %s %s (err=%v)",
+			id, key, err)
+	}()
+	// Taking the lock is idempotent for the session that holds it.
+	return md.lockPath(ctx, id, key, duration)
+}
+
+// ReleasePathLock implements the MDServer interface for MDServerRemote.
+func (md *MDServerRemote) ReleasePathLock(ctx context.Context, id tlf.ID,
+	key PathLockKey, leaseID PathLeaseID) (err error) {
+	ctx = rpc.WithFireNow(ctx)
+	md.log.LazyTrace(ctx, "MDServer: ReleasePathLock %s %s", id, key)
+	defer func() {
+		md.deferLog.LazyTrace(ctx, "MDServer: ReleasePathLock %s %s (err=%v)",
+			id, key, err)
+	}()
+	return md.getClient().ReleaseLock(ctx, keybase1.ReleaseLockArg{
+		FolderID: id.String(),
+		LockID:   key.lockID(),
+	})
+}
+
 // GetLatestHandleForTLF implements the MDServer interface for MDServerRemote.
 func (md *MDServerRemote) GetLatestHandleForTLF(ctx context.Context, id tlf.ID) (
 	handle tlf.Handle, err error) {
@@ -0,0 +1,679 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/kbfscodec"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// mdServerRPCHandler serves the MD server and key server RPC
+// protocols for a single connection, by translating them into calls
+// on per-connection copies of the KBFSServer's local servers.
+type mdServerRPCHandler struct {
+	// ctx is the connection's context, used for things that outlive
+	// a single RPC.
+	ctx          context.Context
+	codec        kbfscodec.Codec
+	clock        Clock
+	log          logger.Logger
+	auth         *kbfsServerAuth
+	mdServer     mdServerLocal
+	keyServer    *KeyServerLocal
+	updateClient keybase1.MetadataUpdateClient
+	leaseID      PathLeaseID
+
+	lock sync.Mutex
+	// registered holds the TLFs this connection is registered
+	// for updates on.
+	registered map[tlf.ID]bool
+	// locks holds the path locks this connection might hold, so
+	// they can be released when it goes away.
+	locks map[tlf.ID]map[PathLockKey]bool
+}
+
+var _ keybase1.MetadataInterface = (*mdServerRPCHandler)(nil)
+
+func newMDServerRPCHandler(ctx context.Context, s *KBFSServer,
+	updateClient keybase1.MetadataUpdateClient) (
+	*mdServerRPCHandler, error) {
+	leaseID, err := makeRandomPathLeaseID()
+	if err != nil {
+		return nil, err
+	}
+	auth := newKBFSServerAuth(
+		MdServerTokenServer, MdServerTokenExpireIn, s.clock)
+	config := kbfsServerConnConfig{s, auth}
+	return &mdServerRPCHandler{
+		ctx:          ctx,
+		codec:        s.codec,
+		clock:        s.clock,
+		log:          s.log,
+		auth:         auth,
+		mdServer:     s.mdServer.copy(config),
+		keyServer:    s.keyServer.copy(config),
+		updateClient: updateClient,
+		leaseID:      leaseID,
+		registered:   make(map[tlf.ID]bool),
+		locks:        make(map[tlf.ID]map[PathLockKey]bool),
+	}, nil
+}
+
+// checkAuth returns an error if the connection hasn't authenticated
+// yet, or if its token has expired.
+func (h *mdServerRPCHandler) checkAuth(ctx context.Context) error {
+	_, err := h.auth.GetCurrentSession(ctx)
+	if err != nil {
+		return kbfsmd.ServerErrorUnauthorized{Err: err}
+	}
+	return nil
+}
+
+func (h *mdServerRPCHandler) parseTlfID(folderID string) (tlf.ID, error) {
+	id, err := tlf.ParseID(folderID)
+	if err != nil {
+		return tlf.NullID, kbfsmd.ServerErrorBadRequest{Reason: err.Error()}
+	}
+	return id, nil
+}
+
+// GetChallenge implements the MetadataInterface for
+// mdServerRPCHandler.
+func (h *mdServerRPCHandler) GetChallenge(_ context.Context) (
+	keybase1.ChallengeInfo, error) {
+	return h.auth.getChallenge()
+}
+
+// Authenticate implements the MetadataInterface for
+// mdServerRPCHandler.
+func (h *mdServerRPCHandler) Authenticate(
+	ctx context.Context, signature string) (int, error) {
+	session, err := h.auth.authenticate(signature)
+	if err != nil {
+		return 0, kbfsmd.ServerErrorUnauthorized{Err: err}
+	}
+	h.log.CDebugf(h.ctx, "Authenticated MD session for %s (%s)",
+		session.Name, session.UID)
+	return MdServerDefaultPingIntervalSeconds, nil
+}
+
+// PutMetadata implements the MetadataInterface for
+// mdServerRPCHandler.
+func (h *mdServerRPCHandler) PutMetadata(
+	ctx context.Context, arg keybase1.PutMetadataArg) error {
+	if err := h.checkAuth(ctx); err != nil {
+		return err
+	}
+	if arg.LockContext != nil {
+		return kbfsmd.ServerErrorBadRequest{
+			Reason: "Lock contexts are not supported"}
+	}
+
+	ver := MetadataVer(arg.MdBlock.Version)
+	// The TLF ID isn't known until the block is decoded, and is only
+	// used for error messages.
+	rmds, err := DecodeRootMetadataSigned(
+		h.codec, tlf.NullID, ver, SegregatedKeyBundlesVer,
+		arg.MdBlock.Block, time.Time{})
+	if err != nil {
+		return kbfsmd.ServerErrorBadRequest{Reason: err.Error()}
+	}
+
+	extra, err := h.makeExtraForPut(ctx, rmds, arg)
+	if err != nil {
+		return err
+	}
+	return h.mdServer.Put(ctx, rmds, extra)
+}
+
+// makeExtraForPut reassembles the key bundles for the given MD.
+// Clients only send the key bundles that are new with this MD, so
+// the rest have to be looked up from the ones that were previously
+// put.
+func (h *mdServerRPCHandler) makeExtraForPut(ctx context.Context,
+	rmds *RootMetadataSigned, arg keybase1.PutMetadataArg) (
+	ExtraMetadata, error) {
+	if rmds.Version() < SegregatedKeyBundlesVer {
+		if arg.WriterKeyBundle.Bundle != nil ||
+			arg.ReaderKeyBundle.Bundle != nil {
+			return nil, kbfsmd.ServerErrorBadRequest{
+				Reason: "Unexpected key bundles for pre-v3 MD"}
+		}
+		return nil, nil
+	}
+
+	var wkb TLFWriterKeyBundleV3
+	var rkb TLFReaderKeyBundleV3
+	wkbNew := arg.WriterKeyBundle.Bundle != nil
+	rkbNew := arg.ReaderKeyBundle.Bundle != nil
+	if wkbNew {
+		err := h.codec.Decode(arg.WriterKeyBundle.Bundle, &wkb)
+		if err != nil {
+			return nil, kbfsmd.ServerErrorBadRequest{Reason: err.Error()}
+		}
+	}
+	if rkbNew {
+		err := h.codec.Decode(arg.ReaderKeyBundle.Bundle, &rkb)
+		if err != nil {
+			return nil, kbfsmd.ServerErrorBadRequest{Reason: err.Error()}
+		}
+	}
+
+	wkbID := rmds.MD.GetTLFWriterKeyBundleID()
+	rkbID := rmds.MD.GetTLFReaderKeyBundleID()
+	if wkbID == (TLFWriterKeyBundleID{}) &&
+		rkbID == (TLFReaderKeyBundleID{}) {
+		// Nothing to look up (e.g., for public TLFs).
+		return nil, nil
+	}
+
+	if !wkbNew || !rkbNew {
+		var getWKBID TLFWriterKeyBundleID
+		var getRKBID TLFReaderKeyBundleID
+		if !wkbNew {
+			getWKBID = wkbID
+		}
+		if !rkbNew {
+			getRKBID = rkbID
+		}
+		foundWKB, foundRKB, err := h.mdServer.GetKeyBundles(
+			ctx, rmds.MD.TlfID(), getWKBID, getRKBID)
+		if err != nil {
+			return nil, kbfsmd.ServerError{Err: err}
+		}
+		if !wkbNew {
+			if foundWKB == nil {
+				return nil, kbfsmd.ServerErrorBadRequest{
+					Reason: "Unknown writer key bundle " +
+						wkbID.String()}
+			}
+			wkb = *foundWKB
+		}
+		if !rkbNew {
+			if foundRKB == nil {
+				return nil, kbfsmd.ServerErrorBadRequest{
+					Reason: "Unknown reader key bundle " +
+						rkbID.String()}
+			}
+			rkb = *foundRKB
+		}
+	}
+	return NewExtraMetadataV3(wkb, rkb, wkbNew, rkbNew), nil
+}
+
+// GetMetadata implements the MetadataInterface for
+// mdServerRPCHandler.
+func (h *mdServerRPCHandler) GetMetadata(
+	ctx context.Context, arg keybase1.GetMetadataArg) (
+	keybase1.MetadataResponse, error) {
+	if err := h.checkAuth(ctx); err != nil {
+		return keybase1.MetadataResponse{}, err
+	}
+	if arg.LockBeforeGet != nil {
+		return keybase1.MetadataResponse{}, kbfsmd.ServerErrorBadRequest{
+			Reason: "Locking before a get is not supported"}
+	}
+
+	bid := NullBranchID
+	if arg.BranchID != "" {
+		var err error
+		bid, err = ParseBranchID(arg.BranchID)
+		if err != nil {
+			return keybase1.MetadataResponse{},
+				kbfsmd.ServerErrorBadRequest{Reason: err.Error()}
+		}
+	}
+	mStatus := Merged
+	if arg.Unmerged {
+		mStatus = Unmerged
+	}
+
+	var id tlf.ID
+	var rmdses []*RootMetadataSigned
+	if arg.FolderHandle != nil {
+		var handle tlf.Handle
+		err := h.codec.Decode(arg.FolderHandle, &handle)
+		if err != nil {
+			return keybase1.MetadataResponse{},
+				kbfsmd.ServerErrorBadRequest{Reason: err.Error()}
+		}
+		var rmds *RootMetadataSigned
+		id, rmds, err = h.mdServer.GetForHandle(ctx, handle, mStatus)
+		if err != nil {
+			return keybase1.MetadataResponse{}, err
+		}
+		if rmds != nil {
+			rmdses = append(rmdses, rmds)
+		}
+	} else {
+		var err error
+		id, err = h.parseTlfID(arg.FolderID)
+		if err != nil {
+			return keybase1.MetadataResponse{}, err
+		}
+		if arg.StartRevision == 0 && arg.StopRevision == 0 {
+			rmds, err := h.mdServer.GetForTLF(ctx, id, bid, mStatus)
+			if err != nil {
+				return keybase1.MetadataResponse{}, err
+			}
+			if rmds != nil {
+				rmdses = append(rmdses, rmds)
+			}
+		} else {
+			rmdses, err = h.mdServer.GetRange(ctx, id, bid, mStatus,
+				kbfsmd.Revision(arg.StartRevision),
+				kbfsmd.Revision(arg.StopRevision))
+			if err != nil {
+				return keybase1.MetadataResponse{}, err
+			}
+		}
+	}
+
+	mdBlocks := make([]keybase1.MDBlock, 0, len(rmdses))
+	for _, rmds := range rmdses {
+		buf, err := EncodeRootMetadataSigned(h.codec, rmds)
+		if err != nil {
+			return keybase1.MetadataResponse{}, kbfsmd.ServerError{Err: err}
+		}
+		mdBlocks = append(mdBlocks, keybase1.MDBlock{
+			Version:   int(rmds.Version()),
+			Timestamp: keybase1.ToTime(rmds.untrustedServerTimestamp),
+			Block:     buf,
+		})
+	}
+	return keybase1.MetadataResponse{
+		FolderID: id.String(),
+		MdBlocks: mdBlocks,
+	}, nil
+}
+
+// RegisterForUpdates implements the MetadataInterface for
+// mdServerRPCHandler.  Registering again for a TLF that already has
+// a pending registration is a no-op.
+func (h *mdServerRPCHandler) RegisterForUpdates(
+	ctx context.Context, arg keybase1.RegisterForUpdatesArg) error {
+	if err := h.checkAuth(ctx); err != nil {
+		return err
+	}
+	id, err := h.parseTlfID(arg.FolderID)
+	if err != nil {
+		return err
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.registered[id] {
+		return nil
+	}
+	c, err := h.mdServer.RegisterForUpdate(
+		ctx, id, kbfsmd.Revision(arg.CurrRevision))
+	if err != nil {
+		return err
+	}
+	h.registered[id] = true
+	go h.waitForUpdate(id, c)
+	return nil
+}
+
+// waitForUpdate sends an update notification to the client once the
+// given registration fires, unless it was canceled.
+func (h *mdServerRPCHandler) waitForUpdate(id tlf.ID, c <-chan error) {
+	err := <-c
+	func() {
+		h.lock.Lock()
+		defer h.lock.Unlock()
+		delete(h.registered, id)
+	}()
+	if err != nil {
+		// The registration was canceled.
+		return
+	}
+
+	head, err := h.mdServer.GetForTLF(h.ctx, id, NullBranchID, Merged)
+	if err != nil {
+		h.log.CDebugf(h.ctx, "Couldn't get head for %s: %+v", id, err)
+		return
+	}
+	rev := kbfsmd.RevisionUninitialized
+	if head != nil {
+		rev = head.MD.RevisionNumber()
+	}
+	err = h.updateClient.MetadataUpdate(h.ctx, keybase1.MetadataUpdateArg{
+		FolderID: id.String(),
+		Revision: rev.Number(),
+	})
+	if err != nil {
+		h.log.CDebugf(h.ctx, "Couldn't send update for %s: %+v", id, err)
+	}
+}
+
+// PruneBranch implements the MetadataInterface for
+// mdServerRPCHandler.
+func (h *mdServerRPCHandler) PruneBranch(
+	ctx context.Context, arg keybase1.PruneBranchArg) error {
+	if err := h.checkAuth(ctx); err != nil {
+		return err
+	}
+	id, err := h.parseTlfID(arg.FolderID)
+	if err != nil {
+		return err
+	}
+	bid, err := ParseBranchID(arg.BranchID)
+	if err != nil {
+		return kbfsmd.ServerErrorBadRequest{Reason: err.Error()}
+	}
+	return h.mdServer.PruneBranch(ctx, id, bid)
+}
+
+// PutKeys implements the MetadataInterface for mdServerRPCHandler.
+func (h *mdServerRPCHandler) PutKeys(
+	ctx context.Context, arg keybase1.PutKeysArg) error {
+	if err := h.checkAuth(ctx); err != nil {
+		return err
+	}
+	keyServerHalves := make(UserDeviceKeyServerHalves)
+	for _, keyHalf := range arg.KeyHalves {
+		var serverHalf kbfscrypto.TLFCryptKeyServerHalf
+		err := h.codec.Decode(keyHalf.Key, &serverHalf)
+		if err != nil {
+			return kbfsmd.ServerErrorBadRequest{Reason: err.Error()}
+		}
+		if keyServerHalves[keyHalf.User] == nil {
+			keyServerHalves[keyHalf.User] =
+				make(DeviceKeyServerHalves)
+		}
+		deviceKey := kbfscrypto.MakeCryptPublicKey(keyHalf.DeviceKID)
+		keyServerHalves[keyHalf.User][deviceKey] = serverHalf
+	}
+	return h.keyServer.PutTLFCryptKeyServerHalves(ctx, keyServerHalves)
+}
+
+// GetKey implements the MetadataInterface for mdServerRPCHandler.
+func (h *mdServerRPCHandler) GetKey(
+	ctx context.Context, arg keybase1.GetKeyArg) ([]byte, error) {
+	if err := h.checkAuth(ctx); err != nil {
+		return nil, err
+	}
+	var serverHalfID TLFCryptKeyServerHalfID
+	err := h.codec.Decode(arg.KeyHalfID, &serverHalfID)
+	if err != nil {
+		return nil, kbfsmd.ServerErrorBadRequest{Reason: err.Error()}
+	}
+	kid, err := keybase1.KIDFromStringChecked(arg.DeviceKID)
+	if err != nil {
+		return nil, kbfsmd.ServerErrorBadRequest{Reason: err.Error()}
+	}
+	serverHalf, err := h.keyServer.GetTLFCryptKeyServerHalf(
+		ctx, serverHalfID, kbfscrypto.MakeCryptPublicKey(kid))
+	if err != nil {
+		return nil, err
+	}
+	return h.codec.Encode(serverHalf)
+}
+
+// DeleteKey implements the MetadataInterface for mdServerRPCHandler.
+func (h *mdServerRPCHandler) DeleteKey(
+	ctx context.Context, arg keybase1.DeleteKeyArg) error {
+	if err := h.checkAuth(ctx); err != nil {
+		return err
+	}
+	var serverHalfID TLFCryptKeyServerHalfID
+	err := h.codec.Decode(arg.KeyHalfID, &serverHalfID)
+	if err != nil {
+		return kbfsmd.ServerErrorBadRequest{Reason: err.Error()}
+	}
+	return h.keyServer.DeleteTLFCryptKeyServerHalf(ctx, arg.Uid,
+		kbfscrypto.MakeCryptPublicKey(arg.DeviceKID), serverHalfID)
+}
+
+// TruncateLock implements the MetadataInterface for
+// mdServerRPCHandler.
+func (h *mdServerRPCHandler) TruncateLock(
+	ctx context.Context, folderID string) (bool, error) {
+	if err := h.checkAuth(ctx); err != nil {
+		return false, err
+	}
+	id, err := h.parseTlfID(folderID)
+	if err != nil {
+		return false, err
+	}
+	return h.mdServer.TruncateLock(ctx, id)
+}
+
+// TruncateUnlock implements the MetadataInterface for
+// mdServerRPCHandler.
+func (h *mdServerRPCHandler) TruncateUnlock(
+	ctx context.Context, folderID string) (bool, error) {
+	if err := h.checkAuth(ctx); err != nil {
+		return false, err
+	}
+	id, err := h.parseTlfID(folderID)
+	if err != nil {
+		return false, err
+	}
+	return h.mdServer.TruncateUnlock(ctx, id)
+}
+
+// GetFolderHandle implements the MetadataInterface for
+// mdServerRPCHandler.
+func (h *mdServerRPCHandler) GetFolderHandle(
+	_ context.Context, _ keybase1.GetFolderHandleArg) ([]byte, error) {
+	return nil, kbfsmd.ServerErrorBadRequest{
+		Reason: "GetFolderHandle is not supported"}
+}
+
+// GetFoldersForRekey implements the MetadataInterface for
+// mdServerRPCHandler.  The server doesn't track which devices need
+// rekeys, so it never asks clients to do any.
+func (h *mdServerRPCHandler) GetFoldersForRekey(
+	ctx context.Context, _ keybase1.KID) error {
+	return h.checkAuth(ctx)
+}
+
+// Ping implements the MetadataInterface for mdServerRPCHandler.
+func (h *mdServerRPCHandler) Ping(_ context.Context) error {
+	return nil
+}
+
+// Ping2 implements the MetadataInterface for mdServerRPCHandler.
+func (h *mdServerRPCHandler) Ping2(_ context.Context) (
+	keybase1.PingResponse, error) {
+	return keybase1.PingResponse{
+		Timestamp: keybase1.ToTime(h.clock.Now()),
+	}, nil
+}
+
+// GetLatestFolderHandle implements the MetadataInterface for
+// mdServerRPCHandler.
+func (h *mdServerRPCHandler) GetLatestFolderHandle(
+	ctx context.Context, folderID string) ([]byte, error) {
+	if err := h.checkAuth(ctx); err != nil {
+		return nil, err
+	}
+	id, err := h.parseTlfID(folderID)
+	if err != nil {
+		return nil, err
+	}
+	handle, err := h.mdServer.GetLatestHandleForTLF(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return h.codec.Encode(handle)
+}
+
+// GetKeyBundles implements the MetadataInterface for
+// mdServerRPCHandler.
+func (h *mdServerRPCHandler) GetKeyBundles(
+	ctx context.Context, arg keybase1.GetKeyBundlesArg) (
+	keybase1.KeyBundleResponse, error) {
+	if err := h.checkAuth(ctx); err != nil {
+		return keybase1.KeyBundleResponse{}, err
+	}
+	id, err := h.parseTlfID(arg.FolderID)
+	if err != nil {
+		return keybase1.KeyBundleResponse{}, err
+	}
+	wkbID, err := TLFWriterKeyBundleIDFromString(arg.WriterBundleID)
+	if err != nil {
+		return keybase1.KeyBundleResponse{},
+			kbfsmd.ServerErrorBadRequest{Reason: err.Error()}
+	}
+	rkbID, err := TLFReaderKeyBundleIDFromString(arg.ReaderBundleID)
+	if err != nil {
+		return keybase1.KeyBundleResponse{},
+			kbfsmd.ServerErrorBadRequest{Reason: err.Error()}
+	}
+
+	wkb, rkb, err := h.mdServer.GetKeyBundles(ctx, id, wkbID, rkbID)
+	if err != nil {
+		return keybase1.KeyBundleResponse{}, err
+	}
+
+	var res keybase1.KeyBundleResponse
+	if wkb != nil {
+		buf, err := h.codec.Encode(wkb)
+		if err != nil {
+			return keybase1.KeyBundleResponse{}, err
+		}
+		res.WriterBundle = keybase1.KeyBundle{
+			Version: int(SegregatedKeyBundlesVer),
+			Bundle:  buf,
+		}
+	}
+	if rkb != nil {
+		buf, err := h.codec.Encode(rkb)
+		if err != nil {
+			return keybase1.KeyBundleResponse{}, err
+		}
+		res.ReaderBundle = keybase1.KeyBundle{
+			Version: int(SegregatedKeyBundlesVer),
+			Bundle:  buf,
+		}
+	}
+	return res, nil
+}
+
+// Lock implements the MetadataInterface for mdServerRPCHandler.
+// Taking a lock that this connection already holds renews it.
+func (h *mdServerRPCHandler) Lock(
+	ctx context.Context, arg keybase1.LockArg) error {
+	if err := h.checkAuth(ctx); err != nil {
+		return err
+	}
+	id, err := h.parseTlfID(arg.FolderID)
+	if err != nil {
+		return err
+	}
+	key := pathLockKeyFromLockID(arg.LockID)
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	_, err = h.mdServer.AcquirePathLock(
+		ctx, id, key, h.leaseID, pathLockLeaseDuration)
+	switch errors.Cause(err).(type) {
+	case nil:
+	case kbfsmd.ServerErrorLocked:
+		// Clients expect to be told to back off and retry while
+		// someone else holds the lock.
+		return kbfsmd.ServerErrorThrottle{Err: err}
+	default:
+		return err
+	}
+	if h.locks[id] == nil {
+		h.locks[id] = make(map[PathLockKey]bool)
+	}
+	h.locks[id][key] = true
+	return nil
+}
+
+// ReleaseLock implements the MetadataInterface for
+// mdServerRPCHandler.
+func (h *mdServerRPCHandler) ReleaseLock(
+	ctx context.Context, arg keybase1.ReleaseLockArg) error {
+	if err := h.checkAuth(ctx); err != nil {
+		return err
+	}
+	id, err := h.parseTlfID(arg.FolderID)
+	if err != nil {
+		return err
+	}
+	key := pathLockKeyFromLockID(arg.LockID)
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	err = h.mdServer.ReleasePathLock(ctx, id, key, h.leaseID)
+	if err != nil {
+		return err
+	}
+	delete(h.locks[id], key)
+	if len(h.locks[id]) == 0 {
+		delete(h.locks, id)
+	}
+	return nil
+}
+
+// GetMerkleRoot implements the MetadataInterface for
+// mdServerRPCHandler.
+func (h *mdServerRPCHandler) GetMerkleRoot(
+	_ context.Context, _ keybase1.GetMerkleRootArg) (
+	keybase1.MerkleRoot, error) {
+	return keybase1.MerkleRoot{}, kbfsmd.ServerErrorBadRequest{
+		Reason: "Merkle trees are not supported"}
+}
+
+// GetMerkleRootLatest implements the MetadataInterface for
+// mdServerRPCHandler.
+func (h *mdServerRPCHandler) GetMerkleRootLatest(
+	_ context.Context, _ keybase1.MerkleTreeID) (
+	keybase1.MerkleRoot, error) {
+	return keybase1.MerkleRoot{}, kbfsmd.ServerErrorBadRequest{
+		Reason: "Merkle trees are not supported"}
+}
+
+// GetMerkleRootSince implements the MetadataInterface for
+// mdServerRPCHandler.
+func (h *mdServerRPCHandler) GetMerkleRootSince(
+	_ context.Context, _ keybase1.GetMerkleRootSinceArg) (
+	keybase1.MerkleRoot, error) {
+	return keybase1.MerkleRoot{}, kbfsmd.ServerErrorBadRequest{
+		Reason: "Merkle trees are not supported"}
+}
+
+// GetMerkleNode implements the MetadataInterface for
+// mdServerRPCHandler.
+func (h *mdServerRPCHandler) GetMerkleNode(
+	_ context.Context, _ string) ([]byte, error) {
+	return nil, kbfsmd.ServerErrorBadRequest{
+		Reason: "Merkle trees are not supported"}
+}
+
+// shutdown cancels the connection's update registrations and
+// releases any path locks it still holds.
+func (h *mdServerRPCHandler) shutdown() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for id := range h.registered {
+		h.mdServer.CancelRegistration(h.ctx, id)
+	}
+	for id, keys := range h.locks {
+		for key := range keys {
+			err := h.mdServer.ReleasePathLock(h.ctx, id, key, h.leaseID)
+			if err != nil {
+				h.log.CDebugf(h.ctx, "Couldn't release lock %s in %s: %+v",
+					key, id, err)
+			}
+		}
+	}
+	h.locks = nil
+}
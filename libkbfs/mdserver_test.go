@@ -200,3 +200,61 @@ func TestMDServerRegisterForUpdate(t *testing.T) {
 	_, err = mdServer.RegisterForUpdate(ctx, id2, kbfsmd.RevisionInitial)
 	require.NoError(t, err)
 }
+
+func TestMDServerPathLocks(t *testing.T) {
+	// setup
+	ctx := context.Background()
+	config := MakeTestConfigOrBust(t, "test_user")
+	defer config.Shutdown(ctx)
+	clock := newTestClockNow()
+	config.SetClock(clock)
+	mdServer := config.MDServer()
+
+	id := tlf.FakeID(1, tlf.Private)
+	key := makePathLockKey(kbfscrypto.TLFCryptKey{}, "a/b")
+	otherKey := makePathLockKey(kbfscrypto.TLFCryptKey{}, "a/c")
+	const lease1, lease2 = PathLeaseID(1), PathLeaseID(2)
+
+	expiry, err := mdServer.AcquirePathLock(ctx, id, key, lease1, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, clock.Now().Add(time.Minute), expiry)
+	// Re-acquiring with the same lease is fine.
+	_, err = mdServer.AcquirePathLock(ctx, id, key, lease1, time.Minute)
+	require.NoError(t, err)
+
+	// Someone else can't take the same path, but can take another.
+	_, err = mdServer.AcquirePathLock(ctx, id, key, lease2, time.Minute)
+	require.IsType(t, kbfsmd.ServerErrorLocked{}, err)
+	_, err = mdServer.AcquirePathLock(
+		ctx, id, otherKey, lease2, time.Minute)
+	require.NoError(t, err)
+	_, err = mdServer.RenewPathLock(ctx, id, key, lease2, time.Minute)
+	require.IsType(t, kbfsmd.ServerErrorLocked{}, err)
+
+	// Renewing pushes out the expiration.
+	clock.Add(30 * time.Second)
+	expiry, err = mdServer.RenewPathLock(ctx, id, key, lease1, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, clock.Now().Add(time.Minute), expiry)
+	clock.Add(45 * time.Second)
+	_, err = mdServer.AcquirePathLock(ctx, id, key, lease2, time.Minute)
+	require.IsType(t, kbfsmd.ServerErrorLocked{}, err)
+
+	// Once the lease expires, it can't be renewed and someone else
+	// can take it.
+	clock.Add(time.Minute)
+	_, err = mdServer.RenewPathLock(ctx, id, key, lease1, time.Minute)
+	require.IsType(t, kbfsmd.ServerErrorLocked{}, err)
+	_, err = mdServer.AcquirePathLock(ctx, id, key, lease2, time.Minute)
+	require.NoError(t, err)
+
+	// Releasing someone else's lease doesn't do anything.
+	err = mdServer.ReleasePathLock(ctx, id, key, lease1)
+	require.NoError(t, err)
+	_, err = mdServer.AcquirePathLock(ctx, id, key, lease1, time.Minute)
+	require.IsType(t, kbfsmd.ServerErrorLocked{}, err)
+	err = mdServer.ReleasePathLock(ctx, id, key, lease2)
+	require.NoError(t, err)
+	_, err = mdServer.AcquirePathLock(ctx, id, key, lease1, time.Minute)
+	require.NoError(t, err)
+}
@@ -440,6 +440,111 @@ func (mr *MockdiskBlockCacheSetterMockRecorder) MakeDiskBlockCacheIfNotExists()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "MakeDiskBlockCacheIfNotExists", reflect.TypeOf((*MockdiskBlockCacheSetter)(nil).MakeDiskBlockCacheIfNotExists))
 }
 
+// MockblockDedupIndexGetter is a mock of blockDedupIndexGetter interface
+type MockblockDedupIndexGetter struct {
+	ctrl     *gomock.Controller
+	recorder *MockblockDedupIndexGetterMockRecorder
+}
+
+// MockblockDedupIndexGetterMockRecorder is the mock recorder for MockblockDedupIndexGetter
+type MockblockDedupIndexGetterMockRecorder struct {
+	mock *MockblockDedupIndexGetter
+}
+
+// NewMockblockDedupIndexGetter creates a new mock instance
+func NewMockblockDedupIndexGetter(ctrl *gomock.Controller) *MockblockDedupIndexGetter {
+	mock := &MockblockDedupIndexGetter{ctrl: ctrl}
+	mock.recorder = &MockblockDedupIndexGetterMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockblockDedupIndexGetter) EXPECT() *MockblockDedupIndexGetterMockRecorder {
+	return m.recorder
+}
+
+// BlockDedupIndex mocks base method
+func (m *MockblockDedupIndexGetter) BlockDedupIndex() BlockDedupIndex {
+	ret := m.ctrl.Call(m, "BlockDedupIndex")
+	ret0, _ := ret[0].(BlockDedupIndex)
+	return ret0
+}
+
+// BlockDedupIndex indicates an expected call of BlockDedupIndex
+func (mr *MockblockDedupIndexGetterMockRecorder) BlockDedupIndex() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "BlockDedupIndex", reflect.TypeOf((*MockblockDedupIndexGetter)(nil).BlockDedupIndex))
+}
+
+// MockblockDedupIndexSetter is a mock of blockDedupIndexSetter interface
+type MockblockDedupIndexSetter struct {
+	ctrl     *gomock.Controller
+	recorder *MockblockDedupIndexSetterMockRecorder
+}
+
+// MockblockDedupIndexSetterMockRecorder is the mock recorder for MockblockDedupIndexSetter
+type MockblockDedupIndexSetterMockRecorder struct {
+	mock *MockblockDedupIndexSetter
+}
+
+// NewMockblockDedupIndexSetter creates a new mock instance
+func NewMockblockDedupIndexSetter(ctrl *gomock.Controller) *MockblockDedupIndexSetter {
+	mock := &MockblockDedupIndexSetter{ctrl: ctrl}
+	mock.recorder = &MockblockDedupIndexSetterMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockblockDedupIndexSetter) EXPECT() *MockblockDedupIndexSetterMockRecorder {
+	return m.recorder
+}
+
+// MakeBlockDedupIndexIfNotExists mocks base method
+func (m *MockblockDedupIndexSetter) MakeBlockDedupIndexIfNotExists() error {
+	ret := m.ctrl.Call(m, "MakeBlockDedupIndexIfNotExists")
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// MakeBlockDedupIndexIfNotExists indicates an expected call of MakeBlockDedupIndexIfNotExists
+func (mr *MockblockDedupIndexSetterMockRecorder) MakeBlockDedupIndexIfNotExists() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "MakeBlockDedupIndexIfNotExists", reflect.TypeOf((*MockblockDedupIndexSetter)(nil).MakeBlockDedupIndexIfNotExists))
+}
+
+// MocksearchIndexGetter is a mock of searchIndexGetter interface
+type MocksearchIndexGetter struct {
+	ctrl     *gomock.Controller
+	recorder *MocksearchIndexGetterMockRecorder
+}
+
+// MocksearchIndexGetterMockRecorder is the mock recorder for MocksearchIndexGetter
+type MocksearchIndexGetterMockRecorder struct {
+	mock *MocksearchIndexGetter
+}
+
+// NewMocksearchIndexGetter creates a new mock instance
+func NewMocksearchIndexGetter(ctrl *gomock.Controller) *MocksearchIndexGetter {
+	mock := &MocksearchIndexGetter{ctrl: ctrl}
+	mock.recorder = &MocksearchIndexGetterMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MocksearchIndexGetter) EXPECT() *MocksearchIndexGetterMockRecorder {
+	return m.recorder
+}
+
+// SearchIndex mocks base method
+func (m *MocksearchIndexGetter) SearchIndex() SearchIndex {
+	ret := m.ctrl.Call(m, "SearchIndex")
+	ret0, _ := ret[0].(SearchIndex)
+	return ret0
+}
+
+// SearchIndex indicates an expected call of SearchIndex
+func (mr *MocksearchIndexGetterMockRecorder) SearchIndex() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SearchIndex", reflect.TypeOf((*MocksearchIndexGetter)(nil).SearchIndex))
+}
+
 // MockclockGetter is a mock of clockGetter interface
 type MockclockGetter struct {
 	ctrl     *gomock.Controller
@@ -557,6 +662,223 @@ func (mr *MocksyncedTlfGetterSetterMockRecorder) SetTlfSyncState(tlfID, isSynced
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetTlfSyncState", reflect.TypeOf((*MocksyncedTlfGetterSetter)(nil).SetTlfSyncState), tlfID, isSynced)
 }
 
+// MockblockCompressionGetterSetter is a mock of blockCompressionGetterSetter interface
+type MockblockCompressionGetterSetter struct {
+	ctrl     *gomock.Controller
+	recorder *MockblockCompressionGetterSetterMockRecorder
+}
+
+// MockblockCompressionGetterSetterMockRecorder is the mock recorder for MockblockCompressionGetterSetter
+type MockblockCompressionGetterSetterMockRecorder struct {
+	mock *MockblockCompressionGetterSetter
+}
+
+// NewMockblockCompressionGetterSetter creates a new mock instance
+func NewMockblockCompressionGetterSetter(ctrl *gomock.Controller) *MockblockCompressionGetterSetter {
+	mock := &MockblockCompressionGetterSetter{ctrl: ctrl}
+	mock.recorder = &MockblockCompressionGetterSetterMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockblockCompressionGetterSetter) EXPECT() *MockblockCompressionGetterSetterMockRecorder {
+	return m.recorder
+}
+
+// IsBlockCompressionEnabled mocks base method
+func (m *MockblockCompressionGetterSetter) IsBlockCompressionEnabled(tlfID tlf.ID) bool {
+	ret := m.ctrl.Call(m, "IsBlockCompressionEnabled", tlfID)
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+// IsBlockCompressionEnabled indicates an expected call of IsBlockCompressionEnabled
+func (mr *MockblockCompressionGetterSetterMockRecorder) IsBlockCompressionEnabled(tlfID interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "IsBlockCompressionEnabled", reflect.TypeOf((*MockblockCompressionGetterSetter)(nil).IsBlockCompressionEnabled), tlfID)
+}
+
+// SetBlockCompression mocks base method
+func (m *MockblockCompressionGetterSetter) SetBlockCompression(enabled bool) {
+	m.ctrl.Call(m, "SetBlockCompression", enabled)
+}
+
+// SetBlockCompression indicates an expected call of SetBlockCompression
+func (mr *MockblockCompressionGetterSetterMockRecorder) SetBlockCompression(enabled interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetBlockCompression", reflect.TypeOf((*MockblockCompressionGetterSetter)(nil).SetBlockCompression), enabled)
+}
+
+// SetTlfBlockCompression mocks base method
+func (m *MockblockCompressionGetterSetter) SetTlfBlockCompression(tlfID tlf.ID, enabled bool) {
+	m.ctrl.Call(m, "SetTlfBlockCompression", tlfID, enabled)
+}
+
+// SetTlfBlockCompression indicates an expected call of SetTlfBlockCompression
+func (mr *MockblockCompressionGetterSetterMockRecorder) SetTlfBlockCompression(tlfID, enabled interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetTlfBlockCompression", reflect.TypeOf((*MockblockCompressionGetterSetter)(nil).SetTlfBlockCompression), tlfID, enabled)
+}
+
+// MockconflictResolutionModeGetterSetter is a mock of conflictResolutionModeGetterSetter interface
+type MockconflictResolutionModeGetterSetter struct {
+	ctrl     *gomock.Controller
+	recorder *MockconflictResolutionModeGetterSetterMockRecorder
+}
+
+// MockconflictResolutionModeGetterSetterMockRecorder is the mock recorder for MockconflictResolutionModeGetterSetter
+type MockconflictResolutionModeGetterSetterMockRecorder struct {
+	mock *MockconflictResolutionModeGetterSetter
+}
+
+// NewMockconflictResolutionModeGetterSetter creates a new mock instance
+func NewMockconflictResolutionModeGetterSetter(ctrl *gomock.Controller) *MockconflictResolutionModeGetterSetter {
+	mock := &MockconflictResolutionModeGetterSetter{ctrl: ctrl}
+	mock.recorder = &MockconflictResolutionModeGetterSetterMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockconflictResolutionModeGetterSetter) EXPECT() *MockconflictResolutionModeGetterSetterMockRecorder {
+	return m.recorder
+}
+
+// IsManualConflictResolution mocks base method
+func (m *MockconflictResolutionModeGetterSetter) IsManualConflictResolution(tlfID tlf.ID) bool {
+	ret := m.ctrl.Call(m, "IsManualConflictResolution", tlfID)
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+// IsManualConflictResolution indicates an expected call of IsManualConflictResolution
+func (mr *MockconflictResolutionModeGetterSetterMockRecorder) IsManualConflictResolution(tlfID interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "IsManualConflictResolution", reflect.TypeOf((*MockconflictResolutionModeGetterSetter)(nil).IsManualConflictResolution), tlfID)
+}
+
+// SetManualConflictResolution mocks base method
+func (m *MockconflictResolutionModeGetterSetter) SetManualConflictResolution(tlfID tlf.ID, manual bool) error {
+	ret := m.ctrl.Call(m, "SetManualConflictResolution", tlfID, manual)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetManualConflictResolution indicates an expected call of SetManualConflictResolution
+func (mr *MockconflictResolutionModeGetterSetterMockRecorder) SetManualConflictResolution(tlfID, manual interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetManualConflictResolution", reflect.TypeOf((*MockconflictResolutionModeGetterSetter)(nil).SetManualConflictResolution), tlfID, manual)
+}
+
+// MockdiskCacheTlfLimitsGetterSetter is a mock of diskCacheTlfLimitsGetterSetter interface
+type MockdiskCacheTlfLimitsGetterSetter struct {
+	ctrl     *gomock.Controller
+	recorder *MockdiskCacheTlfLimitsGetterSetterMockRecorder
+}
+
+// MockdiskCacheTlfLimitsGetterSetterMockRecorder is the mock recorder for MockdiskCacheTlfLimitsGetterSetter
+type MockdiskCacheTlfLimitsGetterSetterMockRecorder struct {
+	mock *MockdiskCacheTlfLimitsGetterSetter
+}
+
+// NewMockdiskCacheTlfLimitsGetterSetter creates a new mock instance
+func NewMockdiskCacheTlfLimitsGetterSetter(ctrl *gomock.Controller) *MockdiskCacheTlfLimitsGetterSetter {
+	mock := &MockdiskCacheTlfLimitsGetterSetter{ctrl: ctrl}
+	mock.recorder = &MockdiskCacheTlfLimitsGetterSetterMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockdiskCacheTlfLimitsGetterSetter) EXPECT() *MockdiskCacheTlfLimitsGetterSetterMockRecorder {
+	return m.recorder
+}
+
+// DiskCacheTlfLimits mocks base method
+func (m *MockdiskCacheTlfLimitsGetterSetter) DiskCacheTlfLimits(tlfID tlf.ID) DiskCacheTlfLimits {
+	ret := m.ctrl.Call(m, "DiskCacheTlfLimits", tlfID)
+	ret0, _ := ret[0].(DiskCacheTlfLimits)
+	return ret0
+}
+
+// DiskCacheTlfLimits indicates an expected call of DiskCacheTlfLimits
+func (mr *MockdiskCacheTlfLimitsGetterSetterMockRecorder) DiskCacheTlfLimits(tlfID interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DiskCacheTlfLimits", reflect.TypeOf((*MockdiskCacheTlfLimitsGetterSetter)(nil).DiskCacheTlfLimits), tlfID)
+}
+
+// SetDiskCacheTlfLimits mocks base method
+func (m *MockdiskCacheTlfLimitsGetterSetter) SetDiskCacheTlfLimits(tlfID tlf.ID, limits DiskCacheTlfLimits) {
+	m.ctrl.Call(m, "SetDiskCacheTlfLimits", tlfID, limits)
+}
+
+// SetDiskCacheTlfLimits indicates an expected call of SetDiskCacheTlfLimits
+func (mr *MockdiskCacheTlfLimitsGetterSetterMockRecorder) SetDiskCacheTlfLimits(tlfID, limits interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetDiskCacheTlfLimits", reflect.TypeOf((*MockdiskCacheTlfLimitsGetterSetter)(nil).SetDiskCacheTlfLimits), tlfID, limits)
+}
+
+// MockbandwidthLimiterGetter is a mock of bandwidthLimiterGetter interface
+type MockbandwidthLimiterGetter struct {
+	ctrl     *gomock.Controller
+	recorder *MockbandwidthLimiterGetterMockRecorder
+}
+
+// MockbandwidthLimiterGetterMockRecorder is the mock recorder for MockbandwidthLimiterGetter
+type MockbandwidthLimiterGetterMockRecorder struct {
+	mock *MockbandwidthLimiterGetter
+}
+
+// NewMockbandwidthLimiterGetter creates a new mock instance
+func NewMockbandwidthLimiterGetter(ctrl *gomock.Controller) *MockbandwidthLimiterGetter {
+	mock := &MockbandwidthLimiterGetter{ctrl: ctrl}
+	mock.recorder = &MockbandwidthLimiterGetterMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockbandwidthLimiterGetter) EXPECT() *MockbandwidthLimiterGetterMockRecorder {
+	return m.recorder
+}
+
+// BandwidthLimiter mocks base method
+func (m *MockbandwidthLimiterGetter) BandwidthLimiter() *BandwidthLimiter {
+	ret := m.ctrl.Call(m, "BandwidthLimiter")
+	ret0, _ := ret[0].(*BandwidthLimiter)
+	return ret0
+}
+
+// BandwidthLimiter indicates an expected call of BandwidthLimiter
+func (mr *MockbandwidthLimiterGetterMockRecorder) BandwidthLimiter() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "BandwidthLimiter", reflect.TypeOf((*MockbandwidthLimiterGetter)(nil).BandwidthLimiter))
+}
+
+// MockmetricsRegistryGetter is a mock of metricsRegistryGetter interface
+type MockmetricsRegistryGetter struct {
+	ctrl     *gomock.Controller
+	recorder *MockmetricsRegistryGetterMockRecorder
+}
+
+// MockmetricsRegistryGetterMockRecorder is the mock recorder for MockmetricsRegistryGetter
+type MockmetricsRegistryGetterMockRecorder struct {
+	mock *MockmetricsRegistryGetter
+}
+
+// NewMockmetricsRegistryGetter creates a new mock instance
+func NewMockmetricsRegistryGetter(ctrl *gomock.Controller) *MockmetricsRegistryGetter {
+	mock := &MockmetricsRegistryGetter{ctrl: ctrl}
+	mock.recorder = &MockmetricsRegistryGetterMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockmetricsRegistryGetter) EXPECT() *MockmetricsRegistryGetterMockRecorder {
+	return m.recorder
+}
+
+// MetricsRegistry mocks base method
+func (m *MockmetricsRegistryGetter) MetricsRegistry() go_metrics.Registry {
+	ret := m.ctrl.Call(m, "MetricsRegistry")
+	ret0, _ := ret[0].(go_metrics.Registry)
+	return ret0
+}
+
+// MetricsRegistry indicates an expected call of MetricsRegistry
+func (mr *MockmetricsRegistryGetterMockRecorder) MetricsRegistry() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "MetricsRegistry", reflect.TypeOf((*MockmetricsRegistryGetter)(nil).MetricsRegistry))
+}
+
 // MockBlock is a mock of Block interface
 type MockBlock struct {
 	ctrl     *gomock.Controller
@@ -867,6 +1189,47 @@ func (mr *MockKBFSOpsMockRecorder) GetRootNode(ctx, h, branch interface{}) *gomo
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetRootNode", reflect.TypeOf((*MockKBFSOps)(nil).GetRootNode), ctx, h, branch)
 }
 
+// GetArchivedRootNode mocks base method
+func (m *MockKBFSOps) GetArchivedRootNode(ctx context.Context, h *TlfHandle, rev kbfsmd.Revision) (Node, EntryInfo, error) {
+	ret := m.ctrl.Call(m, "GetArchivedRootNode", ctx, h, rev)
+	ret0, _ := ret[0].(Node)
+	ret1, _ := ret[1].(EntryInfo)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// GetArchivedRootNode indicates an expected call of GetArchivedRootNode
+func (mr *MockKBFSOpsMockRecorder) GetArchivedRootNode(ctx, h, rev interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetArchivedRootNode", reflect.TypeOf((*MockKBFSOps)(nil).GetArchivedRootNode), ctx, h, rev)
+}
+
+// GetUnmergedRootNode mocks base method
+func (m *MockKBFSOps) GetUnmergedRootNode(ctx context.Context, h *TlfHandle) (Node, EntryInfo, error) {
+	ret := m.ctrl.Call(m, "GetUnmergedRootNode", ctx, h)
+	ret0, _ := ret[0].(Node)
+	ret1, _ := ret[1].(EntryInfo)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// GetUnmergedRootNode indicates an expected call of GetUnmergedRootNode
+func (mr *MockKBFSOpsMockRecorder) GetUnmergedRootNode(ctx, h interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUnmergedRootNode", reflect.TypeOf((*MockKBFSOps)(nil).GetUnmergedRootNode), ctx, h)
+}
+
+// GetRevisionForTime mocks base method
+func (m *MockKBFSOps) GetRevisionForTime(ctx context.Context, h *TlfHandle, t time.Time) (kbfsmd.Revision, error) {
+	ret := m.ctrl.Call(m, "GetRevisionForTime", ctx, h, t)
+	ret0, _ := ret[0].(kbfsmd.Revision)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetRevisionForTime indicates an expected call of GetRevisionForTime
+func (mr *MockKBFSOpsMockRecorder) GetRevisionForTime(ctx, h, t interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetRevisionForTime", reflect.TypeOf((*MockKBFSOps)(nil).GetRevisionForTime), ctx, h, t)
+}
+
 // GetDirChildren mocks base method
 func (m *MockKBFSOps) GetDirChildren(ctx context.Context, dir Node) (map[string]EntryInfo, error) {
 	ret := m.ctrl.Call(m, "GetDirChildren", ctx, dir)
@@ -973,15 +1336,171 @@ func (mr *MockKBFSOpsMockRecorder) RemoveEntry(ctx, dir, name interface{}) *gomo
 }
 
 // Rename mocks base method
-func (m *MockKBFSOps) Rename(ctx context.Context, oldParent Node, oldName string, newParent Node, newName string) error {
-	ret := m.ctrl.Call(m, "Rename", ctx, oldParent, oldName, newParent, newName)
+func (m *MockKBFSOps) Rename(ctx context.Context, oldParent Node, oldName string, newParent Node, newName string, mode RenameMode) error {
+	ret := m.ctrl.Call(m, "Rename", ctx, oldParent, oldName, newParent, newName, mode)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // Rename indicates an expected call of Rename
-func (mr *MockKBFSOpsMockRecorder) Rename(ctx, oldParent, oldName, newParent, newName interface{}) *gomock.Call {
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Rename", reflect.TypeOf((*MockKBFSOps)(nil).Rename), ctx, oldParent, oldName, newParent, newName)
+func (mr *MockKBFSOpsMockRecorder) Rename(ctx, oldParent, oldName, newParent, newName, mode interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Rename", reflect.TypeOf((*MockKBFSOps)(nil).Rename), ctx, oldParent, oldName, newParent, newName, mode)
+}
+
+// CopyFile mocks base method
+func (m *MockKBFSOps) CopyFile(ctx context.Context, file, dir Node, name string) (Node, EntryInfo, error) {
+	ret := m.ctrl.Call(m, "CopyFile", ctx, file, dir, name)
+	ret0, _ := ret[0].(Node)
+	ret1, _ := ret[1].(EntryInfo)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// CopyFile indicates an expected call of CopyFile
+func (mr *MockKBFSOpsMockRecorder) CopyFile(ctx, file, dir, name interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CopyFile", reflect.TypeOf((*MockKBFSOps)(nil).CopyFile), ctx, file, dir, name)
+}
+
+// CopyDir mocks base method
+func (m *MockKBFSOps) CopyDir(ctx context.Context, src, dir Node, name string) (Node, EntryInfo, error) {
+	ret := m.ctrl.Call(m, "CopyDir", ctx, src, dir, name)
+	ret0, _ := ret[0].(Node)
+	ret1, _ := ret[1].(EntryInfo)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// CopyDir indicates an expected call of CopyDir
+func (mr *MockKBFSOpsMockRecorder) CopyDir(ctx, src, dir, name interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CopyDir", reflect.TypeOf((*MockKBFSOps)(nil).CopyDir), ctx, src, dir, name)
+}
+
+// GetDeletedEntries mocks base method
+func (m *MockKBFSOps) GetDeletedEntries(ctx context.Context, folderBranch FolderBranch) ([]DeletedEntry, error) {
+	ret := m.ctrl.Call(m, "GetDeletedEntries", ctx, folderBranch)
+	ret0, _ := ret[0].([]DeletedEntry)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetDeletedEntries indicates an expected call of GetDeletedEntries
+func (mr *MockKBFSOpsMockRecorder) GetDeletedEntries(ctx, folderBranch interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetDeletedEntries", reflect.TypeOf((*MockKBFSOps)(nil).GetDeletedEntries), ctx, folderBranch)
+}
+
+// SetTrashRetention mocks base method
+func (m *MockKBFSOps) SetTrashRetention(ctx context.Context, folderBranch FolderBranch, retention time.Duration) error {
+	ret := m.ctrl.Call(m, "SetTrashRetention", ctx, folderBranch, retention)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetTrashRetention indicates an expected call of SetTrashRetention
+func (mr *MockKBFSOpsMockRecorder) SetTrashRetention(ctx, folderBranch, retention interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetTrashRetention", reflect.TypeOf((*MockKBFSOps)(nil).SetTrashRetention), ctx, folderBranch, retention)
+}
+
+// RestoreDeletedEntry mocks base method
+func (m *MockKBFSOps) RestoreDeletedEntry(ctx context.Context, entry DeletedEntry, dir Node, name string) (Node, EntryInfo, error) {
+	ret := m.ctrl.Call(m, "RestoreDeletedEntry", ctx, entry, dir, name)
+	ret0, _ := ret[0].(Node)
+	ret1, _ := ret[1].(EntryInfo)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// RestoreDeletedEntry indicates an expected call of RestoreDeletedEntry
+func (mr *MockKBFSOpsMockRecorder) RestoreDeletedEntry(ctx, entry, dir, name interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RestoreDeletedEntry", reflect.TypeOf((*MockKBFSOps)(nil).RestoreDeletedEntry), ctx, entry, dir, name)
+}
+
+// GetFileVersions mocks base method
+func (m *MockKBFSOps) GetFileVersions(ctx context.Context, file Node) ([]FileVersion, error) {
+	ret := m.ctrl.Call(m, "GetFileVersions", ctx, file)
+	ret0, _ := ret[0].([]FileVersion)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetFileVersions indicates an expected call of GetFileVersions
+func (mr *MockKBFSOpsMockRecorder) GetFileVersions(ctx, file interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetFileVersions", reflect.TypeOf((*MockKBFSOps)(nil).GetFileVersions), ctx, file)
+}
+
+// RestoreFileVersion mocks base method
+func (m *MockKBFSOps) RestoreFileVersion(ctx context.Context, file Node, version FileVersion) error {
+	ret := m.ctrl.Call(m, "RestoreFileVersion", ctx, file, version)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RestoreFileVersion indicates an expected call of RestoreFileVersion
+func (mr *MockKBFSOpsMockRecorder) RestoreFileVersion(ctx, file, version interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RestoreFileVersion", reflect.TypeOf((*MockKBFSOps)(nil).RestoreFileVersion), ctx, file, version)
+}
+
+// GetPathChanges mocks base method
+func (m *MockKBFSOps) GetPathChanges(ctx context.Context, folderBranch FolderBranch, since kbfsmd.Revision) ([]PathChange, kbfsmd.Revision, error) {
+	ret := m.ctrl.Call(m, "GetPathChanges", ctx, folderBranch, since)
+	ret0, _ := ret[0].([]PathChange)
+	ret1, _ := ret[1].(kbfsmd.Revision)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// GetPathChanges indicates an expected call of GetPathChanges
+func (mr *MockKBFSOpsMockRecorder) GetPathChanges(ctx, folderBranch, since interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetPathChanges", reflect.TypeOf((*MockKBFSOps)(nil).GetPathChanges), ctx, folderBranch, since)
+}
+
+// GetDiskUsage mocks base method
+func (m *MockKBFSOps) GetDiskUsage(ctx context.Context, dir Node) (DirDiskUsage, error) {
+	ret := m.ctrl.Call(m, "GetDiskUsage", ctx, dir)
+	ret0, _ := ret[0].(DirDiskUsage)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetDiskUsage indicates an expected call of GetDiskUsage
+func (mr *MockKBFSOpsMockRecorder) GetDiskUsage(ctx, dir interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetDiskUsage", reflect.TypeOf((*MockKBFSOps)(nil).GetDiskUsage), ctx, dir)
+}
+
+// PinPath mocks base method
+func (m *MockKBFSOps) PinPath(ctx context.Context, folderBranch FolderBranch, p string) error {
+	ret := m.ctrl.Call(m, "PinPath", ctx, folderBranch, p)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// PinPath indicates an expected call of PinPath
+func (mr *MockKBFSOpsMockRecorder) PinPath(ctx, folderBranch, p interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PinPath", reflect.TypeOf((*MockKBFSOps)(nil).PinPath), ctx, folderBranch, p)
+}
+
+// UnpinPath mocks base method
+func (m *MockKBFSOps) UnpinPath(ctx context.Context, folderBranch FolderBranch, p string) error {
+	ret := m.ctrl.Call(m, "UnpinPath", ctx, folderBranch, p)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// UnpinPath indicates an expected call of UnpinPath
+func (mr *MockKBFSOpsMockRecorder) UnpinPath(ctx, folderBranch, p interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UnpinPath", reflect.TypeOf((*MockKBFSOps)(nil).UnpinPath), ctx, folderBranch, p)
+}
+
+// GetFileDataExtents mocks base method
+func (m *MockKBFSOps) GetFileDataExtents(ctx context.Context, file Node, off int64, maxExtents int) ([]FileExtent, error) {
+	ret := m.ctrl.Call(m, "GetFileDataExtents", ctx, file, off, maxExtents)
+	ret0, _ := ret[0].([]FileExtent)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetFileDataExtents indicates an expected call of GetFileDataExtents
+func (mr *MockKBFSOpsMockRecorder) GetFileDataExtents(ctx, file, off, maxExtents interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetFileDataExtents", reflect.TypeOf((*MockKBFSOps)(nil).GetFileDataExtents), ctx, file, off, maxExtents)
 }
 
 // Read mocks base method
@@ -1021,28 +1540,114 @@ func (mr *MockKBFSOpsMockRecorder) Truncate(ctx, file, size interface{}) *gomock
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Truncate", reflect.TypeOf((*MockKBFSOps)(nil).Truncate), ctx, file, size)
 }
 
-// SetEx mocks base method
-func (m *MockKBFSOps) SetEx(ctx context.Context, file Node, ex bool) error {
-	ret := m.ctrl.Call(m, "SetEx", ctx, file, ex)
+// PunchHole mocks base method
+func (m *MockKBFSOps) PunchHole(ctx context.Context, file Node, off int64, length int64) error {
+	ret := m.ctrl.Call(m, "PunchHole", ctx, file, off, length)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// PunchHole indicates an expected call of PunchHole
+func (mr *MockKBFSOpsMockRecorder) PunchHole(ctx, file, off, length interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PunchHole", reflect.TypeOf((*MockKBFSOps)(nil).PunchHole), ctx, file, off, length)
+}
+
+// SetEx mocks base method
+func (m *MockKBFSOps) SetEx(ctx context.Context, file Node, ex bool) error {
+	ret := m.ctrl.Call(m, "SetEx", ctx, file, ex)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetEx indicates an expected call of SetEx
+func (mr *MockKBFSOpsMockRecorder) SetEx(ctx, file, ex interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetEx", reflect.TypeOf((*MockKBFSOps)(nil).SetEx), ctx, file, ex)
+}
+
+// SetMtime mocks base method
+func (m *MockKBFSOps) SetMtime(ctx context.Context, file Node, mtime *time.Time) error {
+	ret := m.ctrl.Call(m, "SetMtime", ctx, file, mtime)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetMtime indicates an expected call of SetMtime
+func (mr *MockKBFSOpsMockRecorder) SetMtime(ctx, file, mtime interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetMtime", reflect.TypeOf((*MockKBFSOps)(nil).SetMtime), ctx, file, mtime)
+}
+
+// GetXattr mocks base method
+func (m *MockKBFSOps) GetXattr(ctx context.Context, node Node, name string) ([]byte, error) {
+	ret := m.ctrl.Call(m, "GetXattr", ctx, node, name)
+	ret0, _ := ret[0].([]byte)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetXattr indicates an expected call of GetXattr
+func (mr *MockKBFSOpsMockRecorder) GetXattr(ctx, node, name interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetXattr", reflect.TypeOf((*MockKBFSOps)(nil).GetXattr), ctx, node, name)
+}
+
+// ListXattrs mocks base method
+func (m *MockKBFSOps) ListXattrs(ctx context.Context, node Node) ([]string, error) {
+	ret := m.ctrl.Call(m, "ListXattrs", ctx, node)
+	ret0, _ := ret[0].([]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ListXattrs indicates an expected call of ListXattrs
+func (mr *MockKBFSOpsMockRecorder) ListXattrs(ctx, node interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListXattrs", reflect.TypeOf((*MockKBFSOps)(nil).ListXattrs), ctx, node)
+}
+
+// SetXattr mocks base method
+func (m *MockKBFSOps) SetXattr(ctx context.Context, node Node, name string, value []byte, flag XattrFlag) error {
+	ret := m.ctrl.Call(m, "SetXattr", ctx, node, name, value, flag)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetXattr indicates an expected call of SetXattr
+func (mr *MockKBFSOpsMockRecorder) SetXattr(ctx, node, name, value, flag interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetXattr", reflect.TypeOf((*MockKBFSOps)(nil).SetXattr), ctx, node, name, value, flag)
+}
+
+// RemoveXattr mocks base method
+func (m *MockKBFSOps) RemoveXattr(ctx context.Context, node Node, name string) error {
+	ret := m.ctrl.Call(m, "RemoveXattr", ctx, node, name)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RemoveXattr indicates an expected call of RemoveXattr
+func (mr *MockKBFSOpsMockRecorder) RemoveXattr(ctx, node, name interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RemoveXattr", reflect.TypeOf((*MockKBFSOps)(nil).RemoveXattr), ctx, node, name)
+}
+
+// LockPath mocks base method
+func (m *MockKBFSOps) LockPath(ctx context.Context, node Node, owner PathLockOwner) error {
+	ret := m.ctrl.Call(m, "LockPath", ctx, node, owner)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
-// SetEx indicates an expected call of SetEx
-func (mr *MockKBFSOpsMockRecorder) SetEx(ctx, file, ex interface{}) *gomock.Call {
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetEx", reflect.TypeOf((*MockKBFSOps)(nil).SetEx), ctx, file, ex)
+// LockPath indicates an expected call of LockPath
+func (mr *MockKBFSOpsMockRecorder) LockPath(ctx, node, owner interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LockPath", reflect.TypeOf((*MockKBFSOps)(nil).LockPath), ctx, node, owner)
 }
 
-// SetMtime mocks base method
-func (m *MockKBFSOps) SetMtime(ctx context.Context, file Node, mtime *time.Time) error {
-	ret := m.ctrl.Call(m, "SetMtime", ctx, file, mtime)
+// UnlockPath mocks base method
+func (m *MockKBFSOps) UnlockPath(ctx context.Context, node Node, owner PathLockOwner) error {
+	ret := m.ctrl.Call(m, "UnlockPath", ctx, node, owner)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
-// SetMtime indicates an expected call of SetMtime
-func (mr *MockKBFSOpsMockRecorder) SetMtime(ctx, file, mtime interface{}) *gomock.Call {
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetMtime", reflect.TypeOf((*MockKBFSOps)(nil).SetMtime), ctx, file, mtime)
+// UnlockPath indicates an expected call of UnlockPath
+func (mr *MockKBFSOpsMockRecorder) UnlockPath(ctx, node, owner interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UnlockPath", reflect.TypeOf((*MockKBFSOps)(nil).UnlockPath), ctx, node, owner)
 }
 
 // SyncAll mocks base method
@@ -1085,6 +1690,18 @@ func (mr *MockKBFSOpsMockRecorder) Status(ctx interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Status", reflect.TypeOf((*MockKBFSOps)(nil).Status), ctx)
 }
 
+// ResolveUnmerged mocks base method
+func (m *MockKBFSOps) ResolveUnmerged(ctx context.Context, folderBranch FolderBranch, resolution UnmergedResolution) error {
+	ret := m.ctrl.Call(m, "ResolveUnmerged", ctx, folderBranch, resolution)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ResolveUnmerged indicates an expected call of ResolveUnmerged
+func (mr *MockKBFSOpsMockRecorder) ResolveUnmerged(ctx, folderBranch, resolution interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ResolveUnmerged", reflect.TypeOf((*MockKBFSOps)(nil).ResolveUnmerged), ctx, folderBranch, resolution)
+}
+
 // UnstageForTesting mocks base method
 func (m *MockKBFSOps) UnstageForTesting(ctx context.Context, folderBranch FolderBranch) error {
 	ret := m.ctrl.Call(m, "UnstageForTesting", ctx, folderBranch)
@@ -3041,6 +3658,16 @@ func (mr *MockDiskBlockCacheMockRecorder) GetMetadata(ctx, blockID interface{})
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetMetadata", reflect.TypeOf((*MockDiskBlockCache)(nil).GetMetadata), ctx, blockID)
 }
 
+// SetPinnedBlocks mocks base method
+func (m *MockDiskBlockCache) SetPinnedBlocks(ctx context.Context, tlfID tlf.ID, blockIDs []kbfsblock.ID) {
+	m.ctrl.Call(m, "SetPinnedBlocks", ctx, tlfID, blockIDs)
+}
+
+// SetPinnedBlocks indicates an expected call of SetPinnedBlocks
+func (mr *MockDiskBlockCacheMockRecorder) SetPinnedBlocks(ctx, tlfID, blockIDs interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetPinnedBlocks", reflect.TypeOf((*MockDiskBlockCache)(nil).SetPinnedBlocks), ctx, tlfID, blockIDs)
+}
+
 // Size mocks base method
 func (m *MockDiskBlockCache) Size() int64 {
 	ret := m.ctrl.Call(m, "Size")
@@ -3075,6 +3702,154 @@ func (mr *MockDiskBlockCacheMockRecorder) Shutdown(ctx interface{}) *gomock.Call
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Shutdown", reflect.TypeOf((*MockDiskBlockCache)(nil).Shutdown), ctx)
 }
 
+// MockBlockDedupIndex is a mock of BlockDedupIndex interface
+type MockBlockDedupIndex struct {
+	ctrl     *gomock.Controller
+	recorder *MockBlockDedupIndexMockRecorder
+}
+
+// MockBlockDedupIndexMockRecorder is the mock recorder for MockBlockDedupIndex
+type MockBlockDedupIndexMockRecorder struct {
+	mock *MockBlockDedupIndex
+}
+
+// NewMockBlockDedupIndex creates a new mock instance
+func NewMockBlockDedupIndex(ctrl *gomock.Controller) *MockBlockDedupIndex {
+	mock := &MockBlockDedupIndex{ctrl: ctrl}
+	mock.recorder = &MockBlockDedupIndexMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockBlockDedupIndex) EXPECT() *MockBlockDedupIndexMockRecorder {
+	return m.recorder
+}
+
+// Get mocks base method
+func (m *MockBlockDedupIndex) Get(tlfID tlf.ID, key BlockDedupKey) (BlockPointer, error) {
+	ret := m.ctrl.Call(m, "Get", tlfID, key)
+	ret0, _ := ret[0].(BlockPointer)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Get indicates an expected call of Get
+func (mr *MockBlockDedupIndexMockRecorder) Get(tlfID, key interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Get", reflect.TypeOf((*MockBlockDedupIndex)(nil).Get), tlfID, key)
+}
+
+// Put mocks base method
+func (m *MockBlockDedupIndex) Put(tlfID tlf.ID, key BlockDedupKey, ptr BlockPointer) error {
+	ret := m.ctrl.Call(m, "Put", tlfID, key, ptr)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Put indicates an expected call of Put
+func (mr *MockBlockDedupIndexMockRecorder) Put(tlfID, key, ptr interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Put", reflect.TypeOf((*MockBlockDedupIndex)(nil).Put), tlfID, key, ptr)
+}
+
+// Remove mocks base method
+func (m *MockBlockDedupIndex) Remove(tlfID tlf.ID, key BlockDedupKey) error {
+	ret := m.ctrl.Call(m, "Remove", tlfID, key)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Remove indicates an expected call of Remove
+func (mr *MockBlockDedupIndexMockRecorder) Remove(tlfID, key interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Remove", reflect.TypeOf((*MockBlockDedupIndex)(nil).Remove), tlfID, key)
+}
+
+// RemoveBlocks mocks base method
+func (m *MockBlockDedupIndex) RemoveBlocks(tlfID tlf.ID, ids []kbfsblock.ID) error {
+	ret := m.ctrl.Call(m, "RemoveBlocks", tlfID, ids)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RemoveBlocks indicates an expected call of RemoveBlocks
+func (mr *MockBlockDedupIndexMockRecorder) RemoveBlocks(tlfID, ids interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RemoveBlocks", reflect.TypeOf((*MockBlockDedupIndex)(nil).RemoveBlocks), tlfID, ids)
+}
+
+// Shutdown mocks base method
+func (m *MockBlockDedupIndex) Shutdown() {
+	m.ctrl.Call(m, "Shutdown")
+}
+
+// Shutdown indicates an expected call of Shutdown
+func (mr *MockBlockDedupIndexMockRecorder) Shutdown() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Shutdown", reflect.TypeOf((*MockBlockDedupIndex)(nil).Shutdown))
+}
+
+// MockSearchIndex is a mock of SearchIndex interface
+type MockSearchIndex struct {
+	ctrl     *gomock.Controller
+	recorder *MockSearchIndexMockRecorder
+}
+
+// MockSearchIndexMockRecorder is the mock recorder for MockSearchIndex
+type MockSearchIndexMockRecorder struct {
+	mock *MockSearchIndex
+}
+
+// NewMockSearchIndex creates a new mock instance
+func NewMockSearchIndex(ctrl *gomock.Controller) *MockSearchIndex {
+	mock := &MockSearchIndex{ctrl: ctrl}
+	mock.recorder = &MockSearchIndexMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockSearchIndex) EXPECT() *MockSearchIndexMockRecorder {
+	return m.recorder
+}
+
+// StartIndexing mocks base method
+func (m *MockSearchIndex) StartIndexing(tlfID tlf.ID) {
+	m.ctrl.Call(m, "StartIndexing", tlfID)
+}
+
+// StartIndexing indicates an expected call of StartIndexing
+func (mr *MockSearchIndexMockRecorder) StartIndexing(tlfID interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "StartIndexing", reflect.TypeOf((*MockSearchIndex)(nil).StartIndexing), tlfID)
+}
+
+// StopIndexing mocks base method
+func (m *MockSearchIndex) StopIndexing(tlfID tlf.ID) {
+	m.ctrl.Call(m, "StopIndexing", tlfID)
+}
+
+// StopIndexing indicates an expected call of StopIndexing
+func (mr *MockSearchIndexMockRecorder) StopIndexing(tlfID interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "StopIndexing", reflect.TypeOf((*MockSearchIndex)(nil).StopIndexing), tlfID)
+}
+
+// Search mocks base method
+func (m *MockSearchIndex) Search(ctx context.Context, h *TlfHandle, dir string, query string, maxResults int) ([]SearchResult, error) {
+	ret := m.ctrl.Call(m, "Search", ctx, h, dir, query, maxResults)
+	ret0, _ := ret[0].([]SearchResult)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Search indicates an expected call of Search
+func (mr *MockSearchIndexMockRecorder) Search(ctx, h, dir, query, maxResults interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Search", reflect.TypeOf((*MockSearchIndex)(nil).Search), ctx, h, dir, query, maxResults)
+}
+
+// Shutdown mocks base method
+func (m *MockSearchIndex) Shutdown() {
+	m.ctrl.Call(m, "Shutdown")
+}
+
+// Shutdown indicates an expected call of Shutdown
+func (mr *MockSearchIndexMockRecorder) Shutdown() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Shutdown", reflect.TypeOf((*MockSearchIndex)(nil).Shutdown))
+}
+
 // MockcryptoPure is a mock of cryptoPure interface
 type MockcryptoPure struct {
 	ctrl     *gomock.Controller
@@ -3271,6 +4046,20 @@ func (mr *MockcryptoPureMockRecorder) EncryptBlock(block, key interface{}) *gomo
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "EncryptBlock", reflect.TypeOf((*MockcryptoPure)(nil).EncryptBlock), block, key)
 }
 
+// EncryptCompressedBlock mocks base method
+func (m *MockcryptoPure) EncryptCompressedBlock(block Block, key kbfscrypto.BlockCryptKey) (int, EncryptedBlock, error) {
+	ret := m.ctrl.Call(m, "EncryptCompressedBlock", block, key)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(EncryptedBlock)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// EncryptCompressedBlock indicates an expected call of EncryptCompressedBlock
+func (mr *MockcryptoPureMockRecorder) EncryptCompressedBlock(block, key interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "EncryptCompressedBlock", reflect.TypeOf((*MockcryptoPure)(nil).EncryptCompressedBlock), block, key)
+}
+
 // DecryptBlock mocks base method
 func (m *MockcryptoPure) DecryptBlock(encryptedBlock EncryptedBlock, key kbfscrypto.BlockCryptKey, block Block) error {
 	ret := m.ctrl.Call(m, "DecryptBlock", encryptedBlock, key, block)
@@ -3582,6 +4371,20 @@ func (mr *MockCryptoMockRecorder) EncryptBlock(block, key interface{}) *gomock.C
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "EncryptBlock", reflect.TypeOf((*MockCrypto)(nil).EncryptBlock), block, key)
 }
 
+// EncryptCompressedBlock mocks base method
+func (m *MockCrypto) EncryptCompressedBlock(block Block, key kbfscrypto.BlockCryptKey) (int, EncryptedBlock, error) {
+	ret := m.ctrl.Call(m, "EncryptCompressedBlock", block, key)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(EncryptedBlock)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// EncryptCompressedBlock indicates an expected call of EncryptCompressedBlock
+func (mr *MockCryptoMockRecorder) EncryptCompressedBlock(block, key interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "EncryptCompressedBlock", reflect.TypeOf((*MockCrypto)(nil).EncryptCompressedBlock), block, key)
+}
+
 // DecryptBlock mocks base method
 func (m *MockCrypto) DecryptBlock(encryptedBlock EncryptedBlock, key kbfscrypto.BlockCryptKey, block Block) error {
 	ret := m.ctrl.Call(m, "DecryptBlock", encryptedBlock, key, block)
@@ -4370,6 +5173,44 @@ func (mr *MockMDServerMockRecorder) TruncateUnlock(ctx, id interface{}) *gomock.
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TruncateUnlock", reflect.TypeOf((*MockMDServer)(nil).TruncateUnlock), ctx, id)
 }
 
+// AcquirePathLock mocks base method
+func (m *MockMDServer) AcquirePathLock(ctx context.Context, id tlf.ID, key PathLockKey, leaseID PathLeaseID, duration time.Duration) (time.Time, error) {
+	ret := m.ctrl.Call(m, "AcquirePathLock", ctx, id, key, leaseID, duration)
+	ret0, _ := ret[0].(time.Time)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// AcquirePathLock indicates an expected call of AcquirePathLock
+func (mr *MockMDServerMockRecorder) AcquirePathLock(ctx, id, key, leaseID, duration interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AcquirePathLock", reflect.TypeOf((*MockMDServer)(nil).AcquirePathLock), ctx, id, key, leaseID, duration)
+}
+
+// RenewPathLock mocks base method
+func (m *MockMDServer) RenewPathLock(ctx context.Context, id tlf.ID, key PathLockKey, leaseID PathLeaseID, duration time.Duration) (time.Time, error) {
+	ret := m.ctrl.Call(m, "RenewPathLock", ctx, id, key, leaseID, duration)
+	ret0, _ := ret[0].(time.Time)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// RenewPathLock indicates an expected call of RenewPathLock
+func (mr *MockMDServerMockRecorder) RenewPathLock(ctx, id, key, leaseID, duration interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RenewPathLock", reflect.TypeOf((*MockMDServer)(nil).RenewPathLock), ctx, id, key, leaseID, duration)
+}
+
+// ReleasePathLock mocks base method
+func (m *MockMDServer) ReleasePathLock(ctx context.Context, id tlf.ID, key PathLockKey, leaseID PathLeaseID) error {
+	ret := m.ctrl.Call(m, "ReleasePathLock", ctx, id, key, leaseID)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ReleasePathLock indicates an expected call of ReleasePathLock
+func (mr *MockMDServerMockRecorder) ReleasePathLock(ctx, id, key, leaseID interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReleasePathLock", reflect.TypeOf((*MockMDServer)(nil).ReleasePathLock), ctx, id, key, leaseID)
+}
+
 // DisableRekeyUpdatesForTesting mocks base method
 func (m *MockMDServer) DisableRekeyUpdatesForTesting() {
 	m.ctrl.Call(m, "DisableRekeyUpdatesForTesting")
@@ -4620,6 +5461,44 @@ func (mr *MockmdServerLocalMockRecorder) TruncateUnlock(ctx, id interface{}) *go
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TruncateUnlock", reflect.TypeOf((*MockmdServerLocal)(nil).TruncateUnlock), ctx, id)
 }
 
+// AcquirePathLock mocks base method
+func (m *MockmdServerLocal) AcquirePathLock(ctx context.Context, id tlf.ID, key PathLockKey, leaseID PathLeaseID, duration time.Duration) (time.Time, error) {
+	ret := m.ctrl.Call(m, "AcquirePathLock", ctx, id, key, leaseID, duration)
+	ret0, _ := ret[0].(time.Time)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// AcquirePathLock indicates an expected call of AcquirePathLock
+func (mr *MockmdServerLocalMockRecorder) AcquirePathLock(ctx, id, key, leaseID, duration interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AcquirePathLock", reflect.TypeOf((*MockmdServerLocal)(nil).AcquirePathLock), ctx, id, key, leaseID, duration)
+}
+
+// RenewPathLock mocks base method
+func (m *MockmdServerLocal) RenewPathLock(ctx context.Context, id tlf.ID, key PathLockKey, leaseID PathLeaseID, duration time.Duration) (time.Time, error) {
+	ret := m.ctrl.Call(m, "RenewPathLock", ctx, id, key, leaseID, duration)
+	ret0, _ := ret[0].(time.Time)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// RenewPathLock indicates an expected call of RenewPathLock
+func (mr *MockmdServerLocalMockRecorder) RenewPathLock(ctx, id, key, leaseID, duration interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RenewPathLock", reflect.TypeOf((*MockmdServerLocal)(nil).RenewPathLock), ctx, id, key, leaseID, duration)
+}
+
+// ReleasePathLock mocks base method
+func (m *MockmdServerLocal) ReleasePathLock(ctx context.Context, id tlf.ID, key PathLockKey, leaseID PathLeaseID) error {
+	ret := m.ctrl.Call(m, "ReleasePathLock", ctx, id, key, leaseID)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ReleasePathLock indicates an expected call of ReleasePathLock
+func (mr *MockmdServerLocalMockRecorder) ReleasePathLock(ctx, id, key, leaseID interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReleasePathLock", reflect.TypeOf((*MockmdServerLocal)(nil).ReleasePathLock), ctx, id, key, leaseID)
+}
+
 // DisableRekeyUpdatesForTesting mocks base method
 func (m *MockmdServerLocal) DisableRekeyUpdatesForTesting() {
 	m.ctrl.Call(m, "DisableRekeyUpdatesForTesting")
@@ -5147,6 +6026,20 @@ func (mr *MockBlockSplitterMockRecorder) MaxPtrsPerBlock() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "MaxPtrsPerBlock", reflect.TypeOf((*MockBlockSplitter)(nil).MaxPtrsPerBlock))
 }
 
+// SplitDirIfNeeded mocks base method
+func (m *MockBlockSplitter) SplitDirIfNeeded(block *DirBlock, prevOffs []string) ([]*DirBlock, []string, error) {
+	ret := m.ctrl.Call(m, "SplitDirIfNeeded", block, prevOffs)
+	ret0, _ := ret[0].([]*DirBlock)
+	ret1, _ := ret[1].([]string)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// SplitDirIfNeeded indicates an expected call of SplitDirIfNeeded
+func (mr *MockBlockSplitterMockRecorder) SplitDirIfNeeded(block, prevOffs interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SplitDirIfNeeded", reflect.TypeOf((*MockBlockSplitter)(nil).SplitDirIfNeeded), block, prevOffs)
+}
+
 // ShouldEmbedBlockChanges mocks base method
 func (m *MockBlockSplitter) ShouldEmbedBlockChanges(bc *BlockChanges) bool {
 	ret := m.ctrl.Call(m, "ShouldEmbedBlockChanges", bc)
@@ -5400,6 +6293,54 @@ func (mr *MockConflictRenamerMockRecorder) ConflictRename(ctx, op, original inte
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ConflictRename", reflect.TypeOf((*MockConflictRenamer)(nil).ConflictRename), ctx, op, original)
 }
 
+// MockConflictMerger is a mock of ConflictMerger interface
+type MockConflictMerger struct {
+	ctrl     *gomock.Controller
+	recorder *MockConflictMergerMockRecorder
+}
+
+// MockConflictMergerMockRecorder is the mock recorder for MockConflictMerger
+type MockConflictMergerMockRecorder struct {
+	mock *MockConflictMerger
+}
+
+// NewMockConflictMerger creates a new mock instance
+func NewMockConflictMerger(ctrl *gomock.Controller) *MockConflictMerger {
+	mock := &MockConflictMerger{ctrl: ctrl}
+	mock.recorder = &MockConflictMergerMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockConflictMerger) EXPECT() *MockConflictMergerMockRecorder {
+	return m.recorder
+}
+
+// ShouldMerge mocks base method
+func (m *MockConflictMerger) ShouldMerge(name string, size uint64) bool {
+	ret := m.ctrl.Call(m, "ShouldMerge", name, size)
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+// ShouldMerge indicates an expected call of ShouldMerge
+func (mr *MockConflictMergerMockRecorder) ShouldMerge(name, size interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ShouldMerge", reflect.TypeOf((*MockConflictMerger)(nil).ShouldMerge), name, size)
+}
+
+// ConflictMerge mocks base method
+func (m *MockConflictMerger) ConflictMerge(base []byte, merged []byte, unmerged []byte) ([]byte, bool) {
+	ret := m.ctrl.Call(m, "ConflictMerge", base, merged, unmerged)
+	ret0, _ := ret[0].([]byte)
+	ret1, _ := ret[1].(bool)
+	return ret0, ret1
+}
+
+// ConflictMerge indicates an expected call of ConflictMerge
+func (mr *MockConflictMergerMockRecorder) ConflictMerge(base, merged, unmerged interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ConflictMerge", reflect.TypeOf((*MockConflictMerger)(nil).ConflictMerge), base, merged, unmerged)
+}
+
 // MockTracer is a mock of Tracer interface
 type MockTracer struct {
 	ctrl     *gomock.Controller
@@ -5612,6 +6553,42 @@ func (mr *MockConfigMockRecorder) MakeDiskBlockCacheIfNotExists() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "MakeDiskBlockCacheIfNotExists", reflect.TypeOf((*MockConfig)(nil).MakeDiskBlockCacheIfNotExists))
 }
 
+// BlockDedupIndex mocks base method
+func (m *MockConfig) BlockDedupIndex() BlockDedupIndex {
+	ret := m.ctrl.Call(m, "BlockDedupIndex")
+	ret0, _ := ret[0].(BlockDedupIndex)
+	return ret0
+}
+
+// BlockDedupIndex indicates an expected call of BlockDedupIndex
+func (mr *MockConfigMockRecorder) BlockDedupIndex() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "BlockDedupIndex", reflect.TypeOf((*MockConfig)(nil).BlockDedupIndex))
+}
+
+// MakeBlockDedupIndexIfNotExists mocks base method
+func (m *MockConfig) MakeBlockDedupIndexIfNotExists() error {
+	ret := m.ctrl.Call(m, "MakeBlockDedupIndexIfNotExists")
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// MakeBlockDedupIndexIfNotExists indicates an expected call of MakeBlockDedupIndexIfNotExists
+func (mr *MockConfigMockRecorder) MakeBlockDedupIndexIfNotExists() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "MakeBlockDedupIndexIfNotExists", reflect.TypeOf((*MockConfig)(nil).MakeBlockDedupIndexIfNotExists))
+}
+
+// SearchIndex mocks base method
+func (m *MockConfig) SearchIndex() SearchIndex {
+	ret := m.ctrl.Call(m, "SearchIndex")
+	ret0, _ := ret[0].(SearchIndex)
+	return ret0
+}
+
+// SearchIndex indicates an expected call of SearchIndex
+func (mr *MockConfigMockRecorder) SearchIndex() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SearchIndex", reflect.TypeOf((*MockConfig)(nil).SearchIndex))
+}
+
 // Clock mocks base method
 func (m *MockConfig) Clock() Clock {
 	ret := m.ctrl.Call(m, "Clock")
@@ -5660,6 +6637,96 @@ func (mr *MockConfigMockRecorder) SetTlfSyncState(tlfID, isSynced interface{}) *
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetTlfSyncState", reflect.TypeOf((*MockConfig)(nil).SetTlfSyncState), tlfID, isSynced)
 }
 
+// IsBlockCompressionEnabled mocks base method
+func (m *MockConfig) IsBlockCompressionEnabled(tlfID tlf.ID) bool {
+	ret := m.ctrl.Call(m, "IsBlockCompressionEnabled", tlfID)
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+// IsBlockCompressionEnabled indicates an expected call of IsBlockCompressionEnabled
+func (mr *MockConfigMockRecorder) IsBlockCompressionEnabled(tlfID interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "IsBlockCompressionEnabled", reflect.TypeOf((*MockConfig)(nil).IsBlockCompressionEnabled), tlfID)
+}
+
+// SetBlockCompression mocks base method
+func (m *MockConfig) SetBlockCompression(enabled bool) {
+	m.ctrl.Call(m, "SetBlockCompression", enabled)
+}
+
+// SetBlockCompression indicates an expected call of SetBlockCompression
+func (mr *MockConfigMockRecorder) SetBlockCompression(enabled interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetBlockCompression", reflect.TypeOf((*MockConfig)(nil).SetBlockCompression), enabled)
+}
+
+// SetTlfBlockCompression mocks base method
+func (m *MockConfig) SetTlfBlockCompression(tlfID tlf.ID, enabled bool) {
+	m.ctrl.Call(m, "SetTlfBlockCompression", tlfID, enabled)
+}
+
+// SetTlfBlockCompression indicates an expected call of SetTlfBlockCompression
+func (mr *MockConfigMockRecorder) SetTlfBlockCompression(tlfID, enabled interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetTlfBlockCompression", reflect.TypeOf((*MockConfig)(nil).SetTlfBlockCompression), tlfID, enabled)
+}
+
+// IsManualConflictResolution mocks base method
+func (m *MockConfig) IsManualConflictResolution(tlfID tlf.ID) bool {
+	ret := m.ctrl.Call(m, "IsManualConflictResolution", tlfID)
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+// IsManualConflictResolution indicates an expected call of IsManualConflictResolution
+func (mr *MockConfigMockRecorder) IsManualConflictResolution(tlfID interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "IsManualConflictResolution", reflect.TypeOf((*MockConfig)(nil).IsManualConflictResolution), tlfID)
+}
+
+// SetManualConflictResolution mocks base method
+func (m *MockConfig) SetManualConflictResolution(tlfID tlf.ID, manual bool) error {
+	ret := m.ctrl.Call(m, "SetManualConflictResolution", tlfID, manual)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetManualConflictResolution indicates an expected call of SetManualConflictResolution
+func (mr *MockConfigMockRecorder) SetManualConflictResolution(tlfID, manual interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetManualConflictResolution", reflect.TypeOf((*MockConfig)(nil).SetManualConflictResolution), tlfID, manual)
+}
+
+// DiskCacheTlfLimits mocks base method
+func (m *MockConfig) DiskCacheTlfLimits(tlfID tlf.ID) DiskCacheTlfLimits {
+	ret := m.ctrl.Call(m, "DiskCacheTlfLimits", tlfID)
+	ret0, _ := ret[0].(DiskCacheTlfLimits)
+	return ret0
+}
+
+// DiskCacheTlfLimits indicates an expected call of DiskCacheTlfLimits
+func (mr *MockConfigMockRecorder) DiskCacheTlfLimits(tlfID interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DiskCacheTlfLimits", reflect.TypeOf((*MockConfig)(nil).DiskCacheTlfLimits), tlfID)
+}
+
+// SetDiskCacheTlfLimits mocks base method
+func (m *MockConfig) SetDiskCacheTlfLimits(tlfID tlf.ID, limits DiskCacheTlfLimits) {
+	m.ctrl.Call(m, "SetDiskCacheTlfLimits", tlfID, limits)
+}
+
+// SetDiskCacheTlfLimits indicates an expected call of SetDiskCacheTlfLimits
+func (mr *MockConfigMockRecorder) SetDiskCacheTlfLimits(tlfID, limits interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetDiskCacheTlfLimits", reflect.TypeOf((*MockConfig)(nil).SetDiskCacheTlfLimits), tlfID, limits)
+}
+
+// BandwidthLimiter mocks base method
+func (m *MockConfig) BandwidthLimiter() *BandwidthLimiter {
+	ret := m.ctrl.Call(m, "BandwidthLimiter")
+	ret0, _ := ret[0].(*BandwidthLimiter)
+	return ret0
+}
+
+// BandwidthLimiter indicates an expected call of BandwidthLimiter
+func (mr *MockConfigMockRecorder) BandwidthLimiter() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "BandwidthLimiter", reflect.TypeOf((*MockConfig)(nil).BandwidthLimiter))
+}
+
 // MaybeStartTrace mocks base method
 func (m *MockConfig) MaybeStartTrace(ctx context.Context, family, title string) context.Context {
 	ret := m.ctrl.Call(m, "MaybeStartTrace", ctx, family, title)
@@ -6106,6 +7173,28 @@ func (mr *MockConfigMockRecorder) SetConflictRenamer(arg0 interface{}) *gomock.C
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetConflictRenamer", reflect.TypeOf((*MockConfig)(nil).SetConflictRenamer), arg0)
 }
 
+// ConflictMerger mocks base method
+func (m *MockConfig) ConflictMerger() ConflictMerger {
+	ret := m.ctrl.Call(m, "ConflictMerger")
+	ret0, _ := ret[0].(ConflictMerger)
+	return ret0
+}
+
+// ConflictMerger indicates an expected call of ConflictMerger
+func (mr *MockConfigMockRecorder) ConflictMerger() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ConflictMerger", reflect.TypeOf((*MockConfig)(nil).ConflictMerger))
+}
+
+// SetConflictMerger mocks base method
+func (m *MockConfig) SetConflictMerger(arg0 ConflictMerger) {
+	m.ctrl.Call(m, "SetConflictMerger", arg0)
+}
+
+// SetConflictMerger indicates an expected call of SetConflictMerger
+func (mr *MockConfigMockRecorder) SetConflictMerger(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetConflictMerger", reflect.TypeOf((*MockConfig)(nil).SetConflictMerger), arg0)
+}
+
 // MetadataVersion mocks base method
 func (m *MockConfig) MetadataVersion() MetadataVer {
 	ret := m.ctrl.Call(m, "MetadataVersion")
@@ -71,6 +71,8 @@ const (
 	resolutionOpCode
 	rekeyOpCode
 	gcOpCode // for deleting old blocks during an MD history truncation
+	setXattrOpCode
+	exchangeOpCode
 )
 
 // blockUpdate represents a block that was updated to have a new
@@ -705,6 +707,76 @@ func (ro *renameOp) getDefaultAction(mergedPath path) crAction {
 	return nil
 }
 
+// entryMover is implemented by the ops that move existing entries to
+// new names.
+type entryMover interface {
+	op
+	// moveOp returns the renameOp holding the op's fields.  Any
+	// changes made to it are made to the op itself.
+	moveOp() *renameOp
+}
+
+func (ro *renameOp) moveOp() *renameOp {
+	return ro
+}
+
+// exchangeOp is an op representing two existing entries trading
+// places: the entry at OldName (Renamed) moves to NewName, and the
+// entry at NewName (Exchanged) moves to OldName, at the same time.
+// It's a separate op type, rather than a renameOp with extra fields,
+// so that clients that don't know about exchanges fail to decode the
+// MD, instead of mistaking it for a rename that replaced the other
+// entry.
+type exchangeOp struct {
+	renameOp
+	Exchanged     BlockPointer `codec:"xe"`
+	ExchangedType EntryType    `codec:"xt"`
+}
+
+func newExchangeOp(oldName string, oldOldDir BlockPointer,
+	newName string, oldNewDir BlockPointer, renamed BlockPointer,
+	renamedType EntryType, exchanged BlockPointer,
+	exchangedType EntryType) (*exchangeOp, error) {
+	ro, err := newRenameOp(
+		oldName, oldOldDir, newName, oldNewDir, renamed, renamedType)
+	if err != nil {
+		return nil, err
+	}
+	return &exchangeOp{
+		renameOp:      *ro,
+		Exchanged:     exchanged,
+		ExchangedType: exchangedType,
+	}, nil
+}
+
+func (xo *exchangeOp) deepCopy() op {
+	xoCopy := *xo
+	xoCopy.OpCommon = xo.OpCommon.deepCopy()
+	return &xoCopy
+}
+
+func (xo *exchangeOp) String() string {
+	return fmt.Sprintf("exchange %s <-> %s (%s, %s)",
+		xo.OldName, xo.NewName, xo.RenamedType, xo.ExchangedType)
+}
+
+func (xo *exchangeOp) StringWithRefs(numRefIndents int) string {
+	res := xo.String() + "\n"
+	indent := strings.Repeat("\t", numRefIndents)
+	res += indent + fmt.Sprintf("OldDir: %v -> %v\n",
+		xo.OldDir.Unref, xo.OldDir.Ref)
+	if xo.NewDir != (blockUpdate{}) {
+		res += indent + fmt.Sprintf("NewDir: %v -> %v\n",
+			xo.NewDir.Unref, xo.NewDir.Ref)
+	} else {
+		res += indent + fmt.Sprintf("NewDir: same as above\n")
+	}
+	res += indent + fmt.Sprintf("Renamed: %v\n", xo.Renamed)
+	res += indent + fmt.Sprintf("Exchanged: %v\n", xo.Exchanged)
+	res += xo.stringWithRefs(numRefIndents)
+	return res
+}
+
 // WriteRange represents a file modification.  Len is 0 for a
 // truncate.
 type WriteRange struct {
@@ -854,9 +926,9 @@ func (so *syncOp) checkConflict(
 	isFile bool) (crAction, error) {
 	switch mergedOp.(type) {
 	case *syncOp:
-		// Any sync on the same file is a conflict.  (TODO: add
-		// type-specific intelligent conflict resolvers for file
-		// contents?)
+		// Any sync on the same file is a conflict.  The resolver
+		// might still merge the contents instead of renaming, if
+		// the ConflictMerger allows it (see makeMergeFileAction).
 		toName, err := renamer.ConflictRename(
 			ctx, so, mergedOp.getFinalPath().tailName())
 		if err != nil {
@@ -874,7 +946,7 @@ func (so *syncOp) checkConflict(
 			mergedParentMostRecent: mergedOp.getFinalPath().parentPath().
 				tailPointer(),
 		}, nil
-	case *setAttrOp:
+	case *setAttrOp, *setXattrOp:
 		// Someone on the merged path explicitly set an attribute, so
 		// just copy the size and blockpointer over.
 		return &copyUnmergedAttrAction{
@@ -1021,7 +1093,8 @@ type attrChange uint16
 const (
 	exAttr attrChange = iota
 	mtimeAttr
-	sizeAttr // only used during conflict resolution
+	sizeAttr  // only used during conflict resolution
+	xattrAttr // only used by setXattrOp
 )
 
 func (ac attrChange) String() string {
@@ -1032,6 +1105,8 @@ func (ac attrChange) String() string {
 		return "mtime"
 	case sizeAttr:
 		return "size"
+	case xattrAttr:
+		return "xattr"
 	}
 	return "<invalid attrChange>"
 }
@@ -1170,6 +1245,66 @@ func (sao *setAttrOp) getDefaultAction(mergedPath path) crAction {
 	}
 }
 
+// attrChanger is implemented by the ops that change the attributes
+// of an existing entry in place, without touching its contents.
+type attrChanger interface {
+	op
+	// attrOp returns the setAttrOp holding the op's fields.  Any
+	// changes made to it are made to the op itself.
+	attrOp() *setAttrOp
+}
+
+func (sao *setAttrOp) attrOp() *setAttrOp {
+	return sao
+}
+
+// setXattrOp is an op that represents changing the extended
+// attributes of a file/subdirectory within a directory.  It has the
+// same fields as a setAttrOp with the xattr attribute, but it's a
+// separate op type so that clients that don't know about extended
+// attributes fail to decode the MD, instead of mistaking it for some
+// other attribute change.
+type setXattrOp struct {
+	setAttrOp
+}
+
+func newSetXattrOp(name string, oldDir BlockPointer,
+	file BlockPointer) (*setXattrOp, error) {
+	sao, err := newSetAttrOp(name, oldDir, xattrAttr, file)
+	if err != nil {
+		return nil, err
+	}
+	return &setXattrOp{*sao}, nil
+}
+
+func (sxo *setXattrOp) deepCopy() op {
+	sxoCopy := *sxo
+	sxoCopy.OpCommon = sxo.OpCommon.deepCopy()
+	return &sxoCopy
+}
+
+func (sxo *setXattrOp) String() string {
+	return fmt.Sprintf("setXattr %s", sxo.Name)
+}
+
+func (sxo *setXattrOp) StringWithRefs(numRefIndents int) string {
+	res := sxo.String() + "\n"
+	indent := strings.Repeat("\t", numRefIndents)
+	res += indent + fmt.Sprintf("Dir: %v -> %v\n", sxo.Dir.Unref, sxo.Dir.Ref)
+	res += indent + fmt.Sprintf("File: %v\n", sxo.File)
+	res += sxo.stringWithRefs(numRefIndents)
+	return res
+}
+
+func (sxo *setXattrOp) checkConflict(
+	ctx context.Context, renamer ConflictRenamer, mergedOp op,
+	isFile bool) (crAction, error) {
+	// Extended attributes aren't worth a conflict rename; just let
+	// the unmerged set of attributes win, as if it was written after
+	// the merged one.
+	return nil, nil
+}
+
 // resolutionOp is an op that represents the block changes that took
 // place as part of a conflict resolution.
 type resolutionOp struct {
@@ -1362,6 +1497,18 @@ func invertOpForLocalNotifications(oldOp op) (newOp op, err error) {
 		if err != nil {
 			return nil, err
 		}
+	case *exchangeOp:
+		// An exchange is its own inverse.
+		newDirRef := op.NewDir.Ref
+		if op.NewDir == (blockUpdate{}) {
+			newDirRef = op.OldDir.Ref
+		}
+		newOp, err = newExchangeOp(op.NewName, newDirRef,
+			op.OldName, op.OldDir.Ref, op.Renamed, op.RenamedType,
+			op.Exchanged, op.ExchangedType)
+		if err != nil {
+			return nil, err
+		}
 	case *syncOp:
 		// Just replay the writes; for notifications purposes, they
 		// will do the right job of marking the right bytes as
@@ -1378,6 +1525,11 @@ func invertOpForLocalNotifications(oldOp op) (newOp op, err error) {
 		if err != nil {
 			return nil, err
 		}
+	case *setXattrOp:
+		newOp, err = newSetXattrOp(op.Name, op.Dir.Ref, op.File)
+		if err != nil {
+			return nil, err
+		}
 	case *GCOp:
 		newOp = newGCOp(op.LatestRev)
 	case *resolutionOp:
@@ -1421,6 +1573,10 @@ func opPointerizer(iface interface{}) reflect.Value {
 		return reflect.ValueOf(&op)
 	case GCOp:
 		return reflect.ValueOf(&op)
+	case setXattrOp:
+		return reflect.ValueOf(&op)
+	case exchangeOp:
+		return reflect.ValueOf(&op)
 	}
 }
 
@@ -1434,6 +1590,8 @@ func RegisterOps(codec kbfscodec.Codec) {
 	codec.RegisterType(reflect.TypeOf(resolutionOp{}), resolutionOpCode)
 	codec.RegisterType(reflect.TypeOf(rekeyOp{}), rekeyOpCode)
 	codec.RegisterType(reflect.TypeOf(GCOp{}), gcOpCode)
+	codec.RegisterType(reflect.TypeOf(setXattrOp{}), setXattrOpCode)
+	codec.RegisterType(reflect.TypeOf(exchangeOp{}), exchangeOpCode)
 	codec.RegisterIfaceSliceType(reflect.TypeOf(opsList{}), opsListCode,
 		opPointerizer)
 }
@@ -179,6 +179,10 @@ func opPointerizerFuture(iface interface{}) reflect.Value {
 		return reflect.ValueOf(&op)
 	case gcOpFuture:
 		return reflect.ValueOf(&op)
+	case setXattrOpFuture:
+		return reflect.ValueOf(&op)
+	case exchangeOpFuture:
+		return reflect.ValueOf(&op)
 	}
 }
 
@@ -191,6 +195,8 @@ func registerOpsFuture(codec kbfscodec.Codec) {
 	codec.RegisterType(reflect.TypeOf(resolutionOpFuture{}), resolutionOpCode)
 	codec.RegisterType(reflect.TypeOf(rekeyOpFuture{}), rekeyOpCode)
 	codec.RegisterType(reflect.TypeOf(gcOpFuture{}), gcOpCode)
+	codec.RegisterType(reflect.TypeOf(setXattrOpFuture{}), setXattrOpCode)
+	codec.RegisterType(reflect.TypeOf(exchangeOpFuture{}), exchangeOpCode)
 	codec.RegisterIfaceSliceType(reflect.TypeOf(opsList{}), opsListCode,
 		opPointerizerFuture)
 }
@@ -388,6 +394,122 @@ func TestSetAttrOpUnknownFields(t *testing.T) {
 	testStructUnknownFields(t, makeFakeSetAttrOpFuture(t))
 }
 
+type setXattrOpFuture struct {
+	setXattrOp
+	kbfscodec.Extra
+}
+
+func (sxof setXattrOpFuture) toCurrent() setXattrOp {
+	return sxof.setXattrOp
+}
+
+func (sxof setXattrOpFuture) ToCurrentStruct() kbfscodec.CurrentStruct {
+	return sxof.toCurrent()
+}
+
+func makeFakeSetXattrOpFuture(t *testing.T) setXattrOpFuture {
+	sxof := setXattrOpFuture{
+		setXattrOp{
+			setAttrOp{
+				makeFakeOpCommon(t, true),
+				"name",
+				makeFakeBlockUpdate(t),
+				xattrAttr,
+				makeFakeBlockPointer(t),
+				false,
+			},
+		},
+		kbfscodec.MakeExtraOrBust("setXattrOp", t),
+	}
+	return sxof
+}
+
+func TestSetXattrOpUnknownFields(t *testing.T) {
+	testStructUnknownFields(t, makeFakeSetXattrOpFuture(t))
+}
+
+// Clients that don't know about setXattrOp must fail to decode it,
+// rather than mistake it for another op.
+func TestSetXattrOpUnknownToOldClients(t *testing.T) {
+	codec := kbfscodec.NewMsgpack()
+	RegisterOps(codec)
+	oldCodec := kbfscodec.NewMsgpack()
+	oldCodec.RegisterType(reflect.TypeOf(setAttrOp{}), setAttrOpCode)
+	oldCodec.RegisterIfaceSliceType(reflect.TypeOf(opsList{}), opsListCode,
+		opPointerizer)
+
+	sxo, err := newSetXattrOp(
+		"name", makeFakeBlockPointer(t), makeFakeBlockPointer(t))
+	require.NoError(t, err)
+	buf, err := codec.Encode(opsList{sxo})
+	require.NoError(t, err)
+
+	var ops opsList
+	err = codec.Decode(buf, &ops)
+	require.NoError(t, err)
+	require.Len(t, ops, 1)
+	require.IsType(t, &setXattrOp{}, ops[0])
+
+	err = oldCodec.Decode(buf, &ops)
+	require.Error(t, err)
+}
+
+type exchangeOpFuture struct {
+	exchangeOp
+	kbfscodec.Extra
+}
+
+func (xof exchangeOpFuture) toCurrent() exchangeOp {
+	return xof.exchangeOp
+}
+
+func (xof exchangeOpFuture) ToCurrentStruct() kbfscodec.CurrentStruct {
+	return xof.toCurrent()
+}
+
+func makeFakeExchangeOpFuture(t *testing.T) exchangeOpFuture {
+	xof := exchangeOpFuture{
+		exchangeOp{
+			makeFakeRenameOpFuture(t).toCurrent(),
+			makeFakeBlockPointer(t),
+			Dir,
+		},
+		kbfscodec.MakeExtraOrBust("exchangeOp", t),
+	}
+	return xof
+}
+
+func TestExchangeOpUnknownFields(t *testing.T) {
+	testStructUnknownFields(t, makeFakeExchangeOpFuture(t))
+}
+
+// Clients that don't know about exchangeOp must fail to decode it,
+// rather than mistake it for a rename that replaced the other entry.
+func TestExchangeOpUnknownToOldClients(t *testing.T) {
+	codec := kbfscodec.NewMsgpack()
+	RegisterOps(codec)
+	oldCodec := kbfscodec.NewMsgpack()
+	oldCodec.RegisterType(reflect.TypeOf(renameOp{}), renameOpCode)
+	oldCodec.RegisterIfaceSliceType(reflect.TypeOf(opsList{}), opsListCode,
+		opPointerizer)
+
+	xo, err := newExchangeOp("old", makeFakeBlockPointer(t), "new",
+		makeFakeBlockPointer(t), makeFakeBlockPointer(t), File,
+		makeFakeBlockPointer(t), Dir)
+	require.NoError(t, err)
+	buf, err := codec.Encode(opsList{xo})
+	require.NoError(t, err)
+
+	var ops opsList
+	err = codec.Decode(buf, &ops)
+	require.NoError(t, err)
+	require.Len(t, ops, 1)
+	require.Equal(t, xo, ops[0])
+
+	err = oldCodec.Decode(buf, &ops)
+	require.Error(t, err)
+}
+
 type resolutionOpFuture struct {
 	resolutionOp
 	kbfscodec.Extra
@@ -599,6 +721,21 @@ func TestOpInversion(t *testing.T) {
 			expectedIOp5, iop5)
 	}
 
+	// setXattr
+	sxop, err := newSetXattrOp("name", oldPtr1, filePtr)
+	require.NoError(t, err)
+	sxop.AddUpdate(oldPtr1, newPtr1)
+	expectedIOpX, err := newSetXattrOp("name", newPtr1, filePtr)
+	require.NoError(t, err)
+	expectedIOpX.AddUpdate(newPtr1, oldPtr1)
+	iopX, err := invertOpForLocalNotifications(sxop)
+	require.NoError(t, err)
+	sxo, ok := iopX.(*setXattrOp)
+	if !ok || !reflect.DeepEqual(*sxo, *expectedIOpX) {
+		t.Errorf("setXattrOp didn't invert properly, expected %v, got %v",
+			expectedIOpX, iopX)
+	}
+
 	// rename (same dir)
 	rop, err = newRenameOp("old", oldPtr1, "new", oldPtr1, filePtr, File)
 	require.NoError(t, err)
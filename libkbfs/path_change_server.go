@@ -0,0 +1,421 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/ioutil"
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// PathChangeRequest is the first and only message that a client of a
+// PathChangeServer sends, as a single line of JSON, to subscribe to
+// the changes under a path prefix of a TLF.
+type PathChangeRequest struct {
+	// TlfType is one of "private", "public" or "team".
+	TlfType PathType `json:"tlfType"`
+	TlfName string   `json:"tlfName"`
+	// Prefix limits the changes to the ones made to the given path,
+	// relative to the TLF root, or to anything under it.  An empty
+	// prefix matches the whole TLF.
+	Prefix string `json:"prefix,omitempty"`
+	// Since is the last revision the client has already seen, for
+	// resuming a stream after a disconnect.  If it's not set, the
+	// stream starts from the current head of the TLF.
+	Since *kbfsmd.Revision `json:"since,omitempty"`
+}
+
+const (
+	// PathChangeMessageRevision is the type of a PathChangeMessage
+	// that only reports that the stream has caught up to a revision,
+	// which the client should use to resume from later.
+	PathChangeMessageRevision = "revision"
+	// PathChangeMessageReset is the type of a PathChangeMessage that
+	// reports that the changes made up to a revision can't be
+	// listed anymore, because quota reclamation has already covered
+	// them.  The client should rescan the prefix, since any of it
+	// might have changed; the stream resumes after that revision.
+	PathChangeMessageReset = "reset"
+	// PathChangeMessageError is the type of the PathChangeMessage
+	// sent just before the server closes the stream due to an
+	// error.
+	PathChangeMessageError = "error"
+)
+
+// PathChangeMessage is a message sent by a PathChangeServer to its
+// clients, as a single line of JSON.
+type PathChangeMessage struct {
+	// Type is either one of the PathChangeType strings ("create",
+	// "write", "rename" or "remove"), PathChangeMessageRevision,
+	// PathChangeMessageReset or PathChangeMessageError.
+	Type     string          `json:"type"`
+	Revision kbfsmd.Revision `json:"revision,omitempty"`
+	// Path and OldPath are the same as in PathChange.
+	Path    string     `json:"path,omitempty"`
+	OldPath string     `json:"oldPath,omitempty"`
+	Writer  string     `json:"writer,omitempty"`
+	Time    *time.Time `json:"time,omitempty"`
+	Error   string     `json:"error,omitempty"`
+}
+
+// CtxPathChangeTagKey is the type used for unique context tags
+// within PathChangeServer.
+type CtxPathChangeTagKey int
+
+const (
+	// CtxPathChangeIDKey is the type of the tag for unique operation
+	// IDs within PathChangeServer.
+	CtxPathChangeIDKey CtxPathChangeTagKey = iota
+)
+
+// CtxPathChangeOpID is the display name for the unique operation
+// PathChangeServer ID tag.
+const CtxPathChangeOpID = "PCID"
+
+// pathChangePollInterval is how often a PathChangeServer checks for
+// new revisions without being notified of a change.  Changes made
+// locally are announced to observers before they're synced, so the
+// notifications alone aren't enough to notice every new revision.
+const pathChangePollInterval = 1 * time.Second
+
+// PathChangeServer streams the path changes of TLFs to local clients
+// that connect to a unix socket.  Each client subscribes to a path
+// prefix of a single TLF, and gets a line of JSON for each matching
+// change, in revision order, as it becomes known to this KBFS
+// instance.
+type PathChangeServer struct {
+	config   Config
+	log      logger.Logger
+	listener net.Listener
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+// NewPathChangeServer starts a new PathChangeServer listening on the
+// unix socket at the given path.  Any existing file at that path is
+// replaced, since it's most likely left over from an earlier run.
+func NewPathChangeServer(config Config, socketPath string) (
+	*PathChangeServer, error) {
+	err := ioutil.Remove(socketPath)
+	if err != nil && !ioutil.IsNotExist(err) {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	// Only the local user should be able to see their changes.
+	err = os.Chmod(socketPath, 0600)
+	if err != nil {
+		listener.Close()
+		return nil, errors.WithStack(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &PathChangeServer{
+		config:   config,
+		log:      config.MakeLogger("PCS"),
+		listener: listener,
+		cancel:   cancel,
+	}
+	s.wg.Add(1)
+	go s.serve(ctx)
+	return s, nil
+}
+
+// Shutdown stops the server, and closes all the client connections.
+func (s *PathChangeServer) Shutdown() {
+	s.cancel()
+	err := s.listener.Close()
+	if err != nil {
+		s.log.Debug("Error closing the listener: %+v", err)
+	}
+	s.wg.Wait()
+}
+
+func (s *PathChangeServer) serve(ctx context.Context) {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				s.log.Debug("Temporary accept error: %+v", err)
+				continue
+			}
+			s.log.Warning("Stopped accepting connections: %+v", err)
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handleConn(ctx, conn)
+		}()
+	}
+}
+
+func (s *PathChangeServer) handleConn(ctx context.Context, conn net.Conn) {
+	ctx, cancel := context.WithCancel(CtxWithRandomIDReplayable(
+		ctx, CtxPathChangeIDKey, CtxPathChangeOpID, s.log))
+	defer cancel()
+	// Closing the connection unblocks any pending reads and writes.
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	dec := json.NewDecoder(conn)
+	var req PathChangeRequest
+	err := dec.Decode(&req)
+	if err != nil {
+		s.log.CDebugf(ctx, "Couldn't decode the request: %+v", err)
+		return
+	}
+	// Clients don't send anything else, so just wait for the end of
+	// the connection.
+	go func() {
+		buf := make([]byte, 1)
+		for {
+			if _, err := conn.Read(buf); err != nil {
+				cancel()
+				return
+			}
+		}
+	}()
+
+	s.log.CDebugf(ctx, "New subscription to %s/%s, prefix=%q",
+		req.TlfType, req.TlfName, req.Prefix)
+	enc := json.NewEncoder(conn)
+	err = s.streamChanges(ctx, req, enc)
+	if err != nil && ctx.Err() == nil {
+		s.log.CDebugf(ctx, "Subscription failed: %+v", err)
+		_ = enc.Encode(PathChangeMessage{
+			Type:  PathChangeMessageError,
+			Error: err.Error(),
+		})
+	}
+}
+
+func (s *PathChangeServer) getFolderBranch(
+	ctx context.Context, req PathChangeRequest) (FolderBranch, error) {
+	var t tlf.Type
+	switch req.TlfType {
+	case PrivatePathType:
+		t = tlf.Private
+	case PublicPathType:
+		t = tlf.Public
+	case SingleTeamPathType:
+		t = tlf.SingleTeam
+	default:
+		return FolderBranch{}, errors.Errorf(
+			"Unknown TLF type %q", req.TlfType)
+	}
+
+	name := req.TlfName
+	for {
+		h, err := ParseTlfHandle(ctx, s.config.KBPKI(), name, t)
+		switch e := errors.Cause(err).(type) {
+		case TlfNameNotCanonical:
+			name = e.NameToTry
+			continue
+		case nil:
+		default:
+			return FolderBranch{}, err
+		}
+		rootNode, _, err := s.config.KBFSOps().GetOrCreateRootNode(
+			ctx, h, MasterBranch)
+		if err != nil {
+			return FolderBranch{}, err
+		}
+		return rootNode.GetFolderBranch(), nil
+	}
+}
+
+// cleanTlfRelativePath returns p, a path relative to the TLF root,
+// without any empty or "." components.
+func cleanTlfRelativePath(p string) string {
+	var parts []string
+	for _, part := range strings.Split(p, "/") {
+		if part != "" && part != "." {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// pathHasPrefix returns true if p is the given prefix, or is under
+// it.  Both are relative to the TLF root.
+func pathHasPrefix(p, prefix string) bool {
+	return prefix == "" || p == prefix || strings.HasPrefix(p, prefix+"/")
+}
+
+func (s *PathChangeServer) streamChanges(ctx context.Context,
+	req PathChangeRequest, enc *json.Encoder) error {
+	fb, err := s.getFolderBranch(ctx, req)
+	if err != nil {
+		return err
+	}
+	prefix := cleanTlfRelativePath(req.Prefix)
+
+	// Register before looking at the current revision, so that no
+	// changes can be missed.
+	waiter := newPathChangeWaiter()
+	err = s.config.Notifier().RegisterForChanges(
+		[]FolderBranch{fb}, waiter)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err := s.config.Notifier().UnregisterFromChanges(
+			[]FolderBranch{fb}, waiter)
+		if err != nil {
+			s.log.CDebugf(ctx, "Couldn't unregister: %+v", err)
+		}
+	}()
+
+	var since kbfsmd.Revision
+	if req.Since != nil {
+		since = *req.Since
+	} else {
+		status, _, err := s.config.KBFSOps().FolderStatus(ctx, fb)
+		if err != nil {
+			return err
+		}
+		since = status.Revision
+	}
+	err = enc.Encode(PathChangeMessage{
+		Type:     PathChangeMessageRevision,
+		Revision: since,
+	})
+	if err != nil {
+		return err
+	}
+
+	writers := make(map[keybase1.UID]string)
+	for {
+		changes, lastRev, err := s.config.KBFSOps().GetPathChanges(
+			ctx, fb, since)
+		if e, ok := errors.Cause(err).(PathChangesReclaimedError); ok {
+			s.log.CDebugf(ctx, "Resetting the stream to revision %d",
+				e.LastGCRevision)
+			since = e.LastGCRevision
+			err = enc.Encode(PathChangeMessage{
+				Type:     PathChangeMessageReset,
+				Revision: since,
+			})
+			if err != nil {
+				return err
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+		for _, change := range changes {
+			if !pathHasPrefix(change.Path, prefix) &&
+				!(change.Type == PathRenamed &&
+					pathHasPrefix(change.OldPath, prefix)) {
+				continue
+			}
+			writer, ok := writers[change.Writer]
+			if !ok {
+				name, err := s.config.KBPKI().GetNormalizedUsername(
+					ctx, change.Writer.AsUserOrTeam())
+				if err != nil {
+					s.log.CDebugf(ctx, "Couldn't get the name of %s: %+v",
+						change.Writer, err)
+					writer = change.Writer.String()
+				} else {
+					writer = name.String()
+				}
+				writers[change.Writer] = writer
+			}
+			localTime := change.LocalTime
+			err = enc.Encode(PathChangeMessage{
+				Type:     change.Type.String(),
+				Revision: change.Revision,
+				Path:     change.Path,
+				OldPath:  change.OldPath,
+				Writer:   writer,
+				Time:     &localTime,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if lastRev != since {
+			since = lastRev
+			err = enc.Encode(PathChangeMessage{
+				Type:     PathChangeMessageRevision,
+				Revision: since,
+			})
+			if err != nil {
+				return err
+			}
+			// There may be more revisions to catch up on.
+			continue
+		}
+
+		select {
+		case <-waiter.changed:
+		case <-time.After(pathChangePollInterval):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// pathChangeWaiter is an Observer that signals whenever a TLF has
+// changed.
+type pathChangeWaiter struct {
+	changed chan struct{}
+}
+
+var _ Observer = pathChangeWaiter{}
+
+func newPathChangeWaiter() pathChangeWaiter {
+	return pathChangeWaiter{changed: make(chan struct{}, 1)}
+}
+
+func (w pathChangeWaiter) signal() {
+	select {
+	case w.changed <- struct{}{}:
+	default:
+	}
+}
+
+// LocalChange implements the Observer interface for
+// pathChangeWaiter.  Local writes aren't visible in a revision
+// until they're synced.
+func (w pathChangeWaiter) LocalChange(
+	ctx context.Context, node Node, write WriteRange) {
+}
+
+// BatchChanges implements the Observer interface for
+// pathChangeWaiter.
+func (w pathChangeWaiter) BatchChanges(
+	ctx context.Context, changes []NodeChange) {
+	w.signal()
+}
+
+// TlfHandleChange implements the Observer interface for
+// pathChangeWaiter.
+func (w pathChangeWaiter) TlfHandleChange(
+	ctx context.Context, newHandle *TlfHandle) {
+}
@@ -0,0 +1,160 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/keybase/kbfs/ioutil"
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+)
+
+func subscribeToPathChanges(t *testing.T, socketPath string,
+	req PathChangeRequest) (net.Conn, *json.Decoder) {
+	conn, err := net.Dial("unix", socketPath)
+	require.NoError(t, err)
+	err = json.NewEncoder(conn).Encode(req)
+	require.NoError(t, err)
+	return conn, json.NewDecoder(conn)
+}
+
+// readPathChanges reads messages until one reports that the stream
+// has caught up to at least `rev`, and returns the changes read
+// before that.
+func readPathChanges(t *testing.T, conn net.Conn, dec *json.Decoder,
+	rev kbfsmd.Revision) (changes []PathChangeMessage) {
+	err := conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	require.NoError(t, err)
+	for {
+		var msg PathChangeMessage
+		err := dec.Decode(&msg)
+		require.NoError(t, err)
+		switch msg.Type {
+		case PathChangeMessageError:
+			t.Fatalf("Got an error: %s", msg.Error)
+		case PathChangeMessageRevision:
+			if msg.Revision >= rev {
+				return changes
+			}
+		default:
+			changes = append(changes, msg)
+		}
+	}
+}
+
+func TestPathChangeServer(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "alice")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	clock, now := newTestClockAndTimeNow()
+	config.SetClock(clock)
+
+	tempdir, err := ioutil.TempDir(os.TempDir(), "path_change_server")
+	require.NoError(t, err)
+	defer func() {
+		err := ioutil.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+	socketPath := filepath.Join(tempdir, "sock")
+	err = config.EnablePathChangeServer(socketPath)
+	require.NoError(t, err)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "alice", tlf.Private)
+	fb := rootNode.GetFolderBranch()
+	kbfsOps := config.KBFSOps()
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	getHeadRev := func() kbfsmd.Revision {
+		status, _, err := kbfsOps.FolderStatus(ctx, fb)
+		require.NoError(t, err)
+		return status.Revision
+	}
+	startRev := getHeadRev()
+
+	t.Log("Subscribe to the changes under the directory.")
+	req := PathChangeRequest{
+		TlfType: PrivatePathType,
+		TlfName: "alice",
+		Prefix:  "a/",
+	}
+	conn, dec := subscribeToPathChanges(t, socketPath, req)
+	changes := readPathChanges(t, conn, dec, startRev)
+	require.Len(t, changes, 0)
+
+	t.Log("Only the changes under the prefix are streamed.")
+	_, _, err = kbfsOps.CreateFile(ctx, dirNode, "f", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	_, _, err = kbfsOps.CreateFile(ctx, rootNode, "ab", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	err = kbfsOps.Rename(ctx, dirNode, "f", rootNode, "g", RenameReplace)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	renameRev := getHeadRev()
+	changes = readPathChanges(t, conn, dec, renameRev)
+	require.Len(t, changes, 3)
+	require.Equal(t, "create", changes[0].Type)
+	require.Equal(t, "a/f", changes[0].Path)
+	require.Equal(t, "alice", changes[0].Writer)
+	require.NotNil(t, changes[0].Time)
+	require.Equal(t, "write", changes[1].Type)
+	require.Equal(t, "a/f", changes[1].Path)
+	require.Equal(t, "rename", changes[2].Type)
+	require.Equal(t, "g", changes[2].Path)
+	require.Equal(t, "a/f", changes[2].OldPath)
+	require.Equal(t, renameRev, changes[2].Revision)
+	err = conn.Close()
+	require.NoError(t, err)
+
+	t.Log("Changes made while disconnected are streamed when resuming " +
+		"from the last revision.")
+	err = kbfsOps.RemoveDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	req.Since = &renameRev
+	conn, dec = subscribeToPathChanges(t, socketPath, req)
+	defer conn.Close()
+	changes = readPathChanges(t, conn, dec, getHeadRev())
+	require.Len(t, changes, 1)
+	require.Equal(t, "remove", changes[0].Type)
+	require.Equal(t, "a", changes[0].Path)
+
+	t.Log("Resuming from a revision that QR has already covered resets " +
+		"the stream.")
+	clock.Set(now.Add(2 * config.QuotaReclamationMinUnrefAge()))
+	ops := getOps(config, fb.Tlf)
+	ops.fbm.forceQuotaReclamation()
+	err = ops.fbm.waitForQuotaReclamations(ctx)
+	require.NoError(t, err)
+	req.Since = &startRev
+	resetConn, resetDec := subscribeToPathChanges(t, socketPath, req)
+	defer resetConn.Close()
+	changes = readPathChanges(t, resetConn, resetDec, getHeadRev())
+	require.Len(t, changes, 1)
+	require.Equal(t, PathChangeMessageReset, changes[0].Type)
+	require.True(t, changes[0].Revision > renameRev)
+
+	t.Log("Bad TLF types are reported as errors.")
+	req = PathChangeRequest{TlfType: "bad", TlfName: "alice"}
+	badConn, badDec := subscribeToPathChanges(t, socketPath, req)
+	defer badConn.Close()
+	var msg PathChangeMessage
+	err = badDec.Decode(&msg)
+	require.NoError(t, err)
+	require.Equal(t, PathChangeMessageError, msg.Type)
+}
@@ -0,0 +1,249 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/keybase/kbfs/tlf"
+	"golang.org/x/net/context"
+)
+
+// PathLockKey identifies a lockable path within a TLF to the MD
+// server.  It is a keyed hash of the path, so the server can't learn
+// the path from it.
+type PathLockKey [sha256.Size]byte
+
+// pathLockKeyContext separates path lock keys from any other keyed
+// hashes that might be made with the same TLF crypt key.
+const pathLockKeyContext = "Keybase-KBFS-Path-Lock-1"
+
+func makePathLockKey(
+	tlfCryptKey kbfscrypto.TLFCryptKey, p string) PathLockKey {
+	keyData := tlfCryptKey.Data()
+	mac := hmac.New(sha256.New, keyData[:])
+	// Writes to a hash.Hash never fail.
+	_, _ = mac.Write([]byte(pathLockKeyContext))
+	_, _ = mac.Write([]byte{0})
+	_, _ = mac.Write([]byte(p))
+	var key PathLockKey
+	copy(key[:], mac.Sum(nil))
+	return key
+}
+
+func (k PathLockKey) String() string {
+	return hex.EncodeToString(k[:])
+}
+
+// lockID returns the ID the remote MD server uses for the lock on
+// this key.
+func (k PathLockKey) lockID() keybase1.LockID {
+	return keybase1.LockID(binary.BigEndian.Uint64(k[:8]))
+}
+
+// pathLockKeyFromLockID returns a key that stands in for the one
+// with the given lock ID on the server side.  Only the first 8 bytes
+// of the returned key are set, since that's all a lock ID carries.
+func pathLockKeyFromLockID(lockID keybase1.LockID) PathLockKey {
+	var key PathLockKey
+	binary.BigEndian.PutUint64(key[:8], uint64(lockID))
+	return key
+}
+
+// PathLeaseID identifies a single holder of a path lock lease.
+type PathLeaseID int64
+
+// PathLockOwner identifies who holds a path lock on this device,
+// e.g. an open file handle.  Two owners on the same device exclude
+// each other just like two devices do.
+type PathLockOwner uint64
+
+func makeRandomPathLeaseID() (PathLeaseID, error) {
+	var buf [8]byte
+	err := kbfscrypto.RandRead(buf[:])
+	if err != nil {
+		return 0, err
+	}
+	return PathLeaseID(binary.BigEndian.Uint64(buf[:])), nil
+}
+
+const (
+	// pathLockLeaseDuration is how long each path lock lease lasts
+	// on the MD server before it has to be renewed.
+	pathLockLeaseDuration = 1 * time.Minute
+)
+
+// CtxPathLockTagKey is the type used for unique context tags within
+// pathLockHolder
+type CtxPathLockTagKey int
+
+const (
+	// CtxPathLockIDKey is the type of the tag for unique operation
+	// IDs within pathLockHolder.
+	CtxPathLockIDKey CtxPathLockTagKey = iota
+)
+
+// CtxPathLockOpID is the display name for the unique operation
+// pathLockHolder ID tag.
+const CtxPathLockOpID = "PLID"
+
+type heldPathLock struct {
+	node    NodeID
+	owner   PathLockOwner
+	leaseID PathLeaseID
+	cancel  context.CancelFunc
+}
+
+// pathLockHolder keeps track of the path lock leases this device
+// holds in a single TLF, renewing them in the background until they
+// are released.  A lease that can't be renewed before it expires is
+// forgotten, since someone else might have taken the lock since.
+type pathLockHolder struct {
+	config   Config
+	id       tlf.ID
+	log      logger.Logger
+	duration time.Duration
+
+	// Protects `locks`, and serializes acquisitions so the same key
+	// can't be locked twice at once.
+	lock  sync.Mutex
+	locks map[PathLockKey]heldPathLock
+}
+
+func newPathLockHolder(
+	config Config, id tlf.ID, log logger.Logger) *pathLockHolder {
+	return &pathLockHolder{
+		config:   config,
+		id:       id,
+		log:      log,
+		duration: pathLockLeaseDuration,
+		locks:    make(map[PathLockKey]heldPathLock),
+	}
+}
+
+// acquire takes a lease on `key` for the given node on behalf of
+// `owner`, if it doesn't already hold one.  If another owner on this
+// device holds it, it returns kbfsmd.ServerErrorLocked, just as if
+// another device held it.
+func (h *pathLockHolder) acquire(ctx context.Context, node NodeID,
+	key PathLockKey, owner PathLockOwner) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if l, ok := h.locks[key]; ok {
+		if l.owner != owner {
+			return kbfsmd.ServerErrorLocked{}
+		}
+		return nil
+	}
+
+	leaseID, err := makeRandomPathLeaseID()
+	if err != nil {
+		return err
+	}
+	expiry, err := h.config.MDServer().AcquirePathLock(
+		ctx, h.id, key, leaseID, h.duration)
+	if err != nil {
+		return err
+	}
+	h.log.CDebugf(ctx, "Acquired path lock %s until %s", key, expiry)
+
+	renewCtx, cancel := context.WithCancel(CtxWithRandomIDReplayable(
+		context.Background(), CtxPathLockIDKey, CtxPathLockOpID, h.log))
+	h.locks[key] = heldPathLock{node, owner, leaseID, cancel}
+	go h.renewLoop(renewCtx, key, leaseID, expiry)
+	return nil
+}
+
+func (h *pathLockHolder) forget(key PathLockKey, leaseID PathLeaseID) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if l, ok := h.locks[key]; ok && l.leaseID == leaseID {
+		delete(h.locks, key)
+	}
+}
+
+func (h *pathLockHolder) renewLoop(ctx context.Context,
+	key PathLockKey, leaseID PathLeaseID, expiry time.Time) {
+	// Renew often enough to get a retry in before the lease
+	// expires, in case of a transient error.
+	ticker := time.NewTicker(h.duration / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			newExpiry, err := h.config.MDServer().RenewPathLock(
+				ctx, h.id, key, leaseID, h.duration)
+			if err == nil {
+				expiry = newExpiry
+				continue
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			if h.config.Clock().Now().Before(expiry) {
+				h.log.CDebugf(ctx, "Couldn't renew path lock %s, "+
+					"will retry: %+v", key, err)
+				continue
+			}
+			h.log.CWarningf(ctx, "Lost path lock %s: %+v", key, err)
+			h.forget(key, leaseID)
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// release gives up the lease `owner` holds for the given node, if
+// there is one.  The node's path may have changed since the lease was
+// taken, so the lease is looked up by node rather than by key.
+func (h *pathLockHolder) release(
+	ctx context.Context, node NodeID, owner PathLockOwner) error {
+	h.lock.Lock()
+	var key PathLockKey
+	var l heldPathLock
+	found := false
+	for k, held := range h.locks {
+		if held.node == node && held.owner == owner {
+			key, l, found = k, held, true
+			delete(h.locks, k)
+			break
+		}
+	}
+	h.lock.Unlock()
+	if !found {
+		return nil
+	}
+
+	l.cancel()
+	return h.config.MDServer().ReleasePathLock(ctx, h.id, key, l.leaseID)
+}
+
+// shutdown releases all the leases held by this device.
+func (h *pathLockHolder) shutdown(ctx context.Context) {
+	h.lock.Lock()
+	locks := h.locks
+	h.locks = make(map[PathLockKey]heldPathLock)
+	h.lock.Unlock()
+
+	for key, l := range locks {
+		l.cancel()
+		err := h.config.MDServer().ReleasePathLock(
+			ctx, h.id, key, l.leaseID)
+		if err != nil {
+			h.log.CDebugf(ctx, "Couldn't release path lock %s: %+v",
+				key, err)
+		}
+	}
+}
@@ -31,6 +31,7 @@ func makeRandomDirEntry(
 			101,
 			102,
 			"",
+			nil,
 		},
 		codec.UnknownFieldSetHandler{},
 	}
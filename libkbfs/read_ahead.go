@@ -0,0 +1,137 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sync"
+
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// CtxReadHandleKeyType is the type for a context key identifying the
+// open file handle that a read comes from.
+type CtxReadHandleKeyType int
+
+const (
+	// CtxReadHandleKey can be set in the context of a read to a
+	// comparable value that's unique to the open file handle it
+	// comes from, so that read-ahead can follow the access pattern
+	// of each handle separately.  Reads without it share one access
+	// pattern per file.
+	CtxReadHandleKey CtxReadHandleKeyType = iota
+)
+
+const (
+	// readAheadPrefetchPriority is just below on-demand requests, so
+	// that read-ahead blocks are fetched before any tree-structure
+	// prefetches, but never delay a block someone is waiting on.
+	readAheadPrefetchPriority int = defaultOnDemandRequestPriority - 1
+	// readAheadInitialWindow is how far past the current read
+	// offset blocks are requested, once a file has been read
+	// sequentially twice in a row.
+	readAheadInitialWindow int64 = 1 << 20
+	// readAheadMaxWindow caps how far the read-ahead window grows.
+	readAheadMaxWindow int64 = 16 << 20
+	// readAheadSequentialSlack is how far a read may start from
+	// where the previous one ended and still count as sequential.
+	// The kernel may issue (and reorder) several reads of a file at
+	// once, so requiring exact adjacency would miss most streams.
+	readAheadSequentialSlack int64 = 128 << 10
+	// readAheadMaxTrackedFiles bounds how many file handles' access
+	// patterns are remembered per TLF.
+	readAheadMaxTrackedFiles = 256
+)
+
+// readAheadState tracks the access pattern of a single open file
+// handle.
+type readAheadState struct {
+	// nextOff is the offset just past the furthest read seen in the
+	// current sequential run.
+	nextOff int64
+	// window is the current read-ahead window size, or 0 if the
+	// file isn't being read sequentially.
+	window int64
+	// scheduledEnd is the offset up to which read-ahead has already
+	// been requested.
+	scheduledEnd int64
+}
+
+// update records a read of `n` bytes at `off`, and returns the
+// half-inclusive range of offsets `[start, end)` that should be read
+// ahead as a result.  If `start >= end`, nothing needs to be read
+// ahead.  Each sequential read doubles the window, up to
+// readAheadMaxWindow; any other read resets it.
+func (ras *readAheadState) update(off, n int64) (start, end int64) {
+	if off >= ras.nextOff-readAheadSequentialSlack &&
+		off <= ras.nextOff+readAheadSequentialSlack {
+		if ras.window == 0 {
+			ras.window = readAheadInitialWindow
+		} else if ras.window < readAheadMaxWindow {
+			ras.window *= 2
+			if ras.window > readAheadMaxWindow {
+				ras.window = readAheadMaxWindow
+			}
+		}
+		if off+n > ras.nextOff {
+			ras.nextOff = off + n
+		}
+	} else {
+		// Random access; back off until the reader settles into
+		// another sequential run.
+		ras.window = 0
+		ras.scheduledEnd = 0
+		ras.nextOff = off + n
+		return 0, 0
+	}
+
+	start = ras.nextOff
+	if ras.scheduledEnd > start {
+		start = ras.scheduledEnd
+	}
+	end = ras.nextOff + ras.window
+	if start < end {
+		ras.scheduledEnd = end
+	}
+	return start, end
+}
+
+// readAheadKey identifies an open file handle: the file, and the
+// value of CtxReadHandleKey in the context of its reads.
+type readAheadKey struct {
+	id     NodeID
+	handle interface{}
+}
+
+// readAheadTracker remembers the access patterns of the most
+// recently read file handles in a TLF.
+type readAheadTracker struct {
+	lock    sync.Mutex
+	handles *lru.Cache // readAheadKey -> *readAheadState
+}
+
+func newReadAheadTracker(maxFiles int) *readAheadTracker {
+	handles, err := lru.New(maxFiles)
+	if err != nil {
+		panic(err.Error())
+	}
+	return &readAheadTracker{handles: handles}
+}
+
+// update records a read of `n` bytes at `off` through the given
+// handle of the file identified by `id`, and returns the range that
+// should be read ahead, as described in readAheadState.update.  The
+// first read through a handle never triggers read-ahead.
+func (rat *readAheadTracker) update(id NodeID, handle interface{},
+	off, n int64) (start, end int64) {
+	rat.lock.Lock()
+	defer rat.lock.Unlock()
+	key := readAheadKey{id, handle}
+	tmp, ok := rat.handles.Get(key)
+	if !ok {
+		rat.handles.Add(key, &readAheadState{nextOff: off + n})
+		return 0, 0
+	}
+	return tmp.(*readAheadState).update(off, n)
+}
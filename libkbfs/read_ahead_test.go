@@ -0,0 +1,186 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadAheadStateUpdate(t *testing.T) {
+	const readSize = 64 << 10
+	rat := newReadAheadTracker(1)
+	id := NodeID(&nodeCore{})
+
+	t.Log("The first read never reads ahead")
+	start, end := rat.update(id, nil, 0, readSize)
+	require.True(t, start >= end)
+
+	t.Log("Sequential reads grow the window")
+	start, end = rat.update(id, nil, readSize, readSize)
+	require.Equal(t, int64(2*readSize), start)
+	require.Equal(t, 2*readSize+readAheadInitialWindow, end)
+	start, end = rat.update(id, nil, 2*readSize, readSize)
+	require.Equal(t, 2*readSize+readAheadInitialWindow, start)
+	require.Equal(t, 3*readSize+2*readAheadInitialWindow, end)
+
+	t.Log("Slightly out-of-order reads still count as sequential")
+	start, end = rat.update(id, nil, 2*readSize, readSize)
+	require.Equal(t, 3*readSize+2*readAheadInitialWindow, start)
+	require.Equal(t, 3*readSize+4*readAheadInitialWindow, end)
+
+	t.Log("The window is capped")
+	off := int64(3 * readSize)
+	for i := 0; i < 10; i++ {
+		_, end = rat.update(id, nil, off, readSize)
+		off += readSize
+	}
+	require.Equal(t, off+readAheadMaxWindow, end)
+
+	t.Log("Random access backs off")
+	start, end = rat.update(id, nil, 100*readAheadMaxWindow, readSize)
+	require.True(t, start >= end)
+	start, end = rat.update(id, nil, 0, readSize)
+	require.True(t, start >= end)
+	start, end = rat.update(id, nil, readSize, readSize)
+	require.Equal(t, int64(2*readSize), start)
+	require.Equal(t, 2*readSize+readAheadInitialWindow, end)
+
+	t.Log("Only the most recent handles are tracked")
+	id2 := NodeID(&nodeCore{})
+	start, end = rat.update(id2, nil, 0, readSize)
+	require.True(t, start >= end)
+	start, end = rat.update(id, nil, 2*readSize, readSize)
+	require.True(t, start >= end)
+
+	t.Log("Each handle of a file is tracked separately")
+	rat = newReadAheadTracker(2)
+	start, end = rat.update(id, 1, 0, readSize)
+	require.True(t, start >= end)
+	start, end = rat.update(id, 2, 10*readSize, readSize)
+	require.True(t, start >= end)
+	start, end = rat.update(id, 1, readSize, readSize)
+	require.Equal(t, int64(2*readSize), start)
+	require.Equal(t, 2*readSize+readAheadInitialWindow, end)
+	start, end = rat.update(id, 2, 11*readSize, readSize)
+	require.Equal(t, int64(12*readSize), start)
+	require.Equal(t, 12*readSize+readAheadInitialWindow, end)
+}
+
+type readAheadTestPrefetcher struct {
+	Prefetcher
+	lock       sync.Mutex
+	ptrs       []BlockPointer
+	priorities []int
+}
+
+func (p *readAheadTestPrefetcher) PrefetchBlock(
+	block Block, ptr BlockPointer, kmd KeyMetadata, priority int) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.ptrs = append(p.ptrs, ptr)
+	p.priorities = append(p.priorities, priority)
+	return nil
+}
+
+func (p *readAheadTestPrefetcher) reset() (
+	ptrs []BlockPointer, priorities []int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	ptrs, priorities = p.ptrs, p.priorities
+	p.ptrs, p.priorities = nil, nil
+	return ptrs, priorities
+}
+
+type readAheadTestBlockOps struct {
+	BlockOps
+	p *readAheadTestPrefetcher
+}
+
+func (rbo readAheadTestBlockOps) Prefetcher() Prefetcher {
+	return rbo.p
+}
+
+func TestKBFSOpsReadAhead(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "alice")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	// Use small blocks, so that files get indirect blocks easily.
+	bsplit, err := NewBlockSplitterSimple(20, 8*1024, config.Codec())
+	require.NoError(t, err)
+	config.SetBlockSplitter(bsplit)
+	p := &readAheadTestPrefetcher{Prefetcher: config.BlockOps().Prefetcher()}
+	config.SetBlockOps(readAheadTestBlockOps{config.BlockOps(), p})
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "alice", tlf.Private)
+	fb := rootNode.GetFolderBranch()
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	data := make([]byte, 200)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+
+	t.Log("Dirty files aren't read ahead")
+	buf := make([]byte, 10)
+	for off := int64(0); off < 40; off += 10 {
+		_, err = kbfsOps.Read(ctx, fileNode, buf, off)
+		require.NoError(t, err)
+	}
+	ptrs, _ := p.reset()
+	require.Len(t, ptrs, 0)
+
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	ops := getOps(config, fb.Tlf)
+	ops.blocks.readAhead = newReadAheadTracker(readAheadMaxTrackedFiles)
+
+	t.Log("Sequential reads read ahead to the end of the file, in order")
+	_, err = kbfsOps.Read(ctx, fileNode, buf, 50)
+	require.NoError(t, err)
+	ptrs, _ = p.reset()
+	require.Len(t, ptrs, 0)
+	_, err = kbfsOps.Read(ctx, fileNode, buf, 60)
+	require.NoError(t, err)
+	ptrs, priorities := p.reset()
+	var expectedPtrs []BlockPointer
+	func() {
+		lState := makeFBOLockState()
+		head, _ := ops.getHead(lState)
+		ops.blocks.blockLock.RLock(lState)
+		defer ops.blocks.blockLock.RUnlock(lState)
+		fd := ops.blocks.newFileData(
+			lState, ops.nodeCache.PathFromNode(fileNode), "", head)
+		topBlock, _, err := fd.getter(
+			ctx, fd.kmd, fd.rootBlockPointer(), fd.file, blockRead)
+		require.NoError(t, err)
+		require.True(t, topBlock.IsInd)
+		pfr, err := fd.getIndirectBlocksForOffsetRange(ctx, topBlock, 0, -1)
+		require.NoError(t, err)
+		for _, pathFromRoot := range pfr {
+			iptr := pathFromRoot[len(pathFromRoot)-1].childIPtr()
+			if iptr.Off >= 70 {
+				expectedPtrs = append(expectedPtrs, iptr.BlockPointer)
+			}
+		}
+	}()
+	require.NotEmpty(t, expectedPtrs)
+	require.Equal(t, expectedPtrs, ptrs)
+	for i, priority := range priorities {
+		require.Equal(t, readAheadPrefetchPriority-i, priority)
+	}
+
+	t.Log("Blocks that were already requested aren't requested again")
+	_, err = kbfsOps.Read(ctx, fileNode, buf, 70)
+	require.NoError(t, err)
+	ptrs, _ = p.reset()
+	require.Len(t, ptrs, 0)
+}
@@ -34,6 +34,7 @@ const (
 	errorParamFoldersCreated      = "foldersCreated"
 	errorParamFolderLimit         = "folderLimit"
 	errorParamApplicationExecPath = "applicationExecPath"
+	errorParamConflictAction      = "conflictAction"
 
 	// error operation modes
 	errorModeRead  = "read"
@@ -346,6 +347,35 @@ func fileRenameNotification(oldFile path, newFile path, writer keybase1.UID,
 	return n
 }
 
+// conflictResolvedNotification creates FSNotifications for the
+// decisions made by conflict resolution.  An entry moved aside is
+// reported as a FILE_RENAMED event, and merged contents as a
+// FILE_MODIFIED event.  Either way, the conflictAction param marks
+// it as coming from conflict resolution.
+//
+// TODO: switch to a dedicated notification type once one is added
+// to the FSNotificationType enum in kbfs_common.avdl and
+// re-vendored.
+func conflictResolvedNotification(
+	record ConflictRecord, t tlf.Type) *keybase1.FSNotification {
+	n := &keybase1.FSNotification{
+		FolderType:       t.FolderType(),
+		Filename:         record.Path,
+		StatusCode:       keybase1.FSStatusCode_FINISH,
+		NotificationType: keybase1.FSNotificationType_FILE_MODIFIED,
+		Params: map[string]string{
+			errorParamConflictAction: string(record.Action),
+		},
+		LocalTime: keybase1.ToTime(record.Time),
+	}
+	if record.NewPath != "" {
+		n.Filename = record.NewPath
+		n.NotificationType = keybase1.FSNotificationType_FILE_RENAMED
+		n.Params[errorParamRenameOldFilename] = record.Path
+	}
+	return n
+}
+
 // connectionNotification creates FSNotifications based on whether
 // or not KBFS is online.
 func connectionNotification(status keybase1.FSStatusCode) *keybase1.FSNotification {
@@ -53,6 +53,18 @@ type PrivateMetadata struct {
 	// was performed on this TLF.
 	LastGCRevision kbfsmd.Revision `codec:"lgc"`
 
+	// How long entries removed from this TLF stay restorable,
+	// before garbage collection can delete their blocks.  Zero
+	// means they're collected along with all other unreferenced
+	// blocks.
+	TrashRetention time.Duration `codec:"tr,omitempty"`
+	// The earliest revision whose removed entries haven't been
+	// garbage-collected yet, because they were still in the trash
+	// when the rest of that revision was collected.  If it's not
+	// set, removed entries have been collected up to and including
+	// LastGCRevision.
+	TrashGCStartRevision kbfsmd.Revision `codec:"tgc,omitempty"`
+
 	codec.UnknownFieldSetHandler
 
 	// When the above Changes field gets unembedded into its own
@@ -387,6 +399,30 @@ func (md *RootMetadata) SetLastGCRevision(rev kbfsmd.Revision) {
 	md.data.LastGCRevision = rev
 }
 
+// SetTrashRetention sets how long entries removed from this TLF stay
+// restorable.
+func (md *RootMetadata) SetTrashRetention(retention time.Duration) {
+	md.data.TrashRetention = retention
+}
+
+// SetTrashGCStartRevision sets the earliest revision whose removed
+// entries haven't been garbage-collected yet, or
+// kbfsmd.RevisionUninitialized if they've all been collected up to
+// the last GC revision.
+func (md *RootMetadata) SetTrashGCStartRevision(rev kbfsmd.Revision) {
+	md.data.TrashGCStartRevision = rev
+}
+
+// lastTrashGCRevision returns the last revision up to and including
+// which the removed entries of this TLF have been garbage-collected.
+func (p PrivateMetadata) lastTrashGCRevision(
+	lastGCRev kbfsmd.Revision) kbfsmd.Revision {
+	if p.TrashGCStartRevision >= kbfsmd.RevisionInitial {
+		return p.TrashGCStartRevision - 1
+	}
+	return lastGCRev
+}
+
 // updateFromTlfHandle updates the current RootMetadata's fields to
 // reflect the given handle, which must be the result of running the
 // current handle with ResolveAgain().
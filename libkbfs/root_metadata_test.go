@@ -57,6 +57,8 @@ func makeFakePrivateMetadataFuture(t *testing.T) privateMetadataFuture {
 	resolutionOp := makeFakeResolutionOpFuture(t)
 	rekeyOp := makeFakeRekeyOpFuture(t)
 	gcOp := makeFakeGcOpFuture(t)
+	setXattrOp := makeFakeSetXattrOpFuture(t)
+	exchangeOp := makeFakeExchangeOpFuture(t)
 
 	pmf := privateMetadataFuture{
 		PrivateMetadata{
@@ -73,10 +75,14 @@ func makeFakePrivateMetadataFuture(t *testing.T) privateMetadataFuture {
 					&resolutionOp,
 					&rekeyOp,
 					&gcOp,
+					&setXattrOp,
+					&exchangeOp,
 				},
 				0,
 			},
 			0,
+			0,
+			0,
 			codec.UnknownFieldSetHandler{},
 			BlockChanges{},
 		},
@@ -0,0 +1,1001 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"golang.org/x/net/context"
+)
+
+const (
+	searchIndexFolderName     string = "kbfs_search_index"
+	searchIndexDbFilename     string = "searchIndex.leveldb"
+	currentSearchIndexVersion uint64 = 1
+	// Key prefixes for the kinds of entries in the index.
+	searchStateKeyPrefix byte = 's'
+	searchEntryKeyPrefix byte = 'e'
+	searchTermKeyPrefix  byte = 't'
+	// searchIndexMaxContentSize is the size of the largest file
+	// whose contents are indexed.
+	searchIndexMaxContentSize = 1 << 20
+	// searchIndexMaxTermLen is the length of the longest word that
+	// is indexed.
+	searchIndexMaxTermLen = 64
+	// searchIndexPollInterval is how often a TLF that's being
+	// indexed in the background is checked for new revisions,
+	// without being notified of a change.
+	searchIndexPollInterval = 10 * time.Second
+	// searchIndexBatchSize is roughly how many keys are changed in
+	// one write to the database, so that indexing a big TLF doesn't
+	// hold all of its changes in memory at once.
+	searchIndexBatchSize = 1000
+)
+
+// CtxSearchIndexTagKey is the type used for unique context tags
+// within SearchIndexStandard.
+type CtxSearchIndexTagKey int
+
+const (
+	// CtxSearchIndexIDKey is the type of the tag for unique
+	// operation IDs within SearchIndexStandard.
+	CtxSearchIndexIDKey CtxSearchIndexTagKey = iota
+)
+
+// CtxSearchIndexOpID is the display name for the unique operation
+// SearchIndexStandard ID tag.
+const CtxSearchIndexOpID = "SIID"
+
+type searchIndexConfig interface {
+	codecGetter
+	logMaker
+	KBFSOps() KBFSOps
+	MDOps() MDOps
+	Notifier() Notifier
+}
+
+// searchIndexState is the per-TLF state of the index.
+type searchIndexState struct {
+	// Revision is the last revision of the TLF that's indexed.
+	Revision kbfsmd.Revision `codec:"r"`
+	// Contents is whether the contents of files are indexed.
+	Contents bool `codec:"c"`
+}
+
+// searchIndexEntry is the indexed information about one entry of a
+// TLF.
+type searchIndexEntry struct {
+	Path  string    `codec:"p"`
+	Type  EntryType `codec:"t"`
+	Size  uint64    `codec:"s"`
+	Mtime int64     `codec:"m"`
+	// Terms are the words that the entry is indexed under.
+	Terms []string `codec:"w,omitempty"`
+	// Children are the names of the entries of a directory.
+	Children []string `codec:"c,omitempty"`
+}
+
+// searchIndexKeys are the keys used to encrypt the index of one TLF.
+// They're derived from the TLF's crypt key, so the index can only be
+// read by someone who can read the TLF itself.
+type searchIndexKeys struct {
+	// dataKey encrypts all the values stored in the index.
+	dataKey [32]byte
+	// nameKey hashes the paths and words used in the keys of the
+	// index, so that the keys can be looked up without revealing
+	// them.
+	nameKey []byte
+}
+
+func makeSearchIndexKeys(tlfKey kbfscrypto.TLFCryptKey) searchIndexKeys {
+	nameKey := deriveTLFLocalKey(tlfKey, "Keybase-KBFS-Search-Index-Names-1")
+	return searchIndexKeys{
+		dataKey: deriveTLFLocalKey(
+			tlfKey, "Keybase-KBFS-Search-Index-Data-1"),
+		nameKey: nameKey[:],
+	}
+}
+
+// hashName returns the keyed hash of a path or word of the given kind.
+func (k searchIndexKeys) hashName(kind byte, name string) []byte {
+	mac := hmac.New(sha256.New, k.nameKey)
+	mac.Write([]byte{kind})
+	mac.Write([]byte(name))
+	return mac.Sum(nil)
+}
+
+// searchTerms splits the given text into the distinct, lower-case
+// words that it's indexed and searched under.
+func searchTerms(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	seen := make(map[string]bool, len(words))
+	terms := make([]string, 0, len(words))
+	for _, word := range words {
+		if len(word) > searchIndexMaxTermLen || seen[word] {
+			continue
+		}
+		seen[word] = true
+		terms = append(terms, word)
+	}
+	return terms
+}
+
+// splitTlfRelativePath returns the parent directory and the name of
+// the given path, which is relative to the TLF root.
+func splitTlfRelativePath(p string) (dir, name string) {
+	i := strings.LastIndex(p, "/")
+	if i < 0 {
+		return "", p
+	}
+	return p[:i], p[i+1:]
+}
+
+func joinTlfRelativePath(dir, name string) string {
+	if dir == "" {
+		return name
+	}
+	return dir + "/" + name
+}
+
+// SearchIndexStandard is the standard implementation of SearchIndex,
+// backed by a leveldb database.  For each TLF, it stores an entry for
+// each indexed file or directory, and a list of the entries indexed
+// under each word.  The keys of the database are keyed hashes of the
+// paths and words, and the values are encrypted, using keys derived
+// from the TLF's crypt key.
+type SearchIndexStandard struct {
+	config        searchIndexConfig
+	log           logger.Logger
+	indexContents bool
+
+	// tlfLock protects tlfKeys and tlfSyncLocks.
+	tlfLock sync.Mutex
+	tlfKeys map[tlf.ID]searchIndexKeys
+	// tlfSyncLocks serialize the updates to the index of each TLF.
+	tlfSyncLocks map[tlf.ID]*sync.Mutex
+
+	// Protects the db from being shutdown while it's being
+	// accessed, and protects indexers.
+	lock     sync.RWMutex
+	stor     storage.Storage
+	db       *leveldb.DB
+	indexers map[tlf.ID]context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+var _ SearchIndex = (*SearchIndexStandard)(nil)
+
+// newSearchIndexStandardFromStorage creates a new
+// *SearchIndexStandard with the passed-in storage.Storage as its
+// storage layer.  The index closes the storage on shutdown.
+func newSearchIndexStandardFromStorage(config searchIndexConfig,
+	stor storage.Storage, indexContents bool) (*SearchIndexStandard, error) {
+	db, err := openLevelDB(stor)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &SearchIndexStandard{
+		config:        config,
+		log:           config.MakeLogger("SI"),
+		indexContents: indexContents,
+		tlfKeys:       make(map[tlf.ID]searchIndexKeys),
+		tlfSyncLocks:  make(map[tlf.ID]*sync.Mutex),
+		stor:          stor,
+		db:            db,
+		indexers:      make(map[tlf.ID]context.CancelFunc),
+	}, nil
+}
+
+// newSearchIndexStandard creates a new *SearchIndexStandard that
+// stores its data under the given storage root.
+func newSearchIndexStandard(config searchIndexConfig, storageRoot string,
+	indexContents bool) (*SearchIndexStandard, error) {
+	dirPath := filepath.Join(storageRoot, searchIndexFolderName)
+	dbPath := filepath.Join(
+		versionPathFromVersion(dirPath, currentSearchIndexVersion),
+		searchIndexDbFilename)
+	stor, err := storage.OpenFile(dbPath, false)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	index, err := newSearchIndexStandardFromStorage(
+		config, stor, indexContents)
+	if err != nil {
+		stor.Close()
+		return nil, err
+	}
+	return index, nil
+}
+
+func searchIndexKey(prefix byte, tlfID tlf.ID, hash []byte) []byte {
+	key := append([]byte{prefix}, tlfID.Bytes()...)
+	return append(key, hash...)
+}
+
+func (i *SearchIndexStandard) checkOpenLocked(op string) error {
+	if i.db == nil {
+		return errors.WithStack(SearchIndexClosedError{op})
+	}
+	return nil
+}
+
+func (i *SearchIndexStandard) dbGet(op string, key []byte) ([]byte, error) {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+	err := i.checkOpenLocked(op)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := i.db.Get(key, nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return buf, nil
+}
+
+func (i *SearchIndexStandard) dbWrite(op string, batch *leveldb.Batch) error {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+	err := i.checkOpenLocked(op)
+	if err != nil {
+		return err
+	}
+	return errors.WithStack(i.db.Write(batch, nil))
+}
+
+func (i *SearchIndexStandard) encrypt(
+	keys searchIndexKeys, obj interface{}) ([]byte, error) {
+	buf, err := i.config.Codec().Encode(obj)
+	if err != nil {
+		return nil, err
+	}
+	crypto := MakeCryptoCommon(i.config.Codec())
+	encrypted, err := crypto.encryptData(buf, keys.dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return i.config.Codec().Encode(encrypted)
+}
+
+func (i *SearchIndexStandard) decrypt(
+	keys searchIndexKeys, buf []byte, obj interface{}) error {
+	var encrypted encryptedData
+	err := i.config.Codec().Decode(buf, &encrypted)
+	if err != nil {
+		return err
+	}
+	crypto := MakeCryptoCommon(i.config.Codec())
+	buf, err = crypto.decryptData(encrypted, keys.dataKey)
+	if err != nil {
+		return err
+	}
+	return i.config.Codec().Decode(buf, obj)
+}
+
+// getSyncLock returns the lock that serializes the updates to the
+// index of the given TLF.
+func (i *SearchIndexStandard) getSyncLock(tlfID tlf.ID) *sync.Mutex {
+	i.tlfLock.Lock()
+	defer i.tlfLock.Unlock()
+	syncLock, ok := i.tlfSyncLocks[tlfID]
+	if !ok {
+		syncLock = &sync.Mutex{}
+		i.tlfSyncLocks[tlfID] = syncLock
+	}
+	return syncLock
+}
+
+// getKeys returns the keys for the index of the given TLF.
+func (i *SearchIndexStandard) getKeys(ctx context.Context,
+	h *TlfHandle, tlfID tlf.ID) (searchIndexKeys, error) {
+	i.tlfLock.Lock()
+	keys, ok := i.tlfKeys[tlfID]
+	i.tlfLock.Unlock()
+	if ok {
+		return keys, nil
+	}
+	tlfKey, err := getFirstTLFCryptKey(tlfID,
+		func() ([]kbfscrypto.TLFCryptKey, error) {
+			tlfKeys, _, err := i.config.KBFSOps().GetTLFCryptKeys(ctx, h)
+			return tlfKeys, err
+		})
+	if err != nil {
+		return searchIndexKeys{}, err
+	}
+	keys = makeSearchIndexKeys(tlfKey)
+	i.tlfLock.Lock()
+	defer i.tlfLock.Unlock()
+	i.tlfKeys[tlfID] = keys
+	return keys, nil
+}
+
+// searchIndexTxn buffers a set of changes to the index of one TLF, so
+// that they can be read back before they're written out together.
+type searchIndexTxn struct {
+	i     *SearchIndexStandard
+	tlfID tlf.ID
+	keys  searchIndexKeys
+	// pending maps keys to their new values, or to nil for deleted
+	// keys.
+	pending map[string][]byte
+	// terms maps each word whose entries have been looked up to the
+	// set of IDs of its entries, including any pending changes.
+	// They're only encoded once, when they're committed.
+	terms map[string]map[string]bool
+}
+
+func (i *SearchIndexStandard) newTxn(
+	tlfID tlf.ID, keys searchIndexKeys) *searchIndexTxn {
+	return &searchIndexTxn{
+		i:       i,
+		tlfID:   tlfID,
+		keys:    keys,
+		pending: make(map[string][]byte),
+		terms:   make(map[string]map[string]bool),
+	}
+}
+
+// get decrypts the value of the given key into obj, and returns false
+// if there's no such key.
+func (t *searchIndexTxn) get(key []byte, obj interface{}) (bool, error) {
+	buf, ok := t.pending[string(key)]
+	if !ok {
+		var err error
+		buf, err = t.i.dbGet("Get", key)
+		if err != nil {
+			return false, err
+		}
+	}
+	if buf == nil {
+		return false, nil
+	}
+	err := t.i.decrypt(t.keys, buf, obj)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (t *searchIndexTxn) put(key []byte, obj interface{}) error {
+	buf, err := t.i.encrypt(t.keys, obj)
+	if err != nil {
+		return err
+	}
+	t.pending[string(key)] = buf
+	return nil
+}
+
+func (t *searchIndexTxn) remove(key []byte) {
+	t.pending[string(key)] = nil
+}
+
+// commit writes out all the pending changes, after which the
+// transaction can keep being used for more changes.
+func (t *searchIndexTxn) commit() error {
+	for term, set := range t.terms {
+		err := t.setTermEntries(term, set)
+		if err != nil {
+			return err
+		}
+	}
+	batch := new(leveldb.Batch)
+	for key, buf := range t.pending {
+		if buf == nil {
+			batch.Delete([]byte(key))
+		} else {
+			batch.Put([]byte(key), buf)
+		}
+	}
+	err := t.i.dbWrite("Commit", batch)
+	if err != nil {
+		return err
+	}
+	t.pending = make(map[string][]byte)
+	t.terms = make(map[string]map[string]bool)
+	return nil
+}
+
+// maybeCommit commits the pending changes once there are enough of
+// them.  Callers must only do so where the index is consistent
+// enough to be picked up again from the last committed state
+// revision.
+func (t *searchIndexTxn) maybeCommit() error {
+	if len(t.pending)+len(t.terms) < searchIndexBatchSize {
+		return nil
+	}
+	return t.commit()
+}
+
+func (t *searchIndexTxn) stateKey() []byte {
+	return searchIndexKey(searchStateKeyPrefix, t.tlfID, nil)
+}
+
+func (t *searchIndexTxn) entryKey(entryID []byte) []byte {
+	return searchIndexKey(searchEntryKeyPrefix, t.tlfID, entryID)
+}
+
+func (t *searchIndexTxn) entryID(p string) []byte {
+	return t.keys.hashName(searchEntryKeyPrefix, p)
+}
+
+func (t *searchIndexTxn) termKey(term string) []byte {
+	return searchIndexKey(searchTermKeyPrefix, t.tlfID,
+		t.keys.hashName(searchTermKeyPrefix, term))
+}
+
+func (t *searchIndexTxn) getEntry(p string) (*searchIndexEntry, error) {
+	var entry searchIndexEntry
+	ok, err := t.get(t.entryKey(t.entryID(p)), &entry)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// getTermEntries returns the set of IDs of the entries indexed under
+// the given word.  Changes to the returned set are written out when
+// the transaction is committed.
+func (t *searchIndexTxn) getTermEntries(term string) (
+	map[string]bool, error) {
+	if set, ok := t.terms[term]; ok {
+		return set, nil
+	}
+	var ids []string
+	_, err := t.get(t.termKey(term), &ids)
+	if err != nil {
+		return nil, err
+	}
+	set := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		set[id] = true
+	}
+	t.terms[term] = set
+	return set, nil
+}
+
+func (t *searchIndexTxn) setTermEntries(
+	term string, set map[string]bool) error {
+	if len(set) == 0 {
+		t.remove(t.termKey(term))
+		return nil
+	}
+	ids := make([]string, 0, len(set))
+	for id := range set {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return t.put(t.termKey(term), ids)
+}
+
+// setChild adds or removes a name from the children of the directory
+// at the given path, if it's indexed.
+func (t *searchIndexTxn) setChild(dir, name string, present bool) error {
+	dirEntry, err := t.getEntry(dir)
+	if err != nil || dirEntry == nil {
+		return err
+	}
+	children := dirEntry.Children[:0]
+	for _, child := range dirEntry.Children {
+		if child != name {
+			children = append(children, child)
+		}
+	}
+	if present {
+		children = append(children, name)
+	}
+	dirEntry.Children = children
+	return t.put(t.entryKey(t.entryID(dir)), dirEntry)
+}
+
+// addEntry indexes a new entry, which must not already be indexed.
+func (t *searchIndexTxn) addEntry(entry searchIndexEntry) error {
+	id := t.entryID(entry.Path)
+	for _, term := range entry.Terms {
+		set, err := t.getTermEntries(term)
+		if err != nil {
+			return err
+		}
+		set[string(id)] = true
+	}
+	err := t.put(t.entryKey(id), entry)
+	if err != nil {
+		return err
+	}
+	if entry.Path == "" {
+		return nil
+	}
+	dir, name := splitTlfRelativePath(entry.Path)
+	return t.setChild(dir, name, true)
+}
+
+// removeSubtree removes the entry at the given path, and everything
+// under it, from the index.
+func (t *searchIndexTxn) removeSubtree(p string) error {
+	entry, err := t.getEntry(p)
+	if err != nil || entry == nil {
+		return err
+	}
+	for _, child := range entry.Children {
+		err := t.removeSubtree(joinTlfRelativePath(p, child))
+		if err != nil {
+			return err
+		}
+	}
+	id := t.entryID(p)
+	for _, term := range entry.Terms {
+		set, err := t.getTermEntries(term)
+		if err != nil {
+			return err
+		}
+		delete(set, string(id))
+	}
+	t.remove(t.entryKey(id))
+	if p == "" {
+		return nil
+	}
+	dir, name := splitTlfRelativePath(p)
+	return t.setChild(dir, name, false)
+}
+
+// getFileTerms returns the words in the contents of the given file,
+// if it looks like text.
+func (i *SearchIndexStandard) getFileTerms(
+	ctx context.Context, file Node, size uint64) ([]string, error) {
+	if size == 0 || size > searchIndexMaxContentSize {
+		return nil, nil
+	}
+	buf := make([]byte, size)
+	n, err := i.config.KBFSOps().Read(ctx, file, buf, 0)
+	if err != nil {
+		return nil, err
+	}
+	buf = buf[:n]
+	if bytes.IndexByte(buf, 0) >= 0 || !utf8.Valid(buf) {
+		return nil, nil
+	}
+	return searchTerms(string(buf)), nil
+}
+
+// indexSubtree adds the entry at the given path, and everything under
+// it, to the index.
+func (i *SearchIndexStandard) indexSubtree(ctx context.Context,
+	txn *searchIndexTxn, node Node, p string, ei EntryInfo) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+
+	_, name := splitTlfRelativePath(p)
+	entry := searchIndexEntry{
+		Path:  p,
+		Type:  ei.Type,
+		Size:  ei.Size,
+		Mtime: ei.Mtime,
+		Terms: searchTerms(name),
+	}
+	if i.indexContents && ei.Type.IsFile() {
+		contentTerms, err := i.getFileTerms(ctx, node, ei.Size)
+		if err != nil {
+			return err
+		}
+		entry.Terms = searchTerms(
+			strings.Join(append(entry.Terms, contentTerms...), " "))
+	}
+	err := txn.addEntry(entry)
+	if err != nil {
+		return err
+	}
+	err = txn.maybeCommit()
+	if err != nil {
+		return err
+	}
+	if ei.Type != Dir {
+		return nil
+	}
+
+	children, err := i.config.KBFSOps().GetDirChildren(ctx, node)
+	if err != nil {
+		return err
+	}
+	for childName, childEI := range children {
+		childNode, _, err := i.config.KBFSOps().Lookup(ctx, node, childName)
+		if err != nil {
+			return err
+		}
+		err = i.indexSubtree(
+			ctx, txn, childNode, joinTlfRelativePath(p, childName), childEI)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lookupPath returns the node at the given path, or a nil node if
+// there's no such path.
+func (i *SearchIndexStandard) lookupPath(ctx context.Context,
+	rootNode Node, rootEI EntryInfo, p string) (Node, EntryInfo, error) {
+	node, ei := rootNode, rootEI
+	if p == "" {
+		return node, ei, nil
+	}
+	for _, name := range strings.Split(p, "/") {
+		if ei.Type != Dir {
+			return nil, EntryInfo{}, nil
+		}
+		var err error
+		node, ei, err = i.config.KBFSOps().Lookup(ctx, node, name)
+		if _, ok := errors.Cause(err).(NoSuchNameError); ok {
+			return nil, EntryInfo{}, nil
+		} else if err != nil {
+			return nil, EntryInfo{}, err
+		}
+	}
+	return node, ei, nil
+}
+
+// refreshPath re-indexes the given path, as it is in the current
+// state of the TLF.
+func (i *SearchIndexStandard) refreshPath(ctx context.Context,
+	txn *searchIndexTxn, rootNode Node, rootEI EntryInfo, p string) error {
+	// If the parent isn't indexed, refresh the closest indexed
+	// ancestor instead, so that no entry is left without a parent.
+	for p != "" {
+		dir, _ := splitTlfRelativePath(p)
+		dirEntry, err := txn.getEntry(dir)
+		if err != nil {
+			return err
+		}
+		if dirEntry != nil {
+			break
+		}
+		p = dir
+	}
+
+	err := txn.removeSubtree(p)
+	if err != nil {
+		return err
+	}
+	node, ei, err := i.lookupPath(ctx, rootNode, rootEI, p)
+	if err != nil || node == nil {
+		return err
+	}
+	return i.indexSubtree(ctx, txn, node, p, ei)
+}
+
+func (i *SearchIndexStandard) removeTlf(tlfID tlf.ID) error {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+	err := i.checkOpenLocked("RemoveTlf")
+	if err != nil {
+		return err
+	}
+	batch := new(leveldb.Batch)
+	for _, prefix := range []byte{
+		searchStateKeyPrefix, searchEntryKeyPrefix, searchTermKeyPrefix} {
+		iter := i.db.NewIterator(util.BytesPrefix(
+			searchIndexKey(prefix, tlfID, nil)), nil)
+		for iter.Next() {
+			batch.Delete(append([]byte(nil), iter.Key()...))
+		}
+		iter.Release()
+		if err := iter.Error(); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return errors.WithStack(i.db.Write(batch, nil))
+}
+
+// buildTlf indexes the given TLF from scratch, replacing anything
+// already indexed for it, and returns the new state of its index.
+func (i *SearchIndexStandard) buildTlf(ctx context.Context, fb FolderBranch,
+	keys searchIndexKeys, rootNode Node, rootEI EntryInfo) (
+	searchIndexState, error) {
+	i.log.CDebugf(ctx, "Building the index for %s", fb.Tlf)
+	status, _, err := i.config.KBFSOps().FolderStatus(ctx, fb)
+	if err != nil {
+		return searchIndexState{}, err
+	}
+	err = i.removeTlf(fb.Tlf)
+	if err != nil {
+		return searchIndexState{}, err
+	}
+	// Index everything as of at least this revision; any changes
+	// after it are applied later, which is harmless for the ones
+	// that are already reflected.  The state is only written after
+	// the last batch, so an interrupted build starts over.
+	state := searchIndexState{
+		Revision: status.Revision,
+		Contents: i.indexContents,
+	}
+	txn := i.newTxn(fb.Tlf, keys)
+	err = i.indexSubtree(ctx, txn, rootNode, "", rootEI)
+	if err != nil {
+		return searchIndexState{}, err
+	}
+	err = txn.put(txn.stateKey(), state)
+	if err != nil {
+		return searchIndexState{}, err
+	}
+	err = txn.commit()
+	if err != nil {
+		return searchIndexState{}, err
+	}
+	return state, nil
+}
+
+// syncTlf brings the index of the given TLF up to date with its
+// latest merged revision.
+func (i *SearchIndexStandard) syncTlf(ctx context.Context, h *TlfHandle) (
+	tlf.ID, searchIndexKeys, error) {
+	kbfsOps := i.config.KBFSOps()
+	rootNode, rootEI, err := kbfsOps.GetOrCreateRootNode(
+		ctx, h, MasterBranch)
+	if err != nil {
+		return tlf.ID{}, searchIndexKeys{}, err
+	}
+	fb := rootNode.GetFolderBranch()
+	syncLock := i.getSyncLock(fb.Tlf)
+	syncLock.Lock()
+	defer syncLock.Unlock()
+	keys, err := i.getKeys(ctx, h, fb.Tlf)
+	if err != nil {
+		return tlf.ID{}, searchIndexKeys{}, err
+	}
+
+	var state searchIndexState
+	txn := i.newTxn(fb.Tlf, keys)
+	ok, err := txn.get(txn.stateKey(), &state)
+	if err != nil {
+		return tlf.ID{}, searchIndexKeys{}, err
+	}
+	if !ok || state.Contents != i.indexContents {
+		state, err = i.buildTlf(ctx, fb, keys, rootNode, rootEI)
+		if err != nil {
+			return tlf.ID{}, searchIndexKeys{}, err
+		}
+	}
+
+	for {
+		changes, lastRev, err := kbfsOps.GetPathChanges(
+			ctx, fb, state.Revision)
+		if e, ok := errors.Cause(err).(PathChangesReclaimedError); ok {
+			// The changes made since the index was last updated
+			// can't all be listed anymore, so start over.
+			i.log.CDebugf(ctx, "Revisions of %s after %d were reclaimed "+
+				"up to %d", fb.Tlf, e.Since, e.LastGCRevision)
+			state, err = i.buildTlf(ctx, fb, keys, rootNode, rootEI)
+			if err != nil {
+				return tlf.ID{}, searchIndexKeys{}, err
+			}
+			continue
+		} else if err != nil {
+			return tlf.ID{}, searchIndexKeys{}, err
+		}
+		if lastRev == state.Revision {
+			return fb.Tlf, keys, nil
+		}
+		i.log.CDebugf(ctx, "Indexing %d changes to %s up to revision %d",
+			len(changes), fb.Tlf, lastRev)
+
+		// Each change re-indexes its paths from scratch, so if
+		// this is interrupted after some of the batches are
+		// committed, it's safe to apply them all again.
+		txn = i.newTxn(fb.Tlf, keys)
+		for _, change := range changes {
+			if change.Type == PathRenamed {
+				err := i.refreshPath(
+					ctx, txn, rootNode, rootEI, change.OldPath)
+				if err != nil {
+					return tlf.ID{}, searchIndexKeys{}, err
+				}
+			}
+			err := i.refreshPath(ctx, txn, rootNode, rootEI, change.Path)
+			if err != nil {
+				return tlf.ID{}, searchIndexKeys{}, err
+			}
+			err = txn.maybeCommit()
+			if err != nil {
+				return tlf.ID{}, searchIndexKeys{}, err
+			}
+		}
+		state.Revision = lastRev
+		err = txn.put(txn.stateKey(), state)
+		if err != nil {
+			return tlf.ID{}, searchIndexKeys{}, err
+		}
+		err = txn.commit()
+		if err != nil {
+			return tlf.ID{}, searchIndexKeys{}, err
+		}
+	}
+}
+
+// Search implements the SearchIndex interface for SearchIndexStandard.
+func (i *SearchIndexStandard) Search(ctx context.Context, h *TlfHandle,
+	dir string, query string, maxResults int) ([]SearchResult, error) {
+	terms := searchTerms(query)
+	if len(terms) == 0 {
+		return nil, errors.Errorf("No words to search for in %q", query)
+	}
+	tlfID, keys, err := i.syncTlf(ctx, h)
+	if err != nil {
+		return nil, err
+	}
+
+	txn := i.newTxn(tlfID, keys)
+	var ids map[string]bool
+	for _, term := range terms {
+		set, err := txn.getTermEntries(term)
+		if err != nil {
+			return nil, err
+		}
+		if ids == nil {
+			ids = set
+			continue
+		}
+		for id := range ids {
+			if !set[id] {
+				delete(ids, id)
+			}
+		}
+	}
+
+	dir = cleanTlfRelativePath(dir)
+	var results []SearchResult
+	for id := range ids {
+		var entry searchIndexEntry
+		ok, err := txn.get(txn.entryKey([]byte(id)), &entry)
+		if err != nil {
+			return nil, err
+		}
+		if !ok || entry.Path == dir || !pathHasPrefix(entry.Path, dir) {
+			continue
+		}
+		results = append(results, SearchResult{
+			Path:  entry.Path,
+			Type:  entry.Type,
+			Size:  entry.Size,
+			Mtime: entry.Mtime,
+		})
+	}
+	sort.Slice(results, func(a, b int) bool {
+		return results[a].Path < results[b].Path
+	})
+	if maxResults > 0 && len(results) > maxResults {
+		results = results[:maxResults]
+	}
+	return results, nil
+}
+
+func (i *SearchIndexStandard) indexInBackground(
+	ctx context.Context, tlfID tlf.ID) {
+	defer i.wg.Done()
+	rmd, err := i.config.MDOps().GetForTLF(ctx, tlfID)
+	if err != nil {
+		i.log.CDebugf(ctx, "Couldn't get the head of %s: %+v", tlfID, err)
+		return
+	}
+	if rmd == (ImmutableRootMetadata{}) {
+		i.log.CDebugf(ctx, "%s has no revisions to index", tlfID)
+		return
+	}
+	h := rmd.GetTlfHandle()
+
+	// The first sync makes sure the TLF is initialized, before
+	// registering for its changes.
+	_, _, err = i.syncTlf(ctx, h)
+	if err != nil {
+		i.log.CDebugf(ctx, "Couldn't index %s: %+v", tlfID, err)
+	}
+	fb := FolderBranch{Tlf: tlfID, Branch: MasterBranch}
+	waiter := newPathChangeWaiter()
+	err = i.config.Notifier().RegisterForChanges([]FolderBranch{fb}, waiter)
+	if err != nil {
+		i.log.CDebugf(ctx, "Couldn't register for changes to %s: %+v",
+			tlfID, err)
+		return
+	}
+	defer func() {
+		err := i.config.Notifier().UnregisterFromChanges(
+			[]FolderBranch{fb}, waiter)
+		if err != nil {
+			i.log.CDebugf(ctx, "Couldn't unregister: %+v", err)
+		}
+	}()
+
+	for {
+		select {
+		case <-waiter.changed:
+		case <-time.After(searchIndexPollInterval):
+		case <-ctx.Done():
+			return
+		}
+		_, _, err := i.syncTlf(ctx, h)
+		if err != nil && ctx.Err() == nil {
+			i.log.CDebugf(ctx, "Couldn't index %s: %+v", tlfID, err)
+		}
+	}
+}
+
+// StartIndexing implements the SearchIndex interface for
+// SearchIndexStandard.
+func (i *SearchIndexStandard) StartIndexing(tlfID tlf.ID) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	if i.db == nil {
+		return
+	}
+	if _, ok := i.indexers[tlfID]; ok {
+		return
+	}
+	ctx, cancel := context.WithCancel(CtxWithRandomIDReplayable(
+		context.Background(), CtxSearchIndexIDKey, CtxSearchIndexOpID,
+		i.log))
+	i.indexers[tlfID] = cancel
+	i.wg.Add(1)
+	go i.indexInBackground(ctx, tlfID)
+}
+
+// StopIndexing implements the SearchIndex interface for
+// SearchIndexStandard.
+func (i *SearchIndexStandard) StopIndexing(tlfID tlf.ID) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	if cancel, ok := i.indexers[tlfID]; ok {
+		cancel()
+		delete(i.indexers, tlfID)
+	}
+}
+
+// Shutdown implements the SearchIndex interface for
+// SearchIndexStandard.
+func (i *SearchIndexStandard) Shutdown() {
+	i.lock.Lock()
+	for tlfID, cancel := range i.indexers {
+		cancel()
+		delete(i.indexers, tlfID)
+	}
+	i.lock.Unlock()
+	i.wg.Wait()
+
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	if i.db == nil {
+		return
+	}
+	err := i.db.Close()
+	if err != nil {
+		i.log.Warning("Error closing the search index: %+v", err)
+	}
+	i.db = nil
+	// Release the storage lock, so the index can be opened again.
+	err = i.stor.Close()
+	if err != nil {
+		i.log.Warning("Error closing the search index storage: %+v", err)
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/keybase/kbfs/ioutil"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSearchTerms(t *testing.T) {
+	require.Equal(t, []string{"report", "2017", "txt"},
+		searchTerms("Report-2017.txt"))
+	require.Equal(t, []string{"a", "b"}, searchTerms("  a, B;a\n\tb "))
+	require.Equal(t, []string{"über", "straße"},
+		searchTerms("Über Straße"))
+	require.Len(t, searchTerms(string(make([]byte, 10))), 0)
+}
+
+func searchPaths(t *testing.T, results []SearchResult) []string {
+	paths := make([]string, 0, len(results))
+	for _, result := range results {
+		paths = append(paths, result.Path)
+	}
+	return paths
+}
+
+func TestSearchIndexStandard(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "alice")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	clock, now := newTestClockAndTimeNow()
+	config.SetClock(clock)
+
+	tempdir, err := ioutil.TempDir(os.TempDir(), "search_index")
+	require.NoError(t, err)
+	defer func() {
+		err := ioutil.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+	config.storageRoot = tempdir
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "alice", tlf.Private)
+	fb := rootNode.GetFolderBranch()
+	kbfsOps := config.KBFSOps()
+	h, err := ParseTlfHandle(ctx, config.KBPKI(), "alice", tlf.Private)
+	require.NoError(t, err)
+	writeFile := func(dir Node, name string, data string) {
+		n, _, err := kbfsOps.CreateFile(ctx, dir, name, false, NoExcl)
+		require.NoError(t, err)
+		err = kbfsOps.Write(ctx, n, []byte(data), 0)
+		require.NoError(t, err)
+		err = kbfsOps.SyncAll(ctx, fb)
+		require.NoError(t, err)
+	}
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "docs")
+	require.NoError(t, err)
+	writeFile(dirNode, "Report-2017.txt", "Quarterly earnings summary")
+	writeFile(rootNode, "notes.md", "Notes from the earnings call")
+
+	index, err := newSearchIndexStandard(config, tempdir, true)
+	require.NoError(t, err)
+
+	t.Log("The first search indexes the whole TLF.")
+	results, err := index.Search(ctx, h, "", "earnings", 0)
+	require.NoError(t, err)
+	require.Equal(t,
+		[]string{"docs/Report-2017.txt", "notes.md"}, searchPaths(t, results))
+	require.Equal(t, File, results[0].Type)
+	require.Equal(t, uint64(26), results[0].Size)
+	results, err = index.Search(ctx, h, "", "REPORT 2017", 0)
+	require.NoError(t, err)
+	require.Equal(t, []string{"docs/Report-2017.txt"}, searchPaths(t, results))
+	results, err = index.Search(ctx, h, "docs", "earnings", 0)
+	require.NoError(t, err)
+	require.Equal(t, []string{"docs/Report-2017.txt"}, searchPaths(t, results))
+	results, err = index.Search(ctx, h, "", "earnings", 1)
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	results, err = index.Search(ctx, h, "", "earnings missing", 0)
+	require.NoError(t, err)
+	require.Len(t, results, 0)
+	_, err = index.Search(ctx, h, "", "...", 0)
+	require.Error(t, err)
+
+	t.Log("Nothing is stored in the clear.")
+	iter := index.db.NewIterator(nil, nil)
+	for iter.Next() {
+		for _, word := range []string{"earnings", "Report", "docs"} {
+			require.False(t, bytes.Contains(iter.Key(), []byte(word)))
+			require.False(t, bytes.Contains(iter.Value(), []byte(word)))
+		}
+	}
+	iter.Release()
+	require.NoError(t, iter.Error())
+	index.Shutdown()
+
+	t.Log("Later changes are indexed incrementally, after a restart.")
+	err = kbfsOps.Rename(ctx, rootNode, "docs", rootNode, "archive", RenameReplace)
+	require.NoError(t, err)
+	err = kbfsOps.RemoveEntry(ctx, rootNode, "notes.md")
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	writeFile(rootNode, "todo", "Send the earnings report")
+	index, err = newSearchIndexStandard(config, tempdir, true)
+	require.NoError(t, err)
+	defer index.Shutdown()
+	results, err = index.Search(ctx, h, "", "earnings", 0)
+	require.NoError(t, err)
+	require.Equal(t,
+		[]string{"archive/Report-2017.txt", "todo"}, searchPaths(t, results))
+	results, err = index.Search(ctx, h, "", "docs", 0)
+	require.NoError(t, err)
+	require.Len(t, results, 0)
+	results, err = index.Search(ctx, h, "", "archive", 0)
+	require.NoError(t, err)
+	require.Equal(t, []string{"archive"}, searchPaths(t, results))
+	require.Equal(t, Dir, results[0].Type)
+
+	t.Log("Changes in revisions that QR has already covered are picked " +
+		"up by rebuilding the index.")
+	err = kbfsOps.RemoveEntry(ctx, rootNode, "todo")
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	clock.Set(now.Add(2 * config.QuotaReclamationMinUnrefAge()))
+	ops := getOps(config, fb.Tlf)
+	ops.fbm.forceQuotaReclamation()
+	err = ops.fbm.waitForQuotaReclamations(ctx)
+	require.NoError(t, err)
+	results, err = index.Search(ctx, h, "", "earnings", 0)
+	require.NoError(t, err)
+	require.Equal(t,
+		[]string{"archive/Report-2017.txt"}, searchPaths(t, results))
+}
+
+func TestSearchIndexNamesOnly(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "alice")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	tempdir, err := ioutil.TempDir(os.TempDir(), "search_index")
+	require.NoError(t, err)
+	defer func() {
+		err := ioutil.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+	config.storageRoot = tempdir
+	err = config.EnableSearchIndex(false)
+	require.NoError(t, err)
+	index := config.SearchIndex()
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "alice", tlf.Public)
+	kbfsOps := config.KBFSOps()
+	h, err := ParseTlfHandle(ctx, config.KBPKI(), "alice", tlf.Public)
+	require.NoError(t, err)
+	n, _, err := kbfsOps.CreateFile(ctx, rootNode, "build.log", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, n, []byte("build succeeded"), 0)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	results, err := index.Search(ctx, h, "", "build", 0)
+	require.NoError(t, err)
+	require.Equal(t, []string{"build.log"}, searchPaths(t, results))
+	results, err = index.Search(ctx, h, "", "succeeded", 0)
+	require.NoError(t, err)
+	require.Len(t, results, 0)
+}
@@ -60,6 +60,14 @@ func (sc *StateChecker) findAllBlocksInPath(ctx context.Context,
 		return err
 	}
 
+	infos, err := ops.blocks.GetIndirectDirBlockInfos(ctx, lState, kmd, dir)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		blockSizes[info.BlockPointer] = info.EncodedSize
+	}
+
 	for name, de := range dblock.Children {
 		if de.Type == Sym {
 			continue
@@ -147,6 +155,9 @@ func (sc *StateChecker) CheckMergedState(ctx context.Context, tlfID tlf.ID) erro
 	expectedRef := uint64(0)
 	expectedMDRef := uint64(0)
 	archivedBlocks := make(map[BlockPointer]bool)
+	// Blocks of removed entries that are unreferenced, but not
+	// archived, because they're still in the trash.
+	trashedBlocks := make(map[BlockPointer]bool)
 	actualLiveBlocks := make(map[BlockPointer]uint32)
 
 	// See what the last GC op revision is.  All unref'd pointers from
@@ -167,6 +178,10 @@ func (sc *StateChecker) CheckMergedState(ctx context.Context, tlfID tlf.ID) erro
 			gcRevision = GCOp.LatestRev
 		}
 	}
+	// Removed entries that were still in the trash might not have
+	// been collected along with the rest of their revisions.
+	lastMD := rmds[len(rmds)-1]
+	trashGCRevision := lastMD.data.lastTrashGCRevision(gcRevision)
 
 	for _, rmd := range rmds {
 		// Don't process copies.
@@ -191,6 +206,10 @@ func (sc *StateChecker) CheckMergedState(ctx context.Context, tlfID tlf.ID) erro
 			}
 		}
 
+		revGCRevision := gcRevision
+		if isTrashRevision(rmd.ReadOnly()) {
+			revGCRevision = trashGCRevision
+		}
 		var hasGCOp bool
 		for _, op := range rmd.data.Changes.Ops {
 			_, isGCOp := op.(*GCOp)
@@ -213,8 +232,11 @@ func (sc *StateChecker) CheckMergedState(ctx context.Context, tlfID tlf.ID) erro
 						// indicates a failed and retried sync), the
 						// corresponding block should already be
 						// cleaned up.
-						if rmd.Revision() <= gcRevision || opRefs[ptr] {
+						if rmd.Revision() <= revGCRevision || opRefs[ptr] {
 							delete(archivedBlocks, ptr)
+							delete(trashedBlocks, ptr)
+						} else if isTrashOp(op, rmd.data.TrashRetention) {
+							trashedBlocks[ptr] = true
 						} else {
 							archivedBlocks[ptr] = true
 						}
@@ -226,7 +248,7 @@ func (sc *StateChecker) CheckMergedState(ctx context.Context, tlfID tlf.ID) erro
 					delete(expectedLiveBlocks, update.Unref)
 				}
 				if update.Unref != zeroPtr && update.Ref != update.Unref {
-					if rmd.Revision() <= gcRevision {
+					if rmd.Revision() <= revGCRevision {
 						delete(archivedBlocks, update.Unref)
 					} else {
 						archivedBlocks[update.Unref] = true
@@ -369,6 +391,12 @@ func (sc *StateChecker) CheckMergedState(ctx context.Context, tlfID tlf.ID) erro
 		}
 		blockRefsByID[ptr.ID].put(ptr.Context, archivedBlockRef, "")
 	}
+	for ptr := range trashedBlocks {
+		if _, ok := blockRefsByID[ptr.ID]; !ok {
+			blockRefsByID[ptr.ID] = make(blockRefMap)
+		}
+		blockRefsByID[ptr.ID].put(ptr.Context, liveBlockRef, "")
+	}
 
 	if g, e := bserverKnownBlocks, blockRefsByID; !reflect.DeepEqual(g, e) {
 		for id, eRefs := range e {
@@ -50,7 +50,8 @@ func newConfigForTest(mode InitMode,
 	config.SetBlockOps(bops)
 
 	config.SetBlockSplitter(&BlockSplitterSimple{
-		64 * 1024, 64 * 1024 / int(bpSize), 8 * 1024})
+		64 * 1024, 64 * 1024 / int(bpSize), 8 * 1024,
+		64 * 1024 / int(deSize+maxNameBytesDefault)})
 
 	return config
 }
@@ -286,7 +286,7 @@ func TestLongTlfEditHistory(t *testing.T) {
 	err = kbfsOps1.RemoveEntry(ctx, rootNode1, rmFile2)
 	require.NoError(t, err)
 	err = kbfsOps1.Rename(ctx, rootNode1, renameFile, rootNode1,
-		renameFile+".New")
+		renameFile+".New", RenameReplace)
 	require.NoError(t, err)
 
 	err = kbfsOps2.SyncFromServerForTesting(ctx, rootNode2.GetFolderBranch())
@@ -876,10 +876,19 @@ func (j *tlfJournal) checkServerForConflicts(ctx context.Context) error {
 		return nil
 	}
 
-	nextMDToFlush, err := func() (kbfsmd.Revision, error) {
+	nextMDToFlush, nextMDID, err := func() (
+		kbfsmd.Revision, kbfsmd.ID, error) {
 		j.journalLock.RLock()
 		defer j.journalLock.RUnlock()
-		return j.mdJournal.readEarliestRevision()
+		entry, exists, err := j.mdJournal.j.getEarliestEntry()
+		if err != nil || !exists {
+			return kbfsmd.RevisionUninitialized, kbfsmd.ID{}, err
+		}
+		rev, err := j.mdJournal.readEarliestRevision()
+		if err != nil {
+			return kbfsmd.RevisionUninitialized, kbfsmd.ID{}, err
+		}
+		return rev, entry.ID, nil
 	}()
 	if err != nil {
 		return err
@@ -906,6 +915,21 @@ func (j *tlfJournal) checkServerForConflicts(ctx context.Context) error {
 		// We're still up-to-date with the server.  Nothing left to do.
 		return nil
 	}
+	if currHead.MD.RevisionNumber() >= nextMDToFlush {
+		// The next MD may have been flushed already, e.g. by
+		// another device that imported a bundle of this journal.
+		// If so, flushOneMDOp will skip it once its blocks are
+		// flushed.
+		serverMDID, err := getMdID(ctx, j.config.MDServer(),
+			j.config.Codec(), j.tlfID, NullBranchID, Merged, nextMDToFlush)
+		if err != nil {
+			return err
+		}
+		if serverMDID == nextMDID {
+			j.log.CDebugf(ctx, "Revision %d was already flushed", nextMDToFlush)
+			return nil
+		}
+	}
 
 	j.log.CDebugf(ctx, "Server is ahead of local journal (rev=%d), "+
 		"indicating a conflict", currHead.MD.RevisionNumber())
@@ -0,0 +1,113 @@
+// Copyright 2018 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+
+	"github.com/keybase/kbfs/ioutil"
+	"github.com/keybase/kbfs/kbfscodec"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// getFirstTLFCryptKey returns the crypt key that keys for the local
+// data kept about the given TLF are derived from.  Public TLFs use
+// the well-known public key.  Private TLFs use their first key
+// generation, which stays the same across rekeys and is available
+// to all current readers; `getKeys` is only called for private TLFs,
+// and must return the TLF's keys in key generation order.
+func getFirstTLFCryptKey(tlfID tlf.ID,
+	getKeys func() ([]kbfscrypto.TLFCryptKey, error)) (
+	kbfscrypto.TLFCryptKey, error) {
+	if tlfID.Type() == tlf.Public {
+		return kbfscrypto.PublicTLFCryptKey, nil
+	}
+	keys, err := getKeys()
+	if err != nil {
+		return kbfscrypto.TLFCryptKey{}, err
+	}
+	if len(keys) == 0 {
+		return kbfscrypto.TLFCryptKey{}, errors.Errorf(
+			"No crypt keys for TLF %s", tlfID)
+	}
+	return keys[0], nil
+}
+
+// deriveTLFLocalKey derives a key for a single purpose, named by
+// `purpose`, from a TLF crypt key, so that the keys used for
+// different kinds of local data are independent of each other.
+func deriveTLFLocalKey(
+	tlfKey kbfscrypto.TLFCryptKey, purpose string) [32]byte {
+	data := tlfKey.Data()
+	mac := hmac.New(sha256.New, data[:])
+	// Writes to a hash.Hash never fail.
+	_, _ = mac.Write([]byte(purpose))
+	var key [32]byte
+	copy(key[:], mac.Sum(nil))
+	return key
+}
+
+// getTLFLocalKey returns the key for the given purpose, derived from
+// the first crypt key of the TLF described by `kmd`.  The state kept
+// about a TLF under the storage root, like its disk usages, pinned
+// paths and conflict records, is encrypted with such a key, so that
+// it outlives the process but can only be read by someone who can
+// read the TLF itself.  Where that state depends on the TLF's
+// contents, it's recorded along with the block pointers it was
+// computed for: blocks are never modified in place, so it stays
+// valid for as long as those pointers do.
+func getTLFLocalKey(ctx context.Context, keyManager KeyManager,
+	kmd KeyMetadata, purpose string) ([32]byte, error) {
+	tlfKey, err := getFirstTLFCryptKey(kmd.TlfID(),
+		func() ([]kbfscrypto.TLFCryptKey, error) {
+			return keyManager.GetTLFCryptKeyOfAllGenerations(ctx, kmd)
+		})
+	if err != nil {
+		return [32]byte{}, err
+	}
+	return deriveTLFLocalKey(tlfKey, purpose), nil
+}
+
+// writeTLFLocalFile encodes `obj`, encrypts it with `key`, and
+// writes it to the file at `path`, replacing whatever was there.
+func writeTLFLocalFile(codec kbfscodec.Codec, key [32]byte,
+	path string, obj interface{}) error {
+	buf, err := codec.Encode(obj)
+	if err != nil {
+		return err
+	}
+	encrypted, err := MakeCryptoCommon(codec).encryptData(buf, key)
+	if err != nil {
+		return err
+	}
+	return kbfscodec.SerializeToFile(codec, encrypted, path)
+}
+
+// readTLFLocalFile decrypts the file at `path`, written by
+// writeTLFLocalFile, into `obj`.  It returns false if there's no
+// such file.
+func readTLFLocalFile(codec kbfscodec.Codec, key [32]byte,
+	path string, obj interface{}) (bool, error) {
+	var encrypted encryptedData
+	err := kbfscodec.DeserializeFromFile(codec, path, &encrypted)
+	if ioutil.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	buf, err := MakeCryptoCommon(codec).decryptData(encrypted, key)
+	if err != nil {
+		return false, err
+	}
+	err = codec.Decode(buf, obj)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -19,6 +19,7 @@ import (
 	"github.com/keybase/kbfs/kbfscrypto"
 	"github.com/keybase/kbfs/libkbfs"
 	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
 )
 
 const (
@@ -233,6 +234,11 @@ func (k *SimpleFS) SimpleFSCopy(ctx context.Context, arg keybase1.SimpleFSCopyAr
 func (k *SimpleFS) doCopy(ctx context.Context, srcPath, destPath keybase1.Path) error {
 	// Note this is also used by move, so if this changes update SimpleFSMove
 	// code also.
+	cloned, err := k.tryClone(ctx, srcPath, destPath, false)
+	if err != nil || cloned {
+		return err
+	}
+
 	src, err := k.pathIO(ctx, srcPath, keybase1.OpenFlags_READ|keybase1.OpenFlags_EXISTING, nil)
 	if err != nil {
 		return err
@@ -255,6 +261,55 @@ func (k *SimpleFS) doCopy(ctx context.Context, srcPath, destPath keybase1.Path)
 	return nil
 }
 
+// tryClone copies srcPath to destPath by cloning the blocks of the
+// source, rather than reading and re-uploading all of its data.  It
+// returns false if the copy can't be done that way (e.g., because the
+// paths aren't in the same KBFS folder), in which case the caller
+// should copy the data itself.
+func (k *SimpleFS) tryClone(ctx context.Context, srcPath, destPath keybase1.Path,
+	recursive bool) (bool, error) {
+	for _, path := range []keybase1.Path{srcPath, destPath} {
+		pt, err := path.PathType()
+		if err != nil {
+			return false, err
+		}
+		if pt != keybase1.PathType_KBFS {
+			return false, nil
+		}
+	}
+
+	src, ei, err := k.getRemoteNode(ctx, srcPath)
+	if err != nil {
+		return false, err
+	}
+	dir, name, err := k.getRemoteNodeParent(ctx, destPath)
+	if err != nil {
+		return false, err
+	}
+	if name == "" {
+		return false, nil
+	}
+
+	switch {
+	case ei.Type == libkbfs.File || ei.Type == libkbfs.Exec:
+		_, _, err = k.config.KBFSOps().CopyFile(ctx, src, dir, name)
+	case ei.Type == libkbfs.Dir && recursive:
+		_, _, err = k.config.KBFSOps().CopyDir(ctx, src, dir, name)
+	default:
+		return false, nil
+	}
+	switch errors.Cause(err).(type) {
+	case nil:
+		return true, nil
+	case libkbfs.CopyAcrossFoldersError, libkbfs.NameExistsError:
+		// A regular copy can cross folders and replace existing
+		// entries.
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
 func copyWithCancellation(ctx context.Context, dst io.Writer, src io.Reader) error {
 	for {
 		select {
@@ -282,6 +337,10 @@ func (k *SimpleFS) SimpleFSCopyRecursive(ctx context.Context,
 	return k.startAsync(ctx, arg.OpID, keybase1.NewOpDescriptionWithCopy(
 		keybase1.CopyArgs{OpID: arg.OpID, Src: arg.Src, Dest: arg.Dest}),
 		func(ctx context.Context) (err error) {
+			cloned, err := k.tryClone(ctx, arg.Src, arg.Dest, true)
+			if err != nil || cloned {
+				return err
+			}
 
 			var paths = []pathPair{{src: arg.Src, dest: arg.Dest}}
 			for len(paths) > 0 {
@@ -388,7 +447,8 @@ func (k *SimpleFS) SimpleFSRename(ctx context.Context, arg keybase1.SimpleFSRena
 	if err != nil {
 		return err
 	}
-	err = k.config.KBFSOps().Rename(ctx, snode, sleaf, dnode, dleaf)
+	err = k.config.KBFSOps().Rename(
+		ctx, snode, sleaf, dnode, dleaf, libkbfs.RenameReplace)
 	return err
 }
 
@@ -565,6 +625,120 @@ func (k *SimpleFS) SimpleFSStat(ctx context.Context, path keybase1.Path) (_ keyb
 	return wrapStat(ei, err)
 }
 
+// SimpleFSSearch - Find the entries under a path whose names (and
+// contents, if the search index includes them) contain all the words
+// in the query, using the local search index.  The Name of each
+// result is its path relative to the TLF root.  If maxResults is
+// greater than 0, at most that many results are returned.
+//
+// TODO: add this to the SimpleFS protocol.
+func (k *SimpleFS) SimpleFSSearch(ctx context.Context, path keybase1.Path,
+	query string, maxResults int) (_ []keybase1.Dirent, err error) {
+	ctx, err = k.startSyncOp(ctx, "Search", path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { k.doneSyncOp(ctx, err) }()
+
+	index := k.config.SearchIndex()
+	if index == nil {
+		return nil, errSearchIndexDisabled
+	}
+	ps, t, err := remotePath(path)
+	if err != nil {
+		return nil, err
+	}
+	h, err := libkbfs.ParseTlfHandlePreferred(
+		ctx, k.config.KBPKI(), ps[0], t)
+	if err != nil {
+		return nil, err
+	}
+	results, err := index.Search(
+		ctx, h, strings.Join(ps[1:], "/"), query, maxResults)
+	if err != nil {
+		return nil, err
+	}
+	des := make([]keybase1.Dirent, 0, len(results))
+	for _, result := range results {
+		ei := libkbfs.EntryInfo{
+			Type:  result.Type,
+			Size:  result.Size,
+			Mtime: result.Mtime,
+		}
+		var de keybase1.Dirent
+		setStat(&de, &ei)
+		de.Name = result.Path
+		des = append(des, de)
+	}
+	return des, nil
+}
+
+// SimpleFSPin - Keep everything under a path available offline, by
+// fetching it into the disk block cache and protecting it from
+// eviction, including any later changes to it.
+//
+// TODO: add this to the SimpleFS protocol.
+func (k *SimpleFS) SimpleFSPin(
+	ctx context.Context, path keybase1.Path) (err error) {
+	ctx, err = k.startSyncOp(ctx, "Pin", path)
+	if err != nil {
+		return err
+	}
+	defer func() { k.doneSyncOp(ctx, err) }()
+
+	node, _, ps, err := k.getRemoteRootNode(ctx, path)
+	if err != nil {
+		return err
+	}
+	return k.config.KBFSOps().PinPath(
+		ctx, node.GetFolderBranch(), strings.Join(ps, "/"))
+}
+
+// SimpleFSUnpin - Stop keeping a path pinned with SimpleFSPin
+// available offline.
+//
+// TODO: add this to the SimpleFS protocol.
+func (k *SimpleFS) SimpleFSUnpin(
+	ctx context.Context, path keybase1.Path) (err error) {
+	ctx, err = k.startSyncOp(ctx, "Unpin", path)
+	if err != nil {
+		return err
+	}
+	defer func() { k.doneSyncOp(ctx, err) }()
+
+	node, _, ps, err := k.getRemoteRootNode(ctx, path)
+	if err != nil {
+		return err
+	}
+	return k.config.KBFSOps().UnpinPath(
+		ctx, node.GetFolderBranch(), strings.Join(ps, "/"))
+}
+
+// SimpleFSPinStatus - Get how much of each pinned path in the TLF
+// of the given path is available offline.
+//
+// TODO: add this to the SimpleFS protocol.
+func (k *SimpleFS) SimpleFSPinStatus(
+	ctx context.Context, path keybase1.Path) (
+	_ []libkbfs.PinStatus, err error) {
+	ctx, err = k.startSyncOp(ctx, "PinStatus", path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { k.doneSyncOp(ctx, err) }()
+
+	node, _, _, err := k.getRemoteRootNode(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	status, _, err := k.config.KBFSOps().FolderStatus(
+		ctx, node.GetFolderBranch())
+	if err != nil {
+		return nil, err
+	}
+	return status.Pins, nil
+}
+
 // SimpleFSMakeOpid - Convenience helper for generating new random value
 func (k *SimpleFS) SimpleFSMakeOpid(_ context.Context) (keybase1.OpID, error) {
 	var opid keybase1.OpID
@@ -1022,6 +1196,7 @@ var errOnlyRemotePathSupported = simpleFSError{"Only remote paths are supported
 var errInvalidRemotePath = simpleFSError{"Invalid remote path"}
 var errNoSuchHandle = simpleFSError{"No such handle"}
 var errNoResult = simpleFSError{"Async result not found"}
+var errSearchIndexDisabled = simpleFSError{"The search index is not enabled"}
 
 // simpleFSError wraps errors for SimpleFS
 type simpleFSError struct {
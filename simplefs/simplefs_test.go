@@ -246,6 +246,72 @@ func TestCopyToRemote(t *testing.T) {
 		string(readRemoteFile(ctx, t, sfs, pathAppend(path2, "test1.txt"))))
 }
 
+func TestCopyRemoteToRemote(t *testing.T) {
+	ctx := context.Background()
+	sfs := newSimpleFS(libkbfs.MakeTestConfigOrBust(t, "jdoe"))
+	defer closeSimpleFS(ctx, t, sfs)
+
+	path1 := keybase1.NewPathWithKbfs(`/private/jdoe`)
+	dirPath := pathAppend(path1, "a")
+	opid, err := sfs.SimpleFSMakeOpid(ctx)
+	require.NoError(t, err)
+	err = sfs.SimpleFSOpen(ctx, keybase1.SimpleFSOpenArg{
+		OpID:  opid,
+		Dest:  dirPath,
+		Flags: keybase1.OpenFlags_DIRECTORY,
+	})
+	require.NoError(t, err)
+	err = sfs.SimpleFSClose(ctx, opid)
+	require.NoError(t, err)
+	writeRemoteFile(ctx, t, sfs, pathAppend(dirPath, "test1.txt"), []byte("foo"))
+	writeRemoteFile(ctx, t, sfs, pathAppend(dirPath, "test2.txt"), []byte("bar"))
+
+	t.Log("Copy a single file within the folder.")
+	opid, err = sfs.SimpleFSMakeOpid(ctx)
+	require.NoError(t, err)
+	srcPath := pathAppend(dirPath, "test1.txt")
+	destPath := pathAppend(path1, "test1.txt")
+	err = sfs.SimpleFSCopy(ctx, keybase1.SimpleFSCopyArg{
+		OpID: opid,
+		Src:  srcPath,
+		Dest: destPath,
+	})
+	require.NoError(t, err)
+	err = sfs.SimpleFSWait(ctx, opid)
+	require.NoError(t, err)
+	require.Equal(t, `foo`, string(readRemoteFile(ctx, t, sfs, destPath)))
+
+	t.Log("Copying over an existing file replaces its contents.")
+	opid, err = sfs.SimpleFSMakeOpid(ctx)
+	require.NoError(t, err)
+	err = sfs.SimpleFSCopy(ctx, keybase1.SimpleFSCopyArg{
+		OpID: opid,
+		Src:  pathAppend(dirPath, "test2.txt"),
+		Dest: destPath,
+	})
+	require.NoError(t, err)
+	err = sfs.SimpleFSWait(ctx, opid)
+	require.NoError(t, err)
+	require.Equal(t, `bar`, string(readRemoteFile(ctx, t, sfs, destPath)))
+
+	t.Log("Copy the whole directory within the folder.")
+	opid, err = sfs.SimpleFSMakeOpid(ctx)
+	require.NoError(t, err)
+	destPath = pathAppend(path1, "b")
+	err = sfs.SimpleFSCopyRecursive(ctx, keybase1.SimpleFSCopyRecursiveArg{
+		OpID: opid,
+		Src:  dirPath,
+		Dest: destPath,
+	})
+	require.NoError(t, err)
+	err = sfs.SimpleFSWait(ctx, opid)
+	require.NoError(t, err)
+	require.Equal(t, `foo`,
+		string(readRemoteFile(ctx, t, sfs, pathAppend(destPath, "test1.txt"))))
+	require.Equal(t, `bar`,
+		string(readRemoteFile(ctx, t, sfs, pathAppend(destPath, "test2.txt"))))
+}
+
 func writeRemoteFile(ctx context.Context, t *testing.T, sfs *SimpleFS, path keybase1.Path, data []byte) {
 	opid, err := sfs.SimpleFSMakeOpid(ctx)
 	require.NoError(t, err)